@@ -0,0 +1,113 @@
+package control
+
+// AdminExportQoSMessage asks core to change the io limits of an export on a middleware at runtime (request) and carries
+// the outcome (response). Reset restores the configured limits of the middleware.
+type AdminExportQoSMessage struct {
+	BaseControlMessage
+	Middleware string    `json:"middleware,omitempty"` // UUID
+	Name       string    `json:"name,omitempty"`
+	Limits     QoSLimits `json:"limits"`
+	Reset      bool      `json:"reset,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func NewAdminExportQoSRequest(requestID uint64, middleware string, name string, limits QoSLimits, reset bool) *AdminExportQoSMessage {
+	return &AdminExportQoSMessage{
+		BaseControlMessage: NewBaseControlMessage(CMAdminExportQoS, requestID),
+		Middleware:         middleware,
+		Name:               name,
+		Limits:             limits,
+		Reset:              reset,
+	}
+}
+
+func NewAdminExportQoSResponse(requestID uint64, errorMessage string) *AdminExportQoSMessage {
+	return &AdminExportQoSMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMAdminExportQoS, requestID),
+		Error:              errorMessage,
+	}
+}
+
+// AdminClientDisconnectMessage asks core to close the connection of a client on a middleware (request) and carries the
+// outcome (response)
+type AdminClientDisconnectMessage struct {
+	BaseControlMessage
+	Middleware string `json:"middleware,omitempty"` // UUID
+	ClientID   uint64 `json:"client_id,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func NewAdminClientDisconnectRequest(requestID uint64, middleware string, clientID uint64, reason string) *AdminClientDisconnectMessage {
+	return &AdminClientDisconnectMessage{
+		BaseControlMessage: NewBaseControlMessage(CMAdminClientDisconnect, requestID),
+		Middleware:         middleware,
+		ClientID:           clientID,
+		Reason:             reason,
+	}
+}
+
+func NewAdminClientDisconnectResponse(requestID uint64, errorMessage string) *AdminClientDisconnectMessage {
+	return &AdminClientDisconnectMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMAdminClientDisconnect, requestID),
+		Error:              errorMessage,
+	}
+}
+
+// AdminExportDetachMessage asks core to withdraw an export from a middleware, which disconnects all of its clients
+// (request), and carries the outcome (response)
+type AdminExportDetachMessage struct {
+	BaseControlMessage
+	Middleware string `json:"middleware,omitempty"` // UUID
+	Name       string `json:"name,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func NewAdminExportDetachRequest(requestID uint64, middleware string, name string) *AdminExportDetachMessage {
+	return &AdminExportDetachMessage{
+		BaseControlMessage: NewBaseControlMessage(CMAdminExportDetach, requestID),
+		Middleware:         middleware,
+		Name:               name,
+	}
+}
+
+func NewAdminExportDetachResponse(requestID uint64, errorMessage string) *AdminExportDetachMessage {
+	return &AdminExportDetachMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMAdminExportDetach, requestID),
+		Error:              errorMessage,
+	}
+}
+
+// VolumeLocation tells which middleware on which host serves an export of a volume
+type VolumeLocation struct {
+	Middleware     string       `json:"middleware"` // UUID
+	Implementation string       `json:"implementation"`
+	Hostname       string       `json:"hostname"`
+	Connected      bool         `json:"connected"`
+	Export         ExportInfo   `json:"export"`
+	Clients        []ClientInfo `json:"clients,omitempty"`
+}
+
+// AdminVolumeLocateMessage asks core which hosts have a volume open via which middleware (request) and carries the
+// locations (response)
+type AdminVolumeLocateMessage struct {
+	BaseControlMessage
+	VolumeID  string           `json:"volume_id,omitempty"`
+	Locations []VolumeLocation `json:"locations,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+func NewAdminVolumeLocateRequest(requestID uint64, volumeID string) *AdminVolumeLocateMessage {
+	return &AdminVolumeLocateMessage{
+		BaseControlMessage: NewBaseControlMessage(CMAdminVolumeLocate, requestID),
+		VolumeID:           volumeID,
+	}
+}
+
+func NewAdminVolumeLocateResponse(requestID uint64, locations []VolumeLocation, errorMessage string) *AdminVolumeLocateMessage {
+	return &AdminVolumeLocateMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMAdminVolumeLocate, requestID),
+		Locations:          locations,
+		Error:              errorMessage,
+	}
+}
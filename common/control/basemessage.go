@@ -3,10 +3,24 @@ package control
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
 	CMDummy = iota
+	CMExportAttach
+	CMExportDetach
+	CMMiddlewareRegister
+	CMMiddlewareHeartbeat
+	CMVolumeList
+	CMCacheInvalidate
+	CMExportQoS
+	CMClientReport
+	CMClientDisconnect
+	CMAdminExportQoS
+	CMAdminClientDisconnect
+	CMAdminExportDetach
+	CMAdminVolumeLocate
 )
 
 type ControlMessage interface {
@@ -18,15 +32,81 @@ type ControlMessage interface {
 }
 
 type BaseControlMessage struct {
-	Type        uint32 `json:"type"`
-	RequestID   uint64 `json:"request_id"`
-	IsResponse  bool   `json:"is_response"`
-	GeneratedAt uint64 `json:"generated_at"`
-	GeneratedBy uint32 `json:"generated_by"`
+	MessageType      uint32 `json:"type"`
+	MessageRequestID uint64 `json:"request_id"`
+	IsResponse       bool   `json:"is_response"`
+	CreatedAt        uint64 `json:"generated_at"`
+	CreatedBy        uint32 `json:"generated_by"`
+}
+
+func NewBaseControlMessage(messageType uint32, requestID uint64) BaseControlMessage {
+	return BaseControlMessage{
+		MessageType:      messageType,
+		MessageRequestID: requestID,
+		CreatedAt:        uint64(time.Now().UnixMilli()),
+	}
+}
+
+// NewBaseResponseMessage returns the base of a response to the request with the given id
+func NewBaseResponseMessage(messageType uint32, requestID uint64) BaseControlMessage {
+	base := NewBaseControlMessage(messageType, requestID)
+	base.IsResponse = true
+	return base
+}
+
+// IsResponse returns true, if the message answers a request of the peer
+func IsResponse(msg ControlMessage) bool {
+	return msg.isResponse()
+}
+
+func (msg *BaseControlMessage) Type() uint32 {
+	return msg.MessageType
+}
+
+func (msg *BaseControlMessage) RequestID() uint64 {
+	return msg.MessageRequestID
+}
+
+func (msg *BaseControlMessage) isResponse() bool {
+	return msg.IsResponse
+}
+
+func (msg *BaseControlMessage) GeneratedAt() uint64 {
+	return msg.CreatedAt
+}
+
+func (msg *BaseControlMessage) GeneratedBy() uint32 {
+	return msg.CreatedBy
 }
 
 func NewMessage(messageType uint32) (ControlMessage, error) {
 	switch messageType {
+	case CMExportAttach:
+		return &ExportAttachMessage{}, nil
+	case CMExportDetach:
+		return &ExportDetachMessage{}, nil
+	case CMMiddlewareRegister:
+		return &MiddlewareRegisterMessage{}, nil
+	case CMMiddlewareHeartbeat:
+		return &MiddlewareHeartbeatMessage{}, nil
+	case CMVolumeList:
+		return &VolumeListMessage{}, nil
+	case CMCacheInvalidate:
+		return &CacheInvalidateMessage{}, nil
+	case CMExportQoS:
+		return &ExportQoSMessage{}, nil
+	case CMClientReport:
+		return &ClientReportMessage{}, nil
+	case CMClientDisconnect:
+		return &ClientDisconnectMessage{}, nil
+	case CMAdminExportQoS:
+		return &AdminExportQoSMessage{}, nil
+	case CMAdminClientDisconnect:
+		return &AdminClientDisconnectMessage{}, nil
+	case CMAdminExportDetach:
+		return &AdminExportDetachMessage{}, nil
+	case CMAdminVolumeLocate:
+		return &AdminVolumeLocateMessage{}, nil
 	default:
 		return nil, fmt.Errorf("unknown type %d", messageType)
 	}
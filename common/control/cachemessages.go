@@ -0,0 +1,31 @@
+package control
+
+// ByteRange is a range of a volume in bytes
+type ByteRange struct {
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+}
+
+// CacheInvalidateMessage is sent by core when blocks of a volume changed outside of the middleware (e.g. another writer or a resync).
+// The middleware drops the ranges from its read cache; without ranges the whole volume is dropped. It acknowledges the
+// invalidation with a response once the ranges are dropped, also without cache.
+type CacheInvalidateMessage struct {
+	BaseControlMessage
+	VolumeID string      `json:"volume_id"`
+	Ranges   []ByteRange `json:"ranges,omitempty"`
+}
+
+func NewCacheInvalidateMessage(requestID uint64, volumeID string, ranges []ByteRange) *CacheInvalidateMessage {
+	return &CacheInvalidateMessage{
+		BaseControlMessage: NewBaseControlMessage(CMCacheInvalidate, requestID),
+		VolumeID:           volumeID,
+		Ranges:             ranges,
+	}
+}
+
+func NewCacheInvalidateResponse(requestID uint64, volumeID string) *CacheInvalidateMessage {
+	return &CacheInvalidateMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMCacheInvalidate, requestID),
+		VolumeID:           volumeID,
+	}
+}
@@ -0,0 +1,50 @@
+package control
+
+// PeerCredentials are the credentials of a client on a unix socket
+type PeerCredentials struct {
+	PID  int32    `json:"pid"`
+	UID  uint32   `json:"uid"`
+	GIDs []uint32 `json:"gids,omitempty"`
+}
+
+// ClientInfo describes a client connected to an export of a middleware
+type ClientInfo struct {
+	ID           uint64           `json:"id"` // Unique per middleware instance
+	Export       string           `json:"export"`
+	RemoteAddr   string           `json:"remote_addr"`
+	Credentials  *PeerCredentials `json:"credentials,omitempty"`
+	TLSIdentity  string           `json:"tls_identity,omitempty"`
+	ConnectedAt  uint64           `json:"connected_at"` // Milliseconds since 1970
+	Flags        uint32           `json:"flags"`        // Negotiated flags of the protocol (e.g. NBD transmission flags)
+	Features     []string         `json:"features,omitempty"`
+	BytesRead    uint64           `json:"bytes_read"`
+	BytesWritten uint64           `json:"bytes_written"`
+}
+
+// ClientReportMessage is sent by a middleware with all of its connected clients, whenever they change and periodically
+type ClientReportMessage struct {
+	BaseControlMessage
+	Clients []ClientInfo `json:"clients"`
+}
+
+// ClientDisconnectMessage is sent by core to close the connection of a client (e.g. to revoke the access of a host)
+type ClientDisconnectMessage struct {
+	BaseControlMessage
+	ClientID uint64 `json:"client_id"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func NewClientReportMessage(requestID uint64, clients []ClientInfo) *ClientReportMessage {
+	return &ClientReportMessage{
+		BaseControlMessage: NewBaseControlMessage(CMClientReport, requestID),
+		Clients:            clients,
+	}
+}
+
+func NewClientDisconnectMessage(requestID uint64, clientID uint64, reason string) *ClientDisconnectMessage {
+	return &ClientDisconnectMessage{
+		BaseControlMessage: NewBaseControlMessage(CMClientDisconnect, requestID),
+		ClientID:           clientID,
+		Reason:             reason,
+	}
+}
@@ -0,0 +1,63 @@
+package control
+
+// ExportInfo describes a volume that core exports through a middleware
+type ExportInfo struct {
+	Name      string `json:"name"`
+	VolumeID  string `json:"volume_id"`
+	Size      uint64 `json:"size"`
+	BlockSize uint32 `json:"block_size"`
+	ReadOnly  bool   `json:"read_only"`
+	Epoch     uint64 `json:"epoch,omitempty"` // Fencing epoch of the data path, assigned by core with every attachment of the volume to the middleware
+}
+
+// ExportAttachMessage is sent by core to make an export available on a middleware
+type ExportAttachMessage struct {
+	BaseControlMessage
+	Export ExportInfo `json:"export"`
+}
+
+// ExportDetachMessage is sent by core to withdraw an export from a middleware
+type ExportDetachMessage struct {
+	BaseControlMessage
+	Name string `json:"name"`
+}
+
+// QoSLimits are the io limits of an export. Zero rates are unlimited.
+type QoSLimits struct {
+	ReadIOPS            uint64 `json:"read_iops,omitempty"`
+	WriteIOPS           uint64 `json:"write_iops,omitempty"`
+	ReadBytesPerSecond  uint64 `json:"read_bytes_per_second,omitempty"`
+	WriteBytesPerSecond uint64 `json:"write_bytes_per_second,omitempty"`
+	BurstSeconds        uint32 `json:"burst_seconds,omitempty"`
+}
+
+// ExportQoSMessage is sent by core to change the io limits of an export at runtime.
+// The limits stay in effect across reattaches until a message with Reset restores the configured limits.
+type ExportQoSMessage struct {
+	BaseControlMessage
+	Name   string    `json:"name"`
+	Limits QoSLimits `json:"limits"`
+	Reset  bool      `json:"reset,omitempty"`
+}
+
+func NewExportAttachMessage(requestID uint64, export ExportInfo) *ExportAttachMessage {
+	return &ExportAttachMessage{
+		BaseControlMessage: NewBaseControlMessage(CMExportAttach, requestID),
+		Export:             export,
+	}
+}
+
+func NewExportDetachMessage(requestID uint64, name string) *ExportDetachMessage {
+	return &ExportDetachMessage{
+		BaseControlMessage: NewBaseControlMessage(CMExportDetach, requestID),
+		Name:               name,
+	}
+}
+
+func NewExportQoSMessage(requestID uint64, name string, limits QoSLimits) *ExportQoSMessage {
+	return &ExportQoSMessage{
+		BaseControlMessage: NewBaseControlMessage(CMExportQoS, requestID),
+		Name:               name,
+		Limits:             limits,
+	}
+}
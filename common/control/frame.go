@@ -0,0 +1,73 @@
+package control
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	commonio "quorumbd.net/common/io"
+)
+
+const (
+	MaxFrameSize = 1 << 20 // 1MB
+)
+
+// Preamble is sent by a middleware right after connecting, followed by the 16 bytes of its UUID
+var Preamble = [4]byte{'C', 'T', 'R', 'L'}
+
+// AdminPreamble is sent by an admin tool right after connecting to a unix socket of core, followed by 16 bytes of
+// uuid.Nil. The admin messages are framed like the control messages.
+var AdminPreamble = [4]byte{'A', 'D', 'M', 'N'}
+
+// WriteMessage writes a control message as length prefixed (uint32, big endian) JSON frame
+func WriteMessage(w io.Writer, msg ControlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+
+	if err := commonio.WriteFull(w, header[:]); err != nil {
+		return err
+	}
+	return commonio.WriteFull(w, data)
+}
+
+// ReadMessage reads a frame written by WriteMessage and decodes it into the message type given in the frame
+func ReadMessage(r io.Reader) (ControlMessage, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d > %d", length, MaxFrameSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	var head struct {
+		Type uint32 `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+
+	msg, err := NewMessage(head.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
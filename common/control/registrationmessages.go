@@ -0,0 +1,35 @@
+package control
+
+// MiddlewareInfo describes a middleware instance for the inventory of core
+type MiddlewareInfo struct {
+	UUID            string       `json:"uuid"`
+	Implementation  string       `json:"implementation"`
+	Hostname        string       `json:"hostname"`
+	Version         string       `json:"version"`
+	ListenAddresses []string     `json:"listen_addresses"`
+	Exports         []ExportInfo `json:"exports"`
+}
+
+// MiddlewareRegisterMessage is sent by a middleware after connecting and whenever its info changes
+type MiddlewareRegisterMessage struct {
+	BaseControlMessage
+	Middleware MiddlewareInfo `json:"middleware"`
+}
+
+// MiddlewareHeartbeatMessage is sent periodically by a middleware to keep its inventory entry alive
+type MiddlewareHeartbeatMessage struct {
+	BaseControlMessage
+}
+
+func NewMiddlewareRegisterMessage(requestID uint64, middleware MiddlewareInfo) *MiddlewareRegisterMessage {
+	return &MiddlewareRegisterMessage{
+		BaseControlMessage: NewBaseControlMessage(CMMiddlewareRegister, requestID),
+		Middleware:         middleware,
+	}
+}
+
+func NewMiddlewareHeartbeatMessage(requestID uint64) *MiddlewareHeartbeatMessage {
+	return &MiddlewareHeartbeatMessage{
+		BaseControlMessage: NewBaseControlMessage(CMMiddlewareHeartbeat, requestID),
+	}
+}
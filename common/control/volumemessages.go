@@ -0,0 +1,34 @@
+package control
+
+// VolumeInfo describes a volume of the catalogue of core
+type VolumeInfo struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Size      uint64            `json:"size"`
+	BlockSize uint32            `json:"block_size"`
+	ReadOnly  bool              `json:"read_only"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// VolumeListMessage asks core for the volumes visible to the middleware (request) and carries them (response).
+// A non-empty name restricts the request to the volume of that name.
+type VolumeListMessage struct {
+	BaseControlMessage
+	Name    string       `json:"name,omitempty"`
+	Volumes []VolumeInfo `json:"volumes,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+func NewVolumeListRequest(requestID uint64, name string) *VolumeListMessage {
+	return &VolumeListMessage{
+		BaseControlMessage: NewBaseControlMessage(CMVolumeList, requestID),
+		Name:               name,
+	}
+}
+
+func NewVolumeListResponse(requestID uint64, volumes []VolumeInfo) *VolumeListMessage {
+	return &VolumeListMessage{
+		BaseControlMessage: NewBaseResponseMessage(CMVolumeList, requestID),
+		Volumes:            volumes,
+	}
+}
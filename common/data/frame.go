@@ -0,0 +1,413 @@
+// Package data provides the framing of the data path between the middlewares and core.
+//
+// A middleware opens a data connection per attached export. After the preamble it sends an OPEN request with the
+// volume ID as payload and the epoch of the export, all further requests carry the same epoch. Requests are pipelined:
+// every request has a tag that its reply repeats, and replies may arrive in any order. The checksum of a frame is the
+// CRC32C of its header (with a zero checksum field) and its payload.
+//
+// Epochs fence stale writers: core assigns a new epoch with every attachment of a volume to a middleware and only admits
+// the epoch of the current attachment. Once the volume is reattached or detached, requests of the previous epoch are
+// rejected with StatusStaleEpoch after the requests core already executes have completed.
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	commonio "quorumbd.net/common/io"
+)
+
+// Preamble is sent by a middleware right after connecting, followed by the 16 bytes of its UUID
+var Preamble = [4]byte{'D', 'A', 'T', 'A'}
+
+const (
+	requestMagic      uint32 = 0x51424452 // "QBDR"
+	replyMagic        uint32 = 0x51424441 // "QBDA"
+	RequestHeaderSize        = 40
+	ReplyHeaderSize          = 32
+	MaxPayloadSize           = 32 << 20 // Largest payload of a frame, larger reads and writes are split
+	MaxRangeLength           = 1 << 30  // Largest range of TRIM, WRITE_ZEROES and EXTENTS, larger ranges are split
+	maxVolumeIDLength        = 4096
+	maxBitmapName            = 255
+)
+
+type Opcode uint16
+
+const (
+	OpOpen        Opcode = 1 + iota // Payload: volume ID. Reply payload: size (uint64) and block size (uint32) of the volume
+	OpRead                          // Reply payload: Length bytes at Offset
+	OpWrite                         // Payload: the data at Offset
+	OpFlush                         // Makes all completed writes of the volume durable
+	OpTrim                          // Deallocates Length bytes at Offset (they read as zeroes)
+	OpWriteZeroes                   // Zeroes Length bytes at Offset, deallocating them unless FlagNoHole is set
+	OpExtents                       // Reply payload: the allocation of Length bytes at Offset (see ExtentsPayload)
+	OpBitmaps                       // Reply payload: the names of the change tracking bitmaps of the volume (see BitmapsPayload)
+	OpDirtyMap                      // Payload: bitmap and length of the range at Offset (see DirtyMapPayload). Reply payload: its extents.
+)
+
+func (op Opcode) String() string {
+	switch op {
+	case OpOpen:
+		return "OPEN"
+	case OpRead:
+		return "READ"
+	case OpWrite:
+		return "WRITE"
+	case OpFlush:
+		return "FLUSH"
+	case OpTrim:
+		return "TRIM"
+	case OpWriteZeroes:
+		return "WRITE_ZEROES"
+	case OpExtents:
+		return "EXTENTS"
+	case OpBitmaps:
+		return "BITMAPS"
+	case OpDirtyMap:
+		return "DIRTY_MAP"
+	}
+	return fmt.Sprintf("opcode(%d)", uint16(op))
+}
+
+// hasPayload returns true, if the Length of a request is the length of its payload instead of a range
+func (op Opcode) hasPayload() bool {
+	return op == OpOpen || op == OpWrite || op == OpDirtyMap
+}
+
+type Flags uint16
+
+const (
+	FlagFUA      Flags = 1 << iota // WRITE: the write is durable before it is acknowledged
+	FlagNoHole                     // WRITE_ZEROES: the range stays allocated
+	FlagFastZero                   // WRITE_ZEROES: fail with StatusNotSupported instead of writing zeroes
+	FlagReadOnly                   // OPEN: the connection does not change the volume
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+type Status uint16
+
+const (
+	StatusOK Status = iota
+	StatusIO
+	StatusNoSpace
+	StatusReadOnly
+	StatusInvalid
+	StatusNotSupported
+	StatusOutOfRange
+	StatusStaleEpoch    // The epoch of the request is not the one of the current attachment, the connection is fenced
+	StatusChecksum      // The checksum of the request did not match, the request was not executed
+	StatusUnknownVolume // OPEN: the volume does not exist or is not visible to the middleware
+	StatusNotOpen       // The first request of a connection must be OPEN
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusIO:
+		return "io error"
+	case StatusNoSpace:
+		return "no space left"
+	case StatusReadOnly:
+		return "read-only"
+	case StatusInvalid:
+		return "invalid request"
+	case StatusNotSupported:
+		return "not supported"
+	case StatusOutOfRange:
+		return "out of range"
+	case StatusStaleEpoch:
+		return "stale epoch"
+	case StatusChecksum:
+		return "checksum mismatch"
+	case StatusUnknownVolume:
+		return "unknown volume"
+	case StatusNotOpen:
+		return "not open"
+	}
+	return fmt.Sprintf("status(%d)", uint16(s))
+}
+
+// ErrChecksum is returned with a complete frame whose checksum does not match. The connection stays usable.
+var ErrChecksum = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Request is a request of a middleware
+type Request struct {
+	Opcode  Opcode
+	Flags   Flags
+	Tag     uint64
+	Epoch   uint64
+	Offset  uint64
+	Length  uint32 // Length of the payload of OPEN, WRITE and DIRTY_MAP, of the range otherwise
+	Payload []byte
+}
+
+// Reply is the reply of core to the request with the same tag
+type Reply struct {
+	Status  Status
+	Tag     uint64
+	Epoch   uint64 // Epoch of the current attachment of the volume to the middleware (0: not attached)
+	Payload []byte
+}
+
+// WriteRequest writes a request (Length is set from the payload for requests with payload)
+func WriteRequest(w io.Writer, req *Request) error {
+	if req.Opcode.hasPayload() {
+		if len(req.Payload) > MaxPayloadSize {
+			return fmt.Errorf("payload too large: %d > %d", len(req.Payload), MaxPayloadSize)
+		}
+		req.Length = uint32(len(req.Payload))
+	} else if len(req.Payload) > 0 {
+		return fmt.Errorf("%s requests have no payload", req.Opcode)
+	}
+
+	var header [RequestHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], requestMagic)
+	binary.BigEndian.PutUint16(header[4:6], uint16(req.Opcode))
+	binary.BigEndian.PutUint16(header[6:8], uint16(req.Flags))
+	binary.BigEndian.PutUint64(header[8:16], req.Tag)
+	binary.BigEndian.PutUint64(header[16:24], req.Epoch)
+	binary.BigEndian.PutUint64(header[24:32], req.Offset)
+	binary.BigEndian.PutUint32(header[32:36], req.Length)
+	binary.BigEndian.PutUint32(header[36:40], checksum(header[:], req.Payload))
+
+	if err := commonio.WriteFull(w, header[:]); err != nil {
+		return err
+	}
+	return commonio.WriteFull(w, req.Payload)
+}
+
+// ReadRequest reads a request written by WriteRequest. With ErrChecksum the request is returned as well, so that it can be
+// rejected by its tag.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var header [RequestHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if magic := binary.BigEndian.Uint32(header[0:4]); magic != requestMagic {
+		return nil, fmt.Errorf("invalid request magic 0x%08x", magic)
+	}
+
+	req := &Request{
+		Opcode: Opcode(binary.BigEndian.Uint16(header[4:6])),
+		Flags:  Flags(binary.BigEndian.Uint16(header[6:8])),
+		Tag:    binary.BigEndian.Uint64(header[8:16]),
+		Epoch:  binary.BigEndian.Uint64(header[16:24]),
+		Offset: binary.BigEndian.Uint64(header[24:32]),
+		Length: binary.BigEndian.Uint32(header[32:36]),
+	}
+	if req.Opcode.hasPayload() {
+		if req.Length > MaxPayloadSize {
+			return nil, fmt.Errorf("payload too large: %d > %d", req.Length, MaxPayloadSize)
+		}
+		req.Payload = make([]byte, req.Length)
+		if _, err := io.ReadFull(r, req.Payload); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := binary.BigEndian.Uint32(header[36:40])
+	clear(header[36:40])
+	if checksum(header[:], req.Payload) != sum {
+		return req, ErrChecksum
+	}
+	return req, nil
+}
+
+// WriteReply writes a reply
+func WriteReply(w io.Writer, reply *Reply) error {
+	if len(reply.Payload) > MaxPayloadSize {
+		return fmt.Errorf("payload too large: %d > %d", len(reply.Payload), MaxPayloadSize)
+	}
+
+	var header [ReplyHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], replyMagic)
+	binary.BigEndian.PutUint16(header[4:6], uint16(reply.Status))
+	binary.BigEndian.PutUint64(header[8:16], reply.Tag)
+	binary.BigEndian.PutUint64(header[16:24], reply.Epoch)
+	binary.BigEndian.PutUint32(header[24:28], uint32(len(reply.Payload)))
+	binary.BigEndian.PutUint32(header[28:32], checksum(header[:], reply.Payload))
+
+	if err := commonio.WriteFull(w, header[:]); err != nil {
+		return err
+	}
+	return commonio.WriteFull(w, reply.Payload)
+}
+
+// ReadReply reads a reply written by WriteReply. With ErrChecksum the reply is returned as well, so that the request of
+// its tag can be failed or retried.
+func ReadReply(r io.Reader) (*Reply, error) {
+	var header [ReplyHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if magic := binary.BigEndian.Uint32(header[0:4]); magic != replyMagic {
+		return nil, fmt.Errorf("invalid reply magic 0x%08x", magic)
+	}
+
+	length := binary.BigEndian.Uint32(header[24:28])
+	if length > MaxPayloadSize {
+		return nil, fmt.Errorf("payload too large: %d > %d", length, MaxPayloadSize)
+	}
+	reply := &Reply{
+		Status: Status(binary.BigEndian.Uint16(header[4:6])),
+		Tag:    binary.BigEndian.Uint64(header[8:16]),
+		Epoch:  binary.BigEndian.Uint64(header[16:24]),
+	}
+	if length > 0 {
+		reply.Payload = make([]byte, length)
+		if _, err := io.ReadFull(r, reply.Payload); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := binary.BigEndian.Uint32(header[28:32])
+	clear(header[28:32])
+	if checksum(header[:], reply.Payload) != sum {
+		return reply, ErrChecksum
+	}
+	return reply, nil
+}
+
+// OpenPayload returns the payload of an OPEN request for the volume
+func OpenPayload(volumeID string) ([]byte, error) {
+	if volumeID == "" || len(volumeID) > maxVolumeIDLength {
+		return nil, fmt.Errorf("invalid volume id %q", volumeID)
+	}
+	return []byte(volumeID), nil
+}
+
+// VolumeIDOf returns the volume ID of an OPEN request
+func VolumeIDOf(req *Request) (string, error) {
+	if len(req.Payload) == 0 || len(req.Payload) > maxVolumeIDLength {
+		return "", fmt.Errorf("invalid volume id length %d", len(req.Payload))
+	}
+	return string(req.Payload), nil
+}
+
+// OpenReplyPayload returns the payload of the reply to OPEN
+func OpenReplyPayload(size uint64, blockSize uint32) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint64(payload[0:8], size)
+	binary.BigEndian.PutUint32(payload[8:12], blockSize)
+	return payload
+}
+
+// ParseOpenReply returns size and block size of the volume from the reply to OPEN
+func ParseOpenReply(reply *Reply) (uint64, uint32, error) {
+	if len(reply.Payload) != 12 {
+		return 0, 0, fmt.Errorf("invalid OPEN reply payload length %d", len(reply.Payload))
+	}
+	return binary.BigEndian.Uint64(reply.Payload[0:8]), binary.BigEndian.Uint32(reply.Payload[8:12]), nil
+}
+
+type ExtentFlags uint32
+
+const (
+	ExtentHole  ExtentFlags = 1 << iota // The range is not allocated
+	ExtentZero                          // The range reads as zeroes
+	ExtentDirty                         // The range changed since the bitmap was created (DIRTY_MAP only)
+)
+
+func (f ExtentFlags) Has(flag ExtentFlags) bool {
+	return f&flag != 0
+}
+
+const extentSize = 8
+
+// MaxExtents is the largest number of extents of a reply
+const MaxExtents = MaxPayloadSize / extentSize
+
+// Extent is a range of uniform allocation. The extents of a reply are adjacent and start at the Offset of the request,
+// they may cover less than the requested range (but at least one byte of it).
+type Extent struct {
+	Length uint32
+	Flags  ExtentFlags
+}
+
+// ExtentsPayload returns the payload of the reply to EXTENTS
+func ExtentsPayload(extents []Extent) []byte {
+	payload := make([]byte, 0, extentSize*len(extents))
+	for _, extent := range extents {
+		payload = binary.BigEndian.AppendUint32(payload, extent.Length)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(extent.Flags))
+	}
+	return payload
+}
+
+// ParseExtentsReply returns the extents of the reply to an EXTENTS request of the given length
+func ParseExtentsReply(reply *Reply, length uint32) ([]Extent, error) {
+	if len(reply.Payload) == 0 || len(reply.Payload)%extentSize != 0 {
+		return nil, fmt.Errorf("invalid EXTENTS reply payload length %d", len(reply.Payload))
+	}
+	extents := make([]Extent, 0, len(reply.Payload)/extentSize)
+	var covered uint64
+	for pos := 0; pos < len(reply.Payload); pos += extentSize {
+		extent := Extent{
+			Length: binary.BigEndian.Uint32(reply.Payload[pos:]),
+			Flags:  ExtentFlags(binary.BigEndian.Uint32(reply.Payload[pos+4:])),
+		}
+		covered += uint64(extent.Length)
+		if extent.Length == 0 || covered > uint64(length) {
+			return nil, fmt.Errorf("invalid extent of length %d in EXTENTS reply", extent.Length)
+		}
+		extents = append(extents, extent)
+	}
+	return extents, nil
+}
+
+// BitmapsPayload returns the payload of the reply to BITMAPS
+func BitmapsPayload(names []string) []byte {
+	var payload []byte
+	for _, name := range names {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(name)))
+		payload = append(payload, name...)
+	}
+	return payload
+}
+
+// ParseBitmapsReply returns the names of the bitmaps from the reply to BITMAPS
+func ParseBitmapsReply(reply *Reply) ([]string, error) {
+	var names []string
+	for rest := reply.Payload; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("BITMAPS reply truncated")
+		}
+		length := int(binary.BigEndian.Uint16(rest))
+		if length == 0 || length > maxBitmapName || len(rest) < 2+length {
+			return nil, fmt.Errorf("invalid bitmap name length %d in BITMAPS reply", length)
+		}
+		names = append(names, string(rest[2:2+length]))
+		rest = rest[2+length:]
+	}
+	return names, nil
+}
+
+// DirtyMapPayload returns the payload of a DIRTY_MAP request for the range of the given length of the bitmap
+func DirtyMapPayload(bitmap string, length uint32) ([]byte, error) {
+	if bitmap == "" || len(bitmap) > maxBitmapName {
+		return nil, fmt.Errorf("invalid bitmap name %q", bitmap)
+	}
+	payload := binary.BigEndian.AppendUint32(nil, length)
+	return append(payload, bitmap...), nil
+}
+
+// ParseDirtyMapRequest returns the bitmap and the length of the range of a DIRTY_MAP request
+func ParseDirtyMapRequest(req *Request) (string, uint32, error) {
+	if len(req.Payload) < 4+1 || len(req.Payload) > 4+maxBitmapName {
+		return "", 0, fmt.Errorf("invalid DIRTY_MAP payload length %d", len(req.Payload))
+	}
+	return string(req.Payload[4:]), binary.BigEndian.Uint32(req.Payload[0:4]), nil
+}
+
+func checksum(header []byte, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, payload)
+}
@@ -0,0 +1,256 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+	}{
+		{name: "open", req: Request{Opcode: OpOpen, Flags: FlagReadOnly, Tag: 1, Epoch: 7, Payload: []byte("vol-0")}},
+		{name: "read", req: Request{Opcode: OpRead, Tag: 2, Epoch: 7, Offset: 4096, Length: 512}},
+		{name: "write", req: Request{Opcode: OpWrite, Flags: FlagFUA, Tag: 3, Epoch: 7, Offset: 1 << 40, Payload: bytes.Repeat([]byte{0xa5}, 4096)}},
+		{name: "flush", req: Request{Opcode: OpFlush, Tag: 4, Epoch: 7}},
+		{name: "trim", req: Request{Opcode: OpTrim, Tag: 5, Epoch: 7, Offset: 8192, Length: MaxRangeLength}},
+		{name: "write zeroes", req: Request{Opcode: OpWriteZeroes, Flags: FlagNoHole | FlagFastZero, Tag: 6, Epoch: 7, Length: 65536}},
+		{name: "extents", req: Request{Opcode: OpExtents, Tag: 7, Epoch: 7, Offset: 1 << 30, Length: MaxRangeLength}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			req := test.req
+			if err := WriteRequest(&buf, &req); err != nil {
+				t.Fatal(err)
+			}
+			if want := RequestHeaderSize + len(req.Payload); buf.Len() != want {
+				t.Fatalf("frame of %d bytes, want %d", buf.Len(), want)
+			}
+			got, err := ReadRequest(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, req) {
+				t.Fatalf("read %+v, wrote %+v", *got, req)
+			}
+		})
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply Reply
+	}{
+		{name: "open", reply: Reply{Status: StatusOK, Tag: 1, Epoch: 7, Payload: OpenReplyPayload(1<<30, 4096)}},
+		{name: "read", reply: Reply{Status: StatusOK, Tag: 2, Epoch: 7, Payload: bytes.Repeat([]byte{0x5a}, 512)}},
+		{name: "extents", reply: Reply{Status: StatusOK, Tag: 3, Epoch: 7, Payload: ExtentsPayload([]Extent{{Length: 4096, Flags: ExtentHole | ExtentZero}})}},
+		{name: "stale epoch", reply: Reply{Status: StatusStaleEpoch, Tag: 4, Epoch: 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteReply(&buf, &test.reply); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadReply(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, test.reply) {
+				t.Fatalf("read %+v, wrote %+v", *got, test.reply)
+			}
+		})
+	}
+}
+
+func TestChecksumCorruption(t *testing.T) {
+	var request bytes.Buffer
+	if err := WriteRequest(&request, &Request{Opcode: OpWrite, Tag: 9, Epoch: 1, Offset: 512, Payload: []byte("payload")}); err != nil {
+		t.Fatal(err)
+	}
+	var reply bytes.Buffer
+	if err := WriteReply(&reply, &Reply{Status: StatusOK, Tag: 9, Epoch: 1, Payload: []byte("payload")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		offset int // Byte to corrupt
+		read   func([]byte) (uint64, error)
+	}{
+		{name: "request flags", frame: request.Bytes(), offset: 7, read: readRequestTag},
+		{name: "request offset", frame: request.Bytes(), offset: 30, read: readRequestTag},
+		{name: "request checksum", frame: request.Bytes(), offset: 38, read: readRequestTag},
+		{name: "request payload", frame: request.Bytes(), offset: RequestHeaderSize + 2, read: readRequestTag},
+		{name: "reply status", frame: reply.Bytes(), offset: 5, read: readReplyTag},
+		{name: "reply epoch", frame: reply.Bytes(), offset: 20, read: readReplyTag},
+		{name: "reply payload", frame: reply.Bytes(), offset: ReplyHeaderSize, read: readReplyTag},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := bytes.Clone(test.frame)
+			frame[test.offset] ^= 0x01
+			tag, err := test.read(frame)
+			if !errors.Is(err, ErrChecksum) {
+				t.Fatalf("error %v, want %v", err, ErrChecksum)
+			}
+			if tag != 9 {
+				t.Fatalf("tag %d of corrupted frame, want 9", tag)
+			}
+		})
+	}
+}
+
+func readRequestTag(frame []byte) (uint64, error) {
+	req, err := ReadRequest(bytes.NewReader(frame))
+	if req == nil {
+		return 0, err
+	}
+	return req.Tag, err
+}
+
+func readReplyTag(frame []byte) (uint64, error) {
+	reply, err := ReadReply(bytes.NewReader(frame))
+	if reply == nil {
+		return 0, err
+	}
+	return reply.Tag, err
+}
+
+func TestInvalidFrames(t *testing.T) {
+	var request bytes.Buffer
+	if err := WriteRequest(&request, &Request{Opcode: OpWrite, Tag: 1, Payload: []byte("payload")}); err != nil {
+		t.Fatal(err)
+	}
+	oversized := bytes.Clone(request.Bytes()[:RequestHeaderSize])
+	oversized[32], oversized[33], oversized[34], oversized[35] = 0xff, 0xff, 0xff, 0xff
+	badMagic := bytes.Clone(request.Bytes())
+	badMagic[0] = 'X'
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "bad magic", frame: badMagic},
+		{name: "oversized payload", frame: oversized},
+		{name: "truncated header", frame: request.Bytes()[:RequestHeaderSize-1]},
+		{name: "truncated payload", frame: request.Bytes()[:request.Len()-1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadRequest(bytes.NewReader(test.frame)); err == nil || errors.Is(err, ErrChecksum) {
+				t.Fatalf("error %v, want a framing error", err)
+			}
+		})
+	}
+
+	if err := WriteRequest(&bytes.Buffer{}, &Request{Opcode: OpRead, Payload: []byte{1}}); err == nil {
+		t.Fatal("READ request with payload written")
+	}
+}
+
+func TestParseExtentsReply(t *testing.T) {
+	extents := []Extent{{Length: 4096}, {Length: 8192, Flags: ExtentHole | ExtentZero}, {Length: 512, Flags: ExtentZero}}
+	tests := []struct {
+		name    string
+		payload []byte
+		length  uint32
+		extents []Extent
+		wantErr bool
+	}{
+		{name: "exact", payload: ExtentsPayload(extents), length: 4096 + 8192 + 512, extents: extents},
+		{name: "prefix of the range", payload: ExtentsPayload(extents[:1]), length: 1 << 20, extents: extents[:1]},
+		{name: "empty", payload: nil, length: 4096, wantErr: true},
+		{name: "truncated", payload: ExtentsPayload(extents)[:12], length: 1 << 20, wantErr: true},
+		{name: "zero length", payload: ExtentsPayload([]Extent{{Length: 0}}), length: 4096, wantErr: true},
+		{name: "beyond the range", payload: ExtentsPayload(extents), length: 4096 + 8192, wantErr: true},
+		{name: "overflowing lengths", payload: ExtentsPayload([]Extent{{Length: 1<<32 - 1}, {Length: 1<<32 - 1}}), length: 1<<32 - 1, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseExtentsReply(&Reply{Payload: test.payload}, test.length)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.extents) {
+				t.Fatalf("parsed %+v, want %+v", got, test.extents)
+			}
+		})
+	}
+}
+
+func TestParseBitmapsReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		bitmaps []string
+		wantErr bool
+	}{
+		{name: "none", payload: nil, bitmaps: nil},
+		{name: "several", payload: BitmapsPayload([]string{"backup", "replica-1"}), bitmaps: []string{"backup", "replica-1"}},
+		{name: "truncated length", payload: []byte{0}, wantErr: true},
+		{name: "truncated name", payload: BitmapsPayload([]string{"backup"})[:5], wantErr: true},
+		{name: "empty name", payload: []byte{0, 0}, wantErr: true},
+		{name: "name too long", payload: BitmapsPayload([]string{string(make([]byte, maxBitmapName+1))}), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseBitmapsReply(&Reply{Payload: test.payload})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.bitmaps) {
+				t.Fatalf("parsed %q, want %q", got, test.bitmaps)
+			}
+		})
+	}
+}
+
+func TestDirtyMapRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		bitmap  string
+		length  uint32
+		wantErr bool
+	}{
+		{name: "valid", bitmap: "backup", length: MaxRangeLength},
+		{name: "longest name", bitmap: string(bytes.Repeat([]byte{'b'}, maxBitmapName)), length: 4096},
+		{name: "empty name", bitmap: "", length: 4096, wantErr: true},
+		{name: "name too long", bitmap: string(bytes.Repeat([]byte{'b'}, maxBitmapName+1)), length: 4096, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := DirtyMapPayload(test.bitmap, test.length)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			var buf bytes.Buffer
+			if err := WriteRequest(&buf, &Request{Opcode: OpDirtyMap, Tag: 1, Offset: 8192, Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			req, err := ReadRequest(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bitmap, length, err := ParseDirtyMapRequest(req)
+			if err != nil || bitmap != test.bitmap || length != test.length {
+				t.Fatalf("parsed %q %d, %v", bitmap, length, err)
+			}
+		})
+	}
+
+	for _, payload := range [][]byte{nil, {0, 0, 16, 0}, make([]byte, 4+maxBitmapName+1)} {
+		if _, _, err := ParseDirtyMapRequest(&Request{Opcode: OpDirtyMap, Payload: payload}); err == nil {
+			t.Fatalf("payload of %d bytes parsed", len(payload))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const listenFDsStart = 3
+
+// activated holds the socket activated listeners of the process. They can only be taken once, so this is process-wide.
+var activated struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []net.Listener
+}
+
+// Listen returns the socket activated listener matching network and address, if there is one.
+// Otherwise a new listener is created (existing unix socket files are replaced).
+func Listen(network string, address string) (net.Listener, error) {
+	if ln := takeActivatedListener(network, address); ln != nil {
+		return ln, nil
+	}
+	if network == "unix" {
+		_ = os.Remove(address)
+	}
+	return net.Listen(network, address)
+}
+
+// IsActivated returns true, if the listener was passed by the service manager
+func IsActivated(ln net.Listener) bool {
+	_, ok := ln.(activatedListener)
+	return ok
+}
+
+type activatedListener struct {
+	net.Listener
+}
+
+func takeActivatedListener(network string, address string) net.Listener {
+	activated.once.Do(loadActivatedListeners)
+
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+
+	for i, ln := range activated.listeners {
+		if ln != nil && matches(ln.Addr(), network, address) {
+			activated.listeners[i] = nil
+			return activatedListener{ln}
+		}
+	}
+	return nil
+}
+
+func loadActivatedListeners() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := range count {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(file)
+		file.Close() // FileListener works on a dup
+		if err != nil {
+			continue // not a stream listener (e.g. datagram or fifo)
+		}
+		activated.listeners = append(activated.listeners, ln)
+	}
+}
+
+func matches(addr net.Addr, network string, address string) bool {
+	if addr.Network() != network {
+		return false
+	}
+	if network == "unix" {
+		return addr.String() == address
+	}
+
+	want, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return false
+	}
+	got, ok := addr.(*net.TCPAddr)
+	return ok && got.Port == want.Port && got.IP.Equal(want.IP)
+}
@@ -0,0 +1,116 @@
+package systemd
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The helper process is started with the listener as fd 3, like the service manager passes it
+const helperEnv = "QBD_SYSTEMD_LISTEN_HELPER"
+
+func TestListenHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperEnv)
+	if mode == "" {
+		t.Skip("helper process")
+	}
+	socket := os.Getenv("QBD_SYSTEMD_LISTEN_SOCKET")
+	if mode == "activated" {
+		// The pid of the child is unknown to the parent before the start
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+
+	ln, err := Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if IsActivated(ln) != (mode == "activated") {
+		t.Fatalf("activated %t in mode %s", IsActivated(ln), mode)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Fatalf("%s is still set", name)
+		}
+	}
+
+	// A listener that was not passed is created
+	other, err := Listen("unix", socket+".other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if IsActivated(other) {
+		t.Fatal("listener for another address is activated")
+	}
+
+	if mode == "activated" {
+		// The parent connected to the passed socket before the start
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+	}
+}
+
+func TestListenActivated(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		pid  string // LISTEN_PID passed by the parent, set by the child itself if empty
+	}{
+		{name: "passed to the process", mode: "activated"},
+		{name: "passed to another process", mode: "other", pid: "1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			socket := filepath.Join(dir, "activated.sock")
+			ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln.SetUnlinkOnClose(false)
+			file, err := ln.File()
+			ln.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			conn, err := net.DialTimeout("unix", socket, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestListenHelperProcess$", "-test.v")
+			cmd.Env = append(os.Environ(),
+				helperEnv+"="+test.mode,
+				"QBD_SYSTEMD_LISTEN_SOCKET="+socket,
+				"LISTEN_FDS=1",
+				"LISTEN_FDNAMES=activated",
+				"LISTEN_PID="+test.pid,
+			)
+			cmd.ExtraFiles = []*os.File{file}
+			out, err := cmd.CombinedOutput()
+			if err != nil || !strings.Contains(string(out), "--- PASS: TestListenHelperProcess") {
+				t.Fatalf("helper process failed: %v\n%s", err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Package systemd provides the systemd service integration (sd_notify, watchdog and socket activation) without libsystemd
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier sends state notifications to the service manager. A notifier without socket ignores all notifications.
+type Notifier struct {
+	socket string
+}
+
+// NewNotifier creates a notifier for the given socket path (abstract sockets start with '@')
+func NewNotifier(socket string) *Notifier {
+	return &Notifier{socket: socket}
+}
+
+// NotifierFromEnv creates a notifier for $NOTIFY_SOCKET
+func NotifierFromEnv() *Notifier {
+	return NewNotifier(os.Getenv("NOTIFY_SOCKET"))
+}
+
+// Enabled returns true, if there is a service manager to notify
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.socket != ""
+}
+
+// Notify sends the given states (e.g. "READY=1") as one datagram
+func (n *Notifier) Notify(states ...string) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+func (n *Notifier) Watchdog() error {
+	return n.Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout requested by the service manager for this process (0, if disabled)
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog sends WATCHDOG=1 at half of the interval as long as alive reports true, until ctx is done.
+// If alive reports false, the pings stop and the service manager restarts the service once the interval elapsed.
+func (n *Notifier) RunWatchdog(ctx context.Context, interval time.Duration, alive func() bool) {
+	if !n.Enabled() || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if alive() {
+				_ = n.Watchdog()
+			}
+		}
+	}
+}
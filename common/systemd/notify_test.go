@@ -0,0 +1,159 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenNotify creates the notify socket of a fake service manager
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn, timeout time.Duration) (string, bool) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return "", false
+		}
+		t.Fatal(err)
+	}
+	return string(buf[:n]), true
+}
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		socket string
+	}{
+		{name: "path", socket: filepath.Join(t.TempDir(), "notify.sock")},
+		{name: "abstract", socket: fmt.Sprintf("@qbd-notify-test-%d", os.Getpid())},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := listenNotify(t, test.socket)
+			t.Setenv("NOTIFY_SOCKET", test.socket)
+			n := NotifierFromEnv()
+			if !n.Enabled() {
+				t.Fatal("notifier with NOTIFY_SOCKET is not enabled")
+			}
+
+			if err := n.Notify("READY=1", "STATUS=Serving"); err != nil {
+				t.Fatal(err)
+			}
+			if msg, _ := receive(t, conn, time.Second); msg != "READY=1\nSTATUS=Serving" {
+				t.Fatalf("received %q", msg)
+			}
+			if err := n.Stopping(); err != nil {
+				t.Fatal(err)
+			}
+			if msg, _ := receive(t, conn, time.Second); msg != "STOPPING=1" {
+				t.Fatalf("received %q", msg)
+			}
+		})
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	n := NotifierFromEnv()
+	if n.Enabled() {
+		t.Fatal("notifier without NOTIFY_SOCKET is enabled")
+	}
+	if err := n.Ready(); err != nil {
+		t.Fatalf("disabled notifier failed: %v", err)
+	}
+	var nilNotifier *Notifier
+	if err := nilNotifier.Ready(); err != nil {
+		t.Fatalf("nil notifier failed: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		interval time.Duration
+	}{
+		{name: "disabled", interval: 0},
+		{name: "enabled", usec: "3000000", interval: 3 * time.Second},
+		{name: "own pid", usec: "500000", pid: pid, interval: 500 * time.Millisecond},
+		{name: "other pid", usec: "500000", pid: "1", interval: 0},
+		{name: "zero", usec: "0", interval: 0},
+		{name: "invalid", usec: "abc", interval: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", test.usec)
+			t.Setenv("WATCHDOG_PID", test.pid)
+			if interval := WatchdogInterval(); interval != test.interval {
+				t.Fatalf("interval %s, want %s", interval, test.interval)
+			}
+		})
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn := listenNotify(t, socket)
+	n := NewNotifier(socket)
+
+	var alive atomic.Bool
+	alive.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.RunWatchdog(ctx, 100*time.Millisecond, alive.Load)
+	}()
+
+	for range 3 {
+		if msg, ok := receive(t, conn, time.Second); !ok || msg != "WATCHDOG=1" {
+			t.Fatalf("received %q, %t", msg, ok)
+		}
+	}
+
+	// Pings stop while not alive, so the service manager restarts the service
+	alive.Store(false)
+	time.Sleep(60 * time.Millisecond) // A ping may be in flight
+	for {
+		if _, ok := receive(t, conn, 50*time.Millisecond); !ok {
+			break
+		}
+	}
+	if msg, ok := receive(t, conn, 300*time.Millisecond); ok {
+		t.Fatalf("received %q while not alive", msg)
+	}
+
+	alive.Store(true)
+	if msg, ok := receive(t, conn, time.Second); !ok || msg != "WATCHDOG=1" {
+		t.Fatalf("received %q, %t after alive again", msg, ok)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not stop")
+	}
+}
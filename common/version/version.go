@@ -0,0 +1,5 @@
+// Package version provides the version of the binaries
+package version
+
+// Version is set at build time: go build -ldflags "-X quorumbd.net/common/version.Version=<version>"
+var Version = "dev"
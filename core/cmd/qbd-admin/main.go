@@ -0,0 +1,172 @@
+// Main package of qbd-admin, the command line tool to administrate the middlewares through core
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/admin"
+)
+
+const usage = `usage: qbd-admin [-socket path] <command> [arguments]
+
+commands:
+  qos [flags] <middleware uuid> <export>           change the io limits of an export at runtime
+  disconnect <middleware uuid> <client id> [reason] close the connection of a client
+  detach <middleware uuid> <export>                 withdraw an export, which disconnects all of its clients
+  locate <volume id>                                list the hosts that have a volume open via which middleware
+`
+
+const requestTimeout = 10 * time.Second
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flags := flag.NewFlagSet("qbd-admin", flag.ContinueOnError)
+	socket := flags.String("socket", filepath.Join("/", "var", "run", "qbd", "core.sock"), "Unix socket of core")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "qos":
+		return runQoS(ctx, *socket, args)
+	case "disconnect":
+		return runDisconnect(ctx, *socket, args)
+	case "detach":
+		return runDetach(ctx, *socket, args)
+	case "locate":
+		return runLocate(ctx, *socket, args)
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func runQoS(ctx context.Context, socket string, args []string) error {
+	var (
+		limits commoncontrol.QoSLimits
+		reset  bool
+	)
+	flags := flag.NewFlagSet("qos", flag.ContinueOnError)
+	flags.Uint64Var(&limits.ReadIOPS, "read-iops", 0, "Read requests per second (0: unlimited)")
+	flags.Uint64Var(&limits.WriteIOPS, "write-iops", 0, "Write requests per second (0: unlimited)")
+	flags.Uint64Var(&limits.ReadBytesPerSecond, "read-bps", 0, "Read bytes per second (0: unlimited)")
+	flags.Uint64Var(&limits.WriteBytesPerSecond, "write-bps", 0, "Written bytes per second (0: unlimited)")
+	var burst uint
+	flags.UintVar(&burst, "burst", 0, "Burst in seconds of the rates (0: 1 second)")
+	flags.BoolVar(&reset, "reset", false, "Restore the configured limits of the middleware")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qbd-admin qos [flags] <middleware uuid> <export>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("qos needs a middleware and an export")
+	}
+	if burst > 3600 {
+		return fmt.Errorf("burst must be at most 3600 seconds")
+	}
+	limits.BurstSeconds = uint32(burst)
+
+	client, err := admin.Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.SetExportQoS(ctx, flags.Arg(0), flags.Arg(1), limits, reset)
+}
+
+func runDisconnect(ctx context.Context, socket string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("disconnect needs a middleware and a client id")
+	}
+	clientID, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid client id %q", args[1])
+	}
+
+	client, err := admin.Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.DisconnectClient(ctx, args[0], clientID, strings.Join(args[2:], " "))
+}
+
+func runDetach(ctx context.Context, socket string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("detach needs a middleware and an export")
+	}
+
+	client, err := admin.Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.DetachExport(ctx, args[0], args[1])
+}
+
+func runLocate(ctx context.Context, socket string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("locate needs a volume id")
+	}
+
+	client, err := admin.Dial(ctx, socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	locations, err := client.LocateVolume(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tIMPLEMENTATION\tMIDDLEWARE\tCONNECTED\tEXPORT\tEPOCH\tCLIENTS")
+	for _, location := range locations {
+		clients := make([]string, len(location.Clients))
+		for i, client := range location.Clients {
+			clients[i] = fmt.Sprintf("%d:%s", client.ID, client.RemoteAddr)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%d\t%s\n", location.Hostname, location.Implementation, location.Middleware,
+			location.Connected, location.Export.Name, location.Export.Epoch, strings.Join(clients, ","))
+	}
+	return w.Flush()
+}
@@ -3,6 +3,7 @@ module quorumbd.net/core
 go 1.26.0
 
 require (
+	github.com/google/uuid v1.6.0
 	github.com/pelletier/go-toml/v2 v2.3.0
 	quorumbd.net/common v0.0.0-00010101000000-000000000000
 )
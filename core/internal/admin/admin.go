@@ -0,0 +1,142 @@
+// Package admin serves the admin connections of core, through which operator tools change the middlewares at runtime
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/inventory"
+)
+
+// Controller is the part of the control server the admin commands are executed with
+type Controller interface {
+	SetExportQoS(middleware uuid.UUID, name string, limits commoncontrol.QoSLimits) error
+	ResetExportQoS(middleware uuid.UUID, name string) error
+	DisconnectClient(middleware uuid.UUID, clientID uint64, reason string) error
+	DetachExport(middleware uuid.UUID, name string) error
+}
+
+// Inventory is the part of the inventory the admin queries are answered from
+type Inventory interface {
+	FindVolume(volumeID string) []inventory.ExportLocation
+}
+
+type Server struct {
+	logger     *slog.Logger
+	controller Controller
+	inventory  Inventory
+}
+
+func New(parentLogger *slog.Logger, controller Controller, inventory Inventory) *Server {
+	return &Server{
+		logger:     parentLogger.With("module", "admin"),
+		controller: controller,
+		inventory:  inventory,
+	}
+}
+
+// ServeConn is an interface method of server.Handler. Admin connections are only accepted on unix sockets, the file
+// permissions of the socket decide who may administrate core.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, _ uuid.UUID) {
+	logger := s.logger.With("remote", conn.RemoteAddr().String())
+	if conn.LocalAddr().Network() != "unix" {
+		logger.Warn("Refusing admin connection on a socket that is not a unix socket", "local", conn.LocalAddr().String())
+		return
+	}
+
+	for {
+		msg, err := commoncontrol.ReadMessage(conn)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				logger.Debug("Admin connection closed", "error", err)
+			}
+			return
+		}
+		response := s.handle(logger, msg)
+		if response == nil {
+			logger.Warn("Unexpected admin message type", "type", msg.Type())
+			return
+		}
+		if err := commoncontrol.WriteMessage(conn, response); err != nil {
+			logger.Info("Sending admin response failed", "error", err)
+			return
+		}
+	}
+}
+
+// handle executes an admin request and returns the response (nil for unexpected messages)
+func (s *Server) handle(logger *slog.Logger, msg commoncontrol.ControlMessage) commoncontrol.ControlMessage {
+	if commoncontrol.IsResponse(msg) {
+		return nil
+	}
+	switch m := msg.(type) {
+	case *commoncontrol.AdminExportQoSMessage:
+		middleware, err := parseMiddleware(m.Middleware)
+		if err == nil {
+			if m.Reset {
+				err = s.controller.ResetExportQoS(middleware, m.Name)
+			} else {
+				err = s.controller.SetExportQoS(middleware, m.Name, m.Limits)
+			}
+		}
+		logger.Info("Export limits changed by admin", "uuid", m.Middleware, "export", m.Name, "limits", fmt.Sprintf("%+v", m.Limits), "reset", m.Reset, "error", err)
+		return commoncontrol.NewAdminExportQoSResponse(m.RequestID(), errorMessage(err))
+	case *commoncontrol.AdminClientDisconnectMessage:
+		middleware, err := parseMiddleware(m.Middleware)
+		if err == nil {
+			err = s.controller.DisconnectClient(middleware, m.ClientID, m.Reason)
+		}
+		logger.Info("Client disconnected by admin", "uuid", m.Middleware, "client", m.ClientID, "reason", m.Reason, "error", err)
+		return commoncontrol.NewAdminClientDisconnectResponse(m.RequestID(), errorMessage(err))
+	case *commoncontrol.AdminExportDetachMessage:
+		middleware, err := parseMiddleware(m.Middleware)
+		if err == nil {
+			err = s.controller.DetachExport(middleware, m.Name)
+		}
+		logger.Info("Export detached by admin", "uuid", m.Middleware, "export", m.Name, "error", err)
+		return commoncontrol.NewAdminExportDetachResponse(m.RequestID(), errorMessage(err))
+	case *commoncontrol.AdminVolumeLocateMessage:
+		if m.VolumeID == "" {
+			return commoncontrol.NewAdminVolumeLocateResponse(m.RequestID(), nil, "volume id missing")
+		}
+		return commoncontrol.NewAdminVolumeLocateResponse(m.RequestID(), volumeLocations(s.inventory.FindVolume(m.VolumeID)), "")
+	}
+	return nil
+}
+
+func volumeLocations(locations []inventory.ExportLocation) []commoncontrol.VolumeLocation {
+	result := make([]commoncontrol.VolumeLocation, len(locations))
+	for i, location := range locations {
+		result[i] = commoncontrol.VolumeLocation{
+			Middleware:     location.MiddlewareUUID.String(),
+			Implementation: location.Implementation,
+			Hostname:       location.Hostname,
+			Connected:      location.Connected,
+			Export:         location.Export,
+			Clients:        location.Clients,
+		}
+	}
+	return result
+}
+
+func parseMiddleware(middleware string) (uuid.UUID, error) {
+	id, err := uuid.Parse(middleware)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid middleware UUID %q", middleware)
+	}
+	return id, nil
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/inventory"
+	"quorumbd.net/core/internal/server"
+)
+
+// call is a command executed by the fake controller
+type call struct {
+	method     string
+	middleware uuid.UUID
+	name       string
+	limits     commoncontrol.QoSLimits
+	clientID   uint64
+	reason     string
+}
+
+type fakeController struct {
+	mu    sync.Mutex
+	calls []call
+	err   error
+}
+
+func (c *fakeController) record(cl call) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, cl)
+	return c.err
+}
+
+func (c *fakeController) SetExportQoS(middleware uuid.UUID, name string, limits commoncontrol.QoSLimits) error {
+	return c.record(call{method: "set", middleware: middleware, name: name, limits: limits})
+}
+
+func (c *fakeController) ResetExportQoS(middleware uuid.UUID, name string) error {
+	return c.record(call{method: "reset", middleware: middleware, name: name})
+}
+
+func (c *fakeController) DisconnectClient(middleware uuid.UUID, clientID uint64, reason string) error {
+	return c.record(call{method: "disconnect", middleware: middleware, clientID: clientID, reason: reason})
+}
+
+func (c *fakeController) DetachExport(middleware uuid.UUID, name string) error {
+	return c.record(call{method: "detach", middleware: middleware, name: name})
+}
+
+// checkCalls compares the calls of the controller
+func (c *fakeController) checkCalls(t *testing.T, want []call) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.calls) != len(want) {
+		t.Fatalf("calls %+v, want %+v", c.calls, want)
+	}
+	for i := range want {
+		if c.calls[i] != want[i] {
+			t.Errorf("call %d: %+v, want %+v", i, c.calls[i], want[i])
+		}
+	}
+}
+
+// startAdmin serves admin connections on a unix socket of a core server until the test ends and returns a client
+func startAdmin(t *testing.T, controller Controller, inventory Inventory) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "core.sock")
+	logger := slog.New(slog.DiscardHandler)
+	srv := server.New(logger, []string{"unix://" + path})
+	srv.Handle(commoncontrol.AdminPreamble, New(logger, controller, inventory))
+	if err := srv.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ctx)
+	}()
+
+	client, err := Dial(t.Context(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		cancel()
+		<-done
+	})
+	return client
+}
+
+func TestExportQoS(t *testing.T) {
+	controller := &fakeController{}
+	client := startAdmin(t, controller, nil)
+	middleware := uuid.New()
+	limits := commoncontrol.QoSLimits{ReadIOPS: 100, WriteBytesPerSecond: 1 << 20, BurstSeconds: 2}
+
+	if err := client.SetExportQoS(t.Context(), middleware.String(), "vm1", limits, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetExportQoS(t.Context(), middleware.String(), "vm1", commoncontrol.QoSLimits{}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetExportQoS(t.Context(), "not a uuid", "vm1", limits, false); err == nil {
+		t.Fatal("limits of an invalid middleware UUID changed")
+	}
+	controller.err = errors.New("middleware is not connected")
+	if err := client.SetExportQoS(t.Context(), middleware.String(), "vm1", limits, false); err == nil || err.Error() != controller.err.Error() {
+		t.Fatalf("error %v, want the one of the controller", err)
+	}
+
+	controller.checkCalls(t, []call{
+		{method: "set", middleware: middleware, name: "vm1", limits: limits},
+		{method: "reset", middleware: middleware, name: "vm1"},
+		{method: "set", middleware: middleware, name: "vm1", limits: limits},
+	})
+}
+
+func TestDisconnectAndDetach(t *testing.T) {
+	controller := &fakeController{}
+	client := startAdmin(t, controller, nil)
+	middleware := uuid.New()
+
+	if err := client.DisconnectClient(t.Context(), middleware.String(), 7, "host revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DetachExport(t.Context(), middleware.String(), "vm1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DisconnectClient(t.Context(), "not a uuid", 7, ""); err == nil {
+		t.Fatal("client of an invalid middleware UUID disconnected")
+	}
+	if err := client.DetachExport(t.Context(), "not a uuid", "vm1"); err == nil {
+		t.Fatal("export of an invalid middleware UUID detached")
+	}
+	controller.err = errors.New("middleware is not connected")
+	if err := client.DetachExport(t.Context(), middleware.String(), "vm1"); err == nil || err.Error() != controller.err.Error() {
+		t.Fatalf("error %v, want the one of the controller", err)
+	}
+
+	controller.checkCalls(t, []call{
+		{method: "disconnect", middleware: middleware, clientID: 7, reason: "host revoked"},
+		{method: "detach", middleware: middleware, name: "vm1"},
+		{method: "detach", middleware: middleware, name: "vm1"},
+	})
+}
+
+func TestLocateVolume(t *testing.T) {
+	inv := inventory.New(slog.New(slog.DiscardHandler), time.Minute)
+	client := startAdmin(t, &fakeController{}, inv)
+	export := commoncontrol.ExportInfo{Name: "vm1", VolumeID: "vol-1", Size: 1 << 20, Epoch: 3}
+	middleware := uuid.New()
+	inv.Register(middleware, commoncontrol.MiddlewareInfo{Implementation: "qemu-nbd", Hostname: "host1", Exports: []commoncontrol.ExportInfo{export}}, "")
+	inv.UpdateClients(middleware, []commoncontrol.ClientInfo{{ID: 7, Export: "vm1", RemoteAddr: "10.0.0.1:50000"}, {ID: 8, Export: "vm2"}})
+
+	locations, err := client.LocateVolume(t.Context(), "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 {
+		t.Fatalf("locations %+v", locations)
+	}
+	location := locations[0]
+	if location.Middleware != middleware.String() || location.Hostname != "host1" || location.Implementation != "qemu-nbd" ||
+		!location.Connected || location.Export != export || len(location.Clients) != 1 || location.Clients[0].ID != 7 {
+		t.Fatalf("location %+v", location)
+	}
+
+	if locations, err := client.LocateVolume(t.Context(), "vol-2"); err != nil || len(locations) != 0 {
+		t.Fatalf("locations of an unknown volume %+v: %v", locations, err)
+	}
+	if _, err := client.LocateVolume(t.Context(), ""); err == nil {
+		t.Fatal("located a volume without id")
+	}
+}
+
+func TestRefuseConnectionsNotOnUnixSockets(t *testing.T) {
+	controller := &fakeController{}
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		New(slog.New(slog.DiscardHandler), controller, nil).ServeConn(t.Context(), conn, uuid.Nil)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	request := commoncontrol.NewAdminExportQoSRequest(1, uuid.New().String(), "vm1", commoncontrol.QoSLimits{}, true)
+	if commoncontrol.WriteMessage(client, request) == nil {
+		if _, err := commoncontrol.ReadMessage(client); err == nil {
+			t.Fatal("admin request answered on a pipe")
+		}
+	}
+	<-done
+	if len(controller.calls) != 0 {
+		t.Fatalf("calls %+v", controller.calls)
+	}
+}
@@ -0,0 +1,125 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+// Client is an admin connection to core. Its requests are sequential.
+type Client struct {
+	conn      net.Conn
+	requestID uint64
+}
+
+// Dial connects to the unix socket of core at path
+func Dial(ctx context.Context, path string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(commoncontrol.AdminPreamble[:], uuid.Nil[:]...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// SetExportQoS changes the io limits of an export on a middleware, reset restores its configured limits
+func (c *Client) SetExportQoS(ctx context.Context, middleware string, name string, limits commoncontrol.QoSLimits, reset bool) error {
+	c.requestID++
+	response, err := c.request(ctx, commoncontrol.NewAdminExportQoSRequest(c.requestID, middleware, name, limits, reset))
+	if err != nil {
+		return err
+	}
+	m, ok := response.(*commoncontrol.AdminExportQoSMessage)
+	if !ok {
+		return fmt.Errorf("unexpected response type %d", response.Type())
+	}
+	return responseError(m.Error)
+}
+
+// DisconnectClient closes the connection of a client on a middleware, the reason is logged by the middleware
+func (c *Client) DisconnectClient(ctx context.Context, middleware string, clientID uint64, reason string) error {
+	c.requestID++
+	response, err := c.request(ctx, commoncontrol.NewAdminClientDisconnectRequest(c.requestID, middleware, clientID, reason))
+	if err != nil {
+		return err
+	}
+	m, ok := response.(*commoncontrol.AdminClientDisconnectMessage)
+	if !ok {
+		return fmt.Errorf("unexpected response type %d", response.Type())
+	}
+	return responseError(m.Error)
+}
+
+// DetachExport withdraws an export from a middleware, which disconnects all of its clients
+func (c *Client) DetachExport(ctx context.Context, middleware string, name string) error {
+	c.requestID++
+	response, err := c.request(ctx, commoncontrol.NewAdminExportDetachRequest(c.requestID, middleware, name))
+	if err != nil {
+		return err
+	}
+	m, ok := response.(*commoncontrol.AdminExportDetachMessage)
+	if !ok {
+		return fmt.Errorf("unexpected response type %d", response.Type())
+	}
+	return responseError(m.Error)
+}
+
+// LocateVolume returns which hosts have a volume open via which middleware
+func (c *Client) LocateVolume(ctx context.Context, volumeID string) ([]commoncontrol.VolumeLocation, error) {
+	c.requestID++
+	response, err := c.request(ctx, commoncontrol.NewAdminVolumeLocateRequest(c.requestID, volumeID))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := response.(*commoncontrol.AdminVolumeLocateMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response type %d", response.Type())
+	}
+	if err := responseError(m.Error); err != nil {
+		return nil, err
+	}
+	return m.Locations, nil
+}
+
+// request sends a request and reads its response, ctx bounds both
+func (c *Client) request(ctx context.Context, msg commoncontrol.ControlMessage) (commoncontrol.ControlMessage, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.Close()
+	})
+	defer stop()
+
+	if err := commoncontrol.WriteMessage(c.conn, msg); err != nil {
+		return nil, errors.Join(ctx.Err(), err)
+	}
+	response, err := commoncontrol.ReadMessage(c.conn)
+	if err != nil {
+		return nil, errors.Join(ctx.Err(), err)
+	}
+	if !commoncontrol.IsResponse(response) || response.RequestID() != msg.RequestID() {
+		return nil, fmt.Errorf("unexpected response to request %d", msg.RequestID())
+	}
+	return response, nil
+}
+
+func responseError(message string) error {
+	if message == "" {
+		return nil
+	}
+	return errors.New(message)
+}
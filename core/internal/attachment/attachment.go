@@ -0,0 +1,134 @@
+// Package attachment keeps track of the volumes core attached to the middlewares and of the epochs of the attachments
+package attachment
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Registry holds the attachments of the volumes to the middlewares. Core assigns every attachment a new epoch, the data
+// connections of a middleware are only admitted with the epoch of its current attachment. Replacing or revoking an
+// attachment waits for the requests admitted before, so that a fenced attachment cannot change the volume afterwards.
+type Registry struct {
+	logger    *slog.Logger
+	mu        sync.Mutex
+	volumes   map[string]*volumeAttachments
+	lastEpoch uint64
+}
+
+type volumeAttachments struct {
+	fence  sync.RWMutex // Held shared by admitted requests, exclusively while the attachments change
+	epochs map[uuid.UUID]uint64
+}
+
+func New(parentLogger *slog.Logger) *Registry {
+	return &Registry{
+		logger:  parentLogger.With("module", "attachment"),
+		volumes: make(map[string]*volumeAttachments),
+		// Epochs are not persisted, seeding with the clock keeps them increasing across restarts of core
+		lastEpoch: uint64(time.Now().UnixNano()),
+	}
+}
+
+func (r *Registry) volume(volumeID string) *volumeAttachments {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.volumes[volumeID]
+	if !ok {
+		v = &volumeAttachments{epochs: make(map[uuid.UUID]uint64)}
+		r.volumes[volumeID] = v
+	}
+	return v
+}
+
+func (r *Registry) nextEpoch() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastEpoch++
+	return r.lastEpoch
+}
+
+// Attach attaches the volume to the middleware with a new epoch and returns it. A previous attachment of the volume to
+// the middleware is fenced.
+func (r *Registry) Attach(volumeID string, middleware uuid.UUID) uint64 {
+	v := r.volume(volumeID)
+	v.fence.Lock()
+	defer v.fence.Unlock()
+	epoch := r.nextEpoch()
+	if previous, ok := v.epochs[middleware]; ok {
+		r.logger.Info("Volume reattached, the previous epoch is fenced", "volume", volumeID, "uuid", middleware.String(), "epoch", epoch, "previous_epoch", previous)
+	}
+	v.epochs[middleware] = epoch
+	return epoch
+}
+
+// Detach revokes the attachment of the volume to the middleware (returns false, if there is none)
+func (r *Registry) Detach(volumeID string, middleware uuid.UUID) bool {
+	v := r.volume(volumeID)
+	v.fence.Lock()
+	defer v.fence.Unlock()
+	if _, ok := v.epochs[middleware]; !ok {
+		return false
+	}
+	delete(v.epochs, middleware)
+	r.logger.Info("Volume detached", "volume", volumeID, "uuid", middleware.String())
+	return true
+}
+
+// DetachAll revokes all attachments of the middleware and returns the ids of their volumes
+func (r *Registry) DetachAll(middleware uuid.UUID) []string {
+	r.mu.Lock()
+	volumeIDs := make([]string, 0, len(r.volumes))
+	for volumeID := range r.volumes {
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	r.mu.Unlock()
+
+	var detached []string
+	for _, volumeID := range volumeIDs {
+		if r.Detach(volumeID, middleware) {
+			detached = append(detached, volumeID)
+		}
+	}
+	slices.Sort(detached)
+	return detached
+}
+
+// Epoch returns the epoch of the attachment of the volume to the middleware
+func (r *Registry) Epoch(volumeID string, middleware uuid.UUID) (uint64, bool) {
+	v := r.volume(volumeID)
+	v.fence.RLock()
+	defer v.fence.RUnlock()
+	epoch, ok := v.epochs[middleware]
+	return epoch, ok
+}
+
+// Holders returns the middlewares the volume is attached to
+func (r *Registry) Holders(volumeID string) []uuid.UUID {
+	v := r.volume(volumeID)
+	v.fence.RLock()
+	defer v.fence.RUnlock()
+	holders := make([]uuid.UUID, 0, len(v.epochs))
+	for middleware := range v.epochs {
+		holders = append(holders, middleware)
+	}
+	return holders
+}
+
+// Admit admits a request of the middleware with the epoch to the volume. If the epoch is the one of the current
+// attachment, release must be called when the request completed, the attachment is not changed before. Otherwise it
+// returns the current epoch (0, if the volume is not attached to the middleware).
+func (r *Registry) Admit(volumeID string, middleware uuid.UUID, epoch uint64) (release func(), current uint64, ok bool) {
+	v := r.volume(volumeID)
+	v.fence.RLock()
+	current, attached := v.epochs[middleware]
+	if !attached || current != epoch {
+		v.fence.RUnlock()
+		return nil, current, false
+	}
+	return v.fence.RUnlock, current, true
+}
@@ -0,0 +1,112 @@
+package attachment
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAttachAssignsIncreasingEpochs(t *testing.T) {
+	r := New(slog.New(slog.DiscardHandler))
+	a, b := uuid.New(), uuid.New()
+
+	first := r.Attach("vol", a)
+	second := r.Attach("vol", b)
+	third := r.Attach("vol", a)
+	if !(first < second && second < third) {
+		t.Fatalf("epochs %d, %d, %d are not increasing", first, second, third)
+	}
+	if epoch, ok := r.Epoch("vol", a); !ok || epoch != third {
+		t.Fatalf("epoch of a: %d %t, want %d", epoch, ok, third)
+	}
+	holders := r.Holders("vol")
+	if len(holders) != 2 || !slices.Contains(holders, a) || !slices.Contains(holders, b) {
+		t.Fatalf("holders: %v", holders)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	r := New(slog.New(slog.DiscardHandler))
+	a, b := uuid.New(), uuid.New()
+	epoch := r.Attach("vol", a)
+
+	tests := []struct {
+		name       string
+		volumeID   string
+		middleware uuid.UUID
+		epoch      uint64
+		ok         bool
+		current    uint64
+	}{
+		{name: "current epoch", volumeID: "vol", middleware: a, epoch: epoch, ok: true, current: epoch},
+		{name: "older epoch", volumeID: "vol", middleware: a, epoch: epoch - 1, current: epoch},
+		{name: "newer epoch", volumeID: "vol", middleware: a, epoch: epoch + 1, current: epoch},
+		{name: "epoch of another middleware", volumeID: "vol", middleware: b, epoch: epoch},
+		{name: "other volume", volumeID: "other", middleware: a, epoch: epoch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release, current, ok := r.Admit(test.volumeID, test.middleware, test.epoch)
+			if ok != test.ok || current != test.current {
+				t.Fatalf("admit: %d %t, want %d %t", current, ok, test.current, test.ok)
+			}
+			if ok {
+				release()
+			}
+		})
+	}
+}
+
+func TestReattachWaitsForAdmittedRequests(t *testing.T) {
+	r := New(slog.New(slog.DiscardHandler))
+	a := uuid.New()
+	epoch := r.Attach("vol", a)
+
+	release, _, ok := r.Admit("vol", a, epoch)
+	if !ok {
+		t.Fatal("request with current epoch not admitted")
+	}
+	reattached := make(chan uint64)
+	go func() { reattached <- r.Attach("vol", a) }()
+
+	select {
+	case <-reattached:
+		t.Fatal("reattach did not wait for the admitted request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	newEpoch := <-reattached
+
+	if _, _, ok := r.Admit("vol", a, epoch); ok {
+		t.Fatal("request with fenced epoch admitted")
+	}
+	if release, _, ok := r.Admit("vol", a, newEpoch); !ok {
+		t.Fatal("request with new epoch not admitted")
+	} else {
+		release()
+	}
+}
+
+func TestDetachAll(t *testing.T) {
+	r := New(slog.New(slog.DiscardHandler))
+	a, b := uuid.New(), uuid.New()
+	r.Attach("vol-1", a)
+	r.Attach("vol-2", a)
+	r.Attach("vol-2", b)
+
+	if detached := r.DetachAll(a); !slices.Equal(detached, []string{"vol-1", "vol-2"}) {
+		t.Fatalf("detached: %v", detached)
+	}
+	if _, ok := r.Epoch("vol-1", a); ok {
+		t.Fatal("attachment survived DetachAll")
+	}
+	if holders := r.Holders("vol-2"); !slices.Equal(holders, []uuid.UUID{b}) {
+		t.Fatalf("holders: %v", holders)
+	}
+	if r.Detach("vol-2", a) {
+		t.Fatal("detached an attachment twice")
+	}
+}
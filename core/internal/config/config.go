@@ -7,45 +7,55 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
-	"sync"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/pelletier/go-toml/v2"
 	commonconfig "quorumbd.net/common/config"
 )
 
 const configFileName = "core.toml"
 
-var (
-	config  *Config
-	once    sync.Once
-	loadErr error
-)
+var bitmapName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,255}$`)
 
 type Config struct {
 	CommonConfig  commonconfig.CommonConfig  `toml:"common"`
 	LoggingConfig commonconfig.LoggingConfig `toml:"logging"`
 	CoreConfig    coreConfig                 `toml:"core"`
+	Volumes       []VolumeConfig             `toml:"volumes"`
 }
 
 type coreConfig struct {
-	Listen []string `toml:"listen"`
+	Listen  []string `toml:"listen"`
+	DataDir string   `toml:"data_dir"` // Directory of the volume images
 }
 
-func Load() (*Config, error) {
-	once.Do(func() { // => Singleton
-		config, loadErr = load()
-	})
-	return config, loadErr
+// VolumeConfig defines a volume of the catalogue
+type VolumeConfig struct {
+	ID          string            `toml:"id"`
+	Name        string            `toml:"name"`
+	Size        uint64            `toml:"size"`
+	BlockSize   uint32            `toml:"block_size"`
+	ReadOnly    bool              `toml:"read_only"`
+	Labels      map[string]string `toml:"labels"`
+	Middlewares []string          `toml:"middlewares"` // UUIDs of the middlewares that may see the volume (empty: all)
+	Bitmaps     []string          `toml:"bitmaps"`     // Change tracking bitmaps, they track the changes from their creation on
 }
 
-func load() (*Config, error) {
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
 	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_NBDSERVER_CONFIG")
 	if err != nil {
 		return nil, fmt.Errorf("error loading config: %w", err)
 	}
+	return LoadFrom(configPath)
+}
 
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
 	var cfg Config
 
 	cfg.setDefaults()
@@ -54,13 +64,13 @@ func load() (*Config, error) {
 		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
 	}
 
+	cfg.setVolumeDefaults()
+
 	if err := cfg.validate(); err != nil {
 		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
 	}
 
-	config = &cfg
-
-	return config, nil
+	return &cfg, nil
 }
 
 func (cfg *Config) setDefaults() {
@@ -71,13 +81,63 @@ func (cfg *Config) setDefaults() {
 
 func (cfg *coreConfig) setDefaults() {
 	cfg.Listen = []string{"unix://" + filepath.Join("/", "var", "run", "qbd", "core.sock")}
+	cfg.DataDir = filepath.Join("/", "var", "lib", "qbd", "volumes")
+}
+
+// setVolumeDefaults sets the defaults of the volumes, which only exist after reading the config
+func (cfg *Config) setVolumeDefaults() {
+	for i := range cfg.Volumes {
+		if cfg.Volumes[i].BlockSize == 0 {
+			cfg.Volumes[i].BlockSize = 4096
+		}
+	}
 }
 
 func (cfg *Config) validate() error {
 	commonErrors := cfg.CommonConfig.Validate()
 	loggingErrors := cfg.LoggingConfig.Validate()
 	coreErrors := cfg.CoreConfig.validate()
-	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreErrors)
+	volumeErrors := validateVolumes(cfg.Volumes)
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreErrors, volumeErrors)
+}
+
+func validateVolumes(volumes []VolumeConfig) error {
+	errs := validation.Errors{}
+	ids := make(map[string]bool)
+	names := make(map[string]bool)
+	for i := range volumes {
+		volume := &volumes[i]
+		key := fmt.Sprintf("volumes[%d]", i)
+		if err := validation.ValidateStruct(volume,
+			validation.Field(&volume.ID, validation.Required.Error("volumes.id required")),
+			validation.Field(&volume.Name, validation.Required.Error("volumes.name required"), validation.Length(1, 4096).Error("volumes.name must not exceed 4096 bytes")),
+			validation.Field(&volume.Size, validation.Required.Error("volumes.size required")),
+			validation.Field(&volume.BlockSize, validation.By(func(value interface{}) error {
+				blockSize := value.(uint32)
+				if blockSize < 512 || blockSize > 65536 || blockSize&(blockSize-1) != 0 {
+					return fmt.Errorf("volumes.block_size must be a power of two between 512 and 65536")
+				}
+				return nil
+			})),
+			validation.Field(&volume.Middlewares, validation.Each(is.UUID.Error("volumes.middlewares must contain UUIDs"))),
+			validation.Field(&volume.Bitmaps, validation.Each(validation.Match(bitmapName).Error("volumes.bitmaps must contain names of letters, digits, '.', '_' and '-' of at most 255 bytes"))),
+		); err != nil {
+			errs[key] = err
+			continue
+		}
+		if volume.Size%uint64(volume.BlockSize) != 0 {
+			errs[key] = fmt.Errorf("volumes.size must be a multiple of volumes.block_size")
+		} else if ids[volume.ID] {
+			errs[key] = fmt.Errorf("duplicate volume id %q", volume.ID)
+		} else if names[volume.Name] {
+			errs[key] = fmt.Errorf("duplicate volume name %q", volume.Name)
+		} else if len(slices.Compact(slices.Sorted(slices.Values(volume.Bitmaps)))) != len(volume.Bitmaps) {
+			errs[key] = fmt.Errorf("duplicate bitmap in volumes.bitmaps")
+		}
+		ids[volume.ID] = true
+		names[volume.Name] = true
+	}
+	return errs.Filter()
 }
 
 func (cfg coreConfig) validate() error {
@@ -139,6 +199,7 @@ func (cfg coreConfig) validate() error {
 					}
 				})),
 			),
+			validation.Field(&cfg.DataDir, validation.Required.Error("core.data_dir required")),
 		),
 	}.Filter()
 }
@@ -0,0 +1,310 @@
+// Package controlserver serves the control connections of the middlewares
+package controlserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/attachment"
+	"quorumbd.net/core/internal/inventory"
+	"quorumbd.net/core/internal/volume"
+)
+
+const invalidateTimeout = 3 * time.Second // Time a middleware has to acknowledge a cache invalidation // TOCONFIG
+
+type ControlServer struct {
+	logger            *slog.Logger
+	inventory         *inventory.Inventory
+	volumes           *volume.Catalog
+	attachments       *attachment.Registry
+	invalidateTimeout time.Duration
+	mu                sync.Mutex
+	sessions          map[uuid.UUID]*session
+	acks              map[uint64]chan struct{} // Cache invalidations waiting for the acknowledgement of a middleware
+	requestID         atomic.Uint64
+}
+
+// session is the control connection of a middleware. Responses and messages pushed by core share the connection.
+type session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	offered map[string]bool // Volumes attached in this session, only used by ServeConn
+}
+
+func (s *session) writeMessage(msg commoncontrol.ControlMessage) error {
+	return s.writeMessageUntil(msg, time.Now().Add(5*time.Second)) // TOCONFIG
+}
+
+func (s *session) writeMessageUntil(msg commoncontrol.ControlMessage, deadline time.Time) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(deadline)
+	return commoncontrol.WriteMessage(s.conn, msg)
+}
+
+func New(parentLogger *slog.Logger, inventory *inventory.Inventory, volumes *volume.Catalog, attachments *attachment.Registry) *ControlServer {
+	return &ControlServer{
+		logger:            parentLogger.With("module", "controlserver"),
+		inventory:         inventory,
+		volumes:           volumes,
+		attachments:       attachments,
+		invalidateTimeout: invalidateTimeout,
+		sessions:          make(map[uuid.UUID]*session),
+		acks:              make(map[uint64]chan struct{}),
+	}
+}
+
+// ServeConn is an interface method of server.Handler
+func (cs *ControlServer) ServeConn(ctx context.Context, conn net.Conn, peerUUID uuid.UUID) {
+	logger := cs.logger.With("uuid", peerUUID.String(), "remote", conn.RemoteAddr().String())
+	logger.Info("Middleware connected")
+	defer cs.inventory.Disconnected(peerUUID)
+
+	s := &session{conn: conn, offered: make(map[string]bool)}
+	cs.mu.Lock()
+	cs.sessions[peerUUID] = s
+	cs.mu.Unlock()
+	defer func() {
+		cs.mu.Lock()
+		if cs.sessions[peerUUID] == s {
+			delete(cs.sessions, peerUUID)
+		}
+		cs.mu.Unlock()
+	}()
+
+	for {
+		msg, err := commoncontrol.ReadMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("Closing control connection because context done")
+			} else {
+				logger.Info("Control connection closed", "error", err)
+			}
+			return
+		}
+
+		logger.Debug("Received control message from middleware", "message", fmt.Sprintf("%+v", msg))
+
+		switch m := msg.(type) {
+		case *commoncontrol.MiddlewareRegisterMessage:
+			if m.Middleware.UUID != peerUUID.String() {
+				logger.Warn("Registration UUID does not match preamble, using preamble", "registered_uuid", m.Middleware.UUID)
+				m.Middleware.UUID = peerUUID.String()
+			}
+			cs.inventory.Register(peerUUID, m.Middleware, conn.RemoteAddr().String())
+			if err := cs.attachExports(logger, s, peerUUID, m.Middleware.Exports); err != nil {
+				logger.Info("Sending export attachments failed", "error", err)
+				return
+			}
+		case *commoncontrol.MiddlewareHeartbeatMessage:
+			if !cs.inventory.Touch(peerUUID) {
+				logger.Warn("Heartbeat from unregistered middleware")
+			}
+		case *commoncontrol.ClientReportMessage:
+			if !cs.inventory.UpdateClients(peerUUID, m.Clients) {
+				logger.Warn("Client report from unregistered middleware")
+			}
+		case *commoncontrol.VolumeListMessage:
+			cs.inventory.Touch(peerUUID)
+			response := commoncontrol.NewVolumeListResponse(m.RequestID(), cs.volumes.Visible(peerUUID, m.Name))
+			if err := s.writeMessage(response); err != nil {
+				logger.Info("Sending volume list failed", "error", err)
+				return
+			}
+		case *commoncontrol.CacheInvalidateMessage:
+			cs.inventory.Touch(peerUUID)
+			if !commoncontrol.IsResponse(m) || !cs.acknowledge(m.RequestID()) {
+				logger.Debug("Dropping cache invalidation without pending request", "volume", m.VolumeID, "request_id", m.RequestID())
+			}
+		default:
+			cs.inventory.Touch(peerUUID)
+			logger.Warn("Unexpected control message type", "type", msg.Type())
+		}
+	}
+}
+
+// attachExports attaches the visible volumes that were not attached in this session yet to the middleware and detaches
+// the exports of volumes it may not see. A volume is attached once per session, so that a failing attachment is not
+// repeated with every registration.
+func (cs *ControlServer) attachExports(logger *slog.Logger, s *session, peerUUID uuid.UUID, exports []commoncontrol.ExportInfo) error {
+	claimed := make(map[string]commoncontrol.ExportInfo, len(exports))
+	for _, export := range exports {
+		if !cs.volumes.IsVisible(peerUUID, export.VolumeID) {
+			logger.Warn("Detaching export of a volume that is not visible", "export", export.Name, "volume", export.VolumeID)
+			cs.attachments.Detach(export.VolumeID, peerUUID)
+			if err := s.writeMessage(commoncontrol.NewExportDetachMessage(cs.requestID.Add(1), export.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		claimed[export.VolumeID] = export
+	}
+
+	for _, info := range cs.volumes.Visible(peerUUID, "") {
+		if s.offered[info.ID] {
+			continue
+		}
+		s.offered[info.ID] = true
+
+		export := commoncontrol.ExportInfo{
+			Name:      info.Name,
+			VolumeID:  info.ID,
+			Size:      info.Size,
+			BlockSize: info.BlockSize,
+			ReadOnly:  info.ReadOnly,
+		}
+		if epoch, ok := cs.attachments.Epoch(info.ID, peerUUID); ok {
+			export.Epoch = epoch
+			if claimed[info.ID] == export {
+				// Still attached from a previous session
+				continue
+			}
+		}
+		export.Epoch = cs.attachments.Attach(info.ID, peerUUID)
+		if err := s.writeMessage(commoncontrol.NewExportAttachMessage(cs.requestID.Add(1), export)); err != nil {
+			return err
+		}
+		logger.Info("Attaching volume", "volume", info.ID, "export", export.Name, "epoch", export.Epoch)
+	}
+	return nil
+}
+
+// MiddlewareExpired revokes the attachments of a middleware that expired from the inventory
+func (cs *ControlServer) MiddlewareExpired(middleware uuid.UUID) {
+	if volumeIDs := cs.attachments.DetachAll(middleware); len(volumeIDs) > 0 {
+		cs.logger.Info("Revoked attachments of expired middleware", "uuid", middleware.String(), "volumes", volumeIDs)
+	}
+}
+
+// InvalidateCache tells the middlewares the volume is attached to, except the one that changed it (uuid.Nil: none), to drop
+// the ranges from their read caches (all of the volume without ranges) and waits until they acknowledged it. Middlewares
+// that are not connected or do not acknowledge in time are evicted, so that no middleware serves cached data from before
+// the change after InvalidateCache returned. It must be called whenever blocks change outside of a middleware, e.g. by
+// another writer or a resync. It returns the number of middlewares that acknowledged.
+func (cs *ControlServer) InvalidateCache(volumeID string, ranges []commoncontrol.ByteRange, except uuid.UUID) int {
+	type invalidation struct {
+		peerUUID uuid.UUID
+		s        *session // nil, if the middleware is not connected
+		msg      *commoncontrol.CacheInvalidateMessage
+		ack      chan struct{}
+	}
+
+	holders := cs.attachments.Holders(volumeID)
+	invalidations := make([]invalidation, 0, len(holders))
+	cs.mu.Lock()
+	for _, peerUUID := range holders {
+		if peerUUID == except {
+			continue
+		}
+		msg := commoncontrol.NewCacheInvalidateMessage(cs.requestID.Add(1), volumeID, ranges)
+		ack := make(chan struct{})
+		cs.acks[msg.RequestID()] = ack
+		invalidations = append(invalidations, invalidation{peerUUID: peerUUID, s: cs.sessions[peerUUID], msg: msg, ack: ack})
+	}
+	cs.mu.Unlock()
+	defer func() {
+		cs.mu.Lock()
+		for _, inv := range invalidations {
+			delete(cs.acks, inv.msg.RequestID())
+		}
+		cs.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cs.invalidateTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	var (
+		wg           sync.WaitGroup
+		acknowledged atomic.Int64
+	)
+	for _, inv := range invalidations {
+		wg.Go(func() {
+			if inv.s == nil {
+				cs.evict(volumeID, inv.peerUUID, nil, "middleware not connected")
+				return
+			}
+			if err := inv.s.writeMessageUntil(inv.msg, deadline); err != nil {
+				cs.evict(volumeID, inv.peerUUID, inv.s, "sending cache invalidation failed: "+err.Error())
+				return
+			}
+			select {
+			case <-inv.ack:
+				acknowledged.Add(1)
+			case <-ctx.Done():
+				cs.evict(volumeID, inv.peerUUID, inv.s, "cache invalidation not acknowledged in time")
+			}
+		})
+	}
+	wg.Wait()
+	return int(acknowledged.Load())
+}
+
+// acknowledge completes a pending cache invalidation (false, if it is not pending)
+func (cs *ControlServer) acknowledge(requestID uint64) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ack, ok := cs.acks[requestID]
+	if !ok {
+		return false
+	}
+	close(ack)
+	delete(cs.acks, requestID)
+	return true
+}
+
+// evict revokes the attachment of a volume to a middleware whose cache could not be invalidated, which fences its data
+// connections, and closes its control connection. The middleware detaches its exports and drops their caches when it
+// loses the connection, it gets the volume attached again with a new epoch when it registers after reconnecting.
+func (cs *ControlServer) evict(volumeID string, middleware uuid.UUID, s *session, reason string) {
+	cs.logger.Warn("Evicting middleware from volume, its cache could not be invalidated", "uuid", middleware.String(), "volume", volumeID, "reason", reason)
+	cs.attachments.Detach(volumeID, middleware)
+	if s != nil {
+		s.conn.Close()
+	}
+}
+
+// DisconnectClient closes the connection of a client on a middleware (e.g. to revoke the access of a host)
+func (cs *ControlServer) DisconnectClient(middleware uuid.UUID, clientID uint64, reason string) error {
+	return cs.sendTo(middleware, commoncontrol.NewClientDisconnectMessage(cs.requestID.Add(1), clientID, reason))
+}
+
+// DetachExport withdraws an export from a middleware, which disconnects all of its clients. The attachment is revoked
+// right away, so the data connections of the export are fenced even if the middleware is not connected.
+func (cs *ControlServer) DetachExport(middleware uuid.UUID, name string) error {
+	for _, info := range cs.volumes.Visible(middleware, name) {
+		cs.attachments.Detach(info.ID, middleware)
+	}
+	return cs.sendTo(middleware, commoncontrol.NewExportDetachMessage(cs.requestID.Add(1), name))
+}
+
+// SetExportQoS changes the io limits of an export on a middleware at runtime
+func (cs *ControlServer) SetExportQoS(middleware uuid.UUID, name string, limits commoncontrol.QoSLimits) error {
+	return cs.sendTo(middleware, commoncontrol.NewExportQoSMessage(cs.requestID.Add(1), name, limits))
+}
+
+// ResetExportQoS restores the configured io limits of an export on a middleware
+func (cs *ControlServer) ResetExportQoS(middleware uuid.UUID, name string) error {
+	msg := commoncontrol.NewExportQoSMessage(cs.requestID.Add(1), name, commoncontrol.QoSLimits{})
+	msg.Reset = true
+	return cs.sendTo(middleware, msg)
+}
+
+// sendTo pushes a message to a connected middleware
+func (cs *ControlServer) sendTo(middleware uuid.UUID, msg commoncontrol.ControlMessage) error {
+	cs.mu.Lock()
+	s, ok := cs.sessions[middleware]
+	cs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("middleware %s is not connected", middleware)
+	}
+	return s.writeMessage(msg)
+}
@@ -0,0 +1,243 @@
+package controlserver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/attachment"
+	"quorumbd.net/core/internal/config"
+	"quorumbd.net/core/internal/inventory"
+	"quorumbd.net/core/internal/volume"
+)
+
+const testVolumeID = "vol-0"
+
+func newTestServer(t *testing.T, volumes ...config.VolumeConfig) (*ControlServer, *attachment.Registry) {
+	t.Helper()
+	if len(volumes) == 0 {
+		volumes = []config.VolumeConfig{{ID: testVolumeID, Name: "disk0", Size: 1 << 20, BlockSize: 4096}}
+	}
+	logger := slog.New(slog.DiscardHandler)
+	attachments := attachment.New(logger)
+	cs := New(logger, inventory.New(logger, time.Minute), volume.NewCatalog(volumes), attachments)
+	cs.invalidateTimeout = 100 * time.Millisecond
+	return cs, attachments
+}
+
+// testMiddleware is the control connection of a middleware to the control server
+type testMiddleware struct {
+	t    *testing.T
+	uuid uuid.UUID
+	conn net.Conn
+}
+
+// connectMiddleware serves a control connection of a new middleware until the test ends, registers it and returns it
+// with the exports core attached
+func connectMiddleware(t *testing.T, cs *ControlServer) (*testMiddleware, []commoncontrol.ExportInfo) {
+	t.Helper()
+	client, server := net.Pipe()
+	m := &testMiddleware{t: t, uuid: uuid.New(), conn: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		cs.ServeConn(ctx, server, m.uuid)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+
+	m.send(commoncontrol.NewMiddlewareRegisterMessage(1, commoncontrol.MiddlewareInfo{UUID: m.uuid.String()}))
+	var exports []commoncontrol.ExportInfo
+	for range cs.volumes.Visible(m.uuid, "") {
+		attach, ok := m.receive().(*commoncontrol.ExportAttachMessage)
+		if !ok {
+			t.Fatal("no attach message after the registration")
+		}
+		exports = append(exports, attach.Export)
+	}
+	return m, exports
+}
+
+func (m *testMiddleware) send(msg commoncontrol.ControlMessage) {
+	m.t.Helper()
+	if err := commoncontrol.WriteMessage(m.conn, msg); err != nil {
+		m.t.Fatalf("sending %T failed: %v", msg, err)
+	}
+}
+
+func (m *testMiddleware) receive() commoncontrol.ControlMessage {
+	m.t.Helper()
+	m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := commoncontrol.ReadMessage(m.conn)
+	if err != nil {
+		m.t.Fatalf("receiving failed: %v", err)
+	}
+	return msg
+}
+
+// acknowledgeInvalidations acknowledges the cache invalidations until the connection is closed and passes them on
+func (m *testMiddleware) acknowledgeInvalidations() <-chan *commoncontrol.CacheInvalidateMessage {
+	invalidations := make(chan *commoncontrol.CacheInvalidateMessage, 16)
+	go func() {
+		defer close(invalidations)
+		for {
+			msg, err := commoncontrol.ReadMessage(m.conn)
+			if err != nil {
+				return
+			}
+			if invalidation, ok := msg.(*commoncontrol.CacheInvalidateMessage); ok {
+				invalidations <- invalidation
+				if commoncontrol.WriteMessage(m.conn, commoncontrol.NewCacheInvalidateResponse(msg.RequestID(), invalidation.VolumeID)) != nil {
+					return
+				}
+			}
+		}
+	}()
+	return invalidations
+}
+
+func TestInvalidateCache(t *testing.T) {
+	cs, attachments := newTestServer(t)
+	writer, _ := connectMiddleware(t, cs)
+	acknowledging, _ := connectMiddleware(t, cs)
+	silent, _ := connectMiddleware(t, cs)
+	disconnected := uuid.New()
+	attachments.Attach(testVolumeID, disconnected)
+
+	invalidations := acknowledging.acknowledgeInvalidations()
+	ranges := []commoncontrol.ByteRange{{Offset: 4096, Length: 8192}}
+	if acknowledged := cs.InvalidateCache(testVolumeID, ranges, writer.uuid); acknowledged != 1 {
+		t.Fatalf("%d middlewares acknowledged, want 1", acknowledged)
+	}
+	select {
+	case invalidation := <-invalidations:
+		if invalidation.VolumeID != testVolumeID || len(invalidation.Ranges) != 1 || invalidation.Ranges[0] != ranges[0] {
+			t.Fatalf("invalidation %+v", invalidation)
+		}
+	default:
+		t.Fatal("invalidation acknowledged but not received")
+	}
+
+	// The middlewares that did not acknowledge are evicted: fenced and disconnected
+	for _, test := range []struct {
+		name       string
+		middleware uuid.UUID
+		attached   bool
+	}{
+		{name: "writer", middleware: writer.uuid, attached: true},
+		{name: "acknowledging", middleware: acknowledging.uuid, attached: true},
+		{name: "silent", middleware: silent.uuid, attached: false},
+		{name: "disconnected", middleware: disconnected, attached: false},
+	} {
+		if _, attached := attachments.Epoch(testVolumeID, test.middleware); attached != test.attached {
+			t.Errorf("%s: attached %v, want %v", test.name, attached, test.attached)
+		}
+	}
+	silent.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, silent.conn); err != nil {
+		t.Fatalf("control connection of the silent middleware not closed: %v", err)
+	}
+
+	// The writer is not notified of its own changes
+	writer.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if msg, err := commoncontrol.ReadMessage(writer.conn); err == nil {
+		t.Fatalf("writer received %+v", msg)
+	}
+
+	// An acknowledgement after the timeout is dropped
+	if cs.acknowledge(1 << 60) {
+		t.Fatal("acknowledged an invalidation that is not pending")
+	}
+}
+
+func TestExportQoS(t *testing.T) {
+	cs, _ := newTestServer(t)
+	m, _ := connectMiddleware(t, cs)
+	limits := commoncontrol.QoSLimits{ReadIOPS: 100, WriteBytesPerSecond: 1 << 20}
+
+	// The pipe blocks the sender until the middleware reads
+	sent := make(chan error, 1)
+	go func() {
+		sent <- cs.SetExportQoS(m.uuid, "disk0", limits)
+	}()
+	if msg, ok := m.receive().(*commoncontrol.ExportQoSMessage); !ok || msg.Name != "disk0" || msg.Limits != limits || msg.Reset {
+		t.Fatalf("received %+v, want the limits", msg)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		sent <- cs.ResetExportQoS(m.uuid, "disk0")
+	}()
+	if msg, ok := m.receive().(*commoncontrol.ExportQoSMessage); !ok || msg.Name != "disk0" || msg.Limits != (commoncontrol.QoSLimits{}) || !msg.Reset {
+		t.Fatalf("received %+v, want a reset", msg)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.SetExportQoS(uuid.New(), "disk0", limits); err == nil {
+		t.Fatal("limits sent to a middleware that is not connected")
+	}
+}
+
+func TestDisconnectClient(t *testing.T) {
+	cs, _ := newTestServer(t)
+	m, _ := connectMiddleware(t, cs)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- cs.DisconnectClient(m.uuid, 7, "host revoked")
+	}()
+	if msg, ok := m.receive().(*commoncontrol.ClientDisconnectMessage); !ok || msg.ClientID != 7 || msg.Reason != "host revoked" {
+		t.Fatalf("received %+v, want the disconnect", msg)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.DisconnectClient(uuid.New(), 7, ""); err == nil {
+		t.Fatal("disconnect sent to a middleware that is not connected")
+	}
+}
+
+func TestDetachExport(t *testing.T) {
+	cs, attachments := newTestServer(t)
+	m, _ := connectMiddleware(t, cs)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- cs.DetachExport(m.uuid, "disk0")
+	}()
+	if msg, ok := m.receive().(*commoncontrol.ExportDetachMessage); !ok || msg.Name != "disk0" {
+		t.Fatalf("received %+v, want the detach", msg)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := attachments.Epoch(testVolumeID, m.uuid); ok {
+		t.Fatal("attachment of the detached export not revoked")
+	}
+
+	// The attachment of a middleware that is not connected is revoked, so that its data connections are fenced
+	other := uuid.New()
+	attachments.Attach(testVolumeID, other)
+	if err := cs.DetachExport(other, "disk0"); err == nil {
+		t.Fatal("detach sent to a middleware that is not connected")
+	}
+	if _, ok := attachments.Epoch(testVolumeID, other); ok {
+		t.Fatal("attachment of the middleware that is not connected not revoked")
+	}
+}
@@ -0,0 +1,362 @@
+// Package dataserver serves the data connections of the middlewares
+package dataserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+	commondata "quorumbd.net/common/data"
+
+	"quorumbd.net/core/internal/attachment"
+	"quorumbd.net/core/internal/dirty"
+	"quorumbd.net/core/internal/store"
+	"quorumbd.net/core/internal/volume"
+)
+
+const (
+	maxInFlight  = 64               // Requests executed concurrently per connection // TOCONFIG
+	openTimeout  = 5 * time.Second  // TOCONFIG
+	writeTimeout = 30 * time.Second // TOCONFIG
+)
+
+// CacheInvalidator drops changed ranges of a volume from the read caches of the middlewares (e.g. ControlServer). It
+// returns after the caches dropped the ranges.
+type CacheInvalidator interface {
+	InvalidateCache(volumeID string, ranges []commoncontrol.ByteRange, except uuid.UUID) int
+}
+
+type DataServer struct {
+	logger      *slog.Logger
+	volumes     *volume.Catalog
+	attachments *attachment.Registry
+	store       store.Store
+	tracker     *dirty.Tracker
+	invalidator CacheInvalidator
+}
+
+func New(parentLogger *slog.Logger, volumes *volume.Catalog, attachments *attachment.Registry, store store.Store, tracker *dirty.Tracker, invalidator CacheInvalidator) *DataServer {
+	return &DataServer{
+		logger:      parentLogger.With("module", "dataserver"),
+		volumes:     volumes,
+		attachments: attachments,
+		store:       store,
+		tracker:     tracker,
+		invalidator: invalidator,
+	}
+}
+
+// dataConn is a data connection of a middleware to a volume
+type dataConn struct {
+	logger      *slog.Logger
+	conn        net.Conn
+	r           *bufio.Reader
+	writeMu     sync.Mutex
+	w           *bufio.Writer
+	peerUUID    uuid.UUID
+	attachments *attachment.Registry
+	tracker     *dirty.Tracker
+	invalidator CacheInvalidator
+	info        commoncontrol.VolumeInfo
+	volume      store.Volume
+	epoch       uint64
+	readOnly    bool
+}
+
+// ServeConn is an interface method of server.Handler
+func (ds *DataServer) ServeConn(ctx context.Context, conn net.Conn, peerUUID uuid.UUID) {
+	c := &dataConn{
+		logger:      ds.logger.With("uuid", peerUUID.String(), "remote", conn.RemoteAddr().String()),
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		w:           bufio.NewWriter(conn),
+		peerUUID:    peerUUID,
+		attachments: ds.attachments,
+		tracker:     ds.tracker,
+		invalidator: ds.invalidator,
+	}
+	if !ds.open(c) {
+		return
+	}
+	defer c.volume.Close()
+	c.logger.Info("Data connection opened", "volume", c.info.ID, "epoch", c.epoch, "read_only", c.readOnly)
+
+	sem := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		req, err := commondata.ReadRequest(c.r)
+		if errors.Is(err, commondata.ErrChecksum) {
+			c.logger.Warn("Request with checksum mismatch", "op", req.Opcode.String(), "tag", req.Tag)
+			c.reply(&commondata.Reply{Status: commondata.StatusChecksum, Tag: req.Tag})
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				c.logger.Info("Data connection closed", "volume", c.info.ID)
+			} else {
+				c.logger.Warn("Data connection failed", "volume", c.info.ID, "error", err)
+			}
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			reply := c.execute(req)
+			if reply.Status == commondata.StatusOK {
+				c.invalidate(req)
+			}
+			c.reply(reply)
+		})
+	}
+}
+
+// open handles the OPEN request, which must be the first request of a connection. The epoch of the request must be the one core
+// assigned to the attachment of the volume to the middleware.
+func (ds *DataServer) open(c *dataConn) bool {
+	if err := c.conn.SetReadDeadline(time.Now().Add(openTimeout)); err != nil {
+		return false
+	}
+	req, err := commondata.ReadRequest(c.r)
+	if err != nil {
+		if errors.Is(err, commondata.ErrChecksum) {
+			c.reply(&commondata.Reply{Status: commondata.StatusChecksum, Tag: req.Tag})
+		}
+		c.logger.Warn("Reading OPEN request failed", "error", err)
+		return false
+	}
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+
+	reply := &commondata.Reply{Tag: req.Tag}
+	if req.Opcode != commondata.OpOpen {
+		reply.Status = commondata.StatusNotOpen
+		c.reply(reply)
+		return false
+	}
+	volumeID, err := commondata.VolumeIDOf(req)
+	if err != nil {
+		reply.Status = commondata.StatusInvalid
+		c.reply(reply)
+		return false
+	}
+	info, ok := ds.volumes.Lookup(c.peerUUID, volumeID)
+	if !ok {
+		c.logger.Warn("OPEN of unknown volume", "volume", volumeID)
+		reply.Status = commondata.StatusUnknownVolume
+		c.reply(reply)
+		return false
+	}
+
+	if epoch, attached := ds.attachments.Epoch(volumeID, c.peerUUID); !attached || req.Epoch != epoch {
+		reply.Status, reply.Epoch = commondata.StatusStaleEpoch, epoch
+		c.logger.Warn("OPEN with an epoch that is not the one of the attachment", "volume", volumeID, "epoch", req.Epoch, "attached", attached, "current_epoch", epoch)
+		c.reply(reply)
+		return false
+	}
+
+	vol, err := ds.store.Open(info)
+	if err != nil {
+		c.logger.Error("Opening volume failed", "volume", volumeID, "error", err)
+		reply.Status = commondata.StatusIO
+		c.reply(reply)
+		return false
+	}
+
+	c.info, c.volume, c.epoch = info, vol, req.Epoch
+	c.readOnly = info.ReadOnly || req.Flags.Has(commondata.FlagReadOnly)
+	reply.Epoch = req.Epoch
+	reply.Payload = commondata.OpenReplyPayload(info.Size, info.BlockSize)
+	if !c.reply(reply) {
+		vol.Close()
+		return false
+	}
+	return true
+}
+
+// execute executes a request on the volume, unless the attachment of its epoch was replaced or revoked
+func (c *dataConn) execute(req *commondata.Request) *commondata.Reply {
+	reply := &commondata.Reply{Tag: req.Tag}
+	if req.Epoch != c.epoch {
+		reply.Status, reply.Epoch = commondata.StatusInvalid, c.epoch
+		return reply
+	}
+
+	release, current, ok := c.attachments.Admit(c.info.ID, c.peerUUID, c.epoch)
+	reply.Epoch = current
+	if !ok {
+		reply.Status = commondata.StatusStaleEpoch
+		return reply
+	}
+	defer release()
+
+	if modifies(req.Opcode) && c.readOnly {
+		reply.Status = commondata.StatusReadOnly
+		return reply
+	}
+
+	off, length := int64(req.Offset), int64(req.Length)
+	var bitmap string
+	if req.Opcode == commondata.OpDirtyMap {
+		name, rangeLength, err := commondata.ParseDirtyMapRequest(req)
+		if err != nil {
+			reply.Status = commondata.StatusInvalid
+			return reply
+		}
+		bitmap, length = name, int64(rangeLength)
+	}
+	if req.Opcode != commondata.OpFlush && req.Opcode != commondata.OpBitmaps && (req.Offset > c.info.Size || uint64(length) > c.info.Size-req.Offset) {
+		reply.Status = commondata.StatusOutOfRange
+		return reply
+	}
+	if modifies(req.Opcode) {
+		c.tracker.Mark(c.info.ID, req.Offset, uint64(length)) // Before the change, a failed change leaves a harmless dirty range
+	}
+
+	var err error
+	switch req.Opcode {
+	case commondata.OpRead:
+		if req.Length > commondata.MaxPayloadSize {
+			reply.Status = commondata.StatusInvalid
+			return reply
+		}
+		reply.Payload = make([]byte, length)
+		err = c.volume.ReadAt(reply.Payload, off)
+	case commondata.OpWrite:
+		err = c.volume.WriteAt(req.Payload, off, req.Flags.Has(commondata.FlagFUA))
+	case commondata.OpFlush:
+		err = c.volume.Flush()
+	case commondata.OpTrim:
+		err = c.volume.Trim(off, length)
+	case commondata.OpWriteZeroes:
+		err = c.volume.WriteZeroes(off, length, req.Flags.Has(commondata.FlagNoHole), req.Flags.Has(commondata.FlagFastZero))
+	case commondata.OpExtents:
+		if req.Length == 0 {
+			reply.Status = commondata.StatusInvalid
+			return reply
+		}
+		reply.Payload, err = c.extents(off, length)
+	case commondata.OpBitmaps:
+		reply.Payload = commondata.BitmapsPayload(c.tracker.Bitmaps(c.info.ID))
+	case commondata.OpDirtyMap:
+		if length == 0 {
+			reply.Status = commondata.StatusInvalid
+			return reply
+		}
+		reply.Payload, err = c.dirtyMap(bitmap, req.Offset, uint64(length))
+	default:
+		reply.Status = commondata.StatusInvalid
+		return reply
+	}
+
+	if err != nil {
+		reply.Payload = nil
+		reply.Status = statusOf(err)
+		if reply.Status != commondata.StatusNotSupported {
+			c.logger.Warn("Volume request failed", "volume", c.info.ID, "op", req.Opcode.String(), "offset", off, "length", length, "error", err)
+		}
+	}
+	return reply
+}
+
+// invalidate drops the range changed by a request from the read caches of the other middlewares the volume is attached
+// to. It is called before the request is acknowledged and returns once every other middleware acknowledged the
+// invalidation or was evicted from the volume, so a read on another middleware that starts after the completion of the
+// write does not return cached data from before it.
+func (c *dataConn) invalidate(req *commondata.Request) {
+	if !modifies(req.Opcode) {
+		return
+	}
+	c.invalidator.InvalidateCache(c.info.ID, []commoncontrol.ByteRange{{Offset: req.Offset, Length: uint64(req.Length)}}, c.peerUUID)
+}
+
+// extents returns the payload of the reply to EXTENTS. Replies with more than MaxExtents extents are cut, the middleware
+// requests the rest of the range.
+func (c *dataConn) extents(off int64, length int64) ([]byte, error) {
+	mapped, err := c.volume.Extents(off, length)
+	if err != nil {
+		return nil, err
+	}
+	extents := make([]commondata.Extent, 0, min(len(mapped), commondata.MaxExtents))
+	for _, extent := range mapped[:min(len(mapped), commondata.MaxExtents)] {
+		var flags commondata.ExtentFlags
+		if extent.Hole {
+			flags = commondata.ExtentHole | commondata.ExtentZero
+		}
+		extents = append(extents, commondata.Extent{Length: uint32(extent.Length), Flags: flags})
+	}
+	return commondata.ExtentsPayload(extents), nil
+}
+
+// dirtyMap returns the payload of the reply to DIRTY_MAP, it is cut like the reply to EXTENTS
+func (c *dataConn) dirtyMap(bitmap string, off uint64, length uint64) ([]byte, error) {
+	mapped, err := c.tracker.Extents(c.info.ID, bitmap, off, length)
+	if err != nil {
+		return nil, err
+	}
+	extents := make([]commondata.Extent, 0, min(len(mapped), commondata.MaxExtents))
+	for _, extent := range mapped[:min(len(mapped), commondata.MaxExtents)] {
+		var flags commondata.ExtentFlags
+		if extent.Dirty {
+			flags = commondata.ExtentDirty
+		}
+		extents = append(extents, commondata.Extent{Length: uint32(extent.Length), Flags: flags})
+	}
+	return commondata.ExtentsPayload(extents), nil
+}
+
+// modifies returns true for the requests that change the volume
+func modifies(op commondata.Opcode) bool {
+	switch op {
+	case commondata.OpWrite, commondata.OpTrim, commondata.OpWriteZeroes:
+		return true
+	}
+	return false
+}
+
+func statusOf(err error) commondata.Status {
+	switch {
+	case errors.Is(err, store.ErrNotSupported):
+		return commondata.StatusNotSupported
+	case errors.Is(err, dirty.ErrUnknownBitmap):
+		return commondata.StatusInvalid
+	case errors.Is(err, syscall.ENOSPC):
+		return commondata.StatusNoSpace
+	default:
+		return commondata.StatusIO
+	}
+}
+
+// reply writes a reply, a failed write closes the connection (false)
+func (c *dataConn) reply(reply *commondata.Reply) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return false
+	}
+	err := commondata.WriteReply(c.w, reply)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		c.logger.Debug("Writing reply failed", "tag", reply.Tag, "error", err)
+		c.conn.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,388 @@
+package dataserver
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+	commondata "quorumbd.net/common/data"
+
+	"quorumbd.net/core/internal/attachment"
+	"quorumbd.net/core/internal/config"
+	"quorumbd.net/core/internal/dirty"
+	"quorumbd.net/core/internal/store"
+	"quorumbd.net/core/internal/volume"
+)
+
+const testVolumeID = "vol-0"
+
+// fakeInvalidator records the cache invalidations
+type fakeInvalidator struct {
+	mu    sync.Mutex
+	calls []invalidation
+}
+
+type invalidation struct {
+	volumeID string
+	ranges   []commoncontrol.ByteRange
+	except   uuid.UUID
+}
+
+func (fi *fakeInvalidator) InvalidateCache(volumeID string, ranges []commoncontrol.ByteRange, except uuid.UUID) int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.calls = append(fi.calls, invalidation{volumeID: volumeID, ranges: ranges, except: except})
+	return 1
+}
+
+func (fi *fakeInvalidator) invalidations() []invalidation {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return slices.Clone(fi.calls)
+}
+
+func newTestServer(t *testing.T) (*DataServer, *attachment.Registry, *fakeInvalidator) {
+	t.Helper()
+	volumeStore, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes := []config.VolumeConfig{{ID: testVolumeID, Name: "disk0", Size: 1 << 20, BlockSize: 4096, Bitmaps: []string{"backup"}}}
+	logger := slog.New(slog.DiscardHandler)
+	tracker, err := dirty.Open(logger, t.TempDir(), volumes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tracker.Close() })
+	attachments := attachment.New(logger)
+	invalidator := &fakeInvalidator{}
+	return New(logger, volume.NewCatalog(volumes), attachments, volumeStore, tracker, invalidator), attachments, invalidator
+}
+
+// connect serves a data connection of the middleware until the test ends
+func connect(t *testing.T, ds *DataServer, middleware uuid.UUID) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		ds.ServeConn(ctx, server, middleware)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+func roundTrip(t *testing.T, conn net.Conn, req *commondata.Request) *commondata.Reply {
+	t.Helper()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := commondata.WriteRequest(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := commondata.ReadReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Tag != req.Tag {
+		t.Fatalf("reply tag %d, want %d", reply.Tag, req.Tag)
+	}
+	return reply
+}
+
+func open(t *testing.T, ds *DataServer, middleware uuid.UUID, epoch uint64) (net.Conn, *commondata.Reply) {
+	t.Helper()
+	conn := connect(t, ds, middleware)
+	payload, err := commondata.OpenPayload(testVolumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, roundTrip(t, conn, &commondata.Request{Opcode: commondata.OpOpen, Tag: 1, Epoch: epoch, Payload: payload})
+}
+
+func TestOpenRequiresEpochOfAttachment(t *testing.T) {
+	ds, attachments, _ := newTestServer(t)
+	middleware, other := uuid.New(), uuid.New()
+	epoch := attachments.Attach(testVolumeID, middleware)
+
+	tests := []struct {
+		name       string
+		middleware uuid.UUID
+		epoch      uint64
+		status     commondata.Status
+	}{
+		{name: "epoch of the attachment", middleware: middleware, epoch: epoch, status: commondata.StatusOK},
+		{name: "older epoch", middleware: middleware, epoch: epoch - 1, status: commondata.StatusStaleEpoch},
+		{name: "epoch raised by the client", middleware: middleware, epoch: epoch + 1, status: commondata.StatusStaleEpoch},
+		{name: "middleware without attachment", middleware: other, epoch: epoch, status: commondata.StatusStaleEpoch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, reply := open(t, ds, test.middleware, test.epoch)
+			if reply.Status != test.status {
+				t.Fatalf("OPEN status %s, want %s", reply.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestStaleEpochAfterReattach(t *testing.T) {
+	ds, attachments, _ := newTestServer(t)
+	middleware := uuid.New()
+	epoch := attachments.Attach(testVolumeID, middleware)
+
+	conn, reply := open(t, ds, middleware, epoch)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("OPEN status %s", reply.Status)
+	}
+	data := bytes.Repeat([]byte{0x42}, 4096)
+	write := &commondata.Request{Opcode: commondata.OpWrite, Tag: 2, Epoch: epoch, Payload: data}
+	if reply := roundTrip(t, conn, write); reply.Status != commondata.StatusOK {
+		t.Fatalf("WRITE status %s", reply.Status)
+	}
+
+	newEpoch := attachments.Attach(testVolumeID, middleware)
+	write.Tag = 3
+	reply = roundTrip(t, conn, write)
+	if reply.Status != commondata.StatusStaleEpoch || reply.Epoch != newEpoch {
+		t.Fatalf("WRITE after reattach: status %s epoch %d, want %s epoch %d", reply.Status, reply.Epoch, commondata.StatusStaleEpoch, newEpoch)
+	}
+	if _, reply := open(t, ds, middleware, epoch); reply.Status != commondata.StatusStaleEpoch {
+		t.Fatalf("OPEN with previous epoch: status %s", reply.Status)
+	}
+
+	conn, reply = open(t, ds, middleware, newEpoch)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("OPEN with new epoch: status %s", reply.Status)
+	}
+	reply = roundTrip(t, conn, &commondata.Request{Opcode: commondata.OpRead, Tag: 2, Epoch: newEpoch, Length: uint32(len(data))})
+	if reply.Status != commondata.StatusOK || !bytes.Equal(reply.Payload, data) {
+		t.Fatalf("READ with new epoch: status %s", reply.Status)
+	}
+
+	attachments.Detach(testVolumeID, middleware)
+	reply = roundTrip(t, conn, &commondata.Request{Opcode: commondata.OpFlush, Tag: 3, Epoch: newEpoch})
+	if reply.Status != commondata.StatusStaleEpoch {
+		t.Fatalf("FLUSH after detach: status %s", reply.Status)
+	}
+}
+
+func TestChangesInvalidateCachesBeforeReply(t *testing.T) {
+	ds, attachments, invalidator := newTestServer(t)
+	writer, reader := uuid.New(), uuid.New()
+	epoch := attachments.Attach(testVolumeID, writer)
+	attachments.Attach(testVolumeID, reader)
+
+	conn, reply := open(t, ds, writer, epoch)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("OPEN status %s", reply.Status)
+	}
+
+	tests := []struct {
+		name   string
+		req    commondata.Request
+		ranges []commoncontrol.ByteRange // nil: no invalidation
+	}{
+		{name: "write", req: commondata.Request{Opcode: commondata.OpWrite, Offset: 4096, Payload: make([]byte, 512)}, ranges: []commoncontrol.ByteRange{{Offset: 4096, Length: 512}}},
+		{name: "trim", req: commondata.Request{Opcode: commondata.OpTrim, Offset: 8192, Length: 4096}, ranges: []commoncontrol.ByteRange{{Offset: 8192, Length: 4096}}},
+		{name: "write zeroes", req: commondata.Request{Opcode: commondata.OpWriteZeroes, Offset: 0, Length: 65536}, ranges: []commoncontrol.ByteRange{{Offset: 0, Length: 65536}}},
+		{name: "read", req: commondata.Request{Opcode: commondata.OpRead, Length: 512}},
+		{name: "flush", req: commondata.Request{Opcode: commondata.OpFlush}},
+		{name: "failed write", req: commondata.Request{Opcode: commondata.OpWrite, Offset: 1 << 20, Payload: make([]byte, 512)}},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(invalidator.invalidations())
+			req := test.req
+			req.Tag, req.Epoch = uint64(i+2), epoch
+			roundTrip(t, conn, &req)
+
+			calls := invalidator.invalidations()[before:]
+			if test.ranges == nil {
+				if len(calls) != 0 {
+					t.Fatalf("invalidations %+v, want none", calls)
+				}
+				return
+			}
+			want := []invalidation{{volumeID: testVolumeID, ranges: test.ranges, except: writer}}
+			if !reflect.DeepEqual(calls, want) {
+				t.Fatalf("invalidations %+v, want %+v", calls, want)
+			}
+		})
+	}
+}
+
+// parseExtents returns the extents of an EXTENTS reply with their offsets
+func parseExtents(t *testing.T, reply *commondata.Reply, req *commondata.Request) []store.Extent {
+	t.Helper()
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("EXTENTS status %s", reply.Status)
+	}
+	extents, err := commondata.ParseExtentsReply(reply, req.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped := make([]store.Extent, 0, len(extents))
+	pos := int64(req.Offset)
+	for _, extent := range extents {
+		if hole := extent.Flags.Has(commondata.ExtentHole); hole != extent.Flags.Has(commondata.ExtentZero) {
+			t.Fatalf("extent flags %d", extent.Flags)
+		}
+		mapped = append(mapped, store.Extent{Offset: pos, Length: int64(extent.Length), Hole: extent.Flags.Has(commondata.ExtentHole)})
+		pos += int64(extent.Length)
+	}
+	return mapped
+}
+
+// holeAt returns true, if the offset is in a hole of the extents
+func holeAt(extents []store.Extent, off int64) bool {
+	for _, extent := range extents {
+		if off >= extent.Offset && off < extent.Offset+extent.Length {
+			return extent.Hole
+		}
+	}
+	return false
+}
+
+func TestExtents(t *testing.T) {
+	ds, attachments, _ := newTestServer(t)
+	middleware := uuid.New()
+	epoch := attachments.Attach(testVolumeID, middleware)
+	conn, reply := open(t, ds, middleware, epoch)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("OPEN status %s", reply.Status)
+	}
+
+	extentsOf := &commondata.Request{Opcode: commondata.OpExtents, Tag: 2, Epoch: epoch, Length: 1 << 20}
+	extents := parseExtents(t, roundTrip(t, conn, extentsOf), extentsOf)
+	if len(extents) != 1 || !extents[0].Hole || extents[0].Length != 1<<20 {
+		t.Fatalf("extents of the new volume %+v, want a single hole", extents)
+	}
+
+	write := &commondata.Request{Opcode: commondata.OpWrite, Tag: 3, Epoch: epoch, Offset: 256 << 10, Payload: bytes.Repeat([]byte{1}, 4096)}
+	if reply := roundTrip(t, conn, write); reply.Status != commondata.StatusOK {
+		t.Fatalf("WRITE status %s", reply.Status)
+	}
+	extents = parseExtents(t, roundTrip(t, conn, extentsOf), extentsOf)
+	if last := extents[len(extents)-1]; last.Offset+last.Length != 1<<20 {
+		t.Fatalf("extents %+v do not cover the volume", extents)
+	}
+	if !holeAt(extents, 0) || holeAt(extents, 256<<10) || !holeAt(extents, 1<<20-1) {
+		t.Fatalf("extents %+v after a write in the middle", extents)
+	}
+
+	trim := &commondata.Request{Opcode: commondata.OpTrim, Tag: 4, Epoch: epoch, Offset: 0, Length: 1 << 20}
+	if reply := roundTrip(t, conn, trim); reply.Status != commondata.StatusOK {
+		t.Fatalf("TRIM status %s", reply.Status)
+	}
+	if extents := parseExtents(t, roundTrip(t, conn, extentsOf), extentsOf); !holeAt(extents, 256<<10) {
+		t.Fatalf("extents %+v after trimming the volume", extents)
+	}
+
+	tests := []struct {
+		name   string
+		req    commondata.Request
+		status commondata.Status
+	}{
+		{name: "empty range", req: commondata.Request{Opcode: commondata.OpExtents, Offset: 4096}, status: commondata.StatusInvalid},
+		{name: "beyond the volume", req: commondata.Request{Opcode: commondata.OpExtents, Offset: 1 << 20, Length: 1}, status: commondata.StatusOutOfRange},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.req.Tag, test.req.Epoch = 5, epoch
+			if reply := roundTrip(t, conn, &test.req); reply.Status != test.status {
+				t.Fatalf("status %s, want %s", reply.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestDirtyMapTracksChanges(t *testing.T) {
+	ds, attachments, _ := newTestServer(t)
+	middleware := uuid.New()
+	epoch := attachments.Attach(testVolumeID, middleware)
+	conn, reply := open(t, ds, middleware, epoch)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("OPEN status %s", reply.Status)
+	}
+
+	reply = roundTrip(t, conn, &commondata.Request{Opcode: commondata.OpBitmaps, Tag: 2, Epoch: epoch})
+	if bitmaps, err := commondata.ParseBitmapsReply(reply); err != nil || !slices.Equal(bitmaps, []string{"backup"}) {
+		t.Fatalf("bitmaps %q, %v", bitmaps, err)
+	}
+
+	changes := []commondata.Request{
+		{Opcode: commondata.OpWrite, Offset: 64 << 10, Payload: make([]byte, 512)},
+		{Opcode: commondata.OpWriteZeroes, Offset: 512 << 10, Length: 128 << 10},
+		{Opcode: commondata.OpRead, Offset: 256 << 10, Length: 4096}, // Reads do not change the volume
+	}
+	for i := range changes {
+		changes[i].Tag, changes[i].Epoch = uint64(3+i), epoch
+		if reply := roundTrip(t, conn, &changes[i]); reply.Status != commondata.StatusOK {
+			t.Fatalf("%s status %s", changes[i].Opcode, reply.Status)
+		}
+	}
+
+	payload, err := commondata.DirtyMapPayload("backup", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirtyMap := &commondata.Request{Opcode: commondata.OpDirtyMap, Tag: 9, Epoch: epoch, Payload: payload}
+	reply = roundTrip(t, conn, dirtyMap)
+	if reply.Status != commondata.StatusOK {
+		t.Fatalf("DIRTY_MAP status %s", reply.Status)
+	}
+	extents, err := commondata.ParseExtentsReply(reply, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []commondata.Extent{
+		{Length: 64 << 10},
+		{Length: 64 << 10, Flags: commondata.ExtentDirty},
+		{Length: 384 << 10},
+		{Length: 128 << 10, Flags: commondata.ExtentDirty},
+		{Length: 384 << 10},
+	}
+	if !reflect.DeepEqual(extents, want) {
+		t.Fatalf("dirty extents %+v, want %+v", extents, want)
+	}
+
+	tests := []struct {
+		name   string
+		bitmap string
+		offset uint64
+		length uint32
+		status commondata.Status
+	}{
+		{name: "unknown bitmap", bitmap: "other", length: 4096, status: commondata.StatusInvalid},
+		{name: "empty range", bitmap: "backup", length: 0, status: commondata.StatusInvalid},
+		{name: "beyond the volume", bitmap: "backup", offset: 1<<20 - 512, length: 1024, status: commondata.StatusOutOfRange},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := commondata.DirtyMapPayload(test.bitmap, test.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &commondata.Request{Opcode: commondata.OpDirtyMap, Tag: 10, Epoch: epoch, Offset: test.offset, Payload: payload}
+			if reply := roundTrip(t, conn, req); reply.Status != test.status {
+				t.Fatalf("status %s, want %s", reply.Status, test.status)
+			}
+		})
+	}
+}
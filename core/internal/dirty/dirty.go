@@ -0,0 +1,224 @@
+// Package dirty tracks the changed ranges of the volumes in change tracking bitmaps (e.g. for incremental backups).
+//
+// The bitmaps of a volume are configured with the volume and start clean when they are created. They are kept in memory
+// and persisted to the data directory when core shuts down. A bitmap that was not persisted cleanly (e.g. core crashed)
+// is loaded with the whole volume dirty: changes are never missed, but the next incremental backup copies everything.
+package dirty
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"quorumbd.net/core/internal/config"
+)
+
+const granularity = 64 << 10 // Bytes tracked by a bit of the bitmaps // TOCONFIG
+
+// ErrUnknownBitmap is returned for bitmaps that are not configured for the volume
+var ErrUnknownBitmap = errors.New("unknown bitmap")
+
+// File format: magic, flags, granularity and volume size, followed by the bits as little endian words
+var fileMagic = [4]byte{'Q', 'B', 'D', 'B'}
+
+const (
+	headerSize        = 24
+	flagInUse  uint32 = 1 << 0 // Set while core runs, the bits on disk are outdated then
+)
+
+// Extent is a range of a volume that is either dirty or clean in a bitmap
+type Extent struct {
+	Offset uint64
+	Length uint64
+	Dirty  bool
+}
+
+// Tracker holds the bitmaps of all volumes. It is safe for concurrent use.
+type Tracker struct {
+	logger  *slog.Logger
+	volumes map[string]*volumeBitmaps // Not changed after Open
+}
+
+type volumeBitmaps struct {
+	size    uint64
+	names   []string
+	bitmaps map[string]*bitmap
+}
+
+type bitmap struct {
+	f    *os.File
+	mu   sync.Mutex
+	bits []uint64
+}
+
+// Open loads the bitmaps of the volumes from the data directory and marks them in use
+func Open(parentLogger *slog.Logger, dir string, volumes []config.VolumeConfig) (*Tracker, error) {
+	t := &Tracker{
+		logger:  parentLogger.With("module", "dirty"),
+		volumes: make(map[string]*volumeBitmaps),
+	}
+	for _, volume := range volumes {
+		if len(volume.Bitmaps) == 0 {
+			continue
+		}
+		vb := &volumeBitmaps{size: volume.Size, bitmaps: make(map[string]*bitmap)}
+		t.volumes[volume.ID] = vb
+		for _, name := range volume.Bitmaps {
+			path := filepath.Join(dir, url.PathEscape(volume.ID)+"."+url.PathEscape(name)+".bitmap")
+			b, err := t.load(path, volume.Size)
+			if err != nil {
+				_ = t.Close()
+				return nil, fmt.Errorf("loading bitmap %q of volume %q failed: %w", name, volume.ID, err)
+			}
+			vb.names = append(vb.names, name)
+			vb.bitmaps[name] = b
+		}
+		slices.Sort(vb.names)
+	}
+	return t, nil
+}
+
+// load reads a bitmap and persists it with the in-use flag
+func (t *Tracker) load(path string, size uint64) (*bitmap, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	words := (size + granularity*64 - 1) / (granularity * 64)
+	b := &bitmap{f: f, bits: make([]uint64, words)}
+
+	data, err := io.ReadAll(f)
+	switch {
+	case err != nil:
+		f.Close()
+		return nil, err
+	case len(data) == 0:
+		t.logger.Info("Bitmap created", "path", path)
+	case !validFile(data, size, words):
+		t.logger.Warn("Bitmap was not persisted cleanly, the whole volume is dirty", "path", path)
+		b.setRange(0, size)
+	default:
+		for i := range b.bits {
+			b.bits[i] = binary.LittleEndian.Uint64(data[headerSize+8*i:])
+		}
+	}
+
+	if err := b.persist(size, flagInUse); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func validFile(data []byte, size uint64, words uint64) bool {
+	return len(data) == headerSize+8*int(words) &&
+		[4]byte(data[0:4]) == fileMagic &&
+		binary.LittleEndian.Uint32(data[4:8])&flagInUse == 0 &&
+		binary.LittleEndian.Uint32(data[8:12]) == granularity &&
+		binary.LittleEndian.Uint64(data[16:24]) == size
+}
+
+// persist writes the bitmap with the flags and syncs it (b.mu must be held or the bitmap unused)
+func (b *bitmap) persist(size uint64, flags uint32) error {
+	data := make([]byte, headerSize, headerSize+8*len(b.bits))
+	copy(data[0:4], fileMagic[:])
+	binary.LittleEndian.PutUint32(data[4:8], flags)
+	binary.LittleEndian.PutUint32(data[8:12], granularity)
+	binary.LittleEndian.PutUint64(data[16:24], size)
+	for _, word := range b.bits {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	if _, err := b.f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if err := b.f.Truncate(int64(len(data))); err != nil {
+		return err
+	}
+	return b.f.Sync()
+}
+
+// setRange marks the bits of the granules overlapping [off, off+length)
+func (b *bitmap) setRange(off uint64, length uint64) {
+	for bit, last := off/granularity, (off+length-1)/granularity; bit <= last; bit++ {
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bitmap) isSet(bit uint64) bool {
+	return b.bits[bit/64]&(1<<(bit%64)) != 0
+}
+
+// Bitmaps returns the names of the bitmaps of the volume in ascending order
+func (t *Tracker) Bitmaps(volumeID string) []string {
+	if vb, ok := t.volumes[volumeID]; ok {
+		return slices.Clone(vb.names)
+	}
+	return nil
+}
+
+// Mark marks a range of the volume dirty in all its bitmaps. It is called before the range is changed.
+func (t *Tracker) Mark(volumeID string, off uint64, length uint64) {
+	vb, ok := t.volumes[volumeID]
+	if !ok || length == 0 {
+		return
+	}
+	for _, b := range vb.bitmaps {
+		b.mu.Lock()
+		b.setRange(off, length)
+		b.mu.Unlock()
+	}
+}
+
+// Extents returns the dirty and clean extents of [off, off+length) of a bitmap in ascending order, they cover the range
+// without gaps. The range must lie within the volume.
+func (t *Tracker) Extents(volumeID string, name string, off uint64, length uint64) ([]Extent, error) {
+	vb, ok := t.volumes[volumeID]
+	if !ok {
+		return nil, ErrUnknownBitmap
+	}
+	b, ok := vb.bitmaps[name]
+	if !ok {
+		return nil, ErrUnknownBitmap
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var extents []Extent
+	for pos, end := off, off+length; pos < end; {
+		bit := pos / granularity
+		dirty := b.isSet(bit)
+		next := min((bit+1)*granularity, end)
+		if n := len(extents); n > 0 && extents[n-1].Dirty == dirty {
+			extents[n-1].Length += next - pos
+		} else {
+			extents = append(extents, Extent{Offset: pos, Length: next - pos, Dirty: dirty})
+		}
+		pos = next
+	}
+	return extents, nil
+}
+
+// Close persists the bitmaps without the in-use flag. No volume may be changed afterwards.
+func (t *Tracker) Close() error {
+	var errs []error
+	for volumeID, vb := range t.volumes {
+		for name, b := range vb.bitmaps {
+			b.mu.Lock()
+			err := b.persist(vb.size, 0)
+			b.mu.Unlock()
+			if err != nil {
+				t.logger.Error("Persisting bitmap failed", "volume", volumeID, "bitmap", name, "error", err)
+				errs = append(errs, err)
+			}
+			errs = append(errs, b.f.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
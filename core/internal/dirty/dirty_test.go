@@ -0,0 +1,145 @@
+package dirty
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"quorumbd.net/core/internal/config"
+)
+
+const testSize = 1 << 20
+
+func openTracker(t *testing.T, dir string, bitmaps ...string) *Tracker {
+	t.Helper()
+	tracker, err := Open(slog.New(slog.DiscardHandler), dir, []config.VolumeConfig{
+		{ID: "vol-0", Size: testSize, Bitmaps: bitmaps},
+		{ID: "vol-1", Size: testSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+func extentsOf(t *testing.T, tracker *Tracker, bitmap string) []Extent {
+	t.Helper()
+	extents, err := tracker.Extents("vol-0", bitmap, 0, testSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return extents
+}
+
+func TestExtents(t *testing.T) {
+	tests := []struct {
+		name    string
+		marks   [][2]uint64 // Offset and length
+		off     uint64
+		length  uint64
+		extents []Extent
+	}{
+		{name: "clean", off: 0, length: testSize, extents: []Extent{{Offset: 0, Length: testSize}}},
+		{
+			name:    "granule",
+			marks:   [][2]uint64{{granularity, 1}},
+			off:     0,
+			length:  testSize,
+			extents: []Extent{{Offset: 0, Length: granularity}, {Offset: granularity, Length: granularity, Dirty: true}, {Offset: 2 * granularity, Length: testSize - 2*granularity}},
+		},
+		{
+			name:    "across granules",
+			marks:   [][2]uint64{{granularity - 1, 2}},
+			off:     0,
+			length:  3 * granularity,
+			extents: []Extent{{Offset: 0, Length: 2 * granularity, Dirty: true}, {Offset: 2 * granularity, Length: granularity}},
+		},
+		{
+			name:    "adjacent marks merge",
+			marks:   [][2]uint64{{0, granularity}, {granularity, granularity}},
+			off:     0,
+			length:  2 * granularity,
+			extents: []Extent{{Offset: 0, Length: 2 * granularity, Dirty: true}},
+		},
+		{
+			name:    "unaligned range",
+			marks:   [][2]uint64{{0, granularity}},
+			off:     100,
+			length:  granularity,
+			extents: []Extent{{Offset: 100, Length: granularity - 100, Dirty: true}, {Offset: granularity, Length: 100}},
+		},
+		{
+			name:    "end of the volume",
+			marks:   [][2]uint64{{testSize - 1, 1}},
+			off:     testSize - 512,
+			length:  512,
+			extents: []Extent{{Offset: testSize - 512, Length: 512, Dirty: true}},
+		},
+		{name: "empty mark", marks: [][2]uint64{{0, 0}}, off: 0, length: granularity, extents: []Extent{{Offset: 0, Length: granularity}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := openTracker(t, t.TempDir(), "backup")
+			defer tracker.Close()
+			for _, mark := range test.marks {
+				tracker.Mark("vol-0", mark[0], mark[1])
+			}
+			extents, err := tracker.Extents("vol-0", "backup", test.off, test.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(extents, test.extents) {
+				t.Fatalf("extents %+v, want %+v", extents, test.extents)
+			}
+		})
+	}
+}
+
+func TestUnknownBitmap(t *testing.T) {
+	tracker := openTracker(t, t.TempDir(), "backup")
+	defer tracker.Close()
+	if _, err := tracker.Extents("vol-0", "other", 0, testSize); !errors.Is(err, ErrUnknownBitmap) {
+		t.Fatalf("error %v, want %v", err, ErrUnknownBitmap)
+	}
+	if _, err := tracker.Extents("vol-1", "backup", 0, testSize); !errors.Is(err, ErrUnknownBitmap) {
+		t.Fatalf("error %v, want %v", err, ErrUnknownBitmap)
+	}
+	if bitmaps := tracker.Bitmaps("vol-1"); len(bitmaps) != 0 {
+		t.Fatalf("bitmaps %q of a volume without change tracking", bitmaps)
+	}
+	tracker.Mark("vol-1", 0, testSize) // Volumes without bitmaps are not tracked
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	tracker := openTracker(t, dir, "backup", "archive")
+	if bitmaps := tracker.Bitmaps("vol-0"); !reflect.DeepEqual(bitmaps, []string{"archive", "backup"}) {
+		t.Fatalf("bitmaps %q", bitmaps)
+	}
+	tracker.Mark("vol-0", 3*granularity, granularity)
+	marked := extentsOf(t, tracker, "backup")
+	if err := tracker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closed cleanly: the bits are restored, a new bitmap starts clean
+	tracker = openTracker(t, dir, "backup", "new")
+	if extents := extentsOf(t, tracker, "backup"); !reflect.DeepEqual(extents, marked) {
+		t.Fatalf("extents after a clean restart %+v, want %+v", extents, marked)
+	}
+	if extents := extentsOf(t, tracker, "new"); len(extents) != 1 || extents[0].Dirty {
+		t.Fatalf("extents of a new bitmap %+v", extents)
+	}
+
+	// Not closed (crash): the whole volume is dirty
+	tracker.Mark("vol-0", 0, 1)
+	for _, b := range tracker.volumes["vol-0"].bitmaps {
+		b.f.Close()
+	}
+	tracker = openTracker(t, dir, "backup")
+	defer tracker.Close()
+	if extents := extentsOf(t, tracker, "backup"); !reflect.DeepEqual(extents, []Extent{{Offset: 0, Length: testSize, Dirty: true}}) {
+		t.Fatalf("extents after a crash %+v", extents)
+	}
+}
@@ -0,0 +1,201 @@
+// Package inventory keeps track of the middlewares that are registered with core
+package inventory
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+// Entry is the inventory record of a middleware
+type Entry struct {
+	UUID         uuid.UUID
+	Middleware   commoncontrol.MiddlewareInfo
+	RemoteAddr   string
+	Connected    bool
+	RegisteredAt time.Time
+	LastSeen     time.Time
+	Clients      []commoncontrol.ClientInfo // As last reported by the middleware
+}
+
+// ExportLocation tells which middleware on which host serves an export of a volume
+type ExportLocation struct {
+	MiddlewareUUID uuid.UUID
+	Implementation string
+	Hostname       string
+	Connected      bool
+	Export         commoncontrol.ExportInfo
+	Clients        []commoncontrol.ClientInfo // Clients of the export as last reported by the middleware
+}
+
+type Inventory struct {
+	logger  *slog.Logger
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[uuid.UUID]*Entry
+}
+
+// New creates an inventory that expires entries not seen for longer than ttl
+func New(parentLogger *slog.Logger, ttl time.Duration) *Inventory {
+	return &Inventory{
+		logger:  parentLogger.With("module", "inventory"),
+		ttl:     ttl,
+		entries: make(map[uuid.UUID]*Entry),
+	}
+}
+
+// Register creates or replaces the entry of a middleware
+func (inv *Inventory) Register(id uuid.UUID, middleware commoncontrol.MiddlewareInfo, remoteAddr string) {
+	now := time.Now()
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	entry, ok := inv.entries[id]
+	if !ok {
+		entry = &Entry{UUID: id, RegisteredAt: now}
+		inv.entries[id] = entry
+		inv.logger.Info("Middleware registered", "uuid", id.String(), "implementation", middleware.Implementation, "hostname", middleware.Hostname, "version", middleware.Version)
+	} else {
+		inv.logger.Debug("Middleware registration updated", "uuid", id.String(), "exports", len(middleware.Exports))
+	}
+	entry.Middleware = middleware
+	entry.RemoteAddr = remoteAddr
+	entry.Connected = true
+	entry.LastSeen = now
+}
+
+// Touch updates the last seen timestamp of a middleware (returns false, if it is not registered)
+func (inv *Inventory) Touch(id uuid.UUID) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	entry, ok := inv.entries[id]
+	if !ok {
+		return false
+	}
+	entry.Connected = true
+	entry.LastSeen = time.Now()
+	return true
+}
+
+// UpdateClients replaces the connected clients of a middleware (returns false, if it is not registered)
+func (inv *Inventory) UpdateClients(id uuid.UUID, clients []commoncontrol.ClientInfo) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	entry, ok := inv.entries[id]
+	if !ok {
+		return false
+	}
+	entry.Clients = clients
+	entry.Connected = true
+	entry.LastSeen = time.Now()
+	return true
+}
+
+// Disconnected marks a middleware as disconnected. The entry stays until it expires.
+func (inv *Inventory) Disconnected(id uuid.UUID) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if entry, ok := inv.entries[id]; ok {
+		entry.Connected = false
+	}
+}
+
+// Get returns a copy of the entry of a middleware
+func (inv *Inventory) Get(id uuid.UUID) (Entry, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	entry, ok := inv.entries[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+// List returns copies of all entries sorted by hostname and implementation
+func (inv *Inventory) List() []Entry {
+	inv.mu.RLock()
+	entries := make([]Entry, 0, len(inv.entries))
+	for _, entry := range inv.entries {
+		entries = append(entries, *entry)
+	}
+	inv.mu.RUnlock()
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if c := strings.Compare(a.Middleware.Hostname, b.Middleware.Hostname); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Middleware.Implementation, b.Middleware.Implementation)
+	})
+	return entries
+}
+
+// FindVolume answers which host has the volume open via which frontend
+func (inv *Inventory) FindVolume(volumeID string) []ExportLocation {
+	var locations []ExportLocation
+	for _, entry := range inv.List() {
+		for _, export := range entry.Middleware.Exports {
+			if export.VolumeID != volumeID {
+				continue
+			}
+			location := ExportLocation{
+				MiddlewareUUID: entry.UUID,
+				Implementation: entry.Middleware.Implementation,
+				Hostname:       entry.Middleware.Hostname,
+				Connected:      entry.Connected,
+				Export:         export,
+			}
+			for _, client := range entry.Clients {
+				if client.Export == export.Name {
+					location.Clients = append(location.Clients, client)
+				}
+			}
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+// Expire removes all entries not seen since ttl and returns their UUIDs
+func (inv *Inventory) Expire(now time.Time) []uuid.UUID {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var expired []uuid.UUID
+	for id, entry := range inv.entries {
+		if now.Sub(entry.LastSeen) > inv.ttl {
+			expired = append(expired, id)
+			delete(inv.entries, id)
+			inv.logger.Info("Middleware expired", "uuid", id.String(), "hostname", entry.Middleware.Hostname, "last_seen", entry.LastSeen)
+		}
+	}
+	return expired
+}
+
+// Run expires stale entries periodically until ctx is done and calls expired for each of them
+func (inv *Inventory) Run(ctx context.Context, expired func(uuid.UUID)) {
+	ticker := time.NewTicker(max(inv.ttl/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range inv.Expire(now) {
+				expired(id)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package inventory
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+func newTestInventory(ttl time.Duration) *Inventory {
+	return New(slog.New(slog.DiscardHandler), ttl)
+}
+
+func TestRegister(t *testing.T) {
+	inv := newTestInventory(time.Minute)
+	id := uuid.New()
+	if inv.Touch(id) || inv.UpdateClients(id, nil) {
+		t.Fatal("unregistered middleware touched")
+	}
+	if _, ok := inv.Get(id); ok {
+		t.Fatal("unregistered middleware found")
+	}
+
+	info := commoncontrol.MiddlewareInfo{UUID: id.String(), Implementation: "qemu-nbd", Hostname: "host1", Version: "1"}
+	inv.Register(id, info, "10.0.0.1:4000")
+	entry, ok := inv.Get(id)
+	if !ok || entry.Middleware.Hostname != "host1" || entry.RemoteAddr != "10.0.0.1:4000" || !entry.Connected || entry.RegisteredAt.IsZero() {
+		t.Fatalf("entry %+v", entry)
+	}
+	registeredAt := entry.RegisteredAt
+
+	// A new registration replaces the info and keeps the registration time
+	info.Version = "2"
+	inv.Register(id, info, "10.0.0.1:4001")
+	inv.Disconnected(id)
+	entry, _ = inv.Get(id)
+	if entry.Middleware.Version != "2" || entry.RemoteAddr != "10.0.0.1:4001" || entry.Connected || !entry.RegisteredAt.Equal(registeredAt) {
+		t.Fatalf("entry after the second registration %+v", entry)
+	}
+
+	// Reports mark the middleware connected again
+	clients := []commoncontrol.ClientInfo{{ID: 1, Export: "vm1"}}
+	if !inv.UpdateClients(id, clients) {
+		t.Fatal("clients of a registered middleware not updated")
+	}
+	entry, _ = inv.Get(id)
+	if !entry.Connected || len(entry.Clients) != 1 || entry.Clients[0].ID != 1 {
+		t.Fatalf("entry after the client report %+v", entry)
+	}
+}
+
+func TestList(t *testing.T) {
+	inv := newTestInventory(time.Minute)
+	for _, info := range []commoncontrol.MiddlewareInfo{
+		{Implementation: "qemu-nbd", Hostname: "host2"},
+		{Implementation: "vhost-user-blk", Hostname: "host1"},
+		{Implementation: "qemu-nbd", Hostname: "host1"},
+	} {
+		inv.Register(uuid.New(), info, "")
+	}
+
+	var got []string
+	for _, entry := range inv.List() {
+		got = append(got, entry.Middleware.Hostname+"/"+entry.Middleware.Implementation)
+	}
+	if want := []string{"host1/qemu-nbd", "host1/vhost-user-blk", "host2/qemu-nbd"}; !slices.Equal(got, want) {
+		t.Fatalf("entries %q, want %q", got, want)
+	}
+}
+
+func TestFindVolume(t *testing.T) {
+	inv := newTestInventory(time.Minute)
+	nbd, vhost := uuid.New(), uuid.New()
+	inv.Register(nbd, commoncontrol.MiddlewareInfo{Implementation: "qemu-nbd", Hostname: "host1", Exports: []commoncontrol.ExportInfo{
+		{Name: "vm1", VolumeID: "vol-1"},
+		{Name: "vm2", VolumeID: "vol-2"},
+	}}, "")
+	inv.Register(vhost, commoncontrol.MiddlewareInfo{Implementation: "vhost-user-blk", Hostname: "host2", Exports: []commoncontrol.ExportInfo{
+		{Name: "disk", VolumeID: "vol-1", ReadOnly: true},
+	}}, "")
+	inv.UpdateClients(nbd, []commoncontrol.ClientInfo{{ID: 1, Export: "vm1"}, {ID: 2, Export: "vm2"}, {ID: 3, Export: "vm1"}})
+	inv.Disconnected(vhost)
+
+	locations := inv.FindVolume("vol-1")
+	if len(locations) != 2 {
+		t.Fatalf("locations %+v", locations)
+	}
+	if l := locations[0]; l.MiddlewareUUID != nbd || l.Hostname != "host1" || l.Export.Name != "vm1" || !l.Connected || len(l.Clients) != 2 || l.Clients[0].ID != 1 || l.Clients[1].ID != 3 {
+		t.Fatalf("location on host1 %+v", l)
+	}
+	if l := locations[1]; l.MiddlewareUUID != vhost || l.Implementation != "vhost-user-blk" || !l.Export.ReadOnly || l.Connected || len(l.Clients) != 0 {
+		t.Fatalf("location on host2 %+v", l)
+	}
+	if locations := inv.FindVolume("vol-3"); len(locations) != 0 {
+		t.Fatalf("locations of an unknown volume %+v", locations)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	inv := newTestInventory(time.Minute)
+	stale, fresh := uuid.New(), uuid.New()
+	inv.Register(stale, commoncontrol.MiddlewareInfo{Hostname: "stale"}, "")
+	inv.Register(fresh, commoncontrol.MiddlewareInfo{Hostname: "fresh"}, "")
+
+	if expired := inv.Expire(time.Now().Add(30 * time.Second)); len(expired) != 0 {
+		t.Fatalf("expired %v within the ttl", expired)
+	}
+	inv.mu.Lock()
+	inv.entries[stale].LastSeen = time.Now().Add(-2 * time.Minute)
+	inv.mu.Unlock()
+	if expired := inv.Expire(time.Now()); !slices.Equal(expired, []uuid.UUID{stale}) {
+		t.Fatalf("expired %v, want %v", expired, stale)
+	}
+	if _, ok := inv.Get(stale); ok {
+		t.Fatal("expired middleware still in the inventory")
+	}
+	if _, ok := inv.Get(fresh); !ok {
+		t.Fatal("fresh middleware expired")
+	}
+}
+
+func TestRun(t *testing.T) {
+	inv := newTestInventory(10 * time.Millisecond)
+	id := uuid.New()
+	inv.Register(id, commoncontrol.MiddlewareInfo{}, "")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	expired := make(chan uuid.UUID, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inv.Run(ctx, func(id uuid.UUID) { expired <- id })
+	}()
+	select {
+	case got := <-expired:
+		if got != id {
+			t.Fatalf("expired %v, want %v", got, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("middleware not expired")
+	}
+	cancel()
+	<-done
+}
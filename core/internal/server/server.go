@@ -0,0 +1,173 @@
+// Package server provides the listeners of core and dispatches accepted connections by their preamble
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"quorumbd.net/common/systemd"
+)
+
+const (
+	defaultTCPPort  = "7447"
+	preambleTimeout = 5 * time.Second // TOCONFIG
+)
+
+// Handler serves a connection after its preamble and the UUID of the peer have been read
+type Handler interface {
+	ServeConn(ctx context.Context, conn net.Conn, peerUUID uuid.UUID)
+}
+
+type Server struct {
+	logger    *slog.Logger
+	listen    []string
+	handlers  map[[4]byte]Handler
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	serving   atomic.Bool
+}
+
+func New(parentLogger *slog.Logger, listen []string) *Server {
+	return &Server{
+		logger:   parentLogger.With("module", "server"),
+		listen:   listen,
+		handlers: make(map[[4]byte]Handler),
+	}
+}
+
+// Handle registers the handler for connections starting with the given preamble (must be called before Run)
+func (s *Server) Handle(preamble [4]byte, handler Handler) {
+	s.handlers[preamble] = handler
+}
+
+// Listen opens the listeners of all configured addresses (socket activated ones are taken over)
+func (s *Server) Listen() error {
+	for _, uri := range s.listen {
+		ln, err := listen(uri)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.logger.Info("Listening", "address", uri, "socket_activated", systemd.IsActivated(ln))
+		s.listeners = append(s.listeners, ln)
+	}
+	return nil
+}
+
+// Serve accepts connections on the listeners opened by Listen until ctx is done
+func (s *Server) Serve(ctx context.Context) error {
+	s.serving.Store(true)
+	defer s.serving.Store(false)
+
+	errCh := make(chan error, len(s.listeners))
+	for _, ln := range s.listeners {
+		s.wg.Go(func() {
+			errCh <- s.acceptLoop(ctx, ln)
+		})
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+	}
+
+	s.closeListeners()
+	s.wg.Wait()
+	return err
+}
+
+// Serving returns true, as long as the accept loops are running
+func (s *Server) Serving() bool {
+	return s.serving.Load()
+}
+
+func (s *Server) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+func (s *Server) acceptLoop(ctx context.Context, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		s.wg.Go(func() {
+			s.serveConn(ctx, conn)
+		})
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-connCtx.Done()
+		conn.Close()
+	}()
+
+	var head [4 + 16]byte
+	if err := conn.SetReadDeadline(time.Now().Add(preambleTimeout)); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		if errors.Is(err, io.EOF) { // Reachability probes of the middlewares connect and close immediately
+			s.logger.Debug("Connection closed before preamble", "remote", conn.RemoteAddr().String())
+			return
+		}
+		s.logger.Warn("Reading preamble failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	var preamble [4]byte
+	copy(preamble[:], head[:4])
+	peerUUID, err := uuid.FromBytes(head[4:])
+	if err != nil {
+		s.logger.Warn("Invalid peer UUID", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+
+	handler, ok := s.handlers[preamble]
+	if !ok {
+		s.logger.Warn("Unknown preamble", "remote", conn.RemoteAddr().String(), "preamble", fmt.Sprintf("%q", preamble[:]))
+		return
+	}
+
+	handler.ServeConn(connCtx, conn, peerUUID)
+}
+
+func listen(uri string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(uri, "unix://"):
+		return systemd.Listen("unix", strings.TrimPrefix(uri, "unix://"))
+	case strings.HasPrefix(uri, "tcp://"):
+		address := strings.TrimPrefix(uri, "tcp://")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, defaultTCPPort)
+		}
+		return systemd.Listen("tcp", address)
+	}
+	return nil, fmt.Errorf("invalid listen URI: %s", uri)
+}
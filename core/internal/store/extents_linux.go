@@ -0,0 +1,58 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// mapExtents maps the range of the file with SEEK_DATA and SEEK_HOLE. File systems without support report everything as
+// data, which is correct but not sparse.
+func mapExtents(f *os.File, off int64, length int64) ([]Extent, error) {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var extents []Extent
+	var seekErr error
+	end := off + length
+	if err := rawConn.Control(func(fd uintptr) {
+		for pos := off; pos < end; {
+			// The result of lseek is the one of the call, concurrent calls only race on the unused file offset
+			data, err := syscall.Seek(int(fd), pos, seekData)
+			if errors.Is(err, syscall.ENXIO) {
+				data = end // No data after pos
+			} else if err != nil {
+				seekErr = err
+				return
+			}
+			if data > pos {
+				extents = append(extents, Extent{Offset: pos, Length: min(data, end) - pos, Hole: true})
+				pos = data
+			}
+			if pos >= end {
+				return
+			}
+
+			hole, err := syscall.Seek(int(fd), pos, seekHole)
+			if err != nil {
+				seekErr = err
+				return
+			}
+			extents = append(extents, Extent{Offset: pos, Length: min(hole, end) - pos})
+			pos = hole
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if errors.Is(seekErr, syscall.EINVAL) || errors.Is(seekErr, syscall.EOPNOTSUPP) {
+		return []Extent{{Offset: off, Length: length}}, nil
+	}
+	return extents, seekErr
+}
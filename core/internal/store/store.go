@@ -0,0 +1,135 @@
+// Package store provides the data of the volumes of core
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+// ErrNotSupported is returned by WriteZeroes with fast set, if the range cannot be zeroed without writing zeroes
+var ErrNotSupported = errors.New("operation not supported")
+
+const zeroChunkSize = 1 << 20 // Zeroes written at once, if the file system cannot deallocate ranges
+
+// Store opens the volumes
+type Store interface {
+	Open(info commoncontrol.VolumeInfo) (Volume, error)
+}
+
+// Volume is an open volume. Ranges are validated by the caller. Implementations must be safe for concurrent use.
+type Volume interface {
+	ReadAt(p []byte, off int64) error
+	WriteAt(p []byte, off int64, fua bool) error
+	// Flush makes all completed writes of the volume durable, including those of other opens
+	Flush() error
+	// Trim deallocates the range, it reads as zeroes afterwards
+	Trim(off int64, length int64) error
+	// WriteZeroes zeroes the range, deallocating it unless noHole is set. With fast it fails with ErrNotSupported
+	// instead of writing zeroes.
+	WriteZeroes(off int64, length int64, noHole bool, fast bool) error
+	// Extents returns the allocation of the range in ascending order, the extents cover it without gaps
+	Extents(off int64, length int64) ([]Extent, error)
+	Close() error
+}
+
+// Extent is a range of a volume with uniform allocation, holes read as zeroes
+type Extent struct {
+	Offset int64
+	Length int64
+	Hole   bool
+}
+
+// FileStore keeps every volume in a sparse file of the data directory
+type FileStore struct {
+	dir string
+	mu  sync.Mutex // Serializes creating and growing the files
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating data directory failed: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Open opens the file of the volume, it is created or grown to the size of the volume
+func (fs *FileStore) Open(info commoncontrol.VolumeInfo) (Volume, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := filepath.Join(fs.dir, url.PathEscape(info.ID)+".img")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if size := int64(info.Size); stat.Size() < size {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("growing %s failed: %w", path, err)
+		}
+	}
+	return &fileVolume{f: f}, nil
+}
+
+type fileVolume struct {
+	f *os.File
+}
+
+func (v *fileVolume) ReadAt(p []byte, off int64) error {
+	_, err := v.f.ReadAt(p, off)
+	return err
+}
+
+func (v *fileVolume) WriteAt(p []byte, off int64, fua bool) error {
+	if _, err := v.f.WriteAt(p, off); err != nil {
+		return err
+	}
+	if fua {
+		return v.f.Sync()
+	}
+	return nil
+}
+
+func (v *fileVolume) Flush() error {
+	return v.f.Sync()
+}
+
+func (v *fileVolume) Trim(off int64, length int64) error {
+	return v.WriteZeroes(off, length, false, false)
+}
+
+func (v *fileVolume) WriteZeroes(off int64, length int64, noHole bool, fast bool) error {
+	err := zeroRange(v.f, off, length, noHole)
+	if !errors.Is(err, ErrNotSupported) || fast {
+		return err
+	}
+
+	zeroes := make([]byte, min(length, zeroChunkSize))
+	for end := off + length; off < end; {
+		n := min(int64(len(zeroes)), end-off)
+		if _, err := v.f.WriteAt(zeroes[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+func (v *fileVolume) Extents(off int64, length int64) ([]Extent, error) {
+	return mapExtents(v.f, off, length)
+}
+
+func (v *fileVolume) Close() error {
+	return v.f.Close()
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+)
+
+// zeroRange zeroes the range of the file without writing zeroes: by punching a hole or, with noHole, by converting it
+// to unwritten extents. ErrNotSupported is returned, if the file system supports neither.
+func zeroRange(f *os.File, off int64, length int64, noHole bool) error {
+	mode := uint32(fallocPunchHole | fallocKeepSize)
+	if noHole {
+		mode = fallocZeroRange | fallocKeepSize
+	}
+
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fallocErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		for {
+			fallocErr = syscall.Fallocate(int(fd), mode, off, length)
+			if !errors.Is(fallocErr, syscall.EINTR) {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if errors.Is(fallocErr, syscall.EOPNOTSUPP) || errors.Is(fallocErr, syscall.ENOSYS) {
+		return ErrNotSupported
+	}
+	return fallocErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package store
+
+import (
+	"os"
+)
+
+func zeroRange(*os.File, int64, int64, bool) error {
+	return ErrNotSupported
+}
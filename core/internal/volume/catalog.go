@@ -0,0 +1,82 @@
+// Package volume provides the catalogue of the volumes known to core
+package volume
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/core/internal/config"
+)
+
+type entry struct {
+	info        commoncontrol.VolumeInfo
+	middlewares []uuid.UUID // empty: visible to all middlewares
+}
+
+type Catalog struct {
+	volumes []entry
+}
+
+// NewCatalog creates the catalogue from the configured volumes (which must be validated)
+func NewCatalog(volumes []config.VolumeConfig) *Catalog {
+	catalog := &Catalog{volumes: make([]entry, 0, len(volumes))}
+	for _, volume := range volumes {
+		e := entry{
+			info: commoncontrol.VolumeInfo{
+				ID:        volume.ID,
+				Name:      volume.Name,
+				Size:      volume.Size,
+				BlockSize: volume.BlockSize,
+				ReadOnly:  volume.ReadOnly,
+				Labels:    volume.Labels,
+			},
+		}
+		for _, middleware := range volume.Middlewares {
+			e.middlewares = append(e.middlewares, uuid.MustParse(middleware))
+		}
+		catalog.volumes = append(catalog.volumes, e)
+	}
+	slices.SortFunc(catalog.volumes, func(a, b entry) int {
+		return strings.Compare(a.info.Name, b.info.Name)
+	})
+	return catalog
+}
+
+// Visible returns the volumes the middleware may see, sorted by name. A non-empty name restricts the result to that volume.
+func (catalog *Catalog) Visible(middleware uuid.UUID, name string) []commoncontrol.VolumeInfo {
+	var volumes []commoncontrol.VolumeInfo
+	for _, e := range catalog.volumes {
+		if name != "" && e.info.Name != name {
+			continue
+		}
+		if len(e.middlewares) > 0 && !slices.Contains(e.middlewares, middleware) {
+			continue
+		}
+		volumes = append(volumes, e.info)
+	}
+	return volumes
+}
+
+// Lookup returns the volume with the id, if it is visible to the middleware
+func (catalog *Catalog) Lookup(middleware uuid.UUID, volumeID string) (commoncontrol.VolumeInfo, bool) {
+	for _, e := range catalog.volumes {
+		if e.info.ID == volumeID && (len(e.middlewares) == 0 || slices.Contains(e.middlewares, middleware)) {
+			return e.info, true
+		}
+	}
+	return commoncontrol.VolumeInfo{}, false
+}
+
+// IsVisible returns true, if the volume with the id is visible to the middleware
+func (catalog *Catalog) IsVisible(middleware uuid.UUID, volumeID string) bool {
+	for _, e := range catalog.volumes {
+		if e.info.ID == volumeID {
+			return len(e.middlewares) == 0 || slices.Contains(e.middlewares, middleware)
+		}
+	}
+	return false
+}
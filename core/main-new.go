@@ -1,35 +1,143 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	commoncontrol "quorumbd.net/common/control"
+	commondata "quorumbd.net/common/data"
+	"quorumbd.net/common/logging"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/core/internal/admin"
+	"quorumbd.net/core/internal/attachment"
 	"quorumbd.net/core/internal/config"
+	"quorumbd.net/core/internal/controlserver"
+	"quorumbd.net/core/internal/dataserver"
+	"quorumbd.net/core/internal/dirty"
+	"quorumbd.net/core/internal/inventory"
+	"quorumbd.net/core/internal/server"
+	"quorumbd.net/core/internal/store"
+	"quorumbd.net/core/internal/volume"
 )
 
 func mainNew() {
-	core, err := newCore()
-	if err != nil {
+	if err := runNew(); err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
-	core.run()
+}
+
+func runNew() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	if err := logging.Initialize(cfg.LoggingConfig); err != nil {
+		return err
+	}
+
+	core, err := newCore(cfg, logging.GetDefaultLogger())
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := core.run(ctx); err != nil {
+		return err
+	}
+
+	return logging.CloseLogging()
 }
 
 type core struct {
-	config *config.Config
+	config        *config.Config
+	logger        *slog.Logger
+	notifier      *systemd.Notifier
+	inventory     *inventory.Inventory
+	controlServer *controlserver.ControlServer
+	tracker       *dirty.Tracker
+	server        *server.Server
 }
 
-func newCore() (*core, error) {
-	config, err := config.Load()
+func newCore(cfg *config.Config, logger *slog.Logger) (*core, error) {
+	inv := inventory.New(logger, 60*time.Second) // TOCONFIG
+	catalog := volume.NewCatalog(cfg.Volumes)
+	volumeStore, err := store.NewFileStore(cfg.CoreConfig.DataDir)
 	if err != nil {
 		return nil, err
 	}
+	tracker, err := dirty.Open(logger, cfg.CoreConfig.DataDir, cfg.Volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := attachment.New(logger)
+	controlServer := controlserver.New(logger, inv, catalog, attachments)
+
+	srv := server.New(logger, cfg.CoreConfig.Listen)
+	srv.Handle(commoncontrol.Preamble, controlServer)
+	srv.Handle(commondata.Preamble, dataserver.New(logger, catalog, attachments, volumeStore, tracker, controlServer))
+	srv.Handle(commoncontrol.AdminPreamble, admin.New(logger, controlServer, inv))
+
 	return &core{
-		config: config,
+		config:        cfg,
+		logger:        logger,
+		notifier:      systemd.NotifierFromEnv(),
+		inventory:     inv,
+		controlServer: controlServer,
+		tracker:       tracker,
+		server:        srv,
 	}, nil
 }
 
-func (c *core) run() {
-	panic("unimplemented")
+func (c *core) run(ctx context.Context) error {
+	c.logger.Info("Core is about to start ...")
+	defer func() {
+		// The data connections are closed, so no volume changes anymore
+		if err := c.tracker.Close(); err != nil {
+			c.logger.Error("Persisting the change tracking bitmaps failed", "error", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := c.server.Listen(); err != nil {
+		c.logger.Error("Core is exiting with error", "error", err)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		c.inventory.Run(ctx, c.controlServer.MiddlewareExpired)
+	})
+	wg.Go(func() {
+		c.notifier.RunWatchdog(ctx, systemd.WatchdogInterval(), c.server.Serving)
+	})
+
+	if err := c.notifier.Notify("READY=1", "STATUS=Serving"); err != nil {
+		c.logger.Warn("Notifying service manager failed", "error", err)
+	}
+
+	err := c.server.Serve(ctx)
+	_ = c.notifier.Stopping()
+	cancel()
+	wg.Wait()
+
+	if err != nil {
+		c.logger.Error("Core is exiting with error", "error", err)
+		return err
+	}
+	c.logger.Info("Core is exiting ...")
+	return nil
 }
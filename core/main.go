@@ -13,7 +13,12 @@ import (
 )
 
 func main() {
-	startFakeCore()
+	// The fake core accepts and drops connections, e.g. to test the reconnects of middlewares
+	if os.Getenv("QUORUMBD_FAKE_CORE") != "" {
+		startFakeCore()
+		return
+	}
+	mainNew()
 }
 
 func startFakeCore() {
@@ -0,0 +1,84 @@
+// Package acl implements the access control of exports by the identities of their clients
+package acl
+
+import (
+	"path"
+	"slices"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/config"
+)
+
+// Peer identifies a client with the identities of the control plane, which middlewares report to core in
+// commoncontrol.ClientInfo
+type Peer struct {
+	Credentials *commoncontrol.PeerCredentials // Only for unix socket peers
+	TLSIdentity string                         // Subject common name of the verified client certificate, or the PSK identity
+}
+
+// Describe sets the identities of the peer in the client info reported to core
+func (peer Peer) Describe(client *commoncontrol.ClientInfo) {
+	client.Credentials = peer.Credentials
+	client.TLSIdentity = peer.TLSIdentity
+}
+
+// Access is the access of a peer to an export
+type Access int
+
+const (
+	AccessDenied Access = iota
+	AccessReadOnly
+	AccessReadWrite
+)
+
+// Authorizer decides which exports a peer may access
+type Authorizer interface {
+	Authorize(peer Peer, export string) Access
+}
+
+// ACL is an Authorizer backed by the ACL rules of a config
+type ACL struct {
+	rules []config.ACLRule
+}
+
+// New returns the ACL for the rules. Without rules every peer may access every export.
+func New(rules []config.ACLRule) *ACL {
+	return &ACL{rules: rules}
+}
+
+// Authorize is an interface method of Authorizer: the first rule that applies to the peer and the export decides
+func (acl *ACL) Authorize(peer Peer, export string) Access {
+	if len(acl.rules) == 0 {
+		return AccessReadWrite
+	}
+	for _, rule := range acl.rules {
+		if matched, _ := path.Match(rule.Exports, export); !matched || !applies(rule, peer) {
+			continue
+		}
+		if rule.ReadOnly {
+			return AccessReadOnly
+		}
+		return AccessReadWrite
+	}
+	return AccessDenied
+}
+
+func applies(rule config.ACLRule, peer Peer) bool {
+	if peer.TLSIdentity != "" && slices.Contains(rule.TLSIdentities, peer.TLSIdentity) {
+		return true
+	}
+	creds := peer.Credentials
+	if creds == nil {
+		return false
+	}
+	if slices.Contains(rule.UIDs, creds.UID) {
+		return true
+	}
+	for _, gid := range creds.GIDs {
+		if slices.Contains(rule.GIDs, gid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package acl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"testing"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/config"
+)
+
+func TestAuthorize(t *testing.T) {
+	rules := []config.ACLRule{
+		{Exports: "backup-*", TLSIdentities: []string{"backup.example.com"}, ReadOnly: true},
+		{Exports: "vm-*", UIDs: []uint32{1000}},
+		{Exports: "*", GIDs: []uint32{64}, ReadOnly: true},
+		{Exports: "shared", GIDs: []uint32{100}},
+	}
+	user := func(uid uint32, gids ...uint32) Peer {
+		return Peer{Credentials: &commoncontrol.PeerCredentials{PID: 1, UID: uid, GIDs: gids}}
+	}
+	tests := []struct {
+		name   string
+		rules  []config.ACLRule
+		peer   Peer
+		export string
+		access Access
+	}{
+		{name: "no rules", peer: Peer{}, export: "vm-1", access: AccessReadWrite},
+		{name: "TLS identity", rules: rules, peer: Peer{TLSIdentity: "backup.example.com"}, export: "backup-1", access: AccessReadOnly},
+		{name: "TLS identity of another export", rules: rules, peer: Peer{TLSIdentity: "backup.example.com"}, export: "vm-1", access: AccessDenied},
+		{name: "unknown TLS identity", rules: rules, peer: Peer{TLSIdentity: "other.example.com"}, export: "backup-1", access: AccessDenied},
+		{name: "uid", rules: rules, peer: user(1000, 1000), export: "vm-1", access: AccessReadWrite},
+		{name: "uid of another export", rules: rules, peer: user(1000, 1000), export: "shared", access: AccessDenied},
+		{name: "primary group", rules: rules, peer: user(1001, 64), export: "vm-1", access: AccessReadOnly},
+		{name: "supplementary group", rules: rules, peer: user(1001, 1001, 100), export: "shared", access: AccessReadWrite},
+		{name: "first rule wins", rules: rules, peer: user(1001, 1001, 64, 100), export: "shared", access: AccessReadOnly},
+		{name: "no credentials", rules: rules, peer: Peer{}, export: "shared", access: AccessDenied},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if access := New(test.rules).Authorize(test.peer, test.export); access != test.access {
+				t.Fatalf("access %d, want %d", access, test.access)
+			}
+		})
+	}
+}
+
+func TestPeerOf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	peer, err := PeerOf(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := peer.Credentials
+	if creds == nil || creds.PID != int32(os.Getpid()) || creds.UID != uint32(os.Getuid()) || len(creds.GIDs) == 0 || creds.GIDs[0] != uint32(os.Getgid()) {
+		t.Fatalf("credentials %+v", creds)
+	}
+	groups, _ := os.Getgroups()
+	for _, gid := range groups {
+		if !slices.Contains(creds.GIDs, uint32(gid)) {
+			t.Fatalf("group %d missing in %v", gid, creds.GIDs)
+		}
+	}
+	if exe := PeerExecutable(creds.PID); exe == "unknown" {
+		t.Fatal("executable of the peer unknown")
+	}
+
+	// tcp peers have no credentials
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	tcpClient, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	if peer, err := PeerOf(tcpClient); err != nil || peer.Credentials != nil {
+		t.Fatalf("tcp peer %+v (%v)", peer, err)
+	}
+}
+
+func TestTLSIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    *tls.ConnectionState
+		identity string
+	}{
+		{name: "no TLS", state: nil},
+		{name: "no certificate", state: &tls.ConnectionState{}},
+		{name: "certificate", state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "host.example.com"}}}}, identity: "host.example.com"},
+	}
+	for _, test := range tests {
+		if identity := TLSIdentity(test.state); identity != test.identity {
+			t.Errorf("%s: identity %q, want %q", test.name, identity, test.identity)
+		}
+	}
+}
+
+// TestDescribe checks that the identities the ACL matches are the ones reported to core
+func TestDescribe(t *testing.T) {
+	peer := Peer{Credentials: &commoncontrol.PeerCredentials{PID: 42, UID: 1000, GIDs: []uint32{1000, 100}}, TLSIdentity: "host.example.com"}
+	client := commoncontrol.ClientInfo{ID: 7}
+	peer.Describe(&client)
+	want := commoncontrol.ClientInfo{ID: 7, Credentials: peer.Credentials, TLSIdentity: peer.TLSIdentity}
+	if !reflect.DeepEqual(client, want) {
+		t.Fatalf("client info %+v, want %+v", client, want)
+	}
+}
@@ -0,0 +1,28 @@
+package acl
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// PeerOf returns the peer of a new connection. Credentials are only available for unix sockets, the TLS identity is
+// known once the handshake completed.
+func PeerOf(netConn net.Conn) (Peer, error) {
+	unixConn, ok := netConn.(*net.UnixConn)
+	if !ok {
+		return Peer{}, nil
+	}
+	creds, err := peerCredentials(unixConn)
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{Credentials: creds}, nil
+}
+
+// TLSIdentity returns the identity of the client certificate of a TLS connection (empty without certificate)
+func TLSIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,72 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+func peerCredentials(unixConn *net.UnixConn) (*commoncontrol.PeerCredentials, error) {
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ucred   *syscall.Ucred
+		sockErr error
+	)
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, sockErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_PEERCRED failed: %w", sockErr)
+	}
+
+	creds := &commoncontrol.PeerCredentials{PID: ucred.Pid, UID: ucred.Uid, GIDs: []uint32{ucred.Gid}}
+	creds.GIDs = append(creds.GIDs, supplementaryGroups(ucred.Pid, ucred.Gid)...)
+	return creds, nil
+}
+
+// supplementaryGroups reads the supplementary groups of a process from procfs (best effort, nil on errors)
+func supplementaryGroups(pid int32, primary uint32) []uint32 {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		groups, ok := strings.CutPrefix(scanner.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		var gids []uint32
+		for _, field := range strings.Fields(groups) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil && uint32(gid) != primary {
+				gids = append(gids, uint32(gid))
+			}
+		}
+		return gids
+	}
+	return nil
+}
+
+// PeerExecutable returns the executable of a peer process for logging
+func PeerExecutable(pid int32) string {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "unknown"
+	}
+	return exe
+}
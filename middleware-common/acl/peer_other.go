@@ -0,0 +1,19 @@
+//go:build !linux
+
+package acl
+
+import (
+	"errors"
+	"net"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+func peerCredentials(*net.UnixConn) (*commoncontrol.PeerCredentials, error) {
+	return nil, errors.New("peer credentials are only supported on linux")
+}
+
+// PeerExecutable returns the executable of a peer process for logging
+func PeerExecutable(int32) string {
+	return "unknown"
+}
@@ -1,13 +1,62 @@
 package app
 
+import (
+	"context"
+	"net"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// Adaptor is the contract between the app and a protocol frontend (e.g. qemu-nbd).
+// The app drives the lifecycle and the exports, the adaptor only translates its protocol to backend.BlockBackend calls.
 type Adaptor interface {
 	GetImplementationName() string
 	IsServer() bool
-	Listen() error
+	// ListenAddresses returns the URIs the adaptor listens on (reported to the inventory of core)
+	ListenAddresses() []string
+
+	// Start is called once a core connection is established. It must not block; serving happens in own go routines.
+	Start(ctx context.Context) error
+	// Stop shuts the frontend down and closes all client connections. It is called before the app exits.
+	Stop(ctx context.Context) error
+
+	// AttachExport is called when core attaches an export to this middleware
+	AttachExport(export backend.Export, blockBackend backend.BlockBackend) error
+	// DetachExport is called when core detaches an export. The backend is closed by the app after the call returns.
+	DetachExport(name string) error
+}
+
+// ClientAdaptor must be implemented by adaptors that are not servers (IsServer() == false).
+// The app dials the targets while a core connection is up and hands every established connection to ServeConn.
+type ClientAdaptor interface {
+	Adaptor
+
+	// Targets returns the URIs (unix://<path> or tcp://<host:port>) to connect to
+	Targets() []string
+	// ServeConn serves an outbound connection until it fails or ctx is done. The app closes conn afterwards and dials the
+	// target again with backoff, unless the error is wrapped with errorhelper.Fatal, which stops the middleware.
+	ServeConn(ctx context.Context, target string, conn net.Conn) error
+}
+
+// StatusReporter may be implemented by adaptors to extend the status line reported to the service manager
+// (e.g. shown by systemctl status). Status is polled periodically and should return a short single line.
+type StatusReporter interface {
+	Status() string
 }
 
-// TODO: Receive
-// TODO: Reply
-// TODO: Common structs and commands and mapper for receive and reply
+// ClientReporter may be implemented by adaptors to report their connected clients to core and to let core disconnect them
+type ClientReporter interface {
+	// Clients returns the clients connected to exports, ordered by id
+	Clients() []commoncontrol.ClientInfo
+	// DisconnectClient closes the connection of a client (error, if there is no client with the id)
+	DisconnectClient(id uint64, reason string) error
+}
 
-// TODO: Maybe HandleConnection
+// QoSController may be implemented by adaptors that limit the io of their exports, so that core can change the limits at
+// runtime
+type QoSController interface {
+	// SetExportQoS replaces the limits of an export, also for its later attachments. Reset restores the configured limits.
+	SetExportQoS(name string, limits commoncontrol.QoSLimits, reset bool)
+}
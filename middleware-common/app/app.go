@@ -4,29 +4,30 @@ package app
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"os"
 	"os/signal"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 
+	commoncontrol "quorumbd.net/common/control"
 	"quorumbd.net/common/helper/errorhelper"
+	"quorumbd.net/common/systemd"
+	"quorumbd.net/common/version"
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/cache"
 	"quorumbd.net/middleware-common/config"
 	"quorumbd.net/middleware-common/control"
 	"quorumbd.net/middleware-common/coreconnection"
+	"quorumbd.net/middleware-common/dataclient"
+	"quorumbd.net/middleware-common/volume"
 	"quorumbd.net/middleware-common/worker"
 )
 
-var (
-	Config       config.Config
-	appSingleton struct {
-		mu          sync.Mutex
-		initialized bool
-	}
-)
-
 type App struct {
 	uuid           uuid.UUID
 	logger         *slog.Logger
@@ -35,59 +36,185 @@ type App struct {
 	adaptor        Adaptor
 	dispatcher     *control.Dispatcher
 	controlWorker  *control.ControlWorker
+	provider       backend.Provider
+	exports        *exportManager
+	clients        *clientReporter // nil, if the adaptor is no ClientReporter
+	cache          *cache.Cache    // nil, if disabled
+	volumes        *volume.Catalog
+	notifier       *systemd.Notifier
+	reconnecting   atomic.Bool
 }
 
-func New(adaptor Adaptor, config *config.Config, logger *slog.Logger) (*App, error) {
-	claimAppSingleton()
+// Option customizes an App at construction time
+type Option func(*App)
 
-	if logger == nil {
-		logger = slog.Default()
+// WithUUID sets the instance UUID of the middleware instead of generating a random one (uuid.Nil: random)
+func WithUUID(id uuid.UUID) Option {
+	return func(app *App) {
+		if id != uuid.Nil {
+			app.uuid = id
+		}
 	}
+}
 
-	cs, err := coreconnection.New(&config.CoreConnectionConfig, logger)
-	if err != nil {
-		releaseAppSingleton()
-		return nil, err
+// WithLogger sets the logger of the app and of the components it creates (default: no logging)
+func WithLogger(logger *slog.Logger) Option {
+	return func(app *App) {
+		if logger != nil {
+			app.logger = logger
+		}
+	}
+}
+
+// WithDispatcher injects the dispatcher used for control messages
+func WithDispatcher(dispatcher *control.Dispatcher) Option {
+	return func(app *App) {
+		app.dispatcher = dispatcher
+	}
+}
+
+// WithControlWorker injects the control worker (it must use the dispatcher of the app)
+func WithControlWorker(controlWorker *control.ControlWorker) Option {
+	return func(app *App) {
+		app.controlWorker = controlWorker
 	}
+}
 
+// WithCoreSupervisor injects the core supervisor instead of creating one from the config
+func WithCoreSupervisor(coreSupervisor *coreconnection.CoreSupervisor) Option {
+	return func(app *App) {
+		app.coreSupervisor = coreSupervisor
+	}
+}
+
+// WithBackendProvider sets the provider that opens the block backends of attached exports instead of the client of the
+// core data path
+func WithBackendProvider(provider backend.Provider) Option {
+	return func(app *App) {
+		app.provider = provider
+	}
+}
+
+// WithNotifier sets the notifier for the service manager instead of using $NOTIFY_SOCKET
+func WithNotifier(notifier *systemd.Notifier) Option {
+	return func(app *App) {
+		app.notifier = notifier
+	}
+}
+
+// New creates an app for the adaptor. Apps share no state, several of them may run in one process.
+func New(adaptor Adaptor, config *config.Config, opts ...Option) (*App, error) {
 	newApp := App{
-		uuid:           uuid.New(),
-		logger:         logger,
-		config:         config,
-		coreSupervisor: cs,
-		adaptor:        adaptor,
+		uuid:    uuid.New(),
+		logger:  slog.New(slog.DiscardHandler),
+		config:  config,
+		adaptor: adaptor,
 	}
 
-	dispatcher := control.NewDispatcher(logger)
-	newApp.dispatcher = dispatcher
+	for _, opt := range opts {
+		opt(&newApp)
+	}
+	logger := newApp.logger
 
-	controlWorker := control.NewControlWorker(logger, dispatcher)
-	newApp.controlWorker = controlWorker
+	if newApp.coreSupervisor == nil {
+		cs, err := coreconnection.New(&config.CoreConnectionConfig, logger)
+		if err != nil {
+			return nil, err
+		}
+		newApp.coreSupervisor = cs
+	}
+
+	if newApp.dispatcher == nil {
+		newApp.dispatcher = control.NewDispatcher(logger)
+	}
+
+	if newApp.controlWorker == nil {
+		newApp.controlWorker = control.NewControlWorker(logger, newApp.dispatcher)
+	}
+
+	if newApp.notifier == nil {
+		newApp.notifier = systemd.NotifierFromEnv()
+	}
+
+	if newApp.provider == nil {
+		newApp.provider = dataclient.New(logger, newApp.uuid, newApp.coreSupervisor.GetCurrentEndpoint)
+	}
 
 	newApp.logger = newApp.logger.With("impl", newApp.adaptor.GetImplementationName())
+
+	if !adaptor.IsServer() {
+		if _, ok := adaptor.(ClientAdaptor); !ok {
+			return nil, fmt.Errorf("adaptor %s is not a server and must implement ClientAdaptor", adaptor.GetImplementationName())
+		}
+	}
+
+	newApp.volumes = volume.NewCatalog(newApp.dispatcher)
+	newApp.cache = cache.New(newApp.logger, config.CacheConfig.SizeMiB<<20)
+	newApp.exports = newExportManager(newApp.logger, adaptor, newApp.provider, newApp.cache, newApp.sendRegistration)
+	newApp.controlWorker.SetRegistration(newApp.registration)
+	for _, messageType := range []uint32{commoncontrol.CMExportAttach, commoncontrol.CMExportDetach} {
+		if err := newApp.dispatcher.RegisterForCoreMessage(messageType, newApp.exports); err != nil {
+			return nil, err
+		}
+	}
+	if err := newApp.dispatcher.RegisterForCoreMessage(commoncontrol.CMCacheInvalidate, newCacheInvalidator(newApp.logger, newApp.cache, newApp.dispatcher)); err != nil {
+		return nil, err
+	}
+	if reporter, ok := adaptor.(ClientReporter); ok {
+		newApp.clients = newClientReporter(newApp.logger, reporter, newApp.dispatcher, func() bool {
+			return !newApp.reconnecting.Load()
+		}, newApp.coreSupervisor.GetConnectionEpoch)
+		if err := newApp.dispatcher.RegisterForCoreMessage(commoncontrol.CMClientDisconnect, newApp.clients); err != nil {
+			return nil, err
+		}
+	}
+	if controller, ok := adaptor.(QoSController); ok {
+		if err := newApp.dispatcher.RegisterForCoreMessage(commoncontrol.CMExportQoS, newQoSHandler(newApp.logger, controller)); err != nil {
+			return nil, err
+		}
+	}
+
 	return &newApp, nil
 }
 
-func claimAppSingleton() {
-	appSingleton.mu.Lock()
-	defer appSingleton.mu.Unlock()
+// registration builds the registration message for the inventory of core
+func (app *App) registration() commoncontrol.ControlMessage {
+	hostname, err := os.Hostname()
+	if err != nil {
+		app.logger.Warn("Cannot determine hostname", "error", err)
+	}
+	return commoncontrol.NewMiddlewareRegisterMessage(app.dispatcher.NextRequestID(), commoncontrol.MiddlewareInfo{
+		UUID:            app.uuid.String(),
+		Implementation:  app.adaptor.GetImplementationName(),
+		Hostname:        hostname,
+		Version:         version.Version,
+		ListenAddresses: app.adaptor.ListenAddresses(),
+		Exports:         app.exports.list(),
+	})
+}
 
-	if appSingleton.initialized {
-		panic("app singleton already instantiated")
+// sendRegistration updates the registration on core (e.g. after the exports changed)
+func (app *App) sendRegistration() {
+	if err := app.dispatcher.SendMessageToCore(app.registration()); err != nil {
+		app.logger.Warn("Sending registration to core failed", "error", err)
 	}
+}
 
-	appSingleton.initialized = true
+func (app *App) UUID() uuid.UUID {
+	return app.uuid
 }
 
-func releaseAppSingleton() {
-	appSingleton.mu.Lock()
-	defer appSingleton.mu.Unlock()
-	appSingleton.initialized = false
+func (app *App) Dispatcher() *control.Dispatcher {
+	return app.dispatcher
 }
 
-func (app *App) Run() error {
-	app.logger.Info("Middleware is about to start ...")
+// Volumes returns the volume catalogue of core as visible to this middleware
+func (app *App) Volumes() *volume.Catalog {
+	return app.volumes
+}
 
+// RunUntilSignal is the default entry point for the binaries: it runs the app until SIGINT or SIGTERM
+func (app *App) RunUntilSignal() error {
 	ctx, stop := signal.NotifyContext(
 		context.Background(),
 		syscall.SIGINT,
@@ -95,6 +222,16 @@ func (app *App) Run() error {
 	)
 	defer stop()
 
+	return app.Run(ctx)
+}
+
+// Run runs the app until the given context is done or a worker exits fatally
+func (app *App) Run(parentCtx context.Context) error {
+	app.logger.Info("Middleware is about to start ...")
+
+	ctx, stop := context.WithCancel(parentCtx)
+	defer stop()
+
 	if err := app.coreSupervisor.Try(ctx, 0, 30*time.Second, false); err != nil { // TOCONFIG
 		return err
 	}
@@ -105,24 +242,50 @@ func (app *App) Run() error {
 	}
 
 	var (
-		wg                sync.WaitGroup
 		workerExitChannel = make(chan worker.WorkerExit, 32)
 		runError          error
+		workerExitResult  worker.WorkerExit
 	)
 
-	wg.Go(func() {
-		app.controlWorker.Run(ctx, workerExitChannel, app.uuid, *app.coreSupervisor.GetCurrentEndpoint())
-	})
-
 	// TODO:
 	// - Ask for disklist from core
 	// - Ask for nodes from core
 
-	// TODO: Do Listen here in go routine and start disk worker associated to errgroup
-	// Do only listen, if server, otherwise connect proactively
-	// Do not listen or connect proactively, if there is no core connection
+	if err := app.adaptor.Start(ctx); err != nil {
+		app.logger.Error("Starting adaptor failed", "error", err)
+		app.stopAdaptor()
+		return err
+	}
+
+	session := app.startCoreSession(ctx, workerExitChannel)
 
-var workerExitResult worker.WorkerExit
+	readyDone := make(chan struct{})
+	go func() {
+		defer close(readyDone)
+		select {
+		case <-ctx.Done():
+		case <-app.controlWorker.Registered():
+			app.notify("READY=1", "STATUS="+app.status())
+		}
+	}()
+
+	watchdogDone := make(chan struct{})
+	go func() {
+		defer close(watchdogDone)
+		app.notifier.RunWatchdog(ctx, systemd.WatchdogInterval(), app.alive)
+	}()
+	statusDone := make(chan struct{})
+	go func() {
+		defer close(statusDone)
+		app.refreshStatus(ctx)
+	}()
+	clientsDone := make(chan struct{})
+	go func() {
+		defer close(clientsDone)
+		if app.clients != nil {
+			app.clients.run(ctx)
+		}
+	}()
 
 outer:
 	for {
@@ -138,11 +301,39 @@ outer:
 			case errorhelper.ExitShutdown:
 				stop()
 				break outer
+			case errorhelper.ExitReconnect:
+				if !workerExitResult.Worker().RestartOnCoreReconnect() {
+					continue
+				}
+				if fatal, ok := session.stop(workerExitChannel); ok {
+					workerExitResult = fatal
+					runError = fatal.Error()
+					stop()
+					break outer
+				}
+				app.exports.detachAll()
+				workerExitResult = worker.WorkerExit{}
+				var err error
+				if session, err = app.reconnectToCore(ctx, workerExitChannel); session == nil {
+					runError = err
+					break outer
+				}
 			}
 		}
 	}
 
-	wg.Wait() // Wait for all go routines to finish
+	stop()
+	<-readyDone // READY must not follow STOPPING
+	app.notify("STOPPING=1")
+	<-watchdogDone
+	<-statusDone
+	<-clientsDone
+
+	if session != nil {
+		session.stop(workerExitChannel)
+	}
+
+	app.stopAdaptor()
 
 	err := workerExitResult.Error()
 
@@ -159,7 +350,74 @@ outer:
 	return err
 }
 
-func reconnectToCore(ctx context.Context, workerExitResult worker.WorkerExit, workerExitChannel chan<- worker.WorkerExit) {
-	// TODO Implement
-	panic("unimplemented")
+// alive reports the liveness of the app for the watchdog of the service manager
+func (app *App) alive() bool {
+	return app.reconnecting.Load() || app.controlWorker.Alive()
+}
+
+// status returns the status line of a connected app, extended by the adaptor if it is a StatusReporter
+func (app *App) status() string {
+	status := "Connected to core " + app.coreSupervisor.GetCurrentEndpoint().String()
+	if reporter, ok := app.adaptor.(StatusReporter); ok {
+		if adaptorStatus := reporter.Status(); adaptorStatus != "" {
+			status += "; " + adaptorStatus
+		}
+	}
+	return status
+}
+
+// refreshStatus updates the status line periodically while the core connection is up, until ctx is done
+func (app *App) refreshStatus(ctx context.Context) {
+	if _, ok := app.adaptor.(StatusReporter); !ok {
+		return
+	}
+	ticker := time.NewTicker(10 * time.Second) // TOCONFIG
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !app.reconnecting.Load() {
+				app.notify("STATUS=" + app.status())
+			}
+		}
+	}
+}
+
+func (app *App) notify(states ...string) {
+	if err := app.notifier.Notify(states...); err != nil {
+		app.logger.Warn("Notifying service manager failed", "error", err)
+	}
+}
+
+func (app *App) stopAdaptor() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) // TOCONFIG
+	defer cancel()
+
+	if err := app.adaptor.Stop(ctx); err != nil {
+		app.logger.Warn("Stopping adaptor failed", "error", err)
+	}
+	app.exports.detachAll()
+}
+
+// reconnectToCore probes the core endpoints until one is reachable and starts a new core session (nil, if ctx is done or probing failed)
+func (app *App) reconnectToCore(ctx context.Context, workerExitChannel chan worker.WorkerExit) (*coreSession, error) {
+	app.logger.Warn("Core connection lost, reconnecting", "endpoint", app.coreSupervisor.GetCurrentEndpoint().String())
+	app.notify("STATUS=Core connection to " + app.coreSupervisor.GetCurrentEndpoint().String() + " lost, reconnecting")
+
+	app.reconnecting.Store(true)
+	defer app.reconnecting.Store(false)
+
+	if err := app.coreSupervisor.Retry(ctx, 1*time.Second, 30*time.Second, true, false, nil); err != nil { // TOCONFIG
+		app.logger.Error("Reconnecting to core failed", "error", err)
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+
+	app.logger.Info("Reconnected to core", "endpoint", app.coreSupervisor.GetCurrentEndpoint().String(), "epoch", app.coreSupervisor.GetConnectionEpoch())
+	app.notify("STATUS=" + app.status())
+	return app.startCoreSession(ctx, workerExitChannel), nil
 }
@@ -0,0 +1,305 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/config"
+)
+
+// notifySocket listens for the notifications of the app
+func notifySocket(t *testing.T) (*systemd.Notifier, <-chan string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	notifications := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			notifications <- string(buf[:n])
+		}
+	}()
+	return systemd.NewNotifier(path), notifications
+}
+
+// waitForReady returns true, if READY=1 is notified within the timeout
+func waitForReady(notifications <-chan string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg := <-notifications:
+			if slices.Contains(strings.Split(msg, "\n"), "READY=1") {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// startingAdaptor runs start when the app starts it, which is after the first core connection and before the control connection
+type startingAdaptor struct {
+	fakeAdaptor
+	start func()
+}
+
+func (a startingAdaptor) Start(context.Context) error {
+	a.start()
+	return nil
+}
+
+func runApp(t *testing.T, adaptor Adaptor, coreURI string, notifier *systemd.Notifier, opts ...Option) *App {
+	t.Helper()
+	cfg := &config.Config{CoreConnectionConfig: config.CoreConnectionConfig{Server: coreURI}}
+	a, err := New(adaptor, cfg, append([]Option{WithNotifier(notifier)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return a
+}
+
+// syncBuffer is a log output that can be written by several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// registeringCore accepts control connections on a unix socket and sends the UUIDs of the registrations to the channel
+func registeringCore(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	registrations := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, len(commoncontrol.Preamble)+16)); err != nil {
+					return
+				}
+				for {
+					msg, err := commoncontrol.ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					if register, ok := msg.(*commoncontrol.MiddlewareRegisterMessage); ok {
+						registrations <- register.Middleware.UUID
+					}
+				}
+			}()
+		}
+	}()
+	return "unix://" + path, registrations
+}
+
+func TestAppsAreIndependent(t *testing.T) {
+	type instance struct {
+		id            uuid.UUID
+		log           *syncBuffer
+		registrations <-chan string
+		notifications <-chan string
+		app           *App
+	}
+	instances := make([]*instance, 2)
+	for i := range instances {
+		inst := &instance{id: uuid.New(), log: &syncBuffer{}}
+		coreURI, registrations := registeringCore(t)
+		notifier, notifications := notifySocket(t)
+		inst.registrations, inst.notifications = registrations, notifications
+		inst.app = runApp(t, fakeAdaptor{}, coreURI, notifier, WithUUID(inst.id), WithLogger(slog.New(slog.NewTextHandler(inst.log, nil))))
+		instances[i] = inst
+	}
+	if instances[0].app.Dispatcher() == instances[1].app.Dispatcher() || instances[0].app.Volumes() == instances[1].app.Volumes() {
+		t.Fatal("apps share their dispatcher or volume catalog")
+	}
+
+	// Every app registers with its own core and logs to its own logger
+	for i, inst := range instances {
+		if !waitForReady(inst.notifications, 10*time.Second) {
+			t.Fatalf("app %d did not notify READY", i)
+		}
+		select {
+		case id := <-inst.registrations:
+			if id != inst.id.String() {
+				t.Fatalf("app %d registered as %s, want %s", i, id, inst.id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("app %d did not register", i)
+		}
+		if !strings.Contains(inst.log.String(), "Middleware is about to start") {
+			t.Fatalf("app %d did not log to its logger: %q", i, inst.log.String())
+		}
+	}
+}
+
+func TestReadyAfterRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	registered := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, len(commoncontrol.Preamble)+16)); err != nil {
+					return
+				}
+				if msg, err := commoncontrol.ReadMessage(conn); err == nil && msg.Type() == commoncontrol.CMMiddlewareRegister {
+					registered <- struct{}{}
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	notifier, notifications := notifySocket(t)
+	runApp(t, fakeAdaptor{}, "unix://"+path, notifier)
+	if !waitForReady(notifications, 10*time.Second) {
+		t.Fatal("READY was not notified")
+	}
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("READY without registration")
+	}
+}
+
+func TestNotReadyWithoutRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	// Core accepts the probe of the supervisor and is gone before the control connection
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	adaptor := startingAdaptor{start: func() {
+		ln.Close()
+		os.Remove(path)
+	}}
+
+	notifier, notifications := notifySocket(t)
+	runApp(t, adaptor, "unix://"+path, notifier)
+	if waitForReady(notifications, time.Second) {
+		t.Fatal("READY was notified before the registration")
+	}
+}
+
+// qosAdaptor records the limits core sets
+type qosAdaptor struct {
+	fakeAdaptor
+	limits chan commoncontrol.QoSLimits
+}
+
+func (a qosAdaptor) SetExportQoS(name string, limits commoncontrol.QoSLimits, reset bool) {
+	if name == "vm1" && !reset {
+		a.limits <- limits
+	}
+}
+
+func TestExportQoSReachesAdaptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	limits := commoncontrol.QoSLimits{ReadIOPS: 100, WriteBytesPerSecond: 1 << 20}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, len(commoncontrol.Preamble)+16)); err != nil {
+					return
+				}
+				if msg, err := commoncontrol.ReadMessage(conn); err != nil || msg.Type() != commoncontrol.CMMiddlewareRegister {
+					return
+				}
+				if err := commoncontrol.WriteMessage(conn, commoncontrol.NewExportQoSMessage(1, "vm1", limits)); err != nil {
+					return
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	notifier, _ := notifySocket(t)
+	adaptor := qosAdaptor{limits: make(chan commoncontrol.QoSLimits, 1)}
+	runApp(t, adaptor, "unix://"+path, notifier)
+	select {
+	case got := <-adaptor.limits:
+		if got != limits {
+			t.Fatalf("limits %+v, want %+v", got, limits)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("limits did not reach the adaptor")
+	}
+}
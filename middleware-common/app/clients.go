@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/control"
+)
+
+const (
+	clientPollInterval   = 5 * time.Second  // TOCONFIG
+	clientReportInterval = 30 * time.Second // Report of unchanged clients (bytes transferred); TOCONFIG
+)
+
+// clientReporter reports the clients of the adaptor to core and executes the disconnects sent by core
+type clientReporter struct {
+	logger     *slog.Logger
+	adaptor    ClientReporter
+	dispatcher *control.Dispatcher
+	connected  func() bool   // false while reconnecting to core
+	epoch      func() uint32 // Changes with every core connection
+	changed    chan struct{}
+}
+
+func newClientReporter(logger *slog.Logger, adaptor ClientReporter, dispatcher *control.Dispatcher, connected func() bool, epoch func() uint32) *clientReporter {
+	return &clientReporter{
+		logger:     logger.With("module", "clientreporter"),
+		adaptor:    adaptor,
+		dispatcher: dispatcher,
+		connected:  connected,
+		epoch:      epoch,
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+// HandleMessageBlocking is an interface method of MessageHandler (disconnect messages of core)
+func (cr *clientReporter) HandleMessageBlocking(_ context.Context, msg commoncontrol.ControlMessage) {
+	m, ok := msg.(*commoncontrol.ClientDisconnectMessage)
+	if !ok {
+		cr.logger.Warn("Unexpected message type", "type", msg.Type())
+		return
+	}
+	if err := cr.adaptor.DisconnectClient(m.ClientID, m.Reason); err != nil {
+		cr.logger.Warn("Disconnecting client failed", "client", m.ClientID, "reason", m.Reason, "error", err)
+		return
+	}
+	cr.logger.Info("Client disconnected by core", "client", m.ClientID, "reason", m.Reason)
+	cr.poke()
+}
+
+// poke makes run report the clients right away
+func (cr *clientReporter) poke() {
+	select {
+	case cr.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run reports the clients when they changed, when the core connection changed and periodically, until ctx is done
+func (cr *clientReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(clientPollInterval)
+	defer ticker.Stop()
+
+	var (
+		lastIDs   []uint64
+		lastEpoch uint32
+		lastSent  time.Time
+	)
+	for {
+		if cr.connected() {
+			clients := cr.adaptor.Clients()
+			ids := make([]uint64, len(clients))
+			for i, client := range clients {
+				ids[i] = client.ID
+			}
+			epoch := cr.epoch()
+			if epoch != lastEpoch || !slices.Equal(ids, lastIDs) || time.Since(lastSent) >= clientReportInterval {
+				if err := cr.dispatcher.SendMessageToCore(commoncontrol.NewClientReportMessage(cr.dispatcher.NextRequestID(), clients)); err != nil {
+					cr.logger.Warn("Reporting clients to core failed", "error", err)
+				} else {
+					lastIDs, lastEpoch, lastSent = ids, epoch, time.Now()
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cr.changed:
+		}
+	}
+}
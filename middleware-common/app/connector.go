@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"quorumbd.net/common/helper/errorhelper"
+
+	"quorumbd.net/middleware-common/coreconnection"
+	"quorumbd.net/middleware-common/worker"
+)
+
+const (
+	connectorInitialBackoff = 500 * time.Millisecond // TOCONFIG
+	connectorMaxBackoff     = 30 * time.Second       // TOCONFIG
+)
+
+// connector is the worker of a client adaptor: it dials a target and reconnects with backoff for as long as the core session lives
+type connector struct {
+	logger  *slog.Logger
+	adaptor ClientAdaptor
+	target  string
+}
+
+func newConnector(parentLogger *slog.Logger, adaptor ClientAdaptor, target string) *connector {
+	return &connector{
+		logger:  parentLogger.With("module", "connector", "target", target),
+		adaptor: adaptor,
+		target:  target,
+	}
+}
+
+func (c *connector) String() string {
+	return "connector(" + c.target + ")"
+}
+
+func (c *connector) RestartOnCoreReconnect() bool {
+	return true
+}
+
+func (c *connector) Run(ctx context.Context, workerExitCh chan<- worker.WorkerExit, _ uuid.UUID, _ coreconnection.CoreEndpoint) {
+	network, address, err := splitTargetURI(c.target)
+	if err != nil {
+		c.exit(errorhelper.Fatal(err), workerExitCh)
+		return
+	}
+
+	dialer := net.Dialer{
+		Timeout: 5 * time.Second, // TOCONFIG
+	}
+	backoff := connectorInitialBackoff
+
+	for {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			backoff = connectorInitialBackoff
+			err = c.serve(ctx, conn)
+		}
+
+		if ctx.Err() != nil {
+			c.exit(nil, workerExitCh)
+			return
+		}
+		// Protocol errors of a target are retried like network errors, only explicitly fatal errors stop the middleware
+		if _, ok := errors.AsType[*errorhelper.FatalConnError](err); ok {
+			c.exit(err, workerExitCh)
+			return
+		}
+
+		c.logger.Warn("Connection to target lost or not possible", "error", err, "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			c.exit(nil, workerExitCh)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, connectorMaxBackoff)
+	}
+}
+
+func (c *connector) serve(ctx context.Context, conn net.Conn) error {
+	c.logger.Info("Connected", "address", conn.RemoteAddr().String())
+
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-serveCtx.Done()
+		conn.Close()
+	}()
+
+	return c.adaptor.ServeConn(serveCtx, c.target, conn)
+}
+
+func (c *connector) exit(err error, workerExitCh chan<- worker.WorkerExit) {
+	workerExit := worker.NewWorkerExit(c, err)
+	workerExitCh <- workerExit
+	c.logger.Info("Connector exit: " + workerExit.String())
+}
+
+func splitTargetURI(uri string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(uri, "unix://"):
+		if address := strings.TrimPrefix(uri, "unix://"); address != "" {
+			return "unix", address, nil
+		}
+	case strings.HasPrefix(uri, "tcp://"):
+		if address := strings.TrimPrefix(uri, "tcp://"); address != "" {
+			return "tcp", address, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid target URI %q: expected unix://<path> or tcp://<host:port>", uri)
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"quorumbd.net/common/helper/errorhelper"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/config"
+	"quorumbd.net/middleware-common/coreconnection"
+	"quorumbd.net/middleware-common/worker"
+)
+
+// fakeAdaptor is a server adaptor that does nothing
+type fakeAdaptor struct{}
+
+func (fakeAdaptor) GetImplementationName() string                           { return "fake" }
+func (fakeAdaptor) IsServer() bool                                          { return true }
+func (fakeAdaptor) ListenAddresses() []string                               { return nil }
+func (fakeAdaptor) Start(context.Context) error                             { return nil }
+func (fakeAdaptor) Stop(context.Context) error                              { return nil }
+func (fakeAdaptor) AttachExport(backend.Export, backend.BlockBackend) error { return nil }
+func (fakeAdaptor) DetachExport(string) error                               { return nil }
+
+// fakeClientAdaptor serves its targets with serve and counts the connections
+type fakeClientAdaptor struct {
+	fakeAdaptor
+	targets []string
+	serve   func(ctx context.Context, attempt int32) error
+	conns   atomic.Int32
+	served  chan string
+}
+
+func (a *fakeClientAdaptor) IsServer() bool    { return false }
+func (a *fakeClientAdaptor) Targets() []string { return a.targets }
+
+func (a *fakeClientAdaptor) ServeConn(ctx context.Context, target string, conn net.Conn) error {
+	attempt := a.conns.Add(1)
+	select {
+	case a.served <- target:
+	default:
+	}
+	return a.serve(ctx, attempt)
+}
+
+// listen accepts connections on a unix socket and holds them open until the test ends
+func listen(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return "unix://" + path
+}
+
+func runConnector(t *testing.T, adaptor *fakeClientAdaptor) (context.CancelFunc, chan worker.WorkerExit) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	exits := make(chan worker.WorkerExit, 1)
+	c := newConnector(slog.New(slog.DiscardHandler), adaptor, adaptor.targets[0])
+	go c.Run(ctx, exits, uuid.New(), coreconnection.CoreEndpoint{})
+	return cancel, exits
+}
+
+func TestConnectorRetriesServeErrors(t *testing.T) {
+	adaptor := &fakeClientAdaptor{
+		targets: []string{listen(t, "target.sock")},
+		served:  make(chan string, 1),
+		serve: func(ctx context.Context, attempt int32) error {
+			if attempt < 3 {
+				return errors.New("malformed response from target")
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	cancel, exits := runConnector(t, adaptor)
+
+	deadline := time.After(10 * time.Second)
+	for adaptor.conns.Load() < 3 {
+		select {
+		case exit := <-exits:
+			t.Fatalf("connector exited after a protocol error: %s", exit)
+		case <-adaptor.served:
+		case <-deadline:
+			t.Fatalf("connector did not reconnect, %d connections", adaptor.conns.Load())
+		}
+	}
+
+	cancel()
+	select {
+	case exit := <-exits:
+		if exit.Kind() != errorhelper.ExitShutdown {
+			t.Fatalf("exit after cancel: %s", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connector did not exit after cancel")
+	}
+}
+
+func TestConnectorStopsOnFatalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		serve  func(context.Context, int32) error
+		conns  int32
+	}{
+		{
+			name: "fatal serve error",
+			serve: func(context.Context, int32) error {
+				return errorhelper.Fatal(errors.New("target rejected configuration"))
+			},
+			conns: 1,
+		},
+		{
+			name:   "invalid target",
+			target: "http://target",
+			serve:  func(context.Context, int32) error { return nil },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := test.target
+			if target == "" {
+				target = listen(t, "target.sock")
+			}
+			adaptor := &fakeClientAdaptor{targets: []string{target}, served: make(chan string, 1), serve: test.serve}
+			_, exits := runConnector(t, adaptor)
+
+			select {
+			case exit := <-exits:
+				if exit.Kind() != errorhelper.ExitFatal {
+					t.Fatalf("exit: %s", exit)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("connector did not exit")
+			}
+			if conns := adaptor.conns.Load(); conns != test.conns {
+				t.Fatalf("%d connections, want %d", conns, test.conns)
+			}
+		})
+	}
+}
+
+func TestClientAdaptorIsConnectedByCoreSession(t *testing.T) {
+	coreURI := listen(t, "core.sock")
+	targets := []string{listen(t, "a.sock"), listen(t, "b.sock")}
+	adaptor := &fakeClientAdaptor{
+		targets: targets,
+		served:  make(chan string, len(targets)),
+		serve: func(ctx context.Context, _ int32) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{CoreConnectionConfig: config.CoreConnectionConfig{Server: coreURI}}
+	cs, err := coreconnection.New(&cfg.CoreConnectionConfig, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Try(ctx, 0, time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(adaptor, cfg, WithLogger(logger), WithCoreSupervisor(cs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exits := make(chan worker.WorkerExit, 8)
+	session := a.startCoreSession(ctx, exits)
+	seen := make(map[string]bool)
+	for len(seen) < len(targets) {
+		select {
+		case target := <-adaptor.served:
+			seen[target] = true
+		case exit := <-exits:
+			t.Fatalf("unexpected exit: %s", exit)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("targets served: %v", seen)
+		}
+	}
+	if fatal, ok := session.stop(exits); ok {
+		t.Fatalf("fatal exit on stop: %s", fatal)
+	}
+}
+
+func TestNonServerAdaptorMustBeClientAdaptor(t *testing.T) {
+	cfg := &config.Config{CoreConnectionConfig: config.CoreConnectionConfig{Server: "unix:///nonexistent"}}
+	if _, err := New(nonServer{}, cfg); err == nil {
+		t.Fatal("non-server adaptor without ClientAdaptor accepted")
+	}
+	if _, err := New(fakeAdaptor{}, cfg); err != nil {
+		t.Fatalf("server adaptor rejected: %v", err)
+	}
+}
+
+type nonServer struct {
+	fakeAdaptor
+}
+
+func (nonServer) IsServer() bool { return false }
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/cache"
+)
+
+// exportManager handles the export attach and detach messages of core and drives the adaptor callbacks
+type exportManager struct {
+	logger   *slog.Logger
+	adaptor  Adaptor
+	provider backend.Provider
+	cache    *cache.Cache
+	onChange func()
+	mu       sync.Mutex
+	attached map[string]attachedExport
+}
+
+type attachedExport struct {
+	info    commoncontrol.ExportInfo
+	backend backend.BlockBackend
+}
+
+func newExportManager(logger *slog.Logger, adaptor Adaptor, provider backend.Provider, cache *cache.Cache, onChange func()) *exportManager {
+	return &exportManager{
+		logger:   logger.With("module", "exportmanager"),
+		adaptor:  adaptor,
+		provider: provider,
+		cache:    cache,
+		onChange: onChange,
+		attached: make(map[string]attachedExport),
+	}
+}
+
+func (em *exportManager) HandleMessageBlocking(ctx context.Context, msg commoncontrol.ControlMessage) {
+	switch m := msg.(type) {
+	case *commoncontrol.ExportAttachMessage:
+		if err := em.attach(ctx, m.Export); err != nil {
+			em.logger.Error("Attaching export failed", "export", m.Export.Name, "error", err)
+		}
+		em.onChange()
+	case *commoncontrol.ExportDetachMessage:
+		if err := em.detach(m.Name); err != nil {
+			em.logger.Error("Detaching export failed", "export", m.Name, "error", err)
+		}
+		em.onChange()
+	default:
+		em.logger.Warn("Unexpected message type", "type", msg.Type())
+	}
+}
+
+func (em *exportManager) attach(ctx context.Context, info commoncontrol.ExportInfo) error {
+	if info.Name == "" {
+		return fmt.Errorf("export name must not be empty")
+	}
+
+	export := backend.Export{
+		Name:      info.Name,
+		VolumeID:  info.VolumeID,
+		BlockSize: info.BlockSize,
+		ReadOnly:  info.ReadOnly,
+		Epoch:     info.Epoch,
+	}
+
+	em.mu.Lock()
+	defer em.mu.Unlock()
+
+	if _, ok := em.attached[export.Name]; ok {
+		em.logger.Info("Export is already attached, reattaching", "export", export.Name)
+		if err := em.detachLocked(export.Name); err != nil {
+			return err
+		}
+	}
+
+	blockBackend, err := em.provider.Open(ctx, export, int64(info.Size))
+	if err != nil {
+		return err
+	}
+	blockBackend = em.cache.Wrap(export, blockBackend)
+
+	if err := em.adaptor.AttachExport(export, blockBackend); err != nil {
+		blockBackend.Close()
+		return err
+	}
+
+	em.attached[export.Name] = attachedExport{info: info, backend: blockBackend}
+	em.logger.Info("Export attached", "export", export.Name, "volume", export.VolumeID, "size", blockBackend.Size(), "read_only", export.ReadOnly)
+	return nil
+}
+
+func (em *exportManager) detach(name string) error {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	return em.detachLocked(name)
+}
+
+func (em *exportManager) detachLocked(name string) error {
+	attached, ok := em.attached[name]
+	if !ok {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	delete(em.attached, name)
+
+	err := em.adaptor.DetachExport(name)
+	if closeErr := attached.backend.Close(); err == nil {
+		err = closeErr
+	}
+	em.logger.Info("Export detached", "export", name)
+	return err
+}
+
+func (em *exportManager) detachAll() {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	for name := range em.attached {
+		if err := em.detachLocked(name); err != nil {
+			em.logger.Warn("Detaching export failed", "export", name, "error", err)
+		}
+	}
+}
+
+// list returns the infos of all attached exports
+func (em *exportManager) list() []commoncontrol.ExportInfo {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	infos := make([]commoncontrol.ExportInfo, 0, len(em.attached))
+	for _, attached := range em.attached {
+		infos = append(infos, attached.info)
+	}
+	return infos
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/cache"
+	"quorumbd.net/middleware-common/control"
+)
+
+// cacheInvalidator executes the cache invalidations of core and acknowledges them. Core completes the change that
+// caused an invalidation only after the acknowledgement, so it is sent also if the cache is disabled.
+type cacheInvalidator struct {
+	logger     *slog.Logger
+	cache      *cache.Cache // nil, if disabled
+	dispatcher *control.Dispatcher
+}
+
+func newCacheInvalidator(logger *slog.Logger, cache *cache.Cache, dispatcher *control.Dispatcher) *cacheInvalidator {
+	return &cacheInvalidator{
+		logger:     logger.With("module", "cacheinvalidator"),
+		cache:      cache,
+		dispatcher: dispatcher,
+	}
+}
+
+// HandleMessageBlocking is an interface method of MessageHandler (invalidation messages of core)
+func (ci *cacheInvalidator) HandleMessageBlocking(ctx context.Context, msg commoncontrol.ControlMessage) {
+	m, ok := msg.(*commoncontrol.CacheInvalidateMessage)
+	if !ok {
+		ci.logger.Warn("Unexpected message type", "type", msg.Type())
+		return
+	}
+	ci.cache.HandleMessageBlocking(ctx, m)
+	if err := ci.dispatcher.SendMessageToCore(commoncontrol.NewCacheInvalidateResponse(m.RequestID(), m.VolumeID)); err != nil {
+		ci.logger.Warn("Acknowledging cache invalidation failed", "volume", m.VolumeID, "error", err)
+	}
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+
+	commoncontrol "quorumbd.net/common/control"
+)
+
+// qosHandler passes the io limits of core on to the adaptor
+type qosHandler struct {
+	logger     *slog.Logger
+	controller QoSController
+}
+
+func newQoSHandler(logger *slog.Logger, controller QoSController) *qosHandler {
+	return &qosHandler{
+		logger:     logger.With("module", "qos"),
+		controller: controller,
+	}
+}
+
+// HandleMessageBlocking is an interface method of MessageHandler (QoS messages of core)
+func (qh *qosHandler) HandleMessageBlocking(_ context.Context, msg commoncontrol.ControlMessage) {
+	m, ok := msg.(*commoncontrol.ExportQoSMessage)
+	if !ok {
+		qh.logger.Warn("Unexpected message type", "type", msg.Type())
+		return
+	}
+	qh.controller.SetExportQoS(m.Name, m.Limits, m.Reset)
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"quorumbd.net/common/helper/errorhelper"
+
+	"quorumbd.net/middleware-common/worker"
+)
+
+// coreSession bundles all workers that only run while a core connection is up
+type coreSession struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (app *App) startCoreSession(parentCtx context.Context, workerExitChannel chan<- worker.WorkerExit) *coreSession {
+	ctx, cancel := context.WithCancel(parentCtx)
+	session := &coreSession{cancel: cancel}
+
+	workers := []worker.Worker{app.controlWorker}
+	if clientAdaptor, ok := app.adaptor.(ClientAdaptor); ok && !app.adaptor.IsServer() {
+		for _, target := range clientAdaptor.Targets() {
+			workers = append(workers, newConnector(app.logger, clientAdaptor, target))
+		}
+	}
+
+	coreEndpoint := *app.coreSupervisor.GetCurrentEndpoint()
+	for _, w := range workers {
+		session.wg.Go(func() {
+			w.Run(ctx, workerExitChannel, app.uuid, coreEndpoint)
+		})
+	}
+
+	return session
+}
+
+// stop cancels all workers of the session and waits for them. The exits of the session are consumed, but the first fatal one is reported.
+func (session *coreSession) stop(workerExitChannel <-chan worker.WorkerExit) (worker.WorkerExit, bool) {
+	session.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		session.wg.Wait()
+		close(done)
+	}()
+
+	var (
+		fatal worker.WorkerExit
+		found bool
+	)
+	consume := func(workerExit worker.WorkerExit) {
+		if !found && workerExit.Kind() == errorhelper.ExitFatal {
+			fatal, found = workerExit, true
+		}
+	}
+
+	for {
+		select {
+		case workerExit := <-workerExitChannel:
+			consume(workerExit)
+		case <-done:
+			for {
+				select {
+				case workerExit := <-workerExitChannel:
+					consume(workerExit)
+				default:
+					return fatal, found
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package backend provides the block io contract between the protocol adaptors and the core data path
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type Flags uint32
+
+const (
+	FlagFUA      Flags = 1 << iota // Force unit access: the write is durable before it is acknowledged
+	FlagNoHole                     // WriteZeroes must allocate the range instead of deallocating it
+	FlagFastZero                   // WriteZeroes must fail with ErrNotSupported instead of falling back to a slow write
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+// Export describes a volume that is attached to the middleware by core
+type Export struct {
+	Name      string
+	VolumeID  string
+	BlockSize uint32
+	ReadOnly  bool
+	Epoch     uint64 // Assigned by core with every attachment of the volume, previous attachments are fenced
+}
+
+// BlockBackend is the block io interface of an attached export. Adaptors only translate their protocol to these calls.
+// Implementations must be safe for concurrent use.
+type BlockBackend interface {
+	ReadAt(ctx context.Context, p []byte, off int64) error
+	WriteAt(ctx context.Context, p []byte, off int64, flags Flags) error
+	Flush(ctx context.Context) error
+	// Trim deallocates the range (reads of deallocated ranges return zeroes)
+	Trim(ctx context.Context, off int64, length int64, flags Flags) error
+	// WriteZeroes zeroes the range, deallocating it unless FlagNoHole is set
+	WriteZeroes(ctx context.Context, off int64, length int64, flags Flags) error
+	Size() int64
+	Close() error
+}
+
+// SharedFlusher is implemented by block backends whose Flush makes all writes durable that completed through the backend,
+// regardless of the client connection they came from. Adaptors may only offer several connections per export with
+// shared flush semantics (e.g. NBD_FLAG_CAN_MULTI_CONN) for such backends.
+type SharedFlusher interface {
+	FlushesAllWrites() bool
+}
+
+// FlushesAllWrites returns true, if the backend guarantees shared flush semantics
+func FlushesAllWrites(blockBackend BlockBackend) bool {
+	sharedFlusher, ok := blockBackend.(SharedFlusher)
+	return ok && sharedFlusher.FlushesAllWrites()
+}
+
+// Prefetcher is implemented by block backends that can load a range ahead of reads (e.g. into a read cache).
+// Prefetching is a hint: reads must return the current data, whether the range was prefetched or not.
+type Prefetcher interface {
+	Prefetch(ctx context.Context, off int64, length int64) error
+}
+
+// Provider opens block backends for exports attached by core
+type Provider interface {
+	Open(ctx context.Context, export Export, size int64) (BlockBackend, error)
+}
+
+// Errors of block backends. Implementations wrap or return these, so that adaptors can map them to their protocol.
+var (
+	ErrNoDataPath   = errors.New("no core data path available")
+	ErrOutOfRange   = errors.New("range exceeds export size")
+	ErrIO           = errors.New("io error")
+	ErrNoSpace      = errors.New("no space left")
+	ErrReadOnly     = errors.New("export is read-only")
+	ErrInvalid      = errors.New("invalid request")
+	ErrNotSupported = errors.New("operation not supported")
+	// ErrFenced is an io error: the attachment was replaced or revoked by core, the backend cannot change the volume anymore
+	ErrFenced = fmt.Errorf("%w: the attachment of the volume is fenced", ErrIO)
+)
+
+type unavailableProvider struct{}
+
+// Unavailable returns a provider that refuses to open backends (e.g. for adaptors that run without core)
+func Unavailable() Provider {
+	return unavailableProvider{}
+}
+
+func (unavailableProvider) Open(_ context.Context, _ Export, _ int64) (BlockBackend, error) {
+	return nil, ErrNoDataPath
+}
+
+// CheckRange validates that [off, off+length) lies within a backend of the given size
+func CheckRange(size int64, off int64, length int64) error {
+	if off < 0 || length < 0 || off > size || length > size-off {
+		return ErrOutOfRange
+	}
+	return nil
+}
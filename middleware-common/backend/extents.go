@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+type ExtentFlags uint32
+
+const (
+	ExtentHole  ExtentFlags = 1 << iota // The range is not allocated
+	ExtentZero                          // The range reads as zeroes
+	ExtentDirty                         // The range changed (dirty bitmaps only)
+)
+
+func (f ExtentFlags) Has(flag ExtentFlags) bool {
+	return f&flag != 0
+}
+
+// Extent is a range of an export with uniform allocation
+type Extent struct {
+	Offset int64
+	Length int64
+	Flags  ExtentFlags
+}
+
+// ExtentMapper is implemented by block backends that know the allocation of their volume (e.g. thin volumes)
+type ExtentMapper interface {
+	// Extents returns the extents of [off, off+length) in ascending order
+	Extents(ctx context.Context, off int64, length int64) ([]Extent, error)
+}
+
+// ExtentsOf returns the extents of a range of the backend, which exactly cover the range without gaps.
+// Backends without a mapping (no ExtentMapper or ErrNotSupported) are reported as allocated data, which is only
+// correct for protocols that allow it (e.g. base:allocation of NBD). Ranges missing in the mapping count as data.
+func ExtentsOf(ctx context.Context, blockBackend BlockBackend, off int64, length int64) ([]Extent, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+
+	mapper, ok := blockBackend.(ExtentMapper)
+	if !ok {
+		return []Extent{{Offset: off, Length: length}}, nil
+	}
+
+	extents, err := MappedExtentsOf(ctx, mapper, off, length)
+	if errors.Is(err, ErrNotSupported) {
+		return []Extent{{Offset: off, Length: length}}, nil
+	}
+	return extents, err
+}
+
+// MappedExtentsOf returns the extents of a range of the mapping, which exactly cover the range without gaps.
+// Unlike ExtentsOf it fails with ErrNotSupported, if the mapper has no allocation information.
+func MappedExtentsOf(ctx context.Context, mapper ExtentMapper, off int64, length int64) ([]Extent, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+
+	mapped, err := mapper.Extents(ctx, off, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return coverRange(mapped, off, length), nil
+}
+
+// coverRange clips the extents to [off, off+length), fills gaps with extents without flags and merges adjacent extents
+func coverRange(extents []Extent, off int64, length int64) []Extent {
+	end := off + length
+	result := make([]Extent, 0, len(extents)+1)
+	pos := off
+
+	appendExtent := func(extent Extent) {
+		if extent.Length <= 0 {
+			return
+		}
+		if n := len(result); n > 0 && result[n-1].Flags == extent.Flags && result[n-1].Offset+result[n-1].Length == extent.Offset {
+			result[n-1].Length += extent.Length
+			return
+		}
+		result = append(result, extent)
+	}
+
+	for _, extent := range extents {
+		extentStart := max(extent.Offset, pos)
+		extentEnd := min(extent.Offset+extent.Length, end)
+		if extentEnd <= extentStart {
+			continue
+		}
+		appendExtent(Extent{Offset: pos, Length: extentStart - pos})
+		appendExtent(Extent{Offset: extentStart, Length: extentEnd - extentStart, Flags: extent.Flags})
+		pos = extentEnd
+	}
+	appendExtent(Extent{Offset: pos, Length: end - pos})
+
+	return result
+}
+
+// DirtyMapper is implemented by block backends whose volume has change tracking (used for incremental backups)
+type DirtyMapper interface {
+	// DirtyBitmaps returns the names of the change tracking bitmaps of the volume
+	DirtyBitmaps() []string
+	// DirtyExtents returns the changed extents (flag ExtentDirty) of [off, off+length) in ascending order
+	DirtyExtents(ctx context.Context, bitmap string, off int64, length int64) ([]Extent, error)
+}
+
+// DirtyExtentsOf returns the extents of a range of a dirty bitmap, which exactly cover the range without gaps (missing ranges are clean)
+func DirtyExtentsOf(ctx context.Context, mapper DirtyMapper, bitmap string, off int64, length int64) ([]Extent, error) {
+	mapped, err := mapper.DirtyExtents(ctx, bitmap, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return coverRange(mapped, off, length), nil
+}
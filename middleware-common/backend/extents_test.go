@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testBackend is a BlockBackend without data, the mapping is added by embedding it
+type testBackend struct{}
+
+func (testBackend) ReadAt(context.Context, []byte, int64) error            { return nil }
+func (testBackend) WriteAt(context.Context, []byte, int64, Flags) error    { return nil }
+func (testBackend) Flush(context.Context) error                            { return nil }
+func (testBackend) Trim(context.Context, int64, int64, Flags) error        { return nil }
+func (testBackend) WriteZeroes(context.Context, int64, int64, Flags) error { return nil }
+func (testBackend) Size() int64                                            { return 1 << 20 }
+func (testBackend) Close() error                                           { return nil }
+
+type mappedBackend struct {
+	testBackend
+	extents []Extent
+	err     error
+}
+
+func (b mappedBackend) Extents(context.Context, int64, int64) ([]Extent, error) {
+	return b.extents, b.err
+}
+
+func TestExtentsOf(t *testing.T) {
+	mapped := mappedBackend{extents: []Extent{
+		{Offset: 0, Length: 4096, Flags: ExtentHole | ExtentZero},
+		{Offset: 4096, Length: 4096, Flags: ExtentHole | ExtentZero},
+		{Offset: 16384, Length: 8192, Flags: ExtentZero},
+	}}
+	tests := []struct {
+		name    string
+		backend BlockBackend
+		off     int64
+		length  int64
+		extents []Extent
+		err     error
+	}{
+		{name: "no mapper", backend: testBackend{}, off: 512, length: 1024, extents: []Extent{{Offset: 512, Length: 1024}}},
+		{name: "mapping not supported", backend: mappedBackend{err: ErrNotSupported}, off: 0, length: 8192, extents: []Extent{{Offset: 0, Length: 8192}}},
+		{name: "mapping failed", backend: mappedBackend{err: ErrIO}, off: 0, length: 8192, err: ErrIO},
+		{
+			name:    "merged, gaps filled and clipped",
+			backend: mapped,
+			off:     2048,
+			length:  20480,
+			extents: []Extent{{Offset: 2048, Length: 6144, Flags: ExtentHole | ExtentZero}, {Offset: 8192, Length: 8192}, {Offset: 16384, Length: 6144, Flags: ExtentZero}},
+		},
+		{name: "gap after the mapping", backend: mapped, off: 20480, length: 8192, extents: []Extent{{Offset: 20480, Length: 4096, Flags: ExtentZero}, {Offset: 24576, Length: 4096}}},
+		{name: "empty range", backend: mapped, off: 0, length: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extents, err := ExtentsOf(t.Context(), test.backend, test.off, test.length)
+			if !errors.Is(err, test.err) || !reflect.DeepEqual(extents, test.extents) {
+				t.Fatalf("extents %v (%v), want %v (%v)", extents, err, test.extents, test.err)
+			}
+		})
+	}
+}
+
+func TestMappedExtentsOf(t *testing.T) {
+	if _, err := MappedExtentsOf(t.Context(), mappedBackend{err: ErrNotSupported}, 0, 8192); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("error %v, want %v", err, ErrNotSupported)
+	}
+	extents, err := MappedExtentsOf(t.Context(), mappedBackend{extents: []Extent{{Offset: 4096, Length: 4096, Flags: ExtentHole}}}, 0, 8192)
+	if want := []Extent{{Offset: 0, Length: 4096}, {Offset: 4096, Length: 4096, Flags: ExtentHole}}; err != nil || !reflect.DeepEqual(extents, want) {
+		t.Fatalf("extents %v (%v), want %v", extents, err, want)
+	}
+}
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"context"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const maxPrefetchLength = 4 << 20 // Lines read from the backend per prefetch step; TOCONFIG
+
+// cachedBackend serves reads from the cache and invalidates the cache on every change (write-through, no write caching).
+// The optional interfaces of the wrapped backend are forwarded.
+type cachedBackend struct {
+	cache    *Cache
+	volumeID string
+	backend  backend.BlockBackend
+}
+
+func (b *cachedBackend) ReadAt(ctx context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(b.backend.Size(), off, int64(len(p))); err != nil {
+		return err
+	}
+	return b.fill(ctx, off, int64(len(p)), p)
+}
+
+// Prefetch loads the range into the cache (at most the size of the cache)
+func (b *cachedBackend) Prefetch(ctx context.Context, off int64, length int64) error {
+	if err := backend.CheckRange(b.backend.Size(), off, length); err != nil {
+		return err
+	}
+	length = min(length, b.cache.maxSize)
+	for end := off + length; off < end; {
+		step := min(end-off, maxPrefetchLength-off%lineSize)
+		if err := b.fill(ctx, off, step, nil); err != nil {
+			return err
+		}
+		off += step
+	}
+	return nil
+}
+
+// fill reads the lines of [off, off+length) that are not cached from the backend and caches them.
+// If p is not nil, the range is copied into it.
+func (b *cachedBackend) fill(ctx context.Context, off int64, length int64, p []byte) error {
+	if length == 0 {
+		return nil
+	}
+	first, last := off/lineSize, (off+length-1)/lineSize
+	lines := make([][]byte, last-first+1)
+	missingFirst, missingLast := int64(-1), int64(-1)
+	for line := first; line <= last; line++ {
+		data, ok := b.cache.get(b.volumeID, line)
+		if !ok {
+			if missingFirst < 0 {
+				missingFirst = line
+			}
+			missingLast = line
+			continue
+		}
+		lines[line-first] = data
+	}
+
+	if missingFirst >= 0 {
+		start := missingFirst * lineSize
+		end := min((missingLast+1)*lineSize, b.backend.Size())
+		buf := make([]byte, end-start)
+		fill := b.cache.startFill(b.volumeID, missingFirst, missingLast)
+		if err := b.backend.ReadAt(ctx, buf, start); err != nil {
+			b.cache.finishFill(fill, nil)
+			return err
+		}
+		read := make([][]byte, missingLast-missingFirst+1)
+		for line := missingFirst; line <= missingLast; line++ {
+			data := buf[(line-missingFirst)*lineSize : min((line-missingFirst+1)*lineSize, int64(len(buf)))]
+			lines[line-first] = data
+			read[line-missingFirst] = data
+		}
+		b.cache.finishFill(fill, read)
+	}
+
+	if p != nil {
+		for line := first; line <= last; line++ {
+			lineStart := line * lineSize
+			from := max(off, lineStart)
+			to := min(off+length, lineStart+int64(len(lines[line-first])))
+			copy(p[from-off:to-off], lines[line-first][from-lineStart:to-lineStart])
+		}
+	}
+	return nil
+}
+
+// invalidating runs a change of [off, off+length). The range is invalidated before and after the change, so that reads
+// running concurrently cannot cache the old data.
+func (b *cachedBackend) invalidating(off int64, length int64, change func() error) error {
+	b.cache.Invalidate(b.volumeID, off, length)
+	defer b.cache.Invalidate(b.volumeID, off, length)
+	return change()
+}
+
+func (b *cachedBackend) WriteAt(ctx context.Context, p []byte, off int64, flags backend.Flags) error {
+	return b.invalidating(off, int64(len(p)), func() error {
+		return b.backend.WriteAt(ctx, p, off, flags)
+	})
+}
+
+func (b *cachedBackend) Flush(ctx context.Context) error {
+	return b.backend.Flush(ctx)
+}
+
+func (b *cachedBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.invalidating(off, length, func() error {
+		return b.backend.Trim(ctx, off, length, flags)
+	})
+}
+
+func (b *cachedBackend) WriteZeroes(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.invalidating(off, length, func() error {
+		return b.backend.WriteZeroes(ctx, off, length, flags)
+	})
+}
+
+func (b *cachedBackend) Size() int64 {
+	return b.backend.Size()
+}
+
+func (b *cachedBackend) Close() error {
+	b.cache.InvalidateVolume(b.volumeID)
+	return b.backend.Close()
+}
+
+// FlushesAllWrites is an interface method of backend.SharedFlusher
+func (b *cachedBackend) FlushesAllWrites() bool {
+	return backend.FlushesAllWrites(b.backend)
+}
+
+// Extents is an interface method of backend.ExtentMapper (ErrNotSupported, if the wrapped backend has no mapping)
+func (b *cachedBackend) Extents(ctx context.Context, off int64, length int64) ([]backend.Extent, error) {
+	if mapper, ok := b.backend.(backend.ExtentMapper); ok {
+		return mapper.Extents(ctx, off, length)
+	}
+	return nil, backend.ErrNotSupported
+}
+
+// DirtyBitmaps is an interface method of backend.DirtyMapper (none, if the wrapped backend has no change tracking)
+func (b *cachedBackend) DirtyBitmaps() []string {
+	if mapper, ok := b.backend.(backend.DirtyMapper); ok {
+		return mapper.DirtyBitmaps()
+	}
+	return nil
+}
+
+func (b *cachedBackend) DirtyExtents(ctx context.Context, bitmap string, off int64, length int64) ([]backend.Extent, error) {
+	if mapper, ok := b.backend.(backend.DirtyMapper); ok {
+		return mapper.DirtyExtents(ctx, bitmap, off, length)
+	}
+	return nil, backend.ErrNotSupported
+}
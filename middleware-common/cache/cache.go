@@ -0,0 +1,194 @@
+// Package cache provides the read cache shared by the exports of a middleware
+package cache
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const lineSize = 64 << 10 // Unit of caching and eviction; TOCONFIG
+
+type key struct {
+	volumeID string
+	line     int64
+}
+
+type entry struct {
+	key  key
+	data []byte // Never modified once cached (shorter than lineSize at the end of a volume)
+}
+
+// pendingFill is a read of lines from the backend whose data is to be cached. Lines invalidated while the read runs are
+// marked stale and not cached, as the read may have returned their data from before the change.
+type pendingFill struct {
+	volumeID string
+	first    int64
+	stale    []bool // Per line from first
+}
+
+// Cache is a bounded LRU cache of volume data. Entries are keyed by volume, so exports of the same volume share them.
+type Cache struct {
+	logger  *slog.Logger
+	mu      sync.Mutex
+	maxSize int64      // Bytes
+	size    int64      // Bytes of the cached data
+	lru     *list.List // Front: most recently used
+	entries map[key]*list.Element
+	fills   map[*pendingFill]struct{}
+}
+
+// New creates a cache of sizeBytes (nil, if the size is smaller than a cache line)
+func New(parentLogger *slog.Logger, sizeBytes int64) *Cache {
+	if sizeBytes < lineSize {
+		return nil
+	}
+	return &Cache{
+		logger:  parentLogger.With("module", "cache"),
+		maxSize: sizeBytes,
+		lru:     list.New(),
+		entries: make(map[key]*list.Element),
+		fills:   make(map[*pendingFill]struct{}),
+	}
+}
+
+// Wrap returns a backend that serves reads of the export through the cache. Exports without volume id are not cached,
+// as core could not invalidate them.
+func (cache *Cache) Wrap(export backend.Export, blockBackend backend.BlockBackend) backend.BlockBackend {
+	if cache == nil || export.VolumeID == "" {
+		return blockBackend
+	}
+	return &cachedBackend{cache: cache, volumeID: export.VolumeID, backend: blockBackend}
+}
+
+// HandleMessageBlocking is an interface method of MessageHandler (invalidation messages of core; ignored without cache)
+func (cache *Cache) HandleMessageBlocking(_ context.Context, msg commoncontrol.ControlMessage) {
+	if cache == nil {
+		return
+	}
+	m, ok := msg.(*commoncontrol.CacheInvalidateMessage)
+	if !ok {
+		cache.logger.Warn("Unexpected message type", "type", msg.Type())
+		return
+	}
+	if len(m.Ranges) == 0 {
+		cache.InvalidateVolume(m.VolumeID)
+		cache.logger.Debug("Invalidated volume", "volume", m.VolumeID)
+		return
+	}
+	for _, byteRange := range m.Ranges {
+		cache.Invalidate(m.VolumeID, int64(byteRange.Offset), int64(byteRange.Length))
+	}
+	cache.logger.Debug("Invalidated ranges", "volume", m.VolumeID, "ranges", len(m.Ranges))
+}
+
+// Invalidate drops the cache lines overlapping [off, off+length) of a volume
+func (cache *Cache) Invalidate(volumeID string, off int64, length int64) {
+	if length <= 0 {
+		return
+	}
+	first, last := off/lineSize, (off+length-1)/lineSize
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.markStaleLocked(volumeID, first, last)
+	if last-first+1 > int64(len(cache.entries)) {
+		for k, element := range cache.entries {
+			if k.volumeID == volumeID && k.line >= first && k.line <= last {
+				cache.removeLocked(element)
+			}
+		}
+		return
+	}
+	for line := first; line <= last; line++ {
+		if element, ok := cache.entries[key{volumeID, line}]; ok {
+			cache.removeLocked(element)
+		}
+	}
+}
+
+// InvalidateVolume drops all cache lines of a volume
+func (cache *Cache) InvalidateVolume(volumeID string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.markStaleLocked(volumeID, 0, math.MaxInt64)
+	for k, element := range cache.entries {
+		if k.volumeID == volumeID {
+			cache.removeLocked(element)
+		}
+	}
+}
+
+// markStaleLocked marks the lines [first, last] of the pending fills of a volume stale
+func (cache *Cache) markStaleLocked(volumeID string, first int64, last int64) {
+	for fill := range cache.fills {
+		if fill.volumeID != volumeID {
+			continue
+		}
+		for line := max(first, fill.first); line <= min(last, fill.first+int64(len(fill.stale))-1); line++ {
+			fill.stale[line-fill.first] = true
+		}
+	}
+}
+
+// startFill registers a read of the lines [first, last] from the backend, the data of the lines that are not
+// invalidated before finishFill is cached
+func (cache *Cache) startFill(volumeID string, first int64, last int64) *pendingFill {
+	fill := &pendingFill{volumeID: volumeID, first: first, stale: make([]bool, last-first+1)}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.fills[fill] = struct{}{}
+	return fill
+}
+
+// finishFill caches the lines read by a fill that were not invalidated while it ran (lines nil: the read failed)
+func (cache *Cache) finishFill(fill *pendingFill, lines [][]byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.fills, fill)
+	for i, data := range lines {
+		if !fill.stale[i] {
+			cache.putLocked(key{fill.volumeID, fill.first + int64(i)}, data)
+		}
+	}
+}
+
+func (cache *Cache) get(volumeID string, line int64) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key{volumeID, line}]
+	if !ok {
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	return element.Value.(*entry).data, true
+}
+
+// putLocked caches a line and evicts the least recently used lines beyond the size of the cache
+func (cache *Cache) putLocked(k key, data []byte) {
+	if element, ok := cache.entries[k]; ok {
+		cached := element.Value.(*entry)
+		cache.size += int64(len(data)) - int64(len(cached.data))
+		cached.data = data
+		cache.lru.MoveToFront(element)
+	} else {
+		cache.entries[k] = cache.lru.PushFront(&entry{key: k, data: data})
+		cache.size += int64(len(data))
+	}
+	for cache.size > cache.maxSize {
+		cache.removeLocked(cache.lru.Back())
+	}
+}
+
+func (cache *Cache) removeLocked(element *list.Element) {
+	cached := element.Value.(*entry)
+	delete(cache.entries, cached.key)
+	cache.size -= int64(len(cached.data))
+	cache.lru.Remove(element)
+}
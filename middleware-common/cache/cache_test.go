@@ -0,0 +1,342 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const testVolumeID = "volume-1"
+
+// memBackend is a BlockBackend in memory that counts the reads. onRead runs during every read, after the data was copied.
+type memBackend struct {
+	mu     sync.Mutex
+	data   []byte
+	reads  int
+	onRead func(off int64, length int64)
+}
+
+func (b *memBackend) ReadAt(_ context.Context, p []byte, off int64) error {
+	b.mu.Lock()
+	copy(p, b.data[off:])
+	b.reads++
+	onRead := b.onRead
+	b.mu.Unlock()
+	if onRead != nil {
+		onRead(off, int64(len(p)))
+	}
+	return nil
+}
+
+func (b *memBackend) WriteAt(_ context.Context, p []byte, off int64, _ backend.Flags) error {
+	b.set(p, off)
+	return nil
+}
+
+func (b *memBackend) Flush(context.Context) error { return nil }
+
+func (b *memBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.WriteZeroes(ctx, off, length, flags)
+}
+
+func (b *memBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	b.set(make([]byte, length), off)
+	return nil
+}
+
+func (b *memBackend) Size() int64 { return int64(len(b.data)) }
+
+func (b *memBackend) Close() error { return nil }
+
+// set changes the data behind the back of the cache, like another middleware writing to the volume
+func (b *memBackend) set(p []byte, off int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(b.data[off:], p)
+}
+
+func (b *memBackend) readCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reads
+}
+
+func newTestCache(t *testing.T, lines int64, size int64) (*Cache, *memBackend, backend.BlockBackend) {
+	t.Helper()
+	cache := New(slog.New(slog.DiscardHandler), lines*lineSize)
+	if cache == nil {
+		t.Fatal("cache disabled")
+	}
+	mem := &memBackend{data: bytes.Repeat([]byte{1}, int(size))}
+	return cache, mem, cache.Wrap(backend.Export{Name: "export", VolumeID: testVolumeID}, mem)
+}
+
+func read(t *testing.T, cached backend.BlockBackend, off int64, length int64) []byte {
+	t.Helper()
+	p := make([]byte, length)
+	if err := cached.ReadAt(t.Context(), p, off); err != nil {
+		t.Fatalf("read at %d failed: %v", off, err)
+	}
+	return p
+}
+
+// cachedLines returns the lines of the test volume in the cache, from the most to the least recently used
+func cachedLines(cache *Cache) []int64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var lines []int64
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		lines = append(lines, element.Value.(*entry).key.line)
+	}
+	return lines
+}
+
+func TestNew(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	if cache := New(logger, lineSize-1); cache != nil {
+		t.Fatal("cache smaller than a line not disabled")
+	}
+	var cache *Cache
+	mem := &memBackend{data: make([]byte, lineSize)}
+	if wrapped := cache.Wrap(backend.Export{VolumeID: testVolumeID}, mem); wrapped != mem {
+		t.Fatal("disabled cache wrapped the backend")
+	}
+	if wrapped := New(logger, lineSize).Wrap(backend.Export{}, mem); wrapped != mem {
+		t.Fatal("export without volume id is cached")
+	}
+	cache.HandleMessageBlocking(t.Context(), commoncontrol.NewCacheInvalidateMessage(1, testVolumeID, nil)) // Must not panic
+}
+
+func TestHitAndMiss(t *testing.T) {
+	_, mem, cached := newTestCache(t, 4, 4*lineSize)
+
+	if p := read(t, cached, 100, 1000); !bytes.Equal(p, bytes.Repeat([]byte{1}, 1000)) {
+		t.Fatal("miss returned wrong data")
+	}
+	if reads := mem.readCount(); reads != 1 {
+		t.Fatalf("%d reads of the backend on a miss, want 1", reads)
+	}
+
+	// Changes behind the back of the cache are not seen until the range is invalidated
+	mem.set(bytes.Repeat([]byte{2}, 1000), 100)
+	if p := read(t, cached, 0, lineSize); !bytes.Equal(p[100:1100], bytes.Repeat([]byte{1}, 1000)) {
+		t.Fatal("hit returned data that is not cached")
+	}
+	if reads := mem.readCount(); reads != 1 {
+		t.Fatalf("%d reads of the backend after a hit, want 1", reads)
+	}
+
+	// A read across a cached and an uncached line only reads the missing line
+	if p := read(t, cached, lineSize-10, 20); !bytes.Equal(p, bytes.Repeat([]byte{1}, 20)) {
+		t.Fatal("partial hit returned wrong data")
+	}
+	if reads := mem.readCount(); reads != 2 {
+		t.Fatalf("%d reads of the backend after a partial hit, want 2", reads)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(cache *Cache)
+		cached     []int64 // Most recently used first
+	}{
+		{name: "range", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, lineSize+1, 1) }, cached: []int64{2, 0}},
+		{name: "range across lines", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, lineSize-1, lineSize+2) }, cached: nil},
+		{name: "range larger than the cache", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, lineSize, 100*lineSize) }, cached: []int64{0}},
+		{name: "empty range", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, 0, 0) }, cached: []int64{2, 1, 0}},
+		{name: "other volume", invalidate: func(cache *Cache) { cache.InvalidateVolume("volume-2") }, cached: []int64{2, 1, 0}},
+		{name: "volume", invalidate: func(cache *Cache) { cache.InvalidateVolume(testVolumeID) }, cached: nil},
+		{
+			name: "message with ranges",
+			invalidate: func(cache *Cache) {
+				cache.HandleMessageBlocking(context.Background(), commoncontrol.NewCacheInvalidateMessage(1, testVolumeID, []commoncontrol.ByteRange{{Offset: 0, Length: 1}, {Offset: 2 * lineSize, Length: 1}}))
+			},
+			cached: []int64{1},
+		},
+		{
+			name: "message without ranges",
+			invalidate: func(cache *Cache) {
+				cache.HandleMessageBlocking(context.Background(), commoncontrol.NewCacheInvalidateMessage(1, testVolumeID, nil))
+			},
+			cached: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, mem, cached := newTestCache(t, 4, 3*lineSize)
+			read(t, cached, 0, 3*lineSize)
+			test.invalidate(cache)
+			if lines := cachedLines(cache); !slices.Equal(lines, test.cached) {
+				t.Fatalf("cached lines %v, want %v", lines, test.cached)
+			}
+
+			// Invalidated lines are read again
+			mem.set(bytes.Repeat([]byte{2}, 3*lineSize), 0)
+			for line := range int64(3) {
+				want := byte(2)
+				if slices.Contains(test.cached, line) {
+					want = 1
+				}
+				if p := read(t, cached, line*lineSize, lineSize); !bytes.Equal(p, bytes.Repeat([]byte{want}, lineSize)) {
+					t.Fatalf("line %d does not read as %d", line, want)
+				}
+			}
+		})
+	}
+}
+
+// TestInvalidationRacingFill checks that lines invalidated while they are read from the backend are not cached, as the
+// read may have returned their data from before the change
+func TestInvalidationRacingFill(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(cache *Cache)
+		cached     []int64
+	}{
+		{name: "line", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, lineSize, 1) }, cached: []int64{2, 0}},
+		{name: "volume", invalidate: func(cache *Cache) { cache.InvalidateVolume(testVolumeID) }, cached: nil},
+		{name: "other line", invalidate: func(cache *Cache) { cache.Invalidate(testVolumeID, 5*lineSize, 1) }, cached: []int64{2, 1, 0}},
+		{name: "other volume", invalidate: func(cache *Cache) { cache.Invalidate("volume-2", lineSize, 1) }, cached: []int64{2, 1, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, mem, cached := newTestCache(t, 8, 8*lineSize)
+			mem.onRead = func(int64, int64) {
+				test.invalidate(cache)
+			}
+			read(t, cached, 0, 3*lineSize)
+			if lines := cachedLines(cache); !slices.Equal(lines, test.cached) {
+				t.Fatalf("cached lines %v, want %v", lines, test.cached)
+			}
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			if len(cache.fills) != 0 {
+				t.Fatalf("%d fills pending after the read", len(cache.fills))
+			}
+		})
+	}
+}
+
+// TestWritesInvalidate checks that changes through the cached backend are read back
+func TestWritesInvalidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(ctx context.Context, cached backend.BlockBackend) error
+		want   byte
+	}{
+		{name: "write", change: func(ctx context.Context, cached backend.BlockBackend) error {
+			return cached.WriteAt(ctx, bytes.Repeat([]byte{3}, 10), lineSize+5, 0)
+		}, want: 3},
+		{name: "trim", change: func(ctx context.Context, cached backend.BlockBackend) error {
+			return cached.Trim(ctx, lineSize+5, 10, 0)
+		}, want: 0},
+		{name: "write zeroes", change: func(ctx context.Context, cached backend.BlockBackend) error {
+			return cached.WriteZeroes(ctx, lineSize+5, 10, 0)
+		}, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, cached := newTestCache(t, 4, 3*lineSize)
+			read(t, cached, 0, 3*lineSize)
+			if err := test.change(t.Context(), cached); err != nil {
+				t.Fatal(err)
+			}
+			if p := read(t, cached, lineSize+5, 10); !bytes.Equal(p, bytes.Repeat([]byte{test.want}, 10)) {
+				t.Fatalf("read %v after the change, want %d", p, test.want)
+			}
+		})
+	}
+}
+
+func TestEviction(t *testing.T) {
+	cache, mem, cached := newTestCache(t, 2, 4*lineSize)
+	read(t, cached, 0, 1)
+	read(t, cached, lineSize, 1)
+	read(t, cached, 0, 1) // Line 0 becomes the most recently used
+	read(t, cached, 2*lineSize, 1)
+	if lines := cachedLines(cache); !slices.Equal(lines, []int64{2, 0}) {
+		t.Fatalf("cached lines %v, want [2 0]", lines)
+	}
+	reads := mem.readCount()
+	read(t, cached, lineSize, 1)
+	if mem.readCount() != reads+1 {
+		t.Fatal("evicted line served from the cache")
+	}
+
+	// A read larger than the cache keeps its last lines
+	read(t, cached, 0, 4*lineSize)
+	if lines := cachedLines(cache); !slices.Equal(lines, []int64{3, 2}) {
+		t.Fatalf("cached lines %v after a large read, want [3 2]", lines)
+	}
+}
+
+func TestSizeAccounting(t *testing.T) {
+	const size = 2*lineSize + lineSize/2 // The last line is short
+	cache, _, cached := newTestCache(t, 3, size)
+	cachedSize := func() int64 {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return cache.size
+	}
+
+	read(t, cached, 0, size)
+	if got := cachedSize(); got != size {
+		t.Fatalf("size %d, want %d", got, size)
+	}
+
+	// Caching a line again replaces its data
+	cache.mu.Lock()
+	cache.putLocked(key{testVolumeID, 2}, make([]byte, lineSize/4))
+	cache.mu.Unlock()
+	if got := cachedSize(); got != 2*lineSize+lineSize/4 {
+		t.Fatalf("size %d after replacing a line, want %d", got, 2*lineSize+lineSize/4)
+	}
+
+	cache.Invalidate(testVolumeID, 0, 1)
+	if got := cachedSize(); got != lineSize+lineSize/4 {
+		t.Fatalf("size %d after an invalidation, want %d", got, lineSize+lineSize/4)
+	}
+
+	// The short line leaves room for a line of another volume, which evicts nothing
+	other := cache.Wrap(backend.Export{Name: "other", VolumeID: "volume-2"}, &memBackend{data: make([]byte, lineSize)})
+	read(t, other, 0, lineSize)
+	if got := cachedSize(); got != 2*lineSize+lineSize/4 {
+		t.Fatalf("size %d after caching another volume, want %d", got, 2*lineSize+lineSize/4)
+	}
+	if lines := cachedLines(cache); len(lines) != 3 {
+		t.Fatalf("cached lines %v, want 3", lines)
+	}
+
+	cache.InvalidateVolume(testVolumeID)
+	cache.InvalidateVolume("volume-2")
+	if got := cachedSize(); got != 0 {
+		t.Fatalf("size %d of the empty cache", got)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	cache, mem, cached := newTestCache(t, 2, 4*lineSize)
+	if err := cached.(backend.Prefetcher).Prefetch(t.Context(), 0, 4*lineSize); err != nil {
+		t.Fatal(err)
+	}
+	// At most the size of the cache is prefetched
+	if lines := cachedLines(cache); !slices.Equal(lines, []int64{1, 0}) {
+		t.Fatalf("cached lines %v, want [1 0]", lines)
+	}
+	reads := mem.readCount()
+	read(t, cached, 0, 2*lineSize)
+	if mem.readCount() != reads {
+		t.Fatal("prefetched range read from the backend")
+	}
+	if err := cached.(backend.Prefetcher).Prefetch(t.Context(), 3*lineSize, 2*lineSize); err == nil {
+		t.Fatal("prefetch beyond the end succeeded")
+	}
+}
@@ -4,16 +4,21 @@ package config
 import (
 	"fmt"
 	"net"
+	"path"
+	"strconv"
 	"strings"
 
 	commonconfig "quorumbd.net/common/config"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
+	"github.com/google/uuid"
 )
 
 type Config struct {
 	CommonConfig         commonconfig.CommonConfig `toml:"common"`
 	CoreConnectionConfig CoreConnectionConfig      `toml:"coreconnection"`
+	CacheConfig          CacheConfig               `toml:"cache"`
 }
 
 type CoreConnectionConfig struct {
@@ -37,6 +42,83 @@ func (cfg *CoreConnectionConfig) Validate() error {
 		)}.Filter()
 }
 
+// InstanceConfig identifies the middleware instance to core
+type InstanceConfig struct {
+	UUID string `toml:"uuid"` // Persistent instance UUID, volumes of core restrict their visibility by it. Empty: random with every start
+}
+
+func (cfg *InstanceConfig) SetDefaults() {
+}
+
+func (cfg *InstanceConfig) Validate() error {
+	return validation.Errors{
+		"instance": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.UUID, is.UUID.Error("instance.uuid must be a UUID")),
+		)}.Filter()
+}
+
+// InstanceUUID returns the configured instance UUID (uuid.Nil, if none is configured)
+func (cfg *InstanceConfig) InstanceUUID() uuid.UUID {
+	id, err := uuid.Parse(cfg.UUID)
+	if err != nil {
+		return uuid.Nil
+	}
+	return id
+}
+
+// CacheConfig configures the read cache shared by all exports of the middleware
+type CacheConfig struct {
+	SizeMiB int64 `toml:"size_mib"` // 0 disables the cache
+}
+
+func (cfg *CacheConfig) SetDefaults() {
+	cfg.SizeMiB = 64
+}
+
+func (cfg *CacheConfig) Validate() error {
+	return validation.Errors{
+		"cache": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.SizeMiB, validation.Min(int64(0)).Error("cache.size_mib must not be negative")),
+		)}.Filter()
+}
+
+// ACLRule grants a peer access to the exports matching a pattern. A rule applies, if any of its principals matches the peer.
+// The principals are the identities of clients on the control plane: the peer credentials of unix socket clients and
+// the TLS identity of clients with a verified certificate.
+type ACLRule struct {
+	Exports       string   `toml:"exports"` // path.Match pattern of export names
+	UIDs          []uint32 `toml:"uids"`
+	GIDs          []uint32 `toml:"gids"` // Matched against the primary and the supplementary groups of the peer
+	TLSIdentities []string `toml:"tls_identities"`
+	ReadOnly      bool     `toml:"read_only"`
+}
+
+// ValidateACL validates the ACL rules of a config section (e.g. nbdserver.acl)
+func ValidateACL(section string, rules []ACLRule) error {
+	errs := validation.Errors{}
+	for i := range rules {
+		rule := &rules[i]
+		if err := validation.ValidateStruct(rule,
+			validation.Field(&rule.Exports, validation.Required.Error(section+".exports required"), validation.By(ValidateExportPattern)),
+		); err != nil {
+			errs[strconv.Itoa(i)] = err
+			continue
+		}
+		if len(rule.UIDs) == 0 && len(rule.GIDs) == 0 && len(rule.TLSIdentities) == 0 {
+			errs[strconv.Itoa(i)] = fmt.Errorf("%s rule needs at least one of uids, gids or tls_identities", section)
+		}
+	}
+	return errs.Filter()
+}
+
+// ValidateExportPattern validates a path.Match pattern of export names
+func ValidateExportPattern(value any) error {
+	if _, err := path.Match(value.(string), ""); err != nil {
+		return fmt.Errorf("invalid export pattern: %w", err)
+	}
+	return nil
+}
+
 func validateCoreURI(value interface{}) error {
 	uri, ok := value.(string)
 	if !ok {
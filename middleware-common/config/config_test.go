@@ -0,0 +1,67 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateACL(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ACLRule
+		err   string // Expected part of the error, empty for valid rules
+	}{
+		{name: "no rules"},
+		{name: "principals", rules: []ACLRule{{Exports: "vm-*", UIDs: []uint32{0}}, {Exports: "*", GIDs: []uint32{100}}, {Exports: "backup", TLSIdentities: []string{"backup"}}}},
+		{name: "missing pattern", rules: []ACLRule{{UIDs: []uint32{0}}}, err: "http.acl.exports required"},
+		{name: "invalid pattern", rules: []ACLRule{{Exports: "vm-[", UIDs: []uint32{0}}}, err: "invalid export pattern"},
+		{name: "no principal", rules: []ACLRule{{Exports: "*", UIDs: []uint32{0}}, {Exports: "*", ReadOnly: true}}, err: "1: http.acl rule needs at least one of uids, gids or tls_identities"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateACL("http.acl", test.rules)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestInstanceConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		uuid string
+		want uuid.UUID
+		err  string
+	}{
+		{name: "random", uuid: "", want: uuid.Nil},
+		{name: "persistent", uuid: "6f0c4f1e-8a53-4b43-9b5e-3c2f6b1d9a10", want: uuid.MustParse("6f0c4f1e-8a53-4b43-9b5e-3c2f6b1d9a10")},
+		{name: "invalid", uuid: "middleware-1", err: "instance.uuid must be a UUID"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := InstanceConfig{UUID: test.uuid}
+			err := cfg.Validate()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := cfg.InstanceUUID(); id != test.want {
+				t.Fatalf("uuid %s, want %s", id, test.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,11 @@ package control
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,33 +19,54 @@ import (
 )
 
 const (
-	maxFrameSize = 1 << 20 // 1MB
+	heartbeatInterval = 10 * time.Second // TOCONFIG
+	gracePeriod       = 60 * time.Second // Time the worker may be without a registered core connection // TOCONFIG
 )
 
-var controlWorkerSingleton struct {
-	mu          sync.Mutex
-	initialized bool
-}
-
 type ControlWorker struct {
-	logger     *slog.Logger
-	dispatcher *Dispatcher
+	logger         *slog.Logger
+	dispatcher     *Dispatcher
+	registration   func() commoncontrol.ControlMessage
+	gracePeriod    time.Duration
+	connected      atomic.Bool  // Set once the registration was sent on the current connection
+	lastActivity   atomic.Int64 // Unix nanoseconds of the last progress, start or disconnect
+	registered     chan struct{}
+	registeredOnce sync.Once
 }
 
 func NewControlWorker(parentLogger *slog.Logger, dispatcher *Dispatcher) *ControlWorker {
-	controlWorkerSingleton.mu.Lock()
-	defer controlWorkerSingleton.mu.Unlock()
+	cw := &ControlWorker{
+		logger:      parentLogger.With("module", "controlworker"),
+		dispatcher:  dispatcher,
+		gracePeriod: gracePeriod,
+		registered:  make(chan struct{}),
+	}
+	cw.touch()
+	return cw
+}
 
-	if controlWorkerSingleton.initialized {
-		panic("controlworker singleton already instantiated")
+// SetRegistration sets the function that builds the registration message, which is sent first on every new core connection
+func (cw *ControlWorker) SetRegistration(registration func() commoncontrol.ControlMessage) {
+	cw.registration = registration
+}
+
+// Alive reports false, if the loops of the connected worker made no progress for several heartbeat intervals, or if
+// the worker was not registered with core for longer than the grace period after its start or a lost connection
+func (cw *ControlWorker) Alive() bool {
+	since := time.Since(time.Unix(0, cw.lastActivity.Load()))
+	if cw.connected.Load() {
+		return since < 3*heartbeatInterval
 	}
+	return since < cw.gracePeriod
+}
 
-	controlWorkerSingleton.initialized = true
+// Registered is closed once the first registration was sent to core
+func (cw *ControlWorker) Registered() <-chan struct{} {
+	return cw.registered
+}
 
-	return &ControlWorker{
-		logger:     parentLogger.With("module", "controlworker"),
-		dispatcher: dispatcher,
-	}
+func (cw *ControlWorker) touch() {
+	cw.lastActivity.Store(time.Now().UnixNano())
 }
 
 func (cw *ControlWorker) String() string {
@@ -72,16 +91,32 @@ func (cw *ControlWorker) Run(parentCtx context.Context, workerExitCh chan<- work
 	defer conn.Close()
 	cw.logger.Info("Connected", "address", conn.RemoteAddr().String())
 
+	cw.touch()
+	defer func() {
+		cw.connected.Store(false)
+		cw.touch() // The grace period starts with the disconnect
+	}()
+
 	go func() {
 		<-childContext.Done()
 		conn.Close()
 	}()
 
-	if err := commonio.WriteFull(conn, append([]byte("CTRL"), middlewareUUID[:]...)); err != nil {
+	if err := commonio.WriteFull(conn, append(commoncontrol.Preamble[:], middlewareUUID[:]...)); err != nil {
 		cw.exit(err, workerExitCh)
 		return
 	}
 
+	if cw.registration != nil {
+		if err := cw.send(cw.registration(), 3*time.Second, conn); err != nil { // TOCONFIG
+			cw.exit(err, workerExitCh)
+			return
+		}
+	}
+	cw.touch()
+	cw.connected.Store(true)
+	cw.registeredOnce.Do(func() { close(cw.registered) })
+
 	errCh := make(chan error, 2)
 
 	go func() {
@@ -118,11 +153,24 @@ func (cw *ControlWorker) exit(err error, workerExitCh chan<- worker.WorkerExit)
 }
 
 func (cw *ControlWorker) sendLoop(ctx context.Context, conn net.Conn) error {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			cw.logger.Info("Stopping send loop because context done")
 			return nil
+		case <-heartbeat.C:
+			cw.touch()
+			if err := cw.send(commoncontrol.NewMiddlewareHeartbeatMessage(cw.dispatcher.NextRequestID()), 3*time.Second, conn); err != nil { // TOCONFIG
+				if ctx.Err() != nil {
+					cw.logger.Info("Stopping send loop because context done")
+					return nil
+				}
+				cw.logger.Warn("Stopping send loop", "error", err)
+				return err
+			}
 		case msg, ok := <-cw.dispatcher.toCore:
 			if !ok {
 				cw.logger.Warn("Stopping send loop because of closed channel")
@@ -147,22 +195,7 @@ func (cw *ControlWorker) send(msg commoncontrol.ControlMessage, timeout time.Dur
 	}
 	defer conn.SetWriteDeadline(time.Time{})
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
-	var header [4]byte
-	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
-
-	if err := commonio.WriteFull(conn, header[:]); err != nil {
-		return err
-	}
-	if err := commonio.WriteFull(conn, data); err != nil {
-		return err
-	}
-
-	return nil
+	return commoncontrol.WriteMessage(conn, msg)
 }
 
 func (cw *ControlWorker) recvLoop(ctx context.Context, conn net.Conn) error {
@@ -177,8 +210,16 @@ func (cw *ControlWorker) recvLoop(ctx context.Context, conn net.Conn) error {
 			return err
 		}
 
+		cw.touch()
 		cw.logger.Debug("Received control message from core", "message", fmt.Sprintf("%+v", msg))
 
+		if commoncontrol.IsResponse(msg) {
+			if !cw.dispatcher.deliverResponse(msg) {
+				cw.logger.Debug("Dropping response without pending request", "type", msg.Type(), "request_id", msg.RequestID())
+			}
+			continue
+		}
+
 		handler := cw.dispatcher.getHandlerForMessageType(msg.Type())
 		if handler == nil {
 			cw.logger.Warn("No handler for message type", "type", msg.Type())
@@ -190,36 +231,5 @@ func (cw *ControlWorker) recvLoop(ctx context.Context, conn net.Conn) error {
 }
 
 func (cw *ControlWorker) receive(conn net.Conn) (commoncontrol.ControlMessage, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
-		return nil, err
-	}
-
-	length := binary.BigEndian.Uint32(lenBuf[:])
-	if length > maxFrameSize {
-		return nil, fmt.Errorf("frame too large: %d > %d", length, maxFrameSize)
-	}
-
-	data := make([]byte, length)
-	if _, err := io.ReadFull(conn, data); err != nil {
-		return nil, err
-	}
-
-	var head struct {
-		Type uint32 `json:"type"`
-	}
-	if err := json.Unmarshal(data, &head); err != nil {
-		return nil, err
-	}
-
-	msg, err := commoncontrol.NewMessage(head.Type)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal(data, msg); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
+	return commoncontrol.ReadMessage(conn)
 }
@@ -0,0 +1,130 @@
+package control
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/helper/errorhelper"
+
+	"quorumbd.net/middleware-common/config"
+	"quorumbd.net/middleware-common/coreconnection"
+	"quorumbd.net/middleware-common/worker"
+)
+
+// fakeCore accepts control connections and delivers the first message of each, the probe of the supervisor is ignored
+func fakeCore(t *testing.T) (*coreconnection.CoreEndpoint, chan commoncontrol.ControlMessage, chan net.Conn) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages, conns := make(chan commoncontrol.ControlMessage, 4), make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.ReadFull(conn, make([]byte, len(commoncontrol.Preamble)+16)); err != nil {
+					conn.Close()
+					return
+				}
+				conns <- conn
+				if msg, err := commoncontrol.ReadMessage(conn); err == nil {
+					messages <- msg
+				}
+			}()
+		}
+	}()
+
+	logger := slog.New(slog.DiscardHandler)
+	supervisor, err := coreconnection.New(&config.CoreConnectionConfig{Server: "unix://" + path}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := supervisor.Try(context.Background(), 0, time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	return supervisor.GetCurrentEndpoint(), messages, conns
+}
+
+func TestAliveAfterGracePeriod(t *testing.T) {
+	cw := NewControlWorker(slog.New(slog.DiscardHandler), NewDispatcher(slog.New(slog.DiscardHandler)))
+	cw.gracePeriod = 50 * time.Millisecond
+	if !cw.Alive() {
+		t.Fatal("worker is not alive within the grace period")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cw.Alive() {
+		t.Fatal("worker that never registered is alive after the grace period")
+	}
+}
+
+func TestRegisteredAfterRegistration(t *testing.T) {
+	endpoint, messages, conns := fakeCore(t)
+	logger := slog.New(slog.DiscardHandler)
+	cw := NewControlWorker(logger, NewDispatcher(logger))
+	cw.gracePeriod = 200 * time.Millisecond
+	middlewareUUID := uuid.New()
+	cw.SetRegistration(func() commoncontrol.ControlMessage {
+		select {
+		case <-cw.Registered():
+			t.Error("registered before the registration was sent")
+		default:
+		}
+		return commoncontrol.NewMiddlewareRegisterMessage(1, commoncontrol.MiddlewareInfo{UUID: middlewareUUID.String()})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exits := make(chan worker.WorkerExit, 1)
+	go cw.Run(ctx, exits, middlewareUUID, *endpoint)
+
+	select {
+	case <-cw.Registered():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not registered")
+	}
+	select {
+	case msg := <-messages:
+		if msg.Type() != commoncontrol.CMMiddlewareRegister {
+			t.Fatalf("first message %d is not the registration", msg.Type())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("core did not receive the registration")
+	}
+
+	time.Sleep(250 * time.Millisecond) // Longer than the grace period, shorter than the heartbeat timeout
+	if !cw.Alive() {
+		t.Fatal("registered worker is not alive")
+	}
+
+	// Losing the connection starts the grace period again
+	(<-conns).Close()
+	select {
+	case exit := <-exits:
+		if exit.Kind() != errorhelper.ExitReconnect {
+			t.Fatalf("exit: %s", exit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not exit after the connection was lost")
+	}
+	if !cw.Alive() {
+		t.Fatal("worker is not alive right after the connection was lost")
+	}
+	time.Sleep(250 * time.Millisecond)
+	if cw.Alive() {
+		t.Fatal("worker is alive after the grace period without connection")
+	}
+}
@@ -2,9 +2,11 @@
 package control
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	commoncontrol "quorumbd.net/common/control"
@@ -15,29 +17,23 @@ type Dispatcher struct {
 	toCore     chan commoncontrol.ControlMessage
 	registry   map[uint32]commoncontrol.MessageHandler
 	registryMu sync.RWMutex
+	requestID  atomic.Uint64
+	pendingMu  sync.Mutex
+	pending    map[uint64]chan commoncontrol.ControlMessage // Requests waiting for a response of core
 }
 
-var (
-	dispatcherInstance *Dispatcher
-	dispatcherOnce     sync.Once
-)
-
 func NewDispatcher(parentLogger *slog.Logger) *Dispatcher {
-	dispatcherOnce.Do(func() {
-		dispatcherInstance = &Dispatcher{
-			logger:   parentLogger.With("module", "dispatcher"),
-			toCore:   make(chan commoncontrol.ControlMessage, 6),
-			registry: make(map[uint32]commoncontrol.MessageHandler),
-		}
-	})
-	return dispatcherInstance
+	return &Dispatcher{
+		logger:   parentLogger.With("module", "dispatcher"),
+		toCore:   make(chan commoncontrol.ControlMessage, 6),
+		registry: make(map[uint32]commoncontrol.MessageHandler),
+		pending:  make(map[uint64]chan commoncontrol.ControlMessage),
+	}
 }
 
-func GetDispatcher() (*Dispatcher, error) {
-	if dispatcherInstance == nil {
-		return nil, fmt.Errorf("dispatcher is not initialized")
-	}
-	return dispatcherInstance, nil
+// NextRequestID returns a new request id for messages to core
+func (dispatcher *Dispatcher) NextRequestID() uint64 {
+	return dispatcher.requestID.Add(1)
 }
 
 func (dispatcher *Dispatcher) SendMessageToCore(msg commoncontrol.ControlMessage) error {
@@ -49,6 +45,45 @@ func (dispatcher *Dispatcher) SendMessageToCore(msg commoncontrol.ControlMessage
 	return nil
 }
 
+// Request sends a request to core and waits for the response with the same request id
+func (dispatcher *Dispatcher) Request(ctx context.Context, msg commoncontrol.ControlMessage) (commoncontrol.ControlMessage, error) {
+	responseCh := make(chan commoncontrol.ControlMessage, 1)
+	dispatcher.pendingMu.Lock()
+	dispatcher.pending[msg.RequestID()] = responseCh
+	dispatcher.pendingMu.Unlock()
+	defer func() {
+		dispatcher.pendingMu.Lock()
+		delete(dispatcher.pending, msg.RequestID())
+		dispatcher.pendingMu.Unlock()
+	}()
+
+	if err := dispatcher.SendMessageToCore(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseCh:
+		return response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response of core to request %d: %w", msg.RequestID(), ctx.Err())
+	}
+}
+
+// deliverResponse hands a response of core to the waiting request (false, if nobody waits for it)
+func (dispatcher *Dispatcher) deliverResponse(msg commoncontrol.ControlMessage) bool {
+	dispatcher.pendingMu.Lock()
+	responseCh, ok := dispatcher.pending[msg.RequestID()]
+	dispatcher.pendingMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case responseCh <- msg:
+	default: // Duplicate response
+	}
+	return true
+}
+
 func (dispatcher *Dispatcher) RegisterForCoreMessage(messageType uint32, messageHandler commoncontrol.MessageHandler) error {
 	dispatcher.registryMu.Lock()
 	defer dispatcher.registryMu.Unlock()
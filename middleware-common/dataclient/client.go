@@ -0,0 +1,392 @@
+// Package dataclient is the client of the core data path. It opens the block backends of the attached exports, every
+// adaptor uses it through the backend.Provider of the app.
+package dataclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	commondata "quorumbd.net/common/data"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/coreconnection"
+)
+
+const (
+	maxRetries = 3                      // Retries of a request after a checksum mismatch or a lost connection // TOCONFIG
+	retryDelay = 200 * time.Millisecond // Multiplied by the attempt // TOCONFIG
+)
+
+var errClosed = fmt.Errorf("%w: backend is closed", backend.ErrNoDataPath)
+
+type Client struct {
+	logger   *slog.Logger
+	uuid     uuid.UUID
+	endpoint func() *coreconnection.CoreEndpoint
+}
+
+// New returns a client that connects to the current core endpoint (e.g. CoreSupervisor.GetCurrentEndpoint)
+func New(parentLogger *slog.Logger, middlewareUUID uuid.UUID, endpoint func() *coreconnection.CoreEndpoint) *Client {
+	return &Client{
+		logger:   parentLogger.With("module", "dataclient"),
+		uuid:     middlewareUUID,
+		endpoint: endpoint,
+	}
+}
+
+// Open is an interface method of backend.Provider. The data connection is opened right away, so that unknown volumes
+// and stale epochs fail the attachment. The change tracking bitmaps of the volume are requested once.
+func (c *Client) Open(ctx context.Context, export backend.Export, size int64) (backend.BlockBackend, error) {
+	b := &volumeBackend{
+		client: c,
+		logger: c.logger.With("export", export.Name, "volume", export.VolumeID, "epoch", export.Epoch),
+		export: export,
+		size:   size,
+	}
+	reply, err := b.request(ctx, commondata.Request{Opcode: commondata.OpBitmaps})
+	if err == nil {
+		b.bitmaps, err = commondata.ParseBitmapsReply(reply)
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// volumeBackend is the block backend of an export. Requests are pipelined on one data connection, which is
+// reconnected when it is lost.
+type volumeBackend struct {
+	client  *Client
+	logger  *slog.Logger
+	export  backend.Export
+	size    int64
+	bitmaps []string // Change tracking bitmaps of the volume
+	mu      sync.Mutex
+	session *session // nil, if not connected
+	fenced  bool
+	closed  bool
+}
+
+// currentSession returns the data connection, connecting if there is none
+func (b *volumeBackend) currentSession(ctx context.Context) (*session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.closed:
+		return nil, errClosed
+	case b.fenced:
+		return nil, backend.ErrFenced
+	case b.session != nil && !b.session.broken():
+		return b.session, nil
+	}
+
+	s, err := b.client.connect(ctx, b.export, b.size)
+	if err != nil {
+		if errors.Is(err, backend.ErrFenced) {
+			b.fence()
+		}
+		return nil, err
+	}
+	if b.session != nil {
+		b.logger.Info("Data connection reestablished")
+	}
+	b.session = s
+	return s, nil
+}
+
+// fence makes the backend fail all further requests (b.mu must be held)
+func (b *volumeBackend) fence() {
+	if b.fenced {
+		return
+	}
+	b.fenced = true
+	b.logger.Warn("Attachment of the volume is fenced by core, failing all requests")
+	if b.session != nil {
+		b.session.fail(backend.ErrFenced)
+	}
+}
+
+// request executes a request, retrying it after checksum mismatches and lost connections
+func (b *volumeBackend) request(ctx context.Context, req commondata.Request) (*commondata.Reply, error) {
+	for attempt := 0; ; attempt++ {
+		reply, err := b.try(ctx, req)
+		if err == nil || !retryable(err) || attempt == maxRetries || ctx.Err() != nil {
+			return reply, err
+		}
+		b.logger.Debug("Retrying request", "op", req.Opcode.String(), "offset", req.Offset, "attempt", attempt+1, "error", err)
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *volumeBackend) try(ctx context.Context, req commondata.Request) (*commondata.Reply, error) {
+	s, err := b.currentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Epoch = b.export.Epoch
+	reply, err := s.do(ctx, &req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if reply.Status == commondata.StatusStaleEpoch {
+		b.mu.Lock()
+		b.fence()
+		b.mu.Unlock()
+	}
+	return reply, statusError(reply.Status)
+}
+
+// chunked runs fn concurrently for the chunks of [off, off+length) of at most chunkSize bytes
+func chunked(off int64, length int64, chunkSize int64, fn func(off int64, length int64) error) error {
+	if length == 0 {
+		return nil
+	}
+	if length <= chunkSize {
+		return fn(off, length)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for pos, end := off, off+length; pos < end; pos += chunkSize {
+		wg.Go(func() {
+			if err := fn(pos, min(chunkSize, end-pos)); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ReadAt is an interface method of backend.BlockBackend
+func (b *volumeBackend) ReadAt(ctx context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(b.size, off, int64(len(p))); err != nil {
+		return err
+	}
+	return chunked(off, int64(len(p)), commondata.MaxPayloadSize, func(chunkOff int64, chunkLength int64) error {
+		reply, err := b.request(ctx, commondata.Request{
+			Opcode: commondata.OpRead,
+			Offset: uint64(chunkOff),
+			Length: uint32(chunkLength),
+		})
+		if err != nil {
+			return err
+		}
+		if int64(len(reply.Payload)) != chunkLength {
+			return fmt.Errorf("%w: read returned %d bytes instead of %d", backend.ErrIO, len(reply.Payload), chunkLength)
+		}
+		copy(p[chunkOff-off:], reply.Payload)
+		return nil
+	})
+}
+
+// WriteAt is an interface method of backend.BlockBackend
+func (b *volumeBackend) WriteAt(ctx context.Context, p []byte, off int64, flags backend.Flags) error {
+	if b.export.ReadOnly {
+		return backend.ErrReadOnly
+	}
+	if err := backend.CheckRange(b.size, off, int64(len(p))); err != nil {
+		return err
+	}
+	var dataFlags commondata.Flags
+	if flags.Has(backend.FlagFUA) {
+		dataFlags |= commondata.FlagFUA
+	}
+	return chunked(off, int64(len(p)), commondata.MaxPayloadSize, func(chunkOff int64, chunkLength int64) error {
+		_, err := b.request(ctx, commondata.Request{
+			Opcode:  commondata.OpWrite,
+			Flags:   dataFlags,
+			Offset:  uint64(chunkOff),
+			Payload: p[chunkOff-off : chunkOff-off+chunkLength],
+		})
+		return err
+	})
+}
+
+// Flush is an interface method of backend.BlockBackend
+func (b *volumeBackend) Flush(ctx context.Context) error {
+	_, err := b.request(ctx, commondata.Request{Opcode: commondata.OpFlush})
+	return err
+}
+
+// Trim is an interface method of backend.BlockBackend
+func (b *volumeBackend) Trim(ctx context.Context, off int64, length int64, _ backend.Flags) error {
+	return b.rangeRequest(ctx, commondata.OpTrim, 0, off, length)
+}
+
+// WriteZeroes is an interface method of backend.BlockBackend
+func (b *volumeBackend) WriteZeroes(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	var dataFlags commondata.Flags
+	if flags.Has(backend.FlagNoHole) {
+		dataFlags |= commondata.FlagNoHole
+	}
+	if flags.Has(backend.FlagFastZero) {
+		dataFlags |= commondata.FlagFastZero
+	}
+	return b.rangeRequest(ctx, commondata.OpWriteZeroes, dataFlags, off, length)
+}
+
+func (b *volumeBackend) rangeRequest(ctx context.Context, op commondata.Opcode, flags commondata.Flags, off int64, length int64) error {
+	if b.export.ReadOnly {
+		return backend.ErrReadOnly
+	}
+	if err := backend.CheckRange(b.size, off, length); err != nil {
+		return err
+	}
+	return chunked(off, length, commondata.MaxRangeLength, func(chunkOff int64, chunkLength int64) error {
+		_, err := b.request(ctx, commondata.Request{
+			Opcode: op,
+			Flags:  flags,
+			Offset: uint64(chunkOff),
+			Length: uint32(chunkLength),
+		})
+		return err
+	})
+}
+
+// Extents is an interface method of backend.ExtentMapper
+func (b *volumeBackend) Extents(ctx context.Context, off int64, length int64) ([]backend.Extent, error) {
+	return b.mapRange(ctx, off, length, func(chunkOff int64, chunkLength uint32) (commondata.Request, error) {
+		return commondata.Request{Opcode: commondata.OpExtents, Offset: uint64(chunkOff), Length: chunkLength}, nil
+	})
+}
+
+// DirtyBitmaps is an interface method of backend.DirtyMapper
+func (b *volumeBackend) DirtyBitmaps() []string {
+	return slices.Clone(b.bitmaps)
+}
+
+// DirtyExtents is an interface method of backend.DirtyMapper
+func (b *volumeBackend) DirtyExtents(ctx context.Context, bitmap string, off int64, length int64) ([]backend.Extent, error) {
+	if !slices.Contains(b.bitmaps, bitmap) {
+		return nil, fmt.Errorf("%w: unknown bitmap %q", backend.ErrInvalid, bitmap)
+	}
+	return b.mapRange(ctx, off, length, func(chunkOff int64, chunkLength uint32) (commondata.Request, error) {
+		payload, err := commondata.DirtyMapPayload(bitmap, chunkLength)
+		return commondata.Request{Opcode: commondata.OpDirtyMap, Offset: uint64(chunkOff), Payload: payload}, err
+	})
+}
+
+// mapRange requests the extents of a range with the requests of newRequest. Core may map less than requested, the rest
+// is requested again.
+func (b *volumeBackend) mapRange(ctx context.Context, off int64, length int64, newRequest func(off int64, length uint32) (commondata.Request, error)) ([]backend.Extent, error) {
+	if err := backend.CheckRange(b.size, off, length); err != nil {
+		return nil, err
+	}
+	var extents []backend.Extent
+	for pos, end := off, off+length; pos < end; {
+		chunkLength := uint32(min(commondata.MaxRangeLength, end-pos))
+		req, err := newRequest(pos, chunkLength)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", backend.ErrInvalid, err)
+		}
+		reply, err := b.request(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		mapped, err := commondata.ParseExtentsReply(reply, chunkLength)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", backend.ErrIO, err)
+		}
+		for _, extent := range mapped {
+			var flags backend.ExtentFlags
+			if extent.Flags.Has(commondata.ExtentHole) {
+				flags |= backend.ExtentHole
+			}
+			if extent.Flags.Has(commondata.ExtentZero) {
+				flags |= backend.ExtentZero
+			}
+			if extent.Flags.Has(commondata.ExtentDirty) {
+				flags |= backend.ExtentDirty
+			}
+			extents = append(extents, backend.Extent{Offset: pos, Length: int64(extent.Length), Flags: flags})
+			pos += int64(extent.Length)
+		}
+	}
+	return extents, nil
+}
+
+// Size is an interface method of backend.BlockBackend
+func (b *volumeBackend) Size() int64 {
+	return b.size
+}
+
+// FlushesAllWrites is an interface method of backend.SharedFlusher. A flush on core makes all completed writes of the
+// volume durable.
+func (b *volumeBackend) FlushesAllWrites() bool {
+	return true
+}
+
+// Close is an interface method of backend.BlockBackend
+func (b *volumeBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.session != nil {
+		b.session.fail(errClosed)
+		b.session = nil
+	}
+	return nil
+}
+
+// retryError marks failures after which a request is retried (it was not executed, or executing it again is harmless)
+type retryError struct {
+	err error
+}
+
+func (e retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) bool {
+	var retry retryError
+	return errors.As(err, &retry)
+}
+
+// statusError maps the status of a reply to the errors of the backend package
+func statusError(status commondata.Status) error {
+	switch status {
+	case commondata.StatusOK:
+		return nil
+	case commondata.StatusNoSpace:
+		return backend.ErrNoSpace
+	case commondata.StatusReadOnly:
+		return backend.ErrReadOnly
+	case commondata.StatusInvalid:
+		return backend.ErrInvalid
+	case commondata.StatusNotSupported:
+		return backend.ErrNotSupported
+	case commondata.StatusOutOfRange:
+		return backend.ErrOutOfRange
+	case commondata.StatusStaleEpoch:
+		return backend.ErrFenced
+	case commondata.StatusChecksum:
+		return retryError{fmt.Errorf("%w: %w", backend.ErrIO, commondata.ErrChecksum)}
+	case commondata.StatusUnknownVolume:
+		return fmt.Errorf("%w: volume is unknown to core", backend.ErrNoDataPath)
+	}
+	return fmt.Errorf("%w: %s", backend.ErrIO, status)
+}
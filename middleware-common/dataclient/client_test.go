@@ -0,0 +1,301 @@
+package dataclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	commondata "quorumbd.net/common/data"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/config"
+	"quorumbd.net/middleware-common/coreconnection"
+)
+
+const testVolumeSize = 1 << 20
+
+// fakeCore serves data connections from an in-memory volume. drop decides whether a connection is closed instead of
+// executing a request, stale whether a request is rejected with StatusStaleEpoch.
+type fakeCore struct {
+	mu    sync.Mutex
+	data  []byte
+	dirty map[uint64]bool // Written blocks of 4096 bytes (bitmap "backup")
+	conns atomic.Int32
+	drop  func(conn int32, req *commondata.Request) bool
+	stale func(req *commondata.Request) bool
+}
+
+func (fc *fakeCore) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if _, err := io.ReadFull(r, make([]byte, len(commondata.Preamble)+16)); err != nil {
+		return // The probe of the core supervisor
+	}
+	n := fc.conns.Add(1)
+	for {
+		req, err := commondata.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		if fc.drop != nil && fc.drop(n, req) {
+			return
+		}
+		reply := fc.execute(req)
+		if commondata.WriteReply(w, reply) != nil || w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (fc *fakeCore) execute(req *commondata.Request) *commondata.Reply {
+	reply := &commondata.Reply{Tag: req.Tag, Epoch: req.Epoch}
+	if fc.stale != nil && fc.stale(req) {
+		reply.Status, reply.Epoch = commondata.StatusStaleEpoch, req.Epoch+1
+		return reply
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	switch req.Opcode {
+	case commondata.OpOpen:
+		reply.Payload = commondata.OpenReplyPayload(testVolumeSize, 4096)
+	case commondata.OpRead:
+		reply.Payload = bytes.Clone(fc.data[req.Offset : req.Offset+uint64(req.Length)])
+	case commondata.OpWrite:
+		copy(fc.data[req.Offset:], req.Payload)
+		for block := req.Offset / 4096; block*4096 < req.Offset+uint64(len(req.Payload)); block++ {
+			fc.dirty[block] = true
+		}
+	case commondata.OpFlush:
+	case commondata.OpBitmaps:
+		reply.Payload = commondata.BitmapsPayload([]string{"backup"})
+	case commondata.OpDirtyMap:
+		bitmap, length, err := commondata.ParseDirtyMapRequest(req)
+		if err != nil || bitmap != "backup" {
+			reply.Status = commondata.StatusInvalid
+			break
+		}
+		var extents []commondata.Extent
+		for pos, end := req.Offset, req.Offset+uint64(length); pos < end; {
+			var flags commondata.ExtentFlags
+			if fc.dirty[pos/4096] {
+				flags = commondata.ExtentDirty
+			}
+			next := min((pos/4096+1)*4096, end)
+			extents = append(extents, commondata.Extent{Length: uint32(next - pos), Flags: flags})
+			pos = next
+		}
+		reply.Payload = commondata.ExtentsPayload(extents)
+	case commondata.OpExtents:
+		// Alternating data and holes of 4096 bytes, at most two extents per reply
+		var extents []commondata.Extent
+		for pos, end := req.Offset, req.Offset+uint64(req.Length); pos < end && len(extents) < 2; {
+			var flags commondata.ExtentFlags
+			if pos/4096%2 == 1 {
+				flags = commondata.ExtentHole | commondata.ExtentZero
+			}
+			next := min((pos/4096+1)*4096, end)
+			extents = append(extents, commondata.Extent{Length: uint32(next - pos), Flags: flags})
+			pos = next
+		}
+		reply.Payload = commondata.ExtentsPayload(extents)
+	default:
+		reply.Status = commondata.StatusNotSupported
+	}
+	return reply
+}
+
+// newTestClient starts the fake core and returns a client connected to it
+func newTestClient(t *testing.T, fc *fakeCore) *Client {
+	t.Helper()
+	fc.data = make([]byte, testVolumeSize)
+	fc.dirty = make(map[uint64]bool)
+	path := filepath.Join(t.TempDir(), "core.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fc.serve(conn)
+		}
+	}()
+
+	logger := slog.New(slog.DiscardHandler)
+	supervisor, err := coreconnection.New(&config.CoreConnectionConfig{Server: "unix://" + path}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := supervisor.Try(context.Background(), 0, time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	return New(logger, uuid.New(), supervisor.GetCurrentEndpoint)
+}
+
+func TestRetryAfterConnectionDrop(t *testing.T) {
+	var dropped atomic.Bool
+	fc := &fakeCore{
+		// The first connection is lost with the first write in flight
+		drop: func(conn int32, req *commondata.Request) bool {
+			return conn == 1 && req.Opcode == commondata.OpWrite && !dropped.Swap(true)
+		},
+	}
+	client := newTestClient(t, fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := client.Open(ctx, backend.Export{Name: "disk0", VolumeID: "vol-0", Epoch: 1}, testVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	data := bytes.Repeat([]byte{0x42}, 8192)
+	if err := b.WriteAt(ctx, data, 4096, 0); err != nil {
+		t.Fatalf("write was not retried: %v", err)
+	}
+	if !dropped.Load() {
+		t.Fatal("connection was not dropped")
+	}
+	read := make([]byte, len(data))
+	if err := b.ReadAt(ctx, read, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("read returned other data than written")
+	}
+	if conns := fc.conns.Load(); conns != 2 {
+		t.Fatalf("%d data connections, want 2", conns)
+	}
+}
+
+func TestRetriesAreLimited(t *testing.T) {
+	fc := &fakeCore{
+		drop: func(_ int32, req *commondata.Request) bool {
+			return req.Opcode == commondata.OpRead
+		},
+	}
+	client := newTestClient(t, fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := client.Open(ctx, backend.Export{Name: "disk0", VolumeID: "vol-0", Epoch: 1}, testVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.ReadAt(ctx, make([]byte, 512), 0); !errors.Is(err, backend.ErrIO) {
+		t.Fatalf("error %v, want %v", err, backend.ErrIO)
+	}
+	if conns := fc.conns.Load(); conns != maxRetries+1 {
+		t.Fatalf("%d data connections, want %d", conns, maxRetries+1)
+	}
+}
+
+func TestStaleEpochFencesBackend(t *testing.T) {
+	fc := &fakeCore{
+		stale: func(req *commondata.Request) bool {
+			return req.Opcode == commondata.OpWrite
+		},
+	}
+	client := newTestClient(t, fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := client.Open(ctx, backend.Export{Name: "disk0", VolumeID: "vol-0", Epoch: 1}, testVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.WriteAt(ctx, make([]byte, 512), 0, 0); !errors.Is(err, backend.ErrFenced) {
+		t.Fatalf("write error %v, want %v", err, backend.ErrFenced)
+	}
+	if err := b.ReadAt(ctx, make([]byte, 512), 0); !errors.Is(err, backend.ErrFenced) {
+		t.Fatalf("read error after fencing %v, want %v", err, backend.ErrFenced)
+	}
+	if conns := fc.conns.Load(); conns != 1 {
+		t.Fatalf("%d data connections, want 1", conns)
+	}
+}
+
+func TestExtentsRequestsRestOfRange(t *testing.T) {
+	fc := &fakeCore{}
+	client := newTestClient(t, fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := client.Open(ctx, backend.Export{Name: "disk0", VolumeID: "vol-0", Epoch: 1}, testVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	extents, err := backend.ExtentsOf(ctx, b, 2048, 5*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []backend.Extent{
+		{Offset: 2048, Length: 2048},
+		{Offset: 4096, Length: 4096, Flags: backend.ExtentHole | backend.ExtentZero},
+		{Offset: 8192, Length: 4096},
+		{Offset: 12288, Length: 4096, Flags: backend.ExtentHole | backend.ExtentZero},
+		{Offset: 16384, Length: 4096},
+		{Offset: 20480, Length: 2048, Flags: backend.ExtentHole | backend.ExtentZero},
+	}
+	if !slices.Equal(extents, want) {
+		t.Fatalf("extents %+v, want %+v", extents, want)
+	}
+	if _, err := b.(backend.ExtentMapper).Extents(ctx, testVolumeSize-512, 1024); !errors.Is(err, backend.ErrOutOfRange) {
+		t.Fatalf("error %v, want %v", err, backend.ErrOutOfRange)
+	}
+}
+
+func TestDirtyExtents(t *testing.T) {
+	fc := &fakeCore{}
+	client := newTestClient(t, fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b, err := client.Open(ctx, backend.Export{Name: "disk0", VolumeID: "vol-0", Epoch: 1}, testVolumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	mapper, ok := b.(backend.DirtyMapper)
+	if !ok || !slices.Equal(mapper.DirtyBitmaps(), []string{"backup"}) {
+		t.Fatalf("backend has no bitmap backup")
+	}
+
+	if err := b.WriteAt(ctx, make([]byte, 4096), 8192, 0); err != nil {
+		t.Fatal(err)
+	}
+	extents, err := backend.DirtyExtentsOf(ctx, mapper, "backup", 0, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []backend.Extent{{Offset: 0, Length: 8192}, {Offset: 8192, Length: 4096, Flags: backend.ExtentDirty}, {Offset: 12288, Length: 4096}}
+	if !slices.Equal(extents, want) {
+		t.Fatalf("dirty extents %+v, want %+v", extents, want)
+	}
+	if _, err := mapper.DirtyExtents(ctx, "other", 0, 4096); !errors.Is(err, backend.ErrInvalid) {
+		t.Fatalf("error %v for an unknown bitmap, want %v", err, backend.ErrInvalid)
+	}
+}
@@ -0,0 +1,216 @@
+package dataclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	commondata "quorumbd.net/common/data"
+	commonio "quorumbd.net/common/io"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const (
+	openTimeout  = 5 * time.Second  // TOCONFIG
+	writeTimeout = 30 * time.Second // TOCONFIG
+)
+
+// session is a data connection to core, requests are pipelined on it and matched with their replies by tag
+type session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	w       *bufio.Writer
+	mu      sync.Mutex
+	nextTag uint64
+	pending map[uint64]chan *commondata.Reply
+	err     error         // Set when the connection failed
+	done    chan struct{} // Closed when the connection failed
+}
+
+// connect opens a data connection to the volume of the export
+func (c *Client) connect(ctx context.Context, export backend.Export, size int64) (*session, error) {
+	endpoint := c.endpoint()
+	if endpoint == nil {
+		return nil, retryError{fmt.Errorf("%w: not connected to core", backend.ErrNoDataPath)}
+	}
+	conn, err := endpoint.Dial(ctx)
+	if err != nil {
+		return nil, retryError{fmt.Errorf("%w: %w", backend.ErrNoDataPath, err)}
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	reply, err := c.open(conn, export)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, retryError{fmt.Errorf("%w: opening volume failed: %w", backend.ErrNoDataPath, err)}
+	}
+	if err := checkOpenReply(reply, size); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &session{
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		pending: make(map[uint64]chan *commondata.Reply),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop(bufio.NewReader(conn))
+	return s, nil
+}
+
+// open sends the preamble and the OPEN request and returns the reply
+func (c *Client) open(conn net.Conn, export backend.Export) (*commondata.Reply, error) {
+	payload, err := commondata.OpenPayload(export.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	req := &commondata.Request{Opcode: commondata.OpOpen, Epoch: export.Epoch, Payload: payload}
+	if export.ReadOnly {
+		req.Flags = commondata.FlagReadOnly
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(openTimeout)); err != nil {
+		return nil, err
+	}
+	if err := commonio.WriteFull(conn, append(commondata.Preamble[:], c.uuid[:]...)); err != nil {
+		return nil, err
+	}
+	if err := commondata.WriteRequest(conn, req); err != nil {
+		return nil, err
+	}
+	reply, err := commondata.ReadReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	return reply, conn.SetDeadline(time.Time{})
+}
+
+func checkOpenReply(reply *commondata.Reply, size int64) error {
+	switch reply.Status {
+	case commondata.StatusOK:
+	case commondata.StatusStaleEpoch:
+		return backend.ErrFenced
+	default:
+		return fmt.Errorf("opening volume failed: %w", statusError(reply.Status))
+	}
+	volumeSize, _, err := commondata.ParseOpenReply(reply)
+	if err != nil {
+		return fmt.Errorf("%w: %w", backend.ErrIO, err)
+	}
+	if int64(volumeSize) != size {
+		return fmt.Errorf("%w: volume size %d differs from export size %d", backend.ErrInvalid, volumeSize, size)
+	}
+	return nil
+}
+
+// do sends a request and waits for its reply. Errors are failures of the connection, the status of the reply is not
+// checked.
+func (s *session) do(ctx context.Context, req *commondata.Request) (*commondata.Reply, error) {
+	ch := make(chan *commondata.Reply, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.nextTag++
+	req.Tag = s.nextTag
+	s.pending[req.Tag] = ch
+	s.mu.Unlock()
+	defer s.forget(req.Tag)
+
+	if err := s.send(req); err != nil {
+		s.fail(retryError{fmt.Errorf("%w: data connection lost: %w", backend.ErrIO, err)})
+		return nil, s.failure()
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-s.done:
+		select {
+		case reply := <-ch:
+			return reply, nil
+		default:
+			return nil, s.failure()
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *session) send(req *commondata.Request) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	if err := commondata.WriteRequest(s.w, req); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// readLoop delivers the replies to the waiting requests until the connection fails
+func (s *session) readLoop(r *bufio.Reader) {
+	for {
+		reply, err := commondata.ReadReply(r)
+		if errors.Is(err, commondata.ErrChecksum) {
+			reply.Status, reply.Payload = commondata.StatusChecksum, nil
+		} else if err != nil {
+			s.fail(retryError{fmt.Errorf("%w: data connection lost: %w", backend.ErrIO, err)})
+			return
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[reply.Tag]
+		delete(s.pending, reply.Tag)
+		s.mu.Unlock()
+		if ok {
+			ch <- reply
+		} else if reply.Status == commondata.StatusChecksum {
+			// The corrupted frame may have been the tag, the request it belongs to would wait forever
+			s.fail(retryError{fmt.Errorf("%w: %w", backend.ErrIO, commondata.ErrChecksum)})
+			return
+		}
+	}
+}
+
+// fail closes the connection, the pending and all further requests fail with err
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *session) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *session) broken() bool {
+	return s.failure() != nil
+}
+
+func (s *session) forget(tag uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, tag)
+}
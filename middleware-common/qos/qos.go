@@ -0,0 +1,145 @@
+// Package qos provides token bucket limits for the io of exports
+package qos
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits of an export. Zero rates are unlimited.
+type Limits struct {
+	ReadIOPS            uint64
+	WriteIOPS           uint64
+	ReadBytesPerSecond  uint64
+	WriteBytesPerSecond uint64
+	BurstSeconds        uint32 // Size of the buckets in seconds of their rate (0: 1 second)
+}
+
+// Unlimited returns true, if no rate is limited
+func (limits Limits) Unlimited() bool {
+	return limits.ReadIOPS == 0 && limits.WriteIOPS == 0 && limits.ReadBytesPerSecond == 0 && limits.WriteBytesPerSecond == 0
+}
+
+func (limits Limits) String() string {
+	if limits.Unlimited() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("read %d iops %d B/s, write %d iops %d B/s, burst %ds",
+		limits.ReadIOPS, limits.ReadBytesPerSecond, limits.WriteIOPS, limits.WriteBytesPerSecond, max(limits.BurstSeconds, 1))
+}
+
+type Direction int
+
+const (
+	Read Direction = iota
+	Write
+)
+
+// DirectionStats count the requests of a direction and how long they were throttled
+type DirectionStats struct {
+	Requests  uint64
+	Bytes     uint64
+	Throttled uint64        // Requests that had to wait
+	Delay     time.Duration // Sum of the waits
+}
+
+type Stats struct {
+	Limits Limits
+	Read   DirectionStats
+	Write  DirectionStats
+}
+
+// bucket is a token bucket. Tokens may go negative: a request larger than the bucket is admitted after the debt is refilled.
+type bucket struct {
+	rate     float64 // Tokens per second (0: unlimited)
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(rate uint64, burstSeconds uint32, now time.Time) bucket {
+	capacity := float64(rate) * float64(max(burstSeconds, 1))
+	return bucket{rate: float64(rate), capacity: capacity, tokens: capacity, last: now}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for them
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter throttles the requests of an export. It is safe for concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	limits Limits
+	iops   [2]bucket
+	bytes  [2]bucket
+	stats  [2]DirectionStats
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	limiter := &Limiter{}
+	limiter.SetLimits(limits)
+	return limiter
+}
+
+// SetLimits replaces the limits, the buckets start full
+func (limiter *Limiter) SetLimits(limits Limits) {
+	now := time.Now()
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.limits = limits
+	limiter.iops[Read] = newBucket(limits.ReadIOPS, limits.BurstSeconds, now)
+	limiter.iops[Write] = newBucket(limits.WriteIOPS, limits.BurstSeconds, now)
+	limiter.bytes[Read] = newBucket(limits.ReadBytesPerSecond, limits.BurstSeconds, now)
+	limiter.bytes[Write] = newBucket(limits.WriteBytesPerSecond, limits.BurstSeconds, now)
+}
+
+func (limiter *Limiter) Limits() Limits {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return limiter.limits
+}
+
+// Wait admits a request of bytes in a direction, blocking as long as the limits require
+func (limiter *Limiter) Wait(ctx context.Context, direction Direction, bytes int64) error {
+	now := time.Now()
+	limiter.mu.Lock()
+	delay := max(limiter.iops[direction].reserve(1, now), limiter.bytes[direction].reserve(float64(bytes), now))
+	stats := &limiter.stats[direction]
+	stats.Requests++
+	stats.Bytes += uint64(bytes)
+	if delay > 0 {
+		stats.Throttled++
+		stats.Delay += delay
+	}
+	limiter.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (limiter *Limiter) Stats() Stats {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return Stats{Limits: limiter.limits, Read: limiter.stats[Read], Write: limiter.stats[Write]}
+}
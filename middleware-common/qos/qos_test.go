@@ -0,0 +1,148 @@
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	type step struct {
+		after  time.Duration // Since the previous step
+		tokens float64
+		delay  time.Duration
+	}
+	tests := []struct {
+		name         string
+		rate         uint64
+		burstSeconds uint32
+		steps        []step
+	}{
+		{name: "unlimited", steps: []step{{tokens: 1 << 30}, {tokens: 1 << 30}}},
+		{
+			name: "limit",
+			rate: 10,
+			steps: []step{
+				{tokens: 10},
+				{tokens: 1, delay: 100 * time.Millisecond},
+				{after: 200 * time.Millisecond, tokens: 1},
+				{tokens: 1, delay: 100 * time.Millisecond},
+			},
+		},
+		{
+			name:         "burst",
+			rate:         10,
+			burstSeconds: 3,
+			steps: []step{
+				{tokens: 30},
+				{tokens: 5, delay: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refill up to the capacity",
+			rate: 10,
+			steps: []step{
+				{tokens: 10},
+				{after: time.Minute, tokens: 15, delay: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "request larger than the bucket",
+			rate: 10,
+			steps: []step{
+				{tokens: 30, delay: 2 * time.Second},
+				{after: 2 * time.Second, tokens: 1, delay: 100 * time.Millisecond},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(1000, 0)
+			b := newBucket(test.rate, test.burstSeconds, now)
+			for i, s := range test.steps {
+				now = now.Add(s.after)
+				if delay := b.reserve(s.tokens, now); delay != s.delay {
+					t.Fatalf("step %d: delay %v, want %v", i, delay, s.delay)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(Limits{ReadIOPS: 20, WriteBytesPerSecond: 1 << 20})
+	for range 20 {
+		if err := limiter.Wait(t.Context(), Read, 4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := limiter.Stats(); stats.Read.Requests != 20 || stats.Read.Bytes != 20*4096 || stats.Read.Throttled != 0 {
+		t.Fatalf("read stats within the burst %+v", stats.Read)
+	}
+
+	// The bucket is empty, the next read waits for a token
+	start := time.Now()
+	if err := limiter.Wait(t.Context(), Read, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("throttled read took %v", elapsed)
+	}
+	if stats := limiter.Stats(); stats.Read.Requests != 21 || stats.Read.Throttled != 1 || stats.Read.Delay <= 0 {
+		t.Fatalf("read stats after the burst %+v", stats.Read)
+	}
+
+	// The directions are limited independently
+	if err := limiter.Wait(t.Context(), Write, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if stats := limiter.Stats(); stats.Write.Requests != 1 || stats.Write.Bytes != 1<<20 || stats.Write.Throttled != 0 {
+		t.Fatalf("write stats %+v", stats.Write)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	limits := Limits{ReadIOPS: 1}
+	limiter := NewLimiter(limits)
+	if err := limiter.Wait(t.Context(), Read, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// New limits start with full buckets
+	limiter.SetLimits(limits)
+	if err := limiter.Wait(t.Context(), Read, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats := limiter.Stats(); stats.Read.Throttled != 0 {
+		t.Fatalf("read throttled after the limits were set: %+v", stats.Read)
+	}
+
+	// Resetting to unlimited lifts the limits, the stats are kept
+	limiter.SetLimits(Limits{})
+	for range 100 {
+		if err := limiter.Wait(t.Context(), Read, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := limiter.Stats(); !stats.Limits.Unlimited() || stats.Read.Requests != 102 || stats.Read.Throttled != 0 {
+		t.Fatalf("stats after the reset %+v", stats)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	limiter := NewLimiter(Limits{WriteIOPS: 1, BurstSeconds: 1})
+	if err := limiter.Wait(t.Context(), Write, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if err := limiter.Wait(ctx, Write, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("canceled wait took %v", elapsed)
+	}
+}
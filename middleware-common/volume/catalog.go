@@ -0,0 +1,67 @@
+// Package volume resolves the volumes core makes visible to the middleware
+package volume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/control"
+)
+
+const requestTimeout = 5 * time.Second // TOCONFIG
+
+// ErrUnknownVolume is returned, if core does not know the volume or hides it from the middleware
+var ErrUnknownVolume = errors.New("unknown volume")
+
+// Catalog queries the volume catalogue of core over the control connection
+type Catalog struct {
+	dispatcher *control.Dispatcher
+}
+
+func NewCatalog(dispatcher *control.Dispatcher) *Catalog {
+	return &Catalog{dispatcher: dispatcher}
+}
+
+// List returns the volumes visible to the middleware, sorted by name
+func (catalog *Catalog) List(ctx context.Context) ([]commoncontrol.VolumeInfo, error) {
+	return catalog.request(ctx, "")
+}
+
+// Lookup returns the visible volume with the given name (ErrUnknownVolume, if there is none)
+func (catalog *Catalog) Lookup(ctx context.Context, name string) (commoncontrol.VolumeInfo, error) {
+	if name == "" {
+		return commoncontrol.VolumeInfo{}, ErrUnknownVolume
+	}
+	volumes, err := catalog.request(ctx, name)
+	if err != nil {
+		return commoncontrol.VolumeInfo{}, err
+	}
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return volume, nil
+		}
+	}
+	return commoncontrol.VolumeInfo{}, ErrUnknownVolume
+}
+
+func (catalog *Catalog) request(ctx context.Context, name string) ([]commoncontrol.VolumeInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	msg, err := catalog.dispatcher.Request(ctx, commoncontrol.NewVolumeListRequest(catalog.dispatcher.NextRequestID(), name))
+	if err != nil {
+		return nil, err
+	}
+	response, ok := msg.(*commoncontrol.VolumeListMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response type %d to volume list request", msg.Type())
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("volume list request failed: %s", response.Error)
+	}
+	return response.Volumes, nil
+}
@@ -31,6 +31,10 @@ func NewWorkerExit(worker Worker, err error) WorkerExit {
 	}
 }
 
+func (we WorkerExit) Worker() Worker {
+	return we.worker
+}
+
 func (we WorkerExit) Kind() errorhelper.ExitKind {
 	return we.kind
 }
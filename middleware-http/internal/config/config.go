@@ -0,0 +1,148 @@
+// Package config provides configuration loading and validation
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	commonconfig "quorumbd.net/common/config"
+	middlewareconfig "quorumbd.net/middleware-common/config"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+const configFileName = "middleware-http.toml"
+
+// httpTLSConfig configures TLS on the tcp listeners. The unix socket is local and always plaintext.
+type httpTLSConfig struct {
+	Enabled    bool   `toml:"enabled"`
+	X509Dir    string `toml:"x509_dir"`    // ca-cert.pem, server-cert.pem, server-key.pem (same layout as for the NBD server)
+	VerifyPeer bool   `toml:"verify_peer"` // Require client certificates signed by ca-cert.pem, their common name is the identity of the client
+}
+
+type httpConfig struct {
+	Socket          string                     `toml:"socket"` // Empty: no unix socket
+	Listen          []string                   `toml:"listen"` // tcp listeners (tcp://host:port)
+	MaxWriteSizeMiB int64                      `toml:"max_write_size_mib"`
+	TLS             httpTLSConfig              `toml:"tls"`
+	ACL             []middlewareconfig.ACLRule `toml:"acl"` // Evaluated in order, the first applying rule wins. Without rules every peer may access every export.
+}
+
+type Config struct {
+	CommonConfig         commonconfig.CommonConfig             `toml:"common"`
+	LoggingConfig        commonconfig.LoggingConfig            `toml:"logging"`
+	CoreConnectionConfig middlewareconfig.CoreConnectionConfig `toml:"coreconnection"`
+	InstanceConfig       middlewareconfig.InstanceConfig       `toml:"instance"`
+	HTTPConfig           httpConfig                            `toml:"http"`
+	CacheConfig          middlewareconfig.CacheConfig          `toml:"cache"`
+}
+
+func (cfg *Config) ToMiddlewareConfig() *middlewareconfig.Config {
+	return &middlewareconfig.Config{
+		CommonConfig:         cfg.CommonConfig,
+		CoreConnectionConfig: cfg.CoreConnectionConfig,
+		CacheConfig:          cfg.CacheConfig,
+	}
+}
+
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
+	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_HTTP_CONFIG")
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	return LoadFrom(configPath)
+}
+
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
+	var cfg Config
+
+	cfg.setDefaults()
+
+	if err := cfg.readConfig(configPath); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *Config) setDefaults() {
+	cfg.CommonConfig.SetDefaults()
+	cfg.LoggingConfig.SetDefaults()
+	cfg.CoreConnectionConfig.SetDefaults()
+	cfg.InstanceConfig.SetDefaults()
+	cfg.HTTPConfig.setDefaults()
+	cfg.CacheConfig.SetDefaults()
+}
+
+func (cfg *httpConfig) setDefaults() {
+	cfg.Socket = filepath.Join("/", "var", "run", "qbd", "http.sock")
+	cfg.MaxWriteSizeMiB = 64
+	cfg.TLS.VerifyPeer = true
+}
+
+func (cfg *Config) validate() error {
+	commonErrors := cfg.CommonConfig.Validate()
+	loggingErrors := cfg.LoggingConfig.Validate()
+	coreConnectionErrors := cfg.CoreConnectionConfig.Validate()
+	instanceErrors := cfg.InstanceConfig.Validate()
+	httpErrors := cfg.HTTPConfig.validate()
+	cacheErrors := cfg.CacheConfig.Validate()
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, instanceErrors, httpErrors, cacheErrors)
+}
+
+func (cfg *httpConfig) validate() error {
+	return validation.Errors{
+		"http": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.Listen, validation.When(cfg.Socket == "", validation.Required.Error("http.socket or http.listen required")), validation.Each(validation.By(validateTCPListenAddress))),
+			validation.Field(&cfg.MaxWriteSizeMiB, validation.Min(int64(1)).Error("http.max_write_size_mib must be at least 1")),
+		),
+		"http.tls": validation.ValidateStruct(&cfg.TLS,
+			validation.Field(&cfg.TLS.X509Dir, validation.When(cfg.TLS.Enabled, validation.Required.Error("http.tls.x509_dir required when http.tls.enabled is set"))),
+		),
+		"http.acl": middlewareconfig.ValidateACL("http.acl", cfg.ACL),
+	}.Filter()
+}
+
+// TCPListenAddress returns host:port of a tcp:// listen URI
+func TCPListenAddress(uri string) (string, error) {
+	address, ok := strings.CutPrefix(uri, "tcp://")
+	if !ok {
+		return "", fmt.Errorf("listen address %q must start with tcp://", uri)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", uri, err)
+	}
+	return address, nil
+}
+
+func validateTCPListenAddress(value any) error {
+	_, err := TCPListenAddress(value.(string))
+	return err
+}
+
+func (cfg *Config) readConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
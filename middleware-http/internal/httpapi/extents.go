@@ -0,0 +1,151 @@
+package httpapi
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const changesWindow = 1 << 30 // Range of a bitmap that is mapped at once while streaming changes // TOCONFIG
+
+type extentInfo struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Hole   bool  `json:"hole,omitempty"`
+	Zero   bool  `json:"zero,omitempty"`
+	Dirty  bool  `json:"dirty,omitempty"`
+}
+
+// dirtyMapper returns the change tracking of the export for the bitmap. Without change tracking or bitmap it writes
+// the error response and returns false.
+func dirtyMapper(w http.ResponseWriter, exp *export, bitmap string) (backend.DirtyMapper, bool) {
+	mapper, ok := exp.Backend.(backend.DirtyMapper)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "export has no change tracking")
+		return nil, false
+	}
+	if !slices.Contains(mapper.DirtyBitmaps(), bitmap) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown bitmap %q", bitmap))
+		return nil, false
+	}
+	return mapper, true
+}
+
+// extents returns the allocation map of the range of the offset and length parameters. With parameter since it returns
+// the extents of the bitmap instead, which are dirty, if they changed since the bitmap was created.
+// Exports without allocation information fail with 501 instead of reporting everything as data.
+func (s *Server) extents(w http.ResponseWriter, r *http.Request, req *request) {
+	off, length, err := rangeParams(r, req.export.Backend.Size(), false)
+	if err != nil {
+		s.backendError(w, req, "extents", err)
+		return
+	}
+
+	var extents []backend.Extent
+	if bitmap := r.URL.Query().Get("since"); bitmap != "" {
+		mapper, ok := dirtyMapper(w, req.export, bitmap)
+		if !ok {
+			return
+		}
+		if length > 0 {
+			extents, err = backend.DirtyExtentsOf(req.ctx, mapper, bitmap, off, length)
+		}
+	} else {
+		mapper, ok := req.export.Backend.(backend.ExtentMapper)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, "export has no allocation map")
+			return
+		}
+		extents, err = backend.MappedExtentsOf(req.ctx, mapper, off, length)
+	}
+	if err != nil {
+		s.backendError(w, req, "extents", err)
+		return
+	}
+
+	infos := make([]extentInfo, 0, len(extents))
+	for _, extent := range extents {
+		infos = append(infos, extentInfo{
+			Offset: extent.Offset,
+			Length: extent.Length,
+			Hole:   extent.Flags.Has(backend.ExtentHole),
+			Zero:   extent.Flags.Has(backend.ExtentZero),
+			Dirty:  extent.Flags.Has(backend.ExtentDirty),
+		})
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// changes streams the data of the ranges that changed since the bitmap of parameter since was created (e.g. with a
+// snapshot), limited to the range of the offset and length parameters. The response is multipart/byteranges with a part
+// per changed range in ascending order, whose Content-Range locates it in the export. Adjacent ranges may be split.
+func (s *Server) changes(w http.ResponseWriter, r *http.Request, req *request) {
+	bitmap := r.URL.Query().Get("since")
+	if bitmap == "" {
+		writeError(w, http.StatusBadRequest, "since required")
+		return
+	}
+	mapper, ok := dirtyMapper(w, req.export, bitmap)
+	if !ok {
+		return
+	}
+	size := req.export.Backend.Size()
+	off, length, err := rangeParams(r, size, false)
+	if err != nil {
+		s.backendError(w, req, "changes", err)
+		return
+	}
+
+	// The header is written after the first window was mapped, so that errors of the bitmap get a status
+	parts := multipart.NewWriter(w)
+	var buf []byte
+	for window, end := off, off+length; window < end; window += changesWindow {
+		extents, err := backend.DirtyExtentsOf(req.ctx, mapper, bitmap, window, min(changesWindow, end-window))
+		if err != nil {
+			if window == off {
+				s.backendError(w, req, "changes", err)
+				return
+			}
+			s.abortStream(req, "changes", err)
+		}
+		if window == off {
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+			w.WriteHeader(http.StatusOK)
+		}
+
+		for _, extent := range extents {
+			if !extent.Flags.Has(backend.ExtentDirty) {
+				continue
+			}
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", extent.Offset, extent.Offset+extent.Length-1, size)},
+			})
+			if err != nil {
+				return
+			}
+			if buf == nil {
+				buf = make([]byte, transferChunkSize)
+			}
+			for pos, extentEnd := extent.Offset, extent.Offset+extent.Length; pos < extentEnd; {
+				n := min(int64(len(buf)), extentEnd-pos)
+				if err := req.export.Backend.ReadAt(req.ctx, buf[:n], pos); err != nil {
+					s.abortStream(req, "changes", err)
+				}
+				if _, err := part.Write(buf[:n]); err != nil {
+					return
+				}
+				req.conn.bytesRead.Add(uint64(n))
+				pos += n
+			}
+		}
+	}
+	if length == 0 {
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	}
+	_ = parts.Close() // Fails only if the client went away
+}
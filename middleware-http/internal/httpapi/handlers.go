@@ -0,0 +1,393 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+)
+
+const transferChunkSize = 1 << 20 // Bytes read from or written to the backend at once // TOCONFIG
+
+// request is a request to an export that passed the access control
+type request struct {
+	ctx      context.Context // Done when the client goes away or the export is removed
+	conn     *conn
+	export   *export
+	readOnly bool // The export is read-only or the peer has read-only access
+}
+
+type exportInfo struct {
+	Name      string   `json:"name"`
+	Size      int64    `json:"size"`
+	ReadOnly  bool     `json:"read_only"`
+	BlockSize uint32   `json:"block_size,omitempty"`
+	Bitmaps   []string `json:"bitmaps,omitempty"` // Change tracking bitmaps that can be passed as since to extents and changes
+}
+
+type errorInfo struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/exports", s.listExports)
+	mux.HandleFunc("GET /v1/exports/{name}", s.exportHandler(false, s.describe))
+	mux.HandleFunc("GET /v1/exports/{name}/data", s.exportHandler(false, s.read)) // Also HEAD
+	mux.HandleFunc("PUT /v1/exports/{name}/data", s.exportHandler(true, s.write))
+	mux.HandleFunc("POST /v1/exports/{name}/flush", s.exportHandler(false, s.flush))
+	mux.HandleFunc("POST /v1/exports/{name}/discard", s.exportHandler(true, s.discard))
+	mux.HandleFunc("POST /v1/exports/{name}/zero", s.exportHandler(true, s.zero))
+	mux.HandleFunc("GET /v1/exports/{name}/extents", s.exportHandler(false, s.extents))
+	mux.HandleFunc("GET /v1/exports/{name}/changes", s.exportHandler(false, s.changes))
+	return mux
+}
+
+// exportHandler applies the access control of the peer to the export of the request path and holds the export while handle runs
+func (s *Server) exportHandler(write bool, handle func(http.ResponseWriter, *http.Request, *request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := r.Context().Value(connContextKey{}).(*conn)
+		name := r.PathValue("name")
+		peer := requestPeer(c, r)
+		access := s.authorize(peer, name)
+		if access == acl.AccessDenied {
+			s.logDenied(c, peer, name)
+			writeError(w, http.StatusForbidden, "access to export denied")
+			return
+		}
+
+		exp := s.acquireExport(name)
+		if exp == nil {
+			writeError(w, http.StatusNotFound, "unknown export")
+			return
+		}
+		defer exp.inFlight.Done()
+		s.using(c, peer, name)
+
+		readOnly := exp.ReadOnly || access == acl.AccessReadOnly
+		if write && readOnly {
+			writeError(w, http.StatusForbidden, backend.ErrReadOnly.Error())
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(exp.ctx, cancel)
+		defer stop()
+		handle(w, r, &request{ctx: ctx, conn: c, export: exp, readOnly: readOnly})
+	}
+}
+
+// logDenied logs a denied access with the identities of the peer
+func (s *Server) logDenied(c *conn, peer acl.Peer, export string) {
+	attrs := []any{"export", export, "client", c.id, "remote", c.netConn.RemoteAddr().String(), "tls_identity", peer.TLSIdentity}
+	if creds := peer.Credentials; creds != nil {
+		attrs = append(attrs, "pid", creds.PID, "uid", creds.UID, "gids", creds.GIDs, "executable", acl.PeerExecutable(creds.PID))
+	}
+	s.logger.Warn("Access to export denied", attrs...)
+}
+
+// listExports lists the exports the peer may access
+func (s *Server) listExports(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(connContextKey{}).(*conn)
+	peer := requestPeer(c, r)
+	infos := []exportInfo{}
+	for _, name := range s.Exports() {
+		access := s.authorize(peer, name)
+		if access == acl.AccessDenied {
+			continue
+		}
+		exp := s.acquireExport(name)
+		if exp == nil {
+			continue
+		}
+		infos = append(infos, describeExport(exp, exp.ReadOnly || access == acl.AccessReadOnly))
+		exp.inFlight.Done()
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) describe(w http.ResponseWriter, _ *http.Request, req *request) {
+	writeJSON(w, http.StatusOK, describeExport(req.export, req.readOnly))
+}
+
+func describeExport(exp *export, readOnly bool) exportInfo {
+	info := exportInfo{
+		Name:      exp.Name,
+		Size:      exp.Backend.Size(),
+		ReadOnly:  readOnly,
+		BlockSize: exp.BlockSize,
+	}
+	if mapper, ok := exp.Backend.(backend.DirtyMapper); ok {
+		info.Bitmaps = mapper.DirtyBitmaps()
+	}
+	return info
+}
+
+// read returns the export or the single byte range of the Range header
+func (s *Server) read(w http.ResponseWriter, r *http.Request, req *request) {
+	size := req.export.Backend.Size()
+	off, length := int64(0), size
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" {
+		var err error
+		off, length, err = parseRange(header, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
+		status = http.StatusPartialContent
+	}
+
+	writeHeader := func() {
+		header := w.Header()
+		header.Set("Accept-Ranges", "bytes")
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+		if status == http.StatusPartialContent {
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+length-1, size))
+		}
+		w.WriteHeader(status)
+	}
+	if r.Method == http.MethodHead || length == 0 {
+		writeHeader()
+		return
+	}
+
+	// The header is written after the first chunk was read, so that errors of small reads get a status
+	buf := make([]byte, min(length, transferChunkSize))
+	for pos, end := off, off+length; pos < end; {
+		n := min(int64(len(buf)), end-pos)
+		if err := req.export.Backend.ReadAt(req.ctx, buf[:n], pos); err != nil {
+			if pos == off {
+				s.backendError(w, req, "read", err)
+				return
+			}
+			s.abortStream(req, "read", err)
+		}
+		if pos == off {
+			writeHeader()
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		req.conn.bytesRead.Add(uint64(n))
+		pos += n
+	}
+}
+
+// parseRange parses a Range header with a single byte range. Ranges ending beyond the export are shortened.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, errors.New("only byte ranges are supported")
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, errors.New("multiple ranges are not supported")
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	if first == "" { // The last bytes of the export
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, errors.New("invalid range")
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errors.New("invalid range")
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errors.New("invalid range")
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errors.New("range starts beyond the export size")
+	}
+	return start, end - start + 1, nil
+}
+
+// write writes the body at the offset parameter. Parameter fua makes every write durable before it completes.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, req *request) {
+	off, err := int64Param(r, "offset", 0)
+	if err != nil {
+		s.backendError(w, req, "write", err)
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, "Content-Length required")
+		return
+	}
+	if r.ContentLength > s.options.MaxWriteSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("writes are limited to %d bytes", s.options.MaxWriteSize))
+		return
+	}
+	if err := backend.CheckRange(req.export.Backend.Size(), off, r.ContentLength); err != nil {
+		s.backendError(w, req, "write", err)
+		return
+	}
+	var flags backend.Flags
+	if boolParam(r, "fua") {
+		flags |= backend.FlagFUA
+	}
+
+	buf := make([]byte, min(r.ContentLength, transferChunkSize))
+	for pos, end := off, off+r.ContentLength; pos < end; {
+		n := min(int64(len(buf)), end-pos)
+		if _, err := io.ReadFull(r.Body, buf[:n]); err != nil {
+			writeError(w, http.StatusBadRequest, "request body is shorter than its Content-Length")
+			return
+		}
+		if err := req.export.Backend.WriteAt(req.ctx, buf[:n], pos, flags); err != nil {
+			s.backendError(w, req, "write", err)
+			return
+		}
+		req.conn.bytesWritten.Add(uint64(n))
+		pos += n
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) flush(w http.ResponseWriter, _ *http.Request, req *request) {
+	if err := req.export.Backend.Flush(req.ctx); err != nil {
+		s.backendError(w, req, "flush", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discard deallocates the range of the offset and length parameters
+func (s *Server) discard(w http.ResponseWriter, r *http.Request, req *request) {
+	off, length, err := rangeParams(r, req.export.Backend.Size(), true)
+	if err != nil {
+		s.backendError(w, req, "discard", err)
+		return
+	}
+	if err := req.export.Backend.Trim(req.ctx, off, length, 0); err != nil {
+		s.backendError(w, req, "discard", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// zero zeroes the range of the offset and length parameters. Parameter allocate keeps the range allocated.
+func (s *Server) zero(w http.ResponseWriter, r *http.Request, req *request) {
+	off, length, err := rangeParams(r, req.export.Backend.Size(), true)
+	if err != nil {
+		s.backendError(w, req, "zero", err)
+		return
+	}
+	var flags backend.Flags
+	if boolParam(r, "allocate") {
+		flags |= backend.FlagNoHole
+	}
+	if err := req.export.Backend.WriteZeroes(req.ctx, off, length, flags); err != nil {
+		s.backendError(w, req, "zero", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// int64Param returns a non-negative integer query parameter (invalid values are ErrInvalid)
+func int64Param(r *http.Request, name string, defaultValue int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %s %q", backend.ErrInvalid, name, value)
+	}
+	return n, nil
+}
+
+func boolParam(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && value
+}
+
+// rangeParams returns the range of the offset and length parameters. Without length the range extends to the end of the
+// export, unless the length is required.
+func rangeParams(r *http.Request, size int64, lengthRequired bool) (int64, int64, error) {
+	off, err := int64Param(r, "offset", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lengthRequired && r.URL.Query().Get("length") == "" {
+		return 0, 0, fmt.Errorf("%w: length required", backend.ErrInvalid)
+	}
+	length, err := int64Param(r, "length", max(size-off, 0))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := backend.CheckRange(size, off, length); err != nil {
+		return 0, 0, err
+	}
+	return off, length, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value) // Fails only if the client went away
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorInfo{Error: message})
+}
+
+// backendError replies with the status of a backend error. Failures of the backend are logged, errors of the request are not.
+func (s *Server) backendError(w http.ResponseWriter, req *request, op string, err error) {
+	status := backendStatus(err)
+	if req.ctx.Err() != nil {
+		status = http.StatusServiceUnavailable // The export was removed (or the client is gone and does not see the reply)
+	} else if status >= http.StatusInternalServerError {
+		s.logger.Warn("Backend request failed", "op", op, "export", req.export.Name, "client", req.conn.id, "error", err)
+	}
+	writeError(w, status, err.Error())
+}
+
+// abortStream aborts a response whose header was already sent, so that the client sees a truncated body
+func (s *Server) abortStream(req *request, op string, err error) {
+	if req.ctx.Err() == nil {
+		s.logger.Warn("Backend request failed, aborting response", "op", op, "export", req.export.Name, "client", req.conn.id, "error", err)
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func backendStatus(err error) int {
+	switch {
+	case errors.Is(err, backend.ErrOutOfRange):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, backend.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, backend.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, backend.ErrNoSpace):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, backend.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, backend.ErrNoDataPath):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
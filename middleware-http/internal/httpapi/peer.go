@@ -0,0 +1,22 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"quorumbd.net/middleware-common/acl"
+)
+
+// authorize returns the access of the peer to the export (read-write for all, if the server has no authorizer)
+func (s *Server) authorize(peer acl.Peer, export string) acl.Access {
+	if s.options.Authorizer == nil {
+		return acl.AccessReadWrite
+	}
+	return s.options.Authorizer.Authorize(peer, export)
+}
+
+// requestPeer returns the peer of a request: the peer of its connection and the identity of its client certificate
+func requestPeer(c *conn, r *http.Request) acl.Peer {
+	peer := c.peer
+	peer.TLSIdentity = acl.TLSIdentity(r.TLS)
+	return peer
+}
@@ -0,0 +1,253 @@
+// Package httpapi serves the block api of the exports over HTTP (ranged reads and writes, flush, discard,
+// allocation maps and the changed blocks of change tracking bitmaps)
+package httpapi
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second  // TOCONFIG
+	idleTimeout       = 120 * time.Second // TOCONFIG
+)
+
+// Export is an export served by the api
+type Export struct {
+	Name      string
+	ReadOnly  bool
+	BlockSize uint32 // Internal block granularity of the volume (0: unknown)
+	Backend   backend.BlockBackend
+}
+
+// export is an added export with the requests executing on it
+type export struct {
+	Export
+	ctx      context.Context // Cancelled when the export is removed, aborts its streams
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup
+}
+
+// Options configure the server
+type Options struct {
+	TLSConfig    *tls.Config    // Serves HTTPS on tcp listeners (nil: plaintext)
+	Authorizer   acl.Authorizer // Access control of the exports (nil: every peer may access every export)
+	MaxWriteSize int64          // Largest body of a write request
+}
+
+type Server struct {
+	logger     *slog.Logger
+	options    Options
+	httpServer *http.Server
+	baseCtx    context.Context // Cancelled on shutdown, parent of the contexts of all requests
+	cancelBase context.CancelFunc
+	connsMu    sync.Mutex
+	conns      map[net.Conn]*conn
+	nextConnID atomic.Uint64
+	exportsMu  sync.RWMutex
+	exports    map[string]*export
+}
+
+// conn is a client connection, which may carry requests to several exports
+type conn struct {
+	id           uint64
+	netConn      net.Conn
+	peer         acl.Peer // Without TLS identity, it is known once the handshake completed
+	connectedAt  time.Time
+	tls          bool
+	tlsIdentity  string // Guarded by connsMu
+	export       string // Export of the latest request (guarded by connsMu)
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+type connContextKey struct{}
+
+// ConnectionInfo describes a client connection
+type ConnectionInfo struct {
+	ID           uint64
+	Export       string // Export of the latest request (empty before the first request to an export)
+	RemoteAddr   string
+	Peer         acl.Peer
+	ConnectedAt  time.Time
+	TLS          bool
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+func NewServer(parentLogger *slog.Logger, options Options) *Server {
+	logger := parentLogger.With("module", "httpapi")
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	s := &Server{
+		logger:     logger,
+		options:    options,
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+		conns:      make(map[net.Conn]*conn),
+		exports:    make(map[string]*export),
+	}
+	s.httpServer = &http.Server{
+		Handler:           s.routes(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ConnContext:       s.connContext,
+		ConnState:         s.connState,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelDebug), // TLS handshake failures and malformed requests
+	}
+	return s
+}
+
+// Serve accepts connections until the listener is closed. HTTPS is served on tcp listeners, if TLS is configured.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.options.TLSConfig != nil && ln.Addr().Network() == "tcp" {
+		ln = tls.NewListener(ln, s.options.TLSConfig)
+	}
+	if err := s.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown aborts all requests and closes the client connections (the listeners must be closed by the caller)
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancelBase()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		return err
+	}
+	return nil
+}
+
+// connContext tracks a new connection and makes it available to its requests
+func (s *Server) connContext(ctx context.Context, netConn net.Conn) context.Context {
+	c := &conn{
+		id:          s.nextConnID.Add(1),
+		netConn:     netConn,
+		connectedAt: time.Now(),
+	}
+	_, c.tls = netConn.(*tls.Conn)
+	peer, err := acl.PeerOf(netConn)
+	if err != nil {
+		s.logger.Warn("Cannot determine peer credentials", "client", c.id, "error", err)
+	}
+	c.peer = peer
+
+	s.connsMu.Lock()
+	s.conns[netConn] = c
+	s.connsMu.Unlock()
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+func (s *Server) connState(netConn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	s.connsMu.Lock()
+	delete(s.conns, netConn)
+	s.connsMu.Unlock()
+}
+
+// Connections returns the client connections, ordered by id
+func (s *Server) Connections() []ConnectionInfo {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	infos := make([]ConnectionInfo, 0, len(s.conns))
+	for _, c := range s.conns {
+		infos = append(infos, ConnectionInfo{
+			ID:           c.id,
+			Export:       c.export,
+			RemoteAddr:   c.netConn.RemoteAddr().String(),
+			Peer:         acl.Peer{Credentials: c.peer.Credentials, TLSIdentity: c.tlsIdentity},
+			ConnectedAt:  c.connectedAt,
+			TLS:          c.tls,
+			BytesRead:    c.bytesRead.Load(),
+			BytesWritten: c.bytesWritten.Load(),
+		})
+	}
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// Disconnect closes the connection with the id (false, if there is none)
+func (s *Server) Disconnect(id uint64) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for _, c := range s.conns {
+		if c.id == id {
+			c.netConn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// using records the peer and the export of the latest request of a connection
+func (s *Server) using(c *conn, peer acl.Peer, name string) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	c.tlsIdentity = peer.TLSIdentity
+	c.export = name
+}
+
+// AddExport makes an export available to the clients
+func (s *Server) AddExport(exp Export) error {
+	s.exportsMu.Lock()
+	defer s.exportsMu.Unlock()
+	if _, ok := s.exports[exp.Name]; ok {
+		return fmt.Errorf("export %q already exists", exp.Name)
+	}
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	s.exports[exp.Name] = &export{Export: exp, ctx: ctx, cancel: cancel}
+	return nil
+}
+
+// RemoveExport removes an export, aborts its streams and waits for its requests (false, if there is no such export)
+func (s *Server) RemoveExport(name string) bool {
+	s.exportsMu.Lock()
+	exp, ok := s.exports[name]
+	delete(s.exports, name)
+	s.exportsMu.Unlock()
+	if !ok {
+		return false
+	}
+	exp.cancel()
+	exp.inFlight.Wait()
+	return true
+}
+
+// Exports returns the names of the exports, sorted
+func (s *Server) Exports() []string {
+	s.exportsMu.RLock()
+	defer s.exportsMu.RUnlock()
+	return slices.Sorted(maps.Keys(s.exports))
+}
+
+// acquireExport returns the export with the name and counts a request on it (nil, if there is no such export).
+// The caller must call inFlight.Done.
+func (s *Server) acquireExport(name string) *export {
+	s.exportsMu.RLock()
+	defer s.exportsMu.RUnlock()
+	exp, ok := s.exports[name]
+	if !ok {
+		return nil
+	}
+	exp.inFlight.Add(1)
+	return exp
+}
@@ -0,0 +1,368 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/config"
+)
+
+const testSize = 64 << 10
+
+type memBackend struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func newMemBackend() *memBackend {
+	data := make([]byte, testSize)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	return &memBackend{data: data}
+}
+
+func (b *memBackend) ReadAt(_ context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(p, b.data[off:])
+	return nil
+}
+
+func (b *memBackend) WriteAt(_ context.Context, p []byte, off int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(b.data[off:], p)
+	return nil
+}
+
+func (b *memBackend) Flush(context.Context) error {
+	return nil
+}
+
+func (b *memBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.WriteZeroes(ctx, off, length, flags)
+}
+
+func (b *memBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, length); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.data[off : off+length])
+	return nil
+}
+
+func (b *memBackend) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memBackend) Close() error {
+	return nil
+}
+
+// mappedBackend has an allocation map with a hole at [16K, 32K) and bitmap "snap" with changes at [8K, 12K) and [40K, 48K)
+type mappedBackend struct {
+	*memBackend
+	err error // Error of the mappings (e.g. ErrNotSupported of a cache without mapping below)
+}
+
+func (b *mappedBackend) Extents(_ context.Context, off int64, length int64) ([]backend.Extent, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return []backend.Extent{{Offset: 16 << 10, Length: 16 << 10, Flags: backend.ExtentHole | backend.ExtentZero}}, nil
+}
+
+func (b *mappedBackend) DirtyBitmaps() []string {
+	return []string{"snap"}
+}
+
+func (b *mappedBackend) DirtyExtents(_ context.Context, bitmap string, off int64, length int64) ([]backend.Extent, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return []backend.Extent{
+		{Offset: 8 << 10, Length: 4 << 10, Flags: backend.ExtentDirty},
+		{Offset: 40 << 10, Length: 8 << 10, Flags: backend.ExtentDirty},
+	}, nil
+}
+
+// startServer serves the exports on a unix socket and returns a client for it
+func startServer(t *testing.T, options Options, exports ...Export) (*Server, *http.Client) {
+	t.Helper()
+	s := NewServer(slog.New(slog.DiscardHandler), options)
+	for _, exp := range exports {
+		if err := s.AddExport(exp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	return s, client
+}
+
+func get(t *testing.T, client *http.Client, path string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := client.Get("http://quorumbd" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestExtents(t *testing.T) {
+	_, client := startServer(t, Options{},
+		Export{Name: "plain", Backend: newMemBackend()},
+		Export{Name: "mapped", Backend: &mappedBackend{memBackend: newMemBackend()}},
+		Export{Name: "unsupported", Backend: &mappedBackend{memBackend: newMemBackend(), err: backend.ErrNotSupported}},
+	)
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		extents []extentInfo
+	}{
+		{name: "no allocation map", path: "/v1/exports/plain/extents", status: http.StatusNotImplemented},
+		{name: "allocation map not supported", path: "/v1/exports/unsupported/extents", status: http.StatusNotImplemented},
+		{
+			name:   "allocation map",
+			path:   "/v1/exports/mapped/extents",
+			status: http.StatusOK,
+			extents: []extentInfo{
+				{Offset: 0, Length: 16 << 10},
+				{Offset: 16 << 10, Length: 16 << 10, Hole: true, Zero: true},
+				{Offset: 32 << 10, Length: 32 << 10},
+			},
+		},
+		{
+			name:    "range of the allocation map",
+			path:    "/v1/exports/mapped/extents?offset=20480&length=4096",
+			status:  http.StatusOK,
+			extents: []extentInfo{{Offset: 20 << 10, Length: 4 << 10, Hole: true, Zero: true}},
+		},
+		{name: "range beyond the end", path: "/v1/exports/mapped/extents?offset=65536&length=4096", status: http.StatusRequestedRangeNotSatisfiable},
+		{name: "no change tracking", path: "/v1/exports/plain/extents?since=snap", status: http.StatusNotImplemented},
+		{name: "unknown bitmap", path: "/v1/exports/mapped/extents?since=other", status: http.StatusNotFound},
+		{name: "change tracking not supported", path: "/v1/exports/unsupported/extents?since=snap", status: http.StatusNotImplemented},
+		{
+			name:   "dirty bitmap",
+			path:   "/v1/exports/mapped/extents?since=snap&offset=4096&length=16384",
+			status: http.StatusOK,
+			extents: []extentInfo{
+				{Offset: 4 << 10, Length: 4 << 10},
+				{Offset: 8 << 10, Length: 4 << 10, Dirty: true},
+				{Offset: 12 << 10, Length: 8 << 10},
+			},
+		},
+		{name: "unknown export", path: "/v1/exports/other/extents", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := get(t, client, test.path)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d (%s), want %d", resp.StatusCode, body, test.status)
+			}
+			if test.status != http.StatusOK {
+				var info errorInfo
+				if err := json.Unmarshal(body, &info); err != nil || info.Error == "" {
+					t.Fatalf("error body %q (%v)", body, err)
+				}
+				return
+			}
+			var extents []extentInfo
+			if err := json.Unmarshal(body, &extents); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(extents, test.extents) {
+				t.Fatalf("extents %+v, want %+v", extents, test.extents)
+			}
+		})
+	}
+}
+
+func TestChanges(t *testing.T) {
+	mapped := &mappedBackend{memBackend: newMemBackend()}
+	_, client := startServer(t, Options{},
+		Export{Name: "plain", Backend: newMemBackend()},
+		Export{Name: "mapped", Backend: mapped},
+	)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		ranges [][2]int64 // Offset and length of the expected parts
+	}{
+		{name: "changes", path: "/v1/exports/mapped/changes?since=snap", status: http.StatusOK, ranges: [][2]int64{{8 << 10, 4 << 10}, {40 << 10, 8 << 10}}},
+		{name: "range of the changes", path: "/v1/exports/mapped/changes?since=snap&offset=10240&length=32768", status: http.StatusOK, ranges: [][2]int64{{10 << 10, 2 << 10}, {40 << 10, 2 << 10}}},
+		{name: "no changes in the range", path: "/v1/exports/mapped/changes?since=snap&offset=16384&length=4096", status: http.StatusOK},
+		{name: "without since", path: "/v1/exports/mapped/changes", status: http.StatusBadRequest},
+		{name: "unknown bitmap", path: "/v1/exports/mapped/changes?since=other", status: http.StatusNotFound},
+		{name: "no change tracking", path: "/v1/exports/plain/changes?since=snap", status: http.StatusNotImplemented},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := get(t, client, test.path)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d (%s), want %d", resp.StatusCode, body, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/byteranges" {
+				t.Fatalf("content type %q (%v)", resp.Header.Get("Content-Type"), err)
+			}
+			reader := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+			var ranges [][2]int64
+			for {
+				part, err := reader.NextPart()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				var first, last, size int64
+				if _, err := fmt.Sscanf(part.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err != nil || size != testSize {
+					t.Fatalf("Content-Range %q (%v)", part.Header.Get("Content-Range"), err)
+				}
+				data, err := io.ReadAll(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if int64(len(data)) != last-first+1 || !slices.Equal(data, mapped.data[first:last+1]) {
+					t.Fatalf("data of part %d-%d differs", first, last)
+				}
+				ranges = append(ranges, [2]int64{first, last - first + 1})
+			}
+			if !reflect.DeepEqual(ranges, test.ranges) {
+				t.Fatalf("parts %v, want %v", ranges, test.ranges)
+			}
+		})
+	}
+}
+
+// TestAuthorization checks the access control by the credentials of unix socket peers and that the credentials
+// are the identities reported to core
+func TestAuthorization(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	uid := uint32(os.Getuid())
+	rules := []config.ACLRule{
+		{Exports: "backup-*", UIDs: []uint32{uid}, ReadOnly: true},
+		{Exports: "vm-*", UIDs: []uint32{uid}},
+		{Exports: "*", TLSIdentities: []string{"admin"}},
+	}
+	s, client := startServer(t, Options{Authorizer: acl.New(rules), MaxWriteSize: 1 << 20},
+		Export{Name: "backup-1", Backend: newMemBackend()},
+		Export{Name: "vm-1", Backend: newMemBackend()},
+		Export{Name: "other", Backend: newMemBackend()},
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{name: "read", method: http.MethodGet, path: "/v1/exports/vm-1/data", status: http.StatusOK},
+		{name: "write", method: http.MethodPut, path: "/v1/exports/vm-1/data?offset=0", status: http.StatusNoContent},
+		{name: "read of read-only access", method: http.MethodGet, path: "/v1/exports/backup-1/data", status: http.StatusOK},
+		{name: "write of read-only access", method: http.MethodPut, path: "/v1/exports/backup-1/data?offset=0", status: http.StatusForbidden},
+		{name: "discard of read-only access", method: http.MethodPost, path: "/v1/exports/backup-1/discard?offset=0&length=4096", status: http.StatusForbidden},
+		{name: "denied", method: http.MethodGet, path: "/v1/exports/other/data", status: http.StatusForbidden},
+		{name: "denied describe", method: http.MethodGet, path: "/v1/exports/other", status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "http://quorumbd"+test.path, strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+
+	resp, body := get(t, client, "/v1/exports")
+	var infos []exportInfo
+	if err := json.Unmarshal(body, &infos); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("status %d (%v)", resp.StatusCode, err)
+	}
+	want := []exportInfo{{Name: "backup-1", Size: testSize, ReadOnly: true}, {Name: "vm-1", Size: testSize}}
+	if !reflect.DeepEqual(infos, want) {
+		t.Fatalf("exports %+v, want %+v", infos, want)
+	}
+
+	connections := s.Connections()
+	if len(connections) == 0 {
+		t.Fatal("no connections")
+	}
+	for _, connection := range connections {
+		creds := connection.Peer.Credentials
+		if creds == nil || creds.UID != uid || creds.PID != int32(os.Getpid()) {
+			t.Fatalf("connection %d with credentials %+v", connection.ID, creds)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package implementation implements the adaptor interface of middleware-common
+package implementation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-http/internal/config"
+	"quorumbd.net/middleware-http/internal/httpapi"
+)
+
+type Implementation struct {
+	Config    *config.Config
+	Logger    *slog.Logger
+	server    *httpapi.Server
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+func New(cfg *config.Config, logger *slog.Logger) (*Implementation, error) {
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Implementation{
+		Config: cfg,
+		Logger: logger,
+		server: httpapi.NewServer(logger, httpapi.Options{
+			TLSConfig:    tlsConfig,
+			Authorizer:   acl.New(cfg.HTTPConfig.ACL),
+			MaxWriteSize: cfg.HTTPConfig.MaxWriteSizeMiB << 20,
+		}),
+	}, nil
+}
+
+// GetImplementationName is an interface method of common-middleware.Adapter
+func (impl *Implementation) GetImplementationName() string {
+	return "http"
+}
+
+// IsServer is an interface method of common-middleware.Adapter
+func (impl *Implementation) IsServer() bool {
+	return true
+}
+
+// ListenAddresses is an interface method of common-middleware.Adapter
+func (impl *Implementation) ListenAddresses() []string {
+	var addresses []string
+	if impl.Config.HTTPConfig.Socket != "" {
+		addresses = append(addresses, "unix://"+impl.Config.HTTPConfig.Socket)
+	}
+	return append(addresses, impl.Config.HTTPConfig.Listen...)
+}
+
+// Start is an interface method of common-middleware.Adapter
+func (impl *Implementation) Start(_ context.Context) error {
+	if socket := impl.Config.HTTPConfig.Socket; socket != "" {
+		ln, err := systemd.Listen("unix", socket)
+		if err != nil {
+			return err
+		}
+		impl.serve(ln)
+		impl.Logger.Info("Listening", "socket", socket, "socket_activated", systemd.IsActivated(ln))
+	}
+
+	for _, uri := range impl.Config.HTTPConfig.Listen {
+		address, err := config.TCPListenAddress(uri)
+		if err != nil {
+			return err
+		}
+		ln, err := systemd.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		impl.serve(ln)
+		impl.Logger.Info("Listening", "address", ln.Addr().String(), "tls", impl.Config.HTTPConfig.TLS.Enabled, "socket_activated", systemd.IsActivated(ln))
+	}
+	return nil
+}
+
+func (impl *Implementation) serve(ln net.Listener) {
+	impl.listeners = append(impl.listeners, ln)
+	impl.wg.Go(func() {
+		if err := impl.server.Serve(ln); err != nil {
+			impl.Logger.Error("HTTP server failed", "address", ln.Addr().String(), "error", err)
+		}
+	})
+}
+
+// Stop is an interface method of common-middleware.Adapter
+func (impl *Implementation) Stop(ctx context.Context) error {
+	if len(impl.listeners) == 0 {
+		return nil
+	}
+	var err error
+	for _, ln := range impl.listeners {
+		if closeErr := ln.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	impl.wg.Wait()
+	if shutdownErr := impl.server.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// AttachExport is an interface method of common-middleware.Adapter
+func (impl *Implementation) AttachExport(export backend.Export, blockBackend backend.BlockBackend) error {
+	if err := impl.server.AddExport(httpapi.Export{
+		Name:      export.Name,
+		ReadOnly:  export.ReadOnly,
+		BlockSize: export.BlockSize,
+		Backend:   blockBackend,
+	}); err != nil {
+		return err
+	}
+	impl.Logger.Info("Attached export", "export", export.Name)
+	return nil
+}
+
+// DetachExport is an interface method of common-middleware.Adapter. Streams of the export are aborted and its
+// requests are completed first.
+func (impl *Implementation) DetachExport(name string) error {
+	if !impl.server.RemoveExport(name) {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	impl.Logger.Info("Detached export", "export", name)
+	return nil
+}
+
+// Clients is an interface method of common-middleware.ClientReporter. The export of a client is the one of its latest request.
+func (impl *Implementation) Clients() []commoncontrol.ClientInfo {
+	connections := impl.server.Connections()
+	clients := make([]commoncontrol.ClientInfo, 0, len(connections))
+	for _, connection := range connections {
+		client := commoncontrol.ClientInfo{
+			ID:           connection.ID,
+			Export:       connection.Export,
+			RemoteAddr:   connection.RemoteAddr,
+			ConnectedAt:  uint64(connection.ConnectedAt.UnixMilli()),
+			BytesRead:    connection.BytesRead,
+			BytesWritten: connection.BytesWritten,
+		}
+		connection.Peer.Describe(&client)
+		if connection.TLS {
+			client.Features = append(client.Features, "tls")
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// DisconnectClient is an interface method of common-middleware.ClientReporter
+func (impl *Implementation) DisconnectClient(id uint64, _ string) error {
+	if !impl.server.Disconnect(id) {
+		return fmt.Errorf("no client with id %d", id)
+	}
+	return nil
+}
+
+// Status is an interface method of common-middleware.StatusReporter
+func (impl *Implementation) Status() string {
+	return fmt.Sprintf("%d exports, %d connections", len(impl.server.Exports()), len(impl.server.Connections()))
+}
@@ -0,0 +1,52 @@
+package implementation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"quorumbd.net/middleware-http/internal/config"
+)
+
+// File names of the x509 directory (the tls-creds-x509 layout of QEMU)
+const (
+	x509CACert     = "ca-cert.pem"
+	x509ServerCert = "server-cert.pem"
+	x509ServerKey  = "server-key.pem"
+)
+
+// loadTLSConfig loads the server credentials from the x509 directory (nil, if TLS is disabled)
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsCfg := cfg.HTTPConfig.TLS
+	if !tlsCfg.Enabled {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(tlsCfg.X509Dir, x509ServerCert), filepath.Join(tlsCfg.X509Dir, x509ServerKey))
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate failed: %w", err)
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsCfg.VerifyPeer {
+		caFile := filepath.Join(tlsCfg.X509Dir, x509CACert)
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CA certificate failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		serverConfig.ClientCAs = pool
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return serverConfig, nil
+}
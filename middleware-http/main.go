@@ -0,0 +1,55 @@
+// Main package of middleware-http
+package main
+
+import (
+	"fmt"
+	"os"
+
+	logging "quorumbd.net/common/logging"
+	app "quorumbd.net/middleware-common/app"
+	config "quorumbd.net/middleware-http/internal/config"
+	implementation "quorumbd.net/middleware-http/internal/implementation"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// load and init config
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	// init logging
+	err = logging.Initialize(cfg.LoggingConfig)
+	if err != nil {
+		return err
+	}
+
+	impl, err := implementation.New(cfg, logging.GetDefaultLogger())
+	if err != nil {
+		return err
+	}
+
+	app, err := app.New(
+		impl,
+		cfg.ToMiddlewareConfig(),
+		app.WithLogger(logging.GetDefaultLogger()),
+		app.WithUUID(cfg.InstanceConfig.InstanceUUID()),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := app.RunUntilSignal(); err != nil {
+		return err
+	}
+
+	// terminate logging
+	return logging.CloseLogging()
+}
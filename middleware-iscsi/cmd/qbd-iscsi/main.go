@@ -0,0 +1,164 @@
+// Main package of qbd-iscsi, the command line initiator for targets of middleware-iscsi
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"quorumbd.net/middleware-iscsi/internal/iscsi"
+)
+
+const usage = `usage: qbd-iscsi <command> [arguments]
+
+commands:
+  discover [flags] <portal>          list the targets of a portal (host[:port])
+  luns [flags] <portal> <target>     list the LUNs of a target with their capacity
+
+CHAP secrets are read from QBD_ISCSI_CHAP_SECRET and QBD_ISCSI_MUTUAL_SECRET.
+`
+
+const defaultPort = "3260"
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "discover":
+		return runDiscover(ctx, os.Args[2:])
+	case "luns":
+		return runLUNs(ctx, os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", os.Args[1])
+	}
+}
+
+// sessionFlags registers the flags of the login on a flag set
+func sessionFlags(flags *flag.FlagSet) *iscsi.InitiatorOptions {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	options := &iscsi.InitiatorOptions{
+		CHAP: iscsi.CHAP{
+			Secret:       os.Getenv("QBD_ISCSI_CHAP_SECRET"),
+			MutualSecret: os.Getenv("QBD_ISCSI_MUTUAL_SECRET"),
+		},
+	}
+	flags.StringVar(&options.InitiatorName, "initiator", "iqn.2025-01.net.quorumbd:qbd-iscsi."+strings.ToLower(hostname), "Initiator name")
+	flags.StringVar(&options.CHAP.User, "chap-user", "", "CHAP user of the initiator")
+	flags.StringVar(&options.CHAP.MutualUser, "mutual-user", "", "CHAP user the target must authenticate with")
+	return options
+}
+
+// portalAddress adds the default port to a portal without one
+func portalAddress(portal string) string {
+	if _, _, err := net.SplitHostPort(portal); err != nil {
+		return net.JoinHostPort(strings.Trim(portal, "[]"), defaultPort)
+	}
+	return portal
+}
+
+func runDiscover(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	options := sessionFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qbd-iscsi discover [flags] <portal>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("discover needs a portal")
+	}
+
+	initiator, err := iscsi.Dial(ctx, portalAddress(flags.Arg(0)), *options)
+	if err != nil {
+		return err
+	}
+	targets, err := initiator.SendTargets(ctx)
+	if err != nil {
+		initiator.Close()
+		return err
+	}
+	for _, target := range targets {
+		for _, address := range target.Addresses {
+			fmt.Printf("%s %s\n", address, target.Name)
+		}
+	}
+	return initiator.Logout(ctx)
+}
+
+func runLUNs(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("luns", flag.ContinueOnError)
+	options := sessionFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qbd-iscsi luns [flags] <portal> <target>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("luns needs a portal and a target")
+	}
+	options.TargetName = flags.Arg(1)
+
+	initiator, err := iscsi.Dial(ctx, portalAddress(flags.Arg(0)), *options)
+	if err != nil {
+		return err
+	}
+	if err := printLUNs(ctx, initiator); err != nil {
+		initiator.Close()
+		return err
+	}
+	return initiator.Logout(ctx)
+}
+
+func printLUNs(ctx context.Context, initiator *iscsi.Initiator) error {
+	luns, err := initiator.ReportLUNs(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LUN\tBLOCKS\tBLOCK SIZE\tBYTES")
+	for _, lun := range luns {
+		blocks, blockSize, err := initiator.ReadCapacity(ctx, lun)
+		if _, ok := errors.AsType[*iscsi.SCSIError](err); ok {
+			fmt.Fprintf(w, "%d\t-\t-\t%v\n", lun, err) // Unmapped meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", lun, blocks, blockSize, blocks*uint64(blockSize))
+	}
+	return w.Flush()
+}
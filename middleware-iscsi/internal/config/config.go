@@ -0,0 +1,204 @@
+// Package config provides configuration loading and validation
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	commonconfig "quorumbd.net/common/config"
+	middlewareconfig "quorumbd.net/middleware-common/config"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+const configFileName = "middleware-iscsi.toml"
+
+// MaxLUN is the highest LUN of the flat addressing method
+const MaxLUN = 16383
+
+// chapConfig enables CHAP authentication of all sessions. Without a user the target accepts AuthMethod=None.
+type chapConfig struct {
+	User         string `toml:"user"`
+	Secret       string `toml:"secret"`
+	MutualUser   string `toml:"mutual_user"` // Name of the target for mutual CHAP (the initiator authenticates the target)
+	MutualSecret string `toml:"mutual_secret"`
+}
+
+type iscsiConfig struct {
+	Listen     []string          `toml:"listen"` // tcp://host:port
+	TargetName string            `toml:"target_name"`
+	QueueDepth int               `toml:"queue_depth"` // Commands per session (the CmdSN window)
+	LUNs       map[string]uint16 `toml:"luns"`        // Fixed LUNs of exports, the others get the lowest free LUN on attach
+	CHAP       chapConfig        `toml:"chap"`
+}
+
+type Config struct {
+	CommonConfig         commonconfig.CommonConfig             `toml:"common"`
+	LoggingConfig        commonconfig.LoggingConfig            `toml:"logging"`
+	CoreConnectionConfig middlewareconfig.CoreConnectionConfig `toml:"coreconnection"`
+	InstanceConfig       middlewareconfig.InstanceConfig       `toml:"instance"`
+	ISCSIConfig          iscsiConfig                           `toml:"iscsi"`
+	CacheConfig          middlewareconfig.CacheConfig          `toml:"cache"`
+}
+
+func (cfg *Config) ToMiddlewareConfig() *middlewareconfig.Config {
+	return &middlewareconfig.Config{
+		CommonConfig:         cfg.CommonConfig,
+		CoreConnectionConfig: cfg.CoreConnectionConfig,
+		CacheConfig:          cfg.CacheConfig,
+	}
+}
+
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
+	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_ISCSI_CONFIG")
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	return LoadFrom(configPath)
+}
+
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
+	var cfg Config
+
+	cfg.setDefaults()
+
+	if err := cfg.readConfig(configPath); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *Config) setDefaults() {
+	cfg.CommonConfig.SetDefaults()
+	cfg.LoggingConfig.SetDefaults()
+	cfg.CoreConnectionConfig.SetDefaults()
+	cfg.InstanceConfig.SetDefaults()
+	cfg.ISCSIConfig.setDefaults()
+	cfg.CacheConfig.SetDefaults()
+}
+
+func (cfg *iscsiConfig) setDefaults() {
+	cfg.Listen = []string{"tcp://:3260"}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	cfg.TargetName = "iqn.2025-01.net.quorumbd:" + strings.ToLower(hostname)
+	cfg.QueueDepth = 32
+}
+
+func (cfg *Config) validate() error {
+	commonErrors := cfg.CommonConfig.Validate()
+	loggingErrors := cfg.LoggingConfig.Validate()
+	coreConnectionErrors := cfg.CoreConnectionConfig.Validate()
+	instanceErrors := cfg.InstanceConfig.Validate()
+	iscsiErrors := cfg.ISCSIConfig.validate()
+	cacheErrors := cfg.CacheConfig.Validate()
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, instanceErrors, iscsiErrors, cacheErrors)
+}
+
+func (cfg *iscsiConfig) validate() error {
+	return validation.Errors{
+		"iscsi": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.Listen, validation.Required.Error("iscsi.listen required"), validation.Each(validation.By(validateTCPListenAddress))),
+			validation.Field(&cfg.TargetName, validation.Required.Error("iscsi.target_name required"), validation.By(validateTargetName)),
+			validation.Field(&cfg.QueueDepth, validation.Min(1).Error("iscsi.queue_depth must be at least 1"), validation.Max(1024).Error("iscsi.queue_depth must be at most 1024")),
+			validation.Field(&cfg.LUNs, validation.By(validateLUNs)),
+		),
+		"iscsi.chap": validateCHAP(&cfg.CHAP),
+	}.Filter()
+}
+
+func validateCHAP(cfg *chapConfig) error {
+	if cfg.User == "" {
+		if cfg.Secret != "" || cfg.MutualUser != "" || cfg.MutualSecret != "" {
+			return fmt.Errorf("iscsi.chap.user required with CHAP secrets")
+		}
+		return nil
+	}
+	if cfg.MutualUser == "" && cfg.MutualSecret != "" {
+		return fmt.Errorf("iscsi.chap.mutual_user required with iscsi.chap.mutual_secret")
+	}
+	return validation.ValidateStruct(cfg,
+		validation.Field(&cfg.Secret, validation.Required.Error("iscsi.chap.secret required with iscsi.chap.user"), validation.By(validateCHAPSecret)),
+		validation.Field(&cfg.MutualSecret, validation.When(cfg.MutualUser != "", validation.Required.Error("iscsi.chap.mutual_secret required with iscsi.chap.mutual_user"), validation.By(validateCHAPSecret))),
+	)
+}
+
+// validateTargetName checks the type prefix of an iSCSI name (RFC 3720 3.2.6.3)
+func validateTargetName(value any) error {
+	name := value.(string)
+	if !strings.HasPrefix(name, "iqn.") && !strings.HasPrefix(name, "eui.") && !strings.HasPrefix(name, "naa.") {
+		return fmt.Errorf("iscsi.target_name must start with iqn., eui. or naa.")
+	}
+	if len(name) > 223 || strings.ContainsAny(name, " \x00") {
+		return fmt.Errorf("invalid iscsi.target_name %q", name)
+	}
+	return nil
+}
+
+// validateCHAPSecret enforces the secret length of RFC 3720 8.2.1 (Windows initiators require at least 12 bytes as well)
+func validateCHAPSecret(value any) error {
+	if secret := value.(string); len(secret) < 12 || len(secret) > 255 {
+		return fmt.Errorf("CHAP secrets must have 12 to 255 bytes")
+	}
+	return nil
+}
+
+func validateLUNs(value any) error {
+	used := make(map[uint16]string)
+	for export, lun := range value.(map[string]uint16) {
+		if lun > MaxLUN {
+			return fmt.Errorf("iscsi.luns: LUN %d of %q exceeds %d", lun, export, MaxLUN)
+		}
+		if other, ok := used[lun]; ok {
+			return fmt.Errorf("iscsi.luns: LUN %d is used by %q and %q", lun, other, export)
+		}
+		used[lun] = export
+	}
+	return nil
+}
+
+// TCPListenAddress returns host:port of a tcp:// listen URI
+func TCPListenAddress(uri string) (string, error) {
+	address, ok := strings.CutPrefix(uri, "tcp://")
+	if !ok {
+		return "", fmt.Errorf("listen address %q must start with tcp://", uri)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", uri, err)
+	}
+	return address, nil
+}
+
+func validateTCPListenAddress(value any) error {
+	_, err := TCPListenAddress(value.(string))
+	return err
+}
+
+func (cfg *Config) readConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
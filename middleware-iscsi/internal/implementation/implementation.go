@@ -0,0 +1,202 @@
+// Package implementation implements the adaptor interface of middleware-common
+package implementation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-iscsi/internal/config"
+	"quorumbd.net/middleware-iscsi/internal/iscsi"
+)
+
+type Implementation struct {
+	Config    *config.Config
+	Logger    *slog.Logger
+	target    *iscsi.Target
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	lunsMu    sync.Mutex
+	luns      map[string]uint16 // LUNs of the attached exports
+}
+
+func New(cfg *config.Config, logger *slog.Logger) *Implementation {
+	chap := cfg.ISCSIConfig.CHAP
+	return &Implementation{
+		Config: cfg,
+		Logger: logger,
+		target: iscsi.NewTarget(logger, iscsi.Options{
+			TargetName: cfg.ISCSIConfig.TargetName,
+			QueueDepth: cfg.ISCSIConfig.QueueDepth,
+			CHAP: iscsi.CHAP{
+				User:         chap.User,
+				Secret:       chap.Secret,
+				MutualUser:   chap.MutualUser,
+				MutualSecret: chap.MutualSecret,
+			},
+		}),
+		luns: make(map[string]uint16),
+	}
+}
+
+// GetImplementationName is an interface method of common-middleware.Adapter
+func (impl *Implementation) GetImplementationName() string {
+	return "iscsi"
+}
+
+// IsServer is an interface method of common-middleware.Adapter
+func (impl *Implementation) IsServer() bool {
+	return true
+}
+
+// ListenAddresses is an interface method of common-middleware.Adapter
+func (impl *Implementation) ListenAddresses() []string {
+	return impl.Config.ISCSIConfig.Listen
+}
+
+// Start is an interface method of common-middleware.Adapter
+func (impl *Implementation) Start(_ context.Context) error {
+	for _, uri := range impl.Config.ISCSIConfig.Listen {
+		address, err := config.TCPListenAddress(uri)
+		if err != nil {
+			return err
+		}
+		ln, err := systemd.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		impl.listeners = append(impl.listeners, ln)
+		impl.wg.Go(func() {
+			if err := impl.target.Serve(ln); err != nil {
+				impl.Logger.Error("iSCSI target failed", "address", ln.Addr().String(), "error", err)
+			}
+		})
+		impl.Logger.Info("Listening", "address", ln.Addr().String(), "target", impl.Config.ISCSIConfig.TargetName, "socket_activated", systemd.IsActivated(ln))
+	}
+	return nil
+}
+
+// Stop is an interface method of common-middleware.Adapter
+func (impl *Implementation) Stop(ctx context.Context) error {
+	if len(impl.listeners) == 0 {
+		return nil
+	}
+	var err error
+	for _, ln := range impl.listeners {
+		if closeErr := ln.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	impl.wg.Wait()
+	if shutdownErr := impl.target.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// AttachExport is an interface method of common-middleware.Adapter: the export is mapped to its configured LUN or the lowest free one
+func (impl *Implementation) AttachExport(export backend.Export, blockBackend backend.BlockBackend) error {
+	impl.lunsMu.Lock()
+	defer impl.lunsMu.Unlock()
+
+	if _, ok := impl.luns[export.Name]; ok {
+		return fmt.Errorf("export %q is already attached", export.Name)
+	}
+	number, err := impl.assignLUN(export.Name)
+	if err != nil {
+		return err
+	}
+	if err := impl.target.AddLUN(iscsi.LUN{
+		Number:    number,
+		Export:    export.Name,
+		VolumeID:  export.VolumeID,
+		ReadOnly:  export.ReadOnly,
+		BlockSize: export.BlockSize,
+		Backend:   blockBackend,
+	}); err != nil {
+		return err
+	}
+	impl.luns[export.Name] = number
+	impl.Logger.Info("Mapped export", "export", export.Name, "lun", number)
+	return nil
+}
+
+// assignLUN returns the configured LUN of an export, otherwise the lowest LUN that is neither used nor configured for another export
+func (impl *Implementation) assignLUN(name string) (uint16, error) {
+	configured := impl.Config.ISCSIConfig.LUNs
+	if number, ok := configured[name]; ok {
+		return number, nil
+	}
+
+	reserved := make(map[uint16]bool, len(impl.luns)+len(configured))
+	for _, number := range impl.luns {
+		reserved[number] = true
+	}
+	for _, number := range configured {
+		reserved[number] = true
+	}
+	for number := uint16(0); number <= config.MaxLUN; number++ {
+		if !reserved[number] {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("no free LUN for export %q", name)
+}
+
+// DetachExport is an interface method of common-middleware.Adapter. Commands executing on the LUN are completed first.
+func (impl *Implementation) DetachExport(name string) error {
+	impl.lunsMu.Lock()
+	defer impl.lunsMu.Unlock()
+
+	number, ok := impl.luns[name]
+	if !ok {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	delete(impl.luns, name)
+	impl.target.RemoveLUN(number)
+	impl.Logger.Info("Unmapped export", "export", name, "lun", number)
+	return nil
+}
+
+// Clients is an interface method of common-middleware.ClientReporter. Sessions reach all LUNs of the target, so no export is reported.
+func (impl *Implementation) Clients() []commoncontrol.ClientInfo {
+	sessions := impl.target.Sessions()
+	clients := make([]commoncontrol.ClientInfo, 0, len(sessions))
+	for _, session := range sessions {
+		client := commoncontrol.ClientInfo{
+			ID:           session.ID,
+			RemoteAddr:   session.RemoteAddr,
+			ConnectedAt:  uint64(session.LoggedInAt.UnixMilli()),
+			Features:     []string{"initiator=" + session.InitiatorName},
+			BytesRead:    session.BytesRead,
+			BytesWritten: session.BytesWritten,
+		}
+		if session.CHAP {
+			client.Features = append(client.Features, "chap")
+		}
+		if session.ImmediateData {
+			client.Features = append(client.Features, "immediate_data")
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// DisconnectClient is an interface method of common-middleware.ClientReporter
+func (impl *Implementation) DisconnectClient(id uint64, _ string) error {
+	if !impl.target.Disconnect(id) {
+		return fmt.Errorf("no client with id %d", id)
+	}
+	return nil
+}
+
+// Status is an interface method of common-middleware.StatusReporter
+func (impl *Implementation) Status() string {
+	return fmt.Sprintf("%d LUNs, %d sessions", len(impl.target.LUNs()), len(impl.target.Sessions()))
+}
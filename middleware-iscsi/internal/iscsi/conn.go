@@ -0,0 +1,195 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const loginTimeout = 30 * time.Second // TOCONFIG
+
+// errLoginRejected is returned by login after a login response with an error status was sent
+var errLoginRejected = errors.New("login rejected")
+
+// conn is the connection of a session (every session has a single connection)
+type conn struct {
+	id        uint64
+	target    *Target
+	logger    *slog.Logger
+	netConn   net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	closeOnce sync.Once
+
+	// Negotiated at login, constant afterwards
+	initiatorName string
+	isid          [6]byte
+	tsih          uint16
+	discovery     bool
+	params        sessionParams
+	loggedInAt    time.Time // Set under Target.connsMu
+
+	// Sequence numbers and the command window, guarded by writeMu
+	writeMu  sync.Mutex
+	statSN   uint32
+	expCmdSN uint32
+	active   uint32 // Non-immediate commands not completed yet
+
+	lunsEpoch    atomic.Uint64 // LUN changes reported to the initiator
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+func newConn(target *Target, netConn net.Conn) *conn {
+	id := target.nextConnID.Add(1)
+	return &conn{
+		id:      id,
+		target:  target,
+		logger:  target.logger.With("remote", netConn.RemoteAddr().String(), "client", id),
+		netConn: netConn,
+		r:       bufio.NewReader(netConn),
+		w:       bufio.NewWriter(netConn),
+		params:  defaultSessionParams(),
+	}
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	ctx, cancel := context.WithCancel(c.target.baseCtx)
+	defer cancel()
+
+	if err := c.netConn.SetDeadline(time.Now().Add(loginTimeout)); err != nil {
+		c.logger.Warn("Cannot set login deadline", "error", err)
+		return
+	}
+	if err := c.login(); err != nil {
+		switch {
+		case errors.Is(err, errLoginRejected):
+			c.logger.Warn("Login rejected", "initiator", c.initiatorName, "error", err)
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			c.logger.Debug("Connection closed during login")
+		default:
+			c.logger.Warn("Login failed", "error", err)
+		}
+		return
+	}
+	if err := c.netConn.SetDeadline(time.Time{}); err != nil {
+		c.logger.Warn("Cannot clear login deadline", "error", err)
+		return
+	}
+
+	c.logger = c.logger.With("initiator", c.initiatorName, "tsih", c.tsih)
+	if c.discovery {
+		c.logger.Debug("Discovery session logged in")
+	} else {
+		c.logger.Info("Session logged in")
+	}
+	c.lunsEpoch.Store(c.target.lunsEpoch.Load())
+	c.target.loggedIn(c)
+
+	if err := c.fullFeature(ctx); err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			c.logger.Info("Session closed by shutdown")
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			c.logger.Info("Connection closed without logout")
+		default:
+			c.logger.Warn("Session failed", "error", err)
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.netConn.Close()
+	})
+}
+
+// send writes PDUs of the target and flushes them. StatSN, ExpCmdSN and MaxCmdSN are filled in.
+func (c *conn) send(pdus ...*pdu) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.sendLocked(pdus)
+}
+
+// complete sends the final PDUs of commands and releases the slots they occupied in the command window
+func (c *conn) complete(released int, pdus ...*pdu) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.active -= uint32(released)
+	return c.sendLocked(pdus)
+}
+
+func (c *conn) sendLocked(pdus []*pdu) error {
+	for _, p := range pdus {
+		p.setU32(24, c.statSN)
+		if advancesStatSN(p) {
+			c.statSN++
+		}
+		p.setU32(28, c.expCmdSN)
+		p.setU32(32, c.maxCmdSNLocked())
+		if err := writePDU(c.w, p); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// maxCmdSNLocked returns the end of the command window: QueueDepth commands including the ones executing
+func (c *conn) maxCmdSNLocked() uint32 {
+	return c.expCmdSN + uint32(c.target.options.QueueDepth) - 1 - c.active
+}
+
+// acceptCmdSN checks the CmdSN of a command. Non-immediate commands advance ExpCmdSN and occupy the
+// command window until complete is called, if occupy is set. Without error recovery, commands must arrive in order.
+func (c *conn) acceptCmdSN(p *pdu, occupy bool) (bool, error) {
+	if p.immediate() {
+		return false, nil
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	cmdSN := p.u32(24)
+	if cmdSN != c.expCmdSN {
+		return false, &protocolError{reason: rejectProtocolError, message: "unexpected CmdSN"}
+	}
+	if int32(c.maxCmdSNLocked()-cmdSN) < 0 {
+		return false, &protocolError{reason: rejectProtocolError, message: "CmdSN outside the command window"}
+	}
+	c.expCmdSN++
+	if occupy {
+		c.active++
+	}
+	return occupy, nil
+}
+
+// advancesStatSN returns true for the PDUs that carry a status
+func advancesStatSN(p *pdu) bool {
+	switch p.opcode() {
+	case OpDataIn:
+		return p.flags()&flagStatus != 0
+	case OpNOPIn:
+		return p.itt() != reservedTag
+	case OpR2T:
+		return false
+	default:
+		return true
+	}
+}
+
+// protocolError is a PDU violating the protocol. It is rejected and the session is closed (error recovery level 0).
+type protocolError struct {
+	reason  uint8
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.message
+}
@@ -0,0 +1,655 @@
+package iscsi
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrInitiatorClosed is returned for commands on a closed initiator
+var ErrInitiatorClosed = errors.New("iscsi initiator closed")
+
+// InitiatorOptions configure the login of an initiator
+type InitiatorOptions struct {
+	InitiatorName string
+	TargetName    string // Empty for a discovery session
+	// CHAP credentials of the initiator. With MutualUser and MutualSecret the target must authenticate with them.
+	CHAP CHAP
+}
+
+// LoginError is a login response with an error status
+type LoginError struct {
+	Status uint16 // Class << 8 | detail
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("login failed with status 0x%04x", e.Status)
+}
+
+// SCSIError is a command that completed with a status other than good
+type SCSIError struct {
+	Status   uint8
+	SenseKey uint8
+	ASC      uint8
+	ASCQ     uint8
+}
+
+func (e *SCSIError) Error() string {
+	return fmt.Sprintf("SCSI status 0x%02x, sense %x/%02x/%02x", e.Status, e.SenseKey, e.ASC, e.ASCQ)
+}
+
+// DiscoveredTarget is a target returned by SendTargets
+type DiscoveredTarget struct {
+	Name      string
+	Addresses []string // host:port,portal-group-tag
+}
+
+// Initiator is a session to a target with a single connection. Commands are executed one at a time.
+type Initiator struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	options   InitiatorOptions
+	isid      [6]byte
+	tsih      uint16
+	itt       uint32
+	cmdSN     uint32
+	expStatSN uint32
+	params    sessionParams // Limits of the target: MaxRecvDataSegmentLength, bursts and immediate data
+	err       error         // Set, once the connection failed or was closed
+}
+
+// Dial connects to a target portal and logs in
+func Dial(ctx context.Context, address string, options InitiatorOptions) (*Initiator, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	initiator, err := NewInitiator(ctx, conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return initiator, nil
+}
+
+// NewInitiator logs in over an established connection
+func NewInitiator(ctx context.Context, conn net.Conn, options InitiatorOptions) (*Initiator, error) {
+	i := &Initiator{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		options: options,
+		cmdSN:   1,
+		params:  defaultSessionParams(),
+	}
+	if _, err := rand.Read(i.isid[1:4]); err != nil {
+		return nil, err
+	}
+	i.isid[0] = 0x80 // Random ISID format
+
+	err := i.do(ctx, i.login)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// do runs an exchange with the target. Cancelling ctx aborts the connection, the initiator cannot be used afterwards.
+func (i *Initiator) do(ctx context.Context, exchange func() error) error {
+	if i.err != nil {
+		return i.err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		i.conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		i.conn.SetDeadline(time.Unix(1, 0)) // Aborts the exchange
+	})
+	err := exchange()
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if _, ok := errors.AsType[*SCSIError](err); !ok {
+			i.err = err
+			i.conn.Close()
+		}
+		return err
+	}
+	i.conn.SetDeadline(time.Time{})
+	return nil
+}
+
+func (i *Initiator) nextITT() uint32 {
+	i.itt++
+	if i.itt == reservedTag {
+		i.itt = 0
+	}
+	return i.itt
+}
+
+// send writes a PDU of the initiator with CmdSN and ExpStatSN
+func (i *Initiator) send(p *pdu) error {
+	if p.opcode() != OpDataOut {
+		p.setU32(24, i.cmdSN)
+	}
+	p.setU32(28, i.expStatSN)
+	if err := writePDU(i.w, p); err != nil {
+		return err
+	}
+	return i.w.Flush()
+}
+
+// receive reads the next PDU of the target and tracks its StatSN
+func (i *Initiator) receive() (*pdu, error) {
+	p, err := readPDU(i.r, maxRecvDataSegmentLength)
+	if err != nil {
+		return nil, err
+	}
+	if advancesStatSN(p) {
+		i.expStatSN = p.u32(24) + 1
+	}
+	if p.opcode() == OpReject {
+		return nil, fmt.Errorf("target rejected PDU with reason 0x%02x", p.bhs[2])
+	}
+	return p, nil
+}
+
+// login runs the security stage (if CHAP is configured or requested) and the operational stage
+func (i *Initiator) login() error {
+	discovery := i.options.TargetName == ""
+	kvs := keyValues{{key: "InitiatorName", value: i.options.InitiatorName}}
+	if discovery {
+		kvs.add("SessionType", "Discovery")
+	} else {
+		kvs.add("SessionType", "Normal")
+		kvs.add("TargetName", i.options.TargetName)
+	}
+	if i.options.CHAP.User != "" {
+		kvs.add("AuthMethod", "CHAP,None")
+	} else {
+		kvs.add("AuthMethod", valueNone)
+	}
+
+	// Security stage
+	resp, transit, err := i.loginRequest(stageSecurity, stageOperational, kvs)
+	if err != nil {
+		return err
+	}
+	if method, _ := resp.get("AuthMethod"); method == "CHAP" {
+		if err := i.chap(); err != nil {
+			return err
+		}
+	} else if !transit {
+		return fmt.Errorf("target did not complete the security stage")
+	} else if i.options.CHAP.MutualUser != "" {
+		return fmt.Errorf("target did not authenticate")
+	}
+
+	// Operational stage
+	kvs = keyValues{
+		{key: "HeaderDigest", value: valueNone},
+		{key: "DataDigest", value: valueNone},
+		{key: "MaxRecvDataSegmentLength", value: strconv.Itoa(maxRecvDataSegmentLength)},
+		{key: "DefaultTime2Wait", value: "0"},
+		{key: "DefaultTime2Retain", value: "0"},
+		{key: "ErrorRecoveryLevel", value: "0"},
+	}
+	if !discovery {
+		kvs = append(kvs, keyValues{
+			{key: "InitialR2T", value: valueYes},
+			{key: "ImmediateData", value: valueYes},
+			{key: "MaxBurstLength", value: strconv.Itoa(maxBurstLength)},
+			{key: "FirstBurstLength", value: strconv.Itoa(maxFirstBurstLength)},
+			{key: "MaxConnections", value: "1"},
+			{key: "MaxOutstandingR2T", value: "1"},
+			{key: "DataPDUInOrder", value: valueYes},
+			{key: "DataSequenceInOrder", value: valueYes},
+		}...)
+	}
+	for {
+		resp, transit, err = i.loginRequest(stageOperational, stageFullFeature, kvs)
+		if err != nil {
+			return err
+		}
+		if err := i.applyLoginKeys(resp); err != nil {
+			return err
+		}
+		if transit {
+			return nil
+		}
+		kvs = nil
+	}
+}
+
+// chap answers the challenge of the target and verifies its response for mutual CHAP
+func (i *Initiator) chap() error {
+	credentials := i.options.CHAP
+	if credentials.User == "" {
+		return fmt.Errorf("target requires CHAP")
+	}
+	resp, _, err := i.loginRequest(stageSecurity, stageOperational, keyValues{{key: "CHAP_A", value: chapAlgorithmMD5}})
+	if err != nil {
+		return err
+	}
+	idValue, _ := resp.get("CHAP_I")
+	challengeValue, _ := resp.get("CHAP_C")
+	id, err := strconv.ParseUint(idValue, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_I %q", idValue)
+	}
+	challenge, err := decodeBinary(challengeValue)
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_C %q", challengeValue)
+	}
+
+	kvs := keyValues{
+		{key: "CHAP_N", value: credentials.User},
+		{key: "CHAP_R", value: encodeBinary(chapResponse(byte(id), credentials.Secret, challenge))},
+	}
+	var mutualID [1]byte
+	mutualChallenge := make([]byte, chapChallengeSize)
+	if credentials.MutualUser != "" {
+		if _, err := rand.Read(mutualID[:]); err != nil {
+			return err
+		}
+		if _, err := rand.Read(mutualChallenge); err != nil {
+			return err
+		}
+		kvs.add("CHAP_I", strconv.Itoa(int(mutualID[0])))
+		kvs.add("CHAP_C", encodeBinary(mutualChallenge))
+	}
+	resp, transit, err := i.loginRequest(stageSecurity, stageOperational, kvs)
+	if err != nil {
+		return err
+	}
+	if !transit {
+		return fmt.Errorf("target did not complete CHAP authentication")
+	}
+	if credentials.MutualUser == "" {
+		return nil
+	}
+
+	name, _ := resp.get("CHAP_N")
+	response, _ := resp.get("CHAP_R")
+	decoded, err := decodeBinary(response)
+	if err != nil {
+		return fmt.Errorf("invalid CHAP_R of target: %w", err)
+	}
+	expected := chapResponse(mutualID[0], credentials.MutualSecret, mutualChallenge)
+	if name != credentials.MutualUser || subtle.ConstantTimeCompare(decoded, expected) != 1 {
+		return fmt.Errorf("mutual CHAP authentication of target %q failed", name)
+	}
+	return nil
+}
+
+// loginRequest sends a login request that asks to transit to nsg and returns the keys of the response
+func (i *Initiator) loginRequest(csg uint8, nsg uint8, kvs keyValues) (keyValues, bool, error) {
+	req := newPDU(OpLogin|flagImmediate, flagTransit|csg<<2|nsg)
+	copy(req.bhs[8:14], i.isid[:])
+	binary.BigEndian.PutUint16(req.bhs[14:], i.tsih)
+	req.setU32(16, i.nextITT())
+	req.data = kvs.encode()
+	if err := i.send(req); err != nil {
+		return nil, false, err
+	}
+
+	resp, err := i.receive()
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.opcode() != OpLoginResp {
+		return nil, false, fmt.Errorf("unexpected opcode 0x%02x during login", resp.opcode())
+	}
+	if status := binary.BigEndian.Uint16(resp.bhs[36:]); status != loginSuccess {
+		return nil, false, &LoginError{Status: status}
+	}
+	if resp.flags()&flagContinue != 0 {
+		return nil, false, fmt.Errorf("continued login responses are not supported")
+	}
+
+	transit := resp.flags()&flagTransit != 0
+	if transit && resp.flags()&3 == stageFullFeature {
+		i.tsih = binary.BigEndian.Uint16(resp.bhs[14:])
+	}
+	respKeys, err := parseText(resp.data)
+	return respKeys, transit, err
+}
+
+// applyLoginKeys takes over the limits of the target from the operational keys of a login response
+func (i *Initiator) applyLoginKeys(kvs keyValues) error {
+	for _, kv := range kvs {
+		switch kv.key {
+		case "MaxRecvDataSegmentLength", "MaxBurstLength", "FirstBurstLength":
+			n, err := numberValue(kv)
+			if err != nil || n < 512 {
+				return fmt.Errorf("invalid value of %s: %q", kv.key, kv.value)
+			}
+			switch kv.key {
+			case "MaxRecvDataSegmentLength":
+				i.params.maxSendDataSegment = int(n)
+			case "MaxBurstLength":
+				i.params.maxBurst = int(n)
+			default:
+				i.params.firstBurst = int(n)
+			}
+		case "ImmediateData":
+			i.params.immediateData = kv.value == valueYes
+		case "HeaderDigest", "DataDigest":
+			if kv.value != valueNone {
+				return fmt.Errorf("target requires %s=%s", kv.key, kv.value)
+			}
+		}
+	}
+	i.params.firstBurst = min(i.params.firstBurst, i.params.maxBurst)
+	return nil
+}
+
+// SendTargets returns the targets known to the target portal
+func (i *Initiator) SendTargets(ctx context.Context) ([]DiscoveredTarget, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var targets []DiscoveredTarget
+	err := i.do(ctx, func() error {
+		req := newPDU(OpText, flagFinal)
+		req.setU32(16, i.nextITT())
+		req.setU32(20, reservedTag)
+		req.data = keyValues{{key: "SendTargets", value: "All"}}.encode()
+		if err := i.send(req); err != nil {
+			return err
+		}
+		i.cmdSN++
+
+		resp, err := i.receive()
+		if err != nil {
+			return err
+		}
+		if resp.opcode() != OpTextResp {
+			return fmt.Errorf("unexpected opcode 0x%02x in response to SendTargets", resp.opcode())
+		}
+		kvs, err := parseText(resp.data)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			switch kv.key {
+			case "TargetName":
+				targets = append(targets, DiscoveredTarget{Name: kv.value})
+			case "TargetAddress":
+				if len(targets) > 0 {
+					targets[len(targets)-1].Addresses = append(targets[len(targets)-1].Addresses, kv.value)
+				}
+			}
+		}
+		return nil
+	})
+	return targets, err
+}
+
+// Command executes a CDB on a LUN. Data is written from out and read into a buffer of inLength bytes.
+// A unit attention is retried once. The read data is shortened to the length transferred by the target.
+func (i *Initiator) Command(ctx context.Context, lun uint16, cdb []byte, out []byte, inLength int) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var in []byte
+	err := i.do(ctx, func() error {
+		var err error
+		in, err = i.command(lun, cdb, out, inLength)
+		if scsiErr, ok := errors.AsType[*SCSIError](err); ok && scsiErr.SenseKey == senseUnitAttention {
+			in, err = i.command(lun, cdb, out, inLength)
+		}
+		return err
+	})
+	return in, err
+}
+
+func (i *Initiator) command(lun uint16, cdb []byte, out []byte, inLength int) ([]byte, error) {
+	itt := i.nextITT()
+	encodedLUN := encodeLUN(lun)
+
+	flags := flagFinal | 0x01 // Simple task attribute
+	edtl := len(out)
+	if out != nil {
+		flags |= flagWrite
+	} else if inLength > 0 {
+		flags |= flagRead
+		edtl = inLength
+	}
+	req := newPDU(OpSCSICommand, flags)
+	copy(req.bhs[8:16], encodedLUN[:])
+	req.setU32(16, itt)
+	req.setU32(20, uint32(edtl))
+	copy(req.bhs[32:48], cdb)
+	if i.params.immediateData {
+		req.data = out[:min(len(out), i.params.firstBurst, i.params.maxSendDataSegment)]
+	}
+	if err := i.send(req); err != nil {
+		return nil, err
+	}
+	i.cmdSN++
+
+	in := make([]byte, inLength)
+	transferred := 0
+	for {
+		resp, err := i.receive()
+		if err != nil {
+			return nil, err
+		}
+		if resp.itt() != itt {
+			if resp.opcode() == OpNOPIn || resp.opcode() == OpAsyncMessage {
+				continue
+			}
+			return nil, fmt.Errorf("unexpected response with task tag 0x%x", resp.itt())
+		}
+
+		switch resp.opcode() {
+		case OpR2T:
+			if err := i.sendData(resp, out); err != nil {
+				return nil, err
+			}
+		case OpDataIn:
+			offset := int(resp.u32(40))
+			if offset+len(resp.data) > len(in) {
+				return nil, fmt.Errorf("Data-In beyond the expected length")
+			}
+			copy(in[offset:], resp.data)
+			transferred = max(transferred, offset+len(resp.data))
+			if resp.flags()&flagStatus != 0 {
+				return in[:transferred], commandStatus(resp.bhs[3], nil)
+			}
+		case OpSCSIResponse:
+			if resp.bhs[2] != 0 {
+				return nil, fmt.Errorf("command failed with response 0x%02x", resp.bhs[2])
+			}
+			var sense []byte
+			if len(resp.data) >= 2 {
+				senseLength := int(binary.BigEndian.Uint16(resp.data))
+				sense = resp.data[2:min(len(resp.data), 2+senseLength)]
+			}
+			return in[:transferred], commandStatus(resp.bhs[3], sense)
+		default:
+			return nil, fmt.Errorf("unexpected opcode 0x%02x in response to a command", resp.opcode())
+		}
+	}
+}
+
+// sendData answers an R2T with Data-Out PDUs
+func (i *Initiator) sendData(r2t *pdu, out []byte) error {
+	offset := int(r2t.u32(40))
+	end := offset + int(r2t.u32(44))
+	if end > len(out) {
+		return fmt.Errorf("R2T beyond the data of the command")
+	}
+	for dataSN := uint32(0); offset < end; dataSN++ {
+		length := min(end-offset, i.params.maxSendDataSegment)
+		var flags uint8
+		if offset+length == end {
+			flags = flagFinal
+		}
+		p := newPDU(OpDataOut, flags)
+		copy(p.bhs[8:16], r2t.lun())
+		p.setU32(16, r2t.itt())
+		p.setU32(20, r2t.u32(20))
+		p.setU32(36, dataSN)
+		p.setU32(40, uint32(offset))
+		p.data = out[offset : offset+length]
+		if err := i.send(p); err != nil {
+			return err
+		}
+		offset += length
+	}
+	return nil
+}
+
+// commandStatus returns a SCSIError for a status other than good
+func commandStatus(status uint8, sense []byte) error {
+	if status == statusGood {
+		return nil
+	}
+	err := &SCSIError{Status: status}
+	if len(sense) >= 14 && sense[0]&0x7e == 0x70 {
+		err.SenseKey = sense[2] & 0x0f
+		err.ASC = sense[12]
+		err.ASCQ = sense[13]
+	}
+	return err
+}
+
+// ReportLUNs returns the LUNs of the target
+func (i *Initiator) ReportLUNs(ctx context.Context) ([]uint16, error) {
+	const allocationLength = 8 + 8*1024
+	cdb := make([]byte, 12)
+	cdb[0] = opReportLUNs
+	binary.BigEndian.PutUint32(cdb[6:], allocationLength)
+	data, err := i.Command(ctx, 0, cdb, nil, allocationLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("short REPORT LUNS data")
+	}
+	listLength := int(binary.BigEndian.Uint32(data))
+	var luns []uint16
+	for off := 8; off+8 <= len(data) && off < 8+listLength; off += 8 {
+		if lun, ok := decodeLUN(data[off : off+8]); ok {
+			luns = append(luns, lun)
+		}
+	}
+	return luns, nil
+}
+
+// ReadCapacity returns the number of logical blocks and the logical block size of a LUN
+func (i *Initiator) ReadCapacity(ctx context.Context, lun uint16) (uint64, uint32, error) {
+	cdb := make([]byte, 16)
+	cdb[0] = opServiceActionIn16
+	cdb[1] = saReadCapacity16
+	binary.BigEndian.PutUint32(cdb[10:], 32)
+	data, err := i.Command(ctx, lun, cdb, nil, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) < 12 {
+		return 0, 0, fmt.Errorf("short READ CAPACITY data")
+	}
+	return binary.BigEndian.Uint64(data) + 1, binary.BigEndian.Uint32(data[8:]), nil
+}
+
+// Read reads blocks of 512 bytes starting at lba
+func (i *Initiator) Read(ctx context.Context, lun uint16, lba uint64, blocks uint32) ([]byte, error) {
+	cdb := make([]byte, 16)
+	cdb[0] = opRead16
+	binary.BigEndian.PutUint64(cdb[2:], lba)
+	binary.BigEndian.PutUint32(cdb[10:], blocks)
+	return i.Command(ctx, lun, cdb, nil, int(blocks)*logicalBlockSize)
+}
+
+// Write writes data (a multiple of 512 bytes) starting at lba. With fua, the data is durable when Write returns.
+func (i *Initiator) Write(ctx context.Context, lun uint16, lba uint64, data []byte, fua bool) error {
+	if len(data)%logicalBlockSize != 0 {
+		return fmt.Errorf("write of %d bytes is not a multiple of the block size", len(data))
+	}
+	cdb := make([]byte, 16)
+	cdb[0] = opWrite16
+	if fua {
+		cdb[1] = 0x08
+	}
+	binary.BigEndian.PutUint64(cdb[2:], lba)
+	binary.BigEndian.PutUint32(cdb[10:], uint32(len(data)/logicalBlockSize))
+	_, err := i.Command(ctx, lun, cdb, data, 0)
+	return err
+}
+
+// SynchronizeCache makes all written data of a LUN durable
+func (i *Initiator) SynchronizeCache(ctx context.Context, lun uint16) error {
+	cdb := make([]byte, 10)
+	cdb[0] = opSynchronizeCache10
+	_, err := i.Command(ctx, lun, cdb, nil, 0)
+	return err
+}
+
+// Unmap deallocates blocks starting at lba
+func (i *Initiator) Unmap(ctx context.Context, lun uint16, lba uint64, blocks uint32) error {
+	params := make([]byte, 8+unmapDescriptorSize)
+	binary.BigEndian.PutUint16(params, uint16(len(params)-2))
+	binary.BigEndian.PutUint16(params[2:], unmapDescriptorSize)
+	binary.BigEndian.PutUint64(params[8:], lba)
+	binary.BigEndian.PutUint32(params[16:], blocks)
+
+	cdb := make([]byte, 10)
+	cdb[0] = opUnmap
+	binary.BigEndian.PutUint16(cdb[7:], uint16(len(params)))
+	_, err := i.Command(ctx, lun, cdb, params, 0)
+	return err
+}
+
+// Logout ends the session and closes the connection
+func (i *Initiator) Logout(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	err := i.do(ctx, func() error {
+		req := newPDU(OpLogout|flagImmediate, flagFinal|logoutCloseSession)
+		req.setU32(16, i.nextITT())
+		if err := i.send(req); err != nil {
+			return err
+		}
+		resp, err := i.receive()
+		if err != nil {
+			return err
+		}
+		if resp.opcode() != OpLogoutResp || resp.bhs[2] != logoutSuccess {
+			return fmt.Errorf("logout failed with response 0x%02x", resp.bhs[2])
+		}
+		return nil
+	})
+	i.close()
+	return err
+}
+
+// Close closes the connection without logout
+func (i *Initiator) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.close()
+	return nil
+}
+
+func (i *Initiator) close() {
+	if i.err == nil {
+		i.err = ErrInitiatorClosed
+		i.conn.Close()
+	}
+}
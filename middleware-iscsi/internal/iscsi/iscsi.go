@@ -0,0 +1,198 @@
+// Package iscsi provides the iSCSI target (login, CHAP, full feature phase and the SCSI block commands) of the iscsi middleware
+// and an initiator for tooling and tests
+package iscsi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Initiator opcodes
+const (
+	OpNOPOut      uint8 = 0x00
+	OpSCSICommand uint8 = 0x01
+	OpTaskMgmt    uint8 = 0x02
+	OpLogin       uint8 = 0x03
+	OpText        uint8 = 0x04
+	OpDataOut     uint8 = 0x05
+	OpLogout      uint8 = 0x06
+	OpSNACK       uint8 = 0x10
+)
+
+// Target opcodes
+const (
+	OpNOPIn         uint8 = 0x20
+	OpSCSIResponse  uint8 = 0x21
+	OpTaskMgmtResp  uint8 = 0x22
+	OpLoginResp     uint8 = 0x23
+	OpTextResp      uint8 = 0x24
+	OpDataIn        uint8 = 0x25
+	OpLogoutResp    uint8 = 0x26
+	OpR2T           uint8 = 0x31
+	OpAsyncMessage  uint8 = 0x32
+	OpReject        uint8 = 0x3f
+	opcodeMask      uint8 = 0x3f
+	flagImmediate   uint8 = 0x40
+	reservedTag           = 0xffffffff
+	bhsSize               = 48
+	maxTextDataSize       = 64 << 10 // Text and login data of all continuation PDUs
+)
+
+// PDU flags (byte 1)
+const (
+	flagFinal       uint8 = 0x80
+	flagContinue    uint8 = 0x40 // Login and text
+	flagTransit     uint8 = 0x80 // Login
+	flagRead        uint8 = 0x40 // SCSI command
+	flagWrite       uint8 = 0x20 // SCSI command
+	flagAcknowledge uint8 = 0x40 // Data-In
+	flagOverflow    uint8 = 0x04 // Data-In and SCSI response
+	flagUnderflow   uint8 = 0x02 // Data-In and SCSI response
+	flagStatus      uint8 = 0x01 // Data-In
+)
+
+// Login stages
+const (
+	stageSecurity    uint8 = 0
+	stageOperational uint8 = 1
+	stageFullFeature uint8 = 3
+)
+
+// Login status (class << 8 | detail)
+const (
+	loginSuccess            uint16 = 0x0000
+	loginInitiatorError     uint16 = 0x0200
+	loginAuthFailed         uint16 = 0x0201
+	loginNotFound           uint16 = 0x0203
+	loginUnsupportedVersion uint16 = 0x0205
+	loginMissingParameter   uint16 = 0x0207
+	loginUnsupportedSession uint16 = 0x0209
+	loginSessionNotFound    uint16 = 0x020a
+	loginInvalidRequest     uint16 = 0x020b
+	loginTargetError        uint16 = 0x0300
+)
+
+// Reject reasons
+const (
+	rejectCommandNotSupported uint8 = 0x05
+	rejectProtocolError       uint8 = 0x04
+	rejectInvalidPDUField     uint8 = 0x09
+)
+
+// pdu is a protocol data unit: the basic header segment and the data segment (additional headers are skipped)
+type pdu struct {
+	bhs  [bhsSize]byte
+	data []byte
+}
+
+func newPDU(opcode uint8, flags uint8) *pdu {
+	p := &pdu{}
+	p.bhs[0] = opcode
+	p.bhs[1] = flags
+	return p
+}
+
+func (p *pdu) opcode() uint8 {
+	return p.bhs[0] & opcodeMask
+}
+
+func (p *pdu) immediate() bool {
+	return p.bhs[0]&flagImmediate != 0
+}
+
+func (p *pdu) flags() uint8 {
+	return p.bhs[1]
+}
+
+func (p *pdu) u32(off int) uint32 {
+	return binary.BigEndian.Uint32(p.bhs[off:])
+}
+
+func (p *pdu) setU32(off int, value uint32) {
+	binary.BigEndian.PutUint32(p.bhs[off:], value)
+}
+
+func (p *pdu) itt() uint32 {
+	return p.u32(16)
+}
+
+func (p *pdu) lun() []byte {
+	return p.bhs[8:16]
+}
+
+// readPDU reads the next PDU. Data segments above maxData are a protocol error.
+func readPDU(r *bufio.Reader, maxData int) (*pdu, error) {
+	p := &pdu{}
+	if _, err := io.ReadFull(r, p.bhs[:]); err != nil {
+		return nil, err
+	}
+	if ahsLength := int(p.bhs[4]) * 4; ahsLength > 0 {
+		if _, err := r.Discard(ahsLength); err != nil {
+			return nil, err
+		}
+	}
+
+	dataLength := int(binary.BigEndian.Uint32(p.bhs[4:]) & 0xffffff)
+	if dataLength > maxData {
+		return nil, fmt.Errorf("data segment of %d bytes exceeds %d", dataLength, maxData)
+	}
+	if dataLength > 0 {
+		p.data = make([]byte, dataLength)
+		if _, err := io.ReadFull(r, p.data); err != nil {
+			return nil, err
+		}
+		if padding := pad(dataLength); padding > 0 {
+			if _, err := r.Discard(padding); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// writePDU writes the PDU without flushing. The data segment length is set from the data.
+func writePDU(w *bufio.Writer, p *pdu) error {
+	p.bhs[4] = 0
+	p.bhs[5] = byte(len(p.data) >> 16)
+	p.bhs[6] = byte(len(p.data) >> 8)
+	p.bhs[7] = byte(len(p.data))
+	if _, err := w.Write(p.bhs[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.data); err != nil {
+		return err
+	}
+	var padding [4]byte
+	_, err := w.Write(padding[:pad(len(p.data))])
+	return err
+}
+
+func pad(length int) int {
+	return (4 - length%4) % 4
+}
+
+// encodeLUN returns the 8 byte LUN structure (peripheral addressing below 256, flat addressing above)
+func encodeLUN(lun uint16) [8]byte {
+	var encoded [8]byte
+	if lun < 256 {
+		encoded[1] = byte(lun)
+	} else {
+		encoded[0] = 0x40 | byte(lun>>8)
+		encoded[1] = byte(lun)
+	}
+	return encoded
+}
+
+// decodeLUN returns the LUN of the first level of a LUN structure (false for unsupported addressing methods)
+func decodeLUN(lun []byte) (uint16, bool) {
+	switch lun[0] >> 6 {
+	case 0:
+		return uint16(lun[1]), lun[0] == 0
+	case 1:
+		return uint16(lun[0]&0x3f)<<8 | uint16(lun[1]), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,117 @@
+package iscsi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// rawPDU encodes a basic header segment with the opcode, AHS length and data segment length followed by the rest
+func rawPDU(opcode uint8, ahsWords uint8, dataLength uint32, rest ...byte) []byte {
+	bhs := make([]byte, bhsSize)
+	bhs[0] = opcode
+	bhs[4] = ahsWords
+	bhs[5], bhs[6], bhs[7] = byte(dataLength>>16), byte(dataLength>>8), byte(dataLength)
+	bhs[16] = 0xaa // Initiator task tag
+	return append(bhs, rest...)
+}
+
+func TestReadPDU(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		maxData int
+		data    []byte
+		err     error // Expected error, nil for success
+		failed  bool  // Any error is expected
+	}{
+		{name: "header only", raw: rawPDU(OpNOPOut, 0, 0), maxData: 8192},
+		{name: "data", raw: rawPDU(OpText, 0, 4, 'A', '=', '1', 0), maxData: 8192, data: []byte{'A', '=', '1', 0}},
+		{name: "padded data", raw: rawPDU(OpText, 0, 3, 'A', '=', '1', 0), maxData: 8192, data: []byte{'A', '=', '1'}},
+		{name: "additional header skipped", raw: rawPDU(OpSCSICommand, 1, 1, 9, 9, 9, 9, 0x42, 0, 0, 0), maxData: 8192, data: []byte{0x42}},
+		{name: "data at the limit", raw: append(rawPDU(OpDataOut, 0, 512), make([]byte, 512)...), maxData: 512, data: make([]byte, 512)},
+		{name: "data too large", raw: rawPDU(OpDataOut, 0, 513), maxData: 512, failed: true},
+		{name: "truncated header", raw: rawPDU(OpNOPOut, 0, 0)[:20], maxData: 8192, err: io.ErrUnexpectedEOF},
+		{name: "truncated data", raw: rawPDU(OpText, 0, 8, 'A', '=', '1', 0), maxData: 8192, err: io.ErrUnexpectedEOF},
+		{name: "truncated padding", raw: rawPDU(OpText, 0, 3, 'A', '=', '1'), maxData: 8192, err: io.EOF},
+		{name: "empty", raw: nil, maxData: 8192, err: io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := readPDU(bufio.NewReader(bytes.NewReader(test.raw)), test.maxData)
+			if test.err != nil || test.failed {
+				if err == nil || (test.err != nil && !errors.Is(err, test.err)) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.opcode() != test.raw[0] || p.itt() != 0xaa000000 || !bytes.Equal(p.data, test.data) {
+				t.Fatalf("opcode 0x%02x, task tag 0x%x, data %x", p.opcode(), p.itt(), p.data)
+			}
+		})
+	}
+}
+
+func TestWritePDU(t *testing.T) {
+	for _, length := range []int{0, 1, 3, 4, 5} {
+		p := newPDU(OpTextResp, flagFinal)
+		p.setU32(16, 7)
+		p.data = bytes.Repeat([]byte{'x'}, length)
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := writePDU(w, p); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		if buf.Len() != bhsSize+length+pad(length) || buf.Len()%4 != 0 {
+			t.Fatalf("%d bytes of data written as %d bytes", length, buf.Len())
+		}
+
+		read, err := readPDU(bufio.NewReader(&buf), 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.bhs != p.bhs || !bytes.Equal(read.data, p.data) {
+			t.Fatalf("round trip of %d bytes of data differs", length)
+		}
+	}
+}
+
+func TestLUNAddressing(t *testing.T) {
+	tests := []struct {
+		name    string
+		lun     uint16
+		encoded [8]byte
+	}{
+		{name: "peripheral", lun: 0, encoded: [8]byte{0, 0}},
+		{name: "peripheral maximum", lun: 255, encoded: [8]byte{0, 255}},
+		{name: "flat", lun: 256, encoded: [8]byte{0x41, 0}},
+		{name: "flat maximum", lun: 0x3fff, encoded: [8]byte{0x7f, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodeLUN(test.lun)
+			if encoded != test.encoded {
+				t.Fatalf("encoded %x, want %x", encoded, test.encoded)
+			}
+			if lun, ok := decodeLUN(encoded[:]); !ok || lun != test.lun {
+				t.Fatalf("decoded %d (%t)", lun, ok)
+			}
+		})
+	}
+
+	for _, lun := range [][]byte{
+		{0x01, 0x00, 0, 0, 0, 0, 0, 0}, // Peripheral with bus
+		{0x80, 0x01, 0, 0, 0, 0, 0, 0}, // Logical unit addressing
+		{0xc0, 0x01, 0, 0, 0, 0, 0, 0}, // Extended addressing
+	} {
+		if number, ok := decodeLUN(lun); ok {
+			t.Errorf("unsupported LUN %x decoded as %d", lun, number)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package iscsi
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Limits of the target in the negotiation
+const (
+	maxRecvDataSegmentLength = 256 << 10 // Declared to the initiator, limits Data-Out and immediate data PDUs
+	maxBurstLength           = 1 << 20
+	maxFirstBurstLength      = 256 << 10
+	defaultTime2Wait         = 2
+	chapChallengeSize        = 16
+)
+
+// sessionParams are the negotiated parameters used in the full feature phase
+type sessionParams struct {
+	maxSendDataSegment int // MaxRecvDataSegmentLength of the initiator, limits Data-In PDUs
+	maxBurst           int
+	firstBurst         int // Limit of immediate data (unsolicited Data-Out is not used, InitialR2T=Yes)
+	immediateData      bool
+}
+
+// defaultSessionParams returns the values of keys that are not negotiated (RFC 3720 12)
+func defaultSessionParams() sessionParams {
+	return sessionParams{
+		maxSendDataSegment: 8192,
+		maxBurst:           256 << 10,
+		firstBurst:         64 << 10,
+		immediateData:      true,
+	}
+}
+
+// negotiate answers an operational key. Declarative keys are not answered.
+func (sp *sessionParams) negotiate(kv keyValue) (string, bool) {
+	switch kv.key {
+	case "HeaderDigest", "DataDigest":
+		if hasValue(kv.value, valueNone) {
+			return valueNone, true
+		}
+		return valueReject, true
+	case "InitialR2T":
+		return valueYes, true
+	case "ImmediateData":
+		switch kv.value {
+		case valueYes:
+			sp.immediateData = true
+		case valueNo:
+			sp.immediateData = false
+		default:
+			return valueReject, true
+		}
+		return kv.value, true
+	case "DataPDUInOrder", "DataSequenceInOrder":
+		return valueYes, true
+	case "IFMarker", "OFMarker":
+		return valueNo, true
+	case "IFMarkInt", "OFMarkInt":
+		return valueIrrelevant, true
+	case "InitiatorAlias":
+		return "", false
+	}
+
+	n, err := numberValue(kv)
+	switch kv.key {
+	case "MaxRecvDataSegmentLength":
+		if err != nil || n < 512 || n >= 1<<24 {
+			return valueReject, true
+		}
+		sp.maxSendDataSegment = int(n)
+		return "", false
+	case "MaxBurstLength":
+		if err != nil || n < 512 || n >= 1<<24 {
+			return valueReject, true
+		}
+		sp.maxBurst = min(int(n), maxBurstLength)
+		return strconv.Itoa(sp.maxBurst), true
+	case "FirstBurstLength":
+		if err != nil || n < 512 || n >= 1<<24 {
+			return valueReject, true
+		}
+		sp.firstBurst = min(int(n), maxFirstBurstLength)
+		return strconv.Itoa(sp.firstBurst), true
+	case "MaxConnections":
+		if err != nil || n < 1 {
+			return valueReject, true
+		}
+		return "1", true
+	case "MaxOutstandingR2T":
+		if err != nil || n < 1 {
+			return valueReject, true
+		}
+		return "1", true
+	case "DefaultTime2Wait":
+		if err != nil || n > 3600 {
+			return valueReject, true
+		}
+		return strconv.FormatUint(max(n, defaultTime2Wait), 10), true
+	case "DefaultTime2Retain", "ErrorRecoveryLevel":
+		if err != nil {
+			return valueReject, true
+		}
+		return "0", true
+	default:
+		return valueNotUnderstood, true
+	}
+}
+
+// chapAuth is the state of the security stage
+type chapAuth struct {
+	credentials CHAP
+	method      string // Negotiated AuthMethod
+	id          byte
+	challenge   []byte
+	done        bool
+}
+
+func (a *chapAuth) required() bool {
+	return a.credentials.User != ""
+}
+
+// handle processes the security keys of a login request. A non-zero status fails the login.
+func (a *chapAuth) handle(kvs keyValues, resp *keyValues) (uint16, error) {
+	if methods, ok := kvs.get("AuthMethod"); ok {
+		switch {
+		case a.required() && hasValue(methods, "CHAP"):
+			a.method = "CHAP"
+		case !a.required() && hasValue(methods, valueNone):
+			a.method = valueNone
+			a.done = true
+		default:
+			resp.add("AuthMethod", valueReject)
+			return loginAuthFailed, fmt.Errorf("no acceptable authentication method in %q", methods)
+		}
+		resp.add("AuthMethod", a.method)
+	}
+
+	if algorithms, ok := kvs.get("CHAP_A"); ok {
+		if a.method != "CHAP" {
+			return loginInitiatorError, fmt.Errorf("CHAP_A without AuthMethod=CHAP")
+		}
+		if !hasValue(algorithms, chapAlgorithmMD5) {
+			resp.add("CHAP_A", valueReject)
+			return loginAuthFailed, fmt.Errorf("no supported CHAP algorithm in %q", algorithms)
+		}
+		var id [1]byte
+		a.challenge = make([]byte, chapChallengeSize)
+		if _, err := rand.Read(id[:]); err != nil {
+			return loginTargetError, err
+		}
+		if _, err := rand.Read(a.challenge); err != nil {
+			return loginTargetError, err
+		}
+		a.id = id[0]
+		resp.add("CHAP_A", chapAlgorithmMD5)
+		resp.add("CHAP_I", strconv.Itoa(int(a.id)))
+		resp.add("CHAP_C", encodeBinary(a.challenge))
+	}
+
+	name, hasName := kvs.get("CHAP_N")
+	response, hasResponse := kvs.get("CHAP_R")
+	if !hasName && !hasResponse {
+		return loginSuccess, nil
+	}
+	if a.challenge == nil || !hasName || !hasResponse {
+		return loginInitiatorError, fmt.Errorf("unexpected CHAP response")
+	}
+	decoded, err := decodeBinary(response)
+	if err != nil {
+		return loginInitiatorError, err
+	}
+	expected := chapResponse(a.id, a.credentials.Secret, a.challenge)
+	if name != a.credentials.User || subtle.ConstantTimeCompare(decoded, expected) != 1 {
+		return loginAuthFailed, fmt.Errorf("CHAP authentication of %q failed", name)
+	}
+	if status, err := a.mutual(kvs, resp); err != nil {
+		return status, err
+	}
+	a.done = true
+	return loginSuccess, nil
+}
+
+// mutual answers the challenge of the initiator, if it requested mutual CHAP
+func (a *chapAuth) mutual(kvs keyValues, resp *keyValues) (uint16, error) {
+	idValue, hasID := kvs.get("CHAP_I")
+	challengeValue, hasChallenge := kvs.get("CHAP_C")
+	if !hasID && !hasChallenge {
+		return loginSuccess, nil
+	}
+	if !hasID || !hasChallenge {
+		return loginInitiatorError, fmt.Errorf("incomplete mutual CHAP challenge")
+	}
+	if a.credentials.MutualUser == "" {
+		return loginAuthFailed, fmt.Errorf("mutual CHAP requested, but not configured")
+	}
+	id, err := strconv.ParseUint(idValue, 0, 8)
+	if err != nil {
+		return loginInitiatorError, fmt.Errorf("invalid CHAP_I %q", idValue)
+	}
+	challenge, err := decodeBinary(challengeValue)
+	if err != nil || len(challenge) == 0 {
+		return loginInitiatorError, fmt.Errorf("invalid CHAP_C %q", challengeValue)
+	}
+	if subtle.ConstantTimeCompare(challenge, a.challenge) == 1 {
+		return loginAuthFailed, fmt.Errorf("initiator reflected the CHAP challenge")
+	}
+	resp.add("CHAP_N", a.credentials.MutualUser)
+	resp.add("CHAP_R", encodeBinary(chapResponse(byte(id), a.credentials.MutualSecret, challenge)))
+	return loginSuccess, nil
+}
+
+// login runs the login phase until the session enters the full feature phase
+func (c *conn) login() error {
+	var (
+		stage      = stageSecurity
+		first      = true
+		keysSeen   bool // The first complete key set (with InitiatorName and SessionType) was processed
+		declared   bool // MaxRecvDataSegmentLength of the target was sent
+		auth       = &chapAuth{credentials: c.target.options.CHAP}
+		continued  []byte
+		targetName string
+	)
+
+	for {
+		req, err := readPDU(c.r, maxTextDataSize)
+		if err != nil {
+			return err
+		}
+		if req.opcode() != OpLogin {
+			return fmt.Errorf("unexpected opcode 0x%02x during login", req.opcode())
+		}
+
+		flags := req.flags()
+		csg := (flags >> 2) & 3
+		nsg := flags & 3
+		transit := flags&flagTransit != 0
+
+		if first {
+			first = false
+			copy(c.isid[:], req.bhs[8:14])
+			c.expCmdSN = req.u32(24)
+			if versionMin := req.bhs[3]; versionMin != 0 {
+				return c.rejectLogin(req, csg, loginUnsupportedVersion, fmt.Sprintf("unsupported version %d", versionMin))
+			}
+			if tsih := binary.BigEndian.Uint16(req.bhs[14:]); tsih != 0 {
+				return c.rejectLogin(req, csg, loginSessionNotFound, fmt.Sprintf("session %d does not exist", tsih))
+			}
+		}
+
+		switch {
+		case csg == stage:
+		case csg == stageOperational && stage == stageSecurity && !auth.required():
+			stage = stageOperational
+		default:
+			return c.rejectLogin(req, csg, loginInitiatorError, fmt.Sprintf("invalid login stage %d", csg))
+		}
+
+		continued = append(continued, req.data...)
+		if len(continued) > maxTextDataSize {
+			return c.rejectLogin(req, csg, loginInitiatorError, "login keys too long")
+		}
+		if flags&flagContinue != 0 {
+			if transit {
+				return c.rejectLogin(req, csg, loginInitiatorError, "transit with continuation")
+			}
+			if err := c.send(c.loginResponse(req, csg, 0, false, nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		kvs, err := parseText(continued)
+		continued = nil
+		if err != nil {
+			return c.rejectLogin(req, csg, loginInitiatorError, err.Error())
+		}
+
+		var resp keyValues
+		var security keyValues
+		for _, kv := range kvs {
+			switch kv.key {
+			case "InitiatorName":
+				c.initiatorName = kv.value
+			case "SessionType":
+				switch kv.value {
+				case "Discovery":
+					c.discovery = true
+				case "Normal":
+					c.discovery = false
+				default:
+					return c.rejectLogin(req, csg, loginUnsupportedSession, fmt.Sprintf("unsupported session type %q", kv.value))
+				}
+			case "TargetName":
+				targetName = kv.value
+			case "AuthMethod", "CHAP_A", "CHAP_I", "CHAP_C", "CHAP_N", "CHAP_R":
+				if stage != stageSecurity {
+					return c.rejectLogin(req, csg, loginInitiatorError, kv.key+" outside the security stage")
+				}
+				security = append(security, kv)
+			default:
+				if value, ok := c.params.negotiate(kv); ok {
+					resp.add(kv.key, value)
+				}
+			}
+		}
+
+		if !keysSeen {
+			keysSeen = true
+			if c.initiatorName == "" {
+				return c.rejectLogin(req, csg, loginMissingParameter, "InitiatorName missing")
+			}
+			if !c.discovery {
+				if targetName == "" {
+					return c.rejectLogin(req, csg, loginMissingParameter, "TargetName missing")
+				}
+				if targetName != c.target.options.TargetName {
+					return c.rejectLogin(req, csg, loginNotFound, fmt.Sprintf("unknown target %q", targetName))
+				}
+				resp.add("TargetPortalGroupTag", "1")
+			}
+		}
+
+		if stage == stageSecurity {
+			status, err := auth.handle(security, &resp)
+			if err != nil {
+				return c.rejectLogin(req, csg, status, err.Error())
+			}
+			if transit && !auth.done {
+				if auth.method != "" {
+					transit = false // CHAP exchange in progress
+				} else if auth.required() {
+					return c.rejectLogin(req, csg, loginAuthFailed, "authentication required")
+				}
+			}
+		}
+		if stage == stageOperational && !declared {
+			declared = true
+			resp.add("MaxRecvDataSegmentLength", strconv.Itoa(maxRecvDataSegmentLength))
+		}
+
+		if transit && (nsg <= stage || nsg == 2) {
+			return c.rejectLogin(req, csg, loginInitiatorError, fmt.Sprintf("invalid transit from stage %d to %d", csg, nsg))
+		}
+		if transit && nsg == stageFullFeature {
+			c.params.firstBurst = min(c.params.firstBurst, c.params.maxBurst)
+			c.tsih = c.target.newTSIH()
+		}
+		if err := c.send(c.loginResponse(req, csg, nsg, transit, resp)); err != nil {
+			return err
+		}
+		if transit {
+			if nsg == stageFullFeature {
+				return nil
+			}
+			stage = nsg
+		}
+	}
+}
+
+// loginResponse builds the response to a login request with status success
+func (c *conn) loginResponse(req *pdu, csg uint8, nsg uint8, transit bool, kvs keyValues) *pdu {
+	flags := csg << 2
+	if transit {
+		flags |= flagTransit | nsg
+	}
+	resp := newPDU(OpLoginResp, flags)
+	copy(resp.bhs[8:14], c.isid[:])
+	binary.BigEndian.PutUint16(resp.bhs[14:], c.tsih)
+	resp.setU32(16, req.itt())
+	resp.data = kvs.encode()
+	return resp
+}
+
+// rejectLogin sends a login response with an error status and returns the reason as error
+func (c *conn) rejectLogin(req *pdu, csg uint8, status uint16, message string) error {
+	resp := c.loginResponse(req, csg, 0, false, nil)
+	binary.BigEndian.PutUint16(resp.bhs[36:], status)
+	if err := c.send(resp); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s (status 0x%04x)", errLoginRejected, message, status)
+}
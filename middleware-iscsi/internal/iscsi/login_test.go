@@ -0,0 +1,107 @@
+package iscsi
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		key      string
+		value    string
+		answer   string // Empty for declarative keys that are not answered
+		expected sessionParams
+	}{
+		{key: "HeaderDigest", value: "CRC32C,None", answer: valueNone},
+		{key: "DataDigest", value: "CRC32C", answer: valueReject},
+		{key: "InitialR2T", value: valueNo, answer: valueYes},
+		{key: "ImmediateData", value: valueNo, answer: valueNo, expected: sessionParams{immediateData: false}},
+		{key: "ImmediateData", value: "Maybe", answer: valueReject},
+		{key: "DataPDUInOrder", value: valueNo, answer: valueYes},
+		{key: "IFMarker", value: valueYes, answer: valueNo},
+		{key: "OFMarkInt", value: "2048~8192", answer: valueIrrelevant},
+		{key: "InitiatorAlias", value: "host"},
+		{key: "MaxRecvDataSegmentLength", value: "65536", expected: sessionParams{maxSendDataSegment: 65536}},
+		{key: "MaxRecvDataSegmentLength", value: "0x200", expected: sessionParams{maxSendDataSegment: 512}},
+		{key: "MaxRecvDataSegmentLength", value: "511", answer: valueReject},
+		{key: "MaxRecvDataSegmentLength", value: "16777216", answer: valueReject},
+		{key: "MaxRecvDataSegmentLength", value: "many", answer: valueReject},
+		{key: "MaxBurstLength", value: "16776192", answer: "1048576", expected: sessionParams{maxBurst: maxBurstLength}},
+		{key: "MaxBurstLength", value: "4096", answer: "4096", expected: sessionParams{maxBurst: 4096}},
+		{key: "FirstBurstLength", value: "16776192", answer: "262144", expected: sessionParams{firstBurst: maxFirstBurstLength}},
+		{key: "FirstBurstLength", value: "100", answer: valueReject},
+		{key: "MaxConnections", value: "8", answer: "1"},
+		{key: "MaxConnections", value: "0", answer: valueReject},
+		{key: "MaxOutstandingR2T", value: "4", answer: "1"},
+		{key: "DefaultTime2Wait", value: "0", answer: "2"},
+		{key: "DefaultTime2Wait", value: "20", answer: "20"},
+		{key: "DefaultTime2Wait", value: "3601", answer: valueReject},
+		{key: "DefaultTime2Retain", value: "20", answer: "0"},
+		{key: "ErrorRecoveryLevel", value: "2", answer: "0"},
+		{key: "ErrorRecoveryLevel", value: "-1", answer: valueReject},
+		{key: "X-com.example.key", value: "1", answer: valueNotUnderstood},
+	}
+	for _, test := range tests {
+		t.Run(test.key+"="+test.value, func(t *testing.T) {
+			params := defaultSessionParams()
+			answer, answered := params.negotiate(keyValue{key: test.key, value: test.value})
+			if answer != test.answer || answered != (test.answer != "") {
+				t.Fatalf("answer %q (answered %t), want %q", answer, answered, test.answer)
+			}
+
+			// Only the expected parameter changes from the defaults
+			want := defaultSessionParams()
+			switch {
+			case test.expected.maxSendDataSegment != 0:
+				want.maxSendDataSegment = test.expected.maxSendDataSegment
+			case test.expected.maxBurst != 0:
+				want.maxBurst = test.expected.maxBurst
+			case test.expected.firstBurst != 0:
+				want.firstBurst = test.expected.firstBurst
+			case test.key == "ImmediateData" && answer != valueReject:
+				want.immediateData = test.expected.immediateData
+			}
+			if params != want {
+				t.Fatalf("parameters %+v, want %+v", params, want)
+			}
+		})
+	}
+}
+
+func TestCHAPAuthMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool
+		methods  string
+		method   string
+		done     bool
+		status   uint16
+	}{
+		{name: "none", methods: "None", method: valueNone, done: true},
+		{name: "none preferred over CHAP", methods: "CHAP,None", method: valueNone, done: true},
+		{name: "only CHAP offered", methods: "CHAP", status: loginAuthFailed},
+		{name: "CHAP required", required: true, methods: "None,CHAP", method: "CHAP"},
+		{name: "CHAP required, not offered", required: true, methods: "None,SRP", status: loginAuthFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := &chapAuth{}
+			if test.required {
+				auth.credentials = CHAP{User: "user", Secret: "user-secret-12"}
+			}
+			var resp keyValues
+			status, err := auth.handle(keyValues{{key: "AuthMethod", value: test.methods}}, &resp)
+			if status != test.status || (err != nil) != (test.status != loginSuccess) {
+				t.Fatalf("status 0x%04x (%v), want 0x%04x", status, err, test.status)
+			}
+			if test.status != loginSuccess {
+				if method, _ := resp.get("AuthMethod"); method != valueReject {
+					t.Fatalf("AuthMethod %q in the response, want %q", method, valueReject)
+				}
+				return
+			}
+			if method, _ := resp.get("AuthMethod"); auth.method != test.method || method != test.method || auth.done != test.done {
+				t.Fatalf("method %q (response %q), done %t", auth.method, method, auth.done)
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"quorumbd.net/common/version"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// SCSI operation codes
+const (
+	opTestUnitReady      uint8 = 0x00
+	opRequestSense       uint8 = 0x03
+	opRead6              uint8 = 0x08
+	opWrite6             uint8 = 0x0a
+	opInquiry            uint8 = 0x12
+	opModeSense6         uint8 = 0x1a
+	opStartStopUnit      uint8 = 0x1b
+	opReadCapacity10     uint8 = 0x25
+	opRead10             uint8 = 0x28
+	opWrite10            uint8 = 0x2a
+	opSynchronizeCache10 uint8 = 0x35
+	opUnmap              uint8 = 0x42
+	opModeSense10        uint8 = 0x5a
+	opRead16             uint8 = 0x88
+	opWrite16            uint8 = 0x8a
+	opSynchronizeCache16 uint8 = 0x91
+	opServiceActionIn16  uint8 = 0x9e
+	opReportLUNs         uint8 = 0xa0
+	saReadCapacity16     uint8 = 0x10
+)
+
+// SCSI status, sense keys and additional sense codes
+const (
+	statusGood                  uint8 = 0x00
+	statusCheckCondition        uint8 = 0x02
+	senseNoSense                uint8 = 0x00
+	senseNotReady               uint8 = 0x02
+	senseMediumError            uint8 = 0x03
+	senseIllegalRequest         uint8 = 0x05
+	senseUnitAttention          uint8 = 0x06
+	senseDataProtect            uint8 = 0x07
+	ascNotReady                 uint8 = 0x04
+	ascWriteError               uint8 = 0x0c
+	ascUnrecoveredReadError     uint8 = 0x11
+	ascParameterListLength      uint8 = 0x1a
+	ascInvalidOpcode            uint8 = 0x20
+	ascLBAOutOfRange            uint8 = 0x21
+	ascInvalidFieldInCDB        uint8 = 0x24
+	ascLUNNotSupported          uint8 = 0x25
+	ascInvalidFieldInParameters uint8 = 0x26
+	ascWriteProtected           uint8 = 0x27
+	ascqSpaceAllocationFailed   uint8 = 0x07
+	ascReportedLUNsDataChanged  uint8 = 0x3f
+	ascqReportedLUNsDataChanged uint8 = 0x0e
+	peripheralDirectAccess      uint8 = 0x00
+	peripheralNotConnected      uint8 = 0x7f // Qualifier 3, type 0x1f: no logical unit
+	logicalBlockSize                  = 512
+	maxUnmapBlocks                    = 1 << 22 // Blocks of an UNMAP command
+	maxUnmapDescriptors               = 256
+	unmapDescriptorSize               = 16
+	vendorID                          = "QUORUMBD"
+	productID                         = "QuorumBD volume"
+)
+
+// result is the outcome of a SCSI command
+type result struct {
+	status uint8
+	sense  []byte // Fixed format sense data with check condition
+	data   []byte // Data-In
+	used   int    // Bytes of Data-Out used by the command
+}
+
+func good(data []byte) *result {
+	return &result{status: statusGood, data: data}
+}
+
+func checkCondition(key uint8, asc uint8, ascq uint8) *result {
+	return &result{status: statusCheckCondition, sense: senseData(key, asc, ascq)}
+}
+
+// senseData returns fixed format sense data
+func senseData(key uint8, asc uint8, ascq uint8) []byte {
+	sense := make([]byte, 18)
+	sense[0] = 0x70 // Current error
+	sense[2] = key
+	sense[7] = 10 // Additional sense length
+	sense[12] = asc
+	sense[13] = ascq
+	return sense
+}
+
+// truncate limits data to the allocation length of a command
+func truncate(data []byte, allocationLength int) []byte {
+	return data[:min(len(data), allocationLength)]
+}
+
+// runCommand executes the CDB of a task. INQUIRY, REQUEST SENSE and REPORT LUNS work without a mapped LUN.
+func (c *conn) runCommand(ctx context.Context, t *task) *result {
+	cdb := t.cdb[:]
+	var lu *logicalUnit
+	if number, ok := decodeLUN(t.lun[:]); ok {
+		lu = c.target.acquireLUN(number)
+	}
+	if lu != nil {
+		defer lu.inFlight.Done()
+	}
+
+	switch cdb[0] {
+	case opInquiry:
+		return inquiry(lu, cdb)
+	case opRequestSense:
+		return requestSense(lu, cdb)
+	case opReportLUNs:
+		return c.reportLUNs(cdb)
+	}
+	if lu == nil {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported, 0)
+	}
+	if c.lunsChanged() {
+		return checkCondition(senseUnitAttention, ascReportedLUNsDataChanged, ascqReportedLUNsDataChanged)
+	}
+
+	be := binary.BigEndian
+	switch cdb[0] {
+	case opTestUnitReady, opStartStopUnit:
+		return good(nil)
+	case opReadCapacity10:
+		return readCapacity10(lu)
+	case opServiceActionIn16:
+		if cdb[1]&0x1f != saReadCapacity16 {
+			return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+		}
+		return readCapacity16(lu, cdb)
+	case opModeSense6:
+		return modeSense(lu, cdb, false)
+	case opModeSense10:
+		return modeSense(lu, cdb, true)
+	case opRead6:
+		return c.read(ctx, lu, uint64(be.Uint32(cdb[0:4])&0x1fffff), sixByteLength(cdb[4]))
+	case opRead10:
+		return c.read(ctx, lu, uint64(be.Uint32(cdb[2:6])), uint32(be.Uint16(cdb[7:9])))
+	case opRead16:
+		return c.read(ctx, lu, be.Uint64(cdb[2:10]), be.Uint32(cdb[10:14]))
+	case opWrite6:
+		return c.write(ctx, lu, t, uint64(be.Uint32(cdb[0:4])&0x1fffff), sixByteLength(cdb[4]), false)
+	case opWrite10:
+		return c.write(ctx, lu, t, uint64(be.Uint32(cdb[2:6])), uint32(be.Uint16(cdb[7:9])), cdb[1]&0x08 != 0)
+	case opWrite16:
+		return c.write(ctx, lu, t, be.Uint64(cdb[2:10]), be.Uint32(cdb[10:14]), cdb[1]&0x08 != 0)
+	case opSynchronizeCache10, opSynchronizeCache16:
+		return c.backendResult(lu.Backend.Flush(ctx), true)
+	case opUnmap:
+		return c.unmap(ctx, lu, t, int(be.Uint16(cdb[7:9])))
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidOpcode, 0)
+	}
+}
+
+// lunsChanged returns true once per change of the LUNs (reported as unit attention)
+func (c *conn) lunsChanged() bool {
+	current := c.target.lunsEpoch.Load()
+	seen := c.lunsEpoch.Load()
+	return seen != current && c.lunsEpoch.CompareAndSwap(seen, current)
+}
+
+// sixByteLength returns the transfer length of 6 byte CDBs (0 means 256 blocks)
+func sixByteLength(length uint8) uint32 {
+	if length == 0 {
+		return 256
+	}
+	return uint32(length)
+}
+
+// checkBlocks validates a range of logical blocks
+func checkBlocks(lu *logicalUnit, lba uint64, blocks uint32) *result {
+	total := uint64(lu.Backend.Size()) / logicalBlockSize
+	if lba > total || uint64(blocks) > total-lba {
+		return checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+	}
+	if uint64(blocks)*logicalBlockSize > maxTransferLength {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+	return nil
+}
+
+func (c *conn) read(ctx context.Context, lu *logicalUnit, lba uint64, blocks uint32) *result {
+	if res := checkBlocks(lu, lba, blocks); res != nil {
+		return res
+	}
+	data := make([]byte, int(blocks)*logicalBlockSize)
+	if len(data) == 0 {
+		return good(nil)
+	}
+	if err := lu.Backend.ReadAt(ctx, data, int64(lba)*logicalBlockSize); err != nil {
+		return c.backendResult(err, false)
+	}
+	c.bytesRead.Add(uint64(len(data)))
+	return good(data)
+}
+
+func (c *conn) write(ctx context.Context, lu *logicalUnit, t *task, lba uint64, blocks uint32, fua bool) *result {
+	if lu.ReadOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected, 0)
+	}
+	if res := checkBlocks(lu, lba, blocks); res != nil {
+		return res
+	}
+	length := int(blocks) * logicalBlockSize
+	if length > len(t.data) {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+	if length == 0 {
+		return good(nil)
+	}
+	var flags backend.Flags
+	if fua {
+		flags |= backend.FlagFUA
+	}
+	if err := lu.Backend.WriteAt(ctx, t.data[:length], int64(lba)*logicalBlockSize, flags); err != nil {
+		return c.backendResult(err, true)
+	}
+	c.bytesWritten.Add(uint64(length))
+	return &result{status: statusGood, used: length}
+}
+
+// unmap trims the block descriptors of the parameter list
+func (c *conn) unmap(ctx context.Context, lu *logicalUnit, t *task, parameterLength int) *result {
+	if lu.ReadOnly {
+		return checkCondition(senseDataProtect, ascWriteProtected, 0)
+	}
+	if parameterLength == 0 {
+		return good(nil)
+	}
+	if parameterLength < 8 || parameterLength > len(t.data) {
+		return checkCondition(senseIllegalRequest, ascParameterListLength, 0)
+	}
+	params := t.data[:parameterLength]
+	descriptorLength := int(binary.BigEndian.Uint16(params[2:4]))
+	if descriptorLength%unmapDescriptorSize != 0 || 8+descriptorLength > len(params) {
+		return checkCondition(senseIllegalRequest, ascParameterListLength, 0)
+	}
+	if descriptorLength/unmapDescriptorSize > maxUnmapDescriptors {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInParameters, 0)
+	}
+
+	total := uint64(lu.Backend.Size()) / logicalBlockSize
+	var blocksSum uint64
+	for off := 8; off < 8+descriptorLength; off += unmapDescriptorSize {
+		lba := binary.BigEndian.Uint64(params[off:])
+		blocks := uint64(binary.BigEndian.Uint32(params[off+8:]))
+		if lba > total || blocks > total-lba {
+			return checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+		}
+		if blocksSum += blocks; blocksSum > maxUnmapBlocks {
+			return checkCondition(senseIllegalRequest, ascInvalidFieldInParameters, 0)
+		}
+	}
+	for off := 8; off < 8+descriptorLength; off += unmapDescriptorSize {
+		lba := binary.BigEndian.Uint64(params[off:])
+		blocks := int64(binary.BigEndian.Uint32(params[off+8:]))
+		if blocks == 0 {
+			continue
+		}
+		if err := lu.Backend.Trim(ctx, int64(lba)*logicalBlockSize, blocks*logicalBlockSize, 0); err != nil {
+			return c.backendResult(err, true)
+		}
+	}
+	return &result{status: statusGood, used: parameterLength}
+}
+
+// backendResult maps a backend error to sense data
+func (c *conn) backendResult(err error, write bool) *result {
+	switch {
+	case err == nil:
+		return good(nil)
+	case errors.Is(err, backend.ErrReadOnly):
+		return checkCondition(senseDataProtect, ascWriteProtected, 0)
+	case errors.Is(err, backend.ErrNoSpace):
+		return checkCondition(senseDataProtect, ascWriteProtected, ascqSpaceAllocationFailed)
+	case errors.Is(err, backend.ErrOutOfRange):
+		return checkCondition(senseIllegalRequest, ascLBAOutOfRange, 0)
+	case errors.Is(err, backend.ErrInvalid):
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	case errors.Is(err, backend.ErrNotSupported):
+		return checkCondition(senseIllegalRequest, ascInvalidOpcode, 0)
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		c.logger.Warn("Command failed", "error", err)
+	}
+	switch {
+	case errors.Is(err, backend.ErrNoDataPath):
+		return checkCondition(senseNotReady, ascNotReady, 0)
+	case write:
+		return checkCondition(senseMediumError, ascWriteError, 0)
+	default:
+		return checkCondition(senseMediumError, ascUnrecoveredReadError, 0)
+	}
+}
+
+// serialNumber returns the unit serial number of a logical unit
+func serialNumber(lu *logicalUnit) string {
+	if lu.VolumeID != "" {
+		return lu.VolumeID
+	}
+	return lu.Export
+}
+
+// physicalBlockExponent returns the logical blocks per physical block as power of two
+func physicalBlockExponent(lu *logicalUnit) uint8 {
+	if lu.BlockSize <= logicalBlockSize || lu.BlockSize&(lu.BlockSize-1) != 0 {
+		return 0
+	}
+	return uint8(bits.TrailingZeros32(lu.BlockSize / logicalBlockSize))
+}
+
+func inquiry(lu *logicalUnit, cdb []byte) *result {
+	allocationLength := int(binary.BigEndian.Uint16(cdb[3:5]))
+	evpd := cdb[1]&0x01 != 0
+	if !evpd {
+		if cdb[2] != 0 {
+			return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+		}
+		return good(truncate(standardInquiry(lu), allocationLength))
+	}
+	if lu == nil {
+		return checkCondition(senseIllegalRequest, ascLUNNotSupported, 0)
+	}
+
+	var page []byte
+	switch cdb[2] {
+	case 0x00: // Supported VPD pages
+		page = []byte{0x00, 0x80, 0x83, 0xb0, 0xb1, 0xb2}
+	case 0x80: // Unit serial number
+		page = []byte(serialNumber(lu))
+	case 0x83: // Device identification
+		page = deviceIdentification(lu)
+	case 0xb0: // Block limits
+		page = blockLimits(lu)
+	case 0xb1: // Block device characteristics
+		page = make([]byte, 0x3c)
+		page[1] = 0x01 // Non-rotating medium
+	case 0xb2: // Logical block provisioning
+		page = []byte{0x00, 0x80 | 0x04, 0x02, 0x00} // LBPU and LBPRZ, thin provisioned
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+
+	data := make([]byte, 4+len(page))
+	data[0] = peripheralDirectAccess
+	data[1] = cdb[2]
+	binary.BigEndian.PutUint16(data[2:], uint16(len(page)))
+	copy(data[4:], page)
+	return good(truncate(data, allocationLength))
+}
+
+func standardInquiry(lu *logicalUnit) []byte {
+	data := make([]byte, 36)
+	data[0] = peripheralDirectAccess
+	if lu == nil {
+		data[0] = peripheralNotConnected
+	}
+	data[2] = 0x06        // SPC-4
+	data[3] = 0x10 | 0x02 // HiSup, response data format 2
+	data[4] = byte(len(data) - 5)
+	data[7] = 0x02 // CmdQue
+	copy(data[8:16], padded(vendorID, 8))
+	copy(data[16:32], padded(productID, 16))
+	copy(data[32:36], padded(version.Version, 4))
+	return data
+}
+
+// padded returns s truncated or padded with spaces to n bytes (ASCII fields of SCSI data)
+func padded(s string, n int) []byte {
+	field := bytes.Repeat([]byte{' '}, n)
+	copy(field, s)
+	return field
+}
+
+// deviceIdentification returns the designators of page 0x83: a locally assigned NAA derived from the serial number
+// and a T10 vendor identification
+func deviceIdentification(lu *logicalUnit) []byte {
+	serial := serialNumber(lu)
+	sum := sha256.Sum256([]byte(serial))
+	naa := sum[:8]
+	naa[0] = 0x30 | naa[0]&0x0f // NAA 3: locally assigned
+
+	page := []byte{0x01, 0x03, 0x00, byte(len(naa))} // Binary, LU association, NAA
+	page = append(page, naa...)
+	t10 := append(padded(vendorID, 8), serial...)
+	page = append(page, 0x02, 0x01, 0x00, byte(len(t10))) // ASCII, LU association, T10 vendor ID
+	return append(page, t10...)
+}
+
+func blockLimits(lu *logicalUnit) []byte {
+	page := make([]byte, 0x3c)
+	granularity := uint32(1) << physicalBlockExponent(lu)
+	binary.BigEndian.PutUint16(page[2:], uint16(granularity))                // Optimal transfer length granularity
+	binary.BigEndian.PutUint32(page[4:], maxTransferLength/logicalBlockSize) // Maximum transfer length
+	binary.BigEndian.PutUint32(page[8:], maxTransferLength/logicalBlockSize) // Optimal transfer length
+	binary.BigEndian.PutUint32(page[16:], maxUnmapBlocks)                    // Maximum unmap LBA count
+	binary.BigEndian.PutUint32(page[20:], maxUnmapDescriptors)               // Maximum unmap block descriptor count
+	binary.BigEndian.PutUint32(page[24:], granularity)                       // Optimal unmap granularity
+	binary.BigEndian.PutUint32(page[28:], 0x80000000)                        // Unmap granularity alignment 0 (valid)
+	return page
+}
+
+func requestSense(lu *logicalUnit, cdb []byte) *result {
+	if cdb[1]&0x01 != 0 { // Descriptor format
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+	sense := senseData(senseNoSense, 0, 0)
+	if lu == nil {
+		sense = senseData(senseIllegalRequest, ascLUNNotSupported, 0)
+	}
+	return good(truncate(sense, int(cdb[4])))
+}
+
+// reportLUNs lists the mapped LUNs
+func (c *conn) reportLUNs(cdb []byte) *result {
+	allocationLength := int(binary.BigEndian.Uint32(cdb[6:10]))
+	if allocationLength < 16 {
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+	c.lunsEpoch.Store(c.target.lunsEpoch.Load()) // The initiator learns the current LUNs
+
+	luns := c.target.LUNs()
+	data := make([]byte, 8, 8+8*len(luns))
+	binary.BigEndian.PutUint32(data, uint32(8*len(luns)))
+	for _, number := range luns {
+		lun := encodeLUN(number)
+		data = append(data, lun[:]...)
+	}
+	return good(truncate(data, allocationLength))
+}
+
+func lastLBA(lu *logicalUnit) uint64 {
+	blocks := uint64(lu.Backend.Size()) / logicalBlockSize
+	if blocks == 0 {
+		return 0
+	}
+	return blocks - 1
+}
+
+func readCapacity10(lu *logicalUnit) *result {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(min(lastLBA(lu), 0xffffffff))) // 0xffffffff: use READ CAPACITY (16)
+	binary.BigEndian.PutUint32(data[4:], logicalBlockSize)
+	return good(data)
+}
+
+func readCapacity16(lu *logicalUnit, cdb []byte) *result {
+	data := make([]byte, 32)
+	binary.BigEndian.PutUint64(data, lastLBA(lu))
+	binary.BigEndian.PutUint32(data[8:], logicalBlockSize)
+	data[13] = physicalBlockExponent(lu)
+	data[14] = 0x80 | 0x40 // LBPME and LBPRZ
+	return good(truncate(data, int(binary.BigEndian.Uint32(cdb[10:14]))))
+}
+
+// modeSense returns the caching and control mode pages. The write cache is reported as enabled, so that
+// initiators send SYNCHRONIZE CACHE.
+func modeSense(lu *logicalUnit, cdb []byte, ten bool) *result {
+	pageControl := cdb[2] >> 6
+	pageCode := cdb[2] & 0x3f
+	changeable := pageControl == 1
+	if pageControl == 3 { // Saved values are not supported
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+
+	caching := make([]byte, 20)
+	caching[0], caching[1] = 0x08, 0x12
+	control := make([]byte, 12)
+	control[0], control[1] = 0x0a, 0x0a
+	if !changeable {
+		caching[2] = 0x04 // WCE
+		control[3] = 0x10 // Unrestricted reordering of commands
+	}
+
+	var pages []byte
+	switch pageCode {
+	case 0x08:
+		pages = caching
+	case 0x0a:
+		pages = control
+	case 0x3f:
+		pages = append(caching, control...)
+	default:
+		return checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0)
+	}
+
+	deviceSpecific := uint8(0x10) // DPOFUA
+	if lu.ReadOnly {
+		deviceSpecific |= 0x80 // WP
+	}
+	if !ten {
+		header := []byte{byte(3 + len(pages)), 0, deviceSpecific, 0}
+		return good(truncate(append(header, pages...), int(cdb[4])))
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header, uint16(6+len(pages)))
+	header[3] = deviceSpecific
+	return good(truncate(append(header, pages...), int(binary.BigEndian.Uint16(cdb[7:9]))))
+}
@@ -0,0 +1,487 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Task management functions and responses
+const (
+	tmfAbortTask    uint8 = 1
+	tmfAbortTaskSet uint8 = 2
+	tmfClearTaskSet uint8 = 3
+	tmfLUNReset     uint8 = 5
+	tmfComplete     uint8 = 0
+	tmfTaskNotFound uint8 = 1
+	tmfLUNNotFound  uint8 = 2
+	tmfNotSupported uint8 = 5
+)
+
+// Logout reasons and responses
+const (
+	logoutCloseSession    uint8 = 0
+	logoutCloseConnection uint8 = 1
+	logoutSuccess         uint8 = 0
+	logoutNoRecovery      uint8 = 2
+)
+
+// maxTransferLength limits the data of a single SCSI command (reported as maximum transfer length)
+const maxTransferLength = 8 << 20
+
+// task is a SCSI command of the session
+type task struct {
+	itt      uint32
+	ttt      uint32 // Target transfer tag of the outstanding R2T
+	lun      [8]byte
+	cdb      [16]byte
+	read     bool
+	write    bool
+	edtl     uint32 // Expected data transfer length
+	data     []byte // Data-Out of writes
+	received int
+	burstEnd int // End of the data requested by the outstanding R2T
+	r2tSN    uint32
+	counted  bool          // The command occupies the command window
+	done     chan struct{} // Closed when the task completed (not for tasks that were aborted while waiting for data)
+}
+
+// session is the full feature phase of a connection
+type session struct {
+	c        *conn
+	ctx      context.Context
+	wg       sync.WaitGroup
+	tasksMu  sync.Mutex
+	tasks    map[uint32]*task // By ITT, executing or waiting for data
+	pending  map[uint32]*task // By TTT, waiting for data (only used by the reader)
+	nextTTT  uint32
+	failOnce sync.Once
+	failErr  error
+	cancel   context.CancelFunc
+}
+
+// fullFeature reads the commands of the initiator until it logs out or the connection fails.
+// SCSI commands are executed concurrently and completed as they finish.
+func (c *conn) fullFeature(parentCtx context.Context) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	s := &session{
+		c:       c,
+		ctx:     ctx,
+		tasks:   make(map[uint32]*task),
+		pending: make(map[uint32]*task),
+		cancel:  cancel,
+	}
+
+	err := s.run()
+	s.wg.Wait()
+	if s.failErr != nil {
+		return s.failErr
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *session) run() error {
+	for {
+		req, err := readPDU(s.c.r, maxRecvDataSegmentLength)
+		if err != nil {
+			return err
+		}
+		done, err := s.handle(req)
+		if perr, ok := errors.AsType[*protocolError](err); ok {
+			if rejectErr := s.reject(req, perr.reason); rejectErr != nil {
+				return rejectErr
+			}
+			return fmt.Errorf("protocol error: %w", err)
+		}
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// fail closes the connection after a failed response
+func (s *session) fail(err error) {
+	s.failOnce.Do(func() {
+		s.failErr = err
+		s.cancel()
+		s.c.close() // Unblocks the reader
+	})
+}
+
+func (s *session) handle(req *pdu) (bool, error) {
+	switch req.opcode() {
+	case OpNOPOut:
+		return false, s.handleNOPOut(req)
+	case OpText:
+		return false, s.handleText(req)
+	case OpLogout:
+		return s.handleLogout(req)
+	case OpSNACK:
+		return false, s.reject(req, rejectCommandNotSupported)
+	}
+
+	if s.c.discovery {
+		return false, &protocolError{reason: rejectProtocolError, message: fmt.Sprintf("opcode 0x%02x in discovery session", req.opcode())}
+	}
+	switch req.opcode() {
+	case OpSCSICommand:
+		return false, s.handleCommand(req)
+	case OpDataOut:
+		return false, s.handleDataOut(req)
+	case OpTaskMgmt:
+		return false, s.handleTaskMgmt(req)
+	default:
+		return false, &protocolError{reason: rejectCommandNotSupported, message: fmt.Sprintf("unsupported opcode 0x%02x", req.opcode())}
+	}
+}
+
+// reject returns the header of a PDU to the initiator
+func (s *session) reject(req *pdu, reason uint8) error {
+	resp := newPDU(OpReject, flagFinal)
+	resp.bhs[2] = reason
+	resp.setU32(16, reservedTag)
+	resp.data = bytes.Clone(req.bhs[:])
+	return s.c.send(resp)
+}
+
+func (s *session) handleNOPOut(req *pdu) error {
+	if _, err := s.c.acceptCmdSN(req, false); err != nil {
+		return err
+	}
+	if req.itt() == reservedTag {
+		return nil // Response to a NOP-In of the target
+	}
+	resp := newPDU(OpNOPIn, flagFinal)
+	copy(resp.bhs[8:16], req.lun())
+	resp.setU32(16, req.itt())
+	resp.setU32(20, reservedTag)
+	resp.data = req.data
+	return s.c.send(resp)
+}
+
+// handleText answers SendTargets with the target name and the portal of the connection
+func (s *session) handleText(req *pdu) error {
+	if _, err := s.c.acceptCmdSN(req, false); err != nil {
+		return err
+	}
+	if req.flags()&flagContinue != 0 || req.u32(20) != reservedTag {
+		return &protocolError{reason: rejectCommandNotSupported, message: "text continuation is not supported"}
+	}
+	kvs, err := parseText(req.data)
+	if err != nil {
+		return &protocolError{reason: rejectInvalidPDUField, message: err.Error()}
+	}
+
+	var resp keyValues
+	for _, kv := range kvs {
+		if kv.key != "SendTargets" {
+			resp.add(kv.key, valueNotUnderstood)
+			continue
+		}
+		targetName := s.c.target.options.TargetName
+		if (kv.value == "All" && s.c.discovery) || kv.value == targetName || (kv.value == "" && !s.c.discovery) {
+			resp.add("TargetName", targetName)
+			if addr, ok := s.c.netConn.LocalAddr().(*net.TCPAddr); ok {
+				resp.add("TargetAddress", net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))+",1")
+			}
+		}
+	}
+
+	textResp := newPDU(OpTextResp, flagFinal)
+	copy(textResp.bhs[8:16], req.lun())
+	textResp.setU32(16, req.itt())
+	textResp.setU32(20, reservedTag)
+	textResp.data = resp.encode()
+	return s.c.send(textResp)
+}
+
+// handleLogout completes the outstanding commands and confirms the logout. Commands waiting for data are dropped.
+func (s *session) handleLogout(req *pdu) (bool, error) {
+	if _, err := s.c.acceptCmdSN(req, false); err != nil {
+		return false, err
+	}
+	resp := newPDU(OpLogoutResp, flagFinal)
+	resp.setU32(16, req.itt())
+
+	reason := req.flags() &^ flagFinal
+	if reason != logoutCloseSession && reason != logoutCloseConnection {
+		resp.bhs[2] = logoutNoRecovery
+		return false, s.c.send(resp)
+	}
+
+	released := 0
+	for ttt, t := range s.pending {
+		delete(s.pending, ttt)
+		s.removeTask(t)
+		if t.counted {
+			released++
+		}
+	}
+	s.wg.Wait()
+	resp.bhs[2] = logoutSuccess
+	if err := s.c.complete(released, resp); err != nil {
+		return false, err
+	}
+	s.c.logger.Info("Session logged out")
+	return true, nil
+}
+
+func (s *session) handleCommand(req *pdu) error {
+	counted, err := s.c.acceptCmdSN(req, true)
+	if err != nil {
+		return err
+	}
+
+	t := &task{
+		itt:     req.itt(),
+		read:    req.flags()&flagRead != 0,
+		write:   req.flags()&flagWrite != 0,
+		edtl:    req.u32(20),
+		counted: counted,
+		done:    make(chan struct{}),
+	}
+	copy(t.lun[:], req.lun())
+	copy(t.cdb[:], req.bhs[32:48])
+
+	if len(req.data) > 0 && (!t.write || !s.c.params.immediateData || len(req.data) > int(t.edtl) || len(req.data) > s.c.params.firstBurst) {
+		return &protocolError{reason: rejectProtocolError, message: "unexpected immediate data"}
+	}
+	if (t.read && t.write) || t.edtl > maxTransferLength {
+		// Bidirectional commands are not supported and oversized commands are failed before their data is requested
+		return s.complete(t, checkCondition(senseIllegalRequest, ascInvalidFieldInCDB, 0))
+	}
+
+	s.tasksMu.Lock()
+	if _, ok := s.tasks[t.itt]; ok {
+		s.tasksMu.Unlock()
+		return &protocolError{reason: rejectInvalidPDUField, message: fmt.Sprintf("task tag 0x%x is in use", t.itt)}
+	}
+	s.tasks[t.itt] = t
+	s.tasksMu.Unlock()
+
+	if t.write {
+		t.data = make([]byte, t.edtl)
+		t.received = copy(t.data, req.data)
+		if t.received < len(t.data) {
+			return s.requestData(t)
+		}
+	}
+	s.execute(t)
+	return nil
+}
+
+// requestData sends an R2T for the next burst of a write
+func (s *session) requestData(t *task) error {
+	s.nextTTT++
+	if s.nextTTT == reservedTag {
+		s.nextTTT = 0
+	}
+	t.ttt = s.nextTTT
+	s.pending[t.ttt] = t
+
+	length := min(len(t.data)-t.received, s.c.params.maxBurst)
+	t.burstEnd = t.received + length
+
+	r2t := newPDU(OpR2T, flagFinal)
+	copy(r2t.bhs[8:16], t.lun[:])
+	r2t.setU32(16, t.itt)
+	r2t.setU32(20, t.ttt)
+	r2t.setU32(36, t.r2tSN)
+	r2t.setU32(40, uint32(t.received))
+	r2t.setU32(44, uint32(length))
+	t.r2tSN++
+	return s.c.send(r2t)
+}
+
+func (s *session) handleDataOut(req *pdu) error {
+	ttt := req.u32(20)
+	if ttt == reservedTag {
+		return &protocolError{reason: rejectProtocolError, message: "unsolicited data"}
+	}
+	t, ok := s.pending[ttt]
+	if !ok {
+		s.c.logger.Debug("Discarding data of an aborted task", "itt", req.itt(), "ttt", ttt)
+		return nil
+	}
+	if req.itt() != t.itt {
+		return &protocolError{reason: rejectInvalidPDUField, message: "task tag of data does not match the R2T"}
+	}
+	if offset := int(req.u32(40)); offset != t.received || offset+len(req.data) > t.burstEnd {
+		return &protocolError{reason: rejectProtocolError, message: fmt.Sprintf("data at offset %d out of order", offset)}
+	}
+
+	t.received += copy(t.data[t.received:t.burstEnd], req.data)
+	if req.flags()&flagFinal == 0 {
+		return nil
+	}
+	if t.received != t.burstEnd {
+		return &protocolError{reason: rejectProtocolError, message: "data sequence ended before the requested length"}
+	}
+	delete(s.pending, ttt)
+	if t.received < len(t.data) {
+		return s.requestData(t)
+	}
+	s.execute(t)
+	return nil
+}
+
+// execute runs a command with all its data in its own go routine
+func (s *session) execute(t *task) {
+	s.wg.Go(func() {
+		res := s.c.runCommand(s.ctx, t)
+		s.removeTask(t)
+		defer close(t.done)
+		if err := s.complete(t, res); err != nil {
+			s.fail(err)
+		}
+	})
+}
+
+func (s *session) removeTask(t *task) {
+	s.tasksMu.Lock()
+	defer s.tasksMu.Unlock()
+	if s.tasks[t.itt] == t {
+		delete(s.tasks, t.itt)
+	}
+}
+
+// complete sends the data and the status of a command. Read data goes with the status in the last Data-In PDU, if the status is good.
+func (s *session) complete(t *task, res *result) error {
+	data := res.data
+	var residualFlags uint8
+	var residual uint32
+	switch {
+	case len(data) > int(t.edtl):
+		residualFlags, residual = flagOverflow, uint32(len(data))-t.edtl
+		data = data[:t.edtl]
+	case t.read && len(data) < int(t.edtl):
+		residualFlags, residual = flagUnderflow, t.edtl-uint32(len(data))
+	case t.write && res.used < int(t.edtl):
+		residualFlags, residual = flagUnderflow, t.edtl-uint32(res.used)
+	}
+
+	released := 0
+	if t.counted {
+		released = 1
+	}
+
+	if len(data) > 0 && res.status == statusGood {
+		return s.c.complete(released, s.dataIn(t, data, residualFlags, residual)...)
+	}
+
+	resp := newPDU(OpSCSIResponse, flagFinal|residualFlags)
+	resp.bhs[3] = res.status
+	resp.setU32(16, t.itt)
+	resp.setU32(44, residual)
+	if len(res.sense) > 0 {
+		resp.data = make([]byte, 2+len(res.sense))
+		resp.data[0] = byte(len(res.sense) >> 8)
+		resp.data[1] = byte(len(res.sense))
+		copy(resp.data[2:], res.sense)
+	}
+	return s.c.complete(released, resp)
+}
+
+// dataIn splits read data into Data-In PDUs of the initiator's segment size. Sequences end at MaxBurstLength.
+func (s *session) dataIn(t *task, data []byte, residualFlags uint8, residual uint32) []*pdu {
+	segment := s.c.params.maxSendDataSegment
+	pdus := make([]*pdu, 0, (len(data)+segment-1)/segment)
+	for offset := 0; offset < len(data); {
+		length := min(segment, len(data)-offset, s.c.params.maxBurst-offset%s.c.params.maxBurst)
+		end := offset + length
+
+		var flags uint8
+		if end == len(data) {
+			flags = flagFinal | flagStatus | residualFlags
+		} else if end%s.c.params.maxBurst == 0 {
+			flags = flagFinal
+		}
+		p := newPDU(OpDataIn, flags)
+		copy(p.bhs[8:16], t.lun[:])
+		p.setU32(16, t.itt)
+		p.setU32(20, reservedTag)
+		p.setU32(36, uint32(len(pdus)))
+		p.setU32(40, uint32(offset))
+		if flags&flagStatus != 0 {
+			p.bhs[3] = statusGood
+			p.setU32(44, residual)
+		}
+		p.data = data[offset:end]
+		pdus = append(pdus, p)
+		offset = end
+	}
+	return pdus
+}
+
+// handleTaskMgmt aborts tasks. Tasks waiting for data are dropped, executing tasks are waited for (their backend calls cannot be aborted).
+func (s *session) handleTaskMgmt(req *pdu) error {
+	if _, err := s.c.acceptCmdSN(req, false); err != nil {
+		return err
+	}
+	resp := newPDU(OpTaskMgmtResp, flagFinal)
+	resp.setU32(16, req.itt())
+
+	var lun [8]byte
+	copy(lun[:], req.lun())
+	function := req.flags() &^ flagFinal
+
+	var match func(t *task) bool
+	switch function {
+	case tmfAbortTask:
+		refITT := req.u32(20)
+		match = func(t *task) bool { return t.itt == refITT }
+	case tmfAbortTaskSet, tmfClearTaskSet, tmfLUNReset:
+		if number, ok := decodeLUN(lun[:]); !ok || !s.c.target.mapped(number) {
+			resp.bhs[2] = tmfLUNNotFound
+			return s.c.send(resp)
+		}
+		match = func(t *task) bool { return t.lun == lun }
+	default:
+		resp.bhs[2] = tmfNotSupported
+		return s.c.send(resp)
+	}
+
+	aborted, released := 0, 0
+	for ttt, t := range s.pending {
+		if match(t) {
+			delete(s.pending, ttt)
+			s.removeTask(t)
+			aborted++
+			if t.counted {
+				released++
+			}
+		}
+	}
+	var executing []*task
+	s.tasksMu.Lock()
+	for _, t := range s.tasks {
+		if match(t) {
+			executing = append(executing, t)
+		}
+	}
+	s.tasksMu.Unlock()
+
+	if function == tmfAbortTask && aborted == 0 && len(executing) == 0 {
+		resp.bhs[2] = tmfTaskNotFound
+		return s.c.send(resp)
+	}
+	resp.bhs[2] = tmfComplete
+	s.wg.Go(func() {
+		for _, t := range executing {
+			<-t.done
+		}
+		if err := s.c.complete(released, resp); err != nil {
+			s.fail(err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,269 @@
+package iscsi
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// LUN is a logical unit of the target backed by an export
+type LUN struct {
+	Number    uint16
+	Export    string
+	VolumeID  string // Unit serial number and device identification (the export name, if empty)
+	ReadOnly  bool
+	BlockSize uint32 // Internal block granularity of the volume (0: unknown)
+	Backend   backend.BlockBackend
+}
+
+// CHAP are the credentials of CHAP authentication. Without a user, sessions are not authenticated.
+type CHAP struct {
+	User         string
+	Secret       string
+	MutualUser   string // Mutual CHAP: the target authenticates to the initiator with these credentials
+	MutualSecret string
+}
+
+// Options configure the target
+type Options struct {
+	TargetName string
+	QueueDepth int // Commands per session (0: 32)
+	CHAP       CHAP
+}
+
+// logicalUnit is a LUN with the commands executing on it
+type logicalUnit struct {
+	LUN
+	inFlight sync.WaitGroup
+}
+
+// SessionInfo describes a logged in session
+type SessionInfo struct {
+	ID            uint64
+	InitiatorName string
+	RemoteAddr    string
+	TSIH          uint16
+	LoggedInAt    time.Time
+	CHAP          bool
+	ImmediateData bool
+	BytesRead     uint64
+	BytesWritten  uint64
+}
+
+// Target is an iSCSI target with a single target name whose LUNs are the attached exports.
+// Every connection is a session of its own (MaxConnections=1).
+type Target struct {
+	logger     *slog.Logger
+	options    Options
+	baseCtx    context.Context // Cancelled on shutdown, parent of the contexts of all connections
+	cancelBase context.CancelFunc
+	wg         sync.WaitGroup
+	connsMu    sync.Mutex
+	conns      map[*conn]struct{}
+	closing    bool
+	nextConnID atomic.Uint64
+	nextTSIH   atomic.Uint32
+	lunsMu     sync.RWMutex
+	luns       map[uint16]*logicalUnit
+	lunsEpoch  atomic.Uint64 // Incremented on LUN changes, sessions report them as unit attention
+}
+
+func NewTarget(parentLogger *slog.Logger, options Options) *Target {
+	if options.QueueDepth <= 0 {
+		options.QueueDepth = 32
+	}
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	return &Target{
+		logger:     parentLogger.With("module", "iscsitarget"),
+		options:    options,
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+		conns:      make(map[*conn]struct{}),
+		luns:       make(map[uint16]*logicalUnit),
+	}
+}
+
+// Serve accepts connections until the listener is closed
+func (t *Target) Serve(ln net.Listener) error {
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		c := newConn(t, netConn)
+		if !t.track(c) {
+			netConn.Close()
+			return nil
+		}
+
+		t.wg.Go(func() {
+			defer t.untrack(c)
+			c.serve()
+		})
+	}
+}
+
+// Shutdown closes all connections and waits for them (the listeners must be closed by the caller)
+func (t *Target) Shutdown(ctx context.Context) error {
+	t.connsMu.Lock()
+	t.closing = true
+	t.cancelBase()
+	for c := range t.conns {
+		c.close()
+	}
+	t.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Target) track(c *conn) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *Target) untrack(c *conn) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	delete(t.conns, c)
+}
+
+// loggedIn marks a session as entering the full feature phase (its negotiated state does not change anymore)
+func (t *Target) loggedIn(c *conn) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	c.loggedInAt = time.Now()
+}
+
+// Sessions returns the logged in normal sessions, ordered by id (discovery sessions are not reported)
+func (t *Target) Sessions() []SessionInfo {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	infos := make([]SessionInfo, 0, len(t.conns))
+	for c := range t.conns {
+		if c.loggedInAt.IsZero() || c.discovery {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			ID:            c.id,
+			InitiatorName: c.initiatorName,
+			RemoteAddr:    c.netConn.RemoteAddr().String(),
+			TSIH:          c.tsih,
+			LoggedInAt:    c.loggedInAt,
+			CHAP:          t.options.CHAP.User != "",
+			ImmediateData: c.params.immediateData,
+			BytesRead:     c.bytesRead.Load(),
+			BytesWritten:  c.bytesWritten.Load(),
+		})
+	}
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// Disconnect closes the session with the id (false, if there is none)
+func (t *Target) Disconnect(id uint64) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	for c := range t.conns {
+		if c.id == id {
+			c.close()
+			return true
+		}
+	}
+	return false
+}
+
+// AddLUN maps an export to a LUN
+func (t *Target) AddLUN(lun LUN) error {
+	t.lunsMu.Lock()
+	defer t.lunsMu.Unlock()
+	if existing, ok := t.luns[lun.Number]; ok {
+		return fmt.Errorf("LUN %d is used by export %q", lun.Number, existing.Export)
+	}
+	t.luns[lun.Number] = &logicalUnit{LUN: lun}
+	t.lunsEpoch.Add(1)
+	return nil
+}
+
+// RemoveLUN unmaps a LUN and waits for its executing commands, so the backend is not used anymore afterwards
+func (t *Target) RemoveLUN(number uint16) bool {
+	t.lunsMu.Lock()
+	lu, ok := t.luns[number]
+	delete(t.luns, number)
+	if ok {
+		t.lunsEpoch.Add(1)
+	}
+	t.lunsMu.Unlock()
+
+	if ok {
+		lu.inFlight.Wait()
+	}
+	return ok
+}
+
+// LUNs returns the mapped LUNs in ascending order
+func (t *Target) LUNs() []uint16 {
+	t.lunsMu.RLock()
+	defer t.lunsMu.RUnlock()
+	return slices.Sorted(maps.Keys(t.luns))
+}
+
+// acquireLUN returns the logical unit for a command, which must be released with inFlight.Done
+func (t *Target) acquireLUN(number uint16) *logicalUnit {
+	t.lunsMu.RLock()
+	defer t.lunsMu.RUnlock()
+	lu, ok := t.luns[number]
+	if !ok {
+		return nil
+	}
+	lu.inFlight.Add(1)
+	return lu
+}
+
+// mapped returns true, if the LUN is mapped
+func (t *Target) mapped(number uint16) bool {
+	t.lunsMu.RLock()
+	defer t.lunsMu.RUnlock()
+	_, ok := t.luns[number]
+	return ok
+}
+
+// newTSIH returns the target session identifying handle of a new session (never 0)
+func (t *Target) newTSIH() uint16 {
+	for {
+		if tsih := uint16(t.nextTSIH.Add(1)); tsih != 0 {
+			return tsih
+		}
+	}
+}
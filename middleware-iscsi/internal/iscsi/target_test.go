@@ -0,0 +1,563 @@
+package iscsi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const (
+	testTargetName    = "iqn.2024-01.net.quorumbd:test"
+	testInitiatorName = "iqn.2024-01.net.quorumbd:initiator"
+	testSize          = 1 << 20
+)
+
+// memBackend is an in-memory block backend
+type memBackend struct {
+	mu      sync.Mutex
+	data    []byte
+	flushes int
+}
+
+func newMemBackend(size int64) *memBackend {
+	return &memBackend{data: make([]byte, size)}
+}
+
+func (b *memBackend) ReadAt(_ context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(p, b.data[off:])
+	return nil
+}
+
+func (b *memBackend) WriteAt(_ context.Context, p []byte, off int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(b.data[off:], p)
+	return nil
+}
+
+func (b *memBackend) Flush(context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+	return nil
+}
+
+func (b *memBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.WriteZeroes(ctx, off, length, flags)
+}
+
+func (b *memBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, length); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.data[off : off+length])
+	return nil
+}
+
+func (b *memBackend) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memBackend) Close() error {
+	return nil
+}
+
+// startTarget serves a target on a tcp port until the test ends and returns its address
+func startTarget(t *testing.T, options Options, luns ...LUN) (*Target, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.TargetName = testTargetName
+	target := NewTarget(slog.New(slog.DiscardHandler), options)
+	for _, lun := range luns {
+		if err := target.AddLUN(lun); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = target.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := target.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-done
+	})
+	return target, ln.Addr().String()
+}
+
+func TestLogin(t *testing.T) {
+	user := CHAP{User: "user", Secret: "user-secret-12"}
+	mutual := CHAP{User: "user", Secret: "user-secret-12", MutualUser: "target", MutualSecret: "target-secret-12"}
+
+	tests := []struct {
+		name       string
+		target     CHAP
+		initiator  CHAP
+		targetName string
+		status     uint16 // Login status of a rejected login
+		wantErr    bool   // Login fails on the initiator side
+	}{
+		{name: "no authentication", targetName: testTargetName},
+		{name: "CHAP offered but not required", initiator: user, targetName: testTargetName},
+		{name: "CHAP", target: user, initiator: user, targetName: testTargetName},
+		{name: "mutual CHAP", target: mutual, initiator: mutual, targetName: testTargetName},
+		{name: "mutual CHAP not requested", target: mutual, initiator: user, targetName: testTargetName},
+		{name: "CHAP required", target: user, targetName: testTargetName, status: loginAuthFailed},
+		{name: "wrong secret", target: user, initiator: CHAP{User: "user", Secret: "wrong-secret-12"}, targetName: testTargetName, status: loginAuthFailed},
+		{name: "wrong user", target: user, initiator: CHAP{User: "other", Secret: user.Secret}, targetName: testTargetName, status: loginAuthFailed},
+		{name: "mutual CHAP not configured", target: user, initiator: mutual, targetName: testTargetName, status: loginAuthFailed},
+		{
+			name:       "wrong mutual secret",
+			target:     CHAP{User: "user", Secret: user.Secret, MutualUser: "target", MutualSecret: "forged-secret-12"},
+			initiator:  mutual,
+			targetName: testTargetName,
+			wantErr:    true,
+		},
+		{
+			name:       "wrong mutual user",
+			target:     CHAP{User: "user", Secret: user.Secret, MutualUser: "forged", MutualSecret: mutual.MutualSecret},
+			initiator:  mutual,
+			targetName: testTargetName,
+			wantErr:    true,
+		},
+		{name: "mutual CHAP without CHAP", initiator: mutual, targetName: testTargetName, wantErr: true},
+		{name: "unknown target", targetName: "iqn.2024-01.net.quorumbd:other", status: loginNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, address := startTarget(t, Options{CHAP: test.target})
+			initiator, err := Dial(t.Context(), address, InitiatorOptions{InitiatorName: testInitiatorName, TargetName: test.targetName, CHAP: test.initiator})
+			switch {
+			case test.status != 0:
+				if loginErr, ok := errors.AsType[*LoginError](err); !ok || loginErr.Status != test.status {
+					t.Fatalf("error %v, want login status 0x%04x", err, test.status)
+				}
+				return
+			case test.wantErr:
+				if err == nil {
+					initiator.Close()
+					t.Fatal("login succeeded")
+				}
+				if _, ok := errors.AsType[*LoginError](err); ok {
+					t.Fatalf("error %v, want a failure of the initiator", err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			sessions := target.Sessions()
+			if len(sessions) != 1 || sessions[0].InitiatorName != testInitiatorName || sessions[0].CHAP != (test.target.User != "") || sessions[0].TSIH == 0 {
+				t.Fatalf("sessions %+v", sessions)
+			}
+			if err := initiator.Logout(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	_, address := startTarget(t, Options{})
+	initiator, err := Dial(t.Context(), address, InitiatorOptions{InitiatorName: testInitiatorName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Close()
+	targets, err := initiator.SendTargets(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Name != testTargetName || !slices.Equal(targets[0].Addresses, []string{address + ",1"}) {
+		t.Fatalf("targets %+v", targets)
+	}
+	if _, err := initiator.ReportLUNs(t.Context()); err == nil {
+		t.Fatal("command in a discovery session succeeded")
+	}
+}
+
+// rawLogin is a connection that sends login requests without the state machine of the initiator
+type rawLogin struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	itt  uint32
+}
+
+func dialLogin(t *testing.T, address string) *rawLogin {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rawLogin{t: t, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// exchange sends a login request of the stage csg (transit to nsg, if set) and returns the status and keys of the response
+func (l *rawLogin) exchange(csg uint8, nsg uint8, transit bool, kvs keyValues) (uint16, keyValues) {
+	l.t.Helper()
+	flags := csg<<2 | nsg
+	if transit {
+		flags |= flagTransit
+	}
+	req := newPDU(OpLogin|flagImmediate, flags)
+	copy(req.bhs[8:14], []byte{0x80, 1, 2, 3, 0, 0})
+	l.itt++
+	req.setU32(16, l.itt)
+	req.setU32(24, 1)
+	req.data = kvs.encode()
+	if err := writePDU(l.w, req); err != nil {
+		l.t.Fatal(err)
+	}
+	if err := l.w.Flush(); err != nil {
+		l.t.Fatal(err)
+	}
+
+	resp, err := readPDU(l.r, maxTextDataSize)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	if resp.opcode() != OpLoginResp || resp.itt() != l.itt {
+		l.t.Fatalf("response opcode 0x%02x with task tag %d", resp.opcode(), resp.itt())
+	}
+	respKeys, err := parseText(resp.data)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return binary.BigEndian.Uint16(resp.bhs[36:]), respKeys
+}
+
+// chapAnswer returns the CHAP_N and CHAP_R keys answering the challenge of a response
+func chapAnswer(t *testing.T, credentials CHAP, resp keyValues) keyValues {
+	t.Helper()
+	idValue, _ := resp.get("CHAP_I")
+	challengeValue, _ := resp.get("CHAP_C")
+	id, err := strconv.ParseUint(idValue, 10, 8)
+	if err != nil {
+		t.Fatalf("CHAP_I %q", idValue)
+	}
+	challenge, err := decodeBinary(challengeValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyValues{
+		{key: "CHAP_N", value: credentials.User},
+		{key: "CHAP_R", value: encodeBinary(chapResponse(byte(id), credentials.Secret, challenge))},
+	}
+}
+
+func TestLoginExchanges(t *testing.T) {
+	credentials := CHAP{User: "user", Secret: "user-secret-12", MutualUser: "target", MutualSecret: "target-secret-12"}
+	start := keyValues{
+		{key: "InitiatorName", value: testInitiatorName},
+		{key: "SessionType", value: "Normal"},
+		{key: "TargetName", value: testTargetName},
+		{key: "AuthMethod", value: "CHAP"},
+	}
+
+	tests := []struct {
+		name   string
+		answer func(t *testing.T, challenge keyValues) keyValues // Keys answering the challenge of the target
+		status uint16
+		keys   keyValues // Expected keys of the response
+	}{
+		{
+			name:   "CHAP",
+			answer: func(t *testing.T, challenge keyValues) keyValues { return chapAnswer(t, credentials, challenge) },
+		},
+		{
+			name: "mutual CHAP",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				answer := chapAnswer(t, credentials, challenge)
+				answer.add("CHAP_I", "7")
+				answer.add("CHAP_C", encodeBinary(bytes.Repeat([]byte{0x5a}, chapChallengeSize)))
+				return answer
+			},
+			keys: keyValues{
+				{key: "CHAP_N", value: credentials.MutualUser},
+				{key: "CHAP_R", value: encodeBinary(chapResponse(7, credentials.MutualSecret, bytes.Repeat([]byte{0x5a}, chapChallengeSize)))},
+			},
+		},
+		{
+			// The initiator sends the challenge of the target back to learn the response to it from the target
+			name: "reflected challenge",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				answer := chapAnswer(t, credentials, challenge)
+				challengeValue, _ := challenge.get("CHAP_C")
+				answer.add("CHAP_I", "7")
+				answer.add("CHAP_C", challengeValue)
+				return answer
+			},
+			status: loginAuthFailed,
+		},
+		{
+			name: "incomplete mutual challenge",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				return append(chapAnswer(t, credentials, challenge), keyValue{key: "CHAP_I", value: "7"})
+			},
+			status: loginInitiatorError,
+		},
+		{
+			name: "empty mutual challenge",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				return append(chapAnswer(t, credentials, challenge), keyValue{key: "CHAP_I", value: "7"}, keyValue{key: "CHAP_C", value: "0x"})
+			},
+			status: loginInitiatorError,
+		},
+		{
+			name: "response without name",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				return chapAnswer(t, credentials, challenge)[1:]
+			},
+			status: loginInitiatorError,
+		},
+		{
+			name: "malformed response",
+			answer: func(t *testing.T, challenge keyValues) keyValues {
+				return keyValues{{key: "CHAP_N", value: credentials.User}, {key: "CHAP_R", value: "0xzz"}}
+			},
+			status: loginInitiatorError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, address := startTarget(t, Options{CHAP: credentials})
+			l := dialLogin(t, address)
+			if status, keys := l.exchange(stageSecurity, stageOperational, true, start); status != loginSuccess || !slices.Contains(keys, keyValue{key: "AuthMethod", value: "CHAP"}) {
+				t.Fatalf("status 0x%04x, keys %v", status, keys)
+			}
+			status, challenge := l.exchange(stageSecurity, stageOperational, true, keyValues{{key: "CHAP_A", value: "7," + chapAlgorithmMD5}})
+			if status != loginSuccess || !slices.Contains(challenge, keyValue{key: "CHAP_A", value: chapAlgorithmMD5}) {
+				t.Fatalf("status 0x%04x, keys %v", status, challenge)
+			}
+
+			status, keys := l.exchange(stageSecurity, stageOperational, true, test.answer(t, challenge))
+			if status != test.status {
+				t.Fatalf("status 0x%04x, want 0x%04x", status, test.status)
+			}
+			for _, kv := range test.keys {
+				if !slices.Contains(keys, kv) {
+					t.Fatalf("keys %v without %v", keys, kv)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginErrors(t *testing.T) {
+	start := keyValues{
+		{key: "InitiatorName", value: testInitiatorName},
+		{key: "SessionType", value: "Normal"},
+		{key: "TargetName", value: testTargetName},
+	}
+	tests := []struct {
+		name    string
+		chap    bool // The target requires CHAP
+		csg     uint8
+		nsg     uint8
+		transit bool
+		kvs     keyValues
+		status  uint16
+	}{
+		{name: "operational stage", csg: stageOperational, nsg: stageFullFeature, transit: true, kvs: start},
+		{name: "skipped authentication", chap: true, csg: stageOperational, nsg: stageFullFeature, transit: true, kvs: start, status: loginInitiatorError},
+		{name: "transit without authentication", chap: true, csg: stageSecurity, nsg: stageOperational, transit: true, kvs: start, status: loginAuthFailed},
+		{name: "CHAP algorithm without method", chap: true, csg: stageSecurity, nsg: stageOperational, kvs: append(slices.Clone(start), keyValue{key: "CHAP_A", value: chapAlgorithmMD5}), status: loginInitiatorError},
+		{name: "unsupported CHAP algorithm", chap: true, csg: stageSecurity, nsg: stageOperational, kvs: append(slices.Clone(start), keyValue{key: "AuthMethod", value: "CHAP"}, keyValue{key: "CHAP_A", value: "7"}), status: loginAuthFailed},
+		{name: "response without challenge", chap: true, csg: stageSecurity, nsg: stageOperational, kvs: append(slices.Clone(start), keyValue{key: "AuthMethod", value: "CHAP"}, keyValue{key: "CHAP_N", value: "user"}, keyValue{key: "CHAP_R", value: "0x00"}), status: loginInitiatorError},
+		{name: "security keys in operational stage", csg: stageOperational, nsg: stageFullFeature, transit: true, kvs: append(slices.Clone(start), keyValue{key: "AuthMethod", value: valueNone}), status: loginInitiatorError},
+		{name: "missing initiator name", csg: stageSecurity, nsg: stageOperational, kvs: start[1:], status: loginMissingParameter},
+		{name: "missing target name", csg: stageSecurity, nsg: stageOperational, kvs: start[:2], status: loginMissingParameter},
+		{name: "unsupported session type", csg: stageSecurity, nsg: stageOperational, kvs: keyValues{start[0], {key: "SessionType", value: "Other"}}, status: loginUnsupportedSession},
+		{name: "transit backwards", csg: stageOperational, nsg: stageSecurity, transit: true, kvs: start, status: loginInitiatorError},
+		{name: "invalid text", csg: stageSecurity, nsg: stageOperational, kvs: keyValues{{key: "", value: "x"}}, status: loginInitiatorError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var options Options
+			if test.chap {
+				options.CHAP = CHAP{User: "user", Secret: "user-secret-12"}
+			}
+			_, address := startTarget(t, options)
+			if status, keys := dialLogin(t, address).exchange(test.csg, test.nsg, test.transit, test.kvs); status != test.status {
+				t.Fatalf("status 0x%04x (keys %v), want 0x%04x", status, keys, test.status)
+			}
+		})
+	}
+}
+
+// cdb10 returns a 10 byte CDB with LBA and transfer length
+func cdb10(opcode uint8, flags uint8, lba uint32, blocks uint16) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = opcode
+	cdb[1] = flags
+	binary.BigEndian.PutUint32(cdb[2:], lba)
+	binary.BigEndian.PutUint16(cdb[7:], blocks)
+	return cdb
+}
+
+func TestCommands(t *testing.T) {
+	disk, ro := newMemBackend(testSize), newMemBackend(testSize)
+	copy(ro.data, bytes.Repeat([]byte{0x77}, testSize))
+	target, address := startTarget(t, Options{},
+		LUN{Number: 0, Export: "disk", Backend: disk},
+		LUN{Number: 1, Export: "ro", ReadOnly: true, Backend: ro},
+		LUN{Number: 300, Export: "flat", Backend: newMemBackend(testSize)},
+	)
+	initiator, err := Dial(t.Context(), address, InitiatorOptions{InitiatorName: testInitiatorName, TargetName: testTargetName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer initiator.Close()
+	ctx := t.Context()
+
+	luns, err := initiator.ReportLUNs(ctx)
+	if err != nil || !slices.Equal(luns, []uint16{0, 1, 300}) {
+		t.Fatalf("LUNs %v (%v)", luns, err)
+	}
+	blocks, blockSize, err := initiator.ReadCapacity(ctx, 300)
+	if err != nil || blocks != testSize/logicalBlockSize || blockSize != logicalBlockSize {
+		t.Fatalf("capacity %d blocks of %d bytes (%v)", blocks, blockSize, err)
+	}
+
+	// WRITE(16) and READ(16), larger than the immediate data: the rest is sent on R2T
+	data := make([]byte, 512<<10)
+	for i := range data {
+		data[i] = byte(i / logicalBlockSize)
+	}
+	if err := initiator.Write(ctx, 0, 8, data, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := initiator.Read(ctx, 0, 8, uint32(len(data)/logicalBlockSize)); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("READ(16) after WRITE(16): %v", err)
+	}
+
+	// WRITE(10) and READ(10)
+	block := bytes.Repeat([]byte{0xcd}, 2*logicalBlockSize)
+	if _, err := initiator.Command(ctx, 0, cdb10(opWrite10, 0x08, 4, 2), block, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := initiator.Command(ctx, 0, cdb10(opRead10, 0, 4, 2), nil, len(block)); err != nil || !bytes.Equal(got, block) {
+		t.Fatalf("READ(10) after WRITE(10): %v", err)
+	}
+	if got, err := initiator.Read(ctx, 0, 3, 1); err != nil || !bytes.Equal(got, make([]byte, logicalBlockSize)) {
+		t.Fatalf("READ(16) of an unwritten block: %v", err)
+	}
+
+	// UNMAP reads back as zeroes
+	if err := initiator.Unmap(ctx, 0, 4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := initiator.Command(ctx, 0, cdb10(opRead10, 0, 4, 2), nil, len(block)); err != nil || !bytes.Equal(got, append(make([]byte, logicalBlockSize), block[:logicalBlockSize]...)) {
+		t.Fatalf("READ(10) after UNMAP: %v", err)
+	}
+
+	if err := initiator.SynchronizeCache(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	disk.mu.Lock()
+	flushes := disk.flushes
+	disk.mu.Unlock()
+	if flushes != 1 {
+		t.Fatalf("%d flushes of the backend", flushes)
+	}
+	if got, err := initiator.Read(ctx, 1, 0, 1); err != nil || !bytes.Equal(got, ro.data[:logicalBlockSize]) {
+		t.Fatalf("read of the read-only LUN: %v", err)
+	}
+
+	last := uint32(testSize/logicalBlockSize - 1)
+	tests := []struct {
+		name string
+		lun  uint16
+		cdb  []byte
+		out  []byte
+		in   int
+		key  uint8
+		asc  uint8
+	}{
+		{name: "READ(10) past the end", cdb: cdb10(opRead10, 0, last, 2), in: 2 * logicalBlockSize, key: senseIllegalRequest, asc: ascLBAOutOfRange},
+		{name: "WRITE(10) past the end", cdb: cdb10(opWrite10, 0, last+1, 1), out: make([]byte, logicalBlockSize), key: senseIllegalRequest, asc: ascLBAOutOfRange},
+		{name: "WRITE(10) to read-only LUN", lun: 1, cdb: cdb10(opWrite10, 0, 0, 1), out: make([]byte, logicalBlockSize), key: senseDataProtect, asc: ascWriteProtected},
+		{name: "UNMAP of read-only LUN", lun: 1, cdb: cdb10(opUnmap, 0, 0, 24), out: unmapParameters(0, 1), key: senseDataProtect, asc: ascWriteProtected},
+		{name: "UNMAP past the end", cdb: cdb10(opUnmap, 0, 0, 24), out: unmapParameters(uint64(last), 2), key: senseIllegalRequest, asc: ascLBAOutOfRange},
+		{name: "UNMAP with short parameters", cdb: cdb10(opUnmap, 0, 0, 4), out: unmapParameters(0, 1)[:4], key: senseIllegalRequest, asc: ascParameterListLength},
+		{name: "unknown LUN", lun: 2, cdb: cdb10(opRead10, 0, 0, 1), in: logicalBlockSize, key: senseIllegalRequest, asc: ascLUNNotSupported},
+		{name: "unknown opcode", cdb: []byte{0xff}, key: senseIllegalRequest, asc: ascInvalidOpcode},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := initiator.Command(ctx, test.lun, test.cdb, test.out, test.in)
+			scsiErr, ok := errors.AsType[*SCSIError](err)
+			if !ok || scsiErr.Status != statusCheckCondition || scsiErr.SenseKey != test.key || scsiErr.ASC != test.asc {
+				t.Fatalf("error %v, want sense %x/%02x", err, test.key, test.asc)
+			}
+		})
+	}
+
+	// A LUN change is reported once as unit attention
+	if err := target.AddLUN(LUN{Number: 2, Export: "new", Backend: newMemBackend(testSize)}); err != nil {
+		t.Fatal(err)
+	}
+	var attentionErr error
+	if err := initiator.do(ctx, func() error {
+		_, attentionErr = initiator.command(0, cdb10(opRead10, 0, 0, 1), nil, logicalBlockSize)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if scsiErr, ok := errors.AsType[*SCSIError](attentionErr); !ok || scsiErr.SenseKey != senseUnitAttention || scsiErr.ASC != ascReportedLUNsDataChanged {
+		t.Fatalf("error %v after a LUN change, want unit attention", attentionErr)
+	}
+	if _, err := initiator.Read(ctx, 2, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initiator.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initiator.Read(ctx, 0, 0, 1); !errors.Is(err, ErrInitiatorClosed) {
+		t.Fatalf("read after logout: error %v, want %v", err, ErrInitiatorClosed)
+	}
+}
+
+// unmapParameters returns the UNMAP parameter list with one block descriptor
+func unmapParameters(lba uint64, blocks uint32) []byte {
+	params := make([]byte, 8+unmapDescriptorSize)
+	binary.BigEndian.PutUint16(params, uint16(len(params)-2))
+	binary.BigEndian.PutUint16(params[2:], unmapDescriptorSize)
+	binary.BigEndian.PutUint64(params[8:], lba)
+	binary.BigEndian.PutUint32(params[16:], blocks)
+	return params
+}
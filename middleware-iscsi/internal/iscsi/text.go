@@ -0,0 +1,114 @@
+package iscsi
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key values of the negotiation
+const (
+	valueYes           = "Yes"
+	valueNo            = "No"
+	valueNone          = "None"
+	valueReject        = "Reject"
+	valueNotUnderstood = "NotUnderstood"
+	valueIrrelevant    = "Irrelevant"
+	chapAlgorithmMD5   = "5"
+)
+
+// keyValue is a text key of login and text PDUs. The order of the keys is kept.
+type keyValue struct {
+	key   string
+	value string
+}
+
+type keyValues []keyValue
+
+// parseText decodes the key=value pairs of a data segment (separated by NUL)
+func parseText(data []byte) (keyValues, error) {
+	var kvs keyValues
+	for field := range bytes.SplitSeq(data, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid text key %q", field)
+		}
+		kvs = append(kvs, keyValue{key: key, value: value})
+	}
+	return kvs, nil
+}
+
+func (kvs keyValues) get(key string) (string, bool) {
+	for _, kv := range kvs {
+		if kv.key == key {
+			return kv.value, true
+		}
+	}
+	return "", false
+}
+
+func (kvs *keyValues) add(key string, value string) {
+	*kvs = append(*kvs, keyValue{key: key, value: value})
+}
+
+func (kvs keyValues) encode() []byte {
+	var buf bytes.Buffer
+	for _, kv := range kvs {
+		buf.WriteString(kv.key)
+		buf.WriteByte('=')
+		buf.WriteString(kv.value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// hasValue returns true, if the comma separated list contains value
+func hasValue(list string, value string) bool {
+	for item := range strings.SplitSeq(list, ",") {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// numberValue parses a numerical value of a key
+func numberValue(kv keyValue) (uint64, error) {
+	n, err := strconv.ParseUint(kv.value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of %s: %q", kv.key, kv.value)
+	}
+	return n, nil
+}
+
+// chapResponse computes the CHAP response MD5(id || secret || challenge)
+func chapResponse(id byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// decodeBinary decodes a binary value in hex (0x) or base64 (0b) encoding
+func decodeBinary(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X"):
+		return hex.DecodeString(value[2:])
+	case strings.HasPrefix(value, "0b") || strings.HasPrefix(value, "0B"):
+		return base64.StdEncoding.DecodeString(value[2:])
+	default:
+		return nil, fmt.Errorf("invalid binary value %q", value)
+	}
+}
+
+func encodeBinary(value []byte) string {
+	return "0x" + hex.EncodeToString(value)
+}
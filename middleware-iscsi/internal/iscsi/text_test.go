@@ -0,0 +1,108 @@
+package iscsi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		kvs     keyValues
+		wantErr bool
+	}{
+		{name: "empty", data: nil, kvs: nil},
+		{name: "keys", data: []byte("InitiatorName=iqn.x\x00SessionType=Normal\x00"), kvs: keyValues{{"InitiatorName", "iqn.x"}, {"SessionType", "Normal"}}},
+		{name: "empty value", data: []byte("TargetAlias=\x00"), kvs: keyValues{{"TargetAlias", ""}}},
+		{name: "separator in value", data: []byte("X-key=a=b\x00"), kvs: keyValues{{"X-key", "a=b"}}},
+		{name: "without final NUL", data: []byte("HeaderDigest=None"), kvs: keyValues{{"HeaderDigest", "None"}}},
+		{name: "padding", data: []byte("A=1\x00\x00\x00\x00"), kvs: keyValues{{"A", "1"}}},
+		{name: "duplicate keys kept in order", data: []byte("A=1\x00B=2\x00A=3\x00"), kvs: keyValues{{"A", "1"}, {"B", "2"}, {"A", "3"}}},
+		{name: "missing separator", data: []byte("A=1\x00B\x00"), wantErr: true},
+		{name: "empty key", data: []byte("=1\x00"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs, err := parseText(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(kvs, test.kvs) {
+				t.Fatalf("keys %v, want %v", kvs, test.kvs)
+			}
+		})
+	}
+}
+
+func TestEncodeText(t *testing.T) {
+	kvs := keyValues{{"TargetName", "iqn.x"}, {"TargetAddress", "127.0.0.1:3260,1"}, {"Empty", ""}}
+	encoded := kvs.encode()
+	if want := []byte("TargetName=iqn.x\x00TargetAddress=127.0.0.1:3260,1\x00Empty=\x00"); !bytes.Equal(encoded, want) {
+		t.Fatalf("encoded %q, want %q", encoded, want)
+	}
+	if decoded, err := parseText(encoded); err != nil || !reflect.DeepEqual(decoded, kvs) {
+		t.Fatalf("decoded %v (%v)", decoded, err)
+	}
+}
+
+func TestDecodeBinary(t *testing.T) {
+	tests := []struct {
+		value   string
+		decoded []byte
+		wantErr bool
+	}{
+		{value: "0x00ff10", decoded: []byte{0x00, 0xff, 0x10}},
+		{value: "0XABCD", decoded: []byte{0xab, 0xcd}},
+		{value: "0x", decoded: []byte{}},
+		{value: "0bAP8Q", decoded: []byte{0x00, 0xff, 0x10}},
+		{value: "0BAP8Q", decoded: []byte{0x00, 0xff, 0x10}},
+		{value: "00ff", wantErr: true},
+		{value: "", wantErr: true},
+		{value: "0x0", wantErr: true},
+		{value: "0xzz", wantErr: true},
+		{value: "0b!!", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			decoded, err := decodeBinary(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(decoded, test.decoded) {
+				t.Fatalf("decoded %x, want %x", decoded, test.decoded)
+			}
+		})
+	}
+	if value := encodeBinary([]byte{0x00, 0xff}); value != "0x00ff" {
+		t.Fatalf("encoded %q", value)
+	}
+}
+
+func TestListValues(t *testing.T) {
+	tests := []struct {
+		list  string
+		value string
+		found bool
+	}{
+		{list: "CHAP,None", value: "None", found: true},
+		{list: "CHAP,None", value: "CHAP", found: true},
+		{list: "CHAP", value: "None", found: false},
+		{list: "CHAPX", value: "CHAP", found: false},
+		{list: "", value: "None", found: false},
+	}
+	for _, test := range tests {
+		if found := hasValue(test.list, test.value); found != test.found {
+			t.Errorf("hasValue(%q, %q) = %t", test.list, test.value, found)
+		}
+	}
+}
+
+func TestCHAPResponse(t *testing.T) {
+	// MD5(0x01 || "secret" || 0x0203)
+	want := []byte{0xf5, 0x06, 0xc2, 0x4f, 0x35, 0xd1, 0xc7, 0x0e, 0x45, 0x0e, 0xdb, 0x8f, 0xdf, 0x93, 0x34, 0x78}
+	if got := chapResponse(1, "secret", []byte{2, 3}); !bytes.Equal(got, want) {
+		t.Fatalf("response %x, want %x", got, want)
+	}
+}
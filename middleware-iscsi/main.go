@@ -0,0 +1,52 @@
+// Main package of middleware-iscsi
+package main
+
+import (
+	"fmt"
+	"os"
+
+	logging "quorumbd.net/common/logging"
+	app "quorumbd.net/middleware-common/app"
+	config "quorumbd.net/middleware-iscsi/internal/config"
+	implementation "quorumbd.net/middleware-iscsi/internal/implementation"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	// load and init config
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	// init logging
+	err = logging.Initialize(cfg.LoggingConfig)
+	if err != nil {
+		return err
+	}
+
+	impl := implementation.New(cfg, logging.GetDefaultLogger())
+
+	app, err := app.New(
+		impl,
+		cfg.ToMiddlewareConfig(),
+		app.WithLogger(logging.GetDefaultLogger()),
+		app.WithUUID(cfg.InstanceConfig.InstanceUUID()),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := app.RunUntilSignal(); err != nil {
+		return err
+	}
+
+	// terminate logging
+	return logging.CloseLogging()
+}
@@ -0,0 +1,185 @@
+// Package config provides configuration loading and validation
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	commonconfig "quorumbd.net/common/config"
+	middlewareconfig "quorumbd.net/middleware-common/config"
+	"quorumbd.net/middleware-nvmeof-tcp/internal/nvme"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+const configFileName = "middleware-nvmeof-tcp.toml"
+
+type nvmeofConfig struct {
+	Listen       []string          `toml:"listen"` // tcp://host:port
+	SubsystemNQN string            `toml:"subsystem_nqn"`
+	QueueDepth   int               `toml:"queue_depth"`   // Entries of every queue (MQES+1)
+	MaxIOQueues  int               `toml:"max_io_queues"` // I/O queues per controller
+	Namespaces   map[string]uint32 `toml:"namespaces"`    // Fixed NSIDs of exports, the others get the lowest free NSID on attach
+	AllowedHosts []string          `toml:"allowed_hosts"` // Host NQNs that may connect (empty: all hosts)
+}
+
+type Config struct {
+	CommonConfig         commonconfig.CommonConfig             `toml:"common"`
+	LoggingConfig        commonconfig.LoggingConfig            `toml:"logging"`
+	CoreConnectionConfig middlewareconfig.CoreConnectionConfig `toml:"coreconnection"`
+	InstanceConfig       middlewareconfig.InstanceConfig       `toml:"instance"`
+	NVMeoFConfig         nvmeofConfig                          `toml:"nvmeof"`
+	CacheConfig          middlewareconfig.CacheConfig          `toml:"cache"`
+}
+
+func (cfg *Config) ToMiddlewareConfig() *middlewareconfig.Config {
+	return &middlewareconfig.Config{
+		CommonConfig:         cfg.CommonConfig,
+		CoreConnectionConfig: cfg.CoreConnectionConfig,
+		CacheConfig:          cfg.CacheConfig,
+	}
+}
+
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
+	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_NVMEOFTCP_CONFIG")
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	return LoadFrom(configPath)
+}
+
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
+	var cfg Config
+
+	cfg.setDefaults()
+
+	if err := cfg.readConfig(configPath); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *Config) setDefaults() {
+	cfg.CommonConfig.SetDefaults()
+	cfg.LoggingConfig.SetDefaults()
+	cfg.CoreConnectionConfig.SetDefaults()
+	cfg.InstanceConfig.SetDefaults()
+	cfg.NVMeoFConfig.setDefaults()
+	cfg.CacheConfig.SetDefaults()
+}
+
+func (cfg *nvmeofConfig) setDefaults() {
+	cfg.Listen = []string{"tcp://:4420"}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	cfg.SubsystemNQN = "nqn.2025-01.net.quorumbd:" + strings.ToLower(hostname)
+	cfg.QueueDepth = 128
+	cfg.MaxIOQueues = 32
+}
+
+func (cfg *Config) validate() error {
+	commonErrors := cfg.CommonConfig.Validate()
+	loggingErrors := cfg.LoggingConfig.Validate()
+	coreConnectionErrors := cfg.CoreConnectionConfig.Validate()
+	instanceErrors := cfg.InstanceConfig.Validate()
+	nvmeofErrors := cfg.NVMeoFConfig.validate()
+	cacheErrors := cfg.CacheConfig.Validate()
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, instanceErrors, nvmeofErrors, cacheErrors)
+}
+
+func (cfg *nvmeofConfig) validate() error {
+	return validation.Errors{
+		"nvmeof": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.Listen, validation.Required.Error("nvmeof.listen required"), validation.Each(validation.By(validateTCPListenAddress))),
+			validation.Field(&cfg.SubsystemNQN, validation.Required.Error("nvmeof.subsystem_nqn required"), validation.By(validateSubsystemNQN)),
+			// The admin queue of Linux hosts has 32 entries
+			validation.Field(&cfg.QueueDepth, validation.Min(32).Error("nvmeof.queue_depth must be at least 32"), validation.Max(1024).Error("nvmeof.queue_depth must be at most 1024")),
+			validation.Field(&cfg.MaxIOQueues, validation.Min(1).Error("nvmeof.max_io_queues must be at least 1"), validation.Max(256).Error("nvmeof.max_io_queues must be at most 256")),
+			validation.Field(&cfg.Namespaces, validation.By(validateNamespaces)),
+			validation.Field(&cfg.AllowedHosts, validation.Each(validation.By(validateHostNQN))),
+		),
+	}.Filter()
+}
+
+// validNQN checks the format of an NVMe qualified name (NVMe base specification 4.5)
+func validNQN(name string) bool {
+	return strings.HasPrefix(name, "nqn.") && len(name) <= 223 && !strings.ContainsAny(name, " \x00")
+}
+
+func validateSubsystemNQN(value any) error {
+	name := value.(string)
+	if !validNQN(name) {
+		return fmt.Errorf("invalid nvmeof.subsystem_nqn %q", name)
+	}
+	if name == nvme.DiscoveryNQN {
+		return fmt.Errorf("nvmeof.subsystem_nqn must not be the discovery NQN")
+	}
+	return nil
+}
+
+func validateHostNQN(value any) error {
+	if name := value.(string); !validNQN(name) {
+		return fmt.Errorf("invalid host NQN %q in nvmeof.allowed_hosts", name)
+	}
+	return nil
+}
+
+func validateNamespaces(value any) error {
+	used := make(map[uint32]string)
+	for export, nsid := range value.(map[string]uint32) {
+		if nsid == 0 || nsid > nvme.MaxNSID {
+			return fmt.Errorf("nvmeof.namespaces: NSID %d of %q must be between 1 and %d", nsid, export, nvme.MaxNSID)
+		}
+		if other, ok := used[nsid]; ok {
+			return fmt.Errorf("nvmeof.namespaces: NSID %d is used by %q and %q", nsid, other, export)
+		}
+		used[nsid] = export
+	}
+	return nil
+}
+
+// TCPListenAddress returns host:port of a tcp:// listen URI
+func TCPListenAddress(uri string) (string, error) {
+	address, ok := strings.CutPrefix(uri, "tcp://")
+	if !ok {
+		return "", fmt.Errorf("listen address %q must start with tcp://", uri)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", uri, err)
+	}
+	return address, nil
+}
+
+func validateTCPListenAddress(value any) error {
+	_, err := TCPListenAddress(value.(string))
+	return err
+}
+
+func (cfg *Config) readConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
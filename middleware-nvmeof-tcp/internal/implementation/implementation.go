@@ -0,0 +1,198 @@
+// Package implementation implements the adaptor interface of middleware-common
+package implementation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-nvmeof-tcp/internal/config"
+	"quorumbd.net/middleware-nvmeof-tcp/internal/nvme"
+)
+
+type Implementation struct {
+	Config       *config.Config
+	Logger       *slog.Logger
+	target       *nvme.Target
+	listeners    []net.Listener
+	wg           sync.WaitGroup
+	namespacesMu sync.Mutex
+	namespaces   map[string]uint32 // NSIDs of the attached exports
+}
+
+func New(cfg *config.Config, logger *slog.Logger) *Implementation {
+	return &Implementation{
+		Config: cfg,
+		Logger: logger,
+		target: nvme.NewTarget(logger, nvme.Options{
+			SubsystemNQN: cfg.NVMeoFConfig.SubsystemNQN,
+			QueueDepth:   cfg.NVMeoFConfig.QueueDepth,
+			MaxIOQueues:  cfg.NVMeoFConfig.MaxIOQueues,
+			AllowedHosts: cfg.NVMeoFConfig.AllowedHosts,
+		}),
+		namespaces: make(map[string]uint32),
+	}
+}
+
+// GetImplementationName is an interface method of common-middleware.Adapter
+func (impl *Implementation) GetImplementationName() string {
+	return "nvmeof-tcp"
+}
+
+// IsServer is an interface method of common-middleware.Adapter
+func (impl *Implementation) IsServer() bool {
+	return true
+}
+
+// ListenAddresses is an interface method of common-middleware.Adapter
+func (impl *Implementation) ListenAddresses() []string {
+	return impl.Config.NVMeoFConfig.Listen
+}
+
+// Start is an interface method of common-middleware.Adapter
+func (impl *Implementation) Start(_ context.Context) error {
+	for _, uri := range impl.Config.NVMeoFConfig.Listen {
+		address, err := config.TCPListenAddress(uri)
+		if err != nil {
+			return err
+		}
+		ln, err := systemd.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		impl.listeners = append(impl.listeners, ln)
+		impl.wg.Go(func() {
+			if err := impl.target.Serve(ln); err != nil {
+				impl.Logger.Error("NVMe/TCP target failed", "address", ln.Addr().String(), "error", err)
+			}
+		})
+		impl.Logger.Info("Listening", "address", ln.Addr().String(), "subsystem", impl.Config.NVMeoFConfig.SubsystemNQN, "socket_activated", systemd.IsActivated(ln))
+	}
+	return nil
+}
+
+// Stop is an interface method of common-middleware.Adapter
+func (impl *Implementation) Stop(ctx context.Context) error {
+	if len(impl.listeners) == 0 {
+		return nil
+	}
+	var err error
+	for _, ln := range impl.listeners {
+		if closeErr := ln.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	impl.wg.Wait()
+	if shutdownErr := impl.target.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// AttachExport is an interface method of common-middleware.Adapter: the export becomes the namespace with its configured NSID or the lowest free one
+func (impl *Implementation) AttachExport(export backend.Export, blockBackend backend.BlockBackend) error {
+	impl.namespacesMu.Lock()
+	defer impl.namespacesMu.Unlock()
+
+	if _, ok := impl.namespaces[export.Name]; ok {
+		return fmt.Errorf("export %q is already attached", export.Name)
+	}
+	nsid, err := impl.assignNSID(export.Name)
+	if err != nil {
+		return err
+	}
+	if err := impl.target.AddNamespace(nvme.Namespace{
+		ID:        nsid,
+		Export:    export.Name,
+		VolumeID:  export.VolumeID,
+		ReadOnly:  export.ReadOnly,
+		BlockSize: export.BlockSize,
+		Backend:   blockBackend,
+	}); err != nil {
+		return err
+	}
+	impl.namespaces[export.Name] = nsid
+	impl.Logger.Info("Attached namespace", "export", export.Name, "nsid", nsid)
+	return nil
+}
+
+// assignNSID returns the configured NSID of an export, otherwise the lowest NSID that is neither used nor configured for another export
+func (impl *Implementation) assignNSID(name string) (uint32, error) {
+	configured := impl.Config.NVMeoFConfig.Namespaces
+	if nsid, ok := configured[name]; ok {
+		return nsid, nil
+	}
+
+	reserved := make(map[uint32]bool, len(impl.namespaces)+len(configured))
+	for _, nsid := range impl.namespaces {
+		reserved[nsid] = true
+	}
+	for _, nsid := range configured {
+		reserved[nsid] = true
+	}
+	for nsid := uint32(1); nsid <= nvme.MaxNSID; nsid++ {
+		if !reserved[nsid] {
+			return nsid, nil
+		}
+	}
+	return 0, fmt.Errorf("no free NSID for export %q", name)
+}
+
+// DetachExport is an interface method of common-middleware.Adapter. Commands executing on the namespace are completed first.
+func (impl *Implementation) DetachExport(name string) error {
+	impl.namespacesMu.Lock()
+	defer impl.namespacesMu.Unlock()
+
+	nsid, ok := impl.namespaces[name]
+	if !ok {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	delete(impl.namespaces, name)
+	impl.target.RemoveNamespace(nsid)
+	impl.Logger.Info("Detached namespace", "export", name, "nsid", nsid)
+	return nil
+}
+
+// Clients is an interface method of common-middleware.ClientReporter. Controllers reach all namespaces of the subsystem, so no export is reported.
+func (impl *Implementation) Clients() []commoncontrol.ClientInfo {
+	controllers := impl.target.Controllers()
+	clients := make([]commoncontrol.ClientInfo, 0, len(controllers))
+	for _, ctrl := range controllers {
+		client := commoncontrol.ClientInfo{
+			ID:           ctrl.ID,
+			RemoteAddr:   ctrl.RemoteAddr,
+			ConnectedAt:  uint64(ctrl.ConnectedAt.UnixMilli()),
+			Features:     []string{"host=" + ctrl.HostNQN, "io_queues=" + strconv.Itoa(ctrl.IOQueues)},
+			BytesRead:    ctrl.BytesRead,
+			BytesWritten: ctrl.BytesWritten,
+		}
+		if ctrl.HeaderDigest {
+			client.Features = append(client.Features, "header_digest")
+		}
+		if ctrl.DataDigest {
+			client.Features = append(client.Features, "data_digest")
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// DisconnectClient is an interface method of common-middleware.ClientReporter
+func (impl *Implementation) DisconnectClient(id uint64, _ string) error {
+	if !impl.target.Disconnect(id) {
+		return fmt.Errorf("no client with id %d", id)
+	}
+	return nil
+}
+
+// Status is an interface method of common-middleware.StatusReporter
+func (impl *Implementation) Status() string {
+	return fmt.Sprintf("%d namespaces, %d controllers", len(impl.target.Namespaces()), len(impl.target.Controllers()))
+}
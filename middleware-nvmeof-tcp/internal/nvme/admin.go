@@ -0,0 +1,225 @@
+package nvme
+
+import (
+	"crypto/sha256"
+	"math/bits"
+
+	"quorumbd.net/common/version"
+)
+
+// Identify controller or namespace structures (CNS values)
+const (
+	cnsNamespace            uint8 = 0x00
+	cnsController           uint8 = 0x01
+	cnsActiveNamespaces     uint8 = 0x02
+	cnsNamespaceDescriptors uint8 = 0x03
+	identifyLength                = 4096
+)
+
+// Log pages
+const (
+	logErrorInformation  uint8  = 0x01
+	logSMART             uint8  = 0x02
+	logFirmwareSlot      uint8  = 0x03
+	logChangedNamespaces uint8  = 0x04
+	logDiscovery         uint8  = 0x70
+	logRetainEvent       uint32 = 1 << 15
+)
+
+const (
+	modelNumber  = "QuorumBD"
+	lbaSize      = 512 // Size of logical blocks (the only LBA format)
+	lbaShift     = 9
+	dataUnitSize = 512000 // Data units of the SMART log page
+)
+
+func (q *queue) handleAdmin(cmd *command) *response {
+	switch cmd.opcode() {
+	case opIdentify:
+		return q.identify(cmd)
+	case opGetLogPage:
+		return q.getLogPage(cmd)
+	case opSetFeatures:
+		return q.ctrl.setFeatures(cmd)
+	case opGetFeatures:
+		return q.ctrl.getFeatures(cmd)
+	case opAsyncEventReq:
+		return q.ctrl.asyncEventRequest(cmd)
+	case opKeepAlive:
+		q.ctrl.keepAliveReceived()
+		return success(nil)
+	case opAbort:
+		return &response{result: 1} // Commands are never aborted, they complete on their own
+	default:
+		return failure(statusInvalidOpcode)
+	}
+}
+
+func (q *queue) identify(cmd *command) *response {
+	cns := uint8(cmd.cdw(10))
+	if q.ctrl.discovery && cns != cnsController {
+		return failure(statusInvalidField)
+	}
+
+	switch cns {
+	case cnsController:
+		return success(q.identifyController())
+	case cnsActiveNamespaces:
+		if cmd.nsid() >= namespaceAll-1 {
+			return failure(statusInvalidNamespace)
+		}
+		data := make([]byte, identifyLength)
+		position := 0
+		for _, id := range q.target.Namespaces() {
+			if id > cmd.nsid() && position < identifyLength {
+				le.PutUint32(data[position:], id)
+				position += 4
+			}
+		}
+		return success(data)
+	case cnsNamespace, cnsNamespaceDescriptors:
+		if cmd.nsid() == 0 || cmd.nsid() > MaxNSID {
+			return failure(statusInvalidNamespace)
+		}
+		ns := q.target.acquireNamespace(cmd.nsid())
+		if ns == nil {
+			if cns == cnsNamespace {
+				return success(make([]byte, identifyLength)) // Inactive namespaces are zero filled
+			}
+			return failure(statusInvalidNamespace)
+		}
+		defer ns.inFlight.Done()
+		if cns == cnsNamespace {
+			return success(identifyNamespace(ns))
+		}
+		data := make([]byte, identifyLength)
+		nguid := namespaceGUID(ns)
+		data[0], data[1] = 0x02, byte(len(nguid)) // Namespace globally unique identifier
+		copy(data[4:], nguid[:])
+		return success(data)
+	default:
+		return failure(statusInvalidField)
+	}
+}
+
+func (q *queue) identifyController() []byte {
+	ctrl := q.ctrl
+	data := make([]byte, identifyLength)
+	putString(data[4:24], q.target.serialNumber)
+	putString(data[24:64], modelNumber)
+	putString(data[64:72], version.Version)
+	data[72] = 6 // Recommended arbitration burst
+	le.PutUint16(data[78:80], ctrl.id)
+	le.PutUint32(data[80:84], nvmeVersion)
+	data[258] = 3                     // Abort command limit (0's based)
+	data[259] = asyncEventLimit - 1   // Asynchronous event request limit (0's based)
+	data[261] = 0x04                  // Log page offsets
+	le.PutUint16(data[320:322], 10)   // Keep alive granularity of 1 s
+	data[512], data[513] = 0x66, 0x44 // SQE and CQE sizes
+	le.PutUint16(data[514:516], uint16(q.target.options.QueueDepth))
+	le.PutUint32(data[536:540], 1|1<<20) // SGLs with offsets of in-capsule data
+	le.PutUint32(data[1792:1796], (sqeSize+maxInCapsuleData)/16)
+	le.PutUint32(data[1796:1800], cqeSize/16)
+	data[1803] = 1 // A single SGL descriptor per command
+	if ctrl.discovery {
+		data[111] = 2 // Discovery controller
+		copy(data[768:1024], DiscoveryNQN)
+		return data
+	}
+
+	data[76] = 0x02                                                // The subsystem has multiple controllers
+	data[77] = uint8(bits.TrailingZeros32(maxTransferSize / 4096)) // Maximum data transfer size in minimum page sizes
+	le.PutUint32(data[92:96], aecNamespaceAttribute)               // Namespace attribute notices
+	data[111] = 1                                                  // I/O controller
+	le.PutUint32(data[516:520], MaxNSID)
+	le.PutUint16(data[520:522], 0x0c) // Dataset management and write zeroes
+	data[525] = 0x01                  // Volatile write cache
+	copy(data[768:1024], q.target.options.SubsystemNQN)
+	return data
+}
+
+func identifyNamespace(ns *namespace) []byte {
+	data := make([]byte, identifyLength)
+	blocks := uint64(ns.Backend.Size()) >> lbaShift
+	le.PutUint64(data[0:8], blocks)
+	le.PutUint64(data[8:16], blocks)
+	le.PutUint64(data[16:24], blocks)
+	data[24] = 0x11 // Thin provisioning, preferred granularities
+	data[30] = 0x01 // Namespace may be attached to multiple controllers
+	data[33] = 0x09 // Deallocated blocks read as zeroes, write zeroes deallocates
+	granularity := uint16(physicalBlockLBAs(ns) - 1)
+	for _, offset := range []int{64, 66, 68, 70, 72} { // Write and deallocate granularity and alignment, optimal write size
+		le.PutUint16(data[offset:offset+2], granularity)
+	}
+	if ns.ReadOnly {
+		data[99] = 0x01 // Write protected
+	}
+	nguid := namespaceGUID(ns)
+	copy(data[104:120], nguid[:])
+	le.PutUint32(data[128:132], lbaShift<<16) // LBA format 0 without metadata
+	return data
+}
+
+// physicalBlockLBAs returns the logical blocks per internal block of the volume
+func physicalBlockLBAs(ns *namespace) uint32 {
+	if ns.BlockSize <= lbaSize || ns.BlockSize&(ns.BlockSize-1) != 0 {
+		return 1
+	}
+	return min(ns.BlockSize/lbaSize, 1<<16)
+}
+
+// namespaceGUID derives the namespace globally unique identifier from the volume, so it is the same on every node
+func namespaceGUID(ns *namespace) [16]byte {
+	id := ns.VolumeID
+	if id == "" {
+		id = ns.Export
+	}
+	sum := sha256.Sum256([]byte(id))
+	return [16]byte(sum[:16])
+}
+
+func (q *queue) getLogPage(cmd *command) *response {
+	lid := uint8(cmd.cdw(10))
+	length := (int(cmd.cdw(11)&0xffff)<<16 | int(cmd.cdw(10)>>16) + 1) * 4
+	offset := uint64(cmd.cdw(13))<<32 | uint64(cmd.cdw(12))
+
+	var page []byte
+	switch {
+	case q.ctrl.discovery && lid == logDiscovery:
+		page = q.discoveryLog()
+	case q.ctrl.discovery:
+		return failure(statusInvalidLogPage)
+	case lid == logErrorInformation:
+		page = make([]byte, 64) // No errors are recorded
+	case lid == logSMART:
+		page = q.smartLog()
+	case lid == logFirmwareSlot:
+		page = make([]byte, 512)
+		page[0] = 1 // Active firmware slot
+		putString(page[8:16], version.Version)
+	case lid == logChangedNamespaces:
+		page = make([]byte, 4096)
+		for i, id := range q.ctrl.readChangedNamespaces(cmd.cdw(10)&logRetainEvent != 0) {
+			le.PutUint32(page[i*4:], id)
+		}
+	default:
+		return failure(statusInvalidLogPage)
+	}
+
+	if offset%4 != 0 || offset > uint64(len(page)) {
+		return failure(statusInvalidField)
+	}
+	data := make([]byte, min(length, int(cmd.sglLength())))
+	copy(data, page[offset:])
+	return success(data)
+}
+
+// smartLog returns the SMART / health information: no warnings, all spares available and the data transferred by the controller
+func (q *queue) smartLog() []byte {
+	page := make([]byte, 512)
+	page[3] = 100 // Available spare
+	page[4] = 10  // Available spare threshold
+	le.PutUint64(page[32:40], (q.ctrl.bytesRead.Load()+dataUnitSize-1)/dataUnitSize)
+	le.PutUint64(page[48:56], (q.ctrl.bytesWritten.Load()+dataUnitSize-1)/dataUnitSize)
+	return page
+}
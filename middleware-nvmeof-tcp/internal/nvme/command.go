@@ -0,0 +1,151 @@
+package nvme
+
+const (
+	sqeSize = 64
+	cqeSize = 16
+)
+
+// Admin command opcodes
+const (
+	opGetLogPage       uint8 = 0x02
+	opIdentify         uint8 = 0x06
+	opAbort            uint8 = 0x08
+	opSetFeatures      uint8 = 0x09
+	opGetFeatures      uint8 = 0x0a
+	opAsyncEventReq    uint8 = 0x0c
+	opKeepAlive        uint8 = 0x18
+	opFabrics          uint8 = 0x7f
+	opcodeDataTransfer uint8 = 0x03 // Data transfer direction bits of opcodes and fabrics command types
+	transferHostToCtrl uint8 = 0x01
+	transferCtrlToHost uint8 = 0x02
+)
+
+// NVM command set opcodes
+const (
+	opFlush             uint8 = 0x00
+	opWrite             uint8 = 0x01
+	opRead              uint8 = 0x02
+	opWriteZeroes       uint8 = 0x08
+	opDatasetManagement uint8 = 0x09
+)
+
+// Fabrics command types
+const (
+	fctypePropertySet uint8 = 0x00
+	fctypeConnect     uint8 = 0x01
+	fctypePropertyGet uint8 = 0x04
+	fctypeDisconnect  uint8 = 0x08
+)
+
+// SGL descriptor types (type in the high nibble, subtype in the low nibble)
+const (
+	sglDataBlockOffset     uint8  = 0x01 // In-capsule data
+	sglTransportDataBlock  uint8  = 0x5a // Data transferred by R2T and H2CData or by C2HData
+	namespaceAll           uint32 = 0xffffffff
+	dynamicControllerID    uint16 = 0xffff
+	disabledSQFlowControl  uint16 = 0xffff  // SQ head pointer, if the host disabled SQ flow control
+	connectDisableSQFlow   uint8  = 0x04    // Connect command attribute
+	invalidParameterInData uint64 = 1 << 16 // Invalid parameter of a connect command in the data instead of the SQE
+)
+
+// Status codes: status code type in the high byte, status code in the low byte
+const (
+	statusSuccess                 uint16 = 0x000
+	statusInvalidOpcode           uint16 = 0x001
+	statusInvalidField            uint16 = 0x002
+	statusDataTransferError       uint16 = 0x004
+	statusInternalError           uint16 = 0x006
+	statusAbortedByRequest        uint16 = 0x007
+	statusInvalidNamespace        uint16 = 0x00b
+	statusCommandSequenceError    uint16 = 0x00c
+	statusDataSGLLengthInvalid    uint16 = 0x00f
+	statusSGLTypeInvalid          uint16 = 0x011
+	statusNamespaceWriteProtected uint16 = 0x020
+	statusTransientTransportError uint16 = 0x022
+	statusLBAOutOfRange           uint16 = 0x080
+	statusCapacityExceeded        uint16 = 0x081
+	statusNamespaceNotReady       uint16 = 0x082
+	statusAERLimitExceeded        uint16 = 0x105
+	statusInvalidLogPage          uint16 = 0x109
+	statusFeatureNotSaveable      uint16 = 0x10d
+	statusConnectIncompatible     uint16 = 0x180
+	statusConnectInvalidParameter uint16 = 0x182
+	statusConnectInvalidHost      uint16 = 0x184
+	statusWriteFault              uint16 = 0x280
+	statusUnrecoveredReadError    uint16 = 0x281
+)
+
+// command is a submission queue entry with the data the host transferred for it
+type command struct {
+	sqe  [sqeSize]byte
+	data []byte
+}
+
+func (cmd *command) opcode() uint8 {
+	return cmd.sqe[0]
+}
+
+func (cmd *command) cid() uint16 {
+	return le.Uint16(cmd.sqe[2:4])
+}
+
+func (cmd *command) nsid() uint32 {
+	return le.Uint32(cmd.sqe[4:8])
+}
+
+// fctype returns the command type of fabrics commands (in place of the NSID)
+func (cmd *command) fctype() uint8 {
+	return cmd.sqe[4]
+}
+
+// cdw returns command dword n (10 to 15 are the command specific dwords)
+func (cmd *command) cdw(n int) uint32 {
+	return le.Uint32(cmd.sqe[4*n:])
+}
+
+func (cmd *command) sglType() uint8 {
+	return cmd.sqe[39]
+}
+
+func (cmd *command) sglLength() uint32 {
+	return le.Uint32(cmd.sqe[32:36])
+}
+
+func (cmd *command) sglAddress() uint64 {
+	return le.Uint64(cmd.sqe[24:32])
+}
+
+// transfer returns the data transfer direction of the command
+func (cmd *command) transfer() uint8 {
+	if cmd.opcode() == opFabrics {
+		return cmd.fctype() & opcodeDataTransfer
+	}
+	return cmd.opcode() & opcodeDataTransfer
+}
+
+// response is the completion of a command
+type response struct {
+	result uint64 // Command specific dwords 0 and 1
+	status uint16
+	data   []byte // Controller to host data, truncated to the data length of the command
+}
+
+func success(data []byte) *response {
+	return &response{data: data}
+}
+
+func failure(status uint16) *response {
+	return &response{status: status}
+}
+
+// statusField returns the status field of a completion queue entry (phase tag 0). Errors that may succeed on a
+// retry are the only ones without the do not retry bit.
+func statusField(status uint16) uint16 {
+	field := (status&0x700)<<1 | (status&0xff)<<1
+	switch status {
+	case statusSuccess, statusNamespaceNotReady, statusTransientTransportError, statusInternalError, statusAbortedByRequest:
+	default:
+		field |= 0x8000
+	}
+	return field
+}
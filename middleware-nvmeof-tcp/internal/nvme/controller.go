@@ -0,0 +1,380 @@
+package nvme
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Controller properties
+const (
+	propertyCAP  uint32 = 0x00
+	propertyVS   uint32 = 0x08
+	propertyCC   uint32 = 0x14
+	propertyCSTS uint32 = 0x1c
+)
+
+// Controller configuration and status bits
+const (
+	ccEnable              uint32 = 0x01
+	ccShutdown            uint32 = 0xc000
+	cstsReady             uint32 = 0x01
+	cstsShutdownMask      uint32 = 0x0c
+	cstsShutdownOccurring uint32 = 0x04
+	cstsShutdownComplete  uint32 = 0x08
+	nvmeVersion           uint32 = 0x00010300 // 1.3
+)
+
+// Features
+const (
+	featureVolatileWriteCache uint8  = 0x06
+	featureNumberOfQueues     uint8  = 0x07
+	featureAsyncEventConfig   uint8  = 0x0b
+	featureKeepAliveTimer     uint8  = 0x0f
+	featureSave               uint32 = 1 << 31
+	featureSelectSupported    uint32 = 3
+)
+
+// Asynchronous events
+const (
+	asyncEventLimit                = 4        // Outstanding asynchronous event requests (reported 0's based)
+	aecNamespaceAttribute   uint32 = 1 << 8   // Namespace attribute notices are enabled
+	eventNamespaceAttribute uint64 = 0x040002 // Notice of a namespace attribute change, changed namespace list log page
+	maxChangedNamespaces           = 1024
+)
+
+// controller is a controller of the subsystem or a discovery controller, it lives as long as its admin queue
+type controller struct {
+	id          uint16
+	target      *Target
+	logger      *slog.Logger
+	admin       *queue
+	discovery   bool
+	hostNQN     string
+	hostID      [16]byte
+	connectedAt time.Time
+
+	mu                sync.Mutex
+	cc                uint32
+	csts              uint32
+	ioQueues          map[uint16]*queue
+	numIOQueues       int // Granted by the number of queues feature
+	kato              time.Duration
+	keepAlive         *time.Timer
+	asyncEventConfig  uint32
+	asyncEvents       []*command // Outstanding asynchronous event requests
+	changedNamespaces []uint32
+	noticePending     bool // A namespace attribute notice waits for an asynchronous event request
+	noticeMasked      bool // Notices are masked until the changed namespace list is read
+	closed            bool
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+func newController(target *Target, id uint16, admin *queue, discovery bool, hostNQN string, hostID [16]byte, kato time.Duration) *controller {
+	ctrl := &controller{
+		id:          id,
+		target:      target,
+		logger:      admin.logger.With("cntlid", id),
+		admin:       admin,
+		discovery:   discovery,
+		hostNQN:     hostNQN,
+		hostID:      hostID,
+		connectedAt: time.Now(),
+		ioQueues:    make(map[uint16]*queue),
+		numIOQueues: target.options.MaxIOQueues,
+	}
+	ctrl.setKeepAliveLocked(kato)
+	return ctrl
+}
+
+func (c *controller) info() ControllerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ControllerInfo{
+		ID:           c.admin.id,
+		ControllerID: c.id,
+		HostNQN:      c.hostNQN,
+		RemoteAddr:   c.admin.netConn.RemoteAddr().String(),
+		ConnectedAt:  c.connectedAt,
+		IOQueues:     len(c.ioQueues),
+		HeaderDigest: c.admin.framing.headerDigest,
+		DataDigest:   c.admin.framing.dataDigest,
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+	}
+}
+
+// ready returns true, if the host enabled the controller
+func (c *controller) ready() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.csts&cstsReady != 0
+}
+
+// addIOQueue registers a connected I/O queue
+func (c *controller) addIOQueue(qid uint16, q *queue) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		return statusConnectInvalidParameter
+	case c.csts&cstsReady == 0:
+		return statusCommandSequenceError
+	case c.discovery || int(qid) > c.numIOQueues:
+		return statusConnectInvalidParameter
+	}
+	if _, ok := c.ioQueues[qid]; ok {
+		return statusConnectInvalidParameter
+	}
+	c.ioQueues[qid] = q
+	return statusSuccess
+}
+
+// queueClosed removes a closed queue. The controller ends with its admin queue, closing its I/O queues.
+func (c *controller) queueClosed(q *queue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if q != c.admin {
+		if c.ioQueues[q.qid] == q {
+			delete(c.ioQueues, q.qid)
+		}
+		return
+	}
+
+	c.closed = true
+	c.closeIOQueuesLocked()
+	if c.keepAlive != nil {
+		c.keepAlive.Stop()
+	}
+	c.asyncEvents = nil
+	c.target.removeController(c)
+	if !c.discovery {
+		c.logger.Info("Controller disconnected")
+	}
+}
+
+func (c *controller) closeIOQueuesLocked() {
+	for _, q := range c.ioQueues {
+		q.close()
+	}
+	clear(c.ioQueues)
+}
+
+// getProperty returns a controller property
+func (c *controller) getProperty(offset uint32, eightBytes bool) (uint64, uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case offset == propertyCAP && eightBytes:
+		// MQES, contiguous queues required, timeout of 15 s, NVM command set, 4 KiB pages
+		return uint64(c.target.options.QueueDepth-1) | 1<<16 | 30<<24 | 1<<37, statusSuccess
+	case offset == propertyVS && !eightBytes:
+		return uint64(nvmeVersion), statusSuccess
+	case offset == propertyCC && !eightBytes:
+		return uint64(c.cc), statusSuccess
+	case offset == propertyCSTS && !eightBytes:
+		return uint64(c.csts), statusSuccess
+	default:
+		return 0, statusInvalidField
+	}
+}
+
+// setProperty changes the controller configuration: enabling makes the controller ready, disabling resets it and a
+// shutdown notification flushes the namespaces
+func (c *controller) setProperty(offset uint32, value uint64, eightBytes bool) uint16 {
+	if offset != propertyCC || eightBytes {
+		return statusInvalidField
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cc := uint32(value)
+	previous := c.cc
+	c.cc = cc
+	switch {
+	case cc&ccEnable != 0 && previous&ccEnable == 0:
+		c.csts = cstsReady
+	case cc&ccEnable == 0 && previous&ccEnable != 0:
+		c.logger.Debug("Controller reset")
+		c.csts = 0
+		c.closeIOQueuesLocked()
+		c.asyncEvents = nil
+	}
+	if cc&ccShutdown != 0 && previous&ccShutdown == 0 {
+		c.csts = c.csts&^cstsShutdownMask | cstsShutdownOccurring
+		c.admin.wg.Go(c.shutdown)
+	}
+	return statusSuccess
+}
+
+// shutdown flushes the namespaces after a shutdown notification of the host
+func (c *controller) shutdown() {
+	if !c.discovery {
+		for _, id := range c.target.Namespaces() {
+			ns := c.target.acquireNamespace(id)
+			if ns == nil {
+				continue
+			}
+			if err := ns.Backend.Flush(c.admin.ctx); err != nil {
+				c.logger.Warn("Flush on shutdown failed", "nsid", id, "error", err)
+			}
+			ns.inFlight.Done()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.csts = c.csts&^cstsShutdownMask | cstsShutdownComplete
+}
+
+// setKeepAliveLocked starts the keep alive timer. The host has to send a keep alive command within its timeout;
+// the controller waits twice as long, as hosts send them just in time.
+func (c *controller) setKeepAliveLocked(kato time.Duration) {
+	if c.keepAlive != nil {
+		c.keepAlive.Stop()
+		c.keepAlive = nil
+	}
+	c.kato = kato
+	if kato > 0 {
+		c.keepAlive = time.AfterFunc(2*kato, func() {
+			c.logger.Warn("Keep alive timeout expired", "kato", kato)
+			c.admin.close()
+		})
+	}
+}
+
+func (c *controller) keepAliveReceived() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keepAlive != nil {
+		c.keepAlive.Reset(2 * c.kato)
+	}
+}
+
+func (c *controller) setFeatures(cmd *command) *response {
+	if cmd.cdw(10)&featureSave != 0 {
+		return failure(statusFeatureNotSaveable)
+	}
+	value := cmd.cdw(11)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch uint8(cmd.cdw(10)) {
+	case featureNumberOfQueues:
+		if c.discovery {
+			return failure(statusInvalidField)
+		}
+		requested := int(max(value&0xffff, value>>16))
+		if requested == 0xffff {
+			return failure(statusInvalidField)
+		}
+		c.numIOQueues = min(requested+1, c.target.options.MaxIOQueues)
+		return &response{result: c.numberOfQueuesLocked()}
+	case featureAsyncEventConfig:
+		c.asyncEventConfig = value
+		return success(nil)
+	case featureKeepAliveTimer:
+		c.setKeepAliveLocked(time.Duration(value) * time.Millisecond)
+		return success(nil)
+	case featureVolatileWriteCache:
+		if c.discovery || value&1 == 0 {
+			return failure(statusInvalidField) // The write cache cannot be disabled
+		}
+		return success(nil)
+	default:
+		return failure(statusInvalidField)
+	}
+}
+
+func (c *controller) getFeatures(cmd *command) *response {
+	if (cmd.cdw(10)>>8)&0x07 == featureSelectSupported {
+		return success(nil) // No feature is saveable or namespace specific
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch uint8(cmd.cdw(10)) {
+	case featureNumberOfQueues:
+		if c.discovery {
+			return failure(statusInvalidField)
+		}
+		return &response{result: c.numberOfQueuesLocked()}
+	case featureAsyncEventConfig:
+		return &response{result: uint64(c.asyncEventConfig)}
+	case featureKeepAliveTimer:
+		return &response{result: uint64(c.kato / time.Millisecond)}
+	case featureVolatileWriteCache:
+		if c.discovery {
+			return failure(statusInvalidField)
+		}
+		return &response{result: 1}
+	default:
+		return failure(statusInvalidField)
+	}
+}
+
+// numberOfQueuesLocked returns the granted submission and completion queues (0's based)
+func (c *controller) numberOfQueuesLocked() uint64 {
+	n := uint64(c.numIOQueues - 1)
+	return n | n<<16
+}
+
+// asyncEventRequest keeps an asynchronous event request until an event occurs. A pending event completes it right away.
+func (c *controller) asyncEventRequest(cmd *command) *response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.noticePending && !c.noticeMasked {
+		c.noticePending = false
+		c.noticeMasked = true
+		return &response{result: eventNamespaceAttribute}
+	}
+	if len(c.asyncEvents) >= asyncEventLimit {
+		return failure(statusAERLimitExceeded)
+	}
+	c.asyncEvents = append(c.asyncEvents, cmd)
+	return nil
+}
+
+// namespaceChanged records a namespace change for the changed namespace list and notifies the host, if it enabled notices
+func (c *controller) namespaceChanged(id uint32) {
+	c.mu.Lock()
+	switch {
+	case len(c.changedNamespaces) >= maxChangedNamespaces:
+		c.changedNamespaces = []uint32{namespaceAll} // The list overflowed
+	case !slices.Contains(c.changedNamespaces, id):
+		c.changedNamespaces = append(c.changedNamespaces, id)
+	}
+	if c.asyncEventConfig&aecNamespaceAttribute == 0 || c.noticeMasked || c.csts&cstsReady == 0 {
+		c.mu.Unlock()
+		return
+	}
+	if len(c.asyncEvents) == 0 {
+		c.noticePending = true
+		c.mu.Unlock()
+		return
+	}
+	cmd := c.asyncEvents[0]
+	c.asyncEvents = c.asyncEvents[1:]
+	c.noticeMasked = true
+	c.mu.Unlock()
+
+	if err := c.admin.complete(cmd, &response{result: eventNamespaceAttribute}); err != nil {
+		c.admin.fail(err)
+	}
+}
+
+// readChangedNamespaces returns the changed namespace list. Unless the host retains the event, the list is cleared
+// and notices are unmasked.
+func (c *controller) readChangedNamespaces(retain bool) []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := slices.Clone(c.changedNamespaces)
+	slices.Sort(list)
+	if !retain {
+		c.changedNamespaces = nil
+		c.noticeMasked = false
+	}
+	return list
+}
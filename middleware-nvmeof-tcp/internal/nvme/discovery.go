@@ -0,0 +1,46 @@
+package nvme
+
+import (
+	"net"
+	"strconv"
+)
+
+// Discovery log page
+const (
+	discoveryHeaderLength       = 1024
+	discoveryEntryLength        = 1024
+	transportTCP          uint8 = 3
+	addressFamilyIPv4     uint8 = 1
+	addressFamilyIPv6     uint8 = 2
+	subtypeNVMSubsystem   uint8 = 2
+)
+
+// discoveryLog returns the discovery log page with the subsystem at the address the host connected to.
+// Hosts that may not connect to the subsystem get an empty log.
+func (q *queue) discoveryLog() []byte {
+	addr, ok := q.netConn.LocalAddr().(*net.TCPAddr)
+	if !ok || !q.target.allowedHost(q.ctrl.hostNQN) {
+		page := make([]byte, discoveryHeaderLength)
+		le.PutUint64(page[0:8], 1) // Generation counter
+		return page
+	}
+
+	page := make([]byte, discoveryHeaderLength+discoveryEntryLength)
+	le.PutUint64(page[0:8], 1)  // Generation counter, the log never changes
+	le.PutUint64(page[8:16], 1) // Number of records
+	entry := page[discoveryHeaderLength:]
+	entry[0] = transportTCP
+	entry[1] = addressFamilyIPv6
+	if addr.IP.To4() != nil {
+		entry[1] = addressFamilyIPv4
+	}
+	entry[2] = subtypeNVMSubsystem
+	entry[3] = 0x06             // Secure channel not required, SQ flow control can be disabled
+	le.PutUint16(entry[4:6], 1) // Port ID
+	le.PutUint16(entry[6:8], dynamicControllerID)
+	le.PutUint16(entry[8:10], uint16(q.target.options.QueueDepth)) // Maximum admin queue size
+	putString(entry[32:64], strconv.Itoa(addr.Port))
+	copy(entry[256:512], q.target.options.SubsystemNQN)
+	putString(entry[512:768], addr.IP.String())
+	return page
+}
@@ -0,0 +1,139 @@
+package nvme
+
+import (
+	"time"
+)
+
+// Connect data layout
+const (
+	connectDataLength    = 1024
+	connectHostIDOffset  = 0
+	connectCNTLIDOffset  = 16
+	connectSubNQNOffset  = 256
+	connectHostNQNOffset = 512
+	nqnFieldLength       = 256
+)
+
+// Connect command fields (offsets in the SQE)
+const (
+	connectQIDOffset    = 42
+	connectSQSizeOffset = 44
+)
+
+// handleFabrics executes the fabrics commands. Connect is the only command accepted before the queue is connected.
+func (q *queue) handleFabrics(cmd *command) *response {
+	if cmd.fctype() == fctypeConnect {
+		if q.ctrl != nil {
+			return failure(statusCommandSequenceError)
+		}
+		return q.connect(cmd)
+	}
+	if q.ctrl == nil {
+		return failure(statusCommandSequenceError)
+	}
+
+	switch cmd.fctype() {
+	case fctypePropertyGet:
+		if q.qid != 0 {
+			return failure(statusInvalidField)
+		}
+		value, status := q.ctrl.getProperty(cmd.cdw(11), cmd.sqe[40]&0x07 != 0)
+		return &response{result: value, status: status}
+	case fctypePropertySet:
+		if q.qid != 0 {
+			return failure(statusInvalidField)
+		}
+		return failure(q.ctrl.setProperty(cmd.cdw(11), le.Uint64(cmd.sqe[48:56]), cmd.sqe[40]&0x07 != 0))
+	case fctypeDisconnect:
+		if q.qid == 0 {
+			return failure(statusInvalidField) // The admin queue is disconnected by a shutdown of the controller
+		}
+		return success(nil)
+	default:
+		return failure(statusInvalidOpcode)
+	}
+}
+
+// connect binds the queue to a controller: the admin queue creates a new controller of the subsystem or a
+// discovery controller, I/O queues join the controller of their admin queue
+func (q *queue) connect(cmd *command) *response {
+	if recfmt := le.Uint16(cmd.sqe[40:42]); recfmt != 0 {
+		return failure(statusConnectIncompatible)
+	}
+	if len(cmd.data) < connectDataLength {
+		return failure(statusDataSGLLengthInvalid)
+	}
+	qid := le.Uint16(cmd.sqe[connectQIDOffset:])
+	size := int(le.Uint16(cmd.sqe[connectSQSizeOffset:])) + 1
+	kato := time.Duration(cmd.cdw(12)) * time.Millisecond
+	var hostID [16]byte
+	copy(hostID[:], cmd.data[connectHostIDOffset:])
+	cntlid := le.Uint16(cmd.data[connectCNTLIDOffset:])
+	subNQN := cString(cmd.data[connectSubNQNOffset : connectSubNQNOffset+nqnFieldLength])
+	hostNQN := cString(cmd.data[connectHostNQNOffset : connectHostNQNOffset+nqnFieldLength])
+
+	discovery := subNQN == DiscoveryNQN
+	switch {
+	case !discovery && subNQN != q.target.options.SubsystemNQN:
+		q.logger.Warn("Connect to unknown subsystem", "nqn", subNQN, "host", hostNQN)
+		return invalidConnectParameter(connectSubNQNOffset, true)
+	case !discovery && !q.target.allowedHost(hostNQN):
+		q.logger.Warn("Connect of a host that is not allowed", "host", hostNQN)
+		return &response{result: invalidParameterInData | connectHostNQNOffset, status: statusConnectInvalidHost}
+	case size < 2 || size > q.target.options.QueueDepth:
+		return invalidConnectParameter(connectSQSizeOffset, false)
+	}
+
+	q.logger = q.logger.With("host", hostNQN, "qid", qid)
+	if qid == 0 {
+		if cntlid != dynamicControllerID {
+			return invalidConnectParameter(connectCNTLIDOffset, true)
+		}
+		ctrl := q.target.newController(q, discovery, hostNQN, hostID, kato)
+		if ctrl == nil {
+			return failure(statusInternalError)
+		}
+		q.ctrl = ctrl
+		q.logger = q.logger.With("cntlid", ctrl.id)
+		if discovery {
+			q.logger.Debug("Discovery controller connected")
+		} else {
+			q.logger.Info("Controller connected")
+		}
+	} else {
+		ctrl := q.target.controller(cntlid)
+		if ctrl == nil || ctrl.discovery != discovery || ctrl.hostNQN != hostNQN || ctrl.hostID != hostID {
+			return invalidConnectParameter(connectCNTLIDOffset, true)
+		}
+		if status := ctrl.addIOQueue(qid, q); status != statusSuccess {
+			if status == statusConnectInvalidParameter {
+				return invalidConnectParameter(connectQIDOffset, false)
+			}
+			return failure(status)
+		}
+		q.ctrl = ctrl
+		q.logger = q.logger.With("cntlid", ctrl.id)
+		q.logger.Debug("I/O queue connected")
+	}
+
+	q.writeMu.Lock()
+	q.qid = qid
+	q.size = size
+	q.sqFlowControl = cmd.sqe[46]&connectDisableSQFlow == 0
+	q.sqhd = uint16(1 % size)
+	q.writeMu.Unlock()
+
+	if err := q.netConn.SetDeadline(time.Time{}); err != nil {
+		q.logger.Warn("Cannot clear connect deadline", "error", err)
+	}
+	return &response{result: uint64(q.ctrl.id)}
+}
+
+// invalidConnectParameter returns the offset of the invalid parameter in the SQE or in the connect data
+func invalidConnectParameter(offset uint64, inData bool) *response {
+	resp := &response{result: offset, status: statusConnectInvalidParameter}
+	if inData {
+		resp.result |= invalidParameterInData
+	}
+	return resp
+}
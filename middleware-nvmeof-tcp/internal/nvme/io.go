@@ -0,0 +1,197 @@
+package nvme
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// Command dword bits of the NVM command set
+const (
+	cdw12ForceUnitAccess uint32 = 1 << 30 // Read, write and write zeroes
+	cdw12Deallocate      uint32 = 1 << 25 // Write zeroes
+	dsmDeallocate        uint32 = 1 << 2  // Dataset management (command dword 11)
+	dsmRangeLength              = 16
+)
+
+func (q *queue) handleIO(cmd *command) *response {
+	if cmd.opcode() == opFlush && cmd.nsid() == namespaceAll {
+		return q.flushAll()
+	}
+	ns := q.target.acquireNamespace(cmd.nsid())
+	if ns == nil {
+		return failure(statusInvalidNamespace)
+	}
+	defer ns.inFlight.Done()
+
+	switch cmd.opcode() {
+	case opRead:
+		return q.read(ns, cmd)
+	case opWrite:
+		return q.write(ns, cmd)
+	case opFlush:
+		return q.backendResponse(ns.Backend.Flush(q.ctx), true)
+	case opWriteZeroes:
+		return q.writeZeroes(ns, cmd)
+	case opDatasetManagement:
+		return q.datasetManagement(ns, cmd)
+	default:
+		return failure(statusInvalidOpcode)
+	}
+}
+
+// blockRange returns the byte range of the starting LBA and the number of logical blocks (0's based) of a command
+func blockRange(cmd *command) (int64, int64) {
+	slba := uint64(cmd.cdw(11))<<32 | uint64(cmd.cdw(10))
+	length := int64(cmd.cdw(12)&0xffff+1) << lbaShift
+	if slba > math.MaxInt64>>lbaShift {
+		return -1, length // Out of range of every namespace
+	}
+	return int64(slba) << lbaShift, length
+}
+
+func (q *queue) read(ns *namespace, cmd *command) *response {
+	off, length := blockRange(cmd)
+	if length > int64(cmd.sglLength()) {
+		return failure(statusDataSGLLengthInvalid)
+	}
+	if err := backend.CheckRange(ns.Backend.Size(), off, length); err != nil {
+		return failure(statusLBAOutOfRange)
+	}
+	data := make([]byte, length)
+	if err := ns.Backend.ReadAt(q.ctx, data, off); err != nil {
+		return q.backendResponse(err, false)
+	}
+	q.ctrl.bytesRead.Add(uint64(length))
+	return success(data)
+}
+
+func (q *queue) write(ns *namespace, cmd *command) *response {
+	if ns.ReadOnly {
+		return failure(statusNamespaceWriteProtected)
+	}
+	off, length := blockRange(cmd)
+	if int64(len(cmd.data)) != length {
+		return failure(statusDataSGLLengthInvalid)
+	}
+	if err := backend.CheckRange(ns.Backend.Size(), off, length); err != nil {
+		return failure(statusLBAOutOfRange)
+	}
+	var flags backend.Flags
+	if cmd.cdw(12)&cdw12ForceUnitAccess != 0 {
+		flags |= backend.FlagFUA
+	}
+	if err := ns.Backend.WriteAt(q.ctx, cmd.data, off, flags); err != nil {
+		return q.backendResponse(err, true)
+	}
+	q.ctrl.bytesWritten.Add(uint64(length))
+	return success(nil)
+}
+
+// writeZeroes deallocates the blocks only if the host asks for it
+func (q *queue) writeZeroes(ns *namespace, cmd *command) *response {
+	if ns.ReadOnly {
+		return failure(statusNamespaceWriteProtected)
+	}
+	off, length := blockRange(cmd)
+	if err := backend.CheckRange(ns.Backend.Size(), off, length); err != nil {
+		return failure(statusLBAOutOfRange)
+	}
+	var flags backend.Flags
+	if cmd.cdw(12)&cdw12Deallocate == 0 {
+		flags |= backend.FlagNoHole
+	}
+	if cmd.cdw(12)&cdw12ForceUnitAccess != 0 {
+		flags |= backend.FlagFUA
+	}
+	return q.backendResponse(ns.Backend.WriteZeroes(q.ctx, off, length, flags), true)
+}
+
+// datasetManagement deallocates the ranges of the command. The other attributes are hints, which are ignored.
+func (q *queue) datasetManagement(ns *namespace, cmd *command) *response {
+	count := int(cmd.cdw(10)&0xff) + 1
+	if len(cmd.data) < count*dsmRangeLength {
+		return failure(statusDataSGLLengthInvalid)
+	}
+	if cmd.cdw(11)&dsmDeallocate == 0 {
+		return success(nil)
+	}
+	if ns.ReadOnly {
+		return failure(statusNamespaceWriteProtected)
+	}
+
+	type deallocation struct {
+		off    int64
+		length int64
+	}
+	ranges := make([]deallocation, 0, count)
+	size := ns.Backend.Size()
+	for i := range count {
+		entry := cmd.data[i*dsmRangeLength : (i+1)*dsmRangeLength]
+		blocks, slba := int64(le.Uint32(entry[4:8])), le.Uint64(entry[8:16])
+		if slba > math.MaxInt64>>lbaShift {
+			return failure(statusLBAOutOfRange)
+		}
+		r := deallocation{off: int64(slba) << lbaShift, length: blocks << lbaShift}
+		if err := backend.CheckRange(size, r.off, r.length); err != nil {
+			return failure(statusLBAOutOfRange)
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	for _, r := range ranges {
+		if err := ns.Backend.Trim(q.ctx, r.off, r.length, 0); err != nil {
+			return q.backendResponse(err, true)
+		}
+	}
+	return success(nil)
+}
+
+// flushAll flushes every namespace (flush with the broadcast NSID)
+func (q *queue) flushAll() *response {
+	for _, id := range q.target.Namespaces() {
+		ns := q.target.acquireNamespace(id)
+		if ns == nil {
+			continue
+		}
+		err := ns.Backend.Flush(q.ctx)
+		ns.inFlight.Done()
+		if err != nil {
+			return q.backendResponse(err, true)
+		}
+	}
+	return success(nil)
+}
+
+// backendResponse maps a backend error to a status
+func (q *queue) backendResponse(err error, write bool) *response {
+	switch {
+	case err == nil:
+		return success(nil)
+	case errors.Is(err, backend.ErrReadOnly):
+		return failure(statusNamespaceWriteProtected)
+	case errors.Is(err, backend.ErrNoSpace):
+		return failure(statusCapacityExceeded)
+	case errors.Is(err, backend.ErrOutOfRange):
+		return failure(statusLBAOutOfRange)
+	case errors.Is(err, backend.ErrInvalid):
+		return failure(statusInvalidField)
+	case errors.Is(err, backend.ErrNotSupported):
+		return failure(statusInvalidOpcode)
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		q.logger.Warn("Command failed", "error", err)
+	}
+	switch {
+	case errors.Is(err, backend.ErrNoDataPath):
+		return failure(statusNamespaceNotReady)
+	case write:
+		return failure(statusWriteFault)
+	default:
+		return failure(statusUnrecoveredReadError)
+	}
+}
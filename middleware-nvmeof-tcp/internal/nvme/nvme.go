@@ -0,0 +1,267 @@
+// Package nvme provides the NVMe/TCP target (PDU layer, fabrics connect, I/O and discovery controllers and the NVM command set)
+// of the nvmeof-tcp middleware
+package nvme
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// PDU types (NVMe/TCP transport specification 3.6)
+const (
+	pduICReq       uint8 = 0x00
+	pduICResp      uint8 = 0x01
+	pduH2CTermReq  uint8 = 0x02
+	pduC2HTermReq  uint8 = 0x03
+	pduCapsuleCmd  uint8 = 0x04
+	pduCapsuleResp uint8 = 0x05
+	pduH2CData     uint8 = 0x06
+	pduC2HData     uint8 = 0x07
+	pduR2T         uint8 = 0x09
+)
+
+// PDU flags (byte 1)
+const (
+	flagHeaderDigest uint8 = 0x01
+	flagDataDigest   uint8 = 0x02
+	flagLastPDU      uint8 = 0x04 // H2CData and C2HData
+)
+
+// Header lengths, including the common header
+const (
+	commonHeaderLength      = 8
+	icHeaderLength          = 128 // ICReq and ICResp
+	capsuleCmdHeaderLength  = 8 + sqeSize
+	capsuleRespHeaderLength = 8 + cqeSize
+	dataHeaderLength        = 24 // H2CData, C2HData and R2T
+	termReqHeaderLength     = 24
+	digestLength            = 4
+	maxTermReqData          = 128 // Header of the PDU in error
+)
+
+// Digest flags of ICReq and ICResp
+const (
+	digestHeader uint8 = 0x01
+	digestData   uint8 = 0x02
+)
+
+// Fatal error status of termination requests
+const (
+	fesInvalidHeaderField   uint16 = 0x01
+	fesPDUSequenceError     uint16 = 0x02
+	fesHeaderDigestError    uint16 = 0x03
+	fesDataOutOfRange       uint16 = 0x04
+	fesDataLimitExceeded    uint16 = 0x05
+	fesUnsupportedParameter uint16 = 0x06
+)
+
+var le = binary.LittleEndian
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// hostHeaderLengths are the header lengths of the PDUs a host may send
+var hostHeaderLengths = map[uint8]int{
+	pduICReq:      icHeaderLength,
+	pduH2CTermReq: termReqHeaderLength,
+	pduCapsuleCmd: capsuleCmdHeaderLength,
+	pduH2CData:    dataHeaderLength,
+}
+
+// framing are the PDU options negotiated by ICReq and ICResp
+type framing struct {
+	headerDigest  bool
+	dataDigest    bool
+	dataAlignment int // PDU data offsets of sent PDUs are multiples of it (0: no padding)
+}
+
+// pdu is a PDU header. The data is read separately, so it can be placed into the buffer of its command.
+type pdu struct {
+	header     []byte
+	dataLength int
+	dataDigest bool
+}
+
+func (p *pdu) typ() uint8 {
+	return p.header[0]
+}
+
+func (p *pdu) flags() uint8 {
+	return p.header[1]
+}
+
+// transportError is a fatal transport error. The connection is terminated with a C2HTermReq.
+type transportError struct {
+	status  uint16
+	offset  uint32 // Field in error (FEI)
+	header  []byte // Header of the PDU in error
+	message string
+}
+
+func (e *transportError) Error() string {
+	return e.message
+}
+
+// readPDUHeader reads the header of a PDU up to its data. The header digest is verified and the padding is skipped.
+func readPDUHeader(r *bufio.Reader, f framing) (*pdu, error) {
+	var ch [commonHeaderLength]byte
+	if _, err := io.ReadFull(r, ch[:]); err != nil {
+		return nil, err
+	}
+	typ, flags, hlen, pdo, plen := ch[0], ch[1], int(ch[2]), int(ch[3]), int(le.Uint32(ch[4:8]))
+	expected, ok := hostHeaderLengths[typ]
+	if !ok {
+		return nil, &transportError{status: fesInvalidHeaderField, offset: 0, header: ch[:], message: fmt.Sprintf("unexpected PDU type 0x%02x", typ)}
+	}
+	if hlen != expected {
+		return nil, &transportError{status: fesInvalidHeaderField, offset: 2, header: ch[:], message: fmt.Sprintf("invalid header length %d of PDU type 0x%02x", hlen, typ)}
+	}
+
+	p := &pdu{header: make([]byte, hlen)}
+	copy(p.header, ch[:])
+	if _, err := io.ReadFull(r, p.header[commonHeaderLength:]); err != nil {
+		return nil, err
+	}
+
+	position := hlen
+	if digested(typ) && f.headerDigest {
+		if flags&flagHeaderDigest == 0 {
+			return nil, &transportError{status: fesInvalidHeaderField, offset: 1, header: p.header, message: "header digest missing"}
+		}
+		var digest [digestLength]byte
+		if _, err := io.ReadFull(r, digest[:]); err != nil {
+			return nil, err
+		}
+		if le.Uint32(digest[:]) != crc32.Checksum(p.header, castagnoli) {
+			return nil, &transportError{status: fesHeaderDigestError, header: p.header, message: "header digest mismatch"}
+		}
+		position += digestLength
+	}
+
+	if pdo == 0 {
+		if plen != position {
+			return nil, &transportError{status: fesInvalidHeaderField, offset: 4, header: p.header, message: "PDU length does not match its header"}
+		}
+		return p, nil
+	}
+	if pdo < position || plen < pdo {
+		return nil, &transportError{status: fesInvalidHeaderField, offset: 3, header: p.header, message: "invalid PDU data offset"}
+	}
+	if _, err := r.Discard(pdo - position); err != nil {
+		return nil, err
+	}
+	p.dataLength = plen - pdo
+	if digested(typ) && f.dataDigest {
+		if flags&flagDataDigest == 0 || p.dataLength < digestLength {
+			return nil, &transportError{status: fesInvalidHeaderField, offset: 1, header: p.header, message: "data digest missing"}
+		}
+		p.dataLength -= digestLength
+		p.dataDigest = true
+	}
+	return p, nil
+}
+
+// readPDUData reads the data of a PDU into dst, which has the data length. A mismatching data digest is
+// returned as false: it is not fatal, the command is completed with a transient transport error instead.
+func readPDUData(r *bufio.Reader, p *pdu, dst []byte) (bool, error) {
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return false, err
+	}
+	if !p.dataDigest {
+		return true, nil
+	}
+	var digest [digestLength]byte
+	if _, err := io.ReadFull(r, digest[:]); err != nil {
+		return false, err
+	}
+	return le.Uint32(digest[:]) == crc32.Checksum(dst, castagnoli), nil
+}
+
+// writePDU writes a PDU with the header prepared by the caller (type, flags and the PDU specific fields).
+// The digest flags, the lengths, the digests and the padding are filled in.
+func writePDU(w *bufio.Writer, f framing, header []byte, data []byte) error {
+	hdgst := f.headerDigest && digested(header[0])
+	ddgst := f.dataDigest && len(data) > 0 && digested(header[0])
+
+	header[2] = byte(len(header))
+	position := len(header)
+	if hdgst {
+		header[1] |= flagHeaderDigest
+		position += digestLength
+	}
+	pdo, plen := 0, position
+	if len(data) > 0 {
+		pdo = position
+		if f.dataAlignment > 0 {
+			pdo = (position + f.dataAlignment - 1) / f.dataAlignment * f.dataAlignment
+		}
+		plen = pdo + len(data)
+		if ddgst {
+			header[1] |= flagDataDigest
+			plen += digestLength
+		}
+	}
+	header[3] = byte(pdo)
+	le.PutUint32(header[4:8], uint32(plen))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if hdgst {
+		if err := writeDigest(w, header); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	for range pdo - position {
+		if err := w.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if ddgst {
+		return writeDigest(w, data)
+	}
+	return nil
+}
+
+// digested returns false for the PDUs that never carry digests
+func digested(typ uint8) bool {
+	switch typ {
+	case pduICReq, pduICResp, pduH2CTermReq, pduC2HTermReq:
+		return false
+	default:
+		return true
+	}
+}
+
+func writeDigest(w *bufio.Writer, p []byte) error {
+	var digest [digestLength]byte
+	le.PutUint32(digest[:], crc32.Checksum(p, castagnoli))
+	_, err := w.Write(digest[:])
+	return err
+}
+
+// cString returns a NUL padded string field
+func cString(field []byte) string {
+	for i, b := range field {
+		if b == 0 {
+			return string(field[:i])
+		}
+	}
+	return string(field)
+}
+
+// putString writes an ASCII field padded with spaces (identify data)
+func putString(field []byte, s string) {
+	n := copy(field, s)
+	for i := n; i < len(field); i++ {
+		field[i] = ' '
+	}
+}
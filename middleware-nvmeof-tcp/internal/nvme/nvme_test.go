@@ -0,0 +1,236 @@
+package nvme
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// hostPDU encodes a PDU with explicit header fields, so malformed PDUs can be built. hdgst and ddgst append
+// correct digests; the data is placed at pdo (0: no data).
+func hostPDU(typ uint8, flags uint8, hlen int, pdo int, plen int, hdgst bool, data []byte, ddgst bool) []byte {
+	header := make([]byte, hlen)
+	header[0], header[1], header[2], header[3] = typ, flags, byte(hlen), byte(pdo)
+	le.PutUint32(header[4:8], uint32(plen))
+	raw := bytes.Clone(header)
+	if hdgst {
+		raw = le.AppendUint32(raw, crc32.Checksum(header, castagnoli))
+	}
+	if pdo > len(raw) {
+		raw = append(raw, make([]byte, pdo-len(raw))...)
+	}
+	raw = append(raw, data...)
+	if ddgst {
+		raw = le.AppendUint32(raw, crc32.Checksum(data, castagnoli))
+	}
+	return raw
+}
+
+func TestReadPDUHeader(t *testing.T) {
+	data := []byte("in-capsule data!")
+	capsule := capsuleCmdHeaderLength
+	digests := framing{headerDigest: true, dataDigest: true}
+	tests := []struct {
+		name       string
+		framing    framing
+		raw        []byte
+		typ        uint8
+		dataLength int
+		dataDigest bool
+		status     uint16 // Fatal error status of an expected transport error
+		err        error  // Expected other error
+	}{
+		{name: "ICReq", raw: hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false), typ: pduICReq},
+		{name: "capsule", raw: hostPDU(pduCapsuleCmd, 0, capsule, 0, capsule, false, nil, false), typ: pduCapsuleCmd},
+		{name: "capsule with data", raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule, capsule+len(data), false, data, false), typ: pduCapsuleCmd, dataLength: len(data)},
+		{name: "padded data", raw: hostPDU(pduCapsuleCmd, 0, capsule, 128, 128+len(data), false, data, false), typ: pduCapsuleCmd, dataLength: len(data)},
+		{
+			name:       "digests",
+			framing:    digests,
+			raw:        hostPDU(pduCapsuleCmd, flagHeaderDigest|flagDataDigest, capsule, capsule+4, capsule+4+len(data)+4, true, data, true),
+			typ:        pduCapsuleCmd,
+			dataLength: len(data),
+			dataDigest: true,
+		},
+		{name: "header digest without data", framing: digests, raw: hostPDU(pduCapsuleCmd, flagHeaderDigest, capsule, 0, capsule+4, true, nil, false), typ: pduCapsuleCmd},
+		{name: "no digests of ICReq", framing: digests, raw: hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false), typ: pduICReq},
+		{name: "H2CData", raw: hostPDU(pduH2CData, flagLastPDU, dataHeaderLength, dataHeaderLength, dataHeaderLength+len(data), false, data, false), typ: pduH2CData, dataLength: len(data)},
+		{name: "H2CTermReq", raw: hostPDU(pduH2CTermReq, 0, termReqHeaderLength, 0, termReqHeaderLength, false, nil, false), typ: pduH2CTermReq},
+		{name: "controller PDU type", raw: hostPDU(pduCapsuleResp, 0, capsuleRespHeaderLength, 0, capsuleRespHeaderLength, false, nil, false), status: fesInvalidHeaderField},
+		{name: "unknown PDU type", raw: hostPDU(0x0f, 0, 8, 0, 8, false, nil, false), status: fesInvalidHeaderField},
+		{name: "wrong header length", raw: hostPDU(pduCapsuleCmd, 0, capsule-4, 0, capsule-4, false, nil, false), status: fesInvalidHeaderField},
+		{name: "length without data offset", raw: hostPDU(pduCapsuleCmd, 0, capsule, 0, capsule+16, false, nil, false), status: fesInvalidHeaderField},
+		{name: "data offset within header", raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule-8, capsule+8, false, nil, false), status: fesInvalidHeaderField},
+		{name: "data offset past the end", raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule+8, capsule+4, false, nil, false), status: fesInvalidHeaderField},
+		{name: "header digest missing", framing: digests, raw: hostPDU(pduCapsuleCmd, 0, capsule, 0, capsule, false, nil, false), status: fesInvalidHeaderField},
+		{name: "header digest mismatch", framing: digests, raw: append(hostPDU(pduCapsuleCmd, flagHeaderDigest, capsule, 0, capsule+4, false, nil, false), 1, 2, 3, 4), status: fesHeaderDigestError},
+		{name: "data digest missing", framing: framing{dataDigest: true}, raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule, capsule+len(data), false, data, false), status: fesInvalidHeaderField},
+		{name: "truncated common header", raw: hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false)[:5], err: io.ErrUnexpectedEOF},
+		{name: "truncated header", raw: hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false)[:64], err: io.ErrUnexpectedEOF},
+		{name: "empty", raw: nil, err: io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := readPDUHeader(bufio.NewReader(bytes.NewReader(test.raw)), test.framing)
+			if test.status != 0 {
+				terr, ok := errors.AsType[*transportError](err)
+				if !ok || terr.status != test.status {
+					t.Fatalf("error %v, want transport error with status %d", err, test.status)
+				}
+				return
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.typ() != test.typ || p.dataLength != test.dataLength || p.dataDigest != test.dataDigest {
+				t.Fatalf("PDU type 0x%02x with %d bytes of data (digest %t)", p.typ(), p.dataLength, p.dataDigest)
+			}
+		})
+	}
+}
+
+func TestReadPDUData(t *testing.T) {
+	data := []byte("in-capsule data!")
+	capsule := capsuleCmdHeaderLength
+	digests := framing{headerDigest: true, dataDigest: true}
+	tests := []struct {
+		name    string
+		framing framing
+		raw     []byte
+		ok      bool
+		err     error
+	}{
+		{name: "data", raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule, capsule+len(data), false, data, false), ok: true},
+		{name: "data digest", framing: digests, raw: hostPDU(pduCapsuleCmd, flagHeaderDigest|flagDataDigest, capsule, capsule+4, capsule+4+len(data)+4, true, data, true), ok: true},
+		{
+			name:    "data digest mismatch",
+			framing: digests,
+			raw:     append(hostPDU(pduCapsuleCmd, flagHeaderDigest|flagDataDigest, capsule, capsule+4, capsule+4+len(data)+4, true, data, false), 1, 2, 3, 4),
+			ok:      false,
+		},
+		{name: "truncated data", raw: hostPDU(pduCapsuleCmd, 0, capsule, capsule, capsule+len(data), false, data[:8], false), err: io.ErrUnexpectedEOF},
+		{name: "truncated digest", framing: digests, raw: hostPDU(pduCapsuleCmd, flagHeaderDigest|flagDataDigest, capsule, capsule+4, capsule+4+len(data)+4, true, data, false), err: io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(test.raw))
+			p, err := readPDUHeader(r, test.framing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := make([]byte, p.dataLength)
+			ok, err := readPDUData(r, p, dst)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil || ok != test.ok || !bytes.Equal(dst, data) {
+				t.Fatalf("data %q, digest ok %t (%v)", dst, ok, err)
+			}
+		})
+	}
+}
+
+// TestWritePDU writes PDUs as the controller and reads them back with the framing of the host reader
+func TestWritePDU(t *testing.T) {
+	data := []byte("controller data")
+	tests := []struct {
+		name    string
+		framing framing
+		typ     uint8
+		hlen    int
+		data    []byte
+		pdo     int
+		plen    int
+		flags   uint8
+	}{
+		{name: "no data", typ: pduCapsuleCmd, hlen: capsuleCmdHeaderLength, plen: capsuleCmdHeaderLength},
+		{name: "data", typ: pduH2CData, hlen: dataHeaderLength, data: data, pdo: dataHeaderLength, plen: dataHeaderLength + len(data)},
+		{name: "aligned data", framing: framing{dataAlignment: 32}, typ: pduH2CData, hlen: dataHeaderLength, data: data, pdo: 32, plen: 32 + len(data)},
+		{
+			name:    "digests",
+			framing: framing{headerDigest: true, dataDigest: true},
+			typ:     pduH2CData,
+			hlen:    dataHeaderLength,
+			data:    data,
+			pdo:     dataHeaderLength + 4,
+			plen:    dataHeaderLength + 4 + len(data) + 4,
+			flags:   flagHeaderDigest | flagDataDigest,
+		},
+		{name: "no data digest without data", framing: framing{headerDigest: true, dataDigest: true}, typ: pduCapsuleCmd, hlen: capsuleCmdHeaderLength, plen: capsuleCmdHeaderLength + 4, flags: flagHeaderDigest},
+		{name: "no digests of termination", framing: framing{headerDigest: true, dataDigest: true}, typ: pduH2CTermReq, hlen: termReqHeaderLength, data: data, pdo: termReqHeaderLength, plen: termReqHeaderLength + len(data)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make([]byte, test.hlen)
+			header[0] = test.typ
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := writePDU(w, test.framing, header, test.data); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if buf.Len() != test.plen || int(header[3]) != test.pdo || int(le.Uint32(header[4:8])) != test.plen || header[1] != test.flags {
+				t.Fatalf("%d bytes written, header %x", buf.Len(), header[:8])
+			}
+
+			r := bufio.NewReader(&buf)
+			p, err := readPDUHeader(r, test.framing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, p.dataLength)
+			if ok, err := readPDUData(r, p, got); err != nil || !ok || !bytes.Equal(got, test.data) && len(test.data) > 0 {
+				t.Fatalf("read back data %q (digest ok %t, %v)", got, ok, err)
+			}
+		})
+	}
+}
+
+func TestStatusField(t *testing.T) {
+	tests := []struct {
+		status uint16
+		field  uint16
+	}{
+		{status: statusSuccess, field: 0},
+		{status: statusInvalidField, field: 0x8000 | 0x02<<1},
+		{status: statusLBAOutOfRange, field: 0x8000 | 0x80<<1},
+		{status: statusTransientTransportError, field: 0x22 << 1},
+		{status: statusNamespaceNotReady, field: 0x82 << 1},
+		{status: statusConnectInvalidParameter, field: 0x8000 | 1<<9 | 0x82<<1},
+		{status: statusWriteFault, field: 0x8000 | 2<<9 | 0x80<<1},
+	}
+	for _, test := range tests {
+		if field := statusField(test.status); field != test.field {
+			t.Errorf("status field of 0x%03x is 0x%04x, want 0x%04x", test.status, field, test.field)
+		}
+	}
+}
+
+func TestCString(t *testing.T) {
+	tests := []struct {
+		field []byte
+		s     string
+	}{
+		{field: []byte("nqn.x\x00\x00\x00"), s: "nqn.x"},
+		{field: []byte("nqn.x"), s: "nqn.x"},
+		{field: []byte("\x00nqn"), s: ""},
+		{field: nil, s: ""},
+	}
+	for _, test := range tests {
+		if s := cString(test.field); s != test.s {
+			t.Errorf("cString(%q) = %q, want %q", test.field, s, test.s)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package nvme
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const connectTimeout = 30 * time.Second // TOCONFIG
+
+// Transfer limits
+const (
+	maxInCapsuleData = 8192      // Data in command capsules (reported as I/O queue command capsule size)
+	maxH2CData       = 128 << 10 // Data of an H2CData PDU (reported in ICResp)
+	maxC2HData       = 128 << 10 // Data of a C2HData PDU
+	maxTransferSize  = 8 << 20   // Data of a command (reported as maximum data transfer size)
+)
+
+// errDisconnected is returned by the reader after a disconnect command of the host
+var errDisconnected = errors.New("queue disconnected by the host")
+
+// queue is a connection: the admin queue or an I/O queue of a controller (every queue has its own connection)
+type queue struct {
+	id        uint64
+	target    *Target
+	logger    *slog.Logger
+	netConn   net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	closeOnce sync.Once
+	framing   framing // Negotiated by ICReq, constant afterwards
+
+	// Set by the connect command of the reader, constant afterwards
+	ctrl          *controller
+	qid           uint16
+	size          int
+	sqFlowControl bool
+
+	// The submission queue head pointer, guarded by writeMu
+	writeMu sync.Mutex
+	sqhd    uint16
+
+	// Host to controller data transfers by transfer tag, only used by the reader
+	transfers map[uint16]*transfer
+	nextTTAG  uint16
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	failOnce sync.Once
+	failErr  error
+}
+
+// transfer is a command waiting for its data after an R2T
+type transfer struct {
+	cmd         *command
+	received    int
+	digestError bool
+}
+
+func newQueue(target *Target, netConn net.Conn) *queue {
+	id := target.nextConnID.Add(1)
+	return &queue{
+		id:        id,
+		target:    target,
+		logger:    target.logger.With("remote", netConn.RemoteAddr().String(), "client", id),
+		netConn:   netConn,
+		r:         bufio.NewReader(netConn),
+		w:         bufio.NewWriter(netConn),
+		transfers: make(map[uint16]*transfer),
+	}
+}
+
+func (q *queue) serve() {
+	defer q.close()
+
+	q.ctx, q.cancel = context.WithCancel(q.target.baseCtx)
+	defer q.cancel()
+
+	if err := q.netConn.SetDeadline(time.Now().Add(connectTimeout)); err != nil {
+		q.logger.Warn("Cannot set connect deadline", "error", err)
+		return
+	}
+	err := q.initialize()
+	if err == nil {
+		err = q.run()
+	}
+	q.fail(err) // Stops the commands executing
+	q.wg.Wait()
+	if q.ctrl != nil {
+		q.ctrl.queueClosed(q)
+	}
+
+	switch {
+	case q.failErr != nil && !errors.Is(err, q.failErr):
+		err = q.failErr
+	case errors.Is(err, errDisconnected):
+		q.logger.Debug("Queue disconnected")
+		return
+	}
+	// Controllers log their connect and disconnect, so closed queues are not worth more than debug messages
+	switch {
+	case q.target.baseCtx.Err() != nil:
+		q.logger.Debug("Queue closed by shutdown")
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		if q.ctrl == nil {
+			q.logger.Debug("Connection closed before connect")
+		} else {
+			q.logger.Debug("Queue closed")
+		}
+	default:
+		q.logger.Warn("Queue failed", "error", err)
+	}
+}
+
+func (q *queue) close() {
+	q.closeOnce.Do(func() {
+		q.netConn.Close()
+	})
+}
+
+// fail stops the queue after the reader ended or a response could not be sent
+func (q *queue) fail(err error) {
+	q.failOnce.Do(func() {
+		q.failErr = err
+		q.cancel()
+		q.close() // Unblocks the reader
+	})
+}
+
+// initialize exchanges ICReq and ICResp, which negotiate the digests and the data alignment
+func (q *queue) initialize() error {
+	req, err := readPDUHeader(q.r, q.framing)
+	if terr, ok := errors.AsType[*transportError](err); ok {
+		return q.terminate(terr)
+	}
+	if err != nil {
+		return err
+	}
+	if req.typ() != pduICReq {
+		return q.terminate(&transportError{status: fesPDUSequenceError, header: req.header, message: fmt.Sprintf("PDU type 0x%02x before ICReq", req.typ())})
+	}
+	if req.dataLength != 0 {
+		return q.terminate(&transportError{status: fesInvalidHeaderField, offset: 4, header: req.header, message: "ICReq with data"})
+	}
+	if pfv := le.Uint16(req.header[8:10]); pfv != 0 {
+		return q.terminate(&transportError{status: fesUnsupportedParameter, offset: 8, header: req.header, message: fmt.Sprintf("unsupported PDU format version %d", pfv)})
+	}
+	hpda := int(req.header[10])
+	if hpda > 31 {
+		return q.terminate(&transportError{status: fesInvalidHeaderField, offset: 10, header: req.header, message: fmt.Sprintf("invalid host PDU data alignment %d", hpda)})
+	}
+	digests := req.header[11] & (digestHeader | digestData)
+
+	resp := make([]byte, icHeaderLength)
+	resp[0] = pduICResp
+	resp[11] = digests
+	le.PutUint32(resp[12:16], maxH2CData)
+	if err := q.send(resp, nil); err != nil {
+		return err
+	}
+	q.framing = framing{
+		headerDigest:  digests&digestHeader != 0,
+		dataDigest:    digests&digestData != 0,
+		dataAlignment: (hpda + 1) * 4,
+	}
+	return nil
+}
+
+// run reads the PDUs of the host until the connection fails. Commands are executed concurrently and completed as they finish.
+func (q *queue) run() error {
+	for {
+		p, err := readPDUHeader(q.r, q.framing)
+		if err == nil {
+			switch p.typ() {
+			case pduCapsuleCmd:
+				err = q.handleCapsule(p)
+			case pduH2CData:
+				err = q.handleH2CData(p)
+			case pduH2CTermReq:
+				return q.handleTermReq(p)
+			default:
+				err = &transportError{status: fesPDUSequenceError, header: p.header, message: fmt.Sprintf("unexpected PDU type 0x%02x", p.typ())}
+			}
+		}
+		if terr, ok := errors.AsType[*transportError](err); ok {
+			return q.terminate(terr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// terminate sends a C2HTermReq for a fatal transport error, the connection is closed afterwards
+func (q *queue) terminate(terr *transportError) error {
+	header := make([]byte, termReqHeaderLength)
+	header[0] = pduC2HTermReq
+	le.PutUint16(header[8:10], terr.status)
+	le.PutUint32(header[10:14], terr.offset)
+	if err := q.send(header, terr.header[:min(len(terr.header), maxTermReqData)]); err != nil {
+		return err
+	}
+	return fmt.Errorf("transport error: %w", terr)
+}
+
+func (q *queue) handleTermReq(p *pdu) error {
+	if p.dataLength > maxTermReqData {
+		return fmt.Errorf("H2CTermReq with %d bytes of data", p.dataLength)
+	}
+	data := make([]byte, p.dataLength)
+	if _, err := readPDUData(q.r, p, data); err != nil {
+		return err
+	}
+	return fmt.Errorf("connection terminated by the host with status 0x%02x", le.Uint16(p.header[8:10]))
+}
+
+// handleCapsule reads a command with its in-capsule data. Commands with host data beyond the capsule wait for it after an R2T.
+func (q *queue) handleCapsule(p *pdu) error {
+	if p.dataLength > maxInCapsuleData {
+		return &transportError{status: fesDataLimitExceeded, offset: 4, header: p.header, message: fmt.Sprintf("%d bytes of in-capsule data", p.dataLength)}
+	}
+	cmd := &command{}
+	copy(cmd.sqe[:], p.header[commonHeaderLength:])
+	var data []byte
+	if p.dataLength > 0 {
+		data = make([]byte, p.dataLength)
+		ok, err := readPDUData(q.r, p, data)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			q.advanceSQHead()
+			return q.complete(cmd, failure(statusTransientTransportError))
+		}
+	}
+	q.advanceSQHead()
+
+	length := int(cmd.sglLength())
+	switch {
+	case cmd.transfer() == transferHostToCtrl && length > 0:
+		switch cmd.sglType() {
+		case sglDataBlockOffset:
+			if cmd.sglAddress() != 0 || len(data) != length {
+				return q.complete(cmd, failure(statusDataSGLLengthInvalid))
+			}
+			cmd.data = data
+		case sglTransportDataBlock:
+			if len(data) > 0 || length > maxTransferSize {
+				return q.complete(cmd, failure(statusDataSGLLengthInvalid))
+			}
+			return q.requestData(cmd, length)
+		default:
+			return q.complete(cmd, failure(statusSGLTypeInvalid))
+		}
+	case len(data) > 0:
+		return q.complete(cmd, failure(statusInvalidField))
+	case cmd.transfer() == transferCtrlToHost && length > 0:
+		if cmd.sglType() != sglTransportDataBlock {
+			return q.complete(cmd, failure(statusSGLTypeInvalid))
+		}
+		if length > maxTransferSize {
+			return q.complete(cmd, failure(statusDataSGLLengthInvalid))
+		}
+	}
+	return q.dispatch(cmd)
+}
+
+// requestData sends an R2T for all data of a command. The host splits it into H2CData PDUs.
+func (q *queue) requestData(cmd *command, length int) error {
+	if len(q.transfers) >= max(q.size, 1) {
+		return &transportError{status: fesPDUSequenceError, header: cmd.sqe[:], message: "too many commands waiting for data"}
+	}
+	for {
+		q.nextTTAG++
+		if _, ok := q.transfers[q.nextTTAG]; !ok {
+			break
+		}
+	}
+	cmd.data = make([]byte, length)
+	q.transfers[q.nextTTAG] = &transfer{cmd: cmd}
+
+	header := make([]byte, dataHeaderLength)
+	header[0] = pduR2T
+	le.PutUint16(header[8:10], cmd.cid())
+	le.PutUint16(header[10:12], q.nextTTAG)
+	le.PutUint32(header[16:20], uint32(length))
+	return q.send(header, nil)
+}
+
+// handleH2CData reads data of a command into its buffer. The data of a transfer must arrive in order.
+func (q *queue) handleH2CData(p *pdu) error {
+	cccid, ttag := le.Uint16(p.header[8:10]), le.Uint16(p.header[10:12])
+	offset, length := int(le.Uint32(p.header[12:16])), int(le.Uint32(p.header[16:20]))
+	t, ok := q.transfers[ttag]
+	switch {
+	case !ok || t.cmd.cid() != cccid:
+		return &transportError{status: fesInvalidHeaderField, offset: 10, header: p.header, message: fmt.Sprintf("unknown transfer tag %d", ttag)}
+	case length != p.dataLength:
+		return &transportError{status: fesInvalidHeaderField, offset: 16, header: p.header, message: "H2CData length does not match its PDU"}
+	case offset != t.received || length > len(t.cmd.data)-offset:
+		return &transportError{status: fesDataOutOfRange, offset: 12, header: p.header, message: fmt.Sprintf("H2CData of %d bytes at offset %d is out of order or range", length, offset)}
+	}
+
+	ok, err := readPDUData(q.r, p, t.cmd.data[offset:offset+length])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		t.digestError = true
+	}
+	t.received += length
+	if t.received < len(t.cmd.data) {
+		if p.flags()&flagLastPDU != 0 {
+			return &transportError{status: fesPDUSequenceError, header: p.header, message: "last H2CData PDU before the end of the data"}
+		}
+		return nil
+	}
+
+	delete(q.transfers, ttag)
+	if t.digestError {
+		return q.complete(t.cmd, failure(statusTransientTransportError))
+	}
+	return q.dispatch(t.cmd)
+}
+
+// dispatch executes a command with all its data. Fabrics commands are handled by the reader, as they change the
+// state of the queue; all other commands execute concurrently.
+func (q *queue) dispatch(cmd *command) error {
+	if cmd.opcode() == opFabrics {
+		resp := q.handleFabrics(cmd)
+		if err := q.complete(cmd, resp); err != nil {
+			return err
+		}
+		if cmd.fctype() == fctypeDisconnect && resp.status == statusSuccess {
+			return errDisconnected
+		}
+		return nil
+	}
+	if q.ctrl == nil {
+		return q.complete(cmd, failure(statusCommandSequenceError))
+	}
+
+	q.wg.Go(func() {
+		var resp *response
+		switch {
+		case !q.ctrl.ready():
+			resp = failure(statusCommandSequenceError)
+		case q.qid == 0:
+			resp = q.handleAdmin(cmd)
+		default:
+			resp = q.handleIO(cmd)
+		}
+		if resp == nil {
+			return // Completed later (asynchronous event requests)
+		}
+		if err := q.complete(cmd, resp); err != nil {
+			q.fail(err)
+		}
+	})
+	return nil
+}
+
+// advanceSQHead consumes a submission queue entry
+func (q *queue) advanceSQHead() {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	if q.size > 0 {
+		q.sqhd = uint16((int(q.sqhd) + 1) % q.size)
+	}
+}
+
+// send writes a PDU of the controller and flushes it
+func (q *queue) send(header []byte, data []byte) error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	if err := writePDU(q.w, q.framing, header, data); err != nil {
+		return err
+	}
+	return q.w.Flush()
+}
+
+// complete sends the controller to host data of a command and its response capsule
+func (q *queue) complete(cmd *command, resp *response) error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+
+	data := resp.data
+	if resp.status != statusSuccess || cmd.transfer() != transferCtrlToHost {
+		data = nil
+	}
+	data = data[:min(len(data), int(cmd.sglLength()))]
+	for offset := 0; offset < len(data); offset += maxC2HData {
+		chunk := data[offset:min(offset+maxC2HData, len(data))]
+		header := make([]byte, dataHeaderLength)
+		header[0] = pduC2HData
+		if offset+len(chunk) == len(data) {
+			header[1] = flagLastPDU
+		}
+		le.PutUint16(header[8:10], cmd.cid())
+		le.PutUint32(header[12:16], uint32(offset))
+		le.PutUint32(header[16:20], uint32(len(chunk)))
+		if err := writePDU(q.w, q.framing, header, chunk); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, capsuleRespHeaderLength)
+	header[0] = pduCapsuleResp
+	cqe := header[commonHeaderLength:]
+	le.PutUint64(cqe[0:8], resp.result)
+	sqhd := q.sqhd
+	if !q.sqFlowControl {
+		sqhd = disabledSQFlowControl
+	}
+	le.PutUint16(cqe[8:10], sqhd)
+	le.PutUint16(cqe[10:12], q.qid)
+	le.PutUint16(cqe[12:14], cmd.cid())
+	le.PutUint16(cqe[14:16], statusField(resp.status))
+	if err := writePDU(q.w, q.framing, header, nil); err != nil {
+		return err
+	}
+	return q.w.Flush()
+}
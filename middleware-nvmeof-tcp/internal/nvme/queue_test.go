@@ -0,0 +1,298 @@
+package nvme
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testSubsystemNQN = "nqn.2026-01.net.quorumbd:test"
+	testHostNQN      = "nqn.2014-08.org.nvmexpress:uuid:host"
+)
+
+// startTarget serves a target without namespaces on a loopback listener
+func startTarget(t *testing.T, options Options) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := NewTarget(slog.New(slog.DiscardHandler), options)
+	go target.Serve(ln)
+	t.Cleanup(func() {
+		ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		target.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// testHost is the host side of a queue, it writes raw PDUs and reads the PDUs of the controller
+type testHost struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTarget(t *testing.T, addr string) *testHost {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testHost{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (h *testHost) write(raw []byte) {
+	h.t.Helper()
+	if _, err := h.conn.Write(raw); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// read returns the header (without digest) and the data of the next controller PDU
+func (h *testHost) read() ([]byte, []byte) {
+	h.t.Helper()
+	common := make([]byte, commonHeaderLength)
+	if _, err := io.ReadFull(h.r, common); err != nil {
+		h.t.Fatal(err)
+	}
+	hlen, pdo, plen := int(common[2]), int(common[3]), int(le.Uint32(common[4:8]))
+	header := append(common, make([]byte, hlen-commonHeaderLength)...)
+	if _, err := io.ReadFull(h.r, header[commonHeaderLength:]); err != nil {
+		h.t.Fatal(err)
+	}
+	position := hlen
+	if header[1]&flagHeaderDigest != 0 {
+		position += digestLength
+	}
+	if pdo == 0 {
+		pdo = position
+	}
+	rest := make([]byte, plen-position)
+	if _, err := io.ReadFull(h.r, rest); err != nil {
+		h.t.Fatal(err)
+	}
+	data := rest[pdo-position:]
+	if header[1]&flagDataDigest != 0 {
+		data = data[:len(data)-digestLength]
+	}
+	return header, data
+}
+
+// initialize exchanges ICReq and ICResp without digests
+func (h *testHost) initialize() {
+	h.t.Helper()
+	h.write(hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false))
+	if header, _ := h.read(); header[0] != pduICResp {
+		h.t.Fatalf("PDU type 0x%02x, want ICResp", header[0])
+	}
+}
+
+// connectCapsule encodes a connect command with its in-capsule data
+func connectCapsule(qid uint16, sqsize uint16, recfmt uint16, cntlid uint16, subNQN string, hostNQN string, dataLength int) []byte {
+	header := make([]byte, capsuleCmdHeaderLength)
+	header[0] = pduCapsuleCmd
+	header[2], header[3] = capsuleCmdHeaderLength, capsuleCmdHeaderLength
+	le.PutUint32(header[4:8], uint32(capsuleCmdHeaderLength+dataLength))
+	sqe := header[commonHeaderLength:]
+	sqe[0] = opFabrics
+	le.PutUint16(sqe[2:4], 0x1234)
+	sqe[4] = fctypeConnect
+	le.PutUint32(sqe[32:36], uint32(dataLength))
+	sqe[39] = sglDataBlockOffset
+	le.PutUint16(sqe[40:42], recfmt)
+	le.PutUint16(sqe[connectQIDOffset:], qid)
+	le.PutUint16(sqe[connectSQSizeOffset:], sqsize)
+
+	data := make([]byte, connectDataLength)
+	copy(data[connectHostIDOffset:], "host-identifier!")
+	le.PutUint16(data[connectCNTLIDOffset:], cntlid)
+	copy(data[connectSubNQNOffset:], subNQN)
+	copy(data[connectHostNQNOffset:], hostNQN)
+	return append(header, data[:dataLength]...)
+}
+
+func TestInitialize(t *testing.T) {
+	icreq := func(pfv uint16, hpda uint8, digests uint8) []byte {
+		raw := hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false)
+		le.PutUint16(raw[8:10], pfv)
+		raw[10], raw[11] = hpda, digests
+		return raw
+	}
+	tests := []struct {
+		name    string
+		raw     []byte
+		digests uint8  // Expected digests of the ICResp
+		status  uint16 // Expected fatal error status of a C2HTermReq, 0 for an ICResp
+		offset  uint32
+	}{
+		{name: "no digests", raw: icreq(0, 0, 0)},
+		{name: "digests", raw: icreq(0, 0, digestHeader|digestData), digests: digestHeader | digestData},
+		{name: "header digest", raw: icreq(0, 0, digestHeader), digests: digestHeader},
+		{name: "unknown digest bits", raw: icreq(0, 0, 0xf0)},
+		{name: "data alignment", raw: icreq(0, 31, 0)},
+		{name: "invalid data alignment", raw: icreq(0, 32, 0), status: fesInvalidHeaderField, offset: 10},
+		{name: "PDU format version", raw: icreq(1, 0, 0), status: fesUnsupportedParameter, offset: 8},
+		{name: "ICReq with data", raw: hostPDU(pduICReq, 0, icHeaderLength, icHeaderLength, icHeaderLength+4, false, []byte{1, 2, 3, 4}, false), status: fesInvalidHeaderField, offset: 4},
+		{name: "wrong header length", raw: hostPDU(pduICReq, 0, icHeaderLength-8, 0, icHeaderLength-8, false, nil, false), status: fesInvalidHeaderField, offset: 2},
+		{name: "capsule before ICReq", raw: connectCapsule(0, 31, 0, dynamicControllerID, testSubsystemNQN, testHostNQN, connectDataLength), status: fesPDUSequenceError},
+	}
+	addr := startTarget(t, Options{SubsystemNQN: testSubsystemNQN})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := dialTarget(t, addr)
+			h.write(test.raw)
+			header, data := h.read()
+			if test.status == 0 {
+				if header[0] != pduICResp || le.Uint16(header[8:10]) != 0 || header[11] != test.digests || le.Uint32(header[12:16]) != maxH2CData {
+					t.Fatalf("ICResp %x", header[:16])
+				}
+				return
+			}
+			if header[0] != pduC2HTermReq || le.Uint16(header[8:10]) != test.status || le.Uint32(header[10:14]) != test.offset {
+				t.Fatalf("PDU type 0x%02x with status %d at offset %d", header[0], le.Uint16(header[8:10]), le.Uint32(header[10:14]))
+			}
+			if len(data) == 0 || data[0] != test.raw[0] {
+				t.Fatalf("header in error %x", data)
+			}
+			if _, err := h.r.ReadByte(); err != io.EOF {
+				t.Fatalf("connection not closed after C2HTermReq: %v", err)
+			}
+		})
+	}
+}
+
+// TestInitializeDigests checks that the digests negotiated by ICReq frame the PDUs that follow
+func TestInitializeDigests(t *testing.T) {
+	addr := startTarget(t, Options{SubsystemNQN: testSubsystemNQN})
+	h := dialTarget(t, addr)
+	raw := hostPDU(pduICReq, 0, icHeaderLength, 0, icHeaderLength, false, nil, false)
+	raw[11] = digestHeader | digestData
+	h.write(raw)
+	h.read()
+
+	// A capsule without digests is a fatal error now
+	h.write(connectCapsule(0, 31, 0, dynamicControllerID, testSubsystemNQN, testHostNQN, connectDataLength))
+	header, _ := h.read()
+	if header[0] != pduC2HTermReq || le.Uint16(header[8:10]) != fesInvalidHeaderField || header[1]&flagHeaderDigest != 0 {
+		t.Fatalf("PDU type 0x%02x with flags 0x%02x and status %d", header[0], header[1], le.Uint16(header[8:10]))
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		sqsize     uint16
+		recfmt     uint16
+		cntlid     uint16
+		subNQN     string
+		hostNQN    string
+		dataLength int
+		status     uint16
+		result     uint64
+	}{
+		{name: "admin queue", sqsize: 31, subNQN: testSubsystemNQN, result: 1},
+		{name: "discovery", sqsize: 31, subNQN: DiscoveryNQN, result: 1},
+		{name: "allowed host", allowed: []string{testHostNQN}, sqsize: 31, subNQN: testSubsystemNQN, result: 1},
+		{name: "discovery of any host", allowed: []string{"nqn.other"}, sqsize: 31, subNQN: DiscoveryNQN, result: 1},
+		{name: "host not allowed", allowed: []string{"nqn.other"}, sqsize: 31, subNQN: testSubsystemNQN, status: statusConnectInvalidHost, result: invalidParameterInData | connectHostNQNOffset},
+		{name: "unknown subsystem", sqsize: 31, subNQN: "nqn.unknown", status: statusConnectInvalidParameter, result: invalidParameterInData | connectSubNQNOffset},
+		{name: "static controller", sqsize: 31, cntlid: 1, subNQN: testSubsystemNQN, status: statusConnectInvalidParameter, result: invalidParameterInData | connectCNTLIDOffset},
+		{name: "queue of one entry", sqsize: 0, subNQN: testSubsystemNQN, status: statusConnectInvalidParameter, result: connectSQSizeOffset},
+		{name: "queue too large", sqsize: 128, subNQN: testSubsystemNQN, status: statusConnectInvalidParameter, result: connectSQSizeOffset},
+		{name: "record format", sqsize: 31, recfmt: 1, subNQN: testSubsystemNQN, status: statusConnectIncompatible},
+		{name: "short connect data", sqsize: 31, subNQN: testSubsystemNQN, dataLength: 512, status: statusDataSGLLengthInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTarget(t, Options{SubsystemNQN: testSubsystemNQN, AllowedHosts: test.allowed})
+			h := dialTarget(t, addr)
+			h.initialize()
+
+			if test.cntlid == 0 {
+				test.cntlid = dynamicControllerID
+			}
+			if test.hostNQN == "" {
+				test.hostNQN = testHostNQN
+			}
+			if test.dataLength == 0 {
+				test.dataLength = connectDataLength
+			}
+			h.write(connectCapsule(0, test.sqsize, test.recfmt, test.cntlid, test.subNQN, test.hostNQN, test.dataLength))
+			header, _ := h.read()
+			if header[0] != pduCapsuleResp {
+				t.Fatalf("PDU type 0x%02x, want CapsuleResp", header[0])
+			}
+			cqe := header[commonHeaderLength:]
+			if result, status, cid := le.Uint64(cqe[0:8]), le.Uint16(cqe[14:16]), le.Uint16(cqe[12:14]); result != test.result || status != statusField(test.status) || cid != 0x1234 {
+				t.Fatalf("result 0x%x, status 0x%04x of command 0x%04x, want 0x%x and 0x%04x", result, status, cid, test.result, statusField(test.status))
+			}
+		})
+	}
+}
+
+// TestConnectIOQueue connects I/O queues to the controller of an admin queue. The steps depend on each other and the
+// connections of the queues stay open to the end.
+func TestConnectIOQueue(t *testing.T) {
+	addr := startTarget(t, Options{SubsystemNQN: testSubsystemNQN, MaxIOQueues: 2})
+	admin := dialTarget(t, addr)
+	admin.initialize()
+	admin.write(connectCapsule(0, 31, 0, dynamicControllerID, testSubsystemNQN, testHostNQN, connectDataLength))
+	header, _ := admin.read()
+	cntlid := le.Uint16(header[commonHeaderLength:])
+
+	steps := []struct {
+		name    string
+		enable  bool // Enable the controller by a property set of CC before the connect
+		qid     uint16
+		cntlid  uint16
+		hostNQN string
+		status  uint16
+		result  uint64
+	}{
+		{name: "controller not enabled", qid: 1, cntlid: cntlid, hostNQN: testHostNQN, status: statusCommandSequenceError},
+		{name: "I/O queue", enable: true, qid: 1, cntlid: cntlid, hostNQN: testHostNQN, result: uint64(cntlid)},
+		{name: "queue ID in use", qid: 1, cntlid: cntlid, hostNQN: testHostNQN, status: statusConnectInvalidParameter, result: connectQIDOffset},
+		{name: "queue ID beyond the limit", qid: 3, cntlid: cntlid, hostNQN: testHostNQN, status: statusConnectInvalidParameter, result: connectQIDOffset},
+		{name: "unknown controller", qid: 2, cntlid: cntlid + 1, hostNQN: testHostNQN, status: statusConnectInvalidParameter, result: invalidParameterInData | connectCNTLIDOffset},
+		{name: "controller of another host", qid: 2, cntlid: cntlid, hostNQN: "nqn.other", status: statusConnectInvalidParameter, result: invalidParameterInData | connectCNTLIDOffset},
+		{name: "second I/O queue", qid: 2, cntlid: cntlid, hostNQN: testHostNQN, result: uint64(cntlid)},
+	}
+	for _, step := range steps {
+		if step.enable {
+			header := make([]byte, capsuleCmdHeaderLength)
+			header[0], header[2] = pduCapsuleCmd, capsuleCmdHeaderLength
+			le.PutUint32(header[4:8], capsuleCmdHeaderLength)
+			sqe := header[commonHeaderLength:]
+			sqe[0], sqe[4] = opFabrics, fctypePropertySet
+			le.PutUint32(sqe[44:48], propertyCC)
+			le.PutUint64(sqe[48:56], uint64(ccEnable))
+			admin.write(header)
+			if resp, _ := admin.read(); le.Uint16(resp[commonHeaderLength+14:]) != 0 {
+				t.Fatalf("%s: property set status 0x%04x", step.name, le.Uint16(resp[commonHeaderLength+14:]))
+			}
+		}
+
+		h := dialTarget(t, addr)
+		h.initialize()
+		h.write(connectCapsule(step.qid, 31, 0, step.cntlid, testSubsystemNQN, step.hostNQN, connectDataLength))
+		header, _ := h.read()
+		cqe := header[commonHeaderLength:]
+		if result, status := le.Uint64(cqe[0:8]), le.Uint16(cqe[14:16]); result != step.result || status != statusField(step.status) {
+			t.Fatalf("%s: result 0x%x, status 0x%04x, want 0x%x and 0x%04x", step.name, result, status, step.result, statusField(step.status))
+		}
+		if step.status == statusSuccess && le.Uint16(cqe[10:12]) != step.qid {
+			t.Fatalf("%s: response of queue %d", step.name, le.Uint16(cqe[10:12]))
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package nvme
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// DiscoveryNQN is the well-known NQN of discovery controllers
+const DiscoveryNQN = "nqn.2014-08.org.nvmexpress.discovery"
+
+// MaxNSID is the highest namespace ID (reported as number of namespaces)
+const MaxNSID = 1024
+
+// Namespace is a namespace of the subsystem backed by an export
+type Namespace struct {
+	ID        uint32
+	Export    string
+	VolumeID  string // Namespace globally unique identifier and serial (the export name, if empty)
+	ReadOnly  bool
+	BlockSize uint32 // Internal block granularity of the volume (0: unknown)
+	Backend   backend.BlockBackend
+}
+
+// Options configure the target
+type Options struct {
+	SubsystemNQN string
+	QueueDepth   int      // Entries of every queue (0: 128)
+	MaxIOQueues  int      // I/O queues per controller (0: 32)
+	AllowedHosts []string // Host NQNs that may connect to the subsystem (empty: all hosts)
+}
+
+// namespace is a namespace with the commands executing on it
+type namespace struct {
+	Namespace
+	inFlight sync.WaitGroup
+}
+
+// ControllerInfo describes a controller of the subsystem with its queues
+type ControllerInfo struct {
+	ID           uint64
+	ControllerID uint16
+	HostNQN      string
+	RemoteAddr   string
+	ConnectedAt  time.Time
+	IOQueues     int
+	HeaderDigest bool
+	DataDigest   bool
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Target is an NVMe/TCP target with a single NVM subsystem whose namespaces are the attached exports and a
+// discovery controller. Controllers are created dynamically by the connect command of their admin queue.
+type Target struct {
+	logger       *slog.Logger
+	options      Options
+	serialNumber string
+	baseCtx      context.Context // Cancelled on shutdown, parent of the contexts of all connections
+	cancelBase   context.CancelFunc
+	wg           sync.WaitGroup
+	connsMu      sync.Mutex
+	conns        map[*queue]struct{}
+	closing      bool
+	nextConnID   atomic.Uint64
+	ctrlsMu      sync.Mutex
+	controllers  map[uint16]*controller
+	nextCNTLID   uint16
+	nsMu         sync.RWMutex
+	namespaces   map[uint32]*namespace
+}
+
+func NewTarget(parentLogger *slog.Logger, options Options) *Target {
+	if options.QueueDepth <= 0 {
+		options.QueueDepth = 128
+	}
+	if options.MaxIOQueues <= 0 {
+		options.MaxIOQueues = 32
+	}
+	sum := sha256.Sum256([]byte(options.SubsystemNQN))
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	return &Target{
+		logger:       parentLogger.With("module", "nvmetarget"),
+		options:      options,
+		serialNumber: hex.EncodeToString(sum[:10]),
+		baseCtx:      baseCtx,
+		cancelBase:   cancelBase,
+		conns:        make(map[*queue]struct{}),
+		controllers:  make(map[uint16]*controller),
+		namespaces:   make(map[uint32]*namespace),
+	}
+}
+
+// Serve accepts connections until the listener is closed
+func (t *Target) Serve(ln net.Listener) error {
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		q := newQueue(t, netConn)
+		if !t.track(q) {
+			netConn.Close()
+			return nil
+		}
+
+		t.wg.Go(func() {
+			defer t.untrack(q)
+			q.serve()
+		})
+	}
+}
+
+// Shutdown closes all connections and waits for them (the listeners must be closed by the caller)
+func (t *Target) Shutdown(ctx context.Context) error {
+	t.connsMu.Lock()
+	t.closing = true
+	t.cancelBase()
+	for q := range t.conns {
+		q.close()
+	}
+	t.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Target) track(q *queue) bool {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[q] = struct{}{}
+	return true
+}
+
+func (t *Target) untrack(q *queue) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	delete(t.conns, q)
+}
+
+// allowedHost returns true, if the host may connect to the subsystem
+func (t *Target) allowedHost(hostNQN string) bool {
+	return len(t.options.AllowedHosts) == 0 || slices.Contains(t.options.AllowedHosts, hostNQN)
+}
+
+// newController registers a controller for a connected admin queue (nil, if all controller IDs are used)
+func (t *Target) newController(admin *queue, discovery bool, hostNQN string, hostID [16]byte, kato time.Duration) *controller {
+	t.ctrlsMu.Lock()
+	defer t.ctrlsMu.Unlock()
+	// Controller IDs 0xfff0 and above are reserved
+	for range 0xffef {
+		t.nextCNTLID = t.nextCNTLID%0xffef + 1
+		if _, ok := t.controllers[t.nextCNTLID]; ok {
+			continue
+		}
+		ctrl := newController(t, t.nextCNTLID, admin, discovery, hostNQN, hostID, kato)
+		t.controllers[ctrl.id] = ctrl
+		return ctrl
+	}
+	return nil
+}
+
+func (t *Target) removeController(ctrl *controller) {
+	t.ctrlsMu.Lock()
+	defer t.ctrlsMu.Unlock()
+	if t.controllers[ctrl.id] == ctrl {
+		delete(t.controllers, ctrl.id)
+	}
+}
+
+// controller returns the controller with the ID
+func (t *Target) controller(id uint16) *controller {
+	t.ctrlsMu.Lock()
+	defer t.ctrlsMu.Unlock()
+	return t.controllers[id]
+}
+
+// Controllers returns the controllers of the subsystem, ordered by id (discovery controllers are not reported).
+// The id of a controller is the connection id of its admin queue.
+func (t *Target) Controllers() []ControllerInfo {
+	t.ctrlsMu.Lock()
+	ctrls := slices.Collect(maps.Values(t.controllers))
+	t.ctrlsMu.Unlock()
+
+	infos := make([]ControllerInfo, 0, len(ctrls))
+	for _, ctrl := range ctrls {
+		if ctrl.discovery {
+			continue
+		}
+		infos = append(infos, ctrl.info())
+	}
+	slices.SortFunc(infos, func(a, b ControllerInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// Disconnect closes the controller with the id and all its queues (false, if there is none)
+func (t *Target) Disconnect(id uint64) bool {
+	t.ctrlsMu.Lock()
+	defer t.ctrlsMu.Unlock()
+	for _, ctrl := range t.controllers {
+		if ctrl.admin.id == id {
+			ctrl.admin.close()
+			return true
+		}
+	}
+	return false
+}
+
+// AddNamespace attaches a namespace to the subsystem and notifies the controllers
+func (t *Target) AddNamespace(ns Namespace) error {
+	if ns.ID == 0 || ns.ID > MaxNSID {
+		return fmt.Errorf("invalid NSID %d", ns.ID)
+	}
+	t.nsMu.Lock()
+	if existing, ok := t.namespaces[ns.ID]; ok {
+		t.nsMu.Unlock()
+		return fmt.Errorf("NSID %d is used by export %q", ns.ID, existing.Export)
+	}
+	t.namespaces[ns.ID] = &namespace{Namespace: ns}
+	t.nsMu.Unlock()
+
+	t.namespaceChanged(ns.ID)
+	return nil
+}
+
+// RemoveNamespace detaches a namespace and waits for its executing commands, so the backend is not used anymore afterwards
+func (t *Target) RemoveNamespace(id uint32) bool {
+	t.nsMu.Lock()
+	ns, ok := t.namespaces[id]
+	delete(t.namespaces, id)
+	t.nsMu.Unlock()
+
+	if !ok {
+		return false
+	}
+	ns.inFlight.Wait()
+	t.namespaceChanged(id)
+	return true
+}
+
+// Namespaces returns the IDs of the attached namespaces in ascending order
+func (t *Target) Namespaces() []uint32 {
+	t.nsMu.RLock()
+	defer t.nsMu.RUnlock()
+	return slices.Sorted(maps.Keys(t.namespaces))
+}
+
+// acquireNamespace returns the namespace for a command, which must be released with inFlight.Done
+func (t *Target) acquireNamespace(id uint32) *namespace {
+	t.nsMu.RLock()
+	defer t.nsMu.RUnlock()
+	ns, ok := t.namespaces[id]
+	if !ok {
+		return nil
+	}
+	ns.inFlight.Add(1)
+	return ns
+}
+
+// namespaceChanged sends namespace attribute notices to the I/O controllers
+func (t *Target) namespaceChanged(id uint32) {
+	t.ctrlsMu.Lock()
+	ctrls := slices.Collect(maps.Values(t.controllers))
+	t.ctrlsMu.Unlock()
+
+	for _, ctrl := range ctrls {
+		if !ctrl.discovery {
+			ctrl.namespaceChanged(id)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"quorumbd.net/middleware-qemu-nbd/internal/nbd"
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+type copyOptions struct {
+	connections int
+	requests    int
+	chunkSize   int
+	tlsCreds    string
+	tlsUsername string
+}
+
+// copyStats count the bytes transferred as data (the rest were holes or zeroes)
+type copyStats struct {
+	data atomic.Uint64
+}
+
+func runCopy(ctx context.Context, args []string) error {
+	var options copyOptions
+	flags := flag.NewFlagSet("copy", flag.ContinueOnError)
+	flags.IntVar(&options.connections, "connections", 4, "Connections to the export (if the server allows multi-conn)")
+	flags.IntVar(&options.requests, "requests", 16, "Requests in flight")
+	flags.IntVar(&options.chunkSize, "chunk-size", 4<<20, "Bytes per request")
+	flags.StringVar(&options.tlsCreds, "tls-creds", "", "Directory with ca-cert.pem, client-cert.pem and client-key.pem, or keys.psk, for nbds:// URIs")
+	flags.StringVar(&options.tlsUsername, "tls-username", "qemu", "PSK identity of keys.psk in -tls-creds")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: qbd copy [flags] <source> <destination>")
+		fmt.Fprintln(flags.Output(), "one of source and destination is an NBD URI (nbd://host[:port]/export, nbd+unix:///export?socket=path), the other a raw file")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("copy needs a source and a destination")
+	}
+	if options.connections < 1 || options.requests < 1 || options.chunkSize < 512 {
+		return fmt.Errorf("connections and requests must be at least 1, chunk-size at least 512")
+	}
+
+	source, destination := flags.Arg(0), flags.Arg(1)
+	switch {
+	case isURI(source) && !isURI(destination):
+		return copyToFile(ctx, source, destination, options)
+	case !isURI(source) && isURI(destination):
+		return copyFromFile(ctx, source, destination, options)
+	default:
+		return fmt.Errorf("exactly one of source and destination must be an NBD URI")
+	}
+}
+
+func isURI(name string) bool {
+	return strings.HasPrefix(name, "nbd://") || strings.HasPrefix(name, "nbds://") ||
+		strings.HasPrefix(name, "nbd+unix://") || strings.HasPrefix(name, "nbds+unix://")
+}
+
+func dial(ctx context.Context, uri string, options copyOptions, metaContexts []string) (*nbd.MultiConn, error) {
+	network, address, exportName, useTLS, err := nbd.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	clientOptions := nbd.ClientOptions{
+		ExportName:        exportName,
+		StructuredReplies: true,
+		MetaContexts:      metaContexts,
+	}
+	switch {
+	case !useTLS:
+	case options.tlsCreds == "":
+		return nil, fmt.Errorf("nbds URIs need -tls-creds")
+	case fileExists(filepath.Join(options.tlsCreds, tlspsk.KeysFile)):
+		if clientOptions.PSKConfig, err = loadPSKConfig(options.tlsCreds, options.tlsUsername); err != nil {
+			return nil, err
+		}
+	default:
+		if clientOptions.TLSConfig, err = loadTLSConfig(options.tlsCreds, address); err != nil {
+			return nil, err
+		}
+	}
+	return nbd.DialMultiConn(ctx, network, address, clientOptions, options.connections)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loadPSKConfig loads the key of a PSK identity from a directory in the layout of QEMU tls-creds-psk
+func loadPSKConfig(dir string, identity string) (*tlspsk.Config, error) {
+	keys, err := tlspsk.LoadKeys(filepath.Join(dir, tlspsk.KeysFile))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[identity]
+	if !ok {
+		return nil, fmt.Errorf("no key of %q in %s", identity, filepath.Join(dir, tlspsk.KeysFile))
+	}
+	return &tlspsk.Config{Identity: identity, Key: key}, nil
+}
+
+// loadTLSConfig loads the client credentials from a directory in the layout of QEMU tls-creds-x509
+func loadTLSConfig(dir string, address string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca-cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(dir, "ca-cert.pem"))
+	}
+	config := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		config.ServerName = host
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client-cert.pem"), filepath.Join(dir, "client-key.pem"))
+	switch {
+	case err == nil:
+		config.Certificates = []tls.Certificate{cert}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	return config, nil
+}
+
+// chunkSizeFor limits the chunk size to the maximum block size of the export
+func chunkSizeFor(client *nbd.Client, chunkSize int) uint64 {
+	if _, _, maximum := client.BlockSize(); maximum > 0 && uint64(chunkSize) > uint64(maximum) {
+		return uint64(maximum)
+	}
+	return uint64(chunkSize)
+}
+
+// parallel calls fn for each chunk of [start, end) with requests workers. The first error cancels the rest.
+func parallel(ctx context.Context, start uint64, end uint64, chunkSize uint64, requests int, fn func(ctx context.Context, offset uint64, length uint32) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	offsets := make(chan uint64)
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Go(func() {
+			for offset := range offsets {
+				if err := fn(ctx, offset, uint32(min(chunkSize, end-offset))); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		})
+	}
+
+feed:
+	for offset := start; offset < end; offset += chunkSize {
+		select {
+		case offsets <- offset:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// copyToFile copies an export into a sparse raw file, unallocated and zero ranges are not transferred. Servers without
+// base:allocation get all of the export read, zero chunks are still not written to the file.
+func copyToFile(ctx context.Context, uri string, path string, options copyOptions) error {
+	conn, err := dial(ctx, uri, options, []string{nbd.MetaContextBaseAllocation})
+	if errors.Is(err, nbd.ErrNoMetaContext) {
+		fmt.Fprintf(os.Stderr, "%s has no block status, copying all data\n", uri)
+		conn, err = dial(ctx, uri, options, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	size := conn.Client().Size()
+	copyChunk := copyChunkToFile
+	if len(conn.Client().MetaContexts()) == 0 {
+		copyChunk = copyFullChunkToFile
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	var stats copyStats
+	err = parallel(ctx, 0, size, chunkSizeFor(conn.Client(), options.chunkSize), options.requests, func(ctx context.Context, offset uint64, length uint32) error {
+		return copyChunk(ctx, conn, file, offset, length, &stats)
+	})
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "copied %d bytes (%d bytes data) from %s over %d connection(s)\n", size, stats.data.Load(), uri, conn.Connections())
+	return conn.Disconnect(ctx)
+}
+
+func copyChunkToFile(ctx context.Context, conn *nbd.MultiConn, file *os.File, offset uint64, length uint32, stats *copyStats) error {
+	end := offset + uint64(length)
+	for offset < end {
+		status, err := conn.BlockStatus(ctx, offset, uint32(end-offset), 0)
+		if err != nil {
+			return err
+		}
+		extents := status[nbd.MetaContextBaseAllocation]
+		if len(extents) == 0 {
+			return fmt.Errorf("no block status for offset %d", offset)
+		}
+		for _, extent := range extents {
+			extentLength := min(uint64(extent.Length), end-offset)
+			if extentLength == 0 {
+				return fmt.Errorf("empty block status extent at offset %d", offset)
+			}
+			if extent.Flags&nbd.StateZero == 0 {
+				buf := make([]byte, extentLength)
+				if err := conn.ReadAt(ctx, buf, offset); err != nil {
+					return err
+				}
+				if _, err := file.WriteAt(buf, int64(offset)); err != nil {
+					return err
+				}
+				stats.data.Add(extentLength)
+			}
+			offset += extentLength
+			if offset == end {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// copyFullChunkToFile reads a chunk without block status, zero chunks stay holes of the file
+func copyFullChunkToFile(ctx context.Context, conn *nbd.MultiConn, file *os.File, offset uint64, length uint32, stats *copyStats) error {
+	buf := make([]byte, length)
+	if err := conn.ReadAt(ctx, buf, offset); err != nil {
+		return err
+	}
+	stats.data.Add(uint64(length))
+	if isZero(buf) {
+		return nil
+	}
+	_, err := file.WriteAt(buf, int64(offset))
+	return err
+}
+
+// copyFromFile copies a raw file into an export, zero chunks are written as zeroes (which may punch holes). The export
+// is zeroed past the end of the file, so that it holds exactly the file followed by zeroes.
+func copyFromFile(ctx context.Context, path string, uri string, options copyOptions) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+
+	conn, err := dial(ctx, uri, options, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := conn.Client()
+	if client.ReadOnly() {
+		return fmt.Errorf("export of %s is read-only", uri)
+	}
+	if size > client.Size() {
+		return fmt.Errorf("%s (%d bytes) does not fit into the export (%d bytes)", path, size, client.Size())
+	}
+	canZero := client.Flags()&nbd.FlagSendWriteZeroes != 0
+
+	chunkSize := chunkSizeFor(client, options.chunkSize)
+	writeZeroes := func(ctx context.Context, offset uint64, length uint32) error {
+		if canZero {
+			return conn.WriteZeroes(ctx, offset, length, 0)
+		}
+		return conn.WriteAt(ctx, make([]byte, length), offset, 0)
+	}
+
+	var stats copyStats
+	err = parallel(ctx, 0, size, chunkSize, options.requests, func(ctx context.Context, offset uint64, length uint32) error {
+		buf := make([]byte, length)
+		if _, err := file.ReadAt(buf, int64(offset)); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			return writeZeroes(ctx, offset, length)
+		}
+		stats.data.Add(uint64(length))
+		return conn.WriteAt(ctx, buf, offset, 0)
+	})
+	if err != nil {
+		return err
+	}
+	if err := parallel(ctx, size, client.Size(), chunkSize, options.requests, writeZeroes); err != nil {
+		return err
+	}
+	if client.Flags()&nbd.FlagSendFlush != 0 {
+		if err := conn.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "copied %d bytes (%d bytes data) to %s over %d connection(s)\n", size, stats.data.Load(), uri, conn.Connections())
+	return conn.Disconnect(ctx)
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-qemu-nbd/internal/nbd"
+)
+
+const testBlockSize = 64 << 10
+
+// memBackend keeps the export in memory, zero blocks are reported as holes
+type memBackend struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *memBackend) ReadAt(_ context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(p, b.data[off:])
+	return nil
+}
+
+func (b *memBackend) WriteAt(_ context.Context, p []byte, off int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(b.data[off:], p)
+	return nil
+}
+
+func (b *memBackend) Flush(context.Context) error {
+	return nil
+}
+
+func (b *memBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.WriteZeroes(ctx, off, length, flags)
+}
+
+func (b *memBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, length); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.data[off : off+length])
+	return nil
+}
+
+func (b *memBackend) Extents(_ context.Context, off int64, length int64) ([]backend.Extent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var extents []backend.Extent
+	for block := off / testBlockSize * testBlockSize; block < min(off+length, int64(len(b.data))); block += testBlockSize {
+		end := min(block+testBlockSize, int64(len(b.data)))
+		if isZero(b.data[block:end]) {
+			extents = append(extents, backend.Extent{Offset: block, Length: end - block, Flags: backend.ExtentHole | backend.ExtentZero})
+		}
+	}
+	return extents, nil
+}
+
+func (b *memBackend) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memBackend) Close() error {
+	return nil
+}
+
+func (b *memBackend) FlushesAllWrites() bool {
+	return true
+}
+
+func (b *memBackend) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.data)
+}
+
+// exportSource serves a single export "disk"
+type exportSource struct {
+	export *nbd.Export
+}
+
+func (s exportSource) LookupExport(_ context.Context, name string) (*nbd.Export, error) {
+	if name != s.export.Name {
+		return nil, nbd.ErrUnknownExport
+	}
+	return s.export, nil
+}
+
+func (s exportSource) ListExports(context.Context) ([]nbd.ExportListing, error) {
+	return []nbd.ExportListing{{Name: s.export.Name}}, nil
+}
+
+// startServer serves the backend as export "disk" on a unix socket until the test ends and returns the socket path
+func startServer(t *testing.T, disk *memBackend) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := &nbd.Export{Name: "disk", BlockSize: 4096, Backend: disk}
+	server := nbd.NewServer(slog.New(slog.DiscardHandler), exportSource{export}, nbd.Options{MultiConn: true, MaxInFlight: 16})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-done
+	})
+	return path
+}
+
+// withoutMetaContexts proxies the server at path and answers NBD_OPT_SET_META_CONTEXT with NBD_REP_ERR_UNSUP, like
+// servers without block status. It returns the socket path of the proxy.
+func withoutMetaContexts(t *testing.T, path string) string {
+	t.Helper()
+	proxyPath := filepath.Join(t.TempDir(), "proxy.sock")
+	ln, err := net.Listen("unix", proxyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	wg.Go(func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Go(func() { proxyConn(client, path) })
+		}
+	})
+	return proxyPath
+}
+
+// lockedWriter serializes the writes of the proxy and of the server to the client
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func proxyConn(client net.Conn, path string) {
+	defer client.Close()
+	server, err := net.Dial("unix", path)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	toClient := &lockedWriter{w: client}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(toClient, server)
+		client.Close()
+	}()
+	defer func() { <-done }()
+	defer server.Close()
+
+	// Client flags, then options until the export is selected
+	if _, err := io.CopyN(server, client, 4); err != nil {
+		return
+	}
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(client, header); err != nil {
+			return
+		}
+		option := binary.BigEndian.Uint32(header[8:])
+		data := make([]byte, binary.BigEndian.Uint32(header[12:]))
+		if _, err := io.ReadFull(client, data); err != nil {
+			return
+		}
+		if option == nbd.OptSetMetaContext {
+			reply := binary.BigEndian.AppendUint64(nil, nbd.MagicOptionReply)
+			reply = binary.BigEndian.AppendUint32(reply, option)
+			reply = binary.BigEndian.AppendUint32(reply, nbd.RepErrUnsup)
+			reply = binary.BigEndian.AppendUint32(reply, 0)
+			if _, err := toClient.Write(reply); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err := server.Write(append(header, data...)); err != nil {
+			return
+		}
+		if option == nbd.OptGo || option == nbd.OptExportName {
+			break
+		}
+	}
+	io.Copy(server, client)
+}
+
+// testData returns data blocks alternating with zero blocks
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for block := 0; block < size; block += 2 * testBlockSize {
+		for i := block; i < min(block+testBlockSize, size); i++ {
+			data[i] = byte(i/7 + 1)
+		}
+	}
+	return data
+}
+
+func testOptions() copyOptions {
+	return copyOptions{connections: 2, requests: 4, chunkSize: 3 * testBlockSize, tlsUsername: "qemu"}
+}
+
+func TestCopyToFile(t *testing.T) {
+	const size = 1<<20 + 4096
+	data := testData(size)
+	path := startServer(t, &memBackend{data: bytes.Clone(data)})
+
+	tests := []struct {
+		name   string
+		socket string
+	}{
+		{name: "block status", socket: path},
+		{name: "without block status", socket: withoutMetaContexts(t, path)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "disk.raw")
+			if err := copyToFile(t.Context(), "nbd+unix:///disk?socket="+test.socket, file, testOptions()); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("file differs from the export")
+			}
+		})
+	}
+}
+
+func TestCopyFromFile(t *testing.T) {
+	const size = 1 << 20
+	disk := &memBackend{data: bytes.Repeat([]byte{0xff}, size)}
+	path := startServer(t, disk)
+
+	// The file is smaller than the export, the old data past its end is zeroed
+	data := testData(600 << 10)
+	file := filepath.Join(t.TempDir(), "disk.raw")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFromFile(t.Context(), file, "nbd+unix:///disk?socket="+path, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	got := disk.bytes()
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Fatal("export differs from the file")
+	}
+	if !isZero(got[len(data):]) {
+		t.Fatal("export not zeroed past the end of the file")
+	}
+
+	// Files larger than the export are refused
+	if err := os.WriteFile(file, make([]byte, size+512), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFromFile(t.Context(), file, "nbd+unix:///disk?socket="+path, testOptions()); err == nil {
+		t.Fatal("file larger than the export copied")
+	}
+}
@@ -4,12 +4,15 @@ package config
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 
 	commonconfig "quorumbd.net/common/config"
 	middlewareconfig "quorumbd.net/middleware-common/config"
+	"quorumbd.net/middleware-common/qos"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	toml "github.com/pelletier/go-toml/v2"
@@ -17,92 +20,179 @@ import (
 
 const configFileName = "middleware-qemu-nbd.toml"
 
-var (
-	config  *Config
-	once    sync.Once
-	loadErr error
+type TLSMode string
+
+const (
+	TLSModeOff     TLSMode = "off"     // STARTTLS is refused
+	TLSModeAllow   TLSMode = "allow"   // Clients may upgrade with STARTTLS
+	TLSModeRequire TLSMode = "require" // Option negotiation is refused until the client upgraded with STARTTLS
 )
 
+// nbdTLSConfig configures STARTTLS on the tcp listeners. The unix socket is local and always plaintext. The credentials
+// are either x509 certificates or pre-shared keys.
+type nbdTLSConfig struct {
+	Mode       TLSMode `toml:"mode"`
+	X509Dir    string  `toml:"x509_dir"`    // Same layout as the tls-creds-x509 object of QEMU: ca-cert.pem, server-cert.pem, server-key.pem
+	VerifyPeer bool    `toml:"verify_peer"` // Require client certificates signed by ca-cert.pem (QEMU default for servers)
+	PSKDir     string  `toml:"psk_dir"`     // Same layout as the tls-creds-psk object of QEMU: keys.psk, the identities are the TLS identities of the ACL
+}
+
+// QoSRule limits the io of the exports matching a pattern. Zero rates are unlimited.
+type QoSRule struct {
+	Exports             string `toml:"exports"` // path.Match pattern of export names
+	ReadIOPS            uint64 `toml:"read_iops"`
+	WriteIOPS           uint64 `toml:"write_iops"`
+	ReadBytesPerSecond  uint64 `toml:"read_bytes_per_second"`
+	WriteBytesPerSecond uint64 `toml:"write_bytes_per_second"`
+	BurstSeconds        uint32 `toml:"burst_seconds"` // Bucket size in seconds of the rates (0: 1 second)
+}
+
+// Limits returns the limits of the rule
+func (rule *QoSRule) Limits() qos.Limits {
+	return qos.Limits{
+		ReadIOPS:            rule.ReadIOPS,
+		WriteIOPS:           rule.WriteIOPS,
+		ReadBytesPerSecond:  rule.ReadBytesPerSecond,
+		WriteBytesPerSecond: rule.WriteBytesPerSecond,
+		BurstSeconds:        rule.BurstSeconds,
+	}
+}
+
 type nbdServerConfig struct {
-	Socket string `toml:"socket"`
+	Socket                  string                     `toml:"socket"`
+	Listen                  []string                   `toml:"listen"` // Additional tcp listeners (tcp://host:port)
+	MultiConn               bool                       `toml:"multi_conn"`
+	MaxConnectionsPerExport int                        `toml:"max_connections_per_export"`
+	MaxInFlightRequests     int                        `toml:"max_in_flight_requests"` // Per connection
+	MemoryBudgetMiB         int64                      `toml:"memory_budget_mib"`      // Write payloads and read buffers of all connections
+	TLS                     nbdTLSConfig               `toml:"tls"`
+	ACL                     []middlewareconfig.ACLRule `toml:"acl"` // Evaluated in order, the first applying rule wins. Without rules every peer may open every export.
+	QoS                     []QoSRule                  `toml:"qos"` // Per export limits, the first matching rule wins. Without a matching rule an export is unlimited.
 }
 
 type Config struct {
 	CommonConfig         commonconfig.CommonConfig             `toml:"common"`
 	LoggingConfig        commonconfig.LoggingConfig            `toml:"logging"`
 	CoreConnectionConfig middlewareconfig.CoreConnectionConfig `toml:"coreconnection"`
+	InstanceConfig       middlewareconfig.InstanceConfig       `toml:"instance"`
 	NBDServerConfig      nbdServerConfig                       `toml:"nbdserver"`
-}
-
-func Get() *Config {
-	if config == nil {
-		panic("config.Get() called before Load()") // This can never happen
-	}
-	return config
+	CacheConfig          middlewareconfig.CacheConfig          `toml:"cache"`
 }
 
 func (cfg *Config) ToMiddlewareConfig() *middlewareconfig.Config {
 	return &middlewareconfig.Config{
 		CommonConfig:         cfg.CommonConfig,
 		CoreConnectionConfig: cfg.CoreConnectionConfig,
+		CacheConfig:          cfg.CacheConfig,
 	}
 }
 
-func Load() error {
-	once.Do(func() { // => Singleton
-		loadErr = load()
-	})
-	return loadErr
-}
-
-func load() error {
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
 	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_NBDSERVER_CONFIG")
 	if err != nil {
-		return fmt.Errorf("error loading config: %w", err)
+		return nil, fmt.Errorf("error loading config: %w", err)
 	}
+	return LoadFrom(configPath)
+}
 
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
 	var cfg Config
 
 	cfg.setDefaults()
 
 	if err := cfg.readConfig(configPath); err != nil {
-		return fmt.Errorf("error parsing config %s: %w", configPath, err)
+		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
 	}
 
 	if err := cfg.validate(); err != nil {
-		return fmt.Errorf("error invalid config %s: %w", configPath, err)
+		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
 	}
 
-	config = &cfg
-
-	return nil
+	return &cfg, nil
 }
 
 func (cfg *Config) setDefaults() {
 	cfg.CommonConfig.SetDefaults()
 	cfg.LoggingConfig.SetDefaults()
 	cfg.CoreConnectionConfig.SetDefaults()
+	cfg.InstanceConfig.SetDefaults()
 	cfg.NBDServerConfig.setDefaults()
+	cfg.CacheConfig.SetDefaults()
 }
 
 func (cfg *nbdServerConfig) setDefaults() {
 	cfg.Socket = filepath.Join("/", "var", "run", "qbd", "nbdserver.sock")
+	cfg.MultiConn = true
+	cfg.MaxConnectionsPerExport = 16
+	cfg.MaxInFlightRequests = 64
+	cfg.MemoryBudgetMiB = 256 // Leaves room in the RAM target of 300-400 MB
+	cfg.TLS.Mode = TLSModeOff
+	cfg.TLS.VerifyPeer = true
 }
 
 func (cfg *Config) validate() error {
 	commonErrors := cfg.CommonConfig.Validate()
 	loggingErrors := cfg.LoggingConfig.Validate()
 	coreConnectionErrors := cfg.CoreConnectionConfig.Validate()
+	instanceErrors := cfg.InstanceConfig.Validate()
 	nbdServerErrors := cfg.NBDServerConfig.validate()
-	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, nbdServerErrors)
+	cacheErrors := cfg.CacheConfig.Validate()
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, instanceErrors, nbdServerErrors, cacheErrors)
 }
 
 func (cfg *nbdServerConfig) validate() error {
 	return validation.Errors{
-		"nbdserver": validation.ValidateStruct(cfg, validation.Field(&cfg.Socket, validation.Required.Error("nbdserver.socket required"))),
+		"nbdserver": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.Socket, validation.Required.Error("nbdserver.socket required")),
+			validation.Field(&cfg.Listen, validation.Each(validation.By(validateTCPListenAddress))),
+			validation.Field(&cfg.MaxConnectionsPerExport, validation.Min(1).Error("nbdserver.max_connections_per_export must be at least 1")),
+			validation.Field(&cfg.MaxInFlightRequests, validation.Min(1).Error("nbdserver.max_in_flight_requests must be at least 1")),
+			validation.Field(&cfg.MemoryBudgetMiB, validation.Min(int64(32)).Error("nbdserver.memory_budget_mib must be at least 32 (the largest request payload)")),
+		),
+		"nbdserver.tls": validation.ValidateStruct(&cfg.TLS,
+			validation.Field(&cfg.TLS.Mode, validation.Required.Error("nbdserver.tls.mode required"), validation.In(TLSModeOff, TLSModeAllow, TLSModeRequire).Error("invalid nbdserver.tls.mode")),
+			validation.Field(&cfg.TLS.X509Dir,
+				validation.When(cfg.TLS.Mode != TLSModeOff && cfg.TLS.PSKDir == "", validation.Required.Error("nbdserver.tls.x509_dir or nbdserver.tls.psk_dir required when nbdserver.tls.mode is not off")),
+				validation.When(cfg.TLS.PSKDir != "", validation.Empty.Error("nbdserver.tls.x509_dir and nbdserver.tls.psk_dir are mutually exclusive"))),
+		),
+		"nbdserver.acl": middlewareconfig.ValidateACL("nbdserver.acl", cfg.ACL),
+		"nbdserver.qos": validateQoS(cfg.QoS),
 	}.Filter()
 }
 
+func validateQoS(rules []QoSRule) error {
+	errs := validation.Errors{}
+	for i := range rules {
+		rule := &rules[i]
+		if err := validation.ValidateStruct(rule,
+			validation.Field(&rule.Exports, validation.Required.Error("nbdserver.qos.exports required"), validation.By(middlewareconfig.ValidateExportPattern)),
+			validation.Field(&rule.BurstSeconds, validation.Max(uint32(3600)).Error("nbdserver.qos.burst_seconds must be at most 3600")),
+		); err != nil {
+			errs[strconv.Itoa(i)] = err
+		}
+	}
+	return errs.Filter()
+}
+
+// TCPListenAddress returns host:port of a tcp:// listen URI
+func TCPListenAddress(uri string) (string, error) {
+	address, ok := strings.CutPrefix(uri, "tcp://")
+	if !ok {
+		return "", fmt.Errorf("listen address %q must start with tcp://", uri)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", uri, err)
+	}
+	return address, nil
+}
+
+func validateTCPListenAddress(value any) error {
+	_, err := TCPListenAddress(value.(string))
+	return err
+}
+
 func (cfg *Config) readConfig(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -2,22 +2,71 @@
 package implementation
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
 
+	commoncontrol "quorumbd.net/common/control"
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/volume"
 	"quorumbd.net/middleware-qemu-nbd/internal/config"
+	"quorumbd.net/middleware-qemu-nbd/internal/nbd"
 )
 
 type Implementation struct {
-	Config *config.Config
-	Logger *slog.Logger
+	Config    *config.Config
+	Logger    *slog.Logger
+	server    *nbd.Server
+	listeners []net.Listener
+	wg        sync.WaitGroup
+	exportsMu sync.RWMutex
+	exports   map[string]*nbd.Export
+	volumes   *volume.Catalog
+	qos       *qosManager
 }
 
-func New(config *config.Config, logger *slog.Logger) *Implementation {
-	return &Implementation{
-		Config: config,
-		Logger: logger,
+func New(cfg *config.Config, logger *slog.Logger) (*Implementation, error) {
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pskConfig, err := loadPSKConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	impl := &Implementation{
+		Config:  cfg,
+		Logger:  logger,
+		exports: make(map[string]*nbd.Export),
+		qos:     newQoSManager(logger, cfg.NBDServerConfig.QoS),
 	}
+	impl.server = nbd.NewServer(logger, impl, nbd.Options{
+		MultiConn:               cfg.NBDServerConfig.MultiConn,
+		MaxConnectionsPerExport: cfg.NBDServerConfig.MaxConnectionsPerExport,
+		TLSConfig:               tlsConfig,
+		PSKConfig:               pskConfig,
+		TLSRequired:             cfg.NBDServerConfig.TLS.Mode == config.TLSModeRequire,
+		Authorizer:              acl.New(cfg.NBDServerConfig.ACL),
+		MaxInFlight:             cfg.NBDServerConfig.MaxInFlightRequests,
+		MemoryBudget:            cfg.NBDServerConfig.MemoryBudgetMiB << 20,
+	})
+	return impl, nil
+}
+
+// SetVolumeCatalog makes the exports resolve through the volume catalogue of core. Without a catalogue all attached exports are served.
+func (impl *Implementation) SetVolumeCatalog(volumes *volume.Catalog) {
+	impl.volumes = volumes
 }
 
 // GetImplementationName is an interface method of common-middleware.Adapter
@@ -25,11 +74,209 @@ func (impl *Implementation) GetImplementationName() string {
 	return "qemu-nbd"
 }
 
+// IsServer is an interface method of common-middleware.Adapter
 func (impl *Implementation) IsServer() bool {
 	return true
 }
 
-// Listen is an interface method of common-middleware.Adapter
-func (impl *Implementation) Listen() error {
-	return errors.New("not implemented")
+// ListenAddresses is an interface method of common-middleware.Adapter
+func (impl *Implementation) ListenAddresses() []string {
+	return append([]string{"unix://" + impl.Config.NBDServerConfig.Socket}, impl.Config.NBDServerConfig.Listen...)
+}
+
+// Start is an interface method of common-middleware.Adapter
+func (impl *Implementation) Start(_ context.Context) error {
+	ln, err := systemd.Listen("unix", impl.Config.NBDServerConfig.Socket)
+	if err != nil {
+		return err
+	}
+	impl.serve(ln)
+	impl.Logger.Info("Listening", "socket", impl.Config.NBDServerConfig.Socket, "socket_activated", systemd.IsActivated(ln))
+
+	for _, uri := range impl.Config.NBDServerConfig.Listen {
+		address, err := config.TCPListenAddress(uri)
+		if err != nil {
+			return err
+		}
+		ln, err := systemd.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		impl.serve(ln)
+		impl.Logger.Info("Listening", "address", ln.Addr().String(), "tls", impl.Config.NBDServerConfig.TLS.Mode, "socket_activated", systemd.IsActivated(ln))
+	}
+	return nil
+}
+
+func (impl *Implementation) serve(ln net.Listener) {
+	impl.listeners = append(impl.listeners, ln)
+	impl.wg.Go(func() {
+		if err := impl.server.Serve(ln); err != nil {
+			impl.Logger.Error("NBD server failed", "address", ln.Addr().String(), "error", err)
+		}
+	})
+}
+
+// Stop is an interface method of common-middleware.Adapter
+func (impl *Implementation) Stop(ctx context.Context) error {
+	if len(impl.listeners) == 0 {
+		return nil
+	}
+	var err error
+	for _, ln := range impl.listeners {
+		if closeErr := ln.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	impl.wg.Wait()
+	if shutdownErr := impl.server.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// AttachExport is an interface method of common-middleware.Adapter
+func (impl *Implementation) AttachExport(export backend.Export, blockBackend backend.BlockBackend) error {
+	impl.exportsMu.Lock()
+	defer impl.exportsMu.Unlock()
+	impl.exports[export.Name] = &nbd.Export{
+		Name:      export.Name,
+		ReadOnly:  export.ReadOnly,
+		BlockSize: export.BlockSize,
+		Backend:   blockBackend,
+		Limiter:   impl.qos.attach(export.Name),
+	}
+	return nil
+}
+
+// DetachExport is an interface method of common-middleware.Adapter
+func (impl *Implementation) DetachExport(name string) error {
+	impl.exportsMu.Lock()
+	defer impl.exportsMu.Unlock()
+	if _, ok := impl.exports[name]; !ok {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	delete(impl.exports, name)
+	impl.qos.detach(name)
+	if disconnected := impl.server.DisconnectExport(name); disconnected > 0 {
+		impl.Logger.Info("Disconnected clients of detached export", "export", name, "clients", disconnected)
+	}
+	return nil
+}
+
+// Clients is an interface method of common-middleware.ClientReporter
+func (impl *Implementation) Clients() []commoncontrol.ClientInfo {
+	connections := impl.server.Connections()
+	clients := make([]commoncontrol.ClientInfo, 0, len(connections))
+	for _, connection := range connections {
+		client := commoncontrol.ClientInfo{
+			ID:           connection.ID,
+			Export:       connection.Export,
+			RemoteAddr:   connection.RemoteAddr,
+			ConnectedAt:  uint64(connection.ConnectedAt.UnixMilli()),
+			Flags:        uint32(connection.Flags),
+			BytesRead:    connection.BytesRead,
+			BytesWritten: connection.BytesWritten,
+		}
+		connection.Peer.Describe(&client)
+		if connection.TLS {
+			client.Features = append(client.Features, "tls")
+		}
+		if connection.StructuredReplies {
+			client.Features = append(client.Features, "structured_replies")
+		}
+		if connection.ExtendedHeaders {
+			client.Features = append(client.Features, "extended_headers")
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// DisconnectClient is an interface method of common-middleware.ClientReporter
+func (impl *Implementation) DisconnectClient(id uint64, _ string) error {
+	if !impl.server.Disconnect(id) {
+		return fmt.Errorf("no client with id %d", id)
+	}
+	return nil
+}
+
+// SetExportQoS is an interface method of common-middleware.QoSController
+func (impl *Implementation) SetExportQoS(name string, limits commoncontrol.QoSLimits, reset bool) {
+	impl.qos.set(name, limits, reset)
+}
+
+// Status is an interface method of common-middleware.StatusReporter
+func (impl *Implementation) Status() string {
+	return impl.qos.status()
+}
+
+// LookupExport is an interface method of nbd.ExportSource: the volume must be visible in core and attached to this middleware
+func (impl *Implementation) LookupExport(ctx context.Context, name string) (*nbd.Export, error) {
+	impl.exportsMu.RLock()
+	export, attached := impl.exports[name]
+	impl.exportsMu.RUnlock()
+
+	if impl.volumes == nil {
+		if !attached {
+			return nil, nbd.ErrUnknownExport
+		}
+		return export, nil
+	}
+
+	info, err := impl.volumes.Lookup(ctx, name)
+	if err != nil {
+		if errors.Is(err, volume.ErrUnknownVolume) {
+			return nil, nbd.ErrUnknownExport
+		}
+		return nil, err
+	}
+	if !attached {
+		return nil, fmt.Errorf("%w: volume %q is not attached", nbd.ErrUnknownExport, name)
+	}
+
+	return &nbd.Export{
+		Name:        export.Name,
+		Description: describeVolume(info),
+		ReadOnly:    export.ReadOnly || info.ReadOnly,
+		BlockSize:   cmp.Or(info.BlockSize, export.BlockSize),
+		Backend:     export.Backend,
+		Limiter:     export.Limiter,
+	}, nil
+}
+
+// ListExports is an interface method of nbd.ExportSource: it lists the volumes visible in core
+func (impl *Implementation) ListExports(ctx context.Context) ([]nbd.ExportListing, error) {
+	if impl.volumes == nil {
+		impl.exportsMu.RLock()
+		listings := make([]nbd.ExportListing, 0, len(impl.exports))
+		for _, export := range impl.exports {
+			listings = append(listings, nbd.ExportListing{Name: export.Name, Description: export.Description})
+		}
+		impl.exportsMu.RUnlock()
+
+		slices.SortFunc(listings, func(a, b nbd.ExportListing) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		return listings, nil
+	}
+
+	volumes, err := impl.volumes.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listings := make([]nbd.ExportListing, 0, len(volumes))
+	for _, info := range volumes {
+		listings = append(listings, nbd.ExportListing{Name: info.Name, Description: describeVolume(info)})
+	}
+	return listings, nil
+}
+
+// describeVolume returns the NBD description of a volume: its size in bytes and its labels sorted by key
+func describeVolume(info commoncontrol.VolumeInfo) string {
+	parts := []string{fmt.Sprintf("size=%d", info.Size)}
+	for _, key := range slices.Sorted(maps.Keys(info.Labels)) {
+		parts = append(parts, key+"="+info.Labels[key])
+	}
+	return strings.Join(parts, " ")
 }
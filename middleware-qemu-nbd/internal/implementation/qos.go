@@ -0,0 +1,120 @@
+package implementation
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	commoncontrol "quorumbd.net/common/control"
+
+	"quorumbd.net/middleware-common/qos"
+	"quorumbd.net/middleware-qemu-nbd/internal/config"
+)
+
+// qosManager keeps the limiters of the attached exports. Limits set by core override the configured rules by export name.
+type qosManager struct {
+	logger    *slog.Logger
+	rules     []config.QoSRule
+	mu        sync.Mutex
+	overrides map[string]qos.Limits
+	limiters  map[string]*qos.Limiter
+}
+
+func newQoSManager(logger *slog.Logger, rules []config.QoSRule) *qosManager {
+	return &qosManager{
+		logger:    logger.With("module", "qos"),
+		rules:     rules,
+		overrides: make(map[string]qos.Limits),
+		limiters:  make(map[string]*qos.Limiter),
+	}
+}
+
+// configured returns the limits of the first rule matching the export
+func (m *qosManager) configured(name string) qos.Limits {
+	for i := range m.rules {
+		if matched, _ := path.Match(m.rules[i].Exports, name); matched {
+			return m.rules[i].Limits()
+		}
+	}
+	return qos.Limits{}
+}
+
+// attach creates the limiter of an export
+func (m *qosManager) attach(name string) *qos.Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limits, ok := m.overrides[name]
+	if !ok {
+		limits = m.configured(name)
+	}
+	limiter := qos.NewLimiter(limits)
+	m.limiters[name] = limiter
+	if !limits.Unlimited() {
+		m.logger.Info("Export is limited", "export", name, "limits", limits.String(), "override", ok)
+	}
+	return limiter
+}
+
+func (m *qosManager) detach(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.limiters, name)
+}
+
+// set applies the limits sent by core (or the configured limits on reset)
+func (m *qosManager) set(name string, qosLimits commoncontrol.QoSLimits, reset bool) {
+	limits := qos.Limits{
+		ReadIOPS:            qosLimits.ReadIOPS,
+		WriteIOPS:           qosLimits.WriteIOPS,
+		ReadBytesPerSecond:  qosLimits.ReadBytesPerSecond,
+		WriteBytesPerSecond: qosLimits.WriteBytesPerSecond,
+		BurstSeconds:        qosLimits.BurstSeconds,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reset {
+		delete(m.overrides, name)
+		limits = m.configured(name)
+	} else {
+		m.overrides[name] = limits
+	}
+	if limiter, ok := m.limiters[name]; ok {
+		limiter.SetLimits(limits)
+	}
+	m.logger.Info("Export limits changed by core", "export", name, "limits", limits.String(), "reset", reset)
+}
+
+// status summarizes the limited exports as throttled/total requests and the summed delay, e.g. "qos vm1: 3/120 throttled (1.2s)"
+// (empty, if no export is limited)
+func (m *qosManager) status() string {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.limiters))
+	for name := range m.limiters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	stats := make([]qos.Stats, len(names))
+	for i, name := range names {
+		stats[i] = m.limiters[name].Stats()
+	}
+	m.mu.Unlock()
+
+	var parts []string
+	for i, name := range names {
+		if stats[i].Limits.Unlimited() {
+			continue
+		}
+		throttled := stats[i].Read.Throttled + stats[i].Write.Throttled
+		delay := (stats[i].Read.Delay + stats[i].Write.Delay).Round(100 * time.Millisecond)
+		parts = append(parts, fmt.Sprintf("%s: %d/%d throttled (%s)", name, throttled, stats[i].Read.Requests+stats[i].Write.Requests, delay))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "qos " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,66 @@
+package implementation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"quorumbd.net/middleware-qemu-nbd/internal/config"
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+// File names of the tls-creds-x509 directory layout of QEMU
+const (
+	x509CACert     = "ca-cert.pem"
+	x509ServerCert = "server-cert.pem"
+	x509ServerKey  = "server-key.pem"
+)
+
+// loadPSKConfig loads the keys from the PSK directory (nil, if TLS is off or uses x509 credentials)
+func loadPSKConfig(cfg *config.Config) (*tlspsk.Config, error) {
+	tlsCfg := cfg.NBDServerConfig.TLS
+	if tlsCfg.Mode == config.TLSModeOff || tlsCfg.PSKDir == "" {
+		return nil, nil
+	}
+	keys, err := tlspsk.LoadKeys(filepath.Join(tlsCfg.PSKDir, tlspsk.KeysFile))
+	if err != nil {
+		return nil, fmt.Errorf("loading pre-shared keys failed: %w", err)
+	}
+	return &tlspsk.Config{Keys: keys}, nil
+}
+
+// loadTLSConfig loads the server credentials from the x509 directory (nil, if TLS is off or uses pre-shared keys)
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsCfg := cfg.NBDServerConfig.TLS
+	if tlsCfg.Mode == config.TLSModeOff || tlsCfg.X509Dir == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(tlsCfg.X509Dir, x509ServerCert), filepath.Join(tlsCfg.X509Dir, x509ServerKey))
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate failed: %w", err)
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsCfg.VerifyPeer {
+		caFile := filepath.Join(tlsCfg.X509Dir, x509CACert)
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading CA certificate failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		serverConfig.ClientCAs = pool
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return serverConfig, nil
+}
@@ -0,0 +1,88 @@
+package nbd
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// budget limits the memory of the write payloads and read buffers of all connections.
+// Waiters are served in FIFO order, so large requests are not starved by small ones.
+type budget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	waiters list.List // *budgetWaiter
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// newBudget returns a budget of limit bytes (nil for an unlimited budget)
+func newBudget(limit int64) *budget {
+	if limit <= 0 {
+		return nil
+	}
+	return &budget{limit: limit}
+}
+
+// acquire blocks until n bytes are available and returns the acquired amount, which must be released.
+// Requests larger than the budget acquire the whole budget.
+func (b *budget) acquire(ctx context.Context, n int64) (int64, error) {
+	if b == nil || n <= 0 {
+		return 0, nil
+	}
+	n = min(n, b.limit)
+
+	b.mu.Lock()
+	if b.waiters.Len() == 0 && b.used+n <= b.limit {
+		b.used += n
+		b.mu.Unlock()
+		return n, nil
+	}
+	waiter := &budgetWaiter{n: n, ready: make(chan struct{})}
+	elem := b.waiters.PushBack(waiter)
+	b.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return n, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-waiter.ready:
+			// Granted while giving up
+			b.used -= n
+		default:
+			b.waiters.Remove(elem)
+		}
+		b.grantLocked()
+		b.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+func (b *budget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.grantLocked()
+	b.mu.Unlock()
+}
+
+// grantLocked wakes up the waiters at the front of the queue that fit into the budget
+func (b *budget) grantLocked() {
+	for elem := b.waiters.Front(); elem != nil; elem = b.waiters.Front() {
+		waiter := elem.Value.(*budgetWaiter)
+		if b.used+waiter.n > b.limit {
+			return
+		}
+		b.used += waiter.n
+		b.waiters.Remove(elem)
+		close(waiter.ready)
+	}
+}
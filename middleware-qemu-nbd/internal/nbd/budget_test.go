@@ -0,0 +1,201 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// acquireAsync acquires n bytes in a goroutine, the channel receives the error
+func acquireAsync(ctx context.Context, b *budget, n int64) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.acquire(ctx, n)
+		done <- err
+	}()
+	return done
+}
+
+// waitForWaiters waits until n acquisitions are queued
+func waitForWaiters(t *testing.T, b *budget, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		waiters := b.waiters.Len()
+		b.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters, want %d", waiters, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func granted(done <-chan error) bool {
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+func TestBudgetUnlimited(t *testing.T) {
+	b := newBudget(0)
+	if n, err := b.acquire(t.Context(), 1<<30); n != 0 || err != nil {
+		t.Fatalf("acquired %d: %v", n, err)
+	}
+	b.release(1 << 30)
+}
+
+func TestBudgetBlocksUntilReleased(t *testing.T) {
+	b := newBudget(100)
+	if n, err := b.acquire(t.Context(), 60); n != 60 || err != nil {
+		t.Fatalf("acquired %d: %v", n, err)
+	}
+
+	// The large request waits, the small one behind it is not admitted before it although it would fit
+	large := acquireAsync(t.Context(), b, 60)
+	waitForWaiters(t, b, 1)
+	small := acquireAsync(t.Context(), b, 10)
+	waitForWaiters(t, b, 2)
+	if granted(large) || granted(small) {
+		t.Fatal("acquired over the budget")
+	}
+
+	b.release(60)
+	if !granted(large) || !granted(small) {
+		t.Fatal("waiters not granted after the release")
+	}
+	if b.used != 70 {
+		t.Fatalf("%d bytes used", b.used)
+	}
+}
+
+func TestBudgetRequestLargerThanBudget(t *testing.T) {
+	b := newBudget(100)
+	if n, err := b.acquire(t.Context(), 10); n != 10 || err != nil {
+		t.Fatalf("acquired %d: %v", n, err)
+	}
+
+	// The request takes the whole budget once everything else is released
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := b.acquire(t.Context(), 1000)
+		done <- n
+	}()
+	waitForWaiters(t, b, 1)
+	b.release(10)
+	select {
+	case n := <-done:
+		if n != 100 {
+			t.Fatalf("acquired %d, want the budget", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request larger than the budget deadlocked")
+	}
+	b.release(100)
+	if b.used != 0 {
+		t.Fatalf("%d bytes used after the release", b.used)
+	}
+}
+
+func TestBudgetCancel(t *testing.T) {
+	b := newBudget(100)
+	if _, err := b.acquire(t.Context(), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	large := acquireAsync(ctx, b, 100)
+	waitForWaiters(t, b, 1)
+	small := acquireAsync(t.Context(), b, 10)
+	waitForWaiters(t, b, 2)
+	b.release(50)
+	if granted(small) {
+		t.Fatal("waiter admitted before the one in front of it")
+	}
+
+	// Canceling the waiter in front lets the one behind it in
+	cancel()
+	if err := <-large; !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want canceled", err)
+	}
+	if !granted(small) {
+		t.Fatal("waiter behind the canceled one not granted")
+	}
+	waitForWaiters(t, b, 0)
+	if b.used != 60 {
+		t.Fatalf("%d bytes used", b.used)
+	}
+}
+
+// gatedBackend blocks writes until the gate is opened and records how many were in the backend at once
+type gatedBackend struct {
+	*memBackend
+	gate        chan struct{}
+	mu          sync.Mutex
+	writing     int
+	maxWriting  int
+	writeCalled chan struct{}
+}
+
+func (b *gatedBackend) WriteAt(ctx context.Context, p []byte, off int64, flags backend.Flags) error {
+	b.mu.Lock()
+	b.writing++
+	b.maxWriting = max(b.maxWriting, b.writing)
+	b.mu.Unlock()
+	b.writeCalled <- struct{}{}
+	<-b.gate
+	b.mu.Lock()
+	b.writing--
+	b.mu.Unlock()
+	return b.memBackend.WriteAt(ctx, p, off, flags)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	gated := &gatedBackend{memBackend: newMemBackend(1 << 20), gate: make(chan struct{}), writeCalled: make(chan struct{}, 16)}
+	exports := exportSource{"disk": {Name: "disk", BlockSize: 4096, Backend: gated}}
+	path := startServer(t, exports, Options{MaxInFlight: 8, MemoryBudget: 8192})
+	client := dialClient(t, path, ClientOptions{ExportName: "disk"})
+
+	// Two payloads fit into the budget, the third is not read until a reply released memory
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := range 3 {
+		wg.Go(func() {
+			errs <- client.WriteAt(t.Context(), make([]byte, 4096), uint64(i)*4096, 0)
+		})
+	}
+	for range 2 {
+		<-gated.writeCalled
+	}
+	select {
+	case <-gated.writeCalled:
+		t.Fatal("write over the memory budget reached the backend")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A payload larger than the budget takes the whole budget once the others are done
+	wg.Go(func() {
+		errs <- client.WriteAt(t.Context(), make([]byte, 16384), 65536, 0)
+	})
+	close(gated.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gated.maxWriting != 2 {
+		t.Fatalf("%d writes in the backend at once, want 2", gated.maxWriting)
+	}
+}
@@ -0,0 +1,748 @@
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+// ErrClientClosed is returned for requests on a closed client
+var ErrClientClosed = errors.New("nbd client closed")
+
+// ErrNoMetaContext is returned by Dial, if the server supports none of the requested meta contexts (e.g. it does not
+// implement NBD_OPT_SET_META_CONTEXT). Clients can dial again without meta contexts.
+var ErrNoMetaContext = errors.New("server supports none of the requested meta contexts")
+
+// ClientOptions configure the negotiation of a client
+type ClientOptions struct {
+	ExportName        string
+	TLSConfig         *tls.Config    // Upgrade with NBD_OPT_STARTTLS, if set
+	PSKConfig         *tlspsk.Config // Upgrade with NBD_OPT_STARTTLS to TLS-PSK, if set instead of TLSConfig
+	StructuredReplies bool           // Sparse reads; implied by MetaContexts
+	MetaContexts      []string       // Meta contexts for BlockStatus, e.g. MetaContextBaseAllocation
+}
+
+// OptionError is an error reply of the server during negotiation
+type OptionError struct {
+	Option  uint32
+	Reply   uint32
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("option %d failed with reply 0x%x: %s", e.Option, e.Reply, e.Message)
+}
+
+// RequestError is an error reply of the server to a request
+type RequestError struct {
+	Errno   uint32
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request failed with errno %d", e.Errno)
+	}
+	return fmt.Sprintf("request failed with errno %d: %s", e.Errno, e.Message)
+}
+
+// BlockStatusExtent is a descriptor of a block status reply
+type BlockStatusExtent struct {
+	Length uint32
+	Flags  uint32
+}
+
+// Client is an NBD client connected to an export. Requests may be issued concurrently; they are pipelined.
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	writeMu sync.Mutex
+
+	size         uint64
+	flags        uint16
+	blockSize    [3]uint32 // minimum, preferred, maximum (zero, if not sent)
+	structured   bool
+	metaContexts map[uint32]string
+
+	mu         sync.Mutex
+	pending    map[uint64]*call
+	nextCookie uint64
+	inFlight   sync.WaitGroup
+	err        error // Set, once the connection failed or was closed
+	done       chan struct{}
+}
+
+// call is an outstanding request of a client
+type call struct {
+	command     uint16
+	offset      uint64
+	length      uint32
+	buf         []byte                         // Destination of reads
+	blockStatus map[string][]BlockStatusExtent // Replies of block status requests
+	err         error                          // First error chunk
+	done        chan error
+}
+
+// Dial connects to the server and negotiates the export
+func Dial(ctx context.Context, network, address string, options ClientOptions) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(ctx, conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient negotiates the export over an established connection
+func NewClient(ctx context.Context, conn net.Conn, options ClientOptions) (*Client, error) {
+	c := &Client{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		pending: make(map[uint64]*call),
+		done:    make(chan struct{}),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close() // Aborts the negotiation
+	})
+	err := c.negotiate(ctx, options)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+// Size returns the size of the export in bytes
+func (c *Client) Size() uint64 {
+	return c.size
+}
+
+// Flags returns the transmission flags of the export
+func (c *Client) Flags() uint16 {
+	return c.flags
+}
+
+func (c *Client) ReadOnly() bool {
+	return c.flags&FlagReadOnly != 0
+}
+
+// CanMultiConn returns true, if the server allows several connections with shared flush semantics
+func (c *Client) CanMultiConn() bool {
+	return c.flags&FlagCanMultiConn != 0
+}
+
+// BlockSize returns the minimum, preferred and maximum block size (zero, if not sent by the server)
+func (c *Client) BlockSize() (uint32, uint32, uint32) {
+	return c.blockSize[0], c.blockSize[1], c.blockSize[2]
+}
+
+// ReadAt reads len(p) bytes at off. With structured replies holes are filled with zeroes.
+func (c *Client) ReadAt(ctx context.Context, p []byte, off uint64) error {
+	return c.do(ctx, &call{command: CmdRead, offset: off, length: uint32(len(p)), buf: p}, 0, nil)
+}
+
+// WriteAt writes p at off (flags: CmdFlagFUA)
+func (c *Client) WriteAt(ctx context.Context, p []byte, off uint64, flags uint16) error {
+	return c.do(ctx, &call{command: CmdWrite, offset: off, length: uint32(len(p))}, flags, p)
+}
+
+func (c *Client) Flush(ctx context.Context) error {
+	return c.do(ctx, &call{command: CmdFlush}, 0, nil)
+}
+
+// Trim discards a range (flags: CmdFlagFUA)
+func (c *Client) Trim(ctx context.Context, off uint64, length uint32, flags uint16) error {
+	return c.do(ctx, &call{command: CmdTrim, offset: off, length: length}, flags, nil)
+}
+
+// WriteZeroes zeroes a range (flags: CmdFlagFUA, CmdFlagNoHole, CmdFlagFastZero)
+func (c *Client) WriteZeroes(ctx context.Context, off uint64, length uint32, flags uint16) error {
+	return c.do(ctx, &call{command: CmdWriteZeroes, offset: off, length: length}, flags, nil)
+}
+
+// Cache asks the server to prefetch a range
+func (c *Client) Cache(ctx context.Context, off uint64, length uint32) error {
+	return c.do(ctx, &call{command: CmdCache, offset: off, length: length}, 0, nil)
+}
+
+// BlockStatus queries the negotiated meta contexts for a range (flags: CmdFlagReqOne). The extents are keyed by context name.
+func (c *Client) BlockStatus(ctx context.Context, off uint64, length uint32, flags uint16) (map[string][]BlockStatusExtent, error) {
+	if len(c.metaContexts) == 0 {
+		return nil, fmt.Errorf("no meta context negotiated")
+	}
+	cl := &call{command: CmdBlockStatus, offset: off, length: length, blockStatus: make(map[string][]BlockStatusExtent)}
+	if err := c.do(ctx, cl, flags, nil); err != nil {
+		return nil, err
+	}
+	return cl.blockStatus, nil
+}
+
+// Disconnect waits for outstanding requests, sends NBD_CMD_DISC and closes the connection. No requests may be issued concurrently.
+func (c *Client) Disconnect(ctx context.Context) error {
+	idle := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+
+	c.mu.Lock()
+	cookie, err := c.nextCookie, c.err
+	c.nextCookie++
+	c.mu.Unlock()
+	if err == nil {
+		err = c.writeRequest(CmdDisc, 0, cookie, 0, 0, nil)
+	}
+	c.Close()
+	if errors.Is(err, ErrClientClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the connection, outstanding requests fail
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	<-c.done
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, cl *call, flags uint16, payload []byte) error {
+	cl.done = make(chan error, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	cookie := c.nextCookie
+	c.nextCookie++
+	c.pending[cookie] = cl
+	c.inFlight.Add(1)
+	c.mu.Unlock()
+	defer c.inFlight.Done()
+
+	if err := c.writeRequest(cl.command, flags, cookie, cl.offset, cl.length, payload); err != nil {
+		c.fail(err)
+	}
+
+	select {
+	case err := <-cl.done:
+		return err
+	case <-ctx.Done():
+		// The reply cannot be skipped on the wire, so the connection is given up
+		c.fail(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+func (c *Client) writeRequest(command uint16, flags uint16, cookie uint64, offset uint64, length uint32, payload []byte) error {
+	var header [28]byte
+	be.PutUint32(header[0:], MagicRequest)
+	be.PutUint16(header[4:], flags)
+	be.PutUint16(header[6:], command)
+	be.PutUint64(header[8:], cookie)
+	be.PutUint64(header[16:], offset)
+	be.PutUint32(header[24:], length)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// fail closes the connection and fails all outstanding requests with err (only the first error counts)
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = make(map[uint64]*call)
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, cl := range pending {
+		cl.done <- err
+	}
+}
+
+// readLoop reads the replies and completes the outstanding requests
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		if err := c.readReply(); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *Client) lookup(cookie uint64) (*call, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.pending[cookie]
+	if !ok {
+		if c.err != nil {
+			return nil, c.err
+		}
+		return nil, fmt.Errorf("reply for unknown cookie %d", cookie)
+	}
+	return cl, nil
+}
+
+func (c *Client) complete(cookie uint64, cl *call, err error) {
+	c.mu.Lock()
+	delete(c.pending, cookie)
+	c.mu.Unlock()
+	cl.done <- err
+}
+
+func (c *Client) readReply() error {
+	var magicBuf [4]byte
+	if _, err := io.ReadFull(c.r, magicBuf[:]); err != nil {
+		return err
+	}
+	switch magic := be.Uint32(magicBuf[:]); magic {
+	case MagicSimpleReply:
+		return c.readSimpleReply()
+	case MagicStructuredReply:
+		return c.readStructuredChunk()
+	default:
+		return fmt.Errorf("invalid reply magic 0x%x", magic)
+	}
+}
+
+func (c *Client) readSimpleReply() error {
+	var header [12]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	errno := be.Uint32(header[0:])
+	cookie := be.Uint64(header[4:])
+	cl, err := c.lookup(cookie)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		c.complete(cookie, cl, &RequestError{Errno: errno})
+		return nil
+	}
+	if cl.command == CmdRead {
+		if _, err := io.ReadFull(c.r, cl.buf); err != nil {
+			return err
+		}
+	}
+	c.complete(cookie, cl, nil)
+	return nil
+}
+
+func (c *Client) readStructuredChunk() error {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	flags := be.Uint16(header[0:])
+	replyType := be.Uint16(header[2:])
+	cookie := be.Uint64(header[4:])
+	length := be.Uint32(header[12:])
+
+	cl, err := c.lookup(cookie)
+	if err != nil {
+		return err
+	}
+	if replyType == ReplyTypeOffsetData {
+		if err := c.readOffsetData(cl, length); err != nil {
+			return err
+		}
+	} else {
+		if length > maxPayloadLength {
+			return fmt.Errorf("reply chunk too large: %d", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		if err := c.handleChunk(cl, replyType, payload); err != nil {
+			return err
+		}
+	}
+
+	if flags&ReplyFlagDone != 0 {
+		c.complete(cookie, cl, cl.err)
+	}
+	return nil
+}
+
+// readOffsetData reads the data of a chunk directly into the buffer of the read
+func (c *Client) readOffsetData(cl *call, length uint32) error {
+	if cl.command != CmdRead || length < 8 {
+		return fmt.Errorf("unexpected data chunk for command %d", cl.command)
+	}
+	var offsetBuf [8]byte
+	if _, err := io.ReadFull(c.r, offsetBuf[:]); err != nil {
+		return err
+	}
+	start, end, err := cl.span(be.Uint64(offsetBuf[:]), uint64(length-8))
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c.r, cl.buf[start:end])
+	return err
+}
+
+func (c *Client) handleChunk(cl *call, replyType uint16, payload []byte) error {
+	switch replyType {
+	case ReplyTypeNone:
+		return nil
+
+	case ReplyTypeOffsetHole:
+		if cl.command != CmdRead || len(payload) != 12 {
+			return fmt.Errorf("unexpected hole chunk for command %d", cl.command)
+		}
+		start, end, err := cl.span(be.Uint64(payload[0:]), uint64(be.Uint32(payload[8:])))
+		if err != nil {
+			return err
+		}
+		clear(cl.buf[start:end])
+		return nil
+
+	case ReplyTypeBlockStatus:
+		if cl.command != CmdBlockStatus || len(payload) < 4 || (len(payload)-4)%8 != 0 {
+			return fmt.Errorf("unexpected block status chunk for command %d", cl.command)
+		}
+		name, ok := c.metaContexts[be.Uint32(payload)]
+		if !ok {
+			return fmt.Errorf("block status for unknown meta context %d", be.Uint32(payload))
+		}
+		for rest := payload[4:]; len(rest) > 0; rest = rest[8:] {
+			cl.blockStatus[name] = append(cl.blockStatus[name], BlockStatusExtent{Length: be.Uint32(rest), Flags: be.Uint32(rest[4:])})
+		}
+		return nil
+
+	case ReplyTypeError, ReplyTypeErrorOffset:
+		if len(payload) < 6 || len(payload) < 6+int(be.Uint16(payload[4:])) {
+			return fmt.Errorf("malformed error chunk")
+		}
+		if cl.err == nil {
+			cl.err = &RequestError{Errno: be.Uint32(payload), Message: string(payload[6 : 6+be.Uint16(payload[4:])])}
+		}
+		return nil
+
+	default:
+		if replyType&(1<<15) != 0 && len(payload) >= 4 {
+			if cl.err == nil {
+				cl.err = &RequestError{Errno: be.Uint32(payload), Message: fmt.Sprintf("unknown error chunk type %d", replyType)}
+			}
+			return nil
+		}
+		return fmt.Errorf("unknown reply chunk type %d", replyType)
+	}
+}
+
+// span returns the range of the read buffer covered by a chunk
+func (cl *call) span(offset uint64, length uint64) (uint64, uint64, error) {
+	if offset < cl.offset || offset-cl.offset > uint64(len(cl.buf)) || length > uint64(len(cl.buf))-(offset-cl.offset) {
+		return 0, 0, fmt.Errorf("reply chunk outside of the requested range")
+	}
+	return offset - cl.offset, offset - cl.offset + length, nil
+}
+
+// negotiate runs the fixed newstyle handshake and enters the transmission phase
+func (c *Client) negotiate(ctx context.Context, options ClientOptions) error {
+	var hello [18]byte
+	if _, err := io.ReadFull(c.r, hello[:]); err != nil {
+		return err
+	}
+	if be.Uint64(hello[0:]) != MagicNBD || be.Uint64(hello[8:]) != MagicOption {
+		return fmt.Errorf("server does not support newstyle negotiation")
+	}
+	serverFlags := be.Uint16(hello[16:])
+	if serverFlags&FlagFixedNewstyle == 0 {
+		return fmt.Errorf("server does not support fixed newstyle negotiation")
+	}
+	clientFlags := FlagClientFixedNewstyle
+	if serverFlags&FlagNoZeroes != 0 {
+		clientFlags |= FlagClientNoZeroes
+	}
+	if err := c.writeAll(be.AppendUint32(nil, clientFlags)); err != nil {
+		return err
+	}
+
+	if options.TLSConfig != nil || options.PSKConfig != nil {
+		if err := c.startTLS(ctx, options); err != nil {
+			return err
+		}
+	}
+
+	if options.StructuredReplies || len(options.MetaContexts) > 0 {
+		if err := c.simpleOption(OptStructuredReply, nil); err != nil {
+			optionErr, ok := errors.AsType[*OptionError](err)
+			if !ok {
+				return err
+			}
+			if len(options.MetaContexts) > 0 {
+				return unsupportedMetaContexts(optionErr)
+			}
+		} else {
+			c.structured = true
+		}
+	}
+
+	if len(options.MetaContexts) > 0 {
+		if err := c.setMetaContexts(options.ExportName, options.MetaContexts); err != nil {
+			return err
+		}
+	}
+
+	return c.goExport(options.ExportName)
+}
+
+func (c *Client) startTLS(ctx context.Context, options ClientOptions) error {
+	if err := c.simpleOption(OptStartTLS, nil); err != nil {
+		return err
+	}
+	var tlsConn interface {
+		net.Conn
+		HandshakeContext(context.Context) error
+	}
+	if options.PSKConfig != nil {
+		tlsConn = tlspsk.Client(c.conn, options.PSKConfig)
+	} else {
+		tlsConn = tls.Client(c.conn, options.TLSConfig)
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	c.w = bufio.NewWriter(tlsConn)
+	return nil
+}
+
+// simpleOption sends an option that is answered by a single NBD_REP_ACK
+func (c *Client) simpleOption(option uint32, data []byte) error {
+	if err := c.writeOption(option, data); err != nil {
+		return err
+	}
+	replyType, payload, err := c.readOptionReply(option)
+	if err != nil {
+		return err
+	}
+	if replyType != RepAck {
+		return fmt.Errorf("unexpected reply 0x%x to option %d (%d bytes)", replyType, option, len(payload))
+	}
+	return nil
+}
+
+func (c *Client) setMetaContexts(exportName string, queries []string) error {
+	data := be.AppendUint32(nil, uint32(len(exportName)))
+	data = append(data, exportName...)
+	data = be.AppendUint32(data, uint32(len(queries)))
+	for _, query := range queries {
+		data = be.AppendUint32(data, uint32(len(query)))
+		data = append(data, query...)
+	}
+	if err := c.writeOption(OptSetMetaContext, data); err != nil {
+		return err
+	}
+
+	c.metaContexts = make(map[uint32]string)
+	for {
+		replyType, payload, err := c.readOptionReply(OptSetMetaContext)
+		if optionErr, ok := errors.AsType[*OptionError](err); ok {
+			return unsupportedMetaContexts(optionErr)
+		}
+		if err != nil {
+			return err
+		}
+		switch replyType {
+		case RepAck:
+			if len(c.metaContexts) == 0 {
+				return fmt.Errorf("%w: server selected none of %v", ErrNoMetaContext, queries)
+			}
+			return nil
+		case RepMetaContext:
+			if len(payload) < 4 {
+				return fmt.Errorf("malformed meta context reply")
+			}
+			c.metaContexts[be.Uint32(payload)] = string(payload[4:])
+		default:
+			return fmt.Errorf("unexpected reply 0x%x to NBD_OPT_SET_META_CONTEXT", replyType)
+		}
+	}
+}
+
+// unsupportedMetaContexts wraps the option error in ErrNoMetaContext, if the server does not implement the option
+func unsupportedMetaContexts(optionErr *OptionError) error {
+	if optionErr.Reply == RepErrUnsup {
+		return fmt.Errorf("%w: %w", ErrNoMetaContext, optionErr)
+	}
+	return optionErr
+}
+
+func (c *Client) goExport(exportName string) error {
+	data := be.AppendUint32(nil, uint32(len(exportName)))
+	data = append(data, exportName...)
+	data = be.AppendUint16(data, 1)
+	data = be.AppendUint16(data, InfoBlockSize)
+	if err := c.writeOption(OptGo, data); err != nil {
+		return err
+	}
+
+	haveExport := false
+	for {
+		replyType, payload, err := c.readOptionReply(OptGo)
+		if err != nil {
+			return err
+		}
+		switch replyType {
+		case RepAck:
+			if !haveExport {
+				return fmt.Errorf("server sent no NBD_INFO_EXPORT")
+			}
+			return nil
+		case RepInfo:
+			if len(payload) < 2 {
+				return fmt.Errorf("malformed info reply")
+			}
+			switch be.Uint16(payload) {
+			case InfoExport:
+				if len(payload) != 12 {
+					return fmt.Errorf("malformed NBD_INFO_EXPORT")
+				}
+				c.size = be.Uint64(payload[2:])
+				c.flags = be.Uint16(payload[10:])
+				haveExport = true
+			case InfoBlockSize:
+				if len(payload) != 14 {
+					return fmt.Errorf("malformed NBD_INFO_BLOCK_SIZE")
+				}
+				c.blockSize = [3]uint32{be.Uint32(payload[2:]), be.Uint32(payload[6:]), be.Uint32(payload[10:])}
+			}
+		default:
+			return fmt.Errorf("unexpected reply 0x%x to NBD_OPT_GO", replyType)
+		}
+	}
+}
+
+func (c *Client) writeOption(option uint32, data []byte) error {
+	header := make([]byte, 16, 16+len(data))
+	be.PutUint64(header[0:], MagicOption)
+	be.PutUint32(header[8:], option)
+	be.PutUint32(header[12:], uint32(len(data)))
+	return c.writeAll(append(header, data...))
+}
+
+// readOptionReply reads an option reply. Error replies are returned as *OptionError.
+func (c *Client) readOptionReply(option uint32) (uint32, []byte, error) {
+	var header [20]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if magic := be.Uint64(header[0:]); magic != MagicOptionReply {
+		return 0, nil, fmt.Errorf("invalid option reply magic 0x%x", magic)
+	}
+	if replyOption := be.Uint32(header[8:]); replyOption != option {
+		return 0, nil, fmt.Errorf("reply for option %d while waiting for option %d", replyOption, option)
+	}
+	replyType := be.Uint32(header[12:])
+	length := be.Uint32(header[16:])
+	if length > maxOptionLength+maxNameLength {
+		return 0, nil, fmt.Errorf("option reply too large: %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if replyType&repFlagError != 0 {
+		return 0, nil, &OptionError{Option: option, Reply: replyType, Message: string(payload)}
+	}
+	return replyType, payload, nil
+}
+
+func (c *Client) writeAll(data []byte) error {
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// MetaContexts returns the names of the negotiated meta contexts
+func (c *Client) MetaContexts() []string {
+	names := make([]string, 0, len(c.metaContexts))
+	for _, name := range c.metaContexts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ParseURI parses an NBD URI (nbd://host[:port]/export, nbds://..., nbd+unix:///export?socket=path) into the network and
+// address to dial, the export name and whether TLS is required
+func ParseURI(uri string) (network string, address string, exportName string, useTLS bool, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", false, err
+	}
+	exportName = strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "nbd", "nbds":
+		if u.Hostname() == "" {
+			return "", "", "", false, fmt.Errorf("missing host in NBD URI %q", uri)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "10809"
+		}
+		return "tcp", net.JoinHostPort(u.Hostname(), port), exportName, u.Scheme == "nbds", nil
+	case "nbd+unix", "nbds+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return "", "", "", false, fmt.Errorf("missing socket in NBD URI %q", uri)
+		}
+		return "unix", socket, exportName, u.Scheme == "nbds+unix", nil
+	default:
+		return "", "", "", false, fmt.Errorf("unsupported scheme %q in NBD URI %q", u.Scheme, uri)
+	}
+}
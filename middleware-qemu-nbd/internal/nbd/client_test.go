@@ -0,0 +1,412 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// mappedBackend is an in-memory backend with a fixed allocation map and a dirty bitmap "backup"
+type mappedBackend struct {
+	*memBackend
+	holes []backend.Extent // Unallocated ranges (flags ExtentHole|ExtentZero)
+	dirty []backend.Extent // Changed ranges (flag ExtentDirty)
+}
+
+// clip returns the parts of the extents within [off, off+length)
+func clip(extents []backend.Extent, off int64, length int64) []backend.Extent {
+	var clipped []backend.Extent
+	for _, extent := range extents {
+		start, end := max(extent.Offset, off), min(extent.Offset+extent.Length, off+length)
+		if start < end {
+			clipped = append(clipped, backend.Extent{Offset: start, Length: end - start, Flags: extent.Flags})
+		}
+	}
+	return clipped
+}
+
+func (b *mappedBackend) Extents(_ context.Context, off int64, length int64) ([]backend.Extent, error) {
+	return clip(b.holes, off, length), nil
+}
+
+func (b *mappedBackend) DirtyBitmaps() []string {
+	return []string{"backup"}
+}
+
+func (b *mappedBackend) DirtyExtents(_ context.Context, _ string, off int64, length int64) ([]backend.Extent, error) {
+	return clip(b.dirty, off, length), nil
+}
+
+const mappedSize = 64 << 10
+
+// mappedExports returns testExports with the export "mapped": a hole at [16 KiB, 32 KiB) and a dirty range at [8 KiB, 24 KiB)
+func mappedExports() exportSource {
+	exports := testExports(mappedSize)
+	exports["mapped"] = &Export{Name: "mapped", BlockSize: 4096, Backend: &mappedBackend{
+		memBackend: newMemBackend(mappedSize),
+		holes:      []backend.Extent{{Offset: 16 << 10, Length: 16 << 10, Flags: backend.ExtentHole | backend.ExtentZero}},
+		dirty:      []backend.Extent{{Offset: 8 << 10, Length: 16 << 10, Flags: backend.ExtentDirty}},
+	}}
+	return exports
+}
+
+func dialClient(t *testing.T, path string, options ClientOptions) *Client {
+	t.Helper()
+	client, err := Dial(t.Context(), "unix", path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestClientHandshake(t *testing.T) {
+	path := startServer(t, mappedExports(), Options{})
+
+	tests := []struct {
+		name         string
+		options      ClientOptions
+		size         uint64
+		readOnly     bool
+		blockSize    [3]uint32
+		metaContexts []string
+		reply        uint32 // Option error expected instead of a client, if set
+	}{
+		{name: "export", options: ClientOptions{ExportName: "disk"}, size: mappedSize, blockSize: [3]uint32{4096, 4096, maxPayloadLength}},
+		{name: "read-only", options: ClientOptions{ExportName: "ro", StructuredReplies: true}, size: mappedSize, readOnly: true, blockSize: [3]uint32{512, 512, maxPayloadLength}},
+		{
+			name:         "meta contexts",
+			options:      ClientOptions{ExportName: "mapped", MetaContexts: []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup"}},
+			size:         mappedSize,
+			blockSize:    [3]uint32{4096, 4096, maxPayloadLength},
+			metaContexts: []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup"},
+		},
+		{
+			name:         "unknown meta context ignored",
+			options:      ClientOptions{ExportName: "disk", MetaContexts: []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup"}},
+			size:         mappedSize,
+			blockSize:    [3]uint32{4096, 4096, maxPayloadLength},
+			metaContexts: []string{MetaContextBaseAllocation},
+		},
+		{name: "unknown export", options: ClientOptions{ExportName: "missing"}, reply: RepErrUnknown},
+		{name: "unknown export of meta contexts", options: ClientOptions{ExportName: "missing", MetaContexts: []string{MetaContextBaseAllocation}}, reply: RepErrUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := Dial(t.Context(), "unix", path, test.options)
+			if test.reply != 0 {
+				optionErr, ok := errors.AsType[*OptionError](err)
+				if !ok || optionErr.Reply != test.reply {
+					t.Fatalf("error %v, want reply 0x%x", err, test.reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			minimum, preferred, maximum := client.BlockSize()
+			if client.Size() != test.size || client.ReadOnly() != test.readOnly || [3]uint32{minimum, preferred, maximum} != test.blockSize {
+				t.Fatalf("size %d, read-only %t, block size %d/%d/%d", client.Size(), client.ReadOnly(), minimum, preferred, maximum)
+			}
+			if metaContexts := client.MetaContexts(); !slices.Equal(metaContexts, test.metaContexts) {
+				t.Fatalf("meta contexts %q, want %q", metaContexts, test.metaContexts)
+			}
+			if err := client.Disconnect(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientNoMetaContextSelected(t *testing.T) {
+	path := startServer(t, mappedExports(), Options{})
+	if _, err := Dial(t.Context(), "unix", path, ClientOptions{ExportName: "disk", MetaContexts: []string{"qemu:allocation-depth"}}); !errors.Is(err, ErrNoMetaContext) {
+		t.Fatalf("error %v, want %v", err, ErrNoMetaContext)
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	for _, structured := range []bool{false, true} {
+		t.Run(map[bool]string{false: "simple", true: "structured"}[structured], func(t *testing.T) {
+			path := startServer(t, mappedExports(), Options{})
+			client := dialClient(t, path, ClientOptions{ExportName: "disk", StructuredReplies: structured})
+			ctx := t.Context()
+
+			data := bytes.Repeat([]byte{0xab}, 3*4096)
+			if err := client.WriteAt(ctx, data, 4096, CmdFlagFUA); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.WriteZeroes(ctx, 4096, 4096, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Trim(ctx, 3*4096, 4096, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]byte, 5*4096)
+			if err := client.ReadAt(ctx, got, 0); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 5*4096)
+			copy(want[2*4096:3*4096], data)
+			if !bytes.Equal(got, want) {
+				t.Fatal("read data differs from the written data")
+			}
+
+			// Errors fail the request, not the connection
+			var requestErr *RequestError
+			if err := client.ReadAt(ctx, make([]byte, 4096), mappedSize); !errors.As(err, &requestErr) || requestErr.Errno != ErrnoInval {
+				t.Fatalf("read past the end: error %v, want errno %d", err, ErrnoInval)
+			}
+			if err := client.WriteAt(ctx, data, mappedSize-4096, 0); !errors.As(err, &requestErr) || requestErr.Errno != ErrnoNoSpace {
+				t.Fatalf("write past the end: error %v, want errno %d", err, ErrnoNoSpace)
+			}
+			if structured && requestErr.Message == "" {
+				t.Fatal("structured error reply without message")
+			}
+			if _, err := client.BlockStatus(ctx, 0, 4096, 0); err == nil {
+				t.Fatal("block status without meta context succeeded")
+			}
+			if err := client.ReadAt(ctx, got[:4096], 2*4096); err != nil || !bytes.Equal(got[:4096], data[:4096]) {
+				t.Fatalf("read after failed requests: %v", err)
+			}
+			if err := client.Disconnect(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Flush(ctx); !errors.Is(err, ErrClientClosed) {
+				t.Fatalf("request after disconnect: error %v, want %v", err, ErrClientClosed)
+			}
+		})
+	}
+}
+
+func TestClientReadOnly(t *testing.T) {
+	path := startServer(t, mappedExports(), Options{})
+	client := dialClient(t, path, ClientOptions{ExportName: "ro"})
+	var requestErr *RequestError
+	if err := client.WriteAt(t.Context(), make([]byte, 512), 0, 0); !errors.As(err, &requestErr) || requestErr.Errno != ErrnoPerm {
+		t.Fatalf("write: error %v, want errno %d", err, ErrnoPerm)
+	}
+	if err := client.Trim(t.Context(), 0, 512, 0); !errors.As(err, &requestErr) || requestErr.Errno != ErrnoPerm {
+		t.Fatalf("trim: error %v, want errno %d", err, ErrnoPerm)
+	}
+}
+
+func TestClientPipelining(t *testing.T) {
+	path := startServer(t, mappedExports(), Options{MaxInFlight: 8})
+	client := dialClient(t, path, ClientOptions{ExportName: "disk", StructuredReplies: true})
+
+	const blocks = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*blocks)
+	for i := range blocks {
+		wg.Go(func() {
+			block := bytes.Repeat([]byte{byte(i + 1)}, 4096)
+			if err := client.WriteAt(t.Context(), block, uint64(i)*4096, 0); err != nil {
+				errs <- err
+				return
+			}
+			got := make([]byte, 4096)
+			if err := client.ReadAt(t.Context(), got, uint64(i)*4096); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, block) {
+				errs <- errors.New("read data of block differs from the written data")
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestClientStructuredReadHoles(t *testing.T) {
+	exports := mappedExports()
+	// Stale data in the hole: it is not sent, the client fills the hole with zeroes
+	mapped := exports["mapped"].Backend.(*mappedBackend)
+	copy(mapped.data[16<<10:], bytes.Repeat([]byte{0xff}, 16<<10))
+	copy(mapped.data[12<<10:16<<10], bytes.Repeat([]byte{0x11}, 4<<10))
+	path := startServer(t, exports, Options{})
+
+	tests := []struct {
+		structured bool
+		holeData   byte
+	}{
+		{structured: false, holeData: 0xff},
+		{structured: true, holeData: 0},
+	}
+	for _, test := range tests {
+		client := dialClient(t, path, ClientOptions{ExportName: "mapped", StructuredReplies: test.structured})
+		got := bytes.Repeat([]byte{0x55}, 16<<10) // Garbage to be overwritten
+		if err := client.ReadAt(t.Context(), got, 12<<10); err != nil {
+			t.Fatal(err)
+		}
+		want := append(bytes.Repeat([]byte{0x11}, 4<<10), bytes.Repeat([]byte{test.holeData}, 12<<10)...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("structured %t: read data differs", test.structured)
+		}
+	}
+}
+
+func TestClientBlockStatus(t *testing.T) {
+	path := startServer(t, mappedExports(), Options{})
+	client := dialClient(t, path, ClientOptions{ExportName: "mapped", MetaContexts: []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup"}})
+
+	tests := []struct {
+		name   string
+		off    uint64
+		length uint32
+		flags  uint16
+		want   map[string][]BlockStatusExtent
+	}{
+		{
+			name:   "whole export",
+			off:    0,
+			length: mappedSize,
+			want: map[string][]BlockStatusExtent{
+				MetaContextBaseAllocation:         {{Length: 16 << 10}, {Length: 16 << 10, Flags: StateHole | StateZero}, {Length: 32 << 10}},
+				MetaContextDirtyBitmap + "backup": {{Length: 8 << 10}, {Length: 16 << 10, Flags: StateDirty}, {Length: 40 << 10}},
+			},
+		},
+		{
+			name:   "within the hole",
+			off:    20 << 10,
+			length: 4 << 10,
+			want: map[string][]BlockStatusExtent{
+				MetaContextBaseAllocation:         {{Length: 4 << 10, Flags: StateHole | StateZero}},
+				MetaContextDirtyBitmap + "backup": {{Length: 4 << 10, Flags: StateDirty}},
+			},
+		},
+		{
+			name:   "one extent",
+			off:    0,
+			length: mappedSize,
+			flags:  CmdFlagReqOne,
+			want: map[string][]BlockStatusExtent{
+				MetaContextBaseAllocation:         {{Length: 16 << 10}},
+				MetaContextDirtyBitmap + "backup": {{Length: 8 << 10}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := client.BlockStatus(t.Context(), test.off, test.length, test.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("block status %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	var requestErr *RequestError
+	if _, err := client.BlockStatus(t.Context(), mappedSize, 4096, 0); !errors.As(err, &requestErr) {
+		t.Fatalf("block status past the end: error %v", err)
+	}
+}
+
+func TestMultiConn(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		export      string
+		connections int
+	}{
+		{name: "multi-conn", options: Options{MultiConn: true}, export: "disk", connections: 4},
+		{name: "read-only", options: Options{MultiConn: true}, export: "ro", connections: 4},
+		{name: "not advertised", options: Options{}, export: "disk", connections: 1},
+		{name: "single connection per export", options: Options{MultiConn: true, MaxConnectionsPerExport: 1}, export: "disk", connections: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exports := mappedExports()
+			path := startServer(t, exports, test.options)
+			m, err := DialMultiConn(t.Context(), "unix", path, ClientOptions{ExportName: test.export}, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if m.Connections() != test.connections || m.Client().CanMultiConn() != (test.connections > 1) {
+				t.Fatalf("%d connections (multi-conn %t), want %d", m.Connections(), m.Client().CanMultiConn(), test.connections)
+			}
+			if test.export == "ro" {
+				return
+			}
+
+			// The writes are spread over the connections, all of them see the data
+			ctx := t.Context()
+			for i := range 8 {
+				if err := m.WriteAt(ctx, bytes.Repeat([]byte{byte(i + 1)}, 4096), uint64(i)*4096, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if flushes := exports["disk"].Backend.(*memBackend).flushes; flushes != 1 {
+				t.Fatalf("%d flushes of the backend", flushes)
+			}
+			for _, client := range m.clients {
+				got := make([]byte, 8*4096)
+				if err := client.ReadAt(ctx, got, 0); err != nil {
+					t.Fatal(err)
+				}
+				for i := range 8 {
+					if got[i*4096] != byte(i+1) {
+						t.Fatalf("block %d not written", i)
+					}
+				}
+			}
+			if err := m.Disconnect(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		network    string
+		address    string
+		exportName string
+		useTLS     bool
+		wantErr    bool
+	}{
+		{uri: "nbd://host/disk", network: "tcp", address: "host:10809", exportName: "disk"},
+		{uri: "nbds://host:1234/disk", network: "tcp", address: "host:1234", exportName: "disk", useTLS: true},
+		{uri: "nbd://[::1]/", network: "tcp", address: "[::1]:10809", exportName: ""},
+		{uri: "nbd+unix:///disk?socket=/run/nbd.sock", network: "unix", address: "/run/nbd.sock", exportName: "disk"},
+		{uri: "nbds+unix:///disk?socket=/run/nbd.sock", network: "unix", address: "/run/nbd.sock", exportName: "disk", useTLS: true},
+		{uri: "nbd:///disk", wantErr: true},
+		{uri: "nbd+unix:///disk", wantErr: true},
+		{uri: "http://host/disk", wantErr: true},
+		{uri: "nbd://host:port:x/disk", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			network, address, exportName, useTLS, err := ParseURI(test.uri)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && (network != test.network || address != test.address || exportName != test.exportName || useTLS != test.useTLS) {
+				t.Fatalf("parsed %s %s %q %t", network, address, exportName, useTLS)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quorumbd.net/middleware-common/acl"
+)
+
+var errAborted = errors.New("client aborted negotiation")
+
+// conn is a client connection of the server
+type conn struct {
+	id        uint64
+	server    *Server
+	logger    *slog.Logger
+	netConn   net.Conn // Underlying connection, also after STARTTLS
+	r         *bufio.Reader
+	w         *bufio.Writer
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+
+	tlsCapable        bool
+	tlsActive         bool // STARTTLS succeeded
+	peer              acl.Peer
+	noZeroes          bool
+	structuredReplies bool
+	extendedHeaders   bool // Implies structured replies
+	metaContexts      []metaContext
+	metaContextExport string // Export of the selected meta contexts
+	export            *Export
+	flags             uint16 // transmission flags
+
+	connectedAt  time.Time
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+func newConn(server *Server, netConn net.Conn, tlsCapable bool) *conn {
+	id := server.nextConnID.Add(1)
+	c := &conn{
+		id:         id,
+		server:     server,
+		logger:     server.logger.With("remote", netConn.RemoteAddr().String(), "client", id),
+		netConn:    netConn,
+		r:          bufio.NewReader(netConn),
+		w:          bufio.NewWriter(netConn),
+		tlsCapable: tlsCapable,
+	}
+
+	peer, err := acl.PeerOf(netConn)
+	if err != nil {
+		c.logger.Warn("Cannot determine peer credentials", "error", err)
+	}
+	c.peer = peer
+	if creds := peer.Credentials; creds != nil {
+		c.logger = c.logger.With("pid", creds.PID, "uid", creds.UID)
+	}
+	return c
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	ctx, cancel := context.WithCancel(c.server.baseCtx)
+	defer cancel()
+
+	if err := c.negotiate(ctx); err != nil {
+		switch {
+		case errors.Is(err, errAborted):
+			c.logger.Debug("Client aborted negotiation")
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			c.logger.Debug("Connection closed during negotiation")
+		default:
+			c.logger.Warn("Negotiation failed", "error", err)
+		}
+		return
+	}
+
+	c.logger = c.logger.With("export", c.export.Name)
+	c.logger.Info("Client connected to export")
+	c.server.transmitting(c)
+
+	if err := c.transmit(ctx); err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			c.logger.Info("Connection closed by shutdown")
+		case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+			c.logger.Info("Connection closed without disconnect")
+		default:
+			c.logger.Warn("Transmission failed", "error", err)
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.netConn.Close()
+	})
+}
@@ -0,0 +1,360 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+)
+
+// negotiate runs the fixed newstyle handshake and the option haggling until the client enters the transmission phase
+func (c *conn) negotiate(ctx context.Context) error {
+	var hello [18]byte
+	be.PutUint64(hello[0:], MagicNBD)
+	be.PutUint64(hello[8:], MagicOption)
+	be.PutUint16(hello[16:], FlagFixedNewstyle|FlagNoZeroes)
+	if err := c.writeAndFlush(hello[:]); err != nil {
+		return err
+	}
+
+	var clientFlagsBuf [4]byte
+	if _, err := io.ReadFull(c.r, clientFlagsBuf[:]); err != nil {
+		return err
+	}
+	clientFlags := be.Uint32(clientFlagsBuf[:])
+	if clientFlags&FlagClientFixedNewstyle == 0 {
+		return fmt.Errorf("client does not support fixed newstyle negotiation")
+	}
+	if clientFlags&^(FlagClientFixedNewstyle|FlagClientNoZeroes) != 0 {
+		return fmt.Errorf("unknown client flags 0x%x", clientFlags)
+	}
+	c.noZeroes = clientFlags&FlagClientNoZeroes != 0
+
+	for {
+		option, data, err := c.readOption()
+		if err != nil {
+			return err
+		}
+
+		done, err := c.handleOption(ctx, option, data)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// readOption reads the next option request. Data of oversized options is discarded (data is nil then).
+func (c *conn) readOption() (uint32, []byte, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if magic := be.Uint64(header[0:]); magic != MagicOption {
+		return 0, nil, fmt.Errorf("invalid option magic 0x%x", magic)
+	}
+	option := be.Uint32(header[8:])
+	length := be.Uint32(header[12:])
+
+	if length > maxOptionLength {
+		if _, err := io.CopyN(io.Discard, c.r, int64(length)); err != nil {
+			return 0, nil, err
+		}
+		return option, nil, nil
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, err
+	}
+	return option, data, nil
+}
+
+// handleOption handles an option request and returns true, if the transmission phase begins
+func (c *conn) handleOption(ctx context.Context, option uint32, data []byte) (bool, error) {
+	if data == nil {
+		return false, c.writeOptionError(option, RepErrTooBig, "option data too large")
+	}
+
+	if c.tlsRequired() && option != OptStartTLS && option != OptAbort {
+		if option == OptExportName {
+			return false, fmt.Errorf("client requested an export without negotiating TLS")
+		}
+		return false, c.writeOptionError(option, RepErrTLSReqd, "TLS is required")
+	}
+
+	switch option {
+	case OptExportName:
+		return true, c.handleExportName(ctx, data)
+	case OptAbort:
+		_ = c.writeOptionReply(option, RepAck, nil)
+		return false, errAborted
+	case OptList:
+		return false, c.handleList(ctx, option, data)
+	case OptStartTLS:
+		return false, c.handleStartTLS(option, data)
+	case OptInfo, OptGo:
+		return c.handleInfo(ctx, option, data)
+	case OptStructuredReply:
+		return false, c.handleStructuredReply(option, data)
+	case OptExtendedHeaders:
+		return false, c.handleExtendedHeaders(option, data)
+	case OptListMetaContext, OptSetMetaContext:
+		return false, c.handleMetaContext(ctx, option, data)
+	default:
+		c.logger.Debug("Unsupported option", "option", option)
+		return false, c.writeOptionError(option, RepErrUnsup, fmt.Sprintf("option %d is not supported", option))
+	}
+}
+
+// handleExportName handles the old style NBD_OPT_EXPORT_NAME, which has no error reply: unknown exports close the connection
+func (c *conn) handleExportName(ctx context.Context, data []byte) error {
+	export, detaches, err := c.server.lookupExport(ctx, string(data))
+	if err != nil {
+		return fmt.Errorf("resolving export %q failed: %w", string(data), err)
+	}
+	if export = c.authorizeExport(export); export == nil {
+		return fmt.Errorf("access to export %q denied", string(data))
+	}
+	if err := c.server.claimExport(c, export, detaches); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 10, 10+124)
+	be.PutUint64(reply[0:], uint64(export.Backend.Size()))
+	be.PutUint16(reply[8:], c.flags)
+	if !c.noZeroes {
+		reply = append(reply, make([]byte, 124)...)
+	}
+	return c.writeAndFlush(reply)
+}
+
+func (c *conn) handleStructuredReply(option uint32, data []byte) error {
+	if len(data) != 0 {
+		return c.writeOptionError(option, RepErrInvalid, "NBD_OPT_STRUCTURED_REPLY must not have data")
+	}
+	if c.extendedHeaders {
+		return c.writeOptionError(option, RepErrExtHeaderReqd, "extended headers are already negotiated")
+	}
+	if c.structuredReplies {
+		return c.writeOptionError(option, RepErrInvalid, "structured replies are already negotiated")
+	}
+	c.structuredReplies = true
+	return c.writeOptionReply(option, RepAck, nil)
+}
+
+// handleExtendedHeaders enables 64-bit request lengths and extended reply headers (structured replies are implied)
+func (c *conn) handleExtendedHeaders(option uint32, data []byte) error {
+	if len(data) != 0 {
+		return c.writeOptionError(option, RepErrInvalid, "NBD_OPT_EXTENDED_HEADERS must not have data")
+	}
+	if c.extendedHeaders {
+		return c.writeOptionError(option, RepErrInvalid, "extended headers are already negotiated")
+	}
+	c.extendedHeaders = true
+	c.structuredReplies = true
+	return c.writeOptionReply(option, RepAck, nil)
+}
+
+func (c *conn) handleList(ctx context.Context, option uint32, data []byte) error {
+	if len(data) != 0 {
+		return c.writeOptionError(option, RepErrInvalid, "NBD_OPT_LIST must not have data")
+	}
+
+	exports, err := c.server.exports.ListExports(ctx)
+	if err != nil {
+		c.logger.Warn("Listing exports failed", "error", err)
+		return c.writeOptionError(option, RepErrUnknown, "export list is unavailable")
+	}
+
+	for _, export := range exports {
+		if c.server.authorize(c.peer, export.Name) == acl.AccessDenied {
+			continue // Only list exports the peer may open
+		}
+		reply := make([]byte, 4, 4+len(export.Name)+len(export.Description))
+		be.PutUint32(reply, uint32(len(export.Name)))
+		reply = append(reply, export.Name...)
+		reply = append(reply, export.Description...)
+		if err := c.writeOptionReply(option, RepServer, reply); err != nil {
+			return err
+		}
+	}
+	return c.writeOptionReply(option, RepAck, nil)
+}
+
+// handleInfo handles NBD_OPT_INFO and NBD_OPT_GO (returns true, if the transmission phase begins)
+func (c *conn) handleInfo(ctx context.Context, option uint32, data []byte) (bool, error) {
+	name, infoRequests, err := parseInfoRequest(data)
+	if err != nil {
+		return false, c.writeOptionError(option, RepErrInvalid, err.Error())
+	}
+
+	export, detaches, err := c.lookupExport(ctx, option, name)
+	if export == nil {
+		return false, err
+	}
+
+	if option == OptGo {
+		if err := c.server.claimExport(c, export, detaches); err != nil {
+			if errors.Is(err, ErrUnknownExport) {
+				return false, c.writeOptionError(option, RepErrUnknown, err.Error())
+			}
+			return false, c.writeOptionError(option, RepErrPolicy, err.Error())
+		}
+	}
+
+	flags := c.transmissionFlags(export)
+
+	var info [12]byte
+	be.PutUint16(info[0:], InfoExport)
+	be.PutUint64(info[2:], uint64(export.Backend.Size()))
+	be.PutUint16(info[10:], flags)
+	if err := c.writeOptionReply(option, RepInfo, info[:]); err != nil {
+		return false, err
+	}
+
+	if err := c.writeOptionReply(option, RepInfo, blockSizeInfo(export, slices.Contains(infoRequests, InfoBlockSize))); err != nil {
+		return false, err
+	}
+
+	for _, infoType := range infoRequests {
+		var payload []byte
+		switch infoType {
+		case InfoName:
+			payload = []byte(export.Name)
+		case InfoDescription:
+			if export.Description == "" {
+				continue
+			}
+			payload = []byte(export.Description)
+		default:
+			continue // Unknown or unsupported info requests may be ignored
+		}
+		reply := make([]byte, 2, 2+len(payload))
+		be.PutUint16(reply, infoType)
+		reply = append(reply, payload...)
+		if err := c.writeOptionReply(option, RepInfo, reply); err != nil {
+			return false, err
+		}
+	}
+
+	if err := c.writeOptionReply(option, RepAck, nil); err != nil {
+		return false, err
+	}
+
+	return option == OptGo, nil
+}
+
+// lookupExport resolves the export of an option request and applies the access of the peer.
+// If it cannot be resolved or the access is denied, the error reply is sent and nil is returned.
+func (c *conn) lookupExport(ctx context.Context, option uint32, name string) (*Export, uint64, error) {
+	export, detaches, err := c.server.lookupExport(ctx, name)
+	if err != nil {
+		if !errors.Is(err, ErrUnknownExport) {
+			c.logger.Warn("Resolving export failed", "export", name, "error", err)
+		}
+		return nil, 0, c.writeOptionError(option, RepErrUnknown, fmt.Sprintf("unknown export %q", name))
+	}
+	if export = c.authorizeExport(export); export == nil {
+		return nil, 0, c.writeOptionError(option, RepErrPolicy, fmt.Sprintf("access to export %q denied", name))
+	}
+	return export, detaches, nil
+}
+
+func parseInfoRequest(data []byte) (string, []uint16, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("option data too short")
+	}
+	nameLength := be.Uint32(data)
+	if nameLength > maxNameLength || uint64(len(data)) < 4+uint64(nameLength)+2 {
+		return "", nil, fmt.Errorf("invalid export name length %d", nameLength)
+	}
+	name := string(data[4 : 4+nameLength])
+	rest := data[4+nameLength:]
+
+	count := int(be.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) != 2*count {
+		return "", nil, fmt.Errorf("invalid number of info requests %d", count)
+	}
+
+	infoRequests := make([]uint16, count)
+	for i := range infoRequests {
+		infoRequests[i] = be.Uint16(rest[2*i:])
+	}
+	return name, infoRequests, nil
+}
+
+// blockSizeInfo returns NBD_INFO_BLOCK_SIZE for the export. The minimum is the block granularity of the volume only
+// for clients that requested the info (and thus respect it): the backend handles unaligned requests for others.
+func blockSizeInfo(export *Export, requested bool) []byte {
+	blockSize := export.BlockSize
+	if blockSize == 0 {
+		blockSize = 512
+	}
+	minimum := uint32(1)
+	if requested {
+		minimum = blockSize
+	}
+	info := make([]byte, 14)
+	be.PutUint16(info[0:], InfoBlockSize)
+	be.PutUint32(info[2:], minimum)
+	be.PutUint32(info[6:], blockSize)
+	be.PutUint32(info[10:], maxPayloadLength)
+	return info
+}
+
+// transmissionFlags returns the transmission flags of an export for this connection. The export carries the effective
+// access of the peer (see authorizeExport), so clients with read-only access get read-only flags.
+func (c *conn) transmissionFlags(export *Export) uint16 {
+	flags := FlagHasFlags | FlagSendFlush | FlagSendFUA
+	if export.ReadOnly {
+		flags |= FlagReadOnly
+	} else {
+		flags |= FlagSendTrim | FlagSendWriteZeroes | FlagSendFastZero
+	}
+	if c.server.multiConn(export) {
+		flags |= FlagCanMultiConn
+	}
+	if _, ok := export.Backend.(backend.Prefetcher); ok {
+		flags |= FlagSendCache
+	}
+	return flags
+}
+
+func (c *conn) setExport(export *Export) {
+	c.export = export
+	c.flags = c.transmissionFlags(export)
+	if c.metaContextExport != export.Name {
+		c.metaContexts = nil // Meta contexts were selected for another export
+	}
+}
+
+func (c *conn) writeOptionReply(option uint32, replyType uint32, data []byte) error {
+	var header [20]byte
+	be.PutUint64(header[0:], MagicOptionReply)
+	be.PutUint32(header[8:], option)
+	be.PutUint32(header[12:], replyType)
+	be.PutUint32(header[16:], uint32(len(data)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *conn) writeOptionError(option uint32, replyType uint32, message string) error {
+	return c.writeOptionReply(option, replyType, []byte(message))
+}
+
+func (c *conn) writeAndFlush(data []byte) error {
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,346 @@
+package nbd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// rawClient speaks the handshake byte by byte, so that malformed options can be sent
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+type optionReply struct {
+	option    uint32
+	replyType uint32
+	data      []byte
+}
+
+// dialRaw connects to the server on a unix socket, checks the hello and sends the client flags
+func dialRaw(t *testing.T, path string, clientFlags uint32) *rawClient {
+	t.Helper()
+	return dialRawNetwork(t, "unix", path, clientFlags)
+}
+
+func dialRawNetwork(t *testing.T, network string, address string, clientFlags uint32) *rawClient {
+	t.Helper()
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	var hello [18]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		t.Fatal(err)
+	}
+	if be.Uint64(hello[0:]) != MagicNBD || be.Uint64(hello[8:]) != MagicOption {
+		t.Fatalf("invalid hello %x", hello)
+	}
+	if flags := be.Uint16(hello[16:]); flags != FlagFixedNewstyle|FlagNoZeroes {
+		t.Fatalf("handshake flags 0x%x", flags)
+	}
+	c := &rawClient{t: t, conn: conn}
+	c.write(be.AppendUint32(nil, clientFlags))
+	return c
+}
+
+func (c *rawClient) write(data []byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *rawClient) sendOption(magic uint64, option uint32, data []byte) {
+	c.t.Helper()
+	header := be.AppendUint64(nil, magic)
+	header = be.AppendUint32(header, option)
+	header = be.AppendUint32(header, uint32(len(data)))
+	c.write(append(header, data...))
+}
+
+func (c *rawClient) readReply() optionReply {
+	c.t.Helper()
+	var header [20]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		c.t.Fatalf("reading option reply: %v", err)
+	}
+	if magic := be.Uint64(header[0:]); magic != MagicOptionReply {
+		c.t.Fatalf("invalid option reply magic 0x%x", magic)
+	}
+	reply := optionReply{option: be.Uint32(header[8:]), replyType: be.Uint32(header[12:])}
+	reply.data = make([]byte, be.Uint32(header[16:]))
+	if _, err := io.ReadFull(c.conn, reply.data); err != nil {
+		c.t.Fatalf("reading option reply data: %v", err)
+	}
+	return reply
+}
+
+// closed returns true, if the server closed the connection
+func (c *rawClient) closed() bool {
+	_, err := c.conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+// infoRequest encodes the data of NBD_OPT_INFO and NBD_OPT_GO
+func infoRequest(name string, infoTypes ...uint16) []byte {
+	data := be.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	data = be.AppendUint16(data, uint16(len(infoTypes)))
+	for _, infoType := range infoTypes {
+		data = be.AppendUint16(data, infoType)
+	}
+	return data
+}
+
+func TestParseInfoRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		export    string
+		infoTypes []uint16
+		wantErr   bool
+	}{
+		{name: "default export", data: infoRequest(""), export: "", infoTypes: []uint16{}},
+		{name: "info requests", data: infoRequest("disk", InfoName, InfoBlockSize), export: "disk", infoTypes: []uint16{InfoName, InfoBlockSize}},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "short length", data: []byte{0, 0, 0}, wantErr: true},
+		{name: "name past the end", data: []byte{0, 0, 0, 8, 'd', 'i', 's', 'k', 0, 0}, wantErr: true},
+		{name: "missing count", data: []byte{0, 0, 0, 4, 'd', 'i', 's', 'k'}, wantErr: true},
+		{name: "name too long", data: be.AppendUint32(nil, maxNameLength+1), wantErr: true},
+		{name: "truncated info requests", data: infoRequest("disk", InfoName)[:11], wantErr: true},
+		{name: "trailing data", data: append(infoRequest("disk", InfoName), 0), wantErr: true},
+		{name: "count past the end", data: []byte{0, 0, 0, 4, 'd', 'i', 's', 'k', 0, 1}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			export, infoTypes, err := parseInfoRequest(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if export != test.export || !slices.Equal(infoTypes, test.infoTypes) {
+				t.Fatalf("parsed %q %v, want %q %v", export, infoTypes, test.export, test.infoTypes)
+			}
+		})
+	}
+}
+
+func TestOptionNegotiation(t *testing.T) {
+	type exchange struct {
+		option  uint32
+		data    []byte
+		replies []uint32 // Reply types in order
+	}
+	tests := []struct {
+		name      string
+		exchanges []exchange
+	}{
+		{name: "unknown option", exchanges: []exchange{{option: 42, replies: []uint32{RepErrUnsup}}}},
+		{name: "list", exchanges: []exchange{{option: OptList, replies: []uint32{RepServer, RepServer, RepAck}}}},
+		{name: "list with data", exchanges: []exchange{{option: OptList, data: []byte{0}, replies: []uint32{RepErrInvalid}}}},
+		{name: "oversized option", exchanges: []exchange{
+			{option: OptList, data: make([]byte, maxOptionLength+1), replies: []uint32{RepErrTooBig}},
+			{option: OptList, replies: []uint32{RepServer, RepServer, RepAck}}, // Negotiation continues
+		}},
+		{name: "structured replies", exchanges: []exchange{{option: OptStructuredReply, replies: []uint32{RepAck}}}},
+		{name: "structured replies with data", exchanges: []exchange{{option: OptStructuredReply, data: []byte{0}, replies: []uint32{RepErrInvalid}}}},
+		{name: "structured replies twice", exchanges: []exchange{
+			{option: OptStructuredReply, replies: []uint32{RepAck}},
+			{option: OptStructuredReply, replies: []uint32{RepErrInvalid}},
+		}},
+		{name: "structured replies after extended headers", exchanges: []exchange{
+			{option: OptExtendedHeaders, replies: []uint32{RepAck}},
+			{option: OptStructuredReply, replies: []uint32{RepErrExtHeaderReqd}},
+		}},
+		{name: "extended headers twice", exchanges: []exchange{
+			{option: OptExtendedHeaders, replies: []uint32{RepAck}},
+			{option: OptExtendedHeaders, replies: []uint32{RepErrInvalid}},
+		}},
+		{name: "extended headers with data", exchanges: []exchange{{option: OptExtendedHeaders, data: []byte{0}, replies: []uint32{RepErrInvalid}}}},
+		{name: "info", exchanges: []exchange{{option: OptInfo, data: infoRequest("disk"), replies: []uint32{RepInfo, RepInfo, RepAck}}}},
+		{name: "info with name and description", exchanges: []exchange{
+			{option: OptInfo, data: infoRequest("disk", InfoName, InfoDescription, 0x7fff), replies: []uint32{RepInfo, RepInfo, RepInfo, RepInfo, RepAck}},
+		}},
+		{name: "info without description", exchanges: []exchange{{option: OptInfo, data: infoRequest("ro", InfoDescription), replies: []uint32{RepInfo, RepInfo, RepAck}}}},
+		{name: "info of unknown export", exchanges: []exchange{{option: OptInfo, data: infoRequest("missing"), replies: []uint32{RepErrUnknown}}}},
+		{name: "info too short", exchanges: []exchange{{option: OptInfo, data: []byte{0, 0}, replies: []uint32{RepErrInvalid}}}},
+		{name: "info with invalid name length", exchanges: []exchange{{option: OptInfo, data: []byte{0, 0, 1, 0, 0, 0}, replies: []uint32{RepErrInvalid}}}},
+		{name: "info with invalid count", exchanges: []exchange{{option: OptInfo, data: []byte{0, 0, 0, 0, 0, 2, 0, 1}, replies: []uint32{RepErrInvalid}}}},
+		{name: "go of unknown export", exchanges: []exchange{
+			{option: OptGo, data: infoRequest("missing"), replies: []uint32{RepErrUnknown}},
+			{option: OptGo, data: infoRequest("disk"), replies: []uint32{RepInfo, RepInfo, RepAck}},
+		}},
+		{name: "starttls without TLS", exchanges: []exchange{{option: OptStartTLS, replies: []uint32{RepErrUnsup}}}},
+		{name: "meta context without structured replies", exchanges: []exchange{
+			{option: OptListMetaContext, data: metaContextRequest("disk"), replies: []uint32{RepErrInvalid}},
+		}},
+	}
+	path := startServer(t, testExports(1<<20), Options{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+			for _, ex := range test.exchanges {
+				c.sendOption(MagicOption, ex.option, ex.data)
+				for _, want := range ex.replies {
+					reply := c.readReply()
+					if reply.option != ex.option || reply.replyType != want {
+						t.Fatalf("option %d: reply %d to option %d, want %d", ex.option, reply.replyType, reply.option, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInfoReplies(t *testing.T) {
+	tests := []struct {
+		name        string
+		export      string
+		infoTypes   []uint16
+		flags       uint16
+		minimum     uint32
+		preferred   uint32
+		description string
+	}{
+		{
+			name:      "writable",
+			export:    "disk",
+			flags:     FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendTrim | FlagSendWriteZeroes | FlagSendFastZero,
+			minimum:   1,
+			preferred: 4096,
+		},
+		{
+			name:        "block size requested",
+			export:      "disk",
+			infoTypes:   []uint16{InfoBlockSize, InfoDescription},
+			flags:       FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagSendTrim | FlagSendWriteZeroes | FlagSendFastZero,
+			minimum:     4096,
+			preferred:   4096,
+			description: "test disk",
+		},
+		{
+			name:      "read-only",
+			export:    "ro",
+			infoTypes: []uint16{InfoBlockSize},
+			flags:     FlagHasFlags | FlagSendFlush | FlagSendFUA | FlagReadOnly,
+			minimum:   512,
+			preferred: 512,
+		},
+	}
+	path := startServer(t, testExports(1<<20), Options{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialRaw(t, path, FlagClientFixedNewstyle)
+			c.sendOption(MagicOption, OptInfo, infoRequest(test.export, test.infoTypes...))
+			var description string
+			for {
+				reply := c.readReply()
+				if reply.replyType == RepAck {
+					break
+				}
+				if reply.replyType != RepInfo || len(reply.data) < 2 {
+					t.Fatalf("reply %d with %d bytes", reply.replyType, len(reply.data))
+				}
+				switch be.Uint16(reply.data) {
+				case InfoExport:
+					if size := be.Uint64(reply.data[2:]); size != 1<<20 {
+						t.Fatalf("size %d", size)
+					}
+					if flags := be.Uint16(reply.data[10:]); flags != test.flags {
+						t.Fatalf("transmission flags 0x%x, want 0x%x", flags, test.flags)
+					}
+				case InfoBlockSize:
+					minimum, preferred, maximum := be.Uint32(reply.data[2:]), be.Uint32(reply.data[6:]), be.Uint32(reply.data[10:])
+					if minimum != test.minimum || preferred != test.preferred || maximum != maxPayloadLength {
+						t.Fatalf("block sizes %d/%d/%d", minimum, preferred, maximum)
+					}
+				case InfoDescription:
+					description = string(reply.data[2:])
+				}
+			}
+			if description != test.description {
+				t.Fatalf("description %q, want %q", description, test.description)
+			}
+		})
+	}
+}
+
+func TestNegotiationClosesConnection(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientFlags uint32
+		magic       uint64
+		option      uint32
+		data        []byte
+	}{
+		{name: "no fixed newstyle", clientFlags: FlagClientNoZeroes},
+		{name: "unknown client flags", clientFlags: FlagClientFixedNewstyle | 1<<7},
+		{name: "invalid option magic", clientFlags: FlagClientFixedNewstyle, magic: MagicNBD, option: OptList},
+		{name: "export name of unknown export", clientFlags: FlagClientFixedNewstyle, magic: MagicOption, option: OptExportName, data: []byte("missing")},
+	}
+	path := startServer(t, testExports(1<<20), Options{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialRaw(t, path, test.clientFlags)
+			if test.magic != 0 {
+				c.sendOption(test.magic, test.option, test.data)
+			}
+			if !c.closed() {
+				t.Fatal("connection is still open")
+			}
+		})
+	}
+}
+
+func TestExportName(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientFlags uint32
+		length      int
+	}{
+		{name: "no zeroes", clientFlags: FlagClientFixedNewstyle | FlagClientNoZeroes, length: 10},
+		{name: "zeroes", clientFlags: FlagClientFixedNewstyle, length: 10 + 124},
+	}
+	path := startServer(t, testExports(1<<20), Options{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialRaw(t, path, test.clientFlags)
+			c.sendOption(MagicOption, OptExportName, []byte("disk"))
+			reply := make([]byte, test.length)
+			if _, err := io.ReadFull(c.conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if size := be.Uint64(reply); size != 1<<20 {
+				t.Fatalf("size %d", size)
+			}
+			if !bytes.Equal(reply[10:], make([]byte, test.length-10)) {
+				t.Fatal("padding is not zero")
+			}
+		})
+	}
+}
+
+// metaContextRequest encodes the data of NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+func metaContextRequest(name string, queries ...string) []byte {
+	data := be.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	data = be.AppendUint32(data, uint32(len(queries)))
+	for _, query := range queries {
+		data = be.AppendUint32(data, uint32(len(query)))
+		data = append(data, query...)
+	}
+	return data
+}
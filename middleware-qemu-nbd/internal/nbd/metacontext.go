@@ -0,0 +1,206 @@
+package nbd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// metaContext is a meta context selected by NBD_OPT_SET_META_CONTEXT
+type metaContext struct {
+	id     uint32
+	name   string
+	bitmap string // Name of the dirty bitmap (empty for base:allocation)
+}
+
+// availableMetaContexts returns the names of all meta contexts of an export
+func availableMetaContexts(export *Export) []string {
+	names := []string{MetaContextBaseAllocation}
+	if mapper, ok := export.Backend.(backend.DirtyMapper); ok {
+		for _, bitmap := range mapper.DirtyBitmaps() {
+			names = append(names, MetaContextDirtyBitmap+bitmap)
+		}
+	}
+	return names
+}
+
+// matchMetaContexts returns the available meta contexts matching the queries.
+// For listing, a query may also be a namespace ("base:", "qemu:") or the dirty bitmap prefix, and no query matches all.
+func matchMetaContexts(available []string, queries []string, listing bool) []string {
+	if len(queries) == 0 {
+		if listing {
+			return available
+		}
+		return nil
+	}
+
+	var matched []string
+	for _, query := range queries {
+		for _, name := range available {
+			if name == query || (listing && isMetaContextQueryPrefix(query) && strings.HasPrefix(name, query)) {
+				if !slices.Contains(matched, name) {
+					matched = append(matched, name)
+				}
+			}
+		}
+	}
+	return matched
+}
+
+func isMetaContextQueryPrefix(query string) bool {
+	return query == "base:" || query == "qemu:" || query == MetaContextDirtyBitmap
+}
+
+func parseMetaContextRequest(data []byte) (string, []string, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("option data too short")
+	}
+	nameLength := be.Uint32(data)
+	if nameLength > maxNameLength || uint64(len(data)) < 4+uint64(nameLength)+4 {
+		return "", nil, fmt.Errorf("invalid export name length %d", nameLength)
+	}
+	name := string(data[4 : 4+nameLength])
+	rest := data[4+nameLength:]
+
+	count := be.Uint32(rest)
+	rest = rest[4:]
+	if count > maxMetaQueries {
+		return "", nil, fmt.Errorf("too many meta context queries %d", count)
+	}
+
+	queries := make([]string, 0, count)
+	for range count {
+		if len(rest) < 4 {
+			return "", nil, fmt.Errorf("meta context query truncated")
+		}
+		length := be.Uint32(rest)
+		if uint64(len(rest)) < 4+uint64(length) {
+			return "", nil, fmt.Errorf("meta context query truncated")
+		}
+		queries = append(queries, string(rest[4:4+length]))
+		rest = rest[4+length:]
+	}
+	if len(rest) != 0 {
+		return "", nil, fmt.Errorf("trailing data after meta context queries")
+	}
+	return name, queries, nil
+}
+
+// handleMetaContext handles NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+func (c *conn) handleMetaContext(ctx context.Context, option uint32, data []byte) error {
+	if !c.structuredReplies {
+		return c.writeOptionError(option, RepErrInvalid, "structured replies must be negotiated first")
+	}
+
+	name, queries, err := parseMetaContextRequest(data)
+	if err != nil {
+		return c.writeOptionError(option, RepErrInvalid, err.Error())
+	}
+
+	export, _, err := c.lookupExport(ctx, option, name)
+	if export == nil {
+		return err
+	}
+
+	listing := option == OptListMetaContext
+	matched := matchMetaContexts(availableMetaContexts(export), queries, listing)
+
+	if !listing {
+		c.metaContexts = nil
+		c.metaContextExport = name
+	}
+
+	for i, contextName := range matched {
+		id := uint32(0) // Ids of listed contexts have no meaning
+		if !listing {
+			id = uint32(i + 1)
+			selected := metaContext{id: id, name: contextName}
+			if strings.HasPrefix(contextName, MetaContextDirtyBitmap) {
+				selected.bitmap = strings.TrimPrefix(contextName, MetaContextDirtyBitmap)
+			}
+			c.metaContexts = append(c.metaContexts, selected)
+		}
+
+		reply := make([]byte, 4, 4+len(contextName))
+		be.PutUint32(reply, id)
+		reply = append(reply, contextName...)
+		if err := c.writeOptionReply(option, RepMetaContext, reply); err != nil {
+			return err
+		}
+	}
+
+	return c.writeOptionReply(option, RepAck, nil)
+}
+
+// replyBlockStatus sends one block status chunk per selected meta context
+func (c *conn) replyBlockStatus(ctx context.Context, req *request) error {
+	offset := int64(req.offset)
+	length := int64(req.length)
+
+	for i, metaContext := range c.metaContexts {
+		var (
+			extents []backend.Extent
+			err     error
+		)
+		if metaContext.bitmap == "" {
+			extents, err = backend.ExtentsOf(ctx, c.export.Backend, offset, length)
+		} else if mapper, ok := c.export.Backend.(backend.DirtyMapper); ok {
+			extents, err = backend.DirtyExtentsOf(ctx, mapper, metaContext.bitmap, offset, length)
+		} else {
+			err = fmt.Errorf("dirty bitmap %q is gone: %w", metaContext.bitmap, backend.ErrInvalid)
+		}
+		if err != nil {
+			return c.replyBackendError(req, err)
+		}
+
+		if req.flags&CmdFlagReqOne != 0 && len(extents) > 1 {
+			extents = extents[:1]
+		}
+
+		replyType, payload := ReplyTypeBlockStatus, make([]byte, 4, 4+8*len(extents))
+		be.PutUint32(payload, metaContext.id)
+		if c.extendedHeaders {
+			replyType, payload = ReplyTypeBlockStatusExt, make([]byte, 8, 8+16*len(extents))
+			be.PutUint32(payload, metaContext.id)
+			be.PutUint32(payload[4:], uint32(len(extents)))
+		}
+		for _, extent := range extents {
+			if c.extendedHeaders {
+				payload = be.AppendUint64(payload, uint64(extent.Length))
+				payload = be.AppendUint64(payload, uint64(blockStatusFlags(metaContext, extent.Flags)))
+				continue
+			}
+			payload = be.AppendUint32(payload, uint32(extent.Length))
+			payload = be.AppendUint32(payload, blockStatusFlags(metaContext, extent.Flags))
+		}
+
+		var flags uint16
+		if i == len(c.metaContexts)-1 {
+			flags = ReplyFlagDone
+		}
+		if err := c.writeStructuredChunk(req, flags, replyType, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func blockStatusFlags(metaContext metaContext, flags backend.ExtentFlags) uint32 {
+	var state uint32
+	if metaContext.bitmap != "" {
+		if flags.Has(backend.ExtentDirty) {
+			state |= StateDirty
+		}
+		return state
+	}
+	if flags.Has(backend.ExtentHole) {
+		state |= StateHole
+	}
+	if flags.Has(backend.ExtentZero) {
+		state |= StateZero
+	}
+	return state
+}
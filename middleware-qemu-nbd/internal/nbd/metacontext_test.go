@@ -0,0 +1,145 @@
+package nbd
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// trackedBackend is an in-memory backend with change tracking bitmaps that report everything clean
+type trackedBackend struct {
+	*memBackend
+	bitmaps []string
+}
+
+func (b *trackedBackend) DirtyBitmaps() []string {
+	return b.bitmaps
+}
+
+func (b *trackedBackend) DirtyExtents(context.Context, string, int64, int64) ([]backend.Extent, error) {
+	return nil, nil
+}
+
+func TestParseMetaContextRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		export  string
+		queries []string
+		wantErr bool
+	}{
+		{name: "no queries", data: metaContextRequest("disk"), export: "disk", queries: []string{}},
+		{name: "queries", data: metaContextRequest("disk", MetaContextBaseAllocation, "qemu:"), export: "disk", queries: []string{MetaContextBaseAllocation, "qemu:"}},
+		{name: "empty query", data: metaContextRequest("", ""), export: "", queries: []string{""}},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "short length", data: []byte{0, 0, 0}, wantErr: true},
+		{name: "name past the end", data: []byte{0, 0, 0, 9, 'd', 'i', 's', 'k', 0, 0, 0, 0}, wantErr: true},
+		{name: "missing count", data: []byte{0, 0, 0, 4, 'd', 'i', 's', 'k', 0, 0}, wantErr: true},
+		{name: "name too long", data: be.AppendUint32(nil, maxNameLength+1), wantErr: true},
+		{name: "too many queries", data: be.AppendUint32(be.AppendUint32(nil, 0), maxMetaQueries+1), wantErr: true},
+		{name: "missing query", data: be.AppendUint32(be.AppendUint32(nil, 0), 1), wantErr: true},
+		{name: "truncated query length", data: append(be.AppendUint32(be.AppendUint32(nil, 0), 1), 0, 0), wantErr: true},
+		{name: "truncated query", data: metaContextRequest("disk", MetaContextBaseAllocation)[:20], wantErr: true},
+		{name: "trailing data", data: append(metaContextRequest("disk", MetaContextBaseAllocation), 0), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			export, queries, err := parseMetaContextRequest(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if export != test.export || !slices.Equal(queries, test.queries) {
+				t.Fatalf("parsed %q %q, want %q %q", export, queries, test.export, test.queries)
+			}
+		})
+	}
+}
+
+func TestMatchMetaContexts(t *testing.T) {
+	available := []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup", MetaContextDirtyBitmap + "replica"}
+	tests := []struct {
+		name    string
+		queries []string
+		listing bool
+		matched []string
+	}{
+		{name: "list all", listing: true, matched: available},
+		{name: "set none", listing: false, matched: nil},
+		{name: "exact", queries: []string{MetaContextBaseAllocation}, matched: []string{MetaContextBaseAllocation}},
+		{name: "list namespace", queries: []string{"qemu:"}, listing: true, matched: available[1:]},
+		{name: "list bitmaps", queries: []string{MetaContextDirtyBitmap}, listing: true, matched: available[1:]},
+		{name: "namespace is no context", queries: []string{"qemu:"}, matched: nil},
+		{name: "arbitrary prefix", queries: []string{"qemu:dirty"}, listing: true, matched: nil},
+		{name: "unknown", queries: []string{"qemu:allocation-depth"}, matched: nil},
+		{name: "duplicates", queries: []string{MetaContextBaseAllocation, "base:", MetaContextBaseAllocation}, listing: true, matched: available[:1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matched := matchMetaContexts(available, test.queries, test.listing); !slices.Equal(matched, test.matched) {
+				t.Fatalf("matched %q, want %q", matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestMetaContextNegotiation(t *testing.T) {
+	exports := testExports(1 << 20)
+	exports["tracked"] = &Export{Name: "tracked", Backend: &trackedBackend{memBackend: newMemBackend(1 << 20), bitmaps: []string{"backup"}}}
+	path := startServer(t, exports, Options{})
+
+	tests := []struct {
+		name     string
+		option   uint32
+		data     []byte
+		contexts []string // Contexts of the replies before the ack
+		reply    uint32   // Reply type instead of contexts and ack, if set
+	}{
+		{name: "list", option: OptListMetaContext, data: metaContextRequest("tracked"), contexts: []string{MetaContextBaseAllocation, MetaContextDirtyBitmap + "backup"}},
+		{name: "list without tracking", option: OptListMetaContext, data: metaContextRequest("disk"), contexts: []string{MetaContextBaseAllocation}},
+		{name: "list bitmaps", option: OptListMetaContext, data: metaContextRequest("tracked", "qemu:"), contexts: []string{MetaContextDirtyBitmap + "backup"}},
+		{name: "set", option: OptSetMetaContext, data: metaContextRequest("tracked", MetaContextDirtyBitmap+"backup", "unknown:context"), contexts: []string{MetaContextDirtyBitmap + "backup"}},
+		{name: "set unknown bitmap", option: OptSetMetaContext, data: metaContextRequest("tracked", MetaContextDirtyBitmap+"other"), contexts: nil},
+		{name: "unknown export", option: OptSetMetaContext, data: metaContextRequest("missing", MetaContextBaseAllocation), reply: RepErrUnknown},
+		{name: "invalid request", option: OptListMetaContext, data: []byte{0, 0, 0, 1}, reply: RepErrInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+			c.sendOption(MagicOption, OptStructuredReply, nil)
+			if reply := c.readReply(); reply.replyType != RepAck {
+				t.Fatalf("structured replies: reply %d", reply.replyType)
+			}
+
+			c.sendOption(MagicOption, test.option, test.data)
+			if test.reply != 0 {
+				if reply := c.readReply(); reply.replyType != test.reply {
+					t.Fatalf("reply %d, want %d", reply.replyType, test.reply)
+				}
+				return
+			}
+			var contexts []string
+			for {
+				reply := c.readReply()
+				if reply.replyType == RepAck {
+					break
+				}
+				if reply.replyType != RepMetaContext || len(reply.data) < 4 {
+					t.Fatalf("reply %d with %d bytes", reply.replyType, len(reply.data))
+				}
+				id := be.Uint32(reply.data)
+				if (test.option == OptSetMetaContext) != (id != 0) {
+					t.Fatalf("context id %d in reply to option %d", id, test.option)
+				}
+				contexts = append(contexts, string(reply.data[4:]))
+			}
+			if !slices.Equal(contexts, test.contexts) {
+				t.Fatalf("contexts %q, want %q", contexts, test.contexts)
+			}
+		})
+	}
+}
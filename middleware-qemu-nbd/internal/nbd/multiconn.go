@@ -0,0 +1,94 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// MultiConn spreads the requests over several connections to the same export. The server must advertise
+// NBD_FLAG_CAN_MULTI_CONN, so a flush on one connection covers the writes completed on all of them.
+type MultiConn struct {
+	clients []*Client
+	next    atomic.Uint64
+}
+
+// DialMultiConn opens up to connections connections to the export (only one, if the server does not allow multi-conn)
+func DialMultiConn(ctx context.Context, network, address string, options ClientOptions, connections int) (*MultiConn, error) {
+	first, err := Dial(ctx, network, address, options)
+	if err != nil {
+		return nil, err
+	}
+	m := &MultiConn{clients: []*Client{first}}
+	if !first.CanMultiConn() {
+		return m, nil
+	}
+	for len(m.clients) < connections {
+		client, err := Dial(ctx, network, address, options)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.clients = append(m.clients, client)
+	}
+	return m, nil
+}
+
+// Connections returns the number of open connections
+func (m *MultiConn) Connections() int {
+	return len(m.clients)
+}
+
+// Client returns the first connection, e.g. for the size and flags of the export
+func (m *MultiConn) Client() *Client {
+	return m.clients[0]
+}
+
+func (m *MultiConn) pick() *Client {
+	return m.clients[m.next.Add(1)%uint64(len(m.clients))]
+}
+
+func (m *MultiConn) ReadAt(ctx context.Context, p []byte, off uint64) error {
+	return m.pick().ReadAt(ctx, p, off)
+}
+
+func (m *MultiConn) WriteAt(ctx context.Context, p []byte, off uint64, flags uint16) error {
+	return m.pick().WriteAt(ctx, p, off, flags)
+}
+
+// Flush flushes the writes completed on all connections
+func (m *MultiConn) Flush(ctx context.Context) error {
+	return m.pick().Flush(ctx)
+}
+
+func (m *MultiConn) Trim(ctx context.Context, off uint64, length uint32, flags uint16) error {
+	return m.pick().Trim(ctx, off, length, flags)
+}
+
+func (m *MultiConn) WriteZeroes(ctx context.Context, off uint64, length uint32, flags uint16) error {
+	return m.pick().WriteZeroes(ctx, off, length, flags)
+}
+
+func (m *MultiConn) Cache(ctx context.Context, off uint64, length uint32) error {
+	return m.pick().Cache(ctx, off, length)
+}
+
+func (m *MultiConn) BlockStatus(ctx context.Context, off uint64, length uint32, flags uint16) (map[string][]BlockStatusExtent, error) {
+	return m.pick().BlockStatus(ctx, off, length, flags)
+}
+
+// Disconnect disconnects all connections
+func (m *MultiConn) Disconnect(ctx context.Context) error {
+	var errs []error
+	for _, client := range m.clients {
+		errs = append(errs, client.Disconnect(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiConn) Close() error {
+	for _, client := range m.clients {
+		client.Close()
+	}
+	return nil
+}
@@ -1,2 +1,154 @@
-// Package nbd provides nbd adaptor
+// Package nbd provides the NBD server (fixed newstyle negotiation and transmission) of the qemu-nbd middleware and an NBD client for tooling and tests
 package nbd
+
+import (
+	"encoding/binary"
+)
+
+// Magics
+const (
+	MagicNBD             uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	MagicOption          uint64 = 0x49484156454f5054 // "IHAVEOPT"
+	MagicOptionReply     uint64 = 0x3e889045565a9
+	MagicRequest         uint32 = 0x25609513
+	MagicExtendedRequest uint32 = 0x21e41c71
+	MagicSimpleReply     uint32 = 0x67446698
+	MagicStructuredReply uint32 = 0x668e33ef
+	MagicExtendedReply   uint32 = 0x6e8a278c
+)
+
+// Handshake flags (server)
+const (
+	FlagFixedNewstyle uint16 = 1 << 0
+	FlagNoZeroes      uint16 = 1 << 1
+)
+
+// Client flags
+const (
+	FlagClientFixedNewstyle uint32 = 1 << 0
+	FlagClientNoZeroes      uint32 = 1 << 1
+)
+
+// Transmission flags
+const (
+	FlagHasFlags        uint16 = 1 << 0
+	FlagReadOnly        uint16 = 1 << 1
+	FlagSendFlush       uint16 = 1 << 2
+	FlagSendFUA         uint16 = 1 << 3
+	FlagSendTrim        uint16 = 1 << 5
+	FlagSendWriteZeroes uint16 = 1 << 6
+	FlagCanMultiConn    uint16 = 1 << 8
+	FlagSendCache       uint16 = 1 << 10
+	FlagSendFastZero    uint16 = 1 << 11
+)
+
+// Options
+const (
+	OptExportName      uint32 = 1
+	OptAbort           uint32 = 2
+	OptList            uint32 = 3
+	OptStartTLS        uint32 = 5
+	OptInfo            uint32 = 6
+	OptGo              uint32 = 7
+	OptStructuredReply uint32 = 8
+	OptListMetaContext uint32 = 9
+	OptSetMetaContext  uint32 = 10
+	OptExtendedHeaders uint32 = 11
+)
+
+// Option replies
+const (
+	RepAck         uint32 = 1
+	RepServer      uint32 = 2
+	RepInfo        uint32 = 3
+	RepMetaContext uint32 = 4
+
+	repFlagError uint32 = 1 << 31
+
+	RepErrUnsup    = repFlagError | 1
+	RepErrPolicy   = repFlagError | 2
+	RepErrInvalid  = repFlagError | 3
+	RepErrPlatform = repFlagError | 4
+	RepErrTLSReqd  = repFlagError | 5
+	RepErrUnknown  = repFlagError | 6
+	RepErrShutdown = repFlagError | 7
+	RepErrTooBig   = repFlagError | 9
+
+	RepErrExtHeaderReqd = repFlagError | 11
+)
+
+// Structured reply flags and chunk types
+const (
+	ReplyFlagDone uint16 = 1 << 0
+
+	ReplyTypeNone           uint16 = 0
+	ReplyTypeOffsetData     uint16 = 1
+	ReplyTypeOffsetHole     uint16 = 2
+	ReplyTypeBlockStatus    uint16 = 5
+	ReplyTypeBlockStatusExt uint16 = 6 // Replaces NBD_REPLY_TYPE_BLOCK_STATUS with extended headers
+	ReplyTypeError          uint16 = 1<<15 | 1
+	ReplyTypeErrorOffset    uint16 = 1<<15 | 2
+)
+
+// Meta contexts
+const (
+	MetaContextBaseAllocation = "base:allocation"
+	MetaContextDirtyBitmap    = "qemu:dirty-bitmap:" // Prefix, followed by the name of the bitmap
+)
+
+// Block status flags of the meta contexts
+const (
+	StateHole  uint32 = 1 << 0 // base:allocation
+	StateZero  uint32 = 1 << 1 // base:allocation
+	StateDirty uint32 = 1 << 0 // qemu:dirty-bitmap:<name>
+)
+
+// Info types of NBD_OPT_INFO and NBD_OPT_GO
+const (
+	InfoExport      uint16 = 0
+	InfoName        uint16 = 1
+	InfoDescription uint16 = 2
+	InfoBlockSize   uint16 = 3
+)
+
+// Commands
+const (
+	CmdRead        uint16 = 0
+	CmdWrite       uint16 = 1
+	CmdDisc        uint16 = 2
+	CmdFlush       uint16 = 3
+	CmdTrim        uint16 = 4
+	CmdCache       uint16 = 5
+	CmdWriteZeroes uint16 = 6
+	CmdBlockStatus uint16 = 7
+)
+
+// Command flags
+const (
+	CmdFlagFUA        uint16 = 1 << 0
+	CmdFlagNoHole     uint16 = 1 << 1
+	CmdFlagReqOne     uint16 = 1 << 3
+	CmdFlagFastZero   uint16 = 1 << 4
+	CmdFlagPayloadLen uint16 = 1 << 5 // Extended headers only: the length is the length of a payload
+)
+
+// Errors (errno values as defined by the protocol)
+const (
+	ErrnoPerm     uint32 = 1
+	ErrnoIO       uint32 = 5
+	ErrnoNoMem    uint32 = 12
+	ErrnoInval    uint32 = 22
+	ErrnoNoSpace  uint32 = 28
+	ErrnoOverflow uint32 = 75
+	ErrnoNotSup   uint32 = 95
+	ErrnoShutdown uint32 = 108
+)
+
+const (
+	maxOptionLength  = 4096
+	maxNameLength    = 4096
+	maxMetaQueries   = 128
+	maxPayloadLength = 32 << 20 // Maximum length of read and write requests (as qemu)
+)
+
+var be = binary.BigEndian
@@ -0,0 +1,40 @@
+package nbd
+
+import (
+	"quorumbd.net/middleware-common/acl"
+)
+
+// authorize returns the access of the peer to the export (read-write for all, if the server has no authorizer)
+func (s *Server) authorize(peer acl.Peer, export string) acl.Access {
+	if s.options.Authorizer == nil {
+		return acl.AccessReadWrite
+	}
+	return s.options.Authorizer.Authorize(peer, export)
+}
+
+// authorizeExport applies the access of the connection peer to an export (nil, if the access is denied)
+func (c *conn) authorizeExport(export *Export) *Export {
+	switch c.server.authorize(c.peer, export.Name) {
+	case acl.AccessReadWrite:
+		return export
+	case acl.AccessReadOnly:
+		if export.ReadOnly {
+			return export
+		}
+		readOnly := *export
+		readOnly.ReadOnly = true
+		return &readOnly
+	default:
+		c.logDenied(export.Name)
+		return nil
+	}
+}
+
+// logDenied logs a denied access (the logger of the connection carries pid and uid of the peer)
+func (c *conn) logDenied(export string) {
+	attrs := []any{"export", export, "tls_identity", c.peer.TLSIdentity}
+	if creds := c.peer.Credentials; creds != nil {
+		attrs = append(attrs, "gids", creds.GIDs, "executable", acl.PeerExecutable(creds.PID))
+	}
+	c.logger.Warn("Access to export denied", attrs...)
+}
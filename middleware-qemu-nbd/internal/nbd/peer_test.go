@@ -0,0 +1,75 @@
+package nbd
+
+import (
+	"errors"
+	"testing"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+)
+
+// exportAuthorizer grants the access of the export to every peer (denied for exports without entry)
+type exportAuthorizer map[string]acl.Access
+
+func (a exportAuthorizer) Authorize(_ acl.Peer, export string) acl.Access {
+	return a[export]
+}
+
+// localFlushBackend hides the shared flush semantics of the in-memory backend
+type localFlushBackend struct {
+	backend.BlockBackend
+}
+
+func TestAccessControl(t *testing.T) {
+	exports := exportSource{
+		"disk":    {Name: "disk", BlockSize: 512, Backend: localFlushBackend{newMemBackend(1 << 20)}},
+		"scratch": {Name: "scratch", BlockSize: 512, Backend: localFlushBackend{newMemBackend(1 << 20)}},
+		"ro":      {Name: "ro", ReadOnly: true, BlockSize: 512, Backend: localFlushBackend{newMemBackend(1 << 20)}},
+		"secret":  {Name: "secret", BlockSize: 512, Backend: newMemBackend(1 << 20)},
+	}
+	authorizer := exportAuthorizer{"disk": acl.AccessReadOnly, "scratch": acl.AccessReadWrite, "ro": acl.AccessReadOnly}
+	path := startServer(t, exports, Options{MultiConn: true, Authorizer: authorizer})
+
+	// Clients with read-only access to a writable export cannot write, so they may use multi-conn
+	tests := []struct {
+		export    string
+		readOnly  bool
+		multiConn bool
+	}{
+		{export: "disk", readOnly: true, multiConn: true},
+		{export: "scratch", readOnly: false, multiConn: false},
+		{export: "ro", readOnly: true, multiConn: true},
+	}
+	for _, test := range tests {
+		t.Run(test.export, func(t *testing.T) {
+			client := dialClient(t, path, ClientOptions{ExportName: test.export})
+			if client.ReadOnly() != test.readOnly || client.CanMultiConn() != test.multiConn {
+				t.Fatalf("read-only %t and multi-conn %t, want %t and %t", client.ReadOnly(), client.CanMultiConn(), test.readOnly, test.multiConn)
+			}
+			err := client.WriteAt(t.Context(), make([]byte, 512), 0, 0)
+			var requestErr *RequestError
+			if test.readOnly && (!errors.As(err, &requestErr) || requestErr.Errno != ErrnoPerm) {
+				t.Fatalf("write: error %v, want errno %d", err, ErrnoPerm)
+			}
+			if !test.readOnly && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("denied", func(t *testing.T) {
+		for _, option := range []uint32{OptInfo, OptGo} {
+			c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+			c.sendOption(MagicOption, option, infoRequest("secret"))
+			if reply := c.readReply(); reply.option != option || reply.replyType != RepErrPolicy {
+				t.Fatalf("option %d: reply %+v, want the policy error", option, reply)
+			}
+		}
+		// NBD_OPT_EXPORT_NAME has no error reply, the connection is closed
+		c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+		c.sendOption(MagicOption, OptExportName, []byte("secret"))
+		if !c.closed() {
+			t.Fatal("connection to a denied export not closed")
+		}
+	})
+}
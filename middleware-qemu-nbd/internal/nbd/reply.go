@@ -0,0 +1,157 @@
+package nbd
+
+import (
+	"context"
+	"fmt"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// replyDone sends the successful reply of a request without payload
+func (c *conn) replyDone(req *request) error {
+	if c.structuredReplies {
+		return c.writeStructuredChunk(req, ReplyFlagDone, ReplyTypeNone, nil)
+	}
+	return c.writeSimpleReply(req, 0, nil)
+}
+
+// replyError sends the error reply of a request
+func (c *conn) replyError(req *request, errno uint32, message string) error {
+	if c.structuredReplies {
+		return c.writeStructuredChunk(req, ReplyFlagDone, ReplyTypeError, errorPayload(errno, message, nil))
+	}
+	return c.writeSimpleReply(req, errno, nil)
+}
+
+// replyRead reads the requested range and sends it. With structured replies unallocated ranges are sent as holes.
+func (c *conn) replyRead(ctx context.Context, req *request) error {
+	offset := int64(req.offset)
+
+	if !c.structuredReplies {
+		data := make([]byte, req.length)
+		if err := c.export.Backend.ReadAt(ctx, data, offset); err != nil {
+			return c.replyBackendError(req, err)
+		}
+		return c.writeSimpleReply(req, 0, data)
+	}
+
+	if req.length == 0 {
+		return c.replyDone(req)
+	}
+
+	extents, err := backend.ExtentsOf(ctx, c.export.Backend, offset, int64(req.length))
+	if err != nil {
+		return c.replyBackendError(req, err)
+	}
+
+	for i, extent := range extents {
+		var flags uint16
+		if i == len(extents)-1 {
+			flags = ReplyFlagDone
+		}
+
+		if extent.Flags.Has(backend.ExtentZero) {
+			payload := make([]byte, 12)
+			be.PutUint64(payload[0:], uint64(extent.Offset))
+			be.PutUint32(payload[8:], uint32(extent.Length))
+			if err := c.writeStructuredChunk(req, flags, ReplyTypeOffsetHole, payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload := make([]byte, 8+extent.Length)
+		be.PutUint64(payload[0:], uint64(extent.Offset))
+		if err := c.export.Backend.ReadAt(ctx, payload[8:], extent.Offset); err != nil {
+			errno := errnoOf(err)
+			c.logger.Warn("Request failed", "command", req.command, "offset", extent.Offset, "length", extent.Length, "errno", errno, "error", err)
+			errorOffset := uint64(extent.Offset)
+			return c.writeStructuredChunk(req, ReplyFlagDone, ReplyTypeErrorOffset, errorPayload(errno, err.Error(), &errorOffset))
+		}
+		if err := c.writeStructuredChunk(req, flags, ReplyTypeOffsetData, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replyBackendError logs a failed request and sends the mapped error
+func (c *conn) replyBackendError(req *request, err error) error {
+	errno := errnoOf(err)
+	if errno == ErrnoNotSup && req.flags&CmdFlagFastZero != 0 {
+		return c.replyError(req, errno, "zeroing would be slow") // Expected answer, if zeroing would be slow
+	}
+	c.logger.Warn("Request failed", "command", req.command, "offset", req.offset, "length", req.length, "errno", errno, "error", err)
+	return c.replyError(req, errno, err.Error())
+}
+
+func errorPayload(errno uint32, message string, offset *uint64) []byte {
+	if len(message) > 4096 {
+		message = message[:4096]
+	}
+	payload := make([]byte, 6, 6+len(message)+8)
+	be.PutUint32(payload[0:], errno)
+	be.PutUint16(payload[4:], uint16(len(message)))
+	payload = append(payload, message...)
+	if offset != nil {
+		payload = be.AppendUint64(payload, *offset)
+	}
+	return payload
+}
+
+func (c *conn) writeSimpleReply(req *request, errno uint32, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var header [16]byte
+	be.PutUint32(header[0:], MagicSimpleReply)
+	be.PutUint32(header[4:], errno)
+	be.PutUint64(header[8:], req.cookie)
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if errno == 0 {
+		if _, err := c.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// writeStructuredChunk writes a reply chunk, with an extended header if negotiated (it repeats the offset of the request)
+func (c *conn) writeStructuredChunk(req *request, flags uint16, replyType uint16, payload []byte) error {
+	var (
+		headerBuf [32]byte
+		header    []byte
+	)
+	if c.extendedHeaders {
+		header = headerBuf[:32]
+		be.PutUint32(header[0:], MagicExtendedReply)
+		be.PutUint16(header[4:], flags)
+		be.PutUint16(header[6:], replyType)
+		be.PutUint64(header[8:], req.cookie)
+		be.PutUint64(header[16:], req.offset)
+		be.PutUint64(header[24:], uint64(len(payload)))
+	} else {
+		if uint64(len(payload)) > 1<<32-1 {
+			return fmt.Errorf("structured reply chunk too large: %d", len(payload))
+		}
+		header = headerBuf[:20]
+		be.PutUint32(header[0:], MagicStructuredReply)
+		be.PutUint16(header[4:], flags)
+		be.PutUint16(header[6:], replyType)
+		be.PutUint64(header[8:], req.cookie)
+		be.PutUint32(header[16:], uint32(len(payload)))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
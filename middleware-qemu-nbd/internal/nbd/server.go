@@ -0,0 +1,278 @@
+package nbd
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/qos"
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+// Export is an export that can be negotiated by NBD clients
+type Export struct {
+	Name        string
+	Description string
+	ReadOnly    bool
+	BlockSize   uint32 // Internal block granularity of the volume (0: unknown)
+	Backend     backend.BlockBackend
+	Limiter     *qos.Limiter // Shared by all connections of the export (nil: unlimited)
+}
+
+// ErrUnknownExport is returned by an ExportSource for exports that do not exist or are not attached
+var ErrUnknownExport = errors.New("unknown export")
+
+// ExportListing is an entry of the reply to NBD_OPT_LIST
+type ExportListing struct {
+	Name        string
+	Description string
+}
+
+// ExportSource resolves the exports served by the server
+type ExportSource interface {
+	LookupExport(ctx context.Context, name string) (*Export, error)
+	ListExports(ctx context.Context) ([]ExportListing, error)
+}
+
+// Options configure the server
+type Options struct {
+	MultiConn               bool // Advertise NBD_FLAG_CAN_MULTI_CONN for exports with shared flush semantics
+	MaxConnectionsPerExport int
+	TLSConfig               *tls.Config    // Enables NBD_OPT_STARTTLS on tcp listeners
+	PSKConfig               *tlspsk.Config // Enables NBD_OPT_STARTTLS with pre-shared keys instead of TLSConfig
+	TLSRequired             bool           // Refuse option negotiation on tcp listeners until TLS is negotiated
+	Authorizer              acl.Authorizer // Access control of the exports (nil: every peer may open every export)
+	MaxInFlight             int            // Requests processed concurrently per connection (0: one at a time)
+	MemoryBudget            int64          // Bytes of write payloads and read buffers of all connections (0: unlimited)
+}
+
+type Server struct {
+	logger      *slog.Logger
+	exports     ExportSource
+	options     Options
+	budget      *budget
+	baseCtx     context.Context // Cancelled on shutdown, parent of the contexts of all connections
+	cancelBase  context.CancelFunc
+	wg          sync.WaitGroup
+	connsMu     sync.Mutex
+	conns       map[*conn]struct{}
+	exportConns map[string]int    // Number of connections in transmission phase per export
+	detaches    map[string]uint64 // Number of DisconnectExport calls per export, see claimExport
+	closing     bool
+	nextConnID  atomic.Uint64
+}
+
+// ConnectionInfo describes a client connection in transmission phase
+type ConnectionInfo struct {
+	ID                uint64
+	Export            string
+	RemoteAddr        string
+	Peer              acl.Peer
+	ConnectedAt       time.Time
+	Flags             uint16 // Transmission flags
+	TLS               bool
+	StructuredReplies bool
+	ExtendedHeaders   bool
+	BytesRead         uint64
+	BytesWritten      uint64
+}
+
+func NewServer(parentLogger *slog.Logger, exports ExportSource, options Options) *Server {
+	if options.MaxInFlight <= 0 {
+		options.MaxInFlight = 1
+	}
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	return &Server{
+		logger:      parentLogger.With("module", "nbdserver"),
+		exports:     exports,
+		options:     options,
+		budget:      newBudget(options.MemoryBudget),
+		baseCtx:     baseCtx,
+		cancelBase:  cancelBase,
+		conns:       make(map[*conn]struct{}),
+		exportConns: make(map[string]int),
+		detaches:    make(map[string]uint64),
+	}
+}
+
+// Serve accepts connections until the listener is closed. STARTTLS is offered on tcp listeners only.
+func (s *Server) Serve(ln net.Listener) error {
+	tlsCapable := (s.options.TLSConfig != nil || s.options.PSKConfig != nil) && ln.Addr().Network() == "tcp"
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		c := newConn(s, netConn, tlsCapable)
+		if !s.track(c) {
+			netConn.Close()
+			return nil
+		}
+
+		s.wg.Go(func() {
+			defer s.untrack(c)
+			c.serve()
+		})
+	}
+}
+
+// Shutdown closes all client connections and waits for them (the listener must be closed by the caller)
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	s.closing = true
+	s.cancelBase()
+	for c := range s.conns {
+		c.close()
+	}
+	s.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(c *conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c *conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, c)
+	if c.export != nil {
+		s.exportConns[c.export.Name]--
+		if s.exportConns[c.export.Name] <= 0 {
+			delete(s.exportConns, c.export.Name)
+		}
+	}
+}
+
+// transmitting marks a connection as entering the transmission phase (its negotiated state does not change anymore)
+func (s *Server) transmitting(c *conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	c.connectedAt = time.Now()
+}
+
+// Connections returns the connections in transmission phase, ordered by id
+func (s *Server) Connections() []ConnectionInfo {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	infos := make([]ConnectionInfo, 0, len(s.conns))
+	for c := range s.conns {
+		if c.connectedAt.IsZero() {
+			continue
+		}
+		infos = append(infos, ConnectionInfo{
+			ID:                c.id,
+			Export:            c.export.Name,
+			RemoteAddr:        c.netConn.RemoteAddr().String(),
+			Peer:              c.peer,
+			ConnectedAt:       c.connectedAt,
+			Flags:             c.flags,
+			TLS:               c.tlsActive,
+			StructuredReplies: c.structuredReplies,
+			ExtendedHeaders:   c.extendedHeaders,
+			BytesRead:         c.bytesRead.Load(),
+			BytesWritten:      c.bytesWritten.Load(),
+		})
+	}
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// Disconnect closes the connection with the id (false, if there is none)
+func (s *Server) Disconnect(id uint64) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for c := range s.conns {
+		if c.id == id {
+			c.close()
+			return true
+		}
+	}
+	return false
+}
+
+// DisconnectExport closes all connections of an export that claimed it and makes the claims of connections that looked it
+// up before fail. It returns the number of closed connections. The export source must not resolve the export anymore.
+func (s *Server) DisconnectExport(name string) int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.detaches[name]++
+	closed := 0
+	for c := range s.conns {
+		if c.export != nil && c.export.Name == name {
+			c.close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// lookupExport resolves an export. It returns the number of detaches of the export before the lookup for claimExport.
+func (s *Server) lookupExport(ctx context.Context, name string) (*Export, uint64, error) {
+	s.connsMu.Lock()
+	detaches := s.detaches[name]
+	s.connsMu.Unlock()
+	export, err := s.exports.LookupExport(ctx, name)
+	return export, detaches, err
+}
+
+// claimExport sets the export of a connection entering the transmission phase and counts it. It fails, if the connection
+// limit of the export is reached or the export was detached since it was looked up.
+func (s *Server) claimExport(c *conn, export *Export, detaches uint64) error {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.detaches[export.Name] != detaches {
+		return fmt.Errorf("%w: export %q was detached", ErrUnknownExport, export.Name)
+	}
+	if s.options.MaxConnectionsPerExport > 0 && s.exportConns[export.Name] >= s.options.MaxConnectionsPerExport {
+		return fmt.Errorf("connection limit of export %q reached", export.Name)
+	}
+	s.exportConns[export.Name]++
+	c.setExport(export) // Set with the claim, so that the claim is released when the connection fails
+	return nil
+}
+
+// multiConn returns true, if several connections to the export may be used with shared flush semantics. The export
+// carries the effective access of the client: a client with read-only access to a writable export writes nothing, so
+// the flush semantics of the backend do not matter for it.
+func (s *Server) multiConn(export *Export) bool {
+	if !s.options.MultiConn || s.options.MaxConnectionsPerExport == 1 {
+		return false
+	}
+	// Without writes there is nothing to flush, otherwise a flush must cover the writes of all connections
+	return export.ReadOnly || backend.FlushesAllWrites(export.Backend)
+}
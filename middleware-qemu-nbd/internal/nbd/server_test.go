@@ -0,0 +1,322 @@
+package nbd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// memBackend is an in-memory block backend
+type memBackend struct {
+	mu      sync.Mutex
+	data    []byte
+	flushes int
+}
+
+func newMemBackend(size int64) *memBackend {
+	return &memBackend{data: make([]byte, size)}
+}
+
+func (b *memBackend) ReadAt(_ context.Context, p []byte, off int64) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(p, b.data[off:])
+	return nil
+}
+
+func (b *memBackend) WriteAt(_ context.Context, p []byte, off int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, int64(len(p))); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copy(b.data[off:], p)
+	return nil
+}
+
+func (b *memBackend) Flush(context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+	return nil
+}
+
+func (b *memBackend) Trim(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	return b.WriteZeroes(ctx, off, length, flags)
+}
+
+func (b *memBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	if err := backend.CheckRange(int64(len(b.data)), off, length); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clear(b.data[off : off+length])
+	return nil
+}
+
+func (b *memBackend) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memBackend) Close() error {
+	return nil
+}
+
+func (b *memBackend) FlushesAllWrites() bool {
+	return true
+}
+
+// exportSource serves a fixed set of exports
+type exportSource map[string]*Export
+
+func (s exportSource) LookupExport(_ context.Context, name string) (*Export, error) {
+	export, ok := s[name]
+	if !ok {
+		return nil, ErrUnknownExport
+	}
+	return export, nil
+}
+
+func (s exportSource) ListExports(context.Context) ([]ExportListing, error) {
+	listings := make([]ExportListing, 0, len(s))
+	for _, export := range s {
+		listings = append(listings, ExportListing{Name: export.Name, Description: export.Description})
+	}
+	return listings, nil
+}
+
+// startServer serves the exports on a unix socket until the test ends and returns its path
+func startServer(t *testing.T, exports exportSource, options Options) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, exports, options)
+	return path
+}
+
+// startTCPServer serves the exports on a tcp socket of the loopback until the test ends and returns its address
+func startTCPServer(t *testing.T, exports exportSource, options Options) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, ln, exports, options), ln.Addr().String()
+}
+
+// serve serves the exports on ln until the test ends
+func serve(t *testing.T, ln net.Listener, exports exportSource, options Options) *Server {
+	t.Helper()
+	server := NewServer(slog.New(slog.DiscardHandler), exports, options)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-done
+	})
+	return server
+}
+
+// testExports returns a writable export "disk" and a read-only export "ro" of the given size
+func testExports(size int64) exportSource {
+	return exportSource{
+		"disk": {Name: "disk", Description: "test disk", BlockSize: 4096, Backend: newMemBackend(size)},
+		"ro":   {Name: "ro", ReadOnly: true, BlockSize: 512, Backend: newMemBackend(size)},
+	}
+}
+
+// waitForConnections waits until the server has n connections in transmission phase and returns them
+func waitForConnections(t *testing.T, server *Server, n int) []ConnectionInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := server.Connections()
+		if len(connections) == n {
+			return connections
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections, want %d", len(connections), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	server, address := startTCPServer(t, testExports(1<<20), Options{})
+	ctx := t.Context()
+	disk, err := Dial(ctx, "tcp", address, ClientOptions{ExportName: "disk", StructuredReplies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	ro, err := Dial(ctx, "tcp", address, ClientOptions{ExportName: "ro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	// Connections in negotiation are not listed
+	dialRawNetwork(t, "tcp", address, FlagClientFixedNewstyle|FlagClientNoZeroes)
+
+	if err := disk.WriteAt(ctx, make([]byte, 4096), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.ReadAt(ctx, make([]byte, 8192), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Requests are processed one at a time, the counters of the previous requests are updated after the flush
+	if err := disk.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	connections := server.Connections()
+	if len(connections) != 2 || connections[0].ID >= connections[1].ID {
+		t.Fatalf("connections %+v", connections)
+	}
+	for i, want := range []ConnectionInfo{
+		{Export: "disk", Flags: disk.Flags(), StructuredReplies: true, BytesRead: 8192, BytesWritten: 4096},
+		{Export: "ro", Flags: ro.Flags()},
+	} {
+		got := connections[i]
+		if got.Export != want.Export || got.Flags != want.Flags || got.StructuredReplies != want.StructuredReplies || got.TLS ||
+			got.BytesRead != want.BytesRead || got.BytesWritten != want.BytesWritten || got.ConnectedAt.IsZero() || got.RemoteAddr == "" {
+			t.Errorf("connection %d: %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	server, address := startTCPServer(t, testExports(1<<20), Options{})
+	ctx := t.Context()
+	var clients []*Client
+	for _, name := range []string{"disk", "disk", "ro"} {
+		client, err := Dial(ctx, "tcp", address, ClientOptions{ExportName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	connections := waitForConnections(t, server, 3)
+
+	if server.Disconnect(connections[len(connections)-1].ID + 100) {
+		t.Fatal("disconnected an unknown connection")
+	}
+	if !server.Disconnect(connections[0].ID) {
+		t.Fatal("connection not found")
+	}
+	if err := clients[0].Flush(ctx); err == nil {
+		t.Fatal("request on a disconnected connection succeeded")
+	}
+	waitForConnections(t, server, 2)
+
+	// Detaching closes the remaining connection of the export, the other export is served on
+	if closed := server.DisconnectExport("disk"); closed != 1 {
+		t.Fatalf("%d connections of the export closed", closed)
+	}
+	if err := clients[1].Flush(ctx); err == nil {
+		t.Fatal("request on a connection of a detached export succeeded")
+	}
+	if err := clients[2].ReadAt(ctx, make([]byte, 512), 0); err != nil {
+		t.Fatal(err)
+	}
+	if connections := waitForConnections(t, server, 1); connections[0].Export != "ro" {
+		t.Fatalf("connections %+v", connections)
+	}
+}
+
+// blockingSource blocks the first lookup of an export until release is closed
+type blockingSource struct {
+	exportSource
+	lookedUp chan struct{}
+	release  chan struct{}
+	once     sync.Once
+}
+
+func (s *blockingSource) LookupExport(ctx context.Context, name string) (*Export, error) {
+	s.once.Do(func() {
+		close(s.lookedUp)
+		<-s.release
+	})
+	return s.exportSource.LookupExport(ctx, name)
+}
+
+func TestDisconnectExportDuringNegotiation(t *testing.T) {
+	t.Run("looked up", func(t *testing.T) {
+		source := &blockingSource{exportSource: testExports(1 << 20), lookedUp: make(chan struct{}), release: make(chan struct{})}
+		server := NewServer(slog.New(slog.DiscardHandler), source, Options{})
+		path := filepath.Join(t.TempDir(), "nbd.sock")
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(ln)
+		defer func() {
+			ln.Close()
+			server.Shutdown(context.Background())
+		}()
+
+		// The export is detached after the lookup, the claim of the looked up export fails
+		c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+		c.sendOption(MagicOption, OptGo, infoRequest("disk"))
+		<-source.lookedUp
+		if closed := server.DisconnectExport("disk"); closed != 0 {
+			t.Fatalf("%d connections closed", closed)
+		}
+		close(source.release)
+		if reply := c.readReply(); reply.replyType != RepErrUnknown {
+			t.Fatalf("reply %d to NBD_OPT_GO of a detached export", reply.replyType)
+		}
+
+		// An export attached again after the detach is served
+		c.sendOption(MagicOption, OptGo, infoRequest("disk"))
+		for _, want := range []uint32{RepInfo, RepInfo, RepAck} {
+			if reply := c.readReply(); reply.replyType != want {
+				t.Fatalf("reply %d to NBD_OPT_GO, want %d", reply.replyType, want)
+			}
+		}
+	})
+
+	t.Run("claimed", func(t *testing.T) {
+		exports := testExports(1 << 20)
+		server := NewServer(slog.New(slog.DiscardHandler), exports, Options{})
+		client, netConn := net.Pipe()
+		defer client.Close()
+		c := newConn(server, netConn, false)
+		if !server.track(c) {
+			t.Fatal("server closing")
+		}
+		defer server.untrack(c)
+
+		// The connection claimed the export and did not enter the transmission phase yet
+		if err := server.claimExport(c, exports["disk"], 0); err != nil {
+			t.Fatal(err)
+		}
+		if closed := server.DisconnectExport("disk"); closed != 1 {
+			t.Fatalf("%d connections closed", closed)
+		}
+		if _, err := netConn.Write([]byte{0}); err == nil {
+			t.Fatal("connection not closed")
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"quorumbd.net/middleware-common/acl"
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second // TOCONFIG
+
+// tlsRequired returns true, if options other than STARTTLS must be refused on this connection
+func (c *conn) tlsRequired() bool {
+	return c.tlsCapable && c.server.options.TLSRequired && !c.tlsActive
+}
+
+// handleStartTLS upgrades the connection to TLS. Negotiation continues over TLS afterwards.
+func (c *conn) handleStartTLS(option uint32, data []byte) error {
+	if !c.tlsCapable {
+		return c.writeOptionError(option, RepErrUnsup, "TLS is not enabled on this listener")
+	}
+	if len(data) != 0 {
+		return c.writeOptionError(option, RepErrInvalid, "NBD_OPT_STARTTLS must not have data")
+	}
+	if c.tlsActive {
+		return c.writeOptionError(option, RepErrInvalid, "TLS is already negotiated")
+	}
+	if err := c.writeOptionReply(option, RepAck, nil); err != nil {
+		return err
+	}
+	if c.r.Buffered() > 0 {
+		return fmt.Errorf("client sent data before the TLS handshake")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn, err := c.tlsHandshake(ctx)
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.tlsActive = true
+	c.r = bufio.NewReader(tlsConn)
+	c.w = bufio.NewWriter(tlsConn)
+
+	// Everything negotiated in plaintext is discarded with the upgrade
+	c.structuredReplies = false
+	c.extendedHeaders = false
+	c.metaContexts = nil
+	c.metaContextExport = ""
+
+	c.logger = c.logger.With("tls_identity", c.peer.TLSIdentity)
+	return nil
+}
+
+// tlsHandshake runs the server handshake with the PSK keys, if configured, or the certificate, and sets the TLS
+// identity of the peer
+func (c *conn) tlsHandshake(ctx context.Context) (net.Conn, error) {
+	if c.server.options.PSKConfig != nil {
+		pskConn := tlspsk.Server(c.netConn, c.server.options.PSKConfig)
+		if err := pskConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		state := pskConn.ConnectionState()
+		c.peer.TLSIdentity = state.Identity
+		c.logger.Debug("TLS-PSK negotiated", "cipher_suite", tlspsk.CipherSuiteName(state.CipherSuite), "psk_identity", state.Identity)
+		return pskConn, nil
+	}
+
+	tlsConn := tls.Server(c.netConn, c.server.options.TLSConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	c.peer.TLSIdentity = acl.TLSIdentity(&state)
+	c.logger.Debug("TLS negotiated", "version", tls.VersionName(state.Version), "cipher_suite", tls.CipherSuiteName(state.CipherSuite))
+	return tlsConn, nil
+}
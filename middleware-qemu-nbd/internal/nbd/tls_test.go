@@ -0,0 +1,239 @@
+package nbd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-qemu-nbd/internal/tlspsk"
+)
+
+const testTLSIdentity = "backup.example.com"
+
+var testPSK = []byte("0123456789abcdef")
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate of a server for localhost or of a client
+func (ca *testCA) issue(t *testing.T, commonName string, server bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serverTLSConfig requires client certificates of the CA, like verify_peer
+func (ca *testCA) serverTLSConfig(t *testing.T) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "localhost", true)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func (ca *testCA) clientTLSConfig(certificates ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: certificates, MinVersion: tls.VersionTLS12}
+}
+
+func TestStartTLS(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	tests := []struct {
+		name    string
+		server  Options
+		client  ClientOptions
+		version string
+	}{
+		{
+			name:   "x509",
+			server: Options{TLSConfig: ca.serverTLSConfig(t), TLSRequired: true},
+			client: ClientOptions{TLSConfig: ca.clientTLSConfig(ca.issue(t, testTLSIdentity, false))},
+		},
+		{
+			name:   "psk",
+			server: Options{PSKConfig: &tlspsk.Config{Keys: map[string][]byte{testTLSIdentity: testPSK}}, TLSRequired: true},
+			client: ClientOptions{PSKConfig: &tlspsk.Config{Identity: testTLSIdentity, Key: testPSK}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, address := startTCPServer(t, testExports(1<<20), test.server)
+			test.client.ExportName = "disk"
+			test.client.StructuredReplies = true
+			client, err := Dial(t.Context(), "tcp", address, test.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			data := bytes.Repeat([]byte{0xa5}, 64<<10)
+			if err := client.WriteAt(t.Context(), data, 4096, 0); err != nil {
+				t.Fatal(err)
+			}
+			read := make([]byte, len(data))
+			if err := client.ReadAt(t.Context(), read, 4096); err != nil || !bytes.Equal(read, data) {
+				t.Fatalf("read after write: %v", err)
+			}
+
+			// The negotiation over TLS is kept, the TLS identity is the one of the certificate or the key
+			connections := server.Connections()
+			if len(connections) != 1 || !connections[0].TLS || !connections[0].StructuredReplies || connections[0].Peer.TLSIdentity != testTLSIdentity {
+				t.Fatalf("connections %+v", connections)
+			}
+		})
+	}
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	options := Options{TLSConfig: ca.serverTLSConfig(t), TLSRequired: true}
+	_, address := startTCPServer(t, testExports(1<<20), options)
+	c := dialRawNetwork(t, "tcp", address, FlagClientFixedNewstyle|FlagClientNoZeroes)
+
+	// Options other than STARTTLS are refused in plaintext, the negotiation continues
+	for _, ex := range []struct {
+		option uint32
+		data   []byte
+		reply  uint32
+	}{
+		{option: OptList, reply: RepErrTLSReqd},
+		{option: OptInfo, data: infoRequest("disk"), reply: RepErrTLSReqd},
+		{option: OptGo, data: infoRequest("disk"), reply: RepErrTLSReqd},
+		{option: OptStructuredReply, reply: RepErrTLSReqd},
+		{option: OptStartTLS, data: []byte{0}, reply: RepErrInvalid},
+		{option: OptStartTLS, reply: RepAck},
+	} {
+		c.sendOption(MagicOption, ex.option, ex.data)
+		if reply := c.readReply(); reply.option != ex.option || reply.replyType != ex.reply {
+			t.Fatalf("reply %d to option %d, want %d", reply.replyType, reply.option, ex.reply)
+		}
+	}
+
+	tlsConn := tls.Client(c.conn, ca.clientTLSConfig(ca.issue(t, testTLSIdentity, false)))
+	if err := tlsConn.HandshakeContext(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	c.conn = tlsConn
+	for _, ex := range []struct {
+		option  uint32
+		data    []byte
+		replies []uint32
+	}{
+		{option: OptStartTLS, replies: []uint32{RepErrInvalid}},
+		{option: OptList, replies: []uint32{RepServer, RepServer, RepAck}},
+		{option: OptGo, data: infoRequest("disk"), replies: []uint32{RepInfo, RepInfo, RepAck}},
+	} {
+		c.sendOption(MagicOption, ex.option, ex.data)
+		for _, want := range ex.replies {
+			if reply := c.readReply(); reply.option != ex.option || reply.replyType != want {
+				t.Fatalf("reply %d to option %d over TLS, want %d", reply.replyType, reply.option, want)
+			}
+		}
+	}
+}
+
+func TestStartTLSOnUnixSocket(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	path := startServer(t, testExports(1<<20), Options{TLSConfig: ca.serverTLSConfig(t), TLSRequired: true})
+	c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+
+	// The unix socket is local and always plaintext
+	c.sendOption(MagicOption, OptStartTLS, nil)
+	if reply := c.readReply(); reply.replyType != RepErrUnsup {
+		t.Fatalf("reply %d to STARTTLS on a unix socket", reply.replyType)
+	}
+	c.sendOption(MagicOption, OptList, nil)
+	if reply := c.readReply(); reply.replyType != RepServer {
+		t.Fatalf("reply %d to list on a unix socket", reply.replyType)
+	}
+}
+
+func TestStartTLSRejected(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	other := newTestCA(t, "other CA")
+	x509Server := Options{TLSConfig: ca.serverTLSConfig(t), TLSRequired: true}
+	pskServer := Options{PSKConfig: &tlspsk.Config{Keys: map[string][]byte{testTLSIdentity: testPSK}}, TLSRequired: true}
+	tests := []struct {
+		name   string
+		server Options
+		client ClientOptions
+	}{
+		{name: "client certificate of another CA", server: x509Server, client: ClientOptions{TLSConfig: ca.clientTLSConfig(other.issue(t, testTLSIdentity, false))}},
+		{name: "no client certificate", server: x509Server, client: ClientOptions{TLSConfig: ca.clientTLSConfig()}},
+		{name: "server certificate of another CA", server: x509Server, client: ClientOptions{TLSConfig: other.clientTLSConfig(ca.issue(t, testTLSIdentity, false))}},
+		{name: "unknown PSK identity", server: pskServer, client: ClientOptions{PSKConfig: &tlspsk.Config{Identity: "stranger", Key: testPSK}}},
+		{name: "wrong PSK", server: pskServer, client: ClientOptions{PSKConfig: &tlspsk.Config{Identity: testTLSIdentity, Key: []byte("wrong")}}},
+		{name: "plaintext", server: x509Server},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, address := startTCPServer(t, testExports(1<<20), test.server)
+			test.client.ExportName = "disk"
+			if client, err := Dial(t.Context(), "tcp", address, test.client); err == nil {
+				client.Close()
+				t.Fatal("connected")
+			}
+			if connections := server.Connections(); len(connections) != 0 {
+				t.Fatalf("connections %+v", connections)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/qos"
+)
+
+// request is a command of the transmission phase
+type request struct {
+	flags   uint16
+	command uint16
+	cookie  uint64
+	offset  uint64
+	length  uint64 // 32 bits without extended headers
+	data    []byte // Payload of writes
+	errno   uint32 // Set, if the request is already known to fail (e.g. discarded payload)
+	cost    int64  // Bytes acquired from the memory budget of the server
+}
+
+// transmit runs the transmission phase until the client disconnects or the connection fails.
+// Requests are processed concurrently and replied as they complete; the client matches replies by cookie.
+func (c *conn) transmit(parentCtx context.Context) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		inFlight = make(chan struct{}, c.server.options.MaxInFlight)
+		failOnce sync.Once
+		failErr  error
+	)
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failErr = err
+			cancel()
+			c.close() // Unblocks the reader
+		})
+	}
+
+	err := func() error {
+		for {
+			// The socket is not read while the connection is saturated or the memory budget is exhausted
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			req, err := c.readRequest(ctx)
+			if err != nil {
+				<-inFlight
+				return err
+			}
+
+			if req.command == CmdDisc {
+				<-inFlight
+				wg.Wait() // Outstanding requests are completed before the connection is closed
+				c.logger.Info("Client disconnected from export")
+				return nil
+			}
+
+			wg.Go(func() {
+				defer func() {
+					c.server.budget.release(req.cost)
+					<-inFlight
+				}()
+				if err := c.handleRequest(ctx, req); err != nil {
+					fail(err)
+				}
+			})
+		}
+	}()
+
+	if err != nil {
+		cancel()
+	}
+	wg.Wait()
+
+	if failErr != nil {
+		return failErr // The first reply that failed is the cause, not the closed socket
+	}
+	return err
+}
+
+func (c *conn) readRequest(ctx context.Context) (*request, error) {
+	req, err := c.readRequestHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	if req.flags&CmdFlagPayloadLen != 0 && req.command != CmdWrite && c.extendedHeaders {
+		// No other command with payload is advertised, the payload is discarded to stay in sync
+		if _, err := io.CopyN(io.Discard, c.r, int64(min(req.length, math.MaxInt64))); err != nil {
+			return nil, err
+		}
+		req.errno = ErrnoInval
+		return req, nil
+	}
+
+	switch req.command {
+	case CmdWrite:
+		if req.length > maxPayloadLength {
+			if _, err := io.CopyN(io.Discard, c.r, int64(min(req.length, math.MaxInt64))); err != nil {
+				return nil, err
+			}
+			req.errno = ErrnoOverflow
+			return req, nil
+		}
+		if err := c.acquireBudget(ctx, req); err != nil {
+			return nil, err
+		}
+		req.data = make([]byte, req.length)
+		if _, err := io.ReadFull(c.r, req.data); err != nil {
+			c.server.budget.release(req.cost)
+			return nil, err
+		}
+
+	case CmdRead:
+		if req.length <= maxPayloadLength { // Larger reads are refused without a buffer
+			if err := c.acquireBudget(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// readRequestHeader reads a classic or, if negotiated, an extended request header
+func (c *conn) readRequestHeader() (*request, error) {
+	if !c.extendedHeaders {
+		var header [28]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		if magic := be.Uint32(header[0:]); magic != MagicRequest {
+			return nil, fmt.Errorf("invalid request magic 0x%x", magic)
+		}
+		return &request{
+			flags:   be.Uint16(header[4:]),
+			command: be.Uint16(header[6:]),
+			cookie:  be.Uint64(header[8:]),
+			offset:  be.Uint64(header[16:]),
+			length:  uint64(be.Uint32(header[24:])),
+		}, nil
+	}
+
+	var header [32]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	if magic := be.Uint32(header[0:]); magic != MagicExtendedRequest {
+		return nil, fmt.Errorf("invalid extended request magic 0x%x", magic)
+	}
+	return &request{
+		flags:   be.Uint16(header[4:]),
+		command: be.Uint16(header[6:]),
+		cookie:  be.Uint64(header[8:]),
+		offset:  be.Uint64(header[16:]),
+		length:  be.Uint64(header[24:]),
+	}, nil
+}
+
+// acquireBudget acquires the memory of the payload or read buffer of a request
+func (c *conn) acquireBudget(ctx context.Context, req *request) error {
+	cost, err := c.server.budget.acquire(ctx, int64(req.length))
+	if err != nil {
+		return err
+	}
+	req.cost = cost
+	return nil
+}
+
+// handleRequest executes a request and sends its reply. Only errors of the connection are returned.
+func (c *conn) handleRequest(ctx context.Context, req *request) error {
+	if req.errno == ErrnoOverflow {
+		return c.replyError(req, req.errno, "request too large")
+	}
+	if req.errno != 0 {
+		return c.replyError(req, req.errno, "payload is not supported for this command")
+	}
+
+	var err error
+
+	size := c.export.Backend.Size()
+
+	if req.flags&CmdFlagReqOne != 0 && req.command != CmdBlockStatus {
+		return c.replyError(req, ErrnoInval, "flag is only valid for NBD_CMD_BLOCK_STATUS")
+	}
+	if req.flags&(CmdFlagNoHole|CmdFlagFastZero) != 0 && req.command != CmdWriteZeroes {
+		return c.replyError(req, ErrnoInval, "flag is only valid for NBD_CMD_WRITE_ZEROES")
+	}
+	if req.flags&CmdFlagPayloadLen != 0 && !c.extendedHeaders {
+		return c.replyError(req, ErrnoInval, "flag is only valid with extended headers")
+	}
+
+	if err := c.throttle(ctx, req); err != nil {
+		return err
+	}
+
+	switch req.command {
+	case CmdRead:
+		if req.length > maxPayloadLength {
+			return c.replyError(req, ErrnoOverflow, "request too large")
+		}
+		if backend.CheckRange(size, int64(req.offset), int64(req.length)) != nil {
+			return c.replyError(req, ErrnoInval, "request exceeds export size")
+		}
+		if err := c.replyRead(ctx, req); err != nil {
+			return err
+		}
+		c.bytesRead.Add(req.length)
+		return nil
+
+	case CmdWrite:
+		if c.export.ReadOnly {
+			return c.replyError(req, ErrnoPerm, "export is read-only")
+		}
+		if backend.CheckRange(size, int64(req.offset), int64(req.length)) != nil {
+			return c.replyError(req, ErrnoNoSpace, "request exceeds export size")
+		}
+		err = c.export.Backend.WriteAt(ctx, req.data, int64(req.offset), backendFlags(req.flags))
+
+	case CmdFlush:
+		err = c.export.Backend.Flush(ctx)
+
+	case CmdTrim, CmdWriteZeroes:
+		if c.export.ReadOnly {
+			return c.replyError(req, ErrnoPerm, "export is read-only")
+		}
+		if backend.CheckRange(size, int64(req.offset), int64(req.length)) != nil {
+			return c.replyError(req, ErrnoNoSpace, "request exceeds export size")
+		}
+		if req.command == CmdTrim {
+			err = c.export.Backend.Trim(ctx, int64(req.offset), int64(req.length), backendFlags(req.flags))
+		} else {
+			err = c.export.Backend.WriteZeroes(ctx, int64(req.offset), int64(req.length), backendFlags(req.flags))
+		}
+
+	case CmdCache:
+		prefetcher, ok := c.export.Backend.(backend.Prefetcher)
+		if !ok {
+			return c.replyError(req, ErrnoInval, "NBD_CMD_CACHE is not supported")
+		}
+		if backend.CheckRange(size, int64(req.offset), int64(req.length)) != nil {
+			return c.replyError(req, ErrnoInval, "request exceeds export size")
+		}
+		err = prefetcher.Prefetch(ctx, int64(req.offset), int64(req.length))
+
+	case CmdBlockStatus:
+		if len(c.metaContexts) == 0 {
+			return c.replyError(req, ErrnoInval, "no meta context negotiated")
+		}
+		if req.length == 0 || backend.CheckRange(size, int64(req.offset), int64(req.length)) != nil {
+			return c.replyError(req, ErrnoInval, "invalid block status range")
+		}
+		return c.replyBlockStatus(ctx, req)
+
+	default:
+		c.logger.Debug("Unsupported command", "command", req.command)
+		return c.replyError(req, ErrnoInval, fmt.Sprintf("command %d is not supported", req.command))
+	}
+
+	if err != nil {
+		return c.replyBackendError(req, err)
+	}
+	if req.command == CmdWrite {
+		c.bytesWritten.Add(req.length)
+	}
+	return c.replyDone(req)
+}
+
+// throttle waits until the limits of the export admit the request. Trim and zeroing count as writes without bytes,
+// flush and block status are not limited.
+func (c *conn) throttle(ctx context.Context, req *request) error {
+	if c.export.Limiter == nil {
+		return nil
+	}
+	switch req.command {
+	case CmdRead, CmdCache:
+		return c.export.Limiter.Wait(ctx, qos.Read, int64(min(req.length, maxPayloadLength)))
+	case CmdWrite:
+		return c.export.Limiter.Wait(ctx, qos.Write, int64(len(req.data)))
+	case CmdTrim, CmdWriteZeroes:
+		return c.export.Limiter.Wait(ctx, qos.Write, 0)
+	default:
+		return nil
+	}
+}
+
+// backendFlags maps the command flags to the flags of the block backend
+func backendFlags(flags uint16) backend.Flags {
+	var result backend.Flags
+	if flags&CmdFlagFUA != 0 {
+		result |= backend.FlagFUA
+	}
+	if flags&CmdFlagNoHole != 0 {
+		result |= backend.FlagNoHole
+	}
+	if flags&CmdFlagFastZero != 0 {
+		result |= backend.FlagFastZero
+	}
+	return result
+}
+
+// errnoOf maps the errors of the block backend (as reported by core) to NBD errors
+func errnoOf(err error) uint32 {
+	switch {
+	case errors.Is(err, backend.ErrReadOnly):
+		return ErrnoPerm
+	case errors.Is(err, backend.ErrNoSpace):
+		return ErrnoNoSpace
+	case errors.Is(err, backend.ErrInvalid), errors.Is(err, backend.ErrOutOfRange):
+		return ErrnoInval
+	case errors.Is(err, backend.ErrNotSupported):
+		return ErrnoNotSup
+	case errors.Is(err, context.Canceled):
+		return ErrnoShutdown
+	default:
+		return ErrnoIO
+	}
+}
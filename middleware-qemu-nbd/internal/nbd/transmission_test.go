@@ -0,0 +1,346 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-common/qos"
+)
+
+// sparseBackend is larger than its memory: only the first bytes hold data, zeroed ranges are reported as holes
+type sparseBackend struct {
+	*memBackend
+	size   int64
+	mu     sync.Mutex
+	zeroed []backend.Extent
+}
+
+func (b *sparseBackend) Size() int64 {
+	return b.size
+}
+
+func (b *sparseBackend) WriteZeroes(_ context.Context, off int64, length int64, _ backend.Flags) error {
+	if err := backend.CheckRange(b.size, off, length); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.zeroed = append(b.zeroed, backend.Extent{Offset: off, Length: length, Flags: backend.ExtentHole | backend.ExtentZero})
+	return nil
+}
+
+func (b *sparseBackend) Extents(_ context.Context, off int64, length int64) ([]backend.Extent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return clip(b.zeroed, off, length), nil
+}
+
+// failingBackend fails every request with err
+type failingBackend struct {
+	*memBackend
+	err error
+}
+
+func (b *failingBackend) ReadAt(context.Context, []byte, int64) error {
+	return b.err
+}
+
+func (b *failingBackend) WriteAt(context.Context, []byte, int64, backend.Flags) error {
+	return b.err
+}
+
+func (b *failingBackend) Flush(context.Context) error {
+	return b.err
+}
+
+func (b *failingBackend) Trim(context.Context, int64, int64, backend.Flags) error {
+	return b.err
+}
+
+func (b *failingBackend) WriteZeroes(context.Context, int64, int64, backend.Flags) error {
+	return b.err
+}
+
+// chunk is a structured reply chunk with an extended header
+type chunk struct {
+	flags     uint16
+	replyType uint16
+	cookie    uint64
+	offset    uint64
+	payload   []byte
+}
+
+// dialExtended negotiates extended headers and base:allocation and enters the transmission phase of the export
+func dialExtended(t *testing.T, path string, name string) *rawClient {
+	t.Helper()
+	c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+	for _, ex := range []struct {
+		option  uint32
+		data    []byte
+		replies []uint32
+	}{
+		{option: OptExtendedHeaders, replies: []uint32{RepAck}},
+		{option: OptSetMetaContext, data: metaContextRequest(name, MetaContextBaseAllocation), replies: []uint32{RepMetaContext, RepAck}},
+		{option: OptGo, data: infoRequest(name), replies: []uint32{RepInfo, RepInfo, RepAck}},
+	} {
+		c.sendOption(MagicOption, ex.option, ex.data)
+		for _, want := range ex.replies {
+			if reply := c.readReply(); reply.replyType != want {
+				t.Fatalf("reply %d to option %d, want %d", reply.replyType, ex.option, want)
+			}
+		}
+	}
+	return c
+}
+
+func (c *rawClient) sendExtendedRequest(flags uint16, command uint16, cookie uint64, offset uint64, length uint64, payload []byte) {
+	c.t.Helper()
+	header := be.AppendUint32(nil, MagicExtendedRequest)
+	header = be.AppendUint16(header, flags)
+	header = be.AppendUint16(header, command)
+	header = be.AppendUint64(header, cookie)
+	header = be.AppendUint64(header, offset)
+	header = be.AppendUint64(header, length)
+	c.write(append(header, payload...))
+}
+
+func (c *rawClient) readChunk() chunk {
+	c.t.Helper()
+	var header [32]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		c.t.Fatalf("reading reply chunk: %v", err)
+	}
+	if magic := be.Uint32(header[0:]); magic != MagicExtendedReply {
+		c.t.Fatalf("invalid extended reply magic 0x%x", magic)
+	}
+	ch := chunk{flags: be.Uint16(header[4:]), replyType: be.Uint16(header[6:]), cookie: be.Uint64(header[8:]), offset: be.Uint64(header[16:])}
+	ch.payload = make([]byte, be.Uint64(header[24:]))
+	if _, err := io.ReadFull(c.conn, ch.payload); err != nil {
+		c.t.Fatalf("reading reply chunk payload: %v", err)
+	}
+	return ch
+}
+
+func TestThrottle(t *testing.T) {
+	exports := testExports(1 << 20)
+	limiter := qos.NewLimiter(qos.Limits{ReadIOPS: 1000, WriteIOPS: 10})
+	exports["disk"].Limiter = limiter
+	path := startServer(t, exports, Options{})
+	client := dialClient(t, path, ClientOptions{ExportName: "disk", StructuredReplies: true})
+	ctx := t.Context()
+
+	// Reads and caches count their length, writes their payload, trims and zeroes one request without bytes
+	if err := client.ReadAt(ctx, make([]byte, 8192), 0); err != nil {
+		t.Fatal(err)
+	}
+	// The memory backend does not prefetch, the cache request is admitted before it fails
+	if err := client.Cache(ctx, 0, 4096); err == nil {
+		t.Fatal("cache without a prefetcher succeeded")
+	}
+	if err := client.WriteAt(ctx, make([]byte, 4096), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Trim(ctx, 0, 4096, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteZeroes(ctx, 0, 4096, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats := limiter.Stats()
+	if stats.Read.Requests != 2 || stats.Read.Bytes != 8192+4096 || stats.Write.Requests != 3 || stats.Write.Bytes != 4096 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if stats.Read.Throttled != 0 || stats.Write.Throttled != 0 {
+		t.Fatalf("requests within the burst throttled: %+v", stats)
+	}
+
+	// The write bucket holds 10 requests, the next ones wait for tokens
+	start := time.Now()
+	for range 9 {
+		if err := client.WriteAt(ctx, make([]byte, 4096), 4096, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("writes over the limit took %v", elapsed)
+	}
+	if stats := limiter.Stats(); stats.Write.Requests != 12 || stats.Write.Throttled != 2 || stats.Read.Throttled != 0 {
+		t.Fatalf("stats after the burst %+v", stats)
+	}
+}
+
+func TestExtendedHeaders(t *testing.T) {
+	const size = 8 << 30
+	sparse := &sparseBackend{memBackend: newMemBackend(64 << 10), size: size}
+	path := startServer(t, exportSource{"big": {Name: "big", BlockSize: 4096, Backend: sparse}}, Options{})
+	c := dialExtended(t, path, "big")
+
+	// Write and read back a block, the replies repeat the offset of the request
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	c.sendExtendedRequest(CmdFlagPayloadLen, CmdWrite, 1, 4096, uint64(len(data)), data)
+	if ch := c.readChunk(); ch.cookie != 1 || ch.offset != 4096 || ch.replyType != ReplyTypeNone || ch.flags != ReplyFlagDone {
+		t.Fatalf("write reply %+v", ch)
+	}
+	c.sendExtendedRequest(0, CmdRead, 2, 4096, 4096, nil)
+	if ch := c.readChunk(); ch.cookie != 2 || ch.replyType != ReplyTypeOffsetData || be.Uint64(ch.payload) != 4096 || !bytes.Equal(ch.payload[8:], data) {
+		t.Fatalf("read reply %+v", ch)
+	}
+
+	// Zeroing takes a 64-bit length, reads of more than the maximum payload are refused
+	c.sendExtendedRequest(0, CmdWriteZeroes, 3, 0, 5<<30, nil)
+	if ch := c.readChunk(); ch.cookie != 3 || ch.replyType != ReplyTypeNone {
+		t.Fatalf("write zeroes reply %+v", ch)
+	}
+	if sparse.zeroed[0].Length != 5<<30 {
+		t.Fatalf("zeroed %+v", sparse.zeroed)
+	}
+	c.sendExtendedRequest(0, CmdRead, 4, 0, 5<<30, nil)
+	if ch := c.readChunk(); ch.cookie != 4 || ch.replyType != ReplyTypeError || be.Uint32(ch.payload) != ErrnoOverflow {
+		t.Fatalf("read reply %+v", ch)
+	}
+
+	// Block status of more than 4 GiB returns extended extents with 64-bit lengths
+	c.sendExtendedRequest(0, CmdBlockStatus, 5, 0, 6<<30, nil)
+	ch := c.readChunk()
+	if ch.cookie != 5 || ch.replyType != ReplyTypeBlockStatusExt || ch.flags != ReplyFlagDone || len(ch.payload) != 8+2*16 {
+		t.Fatalf("block status reply %+v", ch)
+	}
+	if id, count := be.Uint32(ch.payload[0:]), be.Uint32(ch.payload[4:]); id == 0 || count != 2 {
+		t.Fatalf("block status of context %d with %d extents", id, count)
+	}
+	extents := [][2]uint64{{be.Uint64(ch.payload[8:]), be.Uint64(ch.payload[16:])}, {be.Uint64(ch.payload[24:]), be.Uint64(ch.payload[32:])}}
+	if want := [][2]uint64{{5 << 30, uint64(StateHole | StateZero)}, {1 << 30, 0}}; extents[0] != want[0] || extents[1] != want[1] {
+		t.Fatalf("extents %v, want %v", extents, want)
+	}
+}
+
+func TestRequestHeaderMismatch(t *testing.T) {
+	path := startServer(t, testExports(1<<20), Options{})
+
+	compact := be.AppendUint32(nil, MagicRequest)
+	compact = be.AppendUint16(compact, 0)
+	compact = be.AppendUint16(compact, CmdFlush)
+	compact = be.AppendUint64(compact, 1)
+	compact = be.AppendUint64(compact, 0)
+	compact = be.AppendUint32(compact, 0)
+
+	t.Run("compact after extended", func(t *testing.T) {
+		c := dialExtended(t, path, "disk")
+		// The server reads a 32 byte header, the compact header is followed by the start of the next one
+		c.write(append(compact, compact[:4]...))
+		if !c.closed() {
+			t.Fatal("compact request header accepted after extended headers were negotiated")
+		}
+	})
+
+	t.Run("extended without negotiation", func(t *testing.T) {
+		c := dialRaw(t, path, FlagClientFixedNewstyle|FlagClientNoZeroes)
+		c.sendOption(MagicOption, OptGo, infoRequest("disk"))
+		for _, want := range []uint32{RepInfo, RepInfo, RepAck} {
+			if reply := c.readReply(); reply.replyType != want {
+				t.Fatalf("reply %d, want %d", reply.replyType, want)
+			}
+		}
+		c.sendExtendedRequest(0, CmdFlush, 1, 0, 0, nil)
+		if !c.closed() {
+			t.Fatal("extended request header accepted without negotiation")
+		}
+	})
+}
+
+func TestBackendErrors(t *testing.T) {
+	tests := []struct {
+		err   error
+		errno uint32
+	}{
+		{err: backend.ErrIO, errno: ErrnoIO},
+		{err: errors.New("unexpected"), errno: ErrnoIO},
+		{err: fmt.Errorf("writing block: %w", backend.ErrNoSpace), errno: ErrnoNoSpace},
+		{err: backend.ErrReadOnly, errno: ErrnoPerm},
+		{err: backend.ErrInvalid, errno: ErrnoInval},
+		{err: backend.ErrOutOfRange, errno: ErrnoInval},
+		{err: backend.ErrNotSupported, errno: ErrnoNotSup},
+		{err: context.Canceled, errno: ErrnoShutdown},
+	}
+	requests := []struct {
+		name string
+		do   func(ctx context.Context, client *Client) error
+	}{
+		{name: "read", do: func(ctx context.Context, client *Client) error { return client.ReadAt(ctx, make([]byte, 4096), 0) }},
+		{name: "write", do: func(ctx context.Context, client *Client) error { return client.WriteAt(ctx, make([]byte, 4096), 0, 0) }},
+		{name: "flush", do: func(ctx context.Context, client *Client) error { return client.Flush(ctx) }},
+		{name: "trim", do: func(ctx context.Context, client *Client) error { return client.Trim(ctx, 0, 4096, 0) }},
+		{name: "write zeroes", do: func(ctx context.Context, client *Client) error {
+			return client.WriteZeroes(ctx, 0, 4096, CmdFlagNoHole)
+		}},
+	}
+	for _, structured := range []bool{false, true} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s/%v", map[bool]string{false: "simple", true: "structured"}[structured], test.err), func(t *testing.T) {
+				exports := exportSource{"disk": {Name: "disk", BlockSize: 4096, Backend: &failingBackend{memBackend: newMemBackend(1 << 20), err: test.err}}}
+				path := startServer(t, exports, Options{})
+				client := dialClient(t, path, ClientOptions{ExportName: "disk", StructuredReplies: structured})
+				for _, request := range requests {
+					requestErr, ok := errors.AsType[*RequestError](request.do(t.Context(), client))
+					if !ok || requestErr.Errno != test.errno {
+						t.Fatalf("%s: error %v, want errno %d", request.name, requestErr, test.errno)
+					}
+					if structured && requestErr.Message == "" {
+						t.Fatalf("%s: structured error reply without message", request.name)
+					}
+				}
+			})
+		}
+	}
+}
+
+// slowZeroBackend cannot zero without writing the data
+type slowZeroBackend struct {
+	*memBackend
+}
+
+func (b *slowZeroBackend) WriteZeroes(ctx context.Context, off int64, length int64, flags backend.Flags) error {
+	if flags&backend.FlagFastZero != 0 {
+		return backend.ErrNotSupported
+	}
+	return b.memBackend.WriteZeroes(ctx, off, length, flags)
+}
+
+func TestFastZero(t *testing.T) {
+	exports := testExports(1 << 20)
+	exports["slow"] = &Export{Name: "slow", BlockSize: 4096, Backend: &slowZeroBackend{memBackend: newMemBackend(1 << 20)}}
+	path := startServer(t, exports, Options{})
+	ctx := t.Context()
+
+	fast := dialClient(t, path, ClientOptions{ExportName: "disk", StructuredReplies: true})
+	if fast.Flags()&FlagSendFastZero == 0 {
+		t.Fatal("NBD_FLAG_SEND_FAST_ZERO not advertised")
+	}
+	if err := fast.WriteZeroes(ctx, 0, 4096, CmdFlagFastZero); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backend that would have to write the zeroes refuses fast zeroing with ENOTSUP, zeroing without the flag works
+	slow := dialClient(t, path, ClientOptions{ExportName: "slow", StructuredReplies: true})
+	if requestErr, ok := errors.AsType[*RequestError](slow.WriteZeroes(ctx, 0, 4096, CmdFlagFastZero)); !ok || requestErr.Errno != ErrnoNotSup {
+		t.Fatalf("fast zero: error %v, want errno %d", requestErr, ErrnoNotSup)
+	}
+	if err := slow.WriteZeroes(ctx, 0, 4096, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flag is only valid for NBD_CMD_WRITE_ZEROES
+	if requestErr, ok := errors.AsType[*RequestError](fast.Trim(ctx, 0, 4096, CmdFlagFastZero)); !ok || requestErr.Errno != ErrnoInval {
+		t.Fatalf("trim with fast zero: error %v, want errno %d", requestErr, ErrnoInval)
+	}
+}
@@ -0,0 +1,181 @@
+package tlspsk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"math/big"
+)
+
+// Cipher suites of RFC 5487, in the order of preference of the server
+const (
+	suiteDHEPSKWithAES256GCMSHA384 uint16 = 0x00ab
+	suiteDHEPSKWithAES128GCMSHA256 uint16 = 0x00aa
+	suitePSKWithAES256GCMSHA384    uint16 = 0x00a9
+	suitePSKWithAES128GCMSHA256    uint16 = 0x00a8
+)
+
+type cipherSuite struct {
+	id      uint16
+	name    string
+	dhe     bool // Ephemeral Diffie-Hellman, the key exchange is forward secret
+	keyLen  int
+	newHash func() hash.Hash // Of the PRF and the transcript
+}
+
+var cipherSuites = []*cipherSuite{
+	{id: suiteDHEPSKWithAES256GCMSHA384, name: "TLS_DHE_PSK_WITH_AES_256_GCM_SHA384", dhe: true, keyLen: 32, newHash: sha512.New384},
+	{id: suiteDHEPSKWithAES128GCMSHA256, name: "TLS_DHE_PSK_WITH_AES_128_GCM_SHA256", dhe: true, keyLen: 16, newHash: sha256.New},
+	{id: suitePSKWithAES256GCMSHA384, name: "TLS_PSK_WITH_AES_256_GCM_SHA384", keyLen: 32, newHash: sha512.New384},
+	{id: suitePSKWithAES128GCMSHA256, name: "TLS_PSK_WITH_AES_128_GCM_SHA256", keyLen: 16, newHash: sha256.New},
+}
+
+func cipherSuiteByID(id uint16) *cipherSuite {
+	for _, suite := range cipherSuites {
+		if suite.id == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+const (
+	gcmSaltLen     = 4 // Implicit part of the nonce from the key block
+	gcmExplicitLen = 8 // Explicit part of the nonce in every record (the sequence number)
+	gcmTagLen      = 16
+	masterLen      = 48
+	verifyDataLen  = 12
+	dhExponentBits = 256  // Twice the security level of ffdhe2048 (RFC 7919, section 5.2)
+	minDHPrimeBits = 2048 // Of the group of a server
+	maxDHPrimeBits = 8192
+)
+
+// ffdhe2048 is the group 0x0100 of RFC 7919, its generator is 2
+var ffdhe2048, _ = new(big.Int).SetString(""+
+	"FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695"+
+	"A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8F681B202AEC4617A"+
+	"D3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935"+
+	"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE73530ACCA4F483A797A"+
+	"BC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4"+
+	"AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61"+
+	"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005"+
+	"C58EF1837D1683B2C6F34A26C1B2EFFA886B423861285C97FFFFFFFFFFFFFFFF", 16)
+
+var ffdhe2048Group = dhGroup{prime: ffdhe2048, generator: big.NewInt(2)}
+
+// prf is the pseudorandom function of TLS 1.2 (RFC 5246, section 5) with the hash of the cipher suite
+func prf(newHash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(newHash, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+	out := make([]byte, 0, length+mac.Size())
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
+
+// pskPremaster returns the premaster secret of RFC 4279 from the other secret (zeroes of the key length for PSK, the
+// Diffie-Hellman secret for DHE_PSK) and the key
+func pskPremaster(other []byte, key []byte) []byte {
+	premaster := make([]byte, 0, 4+len(other)+len(key))
+	premaster = binary.BigEndian.AppendUint16(premaster, uint16(len(other)))
+	premaster = append(premaster, other...)
+	premaster = binary.BigEndian.AppendUint16(premaster, uint16(len(key)))
+	return append(premaster, key...)
+}
+
+// dhGroup is a finite field Diffie-Hellman group
+type dhGroup struct {
+	prime     *big.Int
+	generator *big.Int
+}
+
+// inRange returns true, if 1 < x < p-1, the valid range of generators and public values (RFC 7919, section 5.1)
+func (group dhGroup) inRange(x *big.Int) bool {
+	return x.Cmp(big.NewInt(1)) > 0 && x.Cmp(new(big.Int).Sub(group.prime, big.NewInt(1))) < 0
+}
+
+// keyPair returns a private exponent and the public value
+func (group dhGroup) keyPair() (*big.Int, *big.Int, error) {
+	private, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), dhExponentBits))
+	if err != nil {
+		return nil, nil, err
+	}
+	private.Add(private, big.NewInt(2))
+	return private, new(big.Int).Exp(group.generator, private, group.prime), nil
+}
+
+// secret returns the shared secret with the public value of the peer, leading zero bytes stripped (RFC 5246, section
+// 8.1.2)
+func (group dhGroup) secret(private *big.Int, peerPublic []byte) ([]byte, bool) {
+	public := new(big.Int).SetBytes(peerPublic)
+	if !group.inRange(public) {
+		return nil, false
+	}
+	return new(big.Int).Exp(public, private, group.prime).Bytes(), true
+}
+
+// halfConn is one direction of the record protection with AES-GCM (RFC 5288)
+type halfConn struct {
+	aead cipher.AEAD // nil before ChangeCipherSpec
+	salt [gcmSaltLen]byte
+	seq  uint64
+}
+
+func newHalfConn(key []byte, salt []byte) (*halfConn, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hc := &halfConn{aead: aead}
+	copy(hc.salt[:], salt)
+	return hc, nil
+}
+
+// additionalData returns the additional data of a record: sequence number, header with the length of the plaintext
+func (hc *halfConn) additionalData(recordType uint8, length int) []byte {
+	ad := binary.BigEndian.AppendUint64(make([]byte, 0, 13), hc.seq)
+	ad = append(ad, recordType, versionTLS12>>8, versionTLS12&0xff)
+	return binary.BigEndian.AppendUint16(ad, uint16(length))
+}
+
+// seal appends the explicit nonce and the encrypted fragment to out
+func (hc *halfConn) seal(out []byte, recordType uint8, fragment []byte) []byte {
+	nonce := binary.BigEndian.AppendUint64(hc.salt[:gcmSaltLen:gcmSaltLen], hc.seq)
+	out = append(out, nonce[gcmSaltLen:]...)
+	out = hc.aead.Seal(out, nonce, fragment, hc.additionalData(recordType, len(fragment)))
+	hc.seq++
+	return out
+}
+
+// open decrypts the payload of a record in place
+func (hc *halfConn) open(recordType uint8, payload []byte) ([]byte, bool) {
+	if len(payload) < gcmExplicitLen+gcmTagLen {
+		return nil, false
+	}
+	nonce := append(hc.salt[:gcmSaltLen:gcmSaltLen], payload[:gcmExplicitLen]...)
+	ciphertext := payload[gcmExplicitLen:]
+	fragment, err := hc.aead.Open(ciphertext[:0], nonce, ciphertext, hc.additionalData(recordType, len(ciphertext)-gcmTagLen))
+	if err != nil {
+		return nil, false
+	}
+	hc.seq++
+	return fragment, true
+}
@@ -0,0 +1,404 @@
+package tlspsk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	versionTLS12 = 0x0303
+
+	recordChangeCipherSpec uint8 = 20
+	recordAlert            uint8 = 21
+	recordHandshake        uint8 = 22
+	recordApplicationData  uint8 = 23
+
+	recordHeaderLen    = 5
+	maxPlaintext       = 1 << 14
+	maxCiphertext      = maxPlaintext + 2048
+	maxEmptyRecords    = 16 // Consecutive empty records before the peer is considered hostile
+	maxHandshakeLen    = 1 << 16
+	maxIdentityLength  = 1<<16 - 1
+	maxKeyLength       = 1<<16 - 1
+	closeNotifyTimeout = 5 * time.Second // TOCONFIG
+)
+
+// Alert descriptions (RFC 5246, section 7.2 and RFC 4279, section 6)
+const (
+	alertCloseNotify          uint8 = 0
+	alertUnexpectedMessage    uint8 = 10
+	alertBadRecordMAC         uint8 = 20
+	alertRecordOverflow       uint8 = 22
+	alertHandshakeFailure     uint8 = 40
+	alertIllegalParameter     uint8 = 47
+	alertDecodeError          uint8 = 50
+	alertDecryptError         uint8 = 51
+	alertProtocolVersion      uint8 = 70
+	alertInsufficientSecurity uint8 = 71
+	alertInternalError        uint8 = 80
+	alertUnsupportedExt       uint8 = 110
+	alertUnknownPSKIdentity   uint8 = 115
+)
+
+// AlertError is a fatal alert, sent to the peer (Remote false) or received from it
+type AlertError struct {
+	Description uint8
+	Remote      bool
+}
+
+func (e *AlertError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("tls-psk: remote error: alert %d", e.Description)
+	}
+	return fmt.Sprintf("tls-psk: local error: alert %d", e.Description)
+}
+
+// Conn is a TLS-PSK connection. It is safe for one concurrent reader and one concurrent writer, like a net.Conn.
+type Conn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	config   *Config
+	isClient bool
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	handshaked   bool
+	state        ConnectionState
+
+	inMu      sync.Mutex
+	in        *halfConn // nil before ChangeCipherSpec of the peer
+	handshake []byte    // Handshake bytes received and not consumed yet
+	input     []byte    // Application data received and not read yet
+	readErr   error
+
+	outMu           sync.Mutex
+	out             *halfConn // nil before ChangeCipherSpec
+	writeErr        error
+	closeNotifySent bool
+}
+
+// Server returns a TLS-PSK connection of a server over conn, the handshake runs with the first Read or Write
+func Server(conn net.Conn, config *Config) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn), config: config}
+}
+
+// Client returns a TLS-PSK connection of a client over conn, the handshake runs with the first Read or Write
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn), config: config, isClient: true}
+}
+
+// HandshakeContext runs the handshake, unless it already ran. ctx bounds the handshake, not the connection.
+func (c *Conn) HandshakeContext(ctx context.Context) (err error) {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshaked || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		interrupted := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.conn.SetDeadline(time.Unix(1, 0)) // Unblocks reads and writes of the handshake
+				close(interrupted)
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			select {
+			case <-interrupted:
+				c.conn.SetDeadline(time.Time{})
+				if err != nil {
+					err = ctx.Err()
+					c.handshakeErr = err
+				}
+			default:
+			}
+		}()
+	}
+
+	if c.isClient {
+		err = c.clientHandshake()
+	} else {
+		err = c.serverHandshake()
+	}
+	c.handshakeErr = err
+	c.handshaked = err == nil
+	return err
+}
+
+// Handshake runs the handshake without time limit
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// ConnectionState returns the negotiated parameters (zero before the handshake completed)
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	return c.state
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	for empty := 0; len(c.input) == 0; {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		recordType, fragment, err := c.readRecord()
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+		switch recordType {
+		case recordApplicationData:
+			if len(fragment) == 0 {
+				if empty++; empty > maxEmptyRecords {
+					c.readErr = c.fail(alertUnexpectedMessage, "too many empty records")
+				}
+				continue
+			}
+			c.input = fragment
+		case recordHandshake:
+			c.readErr = c.fail(alertUnexpectedMessage, "renegotiation is not supported")
+		default:
+			c.readErr = c.fail(alertUnexpectedMessage, fmt.Sprintf("unexpected record type %d", recordType))
+		}
+	}
+	n := copy(p, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.closeNotifySent {
+		return 0, net.ErrClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		fragment := p[:min(len(p), maxPlaintext)]
+		if err := c.writeRecordLocked(recordApplicationData, fragment); err != nil {
+			return n, err
+		}
+		n += len(fragment)
+		p = p[len(fragment):]
+	}
+	return n, nil
+}
+
+// Close sends close_notify, if the handshake completed, and closes the connection
+func (c *Conn) Close() error {
+	c.handshakeMu.Lock()
+	handshaked := c.handshaked
+	c.handshakeMu.Unlock()
+	if handshaked {
+		c.outMu.Lock()
+		if !c.closeNotifySent && c.writeErr == nil {
+			c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+			c.writeAlertLocked(1, alertCloseNotify)
+			c.closeNotifySent = true
+		}
+		c.outMu.Unlock()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// NetConn returns the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// readRecord reads and decrypts the next record. Alerts are handled: close_notify returns io.EOF, fatal alerts an
+// AlertError, warnings are skipped.
+func (c *Conn) readRecord() (uint8, []byte, error) {
+	for {
+		var header [recordHeaderLen]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
+		recordType, version, length := header[0], binary.BigEndian.Uint16(header[1:]), int(binary.BigEndian.Uint16(header[3:]))
+		if version>>8 != 3 {
+			return 0, nil, c.fail(alertProtocolVersion, fmt.Sprintf("record version 0x%04x", version))
+		}
+		if length > maxCiphertext || (c.in == nil && length > maxPlaintext) {
+			return 0, nil, c.fail(alertRecordOverflow, fmt.Sprintf("record of %d bytes", length))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
+
+		fragment := payload
+		if c.in != nil {
+			var ok bool
+			if fragment, ok = c.in.open(recordType, payload); !ok {
+				return 0, nil, c.fail(alertBadRecordMAC, "record decryption failed")
+			}
+			if len(fragment) > maxPlaintext {
+				return 0, nil, c.fail(alertRecordOverflow, fmt.Sprintf("record of %d plaintext bytes", len(fragment)))
+			}
+		}
+
+		if recordType != recordAlert {
+			return recordType, fragment, nil
+		}
+		if len(fragment) != 2 {
+			return 0, nil, c.fail(alertDecodeError, "malformed alert")
+		}
+		switch level, description := fragment[0], fragment[1]; {
+		case description == alertCloseNotify:
+			return 0, nil, io.EOF
+		case level == 2:
+			return 0, nil, &AlertError{Description: description, Remote: true}
+		}
+	}
+}
+
+// writeRecord encrypts and writes a record, the caller must split fragments larger than maxPlaintext
+func (c *Conn) writeRecord(recordType uint8, fragment []byte) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return c.writeRecordLocked(recordType, fragment)
+}
+
+func (c *Conn) writeRecordLocked(recordType uint8, fragment []byte) error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	record := make([]byte, recordHeaderLen, recordHeaderLen+gcmExplicitLen+len(fragment)+gcmTagLen)
+	record[0] = recordType
+	binary.BigEndian.PutUint16(record[1:], versionTLS12)
+	if c.out != nil {
+		record = c.out.seal(record, recordType, fragment)
+	} else {
+		record = append(record, fragment...)
+	}
+	binary.BigEndian.PutUint16(record[3:], uint16(len(record)-recordHeaderLen))
+	if _, err := c.conn.Write(record); err != nil {
+		c.writeErr = err
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) writeAlertLocked(level uint8, description uint8) error {
+	return c.writeRecordLocked(recordAlert, []byte{level, description})
+}
+
+// fail sends a fatal alert and returns the error of the connection
+func (c *Conn) fail(description uint8, reason string) error {
+	c.outMu.Lock()
+	c.writeAlertLocked(2, description)
+	c.writeErr = net.ErrClosed
+	c.outMu.Unlock()
+	return fmt.Errorf("%w: %s", &AlertError{Description: description}, reason)
+}
+
+// readHandshake returns the next handshake message with its header, it must have one of the given types
+func (c *Conn) readHandshake(msgTypes ...uint8) ([]byte, error) {
+	for {
+		if len(c.handshake) >= 4 {
+			length := int(c.handshake[1])<<16 | int(c.handshake[2])<<8 | int(c.handshake[3])
+			if length > maxHandshakeLen {
+				return nil, c.fail(alertDecodeError, fmt.Sprintf("handshake message of %d bytes", length))
+			}
+			if len(c.handshake) >= 4+length {
+				msg := c.handshake[: 4+length : 4+length]
+				c.handshake = c.handshake[4+length:]
+				if !slices.Contains(msgTypes, msg[0]) {
+					return nil, c.fail(alertUnexpectedMessage, fmt.Sprintf("handshake message %d, want %v", msg[0], msgTypes))
+				}
+				return msg, nil
+			}
+		}
+		recordType, fragment, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if recordType != recordHandshake {
+			return nil, c.fail(alertUnexpectedMessage, fmt.Sprintf("record type %d during the handshake", recordType))
+		}
+		if len(fragment) == 0 {
+			return nil, c.fail(alertUnexpectedMessage, "empty handshake record")
+		}
+		c.handshake = append(c.handshake, fragment...)
+	}
+}
+
+// readChangeCipherSpec reads ChangeCipherSpec and protects the following records of the peer with in
+func (c *Conn) readChangeCipherSpec(in *halfConn) error {
+	if len(c.handshake) > 0 {
+		return c.fail(alertUnexpectedMessage, "ChangeCipherSpec within a handshake message")
+	}
+	recordType, fragment, err := c.readRecord()
+	if err != nil {
+		return err
+	}
+	if recordType != recordChangeCipherSpec || len(fragment) != 1 || fragment[0] != 1 {
+		return c.fail(alertUnexpectedMessage, fmt.Sprintf("record type %d instead of ChangeCipherSpec", recordType))
+	}
+	c.in = in
+	return nil
+}
+
+// writeChangeCipherSpec writes ChangeCipherSpec and protects the following records with out
+func (c *Conn) writeChangeCipherSpec(out *halfConn) error {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if err := c.writeRecordLocked(recordChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+	c.out = out
+	return nil
+}
+
+// writeHandshake writes handshake messages, split into records
+func (c *Conn) writeHandshake(msgs ...[]byte) error {
+	var flight []byte
+	for _, msg := range msgs {
+		flight = append(flight, msg...)
+	}
+	for len(flight) > 0 {
+		fragment := flight[:min(len(flight), maxPlaintext)]
+		if err := c.writeRecord(recordHandshake, fragment); err != nil {
+			return err
+		}
+		flight = flight[len(fragment):]
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+package tlspsk
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// Handshake message types (RFC 5246, section 7.4)
+const (
+	handshakeClientHello       uint8 = 1
+	handshakeServerHello       uint8 = 2
+	handshakeServerKeyExchange uint8 = 12
+	handshakeServerHelloDone   uint8 = 14
+	handshakeClientKeyExchange uint8 = 16
+	handshakeFinished          uint8 = 20
+)
+
+// Extensions and signalling values
+const (
+	extensionSupportedGroups      uint16 = 0x000a
+	extensionExtendedMasterSecret uint16 = 0x0017
+	extensionRenegotiationInfo    uint16 = 0xff01
+
+	suiteEmptyRenegotiationInfoSCSV uint16 = 0x00ff
+
+	groupFFDHE2048 uint16 = 0x0100
+)
+
+const randomLen = 32
+
+// clientHello is the part of a ClientHello the server uses
+type clientHello struct {
+	version              uint16
+	random               []byte
+	cipherSuites         []uint16
+	compressionMethods   []byte
+	groups               []uint16 // nil without supported_groups
+	extendedMasterSecret bool
+	secureRenegotiation  bool
+}
+
+// handshakeMessage returns a handshake message with its header
+func handshakeMessage(msgType uint8, body []byte) []byte {
+	msg := []byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+func appendVector8(b []byte, v []byte) []byte {
+	return append(append(b, byte(len(v))), v...)
+}
+
+func appendVector16(b []byte, v []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(v))), v...)
+}
+
+func appendExtension(b []byte, extension uint16, data []byte) []byte {
+	return appendVector16(binary.BigEndian.AppendUint16(b, extension), data)
+}
+
+// parser reads a handshake message, a read past the end clears ok
+type parser struct {
+	data []byte
+	ok   bool
+}
+
+func newParser(data []byte) *parser {
+	return &parser{data: data, ok: true}
+}
+
+func (p *parser) bytes(n int) []byte {
+	if !p.ok || len(p.data) < n {
+		p.ok = false
+		return nil
+	}
+	b := p.data[:n:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *parser) uint8() uint8 {
+	if b := p.bytes(1); p.ok {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) uint16() uint16 {
+	if b := p.bytes(2); p.ok {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *parser) vector8() []byte {
+	return p.bytes(int(p.uint8()))
+}
+
+func (p *parser) vector16() []byte {
+	return p.bytes(int(p.uint16()))
+}
+
+// done returns true, if the message was read completely and without error
+func (p *parser) done() bool {
+	return p.ok && len(p.data) == 0
+}
+
+// extensions calls fn with every extension of the remaining message, which may have none. Duplicate extensions are an
+// error (RFC 5246, section 7.4.1.4).
+func (p *parser) extensions(fn func(extension uint16, data []byte) bool) bool {
+	if p.done() {
+		return true
+	}
+	list := newParser(p.vector16())
+	if !p.done() {
+		return false
+	}
+	var seen []uint16
+	for list.ok && len(list.data) > 0 {
+		extension, data := list.uint16(), list.vector16()
+		if !list.ok || slices.Contains(seen, extension) || !fn(extension, data) {
+			return false
+		}
+		seen = append(seen, extension)
+	}
+	return list.ok
+}
+
+func parseClientHello(body []byte) (*clientHello, bool) {
+	p := newParser(body)
+	hello := &clientHello{version: p.uint16(), random: p.bytes(randomLen)}
+	if sessionID := p.vector8(); len(sessionID) > 32 {
+		return nil, false
+	}
+	suites := newParser(p.vector16())
+	for suites.ok && len(suites.data) > 0 {
+		hello.cipherSuites = append(hello.cipherSuites, suites.uint16())
+	}
+	hello.compressionMethods = p.vector8()
+	if !p.ok || !suites.ok || len(hello.cipherSuites) == 0 || len(hello.compressionMethods) == 0 {
+		return nil, false
+	}
+	ok := p.extensions(func(extension uint16, data []byte) bool {
+		switch extension {
+		case extensionSupportedGroups:
+			groups := newParser(data)
+			list := newParser(groups.vector16())
+			hello.groups = []uint16{}
+			for list.ok && len(list.data) > 0 {
+				hello.groups = append(hello.groups, list.uint16())
+			}
+			return groups.done() && list.ok
+		case extensionExtendedMasterSecret:
+			hello.extendedMasterSecret = true
+			return len(data) == 0
+		case extensionRenegotiationInfo:
+			hello.secureRenegotiation = true
+			return len(data) == 1 && data[0] == 0 // Initial handshake: empty renegotiated_connection
+		}
+		return true
+	})
+	if slices.Contains(hello.cipherSuites, suiteEmptyRenegotiationInfoSCSV) {
+		hello.secureRenegotiation = true
+	}
+	return hello, ok
+}
+
+// selectSuite returns the most preferred cipher suite of the server the client offers. DHE_PSK is skipped, if the
+// client lists finite field groups without ffdhe2048 (RFC 7919, section 4).
+func selectSuite(hello *clientHello, enabled []*cipherSuite) *cipherSuite {
+	ffdhe := true
+	if slices.ContainsFunc(hello.groups, func(group uint16) bool { return group>>8 == 0x01 }) {
+		ffdhe = slices.Contains(hello.groups, groupFFDHE2048)
+	}
+	for _, suite := range enabled {
+		if slices.Contains(hello.cipherSuites, suite.id) && (ffdhe || !suite.dhe) {
+			return suite
+		}
+	}
+	return nil
+}
+
+// transcriptHash returns the hash of the handshake messages so far with the hash of the cipher suite
+func transcriptHash(suite *cipherSuite, transcript []byte) []byte {
+	h := suite.newHash()
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// deriveKeys derives the master secret (RFC 5246 section 8.1, RFC 7627 section 4) and the record protection of both
+// directions (RFC 5246 section 6.3)
+func deriveKeys(suite *cipherSuite, premaster, clientRandom, serverRandom []byte, ems bool, transcript []byte) (master []byte, client, server *halfConn, err error) {
+	if ems {
+		master = prf(suite.newHash, premaster, "extended master secret", transcriptHash(suite, transcript), masterLen)
+	} else {
+		master = prf(suite.newHash, premaster, "master secret", slices.Concat(clientRandom, serverRandom), masterLen)
+	}
+	block := prf(suite.newHash, master, "key expansion", slices.Concat(serverRandom, clientRandom), 2*suite.keyLen+2*gcmSaltLen)
+	clientKey, block := block[:suite.keyLen], block[suite.keyLen:]
+	serverKey, block := block[:suite.keyLen], block[suite.keyLen:]
+	clientSalt, serverSalt := block[:gcmSaltLen], block[gcmSaltLen:]
+	if client, err = newHalfConn(clientKey, clientSalt); err != nil {
+		return nil, nil, nil, err
+	}
+	if server, err = newHalfConn(serverKey, serverSalt); err != nil {
+		return nil, nil, nil, err
+	}
+	return master, client, server, nil
+}
+
+func finishedMessage(suite *cipherSuite, master []byte, label string, transcript []byte) []byte {
+	return handshakeMessage(handshakeFinished, prf(suite.newHash, master, label, transcriptHash(suite, transcript), verifyDataLen))
+}
+
+func (c *Conn) serverHandshake() error {
+	if len(c.config.Keys) == 0 {
+		return errors.New("tls-psk: server without keys")
+	}
+	clientHelloMsg, err := c.readHandshake(handshakeClientHello)
+	if err != nil {
+		return err
+	}
+	hello, ok := parseClientHello(clientHelloMsg[4:])
+	if !ok {
+		return c.fail(alertDecodeError, "malformed ClientHello")
+	}
+	if hello.version < versionTLS12 {
+		return c.fail(alertProtocolVersion, fmt.Sprintf("client version 0x%04x", hello.version))
+	}
+	if !slices.Contains(hello.compressionMethods, 0) {
+		return c.fail(alertIllegalParameter, "client without null compression")
+	}
+	suite := selectSuite(hello, c.config.suites())
+	if suite == nil {
+		return c.fail(alertHandshakeFailure, "no common cipher suite")
+	}
+
+	serverRandom := make([]byte, randomLen)
+	rand.Read(serverRandom)
+	var extensions []byte
+	if hello.secureRenegotiation {
+		extensions = appendExtension(extensions, extensionRenegotiationInfo, []byte{0})
+	}
+	if hello.extendedMasterSecret {
+		extensions = appendExtension(extensions, extensionExtendedMasterSecret, nil)
+	}
+	body := binary.BigEndian.AppendUint16(nil, versionTLS12)
+	body = append(body, serverRandom...)
+	body = appendVector8(body, nil) // Sessions are not resumed
+	body = binary.BigEndian.AppendUint16(body, suite.id)
+	body = append(body, 0)
+	if len(extensions) > 0 {
+		body = appendVector16(body, extensions)
+	}
+	flight := [][]byte{handshakeMessage(handshakeServerHello, body)}
+
+	var dhPrivate *big.Int
+	if suite.dhe {
+		var dhPublic *big.Int
+		if dhPrivate, dhPublic, err = ffdhe2048Group.keyPair(); err != nil {
+			return c.fail(alertInternalError, err.Error())
+		}
+		params := appendVector16(nil, nil) // No identity hint
+		params = appendVector16(params, ffdhe2048Group.prime.Bytes())
+		params = appendVector16(params, ffdhe2048Group.generator.Bytes())
+		params = appendVector16(params, dhPublic.Bytes())
+		flight = append(flight, handshakeMessage(handshakeServerKeyExchange, params))
+	}
+	flight = append(flight, handshakeMessage(handshakeServerHelloDone, nil))
+	if err := c.writeHandshake(flight...); err != nil {
+		return err
+	}
+	transcript := slices.Concat(append([][]byte{clientHelloMsg}, flight...)...)
+
+	keyExchange, err := c.readHandshake(handshakeClientKeyExchange)
+	if err != nil {
+		return err
+	}
+	p := newParser(keyExchange[4:])
+	identity := p.vector16()
+	var dhPublic []byte
+	if suite.dhe {
+		dhPublic = p.vector16()
+	}
+	if !p.done() || len(identity) == 0 {
+		return c.fail(alertDecodeError, "malformed ClientKeyExchange")
+	}
+	key, ok := c.config.Keys[string(identity)]
+	if !ok {
+		return c.fail(alertUnknownPSKIdentity, fmt.Sprintf("unknown PSK identity %q", identity))
+	}
+	other := make([]byte, len(key))
+	if suite.dhe {
+		if other, ok = ffdhe2048Group.secret(dhPrivate, dhPublic); !ok {
+			return c.fail(alertIllegalParameter, "invalid Diffie-Hellman public value")
+		}
+	}
+	transcript = append(transcript, keyExchange...)
+
+	master, in, out, err := deriveKeys(suite, pskPremaster(other, key), hello.random, serverRandom, hello.extendedMasterSecret, transcript)
+	if err != nil {
+		return c.fail(alertInternalError, err.Error())
+	}
+	if err := c.readChangeCipherSpec(in); err != nil {
+		return err
+	}
+	finished, err := c.readHandshake(handshakeFinished)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(finished, finishedMessage(suite, master, "client finished", transcript)) {
+		return c.fail(alertDecryptError, "wrong Finished of the client, the keys differ")
+	}
+	transcript = append(transcript, finished...)
+	if err := c.writeChangeCipherSpec(out); err != nil {
+		return err
+	}
+	if err := c.writeHandshake(finishedMessage(suite, master, "server finished", transcript)); err != nil {
+		return err
+	}
+
+	c.state = ConnectionState{CipherSuite: suite.id, Identity: string(identity), ExtendedMasterSecret: hello.extendedMasterSecret}
+	return nil
+}
+
+func (c *Conn) clientHandshake() error {
+	if c.config.Identity == "" || len(c.config.Identity) > maxIdentityLength || len(c.config.Key) == 0 || len(c.config.Key) > maxKeyLength || len(c.config.suites()) == 0 {
+		return errors.New("tls-psk: client needs an identity, a key and a cipher suite")
+	}
+
+	clientRandom := make([]byte, randomLen)
+	rand.Read(clientRandom)
+	var suites []byte
+	for _, suite := range c.config.suites() {
+		suites = binary.BigEndian.AppendUint16(suites, suite.id)
+	}
+	suites = binary.BigEndian.AppendUint16(suites, suiteEmptyRenegotiationInfoSCSV)
+	extensions := appendExtension(nil, extensionSupportedGroups, appendVector16(nil, binary.BigEndian.AppendUint16(nil, groupFFDHE2048)))
+	extensions = appendExtension(extensions, extensionExtendedMasterSecret, nil)
+	body := binary.BigEndian.AppendUint16(nil, versionTLS12)
+	body = append(body, clientRandom...)
+	body = appendVector8(body, nil)
+	body = appendVector16(body, suites)
+	body = appendVector8(body, []byte{0})
+	body = appendVector16(body, extensions)
+	clientHelloMsg := handshakeMessage(handshakeClientHello, body)
+	if err := c.writeHandshake(clientHelloMsg); err != nil {
+		return err
+	}
+
+	serverHelloMsg, err := c.readHandshake(handshakeServerHello)
+	if err != nil {
+		return err
+	}
+	p := newParser(serverHelloMsg[4:])
+	version, serverRandom := p.uint16(), p.bytes(randomLen)
+	p.vector8()
+	suite, compression := cipherSuiteByID(p.uint16()), p.uint8()
+	var ems, secureRenegotiation, unsupported bool
+	ok := p.ok && p.extensions(func(extension uint16, data []byte) bool {
+		switch extension {
+		case extensionExtendedMasterSecret:
+			ems = true
+			return len(data) == 0
+		case extensionRenegotiationInfo:
+			secureRenegotiation = true
+			return len(data) == 1 && data[0] == 0
+		}
+		unsupported = true
+		return false
+	})
+	switch {
+	case unsupported:
+		return c.fail(alertUnsupportedExt, "server sent an extension that was not offered")
+	case !ok:
+		return c.fail(alertDecodeError, "malformed ServerHello")
+	case version != versionTLS12:
+		return c.fail(alertProtocolVersion, fmt.Sprintf("server version 0x%04x", version))
+	case suite == nil || !slices.Contains(c.config.suites(), suite) || compression != 0:
+		return c.fail(alertIllegalParameter, "server selected a cipher suite or compression that was not offered")
+	case !secureRenegotiation:
+		return c.fail(alertHandshakeFailure, "server without secure renegotiation")
+	}
+	transcript := slices.Concat(clientHelloMsg, serverHelloMsg)
+
+	var dhPublic, other []byte
+	msg, err := c.readHandshake(handshakeServerKeyExchange, handshakeServerHelloDone)
+	if err != nil {
+		return err
+	}
+	if msg[0] == handshakeServerKeyExchange {
+		p := newParser(msg[4:])
+		p.vector16() // The identity hint is not used, the identity is configured
+		if suite.dhe {
+			prime, generator, public := p.vector16(), p.vector16(), p.vector16()
+			if !p.done() {
+				return c.fail(alertDecodeError, "malformed ServerKeyExchange")
+			}
+			// The group is authenticated with the key by the Finished messages, any group large enough is accepted
+			group := dhGroup{prime: new(big.Int).SetBytes(prime), generator: new(big.Int).SetBytes(generator)}
+			if bits := group.prime.BitLen(); bits < minDHPrimeBits || bits > maxDHPrimeBits || group.prime.Bit(0) == 0 {
+				return c.fail(alertInsufficientSecurity, fmt.Sprintf("Diffie-Hellman prime of %d bits", bits))
+			}
+			if !group.inRange(group.generator) {
+				return c.fail(alertIllegalParameter, "invalid Diffie-Hellman generator")
+			}
+			private, ownPublic, err := group.keyPair()
+			if err != nil {
+				return c.fail(alertInternalError, err.Error())
+			}
+			if other, ok = group.secret(private, public); !ok {
+				return c.fail(alertIllegalParameter, "invalid Diffie-Hellman public value")
+			}
+			dhPublic = ownPublic.Bytes()
+		} else if !p.done() {
+			return c.fail(alertDecodeError, "malformed ServerKeyExchange")
+		}
+		transcript = append(transcript, msg...)
+		if msg, err = c.readHandshake(handshakeServerHelloDone); err != nil {
+			return err
+		}
+	} else if suite.dhe {
+		return c.fail(alertUnexpectedMessage, "no ServerKeyExchange with DHE_PSK")
+	}
+	if len(msg) != 4 {
+		return c.fail(alertDecodeError, "malformed ServerHelloDone")
+	}
+	transcript = append(transcript, msg...)
+
+	body = appendVector16(nil, []byte(c.config.Identity))
+	if suite.dhe {
+		body = appendVector16(body, dhPublic)
+	} else {
+		other = make([]byte, len(c.config.Key))
+	}
+	keyExchange := handshakeMessage(handshakeClientKeyExchange, body)
+	transcript = append(transcript, keyExchange...)
+	master, out, in, err := deriveKeys(suite, pskPremaster(other, c.config.Key), clientRandom, serverRandom, ems, transcript)
+	if err != nil {
+		return c.fail(alertInternalError, err.Error())
+	}
+	if err := c.writeHandshake(keyExchange); err != nil {
+		return err
+	}
+	if err := c.writeChangeCipherSpec(out); err != nil {
+		return err
+	}
+	finished := finishedMessage(suite, master, "client finished", transcript)
+	if err := c.writeHandshake(finished); err != nil {
+		return err
+	}
+	transcript = append(transcript, finished...)
+
+	if err := c.readChangeCipherSpec(in); err != nil {
+		return err
+	}
+	serverFinished, err := c.readHandshake(handshakeFinished)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(serverFinished, finishedMessage(suite, master, "server finished", transcript)) {
+		return c.fail(alertDecryptError, "wrong Finished of the server, the keys differ")
+	}
+
+	c.state = ConnectionState{CipherSuite: suite.id, Identity: c.config.Identity, ExtendedMasterSecret: ems}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package tlspsk implements TLS 1.2 with pre-shared keys (RFC 4279, RFC 5487) for the tls-creds-psk object of QEMU,
+// as the TLS stack of Go has no PSK cipher suites. Only the AES-GCM cipher suites are implemented, with ephemeral
+// Diffie-Hellman and without. A server uses the ffdhe2048 group of RFC 7919, a client accepts the group of the server
+// from 2048 bits. Sessions are neither resumed nor renegotiated.
+package tlspsk
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// KeysFile is the file name of the keys in the tls-creds-psk directory layout of QEMU
+const KeysFile = "keys.psk"
+
+// Config configures a TLS-PSK endpoint
+type Config struct {
+	Keys     map[string][]byte // Keys of the PSK identities a server accepts
+	Identity string            // PSK identity of a client
+	Key      []byte            // Key of the identity of a client
+
+	CipherSuites []uint16 // Enabled cipher suites, nil for all, in the order of preference of this package
+}
+
+// suites returns the enabled cipher suites in the order of preference
+func (config *Config) suites() []*cipherSuite {
+	if config.CipherSuites == nil {
+		return cipherSuites
+	}
+	var suites []*cipherSuite
+	for _, suite := range cipherSuites {
+		if slices.Contains(config.CipherSuites, suite.id) {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
+}
+
+// ConnectionState describes a negotiated connection
+type ConnectionState struct {
+	CipherSuite          uint16
+	Identity             string // PSK identity the client authenticated with
+	ExtendedMasterSecret bool   // RFC 7627
+}
+
+// LoadKeys reads keys in the format of psktool (GnuTLS), one "identity:hex key" per line, e.g. keys.psk of a
+// tls-creds-psk directory
+func LoadKeys(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		identity, hexKey, ok := strings.Cut(line, ":")
+		if !ok || identity == "" || len(identity) > maxIdentityLength {
+			return nil, fmt.Errorf("%s:%d: expected identity:key", path, lineNumber)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) == 0 || len(key) > maxKeyLength {
+			return nil, fmt.Errorf("%s:%d: key of %q is not a hex string of 1 to %d bytes", path, lineNumber, identity, maxKeyLength)
+		}
+		if _, ok := keys[identity]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate identity %q", path, lineNumber, identity)
+		}
+		keys[identity] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", path)
+	}
+	return keys, nil
+}
+
+// CipherSuiteName returns the IANA name of a cipher suite of this package
+func CipherSuiteName(id uint16) string {
+	if suite := cipherSuiteByID(id); suite != nil {
+		return suite.name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
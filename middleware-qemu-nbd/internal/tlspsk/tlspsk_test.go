@@ -0,0 +1,287 @@
+package tlspsk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testIdentity = "qemu"
+	testKey, _   = hex.DecodeString("0123456789abcdef0123456789abcdef")
+)
+
+func TestPRF(t *testing.T) {
+	// Expected values of "openssl kdf ... TLS1-PRF"
+	for _, test := range []struct {
+		name   string
+		sha384 bool
+		secret []byte
+		label  string
+		seed   []byte
+		want   string
+	}{
+		{name: "sha256", secret: []byte("secret"), label: "label", seed: []byte("seed"), want: "7ed42a23a133ad379b99196a86db887cf595d9ada5661ec11866916 59bf87a7a"},
+		{name: "sha384", sha384: true, secret: []byte{0, 1, 2, 3, 4}, label: "key expansion", want: "26ee1d4bcfe19666b5d211a203f0bf5e0587c6c2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			newHash := sha256.New
+			if test.sha384 {
+				newHash = sha512.New384
+			}
+			want := strings.ReplaceAll(test.want, " ", "")
+			if got := hex.EncodeToString(prf(newHash, test.secret, test.label, test.seed, len(want)/2)); got != want {
+				t.Fatalf("prf = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{name: "psktool", content: "qemu:0123456789abcdef\n\nother:00ff\n", want: map[string]string{"qemu": "0123456789abcdef", "other": "00ff"}},
+		{name: "no separator", content: "qemu0123\n"},
+		{name: "empty identity", content: ":0123\n"},
+		{name: "no hex", content: "qemu:xyz\n"},
+		{name: "empty key", content: "qemu:\n"},
+		{name: "duplicate", content: "qemu:00\nqemu:01\n"},
+		{name: "empty", content: "\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), KeysFile)
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := LoadKeys(path)
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("loaded %v", keys)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(test.want) {
+				t.Fatalf("loaded %d keys, want %d", len(keys), len(test.want))
+			}
+			for identity, key := range test.want {
+				if hex.EncodeToString(keys[identity]) != key {
+					t.Errorf("key of %s = %x, want %s", identity, keys[identity], key)
+				}
+			}
+		})
+	}
+}
+
+// handshake connects a client and a server over TCP, which buffers unlike a pipe, and runs both handshakes
+func handshake(t *testing.T, client *Config, server *Config) (*Conn, *Conn, error, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	serverConn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c, s := Client(clientConn, client), Server(serverConn, server)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- s.Handshake()
+	}()
+	clientErr := c.Handshake()
+	return c, s, clientErr, <-serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	for _, suite := range cipherSuites {
+		t.Run(suite.name, func(t *testing.T) {
+			client, server, clientErr, serverErr := handshake(t,
+				&Config{Identity: testIdentity, Key: testKey, CipherSuites: []uint16{suite.id}},
+				&Config{Keys: map[string][]byte{"other": {1}, testIdentity: testKey}})
+			if clientErr != nil || serverErr != nil {
+				t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+			}
+			for _, state := range []ConnectionState{client.ConnectionState(), server.ConnectionState()} {
+				if state != (ConnectionState{CipherSuite: suite.id, Identity: testIdentity, ExtendedMasterSecret: true}) {
+					t.Fatalf("connection state %+v", state)
+				}
+			}
+
+			// Larger than a record in both directions
+			data := bytes.Repeat([]byte("0123456789abcdef"), 3*maxPlaintext/16+1)
+			go func() {
+				client.Write(data)
+				client.Close()
+			}()
+			received := make([]byte, len(data))
+			if _, err := io.ReadFull(server, received); err != nil || !bytes.Equal(received, data) {
+				t.Fatalf("server received %d bytes: %v", len(received), err)
+			}
+			if _, err := server.Read(received); err != io.EOF {
+				t.Fatalf("read after close_notify: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandshakePreference(t *testing.T) {
+	client, _, clientErr, serverErr := handshake(t,
+		&Config{Identity: testIdentity, Key: testKey},
+		&Config{Keys: map[string][]byte{testIdentity: testKey}, CipherSuites: []uint16{suitePSKWithAES128GCMSHA256, suiteDHEPSKWithAES128GCMSHA256}})
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	if suite := client.ConnectionState().CipherSuite; suite != suiteDHEPSKWithAES128GCMSHA256 {
+		t.Fatalf("negotiated %s", CipherSuiteName(suite))
+	}
+}
+
+func TestHandshakeFailure(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		client Config
+		server Config
+		alert  uint8 // Received by the client
+	}{
+		{
+			name:   "unknown identity",
+			client: Config{Identity: "stranger", Key: testKey},
+			server: Config{Keys: map[string][]byte{testIdentity: testKey}},
+			alert:  alertUnknownPSKIdentity,
+		},
+		{
+			name:   "wrong key",
+			client: Config{Identity: testIdentity, Key: []byte("wrong key")},
+			server: Config{Keys: map[string][]byte{testIdentity: testKey}},
+			alert:  alertBadRecordMAC,
+		},
+		{
+			name:   "no common cipher suite",
+			client: Config{Identity: testIdentity, Key: testKey, CipherSuites: []uint16{suitePSKWithAES128GCMSHA256}},
+			server: Config{Keys: map[string][]byte{testIdentity: testKey}, CipherSuites: []uint16{suitePSKWithAES256GCMSHA384}},
+			alert:  alertHandshakeFailure,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, clientErr, serverErr := handshake(t, &test.client, &test.server)
+			if serverErr == nil {
+				t.Fatal("server accepted the handshake")
+			}
+			alert, ok := errors.AsType[*AlertError](clientErr)
+			if !ok || !alert.Remote || alert.Description != test.alert {
+				t.Fatalf("client error %v, want alert %d of the server", clientErr, test.alert)
+			}
+		})
+	}
+}
+
+// TestOpenSSL checks the interoperability with OpenSSL, which implements TLS-PSK like GnuTLS of QEMU
+func TestOpenSSL(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not installed")
+	}
+	psk := []string{"-psk", hex.EncodeToString(testKey), "-psk_identity", testIdentity, "-tls1_2"}
+
+	t.Run("server", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		cmd := exec.CommandContext(t.Context(), openssl, append([]string{"s_client", "-connect", listener.Addr().String(), "-quiet"}, psk...)...)
+		cmd.Stdin = strings.NewReader("ping\n")
+		output := make(chan string, 1)
+		go func() {
+			out, _ := cmd.Output()
+			output <- string(out)
+		}()
+
+		netConn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := Server(netConn, &Config{Keys: map[string][]byte{testIdentity: testKey}})
+		netConn.SetDeadline(time.Now().Add(10 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "ping\n" {
+			t.Fatalf("received %q: %v", line, err)
+		}
+		fmt.Fprint(conn, "pong\n")
+		conn.Close()
+		if out := <-output; out != "pong\n" {
+			t.Fatalf("openssl received %q", out)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		cmd := exec.CommandContext(t.Context(), openssl, append([]string{"s_server", "-accept", "127.0.0.1:0", "-nocert", "-rev"}, psk...)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+		lines := bufio.NewScanner(stdout)
+		var address string
+		for lines.Scan() {
+			if rest, ok := strings.CutPrefix(lines.Text(), "ACCEPT "); ok {
+				address = rest
+				break
+			}
+		}
+		go io.Copy(io.Discard, stdout)
+		if address == "" {
+			t.Fatal("openssl s_server did not print its address")
+		}
+
+		netConn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := Client(netConn, &Config{Identity: testIdentity, Key: testKey})
+		defer conn.Close()
+		netConn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprint(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "gnip\n" {
+			t.Fatalf("received %q: %v", line, err)
+		}
+		if suite := conn.ConnectionState().CipherSuite; suite != suiteDHEPSKWithAES256GCMSHA384 {
+			t.Fatalf("negotiated %s", CipherSuiteName(suite))
+		}
+	})
+}
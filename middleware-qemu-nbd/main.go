@@ -20,27 +20,34 @@ func main() {
 
 func run() error {
 	// load and init config
-	err := config.Load()
+	cfg, err := config.Load()
 	if err != nil {
 		return err
 	}
 
 	// init logging
-	err = logging.Initialize(config.Get().LoggingConfig)
+	err = logging.Initialize(cfg.LoggingConfig)
+	if err != nil {
+		return err
+	}
+
+	impl, err := implementation.New(cfg, logging.GetDefaultLogger())
 	if err != nil {
 		return err
 	}
 
 	app, err := app.New(
-		implementation.New(config.Get(), logging.GetDefaultLogger()),
-		config.Get().ToMiddlewareConfig(),
-		logging.GetDefaultLogger(),
+		impl,
+		cfg.ToMiddlewareConfig(),
+		app.WithLogger(logging.GetDefaultLogger()),
+		app.WithUUID(cfg.InstanceConfig.InstanceUUID()),
 	)
 	if err != nil {
 		return err
 	}
+	impl.SetVolumeCatalog(app.Volumes())
 
-	if err := app.Run(); err != nil {
+	if err := app.RunUntilSignal(); err != nil {
 		return err
 	}
 
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	app "quorumbd.net/middleware-common/app"
+	config "quorumbd.net/middleware-qemu-nbd/internal/config"
+	implementation "quorumbd.net/middleware-qemu-nbd/internal/implementation"
+	"quorumbd.net/middleware-qemu-nbd/internal/nbd"
+)
+
+const (
+	testVolumeName = "disk0"
+	testVolumeSize = 16 << 20
+)
+
+// startCore builds core and runs it with one volume (with change tracking bitmap backup) until the test ends, it returns the URI of its socket
+func startCore(t *testing.T) string {
+	t.Helper()
+	return startCoreWith(t, "")
+}
+
+// startCoreWith runs core like startCore, with additional config (e.g. more volumes)
+func startCoreWith(t *testing.T, extraConfig string) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found:", err)
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "core")
+	if out, err := exec.Command(goTool, "build", "-o", binary, "quorumbd.net/core").CombinedOutput(); err != nil {
+		t.Fatalf("building core failed: %v\n%s", err, out)
+	}
+
+	socket := filepath.Join(dir, "core.sock")
+	configPath := filepath.Join(dir, "core.toml")
+	coreConfig := fmt.Sprintf(`
+[common]
+state_dir = %[1]q
+
+[core]
+listen = ["unix://%[2]s"]
+data_dir = %[3]q
+
+[[volumes]]
+id = "vol-0"
+name = %[4]q
+size = %[5]d
+bitmaps = ["backup"]
+%[6]s
+`, dir, socket, filepath.Join(dir, "volumes"), testVolumeName, testVolumeSize, extraConfig)
+	if err := os.WriteFile(configPath, []byte(coreConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), "QUORUMBD_NBDSERVER_CONFIG="+configPath)
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("core output:\n%s", output.String())
+		}
+	})
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+		select {
+		case <-exited:
+			t.Fatalf("core exited:\n%s", output.String())
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("core did not start listening")
+		}
+	}
+}
+
+// startMiddleware runs the middleware against core until the test ends and returns its NBD socket
+func startMiddleware(t *testing.T, coreURI string) string {
+	t.Helper()
+	return startMiddlewareWith(t, coreURI, "")
+}
+
+// startMiddlewareWith runs the middleware like startMiddleware, with additional config (e.g. the instance section)
+func startMiddlewareWith(t *testing.T, coreURI string, extraConfig string) string {
+	t.Helper()
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "nbd.sock")
+	configPath := filepath.Join(dir, "middleware-qemu-nbd.toml")
+	middlewareConfig := fmt.Sprintf(`
+[common]
+state_dir = %q
+
+[coreconnection]
+server = %q
+
+[nbdserver]
+socket = %q
+%s
+`, dir, coreURI, socket, extraConfig)
+	if err := os.WriteFile(configPath, []byte(middlewareConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadFrom(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.DiscardHandler)
+	impl, err := implementation.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware, err := app.New(impl, cfg.ToMiddlewareConfig(), app.WithLogger(logger), app.WithUUID(cfg.InstanceConfig.InstanceUUID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl.SetVolumeCatalog(middleware.Volumes())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		if err := middleware.Run(ctx); err != nil {
+			t.Errorf("middleware failed: %v", err)
+		}
+	})
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return socket
+}
+
+// dialExport connects to the export, waiting until core attached it
+func dialExport(t *testing.T, socket string, options nbd.ClientOptions) *nbd.Client {
+	t.Helper()
+	var lastErr error
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		client, err := nbd.Dial(ctx, "unix", socket, options)
+		cancel()
+		if err == nil {
+			t.Cleanup(func() { client.Close() })
+			return client
+		}
+		lastErr = err
+	}
+	t.Fatalf("export %q was not attached: %v", options.ExportName, lastErr)
+	return nil
+}
+
+func TestExportAttachedByCoreServesIO(t *testing.T) {
+	coreURI := startCore(t)
+	socket := startMiddleware(t, coreURI)
+	client := dialExport(t, socket, nbd.ClientOptions{ExportName: testVolumeName})
+
+	if client.Size() != testVolumeSize {
+		t.Fatalf("export size %d, want %d", client.Size(), testVolumeSize)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("quorumbd"), 1024)
+	const offset = 1 << 20
+	if err := client.WriteAt(ctx, data, offset, nbd.CmdFlagFUA); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	read := make([]byte, len(data))
+	if err := client.ReadAt(ctx, read, offset); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("read returned other data than written")
+	}
+
+	// Unwritten blocks read as zeroes
+	if err := client.ReadAt(ctx, read, 0); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(read, make([]byte, len(read))) {
+		t.Fatal("unwritten blocks are not zero")
+	}
+	if err := client.Disconnect(ctx); err != nil {
+		t.Fatalf("disconnect failed: %v", err)
+	}
+}
+
+func TestRestrictedVolumeIsOnlyVisibleToListedMiddleware(t *testing.T) {
+	const listedUUID = "6f0c4f1e-8a53-4b43-9b5e-3c2f6b1d9a10"
+	coreURI := startCoreWith(t, fmt.Sprintf(`
+[[volumes]]
+id = "vol-1"
+name = "restricted"
+size = %d
+middlewares = [%q]
+`, testVolumeSize, listedUUID))
+	listed := startMiddlewareWith(t, coreURI, fmt.Sprintf("[instance]\nuuid = %q\n", listedUUID))
+	other := startMiddleware(t, coreURI)
+
+	dialExport(t, listed, nbd.ClientOptions{ExportName: "restricted"})
+
+	// Core attached both volumes with the registration of the other middleware, only the restricted one is missing
+	dialExport(t, other, nbd.ClientOptions{ExportName: testVolumeName})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := nbd.Dial(ctx, "unix", other, nbd.ClientOptions{ExportName: "restricted"})
+	if err == nil {
+		client.Close()
+		t.Fatal("restricted volume visible to a middleware that is not listed")
+	}
+	if optionErr, ok := errors.AsType[*nbd.OptionError](err); !ok || optionErr.Reply != nbd.RepErrUnknown {
+		t.Fatalf("dialing the restricted volume failed with %v, want unknown export", err)
+	}
+}
+
+func TestWritesInvalidateCachesOfOtherMiddlewares(t *testing.T) {
+	coreURI := startCore(t)
+	writer := dialExport(t, startMiddleware(t, coreURI), nbd.ClientOptions{ExportName: testVolumeName})
+	reader := dialExport(t, startMiddleware(t, coreURI), nbd.ClientOptions{ExportName: testVolumeName})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Fill the cache of the reader
+	read := make([]byte, 4096)
+	if err := reader.ReadAt(ctx, read, 0); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	data := bytes.Repeat([]byte{0x42}, len(read))
+	if err := writer.WriteAt(ctx, data, 0, 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	// Core acknowledges the write only after the reader dropped the range from its cache
+	if err := reader.ReadAt(ctx, read, 0); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("reader returned cached data from before the write")
+	}
+}
+
+func TestBlockStatusReportsAllocationOfCore(t *testing.T) {
+	coreURI := startCore(t)
+	client := dialExport(t, startMiddleware(t, coreURI), nbd.ClientOptions{
+		ExportName:   testVolumeName,
+		MetaContexts: []string{nbd.MetaContextBaseAllocation},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const offset = 1 << 20
+	if err := client.WriteAt(ctx, bytes.Repeat([]byte{1}, 4096), offset, 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	status, err := client.BlockStatus(ctx, 0, testVolumeSize, 0)
+	if err != nil {
+		t.Fatalf("block status failed: %v", err)
+	}
+
+	// flagsAt returns the flags of the extent of an offset
+	flagsAt := func(off uint64) uint32 {
+		pos := uint64(0)
+		for _, extent := range status[nbd.MetaContextBaseAllocation] {
+			if off < pos+uint64(extent.Length) {
+				return extent.Flags
+			}
+			pos += uint64(extent.Length)
+		}
+		t.Fatalf("extents %+v do not cover offset %d", status, off)
+		return 0
+	}
+	if flags := flagsAt(0); flags != nbd.StateHole|nbd.StateZero {
+		t.Fatalf("unwritten start of the volume has flags %d", flags)
+	}
+	if flags := flagsAt(offset); flags != 0 {
+		t.Fatalf("written block has flags %d", flags)
+	}
+}
+
+func TestDirtyBitmapTracksWritesInCore(t *testing.T) {
+	coreURI := startCore(t)
+	const metaContext = nbd.MetaContextDirtyBitmap + "backup"
+	client := dialExport(t, startMiddleware(t, coreURI), nbd.ClientOptions{ExportName: testVolumeName, MetaContexts: []string{metaContext}})
+	if contexts := client.MetaContexts(); len(contexts) != 1 || contexts[0] != metaContext {
+		t.Fatalf("meta contexts %q, want %q", contexts, metaContext)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const offset = 2 << 20
+	if err := client.WriteAt(ctx, make([]byte, 4096), offset, 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	status, err := client.BlockStatus(ctx, 0, testVolumeSize, 0)
+	if err != nil {
+		t.Fatalf("block status failed: %v", err)
+	}
+	var dirty []uint64 // Offsets of the dirty extents
+	pos := uint64(0)
+	for _, extent := range status[metaContext] {
+		if extent.Flags&nbd.StateDirty != 0 {
+			dirty = append(dirty, pos)
+		}
+		pos += uint64(extent.Length)
+	}
+	if len(dirty) != 1 || dirty[0] > offset || pos != testVolumeSize {
+		t.Fatalf("dirty extents at %v of %+v, want one containing %d", dirty, status[metaContext], offset)
+	}
+}
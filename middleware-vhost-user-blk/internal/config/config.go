@@ -0,0 +1,117 @@
+// Package config provides configuration loading and validation
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	commonconfig "quorumbd.net/common/config"
+	middlewareconfig "quorumbd.net/middleware-common/config"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+const configFileName = "middleware-vhost-user-blk.toml"
+
+// MaxQueues is the maximum number of virtqueues of a device
+const MaxQueues = 64
+
+type vhostUserConfig struct {
+	SocketDir string `toml:"socket_dir"` // One socket per export: <socket_dir>/<export>.sock
+	NumQueues int    `toml:"num_queues"` // Request queues offered to the frontend (num-queues of QEMU must not exceed it)
+}
+
+type Config struct {
+	CommonConfig         commonconfig.CommonConfig             `toml:"common"`
+	LoggingConfig        commonconfig.LoggingConfig            `toml:"logging"`
+	CoreConnectionConfig middlewareconfig.CoreConnectionConfig `toml:"coreconnection"`
+	InstanceConfig       middlewareconfig.InstanceConfig       `toml:"instance"`
+	VhostUserConfig      vhostUserConfig                       `toml:"vhostuser"`
+	CacheConfig          middlewareconfig.CacheConfig          `toml:"cache"`
+}
+
+func (cfg *Config) ToMiddlewareConfig() *middlewareconfig.Config {
+	return &middlewareconfig.Config{
+		CommonConfig:         cfg.CommonConfig,
+		CoreConnectionConfig: cfg.CoreConnectionConfig,
+		CacheConfig:          cfg.CacheConfig,
+	}
+}
+
+// Load resolves the config file from the default locations and loads it
+func Load() (*Config, error) {
+	configPath, err := commonconfig.ResolveConfigPath(configFileName, "QUORUMBD_VHOSTUSERBLK_CONFIG")
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	return LoadFrom(configPath)
+}
+
+// LoadFrom loads the config from the given file (every call returns a new instance)
+func LoadFrom(configPath string) (*Config, error) {
+	var cfg Config
+
+	cfg.setDefaults()
+
+	if err := cfg.readConfig(configPath); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %w", configPath, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("error invalid config %s: %w", configPath, err)
+	}
+
+	return &cfg, nil
+}
+
+func (cfg *Config) setDefaults() {
+	cfg.CommonConfig.SetDefaults()
+	cfg.LoggingConfig.SetDefaults()
+	cfg.CoreConnectionConfig.SetDefaults()
+	cfg.InstanceConfig.SetDefaults()
+	cfg.VhostUserConfig.setDefaults()
+	cfg.CacheConfig.SetDefaults()
+}
+
+func (cfg *vhostUserConfig) setDefaults() {
+	cfg.SocketDir = filepath.Join("/", "var", "run", "qbd", "vhost-user-blk")
+	cfg.NumQueues = 4
+}
+
+func (cfg *Config) validate() error {
+	commonErrors := cfg.CommonConfig.Validate()
+	loggingErrors := cfg.LoggingConfig.Validate()
+	coreConnectionErrors := cfg.CoreConnectionConfig.Validate()
+	instanceErrors := cfg.InstanceConfig.Validate()
+	vhostUserErrors := cfg.VhostUserConfig.validate()
+	cacheErrors := cfg.CacheConfig.Validate()
+	return commonconfig.MergeValidationErrors(commonErrors, loggingErrors, coreConnectionErrors, instanceErrors, vhostUserErrors, cacheErrors)
+}
+
+func (cfg *vhostUserConfig) validate() error {
+	return validation.Errors{
+		"vhostuser": validation.ValidateStruct(cfg,
+			validation.Field(&cfg.SocketDir, validation.Required.Error("vhostuser.socket_dir required")),
+			validation.Field(&cfg.NumQueues, validation.Min(1).Error("vhostuser.num_queues must be at least 1"), validation.Max(MaxQueues).Error(fmt.Sprintf("vhostuser.num_queues must be at most %d", MaxQueues))),
+		),
+	}.Filter()
+}
+
+func (cfg *Config) readConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package implementation implements the adaptor interface of middleware-common
+package implementation
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"quorumbd.net/common/systemd"
+
+	"quorumbd.net/middleware-common/backend"
+	"quorumbd.net/middleware-vhost-user-blk/internal/config"
+	"quorumbd.net/middleware-vhost-user-blk/internal/vhostuser"
+)
+
+// attachedDevice is an attached export with its socket
+type attachedDevice struct {
+	device   *vhostuser.Device
+	listener net.Listener
+	socket   string
+	done     chan struct{} // Closed when Serve returned
+}
+
+type Implementation struct {
+	Config    *config.Config
+	Logger    *slog.Logger
+	devicesMu sync.Mutex
+	devices   map[string]*attachedDevice
+}
+
+func New(cfg *config.Config, logger *slog.Logger) *Implementation {
+	return &Implementation{
+		Config:  cfg,
+		Logger:  logger,
+		devices: make(map[string]*attachedDevice),
+	}
+}
+
+// GetImplementationName is an interface method of common-middleware.Adapter
+func (impl *Implementation) GetImplementationName() string {
+	return "vhost-user-blk"
+}
+
+// IsServer is an interface method of common-middleware.Adapter
+func (impl *Implementation) IsServer() bool {
+	return true
+}
+
+// ListenAddresses is an interface method of common-middleware.Adapter: the sockets of the attached exports
+func (impl *Implementation) ListenAddresses() []string {
+	impl.devicesMu.Lock()
+	defer impl.devicesMu.Unlock()
+
+	addresses := make([]string, 0, len(impl.devices))
+	for _, d := range impl.devices {
+		addresses = append(addresses, "unix://"+d.socket)
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+// Start is an interface method of common-middleware.Adapter
+func (impl *Implementation) Start(_ context.Context) error {
+	if err := os.MkdirAll(impl.Config.VhostUserConfig.SocketDir, 0o755); err != nil {
+		return fmt.Errorf("creating socket directory: %w", err)
+	}
+	return nil
+}
+
+// Stop is an interface method of common-middleware.Adapter
+func (impl *Implementation) Stop(_ context.Context) error {
+	impl.devicesMu.Lock()
+	defer impl.devicesMu.Unlock()
+
+	var err error
+	for name, d := range impl.devices {
+		if closeErr := impl.closeDevice(d); err == nil {
+			err = closeErr
+		}
+		delete(impl.devices, name)
+	}
+	return err
+}
+
+// AttachExport is an interface method of common-middleware.Adapter: every export gets its own socket
+func (impl *Implementation) AttachExport(export backend.Export, blockBackend backend.BlockBackend) error {
+	if export.Name == "." || export.Name == ".." || strings.ContainsAny(export.Name, "/\x00") {
+		return fmt.Errorf("export name %q cannot be used as socket name", export.Name)
+	}
+
+	impl.devicesMu.Lock()
+	defer impl.devicesMu.Unlock()
+
+	if _, ok := impl.devices[export.Name]; ok {
+		return fmt.Errorf("export %q is already attached", export.Name)
+	}
+
+	socket := filepath.Join(impl.Config.VhostUserConfig.SocketDir, export.Name+".sock")
+	ln, err := systemd.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	d := &attachedDevice{
+		device: vhostuser.NewDevice(impl.Logger, vhostuser.Export{
+			Name:      export.Name,
+			ReadOnly:  export.ReadOnly,
+			BlockSize: export.BlockSize,
+			Backend:   blockBackend,
+		}, vhostuser.Options{
+			NumQueues: impl.Config.VhostUserConfig.NumQueues,
+		}),
+		listener: ln,
+		socket:   socket,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		if err := d.device.Serve(ln); err != nil {
+			impl.Logger.Error("vhost-user device failed", "export", export.Name, "error", err)
+		}
+	}()
+	impl.devices[export.Name] = d
+	impl.Logger.Info("Listening", "export", export.Name, "socket", socket, "socket_activated", systemd.IsActivated(ln))
+	return nil
+}
+
+// DetachExport is an interface method of common-middleware.Adapter
+func (impl *Implementation) DetachExport(name string) error {
+	impl.devicesMu.Lock()
+	defer impl.devicesMu.Unlock()
+
+	d, ok := impl.devices[name]
+	if !ok {
+		return fmt.Errorf("export %q is not attached", name)
+	}
+	delete(impl.devices, name)
+	if d.device.Connected() {
+		impl.Logger.Info("Disconnecting frontend of detached export", "export", name)
+	}
+	return impl.closeDevice(d)
+}
+
+// closeDevice stops serving the export and waits until its backend is no longer used
+func (impl *Implementation) closeDevice(d *attachedDevice) error {
+	err := d.listener.Close()
+	d.device.Close()
+	<-d.done
+	return err
+}
@@ -0,0 +1,259 @@
+package vhostuser
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+const (
+	sectorSize        = 512 // Unit of the request sectors, independent of the block size
+	maxConfigSize     = 256
+	segMax            = 126      // Data segments per request (QEMU default for a queue size of 128)
+	maxRequestLength  = 32 << 20 // Read and write payloads
+	maxDiscardLength  = 1 << 30  // Bytes per discard or write zeroes segment
+	maxDiscardSegs    = 16       // Segments per discard or write zeroes request
+	discardSegSize    = 16       // struct virtio_blk_discard_write_zeroes
+	blkIDBytes        = 20       // VIRTIO_BLK_ID_BYTES
+	blkRequestHdrSize = 16       // struct virtio_blk_outhdr
+	maxSector         = math.MaxInt64 / sectorSize
+)
+
+// Request types
+const (
+	blkTypeIn          uint32 = 0
+	blkTypeOut         uint32 = 1
+	blkTypeFlush       uint32 = 4
+	blkTypeGetID       uint32 = 8
+	blkTypeDiscard     uint32 = 11
+	blkTypeWriteZeroes uint32 = 13
+)
+
+// Request status
+const (
+	blkStatusOK     byte = 0
+	blkStatusIOErr  byte = 1
+	blkStatusUnsupp byte = 2
+)
+
+const blkWriteZeroesUnmap uint32 = 1
+
+// buffers are the guest memory of one direction of a request
+type buffers [][]byte
+
+func (b buffers) length() int {
+	n := 0
+	for _, buf := range b {
+		n += len(buf)
+	}
+	return n
+}
+
+// contiguous returns [off, off+n) without copying, if it lies within one buffer
+func (b buffers) contiguous(off int, n int) ([]byte, bool) {
+	for _, buf := range b {
+		if off < len(buf) {
+			if n > len(buf)-off {
+				return nil, false
+			}
+			return buf[off : off+n], true
+		}
+		off -= len(buf)
+	}
+	return nil, n == 0
+}
+
+// gather returns [off, off+n), copied unless it lies within one buffer
+func (b buffers) gather(off int, n int) []byte {
+	if data, ok := b.contiguous(off, n); ok {
+		return data
+	}
+	p := make([]byte, n)
+	copied := 0
+	for _, buf := range b {
+		if copied == n {
+			break
+		}
+		if off >= len(buf) {
+			off -= len(buf)
+			continue
+		}
+		copied += copy(p[copied:], buf[off:])
+		off = 0
+	}
+	return p
+}
+
+// scatter copies p to the buffers starting at off
+func (b buffers) scatter(off int, p []byte) {
+	for _, buf := range b {
+		if len(p) == 0 {
+			return
+		}
+		if off >= len(buf) {
+			off -= len(buf)
+			continue
+		}
+		n := copy(buf[off:], p)
+		p = p[n:]
+		off = 0
+	}
+}
+
+// features returns the virtio features offered for the export
+func (d *Device) features() uint64 {
+	features := featureVersion1 | featureProtocolFeatures | featureRingIndirectDesc |
+		featureBlkSegMax | featureBlkBlkSize | featureBlkTopology | featureBlkFlush | featureBlkMQ
+	if d.export.ReadOnly {
+		return features | featureBlkRO
+	}
+	return features | featureBlkDiscard | featureBlkWriteZeroes
+}
+
+// config returns the virtio-blk config space. The logical block size is always 512 bytes (as with QEMU),
+// the block size of the volume is announced as physical block size.
+func (d *Device) config() []byte {
+	config := make([]byte, maxConfigSize)
+	physicalSectors := uint32(1)
+	if d.export.BlockSize > sectorSize && d.export.BlockSize&(d.export.BlockSize-1) == 0 {
+		physicalSectors = d.export.BlockSize / sectorSize
+	}
+
+	binary.LittleEndian.PutUint64(config[0:], uint64(d.export.Backend.Size()/sectorSize))    // capacity
+	binary.LittleEndian.PutUint32(config[12:], segMax)                                       // seg_max
+	binary.LittleEndian.PutUint32(config[20:], sectorSize)                                   // blk_size
+	config[24] = byte(bits.TrailingZeros32(physicalSectors))                                 // physical_block_exp
+	binary.LittleEndian.PutUint16(config[26:], uint16(min(physicalSectors, math.MaxUint16))) // min_io_size
+	binary.LittleEndian.PutUint16(config[34:], uint16(d.options.NumQueues))                  // num_queues
+	binary.LittleEndian.PutUint32(config[36:], maxDiscardLength/sectorSize)                  // max_discard_sectors
+	binary.LittleEndian.PutUint32(config[40:], maxDiscardSegs)                               // max_discard_seg
+	binary.LittleEndian.PutUint32(config[44:], physicalSectors)                              // discard_sector_alignment
+	binary.LittleEndian.PutUint32(config[48:], maxDiscardLength/sectorSize)                  // max_write_zeroes_sectors
+	binary.LittleEndian.PutUint32(config[52:], maxDiscardSegs)                               // max_write_zeroes_seg
+	config[56] = 1                                                                           // write_zeroes_may_unmap
+	return config
+}
+
+// handleRequest executes a virtio-blk request and returns the number of bytes written to the guest
+func (s *session) handleRequest(ctx context.Context, c *chain) uint32 {
+	if c.writable.length() == 0 {
+		s.logger.Warn("Request without status byte", "head", c.head)
+		return 0
+	}
+	statusOff := c.writable.length() - 1
+
+	if c.readable.length() < blkRequestHdrSize {
+		c.writable.scatter(statusOff, []byte{blkStatusIOErr})
+		return 1
+	}
+	header := c.readable.gather(0, blkRequestHdrSize)
+	requestType := binary.LittleEndian.Uint32(header)
+	sector := binary.LittleEndian.Uint64(header[8:])
+
+	written := uint32(1)
+	var status byte
+	switch requestType {
+	case blkTypeIn:
+		written += uint32(statusOff)
+		status = s.read(ctx, c.writable, statusOff, sector)
+	case blkTypeOut:
+		status = s.write(ctx, c.readable, sector)
+	case blkTypeFlush:
+		status = s.status(s.device.export.Backend.Flush(ctx))
+	case blkTypeGetID:
+		id := make([]byte, min(blkIDBytes, statusOff))
+		copy(id, s.device.export.Name)
+		c.writable.scatter(0, id)
+		written += uint32(len(id))
+	case blkTypeDiscard, blkTypeWriteZeroes:
+		status = s.discard(ctx, c.readable, requestType)
+	default:
+		status = blkStatusUnsupp
+	}
+
+	c.writable.scatter(statusOff, []byte{status})
+	return written
+}
+
+func (s *session) read(ctx context.Context, data buffers, length int, sector uint64) byte {
+	if length%sectorSize != 0 || length > maxRequestLength || sector > maxSector {
+		return blkStatusIOErr
+	}
+	p, direct := data.contiguous(0, length)
+	if !direct {
+		p = make([]byte, length)
+	}
+	if err := s.device.export.Backend.ReadAt(ctx, p, int64(sector*sectorSize)); err != nil {
+		return s.status(err)
+	}
+	if !direct {
+		data.scatter(0, p)
+	}
+	return blkStatusOK
+}
+
+func (s *session) write(ctx context.Context, readable buffers, sector uint64) byte {
+	length := readable.length() - blkRequestHdrSize
+	if s.device.export.ReadOnly || length%sectorSize != 0 || length > maxRequestLength || sector > maxSector {
+		return blkStatusIOErr
+	}
+	p := readable.gather(blkRequestHdrSize, length)
+	return s.status(s.device.export.Backend.WriteAt(ctx, p, int64(sector*sectorSize), 0))
+}
+
+// discard executes the segments of a discard or write zeroes request
+func (s *session) discard(ctx context.Context, readable buffers, requestType uint32) byte {
+	length := readable.length() - blkRequestHdrSize
+	if s.device.export.ReadOnly || length == 0 || length%discardSegSize != 0 || length/discardSegSize > maxDiscardSegs {
+		return blkStatusIOErr
+	}
+	segments := readable.gather(blkRequestHdrSize, length)
+	for ; len(segments) > 0; segments = segments[discardSegSize:] {
+		sector := binary.LittleEndian.Uint64(segments)
+		count := uint64(binary.LittleEndian.Uint32(segments[8:]))
+		flags := binary.LittleEndian.Uint32(segments[12:])
+		if sector > maxSector || count*sectorSize > maxDiscardLength {
+			return blkStatusIOErr
+		}
+
+		var err error
+		if requestType == blkTypeDiscard {
+			if flags != 0 {
+				return blkStatusUnsupp
+			}
+			err = s.device.export.Backend.Trim(ctx, int64(sector*sectorSize), int64(count*sectorSize), 0)
+		} else {
+			if flags&^blkWriteZeroesUnmap != 0 {
+				return blkStatusUnsupp
+			}
+			var zeroFlags backend.Flags
+			if flags&blkWriteZeroesUnmap == 0 {
+				zeroFlags = backend.FlagNoHole
+			}
+			err = s.device.export.Backend.WriteZeroes(ctx, int64(sector*sectorSize), int64(count*sectorSize), zeroFlags)
+		}
+		if status := s.status(err); status != blkStatusOK {
+			return status
+		}
+	}
+	return blkStatusOK
+}
+
+// status maps a backend error to the request status
+func (s *session) status(err error) byte {
+	switch {
+	case err == nil:
+		return blkStatusOK
+	case errors.Is(err, backend.ErrNotSupported):
+		return blkStatusUnsupp
+	default:
+		if !errors.Is(err, context.Canceled) {
+			s.logger.Warn("Request failed", "error", err)
+		}
+		return blkStatusIOErr
+	}
+}
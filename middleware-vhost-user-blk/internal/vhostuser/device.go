@@ -0,0 +1,457 @@
+package vhostuser
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"quorumbd.net/middleware-common/backend"
+)
+
+// Export is the export served by a device
+type Export struct {
+	Name      string
+	ReadOnly  bool
+	BlockSize uint32 // Internal block granularity of the volume (0: unknown)
+	Backend   backend.BlockBackend
+}
+
+// Options configure a device
+type Options struct {
+	NumQueues int // Request queues offered to the frontend
+}
+
+// Device is the vhost-user-blk device of an export. vhost-user has a single frontend per socket,
+// so the connections of the listener are served one after another.
+type Device struct {
+	logger     *slog.Logger
+	export     Export
+	options    Options
+	baseCtx    context.Context // Cancelled on close, parent of the request contexts
+	cancelBase context.CancelFunc
+	mu         sync.Mutex
+	session    *session
+	closed     bool
+}
+
+func NewDevice(parentLogger *slog.Logger, export Export, options Options) *Device {
+	if options.NumQueues <= 0 {
+		options.NumQueues = 1
+	}
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	return &Device{
+		logger:     parentLogger.With("module", "vhostuser", "export", export.Name),
+		export:     export,
+		options:    options,
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+	}
+}
+
+// Serve accepts frontend connections until the listener is closed
+func (d *Device) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		unixConn, ok := conn.(*net.UnixConn)
+		if !ok {
+			conn.Close()
+			return fmt.Errorf("vhost-user needs a unix socket, got %s", ln.Addr().Network())
+		}
+
+		s := newSession(d, unixConn)
+		if !d.track(s) {
+			unixConn.Close()
+			return nil
+		}
+		s.serve()
+		d.untrack()
+	}
+}
+
+// Close disconnects the frontend and cancels the requests in flight. Serve returns once the listener is closed.
+func (d *Device) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.cancelBase()
+	if d.session != nil {
+		d.session.conn.Close()
+	}
+}
+
+// Connected returns true, while a frontend is connected
+func (d *Device) Connected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.session != nil
+}
+
+func (d *Device) track(s *session) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.session = s
+	return true
+}
+
+func (d *Device) untrack() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.session = nil
+}
+
+// session is the connection of a frontend. Messages are handled in order by serve, the queues run in own go routines.
+type session struct {
+	device           *Device
+	logger           *slog.Logger
+	conn             *net.UnixConn
+	ctx              context.Context
+	cancel           context.CancelFunc
+	features         uint64
+	protocolFeatures uint64
+	memory           *memoryTable
+	queues           []*virtqueue
+	failOnce         sync.Once
+}
+
+func newSession(d *Device, conn *net.UnixConn) *session {
+	ctx, cancel := context.WithCancel(d.baseCtx)
+	s := &session{
+		device: d,
+		logger: d.logger,
+		conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+		queues: make([]*virtqueue, d.options.NumQueues),
+	}
+	for i := range s.queues {
+		s.queues[i] = &virtqueue{index: i}
+	}
+	return s
+}
+
+func (s *session) serve() {
+	s.logger.Info("Frontend connected")
+	defer s.close()
+
+	for {
+		msg, err := readMessage(s.conn)
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+				s.logger.Info("Frontend disconnected")
+			default:
+				s.logger.Warn("Reading message failed", "error", err)
+			}
+			return
+		}
+
+		reply, err := s.handle(msg)
+		msg.closeFDs()
+		if err != nil {
+			s.logger.Warn("Request failed", "request", msg.request, "error", err)
+			if msg.request.hasReply() || errors.Is(err, errProtocol) {
+				return
+			}
+		}
+
+		switch {
+		case msg.request.hasReply():
+			err = writeReply(s.conn, msg.request, reply)
+		case msg.flags&flagNeedReply != 0 && s.protocolFeatures&protocolFeatureReplyAck != 0:
+			ack := uint64(0)
+			if err != nil {
+				ack = 1
+			}
+			err = writeReply(s.conn, msg.request, u64Payload(ack))
+		default:
+			err = nil
+		}
+		if err != nil {
+			s.logger.Warn("Writing reply failed", "request", msg.request, "error", err)
+			return
+		}
+	}
+}
+
+// close stops the queues, cancels the requests and releases the guest memory
+func (s *session) close() {
+	s.cancel()
+	for _, vq := range s.queues {
+		vq.reset()
+	}
+	if s.memory != nil {
+		s.memory.unmap()
+		s.memory = nil
+	}
+	s.conn.Close()
+}
+
+// fail ends the session after an error of a queue, the frontend may reconnect
+func (s *session) fail(err error) {
+	s.failOnce.Do(func() {
+		s.logger.Error("Virtqueue failed, closing connection", "error", err)
+		s.conn.Close()
+	})
+}
+
+func (s *session) handle(msg *message) ([]byte, error) {
+	switch msg.request {
+	case reqGetFeatures:
+		return u64Payload(s.device.features()), nil
+	case reqSetFeatures:
+		features, err := msg.u64()
+		if err != nil {
+			return nil, err
+		}
+		if features&^s.device.features() != 0 {
+			return nil, fmt.Errorf("unsupported features %#x", features&^s.device.features())
+		}
+		s.features = features
+		return nil, nil
+	case reqSetOwner:
+		return nil, nil
+	case reqResetOwner:
+		for _, vq := range s.queues {
+			vq.reset()
+		}
+		s.features = 0
+		return nil, nil
+	case reqGetProtocolFeatures:
+		return u64Payload(supportedProtocolFeatures), nil
+	case reqSetProtocolFeatures:
+		features, err := msg.u64()
+		if err != nil {
+			return nil, err
+		}
+		s.protocolFeatures = features & supportedProtocolFeatures
+		return nil, nil
+	case reqGetQueueNum:
+		return u64Payload(uint64(len(s.queues))), nil
+	case reqSetMemTable:
+		return nil, s.setMemTable(msg)
+	case reqSetVringNum:
+		return nil, s.setVringNum(msg)
+	case reqSetVringAddr:
+		return nil, s.setVringAddr(msg)
+	case reqSetVringBase:
+		vq, base, err := s.vringState(msg)
+		if err != nil {
+			return nil, err
+		}
+		vq.stop()
+		vq.lastAvail = uint16(base)
+		return nil, nil
+	case reqGetVringBase:
+		vq, _, err := s.vringState(msg)
+		if err != nil {
+			return nil, err
+		}
+		// The ring stops until the next SET_VRING_KICK
+		vq.stop()
+		vq.setKick(nil)
+		reply := make([]byte, 8)
+		binary.LittleEndian.PutUint32(reply, uint32(vq.index))
+		binary.LittleEndian.PutUint32(reply[4:], uint32(vq.lastAvail))
+		return reply, nil
+	case reqSetVringKick:
+		return nil, s.setVringKick(msg)
+	case reqSetVringCall:
+		vq, file, err := s.vringFile(msg, "call")
+		if err != nil {
+			return nil, err
+		}
+		vq.setCall(file)
+		return nil, nil
+	case reqSetVringErr:
+		// Errors are reported by closing the connection, so the error eventfd is never signalled
+		_, file, err := s.vringFile(msg, "err")
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	case reqSetVringEnable:
+		// virtio-blk has no use for disabled rings: like other block backends the rings are processed once started
+		_, _, err := s.vringState(msg)
+		return nil, err
+	case reqGetConfig:
+		return s.getConfig(msg)
+	case reqSetConfig:
+		// The writeback field is the only writable one, but the cache mode is not negotiable (VIRTIO_BLK_F_CONFIG_WCE)
+		return nil, fmt.Errorf("%w: config space is read-only", backend.ErrNotSupported)
+	default:
+		return nil, fmt.Errorf("%w: request %s", backend.ErrNotSupported, msg.request)
+	}
+}
+
+// setMemTable replaces the guest memory. Running queues are stopped and restarted with the new table.
+func (s *session) setMemTable(msg *message) error {
+	memory, err := mapMemoryTable(msg.payload, msg.fds)
+	if err != nil {
+		return err
+	}
+	msg.closeFDs() // The mappings keep the memory
+
+	var running []*virtqueue
+	for _, vq := range s.queues {
+		if vq.running() {
+			vq.stop()
+			running = append(running, vq)
+		}
+	}
+	if s.memory != nil {
+		s.memory.unmap()
+	}
+	s.memory = memory
+
+	for _, vq := range running {
+		if err := s.startQueue(vq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) setVringNum(msg *message) error {
+	vq, num, err := s.vringState(msg)
+	if err != nil {
+		return err
+	}
+	if num == 0 || num > maxQueueSize || num&(num-1) != 0 {
+		return fmt.Errorf("invalid size %d of queue %d", num, vq.index)
+	}
+	vq.stop()
+	vq.size = uint16(num)
+	return nil
+}
+
+func (s *session) setVringAddr(msg *message) error {
+	if len(msg.payload) < 40 {
+		return fmt.Errorf("%w: %s payload too short", errProtocol, msg.request)
+	}
+	vq, err := s.queue(binary.LittleEndian.Uint32(msg.payload))
+	if err != nil {
+		return err
+	}
+	descAddr := binary.LittleEndian.Uint64(msg.payload[8:])
+	usedAddr := binary.LittleEndian.Uint64(msg.payload[16:])
+	availAddr := binary.LittleEndian.Uint64(msg.payload[24:])
+	if descAddr%16 != 0 || availAddr%2 != 0 || usedAddr%4 != 0 {
+		return fmt.Errorf("%w: misaligned rings of queue %d", errProtocol, vq.index)
+	}
+
+	vq.stop()
+	vq.descAddr, vq.usedAddr, vq.availAddr = descAddr, usedAddr, availAddr
+	vq.addressed = true
+	return nil
+}
+
+// setVringKick sets the kick eventfd and starts the queue
+func (s *session) setVringKick(msg *message) error {
+	vq, file, err := s.vringFile(msg, "kick")
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("%w: polling queue %d without kick", backend.ErrNotSupported, vq.index)
+	}
+	if err := file.SetReadDeadline(time.Time{}); err != nil {
+		file.Close()
+		return fmt.Errorf("kick of queue %d: %w", vq.index, err)
+	}
+
+	vq.stop()
+	vq.setKick(file)
+	return s.startQueue(vq)
+}
+
+func (s *session) startQueue(vq *virtqueue) error {
+	if vq.running() || !vq.ready() || s.memory == nil {
+		return nil
+	}
+	if err := vq.translate(s.memory); err != nil {
+		return err
+	}
+	vq.start(func(c *chain) {
+		written := s.handleRequest(s.ctx, c)
+		if err := vq.push(c.head, written); err != nil {
+			s.fail(fmt.Errorf("notifying queue %d: %w", vq.index, err))
+		}
+	}, s.fail)
+	return nil
+}
+
+func (s *session) getConfig(msg *message) ([]byte, error) {
+	if len(msg.payload) < 12 {
+		return nil, fmt.Errorf("%w: %s payload too short", errProtocol, msg.request)
+	}
+	offset := binary.LittleEndian.Uint32(msg.payload)
+	size := binary.LittleEndian.Uint32(msg.payload[4:])
+	if offset > maxConfigSize || size > maxConfigSize-offset {
+		return nil, fmt.Errorf("config range %d+%d out of bounds", offset, size)
+	}
+
+	// The reply has the size of the request, which may exceed the fields of the device (zeroes)
+	reply := make([]byte, 12+size)
+	copy(reply, msg.payload[:12])
+	copy(reply[12:], s.device.config()[offset:offset+size])
+	return reply, nil
+}
+
+func (s *session) queue(index uint32) (*virtqueue, error) {
+	if index >= uint32(len(s.queues)) {
+		return nil, fmt.Errorf("queue %d of %d", index, len(s.queues))
+	}
+	return s.queues[index], nil
+}
+
+func (s *session) vringState(msg *message) (*virtqueue, uint32, error) {
+	index, num, err := msg.vringState()
+	if err != nil {
+		return nil, 0, err
+	}
+	vq, err := s.queue(index)
+	return vq, num, err
+}
+
+// vringFile decodes SET_VRING_KICK, SET_VRING_CALL and SET_VRING_ERR. The file is nil, if the frontend passed no fd.
+func (s *session) vringFile(msg *message, name string) (*virtqueue, *os.File, error) {
+	value, err := msg.u64()
+	if err != nil {
+		return nil, nil, err
+	}
+	vq, err := s.queue(uint32(value & vringIndexMask))
+	if err != nil {
+		return nil, nil, err
+	}
+	if value&vringNoFD != 0 {
+		return vq, nil, nil
+	}
+
+	fd, err := msg.takeFD()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Non-blocking eventfds are served by the runtime poller, so reads can be interrupted with deadlines
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	return vq, os.NewFile(uintptr(fd), fmt.Sprintf("%s-%s-%d", s.device.export.Name, name, vq.index)), nil
+}
@@ -0,0 +1,56 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func vringAddrPayload(index uint32, descAddr, usedAddr, availAddr uint64) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, index)
+	payload = binary.LittleEndian.AppendUint32(payload, 0) // Flags
+	payload = binary.LittleEndian.AppendUint64(payload, descAddr)
+	payload = binary.LittleEndian.AppendUint64(payload, usedAddr)
+	payload = binary.LittleEndian.AppendUint64(payload, availAddr)
+	return binary.LittleEndian.AppendUint64(payload, 0) // Log address
+}
+
+func TestSetVringAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		wantErr  bool
+		protocol bool // The error is a protocol error
+	}{
+		{name: "aligned", payload: vringAddrPayload(1, 0x1000, 0x3000, 0x2000)},
+		{name: "minimal alignment", payload: vringAddrPayload(0, 0x1010, 0x3004, 0x2002)},
+		{name: "short", payload: vringAddrPayload(0, 0x1000, 0x3000, 0x2000)[:39], wantErr: true, protocol: true},
+		{name: "misaligned descriptors", payload: vringAddrPayload(0, 0x1008, 0x3000, 0x2000), wantErr: true, protocol: true},
+		{name: "misaligned used ring", payload: vringAddrPayload(0, 0x1000, 0x3002, 0x2000), wantErr: true, protocol: true},
+		{name: "misaligned available ring", payload: vringAddrPayload(0, 0x1000, 0x3000, 0x2001), wantErr: true, protocol: true},
+		{name: "unknown queue", payload: vringAddrPayload(2, 0x1000, 0x3000, 0x2000), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSession(NewDevice(slog.New(slog.DiscardHandler), Export{Name: "disk"}, Options{NumQueues: 2}), nil)
+			err := s.setVringAddr(&message{request: reqSetVringAddr, payload: test.payload})
+			if (err != nil) != test.wantErr || errors.Is(err, errProtocol) != test.protocol {
+				t.Fatalf("error %v, want error %t (protocol error %t)", err, test.wantErr, test.protocol)
+			}
+			if test.wantErr {
+				for _, vq := range s.queues {
+					if vq.addressed {
+						t.Fatalf("queue %d addressed by a failed request", vq.index)
+					}
+				}
+				return
+			}
+			vq := s.queues[binary.LittleEndian.Uint32(test.payload)]
+			if !vq.addressed || vq.descAddr != binary.LittleEndian.Uint64(test.payload[8:]) ||
+				vq.usedAddr != binary.LittleEndian.Uint64(test.payload[16:]) || vq.availAddr != binary.LittleEndian.Uint64(test.payload[24:]) {
+				t.Fatalf("queue addresses desc %#x used %#x avail %#x", vq.descAddr, vq.usedAddr, vq.availAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"syscall"
+)
+
+const memoryRegionSize = 32
+
+// region is a part of the guest memory shared by the frontend
+type region struct {
+	guestAddr uint64 // Guest physical address (used by the descriptors)
+	userAddr  uint64 // Virtual address in the frontend process (used by the ring addresses)
+	size      uint64
+	mapping   []byte // Whole mapping of the fd, the region starts at its mmap offset
+	data      []byte
+}
+
+// memoryTable is the guest memory of SET_MEM_TABLE. It is only replaced while all queues are stopped,
+// so the queues access it without locking.
+type memoryTable struct {
+	regions []region
+}
+
+// mapMemoryTable maps the regions of a SET_MEM_TABLE payload, one fd per region. The fds are closed after mapping.
+func mapMemoryTable(payload []byte, fds []int) (*memoryTable, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("%w: memory table too short", errProtocol)
+	}
+	count := int(binary.LittleEndian.Uint32(payload))
+	if count == 0 || count > maxFDs || count != len(fds) || len(payload) < 8+count*memoryRegionSize {
+		return nil, fmt.Errorf("%w: memory table with %d regions and %d fds", errProtocol, count, len(fds))
+	}
+
+	table := &memoryTable{regions: make([]region, 0, count)}
+	for i := range count {
+		entry := payload[8+i*memoryRegionSize:]
+		r := region{
+			guestAddr: binary.LittleEndian.Uint64(entry),
+			size:      binary.LittleEndian.Uint64(entry[8:]),
+			userAddr:  binary.LittleEndian.Uint64(entry[16:]),
+		}
+		mmapOffset := binary.LittleEndian.Uint64(entry[24:])
+		if r.size == 0 || mmapOffset > math.MaxInt || r.size > math.MaxInt-mmapOffset {
+			table.unmap()
+			return nil, fmt.Errorf("%w: memory region %d of %d bytes at mmap offset %d", errProtocol, i, r.size, mmapOffset)
+		}
+
+		// The mmap offset need not be page aligned, so the fd is mapped from the start
+		mapping, err := syscall.Mmap(fds[i], 0, int(r.size+mmapOffset), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			table.unmap()
+			return nil, fmt.Errorf("mapping memory region %d: %w", i, err)
+		}
+		r.mapping = mapping
+		r.data = mapping[mmapOffset : mmapOffset+r.size : mmapOffset+r.size]
+		table.regions = append(table.regions, r)
+	}
+	return table, nil
+}
+
+func (m *memoryTable) unmap() {
+	for _, r := range m.regions {
+		syscall.Munmap(r.mapping)
+	}
+	m.regions = nil
+}
+
+// appendGuest appends the buffers of a guest physical range to bufs. The range may span adjacent regions.
+func (m *memoryTable) appendGuest(bufs [][]byte, addr uint64, length uint64) ([][]byte, error) {
+	for length > 0 {
+		r := m.findGuest(addr)
+		if r == nil {
+			return bufs, fmt.Errorf("guest address %#x is not mapped", addr)
+		}
+		off := addr - r.guestAddr
+		n := min(length, r.size-off)
+		bufs = append(bufs, r.data[off:off+n:off+n])
+		addr += n
+		length -= n
+	}
+	return bufs, nil
+}
+
+// guest returns a guest physical range that lies within one region (e.g. an indirect descriptor table)
+func (m *memoryTable) guest(addr uint64, length uint64) ([]byte, error) {
+	r := m.findGuest(addr)
+	if r == nil || length > r.size-(addr-r.guestAddr) {
+		return nil, fmt.Errorf("guest range %#x+%d is not mapped", addr, length)
+	}
+	off := addr - r.guestAddr
+	return r.data[off : off+length : off+length], nil
+}
+
+// user returns a range of the frontend address space (the rings of SET_VRING_ADDR)
+func (m *memoryTable) user(addr uint64, length uint64) ([]byte, error) {
+	for i := range m.regions {
+		r := &m.regions[i]
+		if addr >= r.userAddr && addr-r.userAddr < r.size {
+			off := addr - r.userAddr
+			if length > r.size-off {
+				break
+			}
+			return r.data[off : off+length : off+length], nil
+		}
+	}
+	return nil, fmt.Errorf("frontend range %#x+%d is not mapped", addr, length)
+}
+
+func (m *memoryTable) findGuest(addr uint64) *region {
+	for i := range m.regions {
+		r := &m.regions[i]
+		if addr >= r.guestAddr && addr-r.guestAddr < r.size {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package vhostuser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const pageSize = 4096
+
+// memoryRegion is an entry of a SET_MEM_TABLE payload
+type memoryRegion struct {
+	guestAddr  uint64
+	size       uint64
+	userAddr   uint64
+	mmapOffset uint64
+}
+
+func memoryTablePayload(count uint32, regions ...memoryRegion) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, count)
+	payload = binary.LittleEndian.AppendUint32(payload, 0) // Padding
+	for _, r := range regions {
+		payload = binary.LittleEndian.AppendUint64(payload, r.guestAddr)
+		payload = binary.LittleEndian.AppendUint64(payload, r.size)
+		payload = binary.LittleEndian.AppendUint64(payload, r.userAddr)
+		payload = binary.LittleEndian.AppendUint64(payload, r.mmapOffset)
+	}
+	return payload
+}
+
+// guestMemory returns n fds of a file of three pages, page i is filled with the byte i+1
+func guestMemory(t *testing.T, n int) []int {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "memory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	for i := range 3 {
+		if _, err := f.Write(bytes.Repeat([]byte{byte(i + 1)}, pageSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fds := make([]int, n)
+	for i := range fds {
+		fds[i] = int(f.Fd())
+	}
+	return fds
+}
+
+// Regions of the guest memory: guest [0, 2 pages) are the pages 1 and 2 of the file, guest [2 pages, 3 pages) is page 0
+var testRegions = []memoryRegion{
+	{guestAddr: 0, size: 2 * pageSize, userAddr: 0x10000, mmapOffset: pageSize},
+	{guestAddr: 2 * pageSize, size: pageSize, userAddr: 0x20000, mmapOffset: 0},
+}
+
+func TestMapMemoryTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		fds     int
+	}{
+		{name: "short", payload: memoryTablePayload(1)[:4], fds: 1},
+		{name: "no regions", payload: memoryTablePayload(0), fds: 0},
+		{name: "too many regions", payload: memoryTablePayload(maxFDs + 1), fds: maxFDs + 1},
+		{name: "fewer fds than regions", payload: memoryTablePayload(2, testRegions...), fds: 1},
+		{name: "missing region", payload: memoryTablePayload(2, testRegions[0]), fds: 2},
+		{name: "empty region", payload: memoryTablePayload(2, testRegions[0], memoryRegion{guestAddr: 2 * pageSize, userAddr: 0x20000}), fds: 2},
+		{name: "size overflow", payload: memoryTablePayload(1, memoryRegion{size: math.MaxUint64 - pageSize + 1, mmapOffset: pageSize}), fds: 1},
+		{name: "size beyond int", payload: memoryTablePayload(1, memoryRegion{size: math.MaxInt, mmapOffset: 1}), fds: 1},
+		{name: "offset beyond int", payload: memoryTablePayload(1, memoryRegion{size: pageSize, mmapOffset: math.MaxInt + 1}), fds: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := mapMemoryTable(test.payload, guestMemory(t, test.fds)); !errors.Is(err, errProtocol) {
+				t.Fatalf("error %v, want %v", err, errProtocol)
+			}
+		})
+	}
+}
+
+func TestMemoryTableLookups(t *testing.T) {
+	memory, err := mapMemoryTable(memoryTablePayload(2, testRegions...), guestMemory(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.unmap()
+
+	page := func(value byte, n int) []byte {
+		return bytes.Repeat([]byte{value}, n)
+	}
+	tests := []struct {
+		name   string
+		lookup func() ([][]byte, error)
+		want   []byte // Concatenated buffers, nil for an error
+	}{
+		{name: "guest", lookup: single(func() ([]byte, error) { return memory.guest(pageSize+16, 32) }), want: page(3, 32)},
+		{name: "guest end of region", lookup: single(func() ([]byte, error) { return memory.guest(3*pageSize-8, 8) }), want: page(1, 8)},
+		{name: "guest across regions", lookup: single(func() ([]byte, error) { return memory.guest(2*pageSize-8, 16) })},
+		{name: "guest unmapped", lookup: single(func() ([]byte, error) { return memory.guest(3*pageSize, 1) })},
+		{name: "guest length overflow", lookup: single(func() ([]byte, error) { return memory.guest(pageSize, math.MaxUint64) })},
+		{
+			name:   "append across regions",
+			lookup: func() ([][]byte, error) { return memory.appendGuest(nil, pageSize, 2*pageSize) },
+			want:   append(page(3, pageSize), page(1, pageSize)...),
+		},
+		{name: "append past the end", lookup: func() ([][]byte, error) { return memory.appendGuest(nil, 2*pageSize, pageSize+1) }},
+		{name: "user", lookup: single(func() ([]byte, error) { return memory.user(0x10000+8, 8) }), want: page(2, 8)},
+		{name: "user second region", lookup: single(func() ([]byte, error) { return memory.user(0x20000, pageSize) }), want: page(1, pageSize)},
+		{name: "user past the region", lookup: single(func() ([]byte, error) { return memory.user(0x20000+pageSize-4, 8) })},
+		{name: "user unmapped", lookup: single(func() ([]byte, error) { return memory.user(0x30000, 1) })},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bufs, err := test.lookup()
+			if test.want == nil {
+				if err == nil {
+					t.Fatal("lookup of an unmapped range succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Join(bufs, nil); !bytes.Equal(got, test.want) {
+				t.Fatalf("lookup returned %d bytes differing from the guest memory", len(got))
+			}
+		})
+	}
+
+	// The regions share the guest memory with the frontend
+	buf, err := memory.guest(2*pageSize, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 0xff
+	if alias, err := memory.user(0x20000, 1); err != nil || alias[0] != 0xff {
+		t.Fatalf("write through the guest address is not visible through the frontend address: %v", err)
+	}
+}
+
+func single(lookup func() ([]byte, error)) func() ([][]byte, error) {
+	return func() ([][]byte, error) {
+		buf, err := lookup()
+		return [][]byte{buf}, err
+	}
+}
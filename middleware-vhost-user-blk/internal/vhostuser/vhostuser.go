@@ -0,0 +1,243 @@
+// Package vhostuser provides the vhost-user backend of a virtio-blk device: the frontend (e.g. QEMU) shares the guest memory
+// and the device processes the split virtqueues of the guest driver in place
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	headerSize     = 12
+	maxPayloadSize = 4096 // Largest payload of the supported requests is the memory table (8 + 8*32 bytes)
+	maxFDs         = 8    // VHOST_MEMORY_BASELINE_NREGIONS, the most fds of a single message
+)
+
+// Header flags
+const (
+	flagVersion     uint32 = 0x1
+	flagVersionMask uint32 = 0x3
+	flagReply       uint32 = 0x4
+	flagNeedReply   uint32 = 0x8
+)
+
+type request uint32
+
+// Frontend requests
+const (
+	reqGetFeatures         request = 1
+	reqSetFeatures         request = 2
+	reqSetOwner            request = 3
+	reqResetOwner          request = 4
+	reqSetMemTable         request = 5
+	reqSetVringNum         request = 8
+	reqSetVringAddr        request = 9
+	reqSetVringBase        request = 10
+	reqGetVringBase        request = 11
+	reqSetVringKick        request = 12
+	reqSetVringCall        request = 13
+	reqSetVringErr         request = 14
+	reqGetProtocolFeatures request = 15
+	reqSetProtocolFeatures request = 16
+	reqGetQueueNum         request = 17
+	reqSetVringEnable      request = 18
+	reqGetConfig           request = 24
+	reqSetConfig           request = 25
+)
+
+var requestNames = map[request]string{
+	reqGetFeatures:         "GET_FEATURES",
+	reqSetFeatures:         "SET_FEATURES",
+	reqSetOwner:            "SET_OWNER",
+	reqResetOwner:          "RESET_OWNER",
+	reqSetMemTable:         "SET_MEM_TABLE",
+	reqSetVringNum:         "SET_VRING_NUM",
+	reqSetVringAddr:        "SET_VRING_ADDR",
+	reqSetVringBase:        "SET_VRING_BASE",
+	reqGetVringBase:        "GET_VRING_BASE",
+	reqSetVringKick:        "SET_VRING_KICK",
+	reqSetVringCall:        "SET_VRING_CALL",
+	reqSetVringErr:         "SET_VRING_ERR",
+	reqGetProtocolFeatures: "GET_PROTOCOL_FEATURES",
+	reqSetProtocolFeatures: "SET_PROTOCOL_FEATURES",
+	reqGetQueueNum:         "GET_QUEUE_NUM",
+	reqSetVringEnable:      "SET_VRING_ENABLE",
+	reqGetConfig:           "GET_CONFIG",
+	reqSetConfig:           "SET_CONFIG",
+}
+
+func (r request) String() string {
+	if name, ok := requestNames[r]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(r), 10)
+}
+
+// hasReply returns true for the requests that are always answered (independent of REPLY_ACK)
+func (r request) hasReply() bool {
+	switch r {
+	case reqGetFeatures, reqGetProtocolFeatures, reqGetVringBase, reqGetQueueNum, reqGetConfig:
+		return true
+	default:
+		return false
+	}
+}
+
+// Virtio feature bits
+const (
+	featureBlkSegMax        uint64 = 1 << 2
+	featureBlkRO            uint64 = 1 << 5
+	featureBlkBlkSize       uint64 = 1 << 6
+	featureBlkFlush         uint64 = 1 << 9
+	featureBlkTopology      uint64 = 1 << 10
+	featureBlkMQ            uint64 = 1 << 12
+	featureBlkDiscard       uint64 = 1 << 13
+	featureBlkWriteZeroes   uint64 = 1 << 14
+	featureRingIndirectDesc uint64 = 1 << 28
+	featureProtocolFeatures uint64 = 1 << 30 // VHOST_USER_F_PROTOCOL_FEATURES
+	featureVersion1         uint64 = 1 << 32
+)
+
+// Protocol feature bits
+const (
+	protocolFeatureMQ       uint64 = 1 << 0
+	protocolFeatureReplyAck uint64 = 1 << 3
+	protocolFeatureConfig   uint64 = 1 << 9
+
+	supportedProtocolFeatures = protocolFeatureMQ | protocolFeatureReplyAck | protocolFeatureConfig
+)
+
+// Payload of the vring fd requests
+const (
+	vringIndexMask uint64 = 0xff
+	vringNoFD      uint64 = 1 << 8
+)
+
+var errProtocol = errors.New("vhost-user protocol error")
+
+type message struct {
+	request request
+	flags   uint32
+	payload []byte
+	fds     []int // Received fds, closed after handling unless taken
+}
+
+// takeFD removes the first fd from the message, the caller owns it
+func (msg *message) takeFD() (int, error) {
+	if len(msg.fds) == 0 {
+		return -1, fmt.Errorf("%w: %s without fd", errProtocol, msg.request)
+	}
+	fd := msg.fds[0]
+	msg.fds = msg.fds[1:]
+	return fd, nil
+}
+
+func (msg *message) closeFDs() {
+	for _, fd := range msg.fds {
+		syscall.Close(fd)
+	}
+	msg.fds = nil
+}
+
+func (msg *message) u64() (uint64, error) {
+	if len(msg.payload) < 8 {
+		return 0, fmt.Errorf("%w: %s payload too short", errProtocol, msg.request)
+	}
+	return binary.LittleEndian.Uint64(msg.payload), nil
+}
+
+// vringState decodes the payload of SET_VRING_NUM, SET_VRING_BASE, GET_VRING_BASE and SET_VRING_ENABLE
+func (msg *message) vringState() (uint32, uint32, error) {
+	if len(msg.payload) < 8 {
+		return 0, 0, fmt.Errorf("%w: %s payload too short", errProtocol, msg.request)
+	}
+	return binary.LittleEndian.Uint32(msg.payload), binary.LittleEndian.Uint32(msg.payload[4:]), nil
+}
+
+// readMessage reads the next frontend message. The fds are passed with the header.
+func readMessage(conn *net.UnixConn) (*message, error) {
+	header := make([]byte, headerSize)
+	oob := make([]byte, syscall.CmsgSpace(maxFDs*4))
+
+	n, oobn, flags, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	msg := &message{}
+	if oobn > 0 {
+		if msg.fds, err = parseFDs(oob[:oobn]); err != nil {
+			return nil, err
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		msg.closeFDs()
+		return nil, fmt.Errorf("%w: too many fds", errProtocol)
+	}
+
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		msg.closeFDs()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF // Part of the header was read, this is no clean disconnect
+		}
+		return nil, err
+	}
+	msg.request = request(binary.LittleEndian.Uint32(header))
+	msg.flags = binary.LittleEndian.Uint32(header[4:])
+	size := binary.LittleEndian.Uint32(header[8:])
+
+	if msg.flags&flagVersionMask != flagVersion {
+		msg.closeFDs()
+		return nil, fmt.Errorf("%w: unsupported version %d", errProtocol, msg.flags&flagVersionMask)
+	}
+	if size > maxPayloadSize {
+		msg.closeFDs()
+		return nil, fmt.Errorf("%w: %s payload of %d bytes", errProtocol, msg.request, size)
+	}
+
+	msg.payload = make([]byte, size)
+	if _, err := io.ReadFull(conn, msg.payload); err != nil {
+		msg.closeFDs()
+		return nil, err
+	}
+	return msg, nil
+}
+
+func parseFDs(oob []byte) ([]int, error) {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range cmsgs {
+		rights, err := syscall.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// writeReply sends the reply to a request
+func writeReply(conn *net.UnixConn, req request, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(req))
+	binary.LittleEndian.PutUint32(buf[4:], flagVersion|flagReply)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func u64Payload(value uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, value)
+}
@@ -0,0 +1,175 @@
+package vhostuser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// socketPair returns the frontend and the backend end of a connected vhost-user socket
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "vhost-user")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+		t.Cleanup(func() { conns[i].Close() })
+	}
+	return conns[0], conns[1]
+}
+
+// rawMessage encodes a frontend message with the given header size (payload may differ for malformed messages)
+func rawMessage(req request, flags uint32, size uint32, payload []byte) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(req))
+	buf = binary.LittleEndian.AppendUint32(buf, flags)
+	buf = binary.LittleEndian.AppendUint32(buf, size)
+	return append(buf, payload...)
+}
+
+// openFDs returns n fds that are closed when the test ends
+func openFDs(t *testing.T, n int) []int {
+	t.Helper()
+	fds := make([]int, n)
+	for i := range fds {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			r.Close()
+			w.Close()
+		})
+		fds[i] = int(r.Fd())
+	}
+	return fds
+}
+
+func TestReadMessage(t *testing.T) {
+	vringState := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 1), 256)
+	tests := []struct {
+		name    string
+		data    []byte
+		fds     int  // Fds passed with the first byte
+		close   bool // The frontend closes after the data
+		request request
+		flags   uint32
+		payload []byte
+		err     error // Expected error (errProtocol or an io error)
+	}{
+		{name: "header only", data: rawMessage(reqGetFeatures, flagVersion, 0, nil), request: reqGetFeatures, flags: flagVersion, payload: []byte{}},
+		{name: "payload", data: rawMessage(reqSetVringNum, flagVersion|flagNeedReply, 8, vringState), request: reqSetVringNum, flags: flagVersion | flagNeedReply, payload: vringState},
+		{name: "fd", data: rawMessage(reqSetVringKick, flagVersion, 8, u64Payload(0)), fds: 1, request: reqSetVringKick, flags: flagVersion, payload: u64Payload(0)},
+		{name: "all fds", data: rawMessage(reqSetMemTable, flagVersion, 0, nil), fds: maxFDs, request: reqSetMemTable, flags: flagVersion, payload: []byte{}},
+		{name: "too many fds", data: rawMessage(reqSetMemTable, flagVersion, 0, nil), fds: maxFDs + 1, err: errProtocol},
+		{name: "no version", data: rawMessage(reqGetFeatures, 0, 0, nil), err: errProtocol},
+		{name: "unsupported version", data: rawMessage(reqGetFeatures, 2, 0, nil), err: errProtocol},
+		{name: "payload too large", data: rawMessage(reqSetMemTable, flagVersion, maxPayloadSize+1, nil), err: errProtocol},
+		{name: "closed", close: true, err: io.EOF},
+		{name: "truncated header", data: rawMessage(reqGetFeatures, flagVersion, 0, nil)[:6], close: true, err: io.ErrUnexpectedEOF},
+		{name: "truncated payload", data: rawMessage(reqSetVringNum, flagVersion, 8, vringState[:4]), close: true, err: io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frontend, backend := socketPair(t)
+			if len(test.data) > 0 {
+				var oob []byte
+				if test.fds > 0 {
+					oob = syscall.UnixRights(openFDs(t, test.fds)...)
+				}
+				if _, _, err := frontend.WriteMsgUnix(test.data, oob, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.close {
+				frontend.Close()
+			}
+
+			msg, err := readMessage(backend)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer msg.closeFDs()
+			if msg.request != test.request || msg.flags != test.flags || !bytes.Equal(msg.payload, test.payload) || len(msg.fds) != test.fds {
+				t.Fatalf("message %s flags %#x payload %x with %d fds", msg.request, msg.flags, msg.payload, len(msg.fds))
+			}
+		})
+	}
+}
+
+func TestMessagePayloads(t *testing.T) {
+	vringState := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 1), 256)
+	tests := []struct {
+		name    string
+		payload []byte
+		value   uint64
+		index   uint32
+		num     uint32
+		wantErr bool
+	}{
+		{name: "vring state", payload: vringState, value: 256<<32 | 1, index: 1, num: 256},
+		{name: "longer payload", payload: append(u64Payload(7), 0, 0), value: 7, index: 7, num: 0},
+		{name: "short", payload: vringState[:7], wantErr: true},
+		{name: "empty", payload: nil, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &message{request: reqSetVringNum, payload: test.payload}
+			value, err := msg.u64()
+			if (err != nil) != test.wantErr || (err != nil && !errors.Is(err, errProtocol)) {
+				t.Fatalf("u64: error %v, want error %t", err, test.wantErr)
+			}
+			index, num, err := msg.vringState()
+			if (err != nil) != test.wantErr || (err != nil && !errors.Is(err, errProtocol)) {
+				t.Fatalf("vring state: error %v, want error %t", err, test.wantErr)
+			}
+			if !test.wantErr && (value != test.value || index != test.index || num != test.num) {
+				t.Fatalf("u64 %d, vring state %d/%d", value, index, num)
+			}
+		})
+	}
+}
+
+func TestTakeFD(t *testing.T) {
+	fds := openFDs(t, 1)
+	msg := &message{request: reqSetVringCall, fds: fds}
+	if fd, err := msg.takeFD(); err != nil || fd != fds[0] || len(msg.fds) != 0 {
+		t.Fatalf("took fd %d (%v), %d fds left", fd, err, len(msg.fds))
+	}
+	if _, err := msg.takeFD(); !errors.Is(err, errProtocol) {
+		t.Fatalf("error %v, want %v", err, errProtocol)
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	frontend, backend := socketPair(t)
+	if err := writeReply(backend, reqGetFeatures, u64Payload(featureVersion1)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, headerSize+8)
+	if _, err := io.ReadFull(frontend, got); err != nil {
+		t.Fatal(err)
+	}
+	if want := rawMessage(reqGetFeatures, flagVersion|flagReply, 8, u64Payload(featureVersion1)); !bytes.Equal(got, want) {
+		t.Fatalf("reply %x, want %x", got, want)
+	}
+}
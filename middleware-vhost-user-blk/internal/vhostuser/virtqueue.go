@@ -0,0 +1,267 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	maxQueueSize = 32768
+	descSize     = 16
+)
+
+// Descriptor and ring flags of split virtqueues
+const (
+	descFlagNext         uint16 = 1
+	descFlagWrite        uint16 = 2
+	descFlagIndirect     uint16 = 4
+	availFlagNoInterrupt uint16 = 1
+)
+
+// chain is the guest memory of a request: the device reads the readable buffers and writes the writable ones
+type chain struct {
+	head     uint16
+	readable buffers
+	writable buffers
+}
+
+// virtqueue is a split virtqueue. The session configures it while it is stopped. While it runs, the worker owns
+// lastAvail and the ring memory, completions are serialized by usedMu.
+type virtqueue struct {
+	index     int
+	size      uint16
+	descAddr  uint64 // Frontend virtual addresses of SET_VRING_ADDR
+	availAddr uint64
+	usedAddr  uint64
+	addressed bool
+	lastAvail uint16
+	kick      *os.File
+
+	mem   *memoryTable // Memory table the rings were translated with
+	desc  []byte
+	avail []byte
+	used  []byte
+
+	usedMu  sync.Mutex
+	usedIdx uint16
+	call    *os.File // nil: the frontend polls the used ring
+
+	done     chan struct{} // nil while stopped
+	inFlight sync.WaitGroup
+}
+
+func (vq *virtqueue) running() bool {
+	return vq.done != nil
+}
+
+// ready returns true, if the queue is configured completely
+func (vq *virtqueue) ready() bool {
+	return vq.size > 0 && vq.addressed && vq.kick != nil
+}
+
+// translate resolves the ring addresses in the memory table
+func (vq *virtqueue) translate(memory *memoryTable) error {
+	size := uint64(vq.size)
+	var err error
+	if vq.desc, err = memory.user(vq.descAddr, descSize*size); err != nil {
+		return fmt.Errorf("descriptor table of queue %d: %w", vq.index, err)
+	}
+	if vq.avail, err = memory.user(vq.availAddr, 6+2*size); err != nil {
+		return fmt.Errorf("available ring of queue %d: %w", vq.index, err)
+	}
+	if vq.used, err = memory.user(vq.usedAddr, 6+8*size); err != nil {
+		return fmt.Errorf("used ring of queue %d: %w", vq.index, err)
+	}
+	vq.mem = memory
+	return nil
+}
+
+// start runs the worker of a ready queue, which processes the available ring on every kick
+func (vq *virtqueue) start(process func(*chain), fail func(error)) {
+	vq.usedIdx = load16(vq.used, 2)
+	vq.done = make(chan struct{})
+	go vq.run(process, fail)
+}
+
+// stop stops the worker and waits for the requests in flight, so the ring memory is not used afterwards
+func (vq *virtqueue) stop() {
+	if !vq.running() {
+		return
+	}
+	vq.kick.SetReadDeadline(time.Now())
+	<-vq.done
+	vq.done = nil
+	vq.kick.SetReadDeadline(time.Time{})
+	vq.inFlight.Wait()
+}
+
+// reset stops the queue and returns it to its initial state
+func (vq *virtqueue) reset() {
+	vq.stop()
+	vq.size = 0
+	vq.addressed = false
+	vq.lastAvail = 0
+	vq.mem, vq.desc, vq.avail, vq.used = nil, nil, nil, nil
+	vq.setKick(nil)
+	vq.setCall(nil)
+}
+
+func (vq *virtqueue) setKick(kick *os.File) {
+	if vq.kick != nil {
+		vq.kick.Close()
+	}
+	vq.kick = kick
+}
+
+// setCall replaces the call eventfd, which is allowed while the queue runs
+func (vq *virtqueue) setCall(call *os.File) {
+	vq.usedMu.Lock()
+	defer vq.usedMu.Unlock()
+	if vq.call != nil {
+		vq.call.Close()
+	}
+	vq.call = call
+}
+
+func (vq *virtqueue) run(process func(*chain), fail func(error)) {
+	defer close(vq.done)
+
+	buf := make([]byte, 8)
+	for {
+		if err := vq.pop(process); err != nil {
+			fail(err)
+			return
+		}
+		if _, err := vq.kick.Read(buf); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, os.ErrClosed) {
+				fail(fmt.Errorf("reading kick of queue %d: %w", vq.index, err))
+			}
+			return
+		}
+	}
+}
+
+// pop hands all new requests of the available ring to process, each in its own go routine
+func (vq *virtqueue) pop(process func(*chain)) error {
+	for {
+		availIdx := load16(vq.avail, 2)
+		if availIdx == vq.lastAvail {
+			return nil
+		}
+		if availIdx-vq.lastAvail > vq.size {
+			return fmt.Errorf("available index of queue %d moved from %d to %d", vq.index, vq.lastAvail, availIdx)
+		}
+
+		for vq.lastAvail != availIdx {
+			head := binary.LittleEndian.Uint16(vq.avail[4+2*int(vq.lastAvail%vq.size):])
+			vq.lastAvail++
+
+			c, err := vq.chain(head)
+			if err != nil {
+				return err
+			}
+			vq.inFlight.Add(1)
+			go func() {
+				defer vq.inFlight.Done()
+				process(c)
+			}()
+		}
+	}
+}
+
+// chain walks the descriptors of a request, following an indirect table
+func (vq *virtqueue) chain(head uint16) (*chain, error) {
+	c := &chain{head: head}
+	table := vq.desc
+	tableSize := int(vq.size)
+	idx := int(head)
+	indirect := false
+
+	for count := 0; ; count++ {
+		if idx >= tableSize || count >= tableSize {
+			return nil, fmt.Errorf("invalid descriptor chain %d of queue %d", head, vq.index)
+		}
+		d := table[idx*descSize:]
+		addr := binary.LittleEndian.Uint64(d)
+		length := binary.LittleEndian.Uint32(d[8:])
+		flags := binary.LittleEndian.Uint16(d[12:])
+		next := binary.LittleEndian.Uint16(d[14:])
+
+		if flags&descFlagIndirect != 0 {
+			if indirect || flags&descFlagNext != 0 || length == 0 || length%descSize != 0 {
+				return nil, fmt.Errorf("invalid indirect descriptor in chain %d of queue %d", head, vq.index)
+			}
+			var err error
+			if table, err = vq.mem.guest(addr, uint64(length)); err != nil {
+				return nil, err
+			}
+			tableSize = int(length / descSize)
+			idx = 0
+			count = -1
+			indirect = true
+			continue
+		}
+
+		var err error
+		if flags&descFlagWrite != 0 {
+			c.writable, err = vq.mem.appendGuest(c.writable, addr, uint64(length))
+		} else {
+			if len(c.writable) > 0 {
+				return nil, fmt.Errorf("readable descriptor after writable one in chain %d of queue %d", head, vq.index)
+			}
+			c.readable, err = vq.mem.appendGuest(c.readable, addr, uint64(length))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if flags&descFlagNext == 0 {
+			return c, nil
+		}
+		idx = int(next)
+	}
+}
+
+// push returns a completed request to the driver and notifies it, unless it suppressed interrupts
+func (vq *virtqueue) push(head uint16, written uint32) error {
+	vq.usedMu.Lock()
+	defer vq.usedMu.Unlock()
+
+	elem := vq.used[4+8*int(vq.usedIdx%vq.size):]
+	binary.LittleEndian.PutUint32(elem, uint32(head))
+	binary.LittleEndian.PutUint32(elem[4:], written)
+	vq.usedIdx++
+	storeUsedIdx(vq.used, vq.usedIdx)
+
+	if vq.call == nil || load16(vq.avail, 0)&availFlagNoInterrupt != 0 {
+		return nil
+	}
+	_, err := vq.call.Write(u64Payload(1))
+	return err
+}
+
+// load16 atomically loads the little endian uint16 at b[off] through the aligned 32 bit word containing it (b[off] is 2 byte aligned)
+func load16(b []byte, off int) uint16 {
+	p := unsafe.Pointer(&b[off])
+	shift := 0
+	if uintptr(p)%4 != 0 {
+		p = unsafe.Add(p, -2)
+		shift = 2
+	}
+	var word [4]byte
+	binary.NativeEndian.PutUint32(word[:], atomic.LoadUint32((*uint32)(p)))
+	return binary.LittleEndian.Uint16(word[shift:])
+}
+
+// storeUsedIdx atomically stores the flags (always 0) and the index of a used ring (4 byte aligned)
+func storeUsedIdx(used []byte, idx uint16) {
+	var word [4]byte
+	binary.LittleEndian.PutUint16(word[2:], idx)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&used[0])), binary.NativeEndian.Uint32(word[:]))
+}